@@ -88,6 +88,10 @@ func (s *Server) Handler() http.Handler {
 
 	r.Get("/x/blacklist", handler.Wrap(s.getBlacklistHandler))
 
+	r.Get("/x/progress/{digest}", handler.Wrap(s.getProgressHandler))
+
+	r.Get("/x/snapshot/{digest}", handler.Wrap(s.getSnapshotHandler))
+
 	// Serves /debug/pprof endpoints.
 	r.Mount("/", http.DefaultServeMux)
 
@@ -149,7 +153,7 @@ func (s *Server) deleteBlobHandler(w http.ResponseWriter, r *http.Request) error
 	if err != nil {
 		return err
 	}
-	if err := s.sched.RemoveTorrent(d); err != nil {
+	if err := s.sched.InvalidateTorrent(d); err != nil {
 		return handler.Errorf("remove torrent: %s", err)
 	}
 	return nil
@@ -205,6 +209,46 @@ func (s *Server) getBlacklistHandler(w http.ResponseWriter, r *http.Request) err
 	return nil
 }
 
+// getProgressHandler returns the progress of the torrent being downloaded or
+// seeded for a blob.
+func (s *Server) getProgressHandler(w http.ResponseWriter, r *http.Request) error {
+	d, err := parseDigest(r)
+	if err != nil {
+		return err
+	}
+	progress, err := s.sched.TorrentProgress(d)
+	if err != nil {
+		if err == scheduler.ErrTorrentNotFound {
+			return handler.ErrorStatus(http.StatusNotFound)
+		}
+		return handler.Errorf("torrent progress: %s", err)
+	}
+	if err := json.NewEncoder(w).Encode(&progress); err != nil {
+		return handler.Errorf("json encode: %s", err)
+	}
+	return nil
+}
+
+// getSnapshotHandler returns a debug snapshot of the torrent being downloaded
+// or seeded for a blob, including the state of each of its peers.
+func (s *Server) getSnapshotHandler(w http.ResponseWriter, r *http.Request) error {
+	d, err := parseDigest(r)
+	if err != nil {
+		return err
+	}
+	snapshot, err := s.sched.TorrentSnapshot(d)
+	if err != nil {
+		if err == scheduler.ErrTorrentNotFound {
+			return handler.ErrorStatus(http.StatusNotFound)
+		}
+		return handler.Errorf("torrent snapshot: %s", err)
+	}
+	if err := json.NewEncoder(w).Encode(&snapshot); err != nil {
+		return handler.Errorf("json encode: %s", err)
+	}
+	return nil
+}
+
 func parseDigest(r *http.Request) (core.Digest, error) {
 	raw, err := httputil.ParseParam(r, "digest")
 	if err != nil {
@@ -30,6 +30,7 @@ import (
 	"github.com/uber/kraken/lib/store"
 	"github.com/uber/kraken/lib/torrent/scheduler"
 	"github.com/uber/kraken/lib/torrent/scheduler/connstate"
+	"github.com/uber/kraken/lib/torrent/scheduler/dispatch"
 	mocktagclient "github.com/uber/kraken/mocks/build-index/tagclient"
 	mockdockerdaemon "github.com/uber/kraken/mocks/lib/dockerdaemon"
 	mockscheduler "github.com/uber/kraken/mocks/lib/torrent/scheduler"
@@ -245,6 +246,92 @@ func TestGetBlacklistHandler(t *testing.T) {
 	require.Equal(blacklist, result)
 }
 
+func TestGetProgressHandler(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newServerMocks(t)
+	defer cleanup()
+
+	d := core.DigestFixture()
+	progress := dispatch.Progress{
+		PiecesCompleted: 1,
+		NumPieces:       2,
+		BytesCompleted:  4,
+		Length:          8,
+		BytesDownloaded: 4,
+		NumPeers:        1,
+	}
+	mocks.sched.EXPECT().TorrentProgress(d).Return(progress, nil)
+
+	addr := mocks.startServer()
+
+	resp, err := httputil.Get(fmt.Sprintf("http://%s/x/progress/%s", addr, d))
+	require.NoError(err)
+
+	var result dispatch.Progress
+	require.NoError(json.NewDecoder(resp.Body).Decode(&result))
+	require.Equal(progress, result)
+}
+
+func TestGetProgressHandlerNotFound(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newServerMocks(t)
+	defer cleanup()
+
+	d := core.DigestFixture()
+	mocks.sched.EXPECT().TorrentProgress(d).Return(dispatch.Progress{}, scheduler.ErrTorrentNotFound)
+
+	addr := mocks.startServer()
+
+	_, err := httputil.Get(fmt.Sprintf("http://%s/x/progress/%s", addr, d))
+	require.True(httputil.IsNotFound(err))
+}
+
+func TestGetSnapshotHandler(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newServerMocks(t)
+	defer cleanup()
+
+	d := core.DigestFixture()
+	snapshot := dispatch.Snapshot{
+		Name:        d.Hex(),
+		NumPieces:   2,
+		NumComplete: 1,
+		Peers: []dispatch.PeerSnapshot{{
+			PeerID:        core.PeerIDFixture().String(),
+			NumPieces:     2,
+			PendingPieces: []int{1},
+		}},
+	}
+	mocks.sched.EXPECT().TorrentSnapshot(d).Return(snapshot, nil)
+
+	addr := mocks.startServer()
+
+	resp, err := httputil.Get(fmt.Sprintf("http://%s/x/snapshot/%s", addr, d))
+	require.NoError(err)
+
+	var result dispatch.Snapshot
+	require.NoError(json.NewDecoder(resp.Body).Decode(&result))
+	require.Equal(snapshot, result)
+}
+
+func TestGetSnapshotHandlerNotFound(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newServerMocks(t)
+	defer cleanup()
+
+	d := core.DigestFixture()
+	mocks.sched.EXPECT().TorrentSnapshot(d).Return(dispatch.Snapshot{}, scheduler.ErrTorrentNotFound)
+
+	addr := mocks.startServer()
+
+	_, err := httputil.Get(fmt.Sprintf("http://%s/x/snapshot/%s", addr, d))
+	require.True(httputil.IsNotFound(err))
+}
+
 func TestDeleteBlobHandler(t *testing.T) {
 	require := require.New(t)
 
@@ -255,7 +342,7 @@ func TestDeleteBlobHandler(t *testing.T) {
 
 	addr := mocks.startServer()
 
-	mocks.sched.EXPECT().RemoveTorrent(d).Return(nil)
+	mocks.sched.EXPECT().InvalidateTorrent(d).Return(nil)
 
 	_, err := httputil.Delete(fmt.Sprintf("http://%s/blobs/%s", addr, d))
 	require.NoError(err)
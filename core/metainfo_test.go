@@ -36,6 +36,12 @@ func TestMetaInfoGetPieceLength(t *testing.T) {
 		{"middle piece", 10, 3, 1, 3},
 		{"outside bounds", 10, 3, 4, 0},
 		{"negative", 10, 3, -1, 0},
+		{"one byte last piece", 10, 3, 3, 1},
+		{"max size last piece", 9, 3, 2, 3},
+		{"single piece shorter than max", 2, 3, 0, 2},
+		{"single piece of max size", 3, 3, 0, 3},
+		{"single piece of one byte", 1, 3, 0, 1},
+		{"past single piece", 2, 3, 1, 0},
 	}
 	for _, test := range tests {
 		t.Run(test.desc, func(t *testing.T) {
@@ -22,6 +22,10 @@ type PeerInfo struct {
 	Port     int    `json:"port"`
 	Origin   bool   `json:"origin"`
 	Complete bool   `json:"complete"`
+
+	// Zone is the zone the peer is running within, if known. Used to prefer
+	// peers in the same zone.
+	Zone string `json:"zone,omitempty"`
 }
 
 // NewPeerInfo creates a new PeerInfo.
@@ -43,7 +47,9 @@ func NewPeerInfo(
 
 // PeerInfoFromContext derives PeerInfo from a PeerContext.
 func PeerInfoFromContext(pctx PeerContext, complete bool) *PeerInfo {
-	return NewPeerInfo(pctx.PeerID, pctx.IP, pctx.Port, pctx.Origin, complete)
+	p := NewPeerInfo(pctx.PeerID, pctx.IP, pctx.Port, pctx.Origin, complete)
+	p.Zone = pctx.Zone
+	return p
 }
 
 // PeerInfos groups PeerInfo structs for sorting.
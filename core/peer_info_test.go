@@ -30,3 +30,13 @@ func TestSortedByPeerID(t *testing.T) {
 	require.True(sorted[0].PeerID.LessThan(sorted[1].PeerID))
 	require.True(sorted[1].PeerID.LessThan(sorted[2].PeerID))
 }
+
+func TestPeerInfoFromContext(t *testing.T) {
+	require := require.New(t)
+
+	pctx := PeerContextFixture()
+	p := PeerInfoFromContext(pctx, true)
+	require.Equal(pctx.PeerID, p.PeerID)
+	require.Equal(pctx.Zone, p.Zone)
+	require.True(p.Complete)
+}
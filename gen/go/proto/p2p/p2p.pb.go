@@ -30,6 +30,8 @@ It has these top-level messages:
 	ErrorMessage
 	CompleteMessage
 	Message
+	AnnouncePiecesMessage
+	PieceRequestsMessage
 */
 package p2p
 
@@ -48,17 +50,72 @@ var _ = math.Inf
 // proto package needs to be updated.
 const _ = proto.ProtoPackageIsVersion2 // please upgrade the proto package
 
+type BitfieldMessage_Have int32
+
+const (
+	BitfieldMessage_BITFIELD BitfieldMessage_Have = 0
+	// The sender has all numPieces pieces. bitfieldBytes is empty.
+	BitfieldMessage_HAVE_ALL BitfieldMessage_Have = 1
+	// The sender has none of numPieces pieces. bitfieldBytes is empty.
+	BitfieldMessage_HAVE_NONE BitfieldMessage_Have = 2
+)
+
+var BitfieldMessage_Have_name = map[int32]string{
+	0: "BITFIELD",
+	1: "HAVE_ALL",
+	2: "HAVE_NONE",
+}
+var BitfieldMessage_Have_value = map[string]int32{
+	"BITFIELD":  0,
+	"HAVE_ALL":  1,
+	"HAVE_NONE": 2,
+}
+
+func (x BitfieldMessage_Have) String() string {
+	return proto.EnumName(BitfieldMessage_Have_name, int32(x))
+}
+func (BitfieldMessage_Have) EnumDescriptor() ([]byte, []int) { return fileDescriptor0, []int{0, 0} }
+
+type PiecePayloadMessage_Codec int32
+
+const (
+	PiecePayloadMessage_NONE   PiecePayloadMessage_Codec = 0
+	PiecePayloadMessage_SNAPPY PiecePayloadMessage_Codec = 1
+	PiecePayloadMessage_LZ4    PiecePayloadMessage_Codec = 2
+)
+
+var PiecePayloadMessage_Codec_name = map[int32]string{
+	0: "NONE",
+	1: "SNAPPY",
+	2: "LZ4",
+}
+var PiecePayloadMessage_Codec_value = map[string]int32{
+	"NONE":   0,
+	"SNAPPY": 1,
+	"LZ4":    2,
+}
+
+func (x PiecePayloadMessage_Codec) String() string {
+	return proto.EnumName(PiecePayloadMessage_Codec_name, int32(x))
+}
+func (PiecePayloadMessage_Codec) EnumDescriptor() ([]byte, []int) { return fileDescriptor0, []int{2, 0} }
+
 type ErrorMessage_ErrorCode int32
 
 const (
 	ErrorMessage_PIECE_REQUEST_FAILED ErrorMessage_ErrorCode = 0
+	// The piece request was rejected transiently, e.g. due to load, and may be
+	// retried later.
+	ErrorMessage_PIECE_REQUEST_RETRY ErrorMessage_ErrorCode = 1
 )
 
 var ErrorMessage_ErrorCode_name = map[int32]string{
 	0: "PIECE_REQUEST_FAILED",
+	1: "PIECE_REQUEST_RETRY",
 }
 var ErrorMessage_ErrorCode_value = map[string]int32{
 	"PIECE_REQUEST_FAILED": 0,
+	"PIECE_REQUEST_RETRY":  1,
 }
 
 func (x ErrorMessage_ErrorCode) String() string {
@@ -76,25 +133,50 @@ const (
 	Message_CANCEL_PIECE  Message_Type = 4
 	Message_ERROR         Message_Type = 5
 	Message_COMPLETE      Message_Type = 6
+	// Only sent to peers which listed the announce_pieces capability.
+	Message_ANNOUNCE_PIECES Message_Type = 7
+	// Notify the receiver that its piece requests are no longer served, or
+	// served again. Only sent to peers which listed the choke capability.
+	Message_CHOKE   Message_Type = 8
+	Message_UNCHOKE Message_Type = 9
+	// Probe whether the receiver is alive, which answers with KEEPALIVE_ACK.
+	// Only sent to peers which listed the keepalive capability.
+	Message_KEEPALIVE     Message_Type = 10
+	Message_KEEPALIVE_ACK Message_Type = 11
+	// Requests multiple pieces at once. Only sent to peers which listed the
+	// batch_requests capability.
+	Message_PIECE_REQUESTS Message_Type = 12
 )
 
 var Message_Type_name = map[int32]string{
-	0: "BITFIELD",
-	1: "PIECE_REQUEST",
-	2: "PIECE_PAYLOAD",
-	3: "ANNOUCE_PIECE",
-	4: "CANCEL_PIECE",
-	5: "ERROR",
-	6: "COMPLETE",
+	0:  "BITFIELD",
+	1:  "PIECE_REQUEST",
+	2:  "PIECE_PAYLOAD",
+	3:  "ANNOUCE_PIECE",
+	4:  "CANCEL_PIECE",
+	5:  "ERROR",
+	6:  "COMPLETE",
+	7:  "ANNOUNCE_PIECES",
+	8:  "CHOKE",
+	9:  "UNCHOKE",
+	10: "KEEPALIVE",
+	11: "KEEPALIVE_ACK",
+	12: "PIECE_REQUESTS",
 }
 var Message_Type_value = map[string]int32{
-	"BITFIELD":      0,
-	"PIECE_REQUEST": 1,
-	"PIECE_PAYLOAD": 2,
-	"ANNOUCE_PIECE": 3,
-	"CANCEL_PIECE":  4,
-	"ERROR":         5,
-	"COMPLETE":      6,
+	"BITFIELD":        0,
+	"PIECE_REQUEST":   1,
+	"PIECE_PAYLOAD":   2,
+	"ANNOUCE_PIECE":   3,
+	"CANCEL_PIECE":    4,
+	"ERROR":           5,
+	"COMPLETE":        6,
+	"ANNOUNCE_PIECES": 7,
+	"CHOKE":           8,
+	"UNCHOKE":         9,
+	"KEEPALIVE":       10,
+	"KEEPALIVE_ACK":   11,
+	"PIECE_REQUESTS":  12,
 }
 
 func (x Message_Type) String() string {
@@ -122,6 +204,13 @@ type BitfieldMessage struct {
 	// remoteBitfieldBytes contains the binary sets of pieces downloaded of
 	// all peers that the sender is currently connected to.
 	RemoteBitfieldBytes map[string][]byte `protobuf:"bytes,7,rep,name=remoteBitfieldBytes" json:"remoteBitfieldBytes,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value,proto3"`
+	// capabilities lists the optional protocol extensions the sender supports.
+	// Only extensions which both peers list are used on a connection.
+	Capabilities []string `protobuf:"bytes,8,rep,name=capabilities" json:"capabilities,omitempty"`
+	// have summarizes the sender's pieces instead of bitfieldBytes. Only sent to
+	// peers which listed the compact_bitfield capability.
+	Have      BitfieldMessage_Have `protobuf:"varint,9,opt,name=have,enum=p2p.BitfieldMessage_Have" json:"have,omitempty"`
+	NumPieces int32                `protobuf:"varint,10,opt,name=numPieces" json:"numPieces,omitempty"`
 }
 
 func (m *BitfieldMessage) Reset()                    { *m = BitfieldMessage{} }
@@ -136,12 +225,23 @@ func (m *BitfieldMessage) GetRemoteBitfieldBytes() map[string][]byte {
 	return nil
 }
 
-// Requests a piece of the given index. Note: offset and length are unused fields
-// and if set, will be rejected.
+func (m *BitfieldMessage) GetCapabilities() []string {
+	if m != nil {
+		return m.Capabilities
+	}
+	return nil
+}
+
+// Requests a piece of the given index. Offset and length may select a chunk of
+// the piece.
 type PieceRequestMessage struct {
 	Index  int32 `protobuf:"varint,2,opt,name=index" json:"index,omitempty"`
 	Offset int32 `protobuf:"varint,3,opt,name=offset" json:"offset,omitempty"`
 	Length int32 `protobuf:"varint,4,opt,name=length" json:"length,omitempty"`
+	// Whether the requester needs the piece urgently, e.g. to unblock a read,
+	// such that the sender may serve it ahead of other requests. Only set for
+	// peers which listed the priority_requests capability.
+	Priority bool `protobuf:"varint,5,opt,name=priority" json:"priority,omitempty"`
 }
 
 func (m *PieceRequestMessage) Reset()                    { *m = PieceRequestMessage{} }
@@ -157,6 +257,12 @@ type PiecePayloadMessage struct {
 	Offset int32  `protobuf:"varint,3,opt,name=offset" json:"offset,omitempty"`
 	Length int32  `protobuf:"varint,4,opt,name=length" json:"length,omitempty"`
 	Digest string `protobuf:"bytes,5,opt,name=digest" json:"digest,omitempty"`
+	// codec compresses the blob following the message, if not NONE. Only used
+	// with codecs which the receiver listed in its capabilities. length remains
+	// the uncompressed length of the blob, and wireLength is the number of
+	// compressed bytes which follow the message.
+	Codec      PiecePayloadMessage_Codec `protobuf:"varint,6,opt,name=codec,enum=p2p.PiecePayloadMessage_Codec" json:"codec,omitempty"`
+	WireLength int32                     `protobuf:"varint,7,opt,name=wireLength" json:"wireLength,omitempty"`
 }
 
 func (m *PiecePayloadMessage) Reset()                    { *m = PiecePayloadMessage{} }
@@ -190,6 +296,10 @@ type ErrorMessage struct {
 	Error string                 `protobuf:"bytes,2,opt,name=error" json:"error,omitempty"`
 	Index int32                  `protobuf:"varint,3,opt,name=index" json:"index,omitempty"`
 	Code  ErrorMessage_ErrorCode `protobuf:"varint,4,opt,name=code,enum=p2p.ErrorMessage_ErrorCode" json:"code,omitempty"`
+	// How long the requester should wait before requesting the piece from us
+	// again, if known. Only set for PIECE_REQUEST_RETRY errors sent to peers
+	// which listed the retry_after capability.
+	RetryAfterMillis int32 `protobuf:"varint,5,opt,name=retryAfterMillis" json:"retryAfterMillis,omitempty"`
 }
 
 func (m *ErrorMessage) Reset()                    { *m = ErrorMessage{} }
@@ -207,15 +317,17 @@ func (*CompleteMessage) ProtoMessage()               {}
 func (*CompleteMessage) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{6} }
 
 type Message struct {
-	Version       string                `protobuf:"bytes,1,opt,name=version" json:"version,omitempty"`
-	Type          Message_Type          `protobuf:"varint,2,opt,name=type,enum=p2p.Message_Type" json:"type,omitempty"`
-	Bitfield      *BitfieldMessage      `protobuf:"bytes,3,opt,name=bitfield" json:"bitfield,omitempty"`
-	PieceRequest  *PieceRequestMessage  `protobuf:"bytes,4,opt,name=pieceRequest" json:"pieceRequest,omitempty"`
-	PiecePayload  *PiecePayloadMessage  `protobuf:"bytes,5,opt,name=piecePayload" json:"piecePayload,omitempty"`
-	AnnouncePiece *AnnouncePieceMessage `protobuf:"bytes,6,opt,name=announcePiece" json:"announcePiece,omitempty"`
-	CancelPiece   *CancelPieceMessage   `protobuf:"bytes,7,opt,name=cancelPiece" json:"cancelPiece,omitempty"`
-	Error         *ErrorMessage         `protobuf:"bytes,8,opt,name=error" json:"error,omitempty"`
-	Complete      *CompleteMessage      `protobuf:"bytes,9,opt,name=complete" json:"complete,omitempty"`
+	Version        string                 `protobuf:"bytes,1,opt,name=version" json:"version,omitempty"`
+	Type           Message_Type           `protobuf:"varint,2,opt,name=type,enum=p2p.Message_Type" json:"type,omitempty"`
+	Bitfield       *BitfieldMessage       `protobuf:"bytes,3,opt,name=bitfield" json:"bitfield,omitempty"`
+	PieceRequest   *PieceRequestMessage   `protobuf:"bytes,4,opt,name=pieceRequest" json:"pieceRequest,omitempty"`
+	PiecePayload   *PiecePayloadMessage   `protobuf:"bytes,5,opt,name=piecePayload" json:"piecePayload,omitempty"`
+	AnnouncePiece  *AnnouncePieceMessage  `protobuf:"bytes,6,opt,name=announcePiece" json:"announcePiece,omitempty"`
+	CancelPiece    *CancelPieceMessage    `protobuf:"bytes,7,opt,name=cancelPiece" json:"cancelPiece,omitempty"`
+	Error          *ErrorMessage          `protobuf:"bytes,8,opt,name=error" json:"error,omitempty"`
+	Complete       *CompleteMessage       `protobuf:"bytes,9,opt,name=complete" json:"complete,omitempty"`
+	AnnouncePieces *AnnouncePiecesMessage `protobuf:"bytes,10,opt,name=announcePieces" json:"announcePieces,omitempty"`
+	PieceRequests  *PieceRequestsMessage  `protobuf:"bytes,11,opt,name=pieceRequests" json:"pieceRequests,omitempty"`
 }
 
 func (m *Message) Reset()                    { *m = Message{} }
@@ -272,6 +384,48 @@ func (m *Message) GetComplete() *CompleteMessage {
 	return nil
 }
 
+func (m *Message) GetAnnouncePieces() *AnnouncePiecesMessage {
+	if m != nil {
+		return m.AnnouncePieces
+	}
+	return nil
+}
+
+func (m *Message) GetPieceRequests() *PieceRequestsMessage {
+	if m != nil {
+		return m.PieceRequests
+	}
+	return nil
+}
+
+// Announces that multiple pieces are available to other peers at once.
+type AnnouncePiecesMessage struct {
+	BitfieldBytes []byte `protobuf:"bytes,2,opt,name=bitfieldBytes,proto3" json:"bitfieldBytes,omitempty"`
+}
+
+func (m *AnnouncePiecesMessage) Reset()                    { *m = AnnouncePiecesMessage{} }
+func (m *AnnouncePiecesMessage) String() string            { return proto.CompactTextString(m) }
+func (*AnnouncePiecesMessage) ProtoMessage()               {}
+func (*AnnouncePiecesMessage) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{8} }
+
+// Requests multiple pieces at once. Each request is handled as if it was sent in
+// its own PIECE_REQUEST message, so a failed request only fails its piece.
+type PieceRequestsMessage struct {
+	Requests []*PieceRequestMessage `protobuf:"bytes,2,rep,name=requests" json:"requests,omitempty"`
+}
+
+func (m *PieceRequestsMessage) Reset()                    { *m = PieceRequestsMessage{} }
+func (m *PieceRequestsMessage) String() string            { return proto.CompactTextString(m) }
+func (*PieceRequestsMessage) ProtoMessage()               {}
+func (*PieceRequestsMessage) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{9} }
+
+func (m *PieceRequestsMessage) GetRequests() []*PieceRequestMessage {
+	if m != nil {
+		return m.Requests
+	}
+	return nil
+}
+
 func init() {
 	proto.RegisterType((*BitfieldMessage)(nil), "p2p.BitfieldMessage")
 	proto.RegisterType((*PieceRequestMessage)(nil), "p2p.PieceRequestMessage")
@@ -281,6 +435,10 @@ func init() {
 	proto.RegisterType((*ErrorMessage)(nil), "p2p.ErrorMessage")
 	proto.RegisterType((*CompleteMessage)(nil), "p2p.CompleteMessage")
 	proto.RegisterType((*Message)(nil), "p2p.Message")
+	proto.RegisterType((*AnnouncePiecesMessage)(nil), "p2p.AnnouncePiecesMessage")
+	proto.RegisterType((*PieceRequestsMessage)(nil), "p2p.PieceRequestsMessage")
+	proto.RegisterEnum("p2p.BitfieldMessage_Have", BitfieldMessage_Have_name, BitfieldMessage_Have_value)
+	proto.RegisterEnum("p2p.PiecePayloadMessage_Codec", PiecePayloadMessage_Codec_name, PiecePayloadMessage_Codec_value)
 	proto.RegisterEnum("p2p.ErrorMessage_ErrorCode", ErrorMessage_ErrorCode_name, ErrorMessage_ErrorCode_value)
 	proto.RegisterEnum("p2p.Message_Type", Message_Type_name, Message_Type_value)
 }
@@ -288,46 +446,65 @@ func init() {
 func init() { proto.RegisterFile("proto/p2p/p2p.proto", fileDescriptor0) }
 
 var fileDescriptor0 = []byte{
-	// 647 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0xac, 0x54, 0x4f, 0x6f, 0xd3, 0x4e,
-	0x10, 0x6d, 0x12, 0x3b, 0x7f, 0x26, 0x69, 0xeb, 0x6c, 0xa3, 0xdf, 0xcf, 0x14, 0x0e, 0x95, 0x45,
-	0x45, 0x85, 0xa0, 0xad, 0xcc, 0x05, 0x10, 0x12, 0x4a, 0x1c, 0x57, 0x44, 0x4a, 0x9b, 0xb0, 0xa4,
-	0x07, 0xc4, 0xa1, 0x72, 0x9d, 0x49, 0x6b, 0x91, 0x7a, 0x8d, 0xed, 0x56, 0xcd, 0xd7, 0xe0, 0x43,
-	0x21, 0xf1, 0xad, 0xd0, 0x4e, 0xec, 0xc4, 0x6e, 0x02, 0xe2, 0xc0, 0x21, 0x92, 0xdf, 0xf3, 0x7b,
-	0xb3, 0xb3, 0x33, 0x2f, 0x86, 0x9d, 0x20, 0x14, 0xb1, 0x38, 0x0a, 0xcc, 0x40, 0xfe, 0x0e, 0x09,
-	0xb1, 0x52, 0x60, 0x06, 0xc6, 0x8f, 0x22, 0x6c, 0x77, 0xbc, 0x78, 0xe2, 0xe1, 0x74, 0x7c, 0x8a,
-	0x51, 0xe4, 0x5c, 0x21, 0xdb, 0x85, 0xaa, 0xe7, 0x4f, 0xc4, 0x07, 0x27, 0xba, 0xd6, 0x8b, 0x7b,
-	0x85, 0x83, 0x1a, 0x5f, 0x60, 0xc6, 0x40, 0xf1, 0x9d, 0x1b, 0xd4, 0x4b, 0xc4, 0xd3, 0x33, 0xfb,
-	0x0f, 0xca, 0x01, 0x62, 0xd8, 0xeb, 0xea, 0x0a, 0xb1, 0x09, 0x62, 0x4f, 0x61, 0xf3, 0x32, 0x29,
-	0xdd, 0x99, 0xc5, 0x18, 0xe9, 0xea, 0x5e, 0xe1, 0xa0, 0xc1, 0xf3, 0x24, 0x7b, 0x02, 0x35, 0x59,
-	0x25, 0x0a, 0x1c, 0x17, 0xf5, 0x32, 0x15, 0x58, 0x12, 0xec, 0x02, 0x76, 0x42, 0xbc, 0x11, 0x31,
-	0x76, 0x72, 0x95, 0x2a, 0x7b, 0xa5, 0x83, 0xba, 0xf9, 0xf2, 0x50, 0xde, 0xe6, 0x41, 0xfb, 0x87,
-	0x7c, 0x55, 0x6f, 0xfb, 0x71, 0x38, 0xe3, 0xeb, 0x2a, 0xed, 0x9e, 0x80, 0xfe, 0x3b, 0x03, 0xd3,
-	0xa0, 0xf4, 0x15, 0x67, 0x7a, 0x81, 0x9a, 0x92, 0x8f, 0xac, 0x05, 0xea, 0x9d, 0x33, 0xbd, 0x45,
-	0x9a, 0x4b, 0x83, 0xcf, 0xc1, 0xdb, 0xe2, 0xeb, 0x82, 0xf1, 0x05, 0x76, 0x86, 0x1e, 0xba, 0xc8,
-	0xf1, 0xdb, 0x2d, 0x46, 0x71, 0x3a, 0xcb, 0x16, 0xa8, 0x9e, 0x3f, 0xc6, 0x7b, 0x32, 0xa8, 0x7c,
-	0x0e, 0xe4, 0xc4, 0xc4, 0x64, 0x12, 0x61, 0x4c, 0x73, 0x54, 0x79, 0x82, 0x24, 0x3f, 0x45, 0xff,
-	0x2a, 0xbe, 0xa6, 0x49, 0xaa, 0x3c, 0x41, 0x46, 0x94, 0x14, 0x1f, 0x3a, 0xb3, 0xa9, 0x70, 0xc6,
-	0xff, 0xb4, 0xb8, 0xe4, 0xc7, 0xde, 0x15, 0x46, 0x31, 0xed, 0xa7, 0xc6, 0x13, 0x64, 0xbc, 0x80,
-	0x56, 0xdb, 0xf7, 0xc5, 0xad, 0xef, 0x22, 0x1d, 0xfe, 0xc7, 0x53, 0x8d, 0xe7, 0xc0, 0x2c, 0xc7,
-	0x77, 0x71, 0xfa, 0x17, 0xda, 0xef, 0x05, 0x68, 0xd8, 0x61, 0x28, 0xc2, 0x8c, 0x0c, 0x25, 0x4e,
-	0xe2, 0x36, 0x07, 0x4b, 0x73, 0x29, 0x7b, 0xbd, 0x23, 0x50, 0x5c, 0x31, 0x46, 0xba, 0xc4, 0x96,
-	0xf9, 0x98, 0x22, 0x90, 0x2d, 0x36, 0x07, 0x96, 0x18, 0x23, 0x27, 0xa1, 0xb1, 0x0f, 0xb5, 0x05,
-	0xc5, 0x74, 0x68, 0x0d, 0x7b, 0xb6, 0x65, 0x5f, 0x70, 0xfb, 0xe3, 0xb9, 0xfd, 0x69, 0x74, 0x71,
-	0xd2, 0xee, 0xf5, 0xed, 0xae, 0xb6, 0x61, 0x34, 0x61, 0xdb, 0x12, 0x37, 0xc1, 0x14, 0xe3, 0xb4,
-	0x7b, 0xe3, 0xa7, 0x02, 0x95, 0xb4, 0x45, 0x1d, 0x2a, 0x77, 0x18, 0x46, 0x9e, 0xf0, 0x93, 0x3c,
-	0xa4, 0x90, 0xed, 0x83, 0x12, 0xcf, 0x82, 0x79, 0x24, 0xb6, 0xcc, 0x26, 0x35, 0x94, 0xf6, 0x32,
-	0x9a, 0x05, 0xc8, 0xe9, 0x35, 0x3b, 0x86, 0x6a, 0x1a, 0x7c, 0xba, 0x50, 0xdd, 0x6c, 0xad, 0x8b,
-	0x2f, 0x5f, 0xa8, 0xd8, 0x3b, 0x68, 0x04, 0x99, 0x48, 0xd1, 0x8d, 0xeb, 0xa6, 0x4e, 0xae, 0x35,
-	0x59, 0xe3, 0x39, 0xf5, 0xc2, 0x9d, 0x64, 0x86, 0x96, 0x9b, 0x73, 0xe7, 0xc3, 0xc4, 0x73, 0x6a,
-	0xf6, 0x1e, 0x36, 0x9d, 0xec, 0xf2, 0xe9, 0x9f, 0x59, 0x37, 0x1f, 0x91, 0x7d, 0x5d, 0x2c, 0x78,
-	0x5e, 0xcf, 0xde, 0x40, 0xdd, 0x5d, 0xe6, 0x41, 0xaf, 0x90, 0xfd, 0x7f, 0xb2, 0xaf, 0xe6, 0x84,
-	0x67, 0xb5, 0xec, 0x59, 0x9a, 0x86, 0x2a, 0x99, 0x9a, 0x2b, 0x2b, 0x4e, 0x03, 0x72, 0x0c, 0x55,
-	0x37, 0x59, 0x99, 0x5e, 0xcb, 0x8c, 0xf4, 0xc1, 0x1e, 0xf9, 0x42, 0x65, 0xdc, 0x83, 0x22, 0x57,
-	0xc2, 0x1a, 0x50, 0xed, 0xf4, 0x46, 0x27, 0x3d, 0xbb, 0xdf, 0xd5, 0x36, 0x58, 0x13, 0x36, 0x73,
-	0xa1, 0xd0, 0x0a, 0x4b, 0x6a, 0xd8, 0xfe, 0xdc, 0x1f, 0xb4, 0xbb, 0x5a, 0x51, 0x52, 0xed, 0xb3,
-	0xb3, 0xc1, 0xb9, 0x24, 0xe5, 0x2b, 0xad, 0xc4, 0x34, 0x68, 0x58, 0xed, 0x33, 0xcb, 0xee, 0x27,
-	0x8c, 0xc2, 0x6a, 0xa0, 0xda, 0x9c, 0x0f, 0xb8, 0xa6, 0xca, 0x33, 0xac, 0xc1, 0xe9, 0xb0, 0x6f,
-	0x8f, 0x6c, 0xad, 0x7c, 0x59, 0xa6, 0x8f, 0xee, 0xab, 0x5f, 0x01, 0x00, 0x00, 0xff, 0xff, 0xfd,
-	0x11, 0xd8, 0xe6, 0x8b, 0x05, 0x00, 0x00,
+	// 959 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xac, 0x56, 0xdf, 0x6e, 0xe2, 0xc6,
+	0x17, 0x5e, 0x63, 0x0c, 0xf6, 0x31, 0x21, 0x93, 0x09, 0xbf, 0x5d, 0xff, 0xd2, 0x6a, 0x85, 0xac,
+	0xfe, 0x41, 0xab, 0x6e, 0x76, 0xeb, 0xe6, 0xa2, 0xad, 0xfa, 0x47, 0x86, 0x4c, 0x14, 0x14, 0x07,
+	0xe8, 0x84, 0xac, 0x94, 0xde, 0x20, 0x07, 0x86, 0xc4, 0x2a, 0xb1, 0x5d, 0xdb, 0xc9, 0x96, 0xd7,
+	0xea, 0xcb, 0xf4, 0xa2, 0x6f, 0xd0, 0xbb, 0xbe, 0x41, 0x35, 0x63, 0x1b, 0x6c, 0xa0, 0x55, 0x2f,
+	0x7a, 0x81, 0xe4, 0xef, 0xf8, 0x3b, 0x73, 0xe6, 0x7c, 0xe7, 0x9b, 0x31, 0x70, 0x18, 0x46, 0x41,
+	0x12, 0xbc, 0x09, 0xad, 0x90, 0xff, 0x8e, 0x05, 0xc2, 0x72, 0x68, 0x85, 0xe6, 0x1f, 0x32, 0xec,
+	0x77, 0xbd, 0x64, 0xee, 0xb1, 0xc5, 0xec, 0x92, 0xc5, 0xb1, 0x7b, 0xc7, 0xf0, 0x11, 0xa8, 0x9e,
+	0x3f, 0x0f, 0xce, 0xdd, 0xf8, 0xde, 0xa8, 0xb4, 0xa5, 0x8e, 0x46, 0x57, 0x18, 0x63, 0xa8, 0xfa,
+	0xee, 0x03, 0x33, 0x64, 0x11, 0x17, 0xcf, 0xf8, 0x39, 0xd4, 0x42, 0xc6, 0xa2, 0xfe, 0xa9, 0x51,
+	0x15, 0xd1, 0x0c, 0xe1, 0x8f, 0x60, 0xef, 0x36, 0x5b, 0xba, 0xbb, 0x4c, 0x58, 0x6c, 0x28, 0x6d,
+	0xa9, 0xd3, 0xa0, 0xe5, 0x20, 0xfe, 0x10, 0x34, 0xbe, 0x4a, 0x1c, 0xba, 0x53, 0x66, 0xd4, 0xc4,
+	0x02, 0xeb, 0x00, 0x9e, 0xc0, 0x61, 0xc4, 0x1e, 0x82, 0x84, 0x75, 0x4b, 0x2b, 0xd5, 0xdb, 0x72,
+	0x47, 0xb7, 0x5e, 0x1f, 0xf3, 0x6e, 0x36, 0xb6, 0x7f, 0x4c, 0xb7, 0xf9, 0xc4, 0x4f, 0xa2, 0x25,
+	0xdd, 0xb5, 0x12, 0x36, 0xa1, 0x31, 0x75, 0x43, 0xf7, 0xd6, 0x5b, 0x78, 0x89, 0xc7, 0x62, 0x43,
+	0x6d, 0xcb, 0x1d, 0x8d, 0x96, 0x62, 0xf8, 0x35, 0x54, 0xef, 0xdd, 0x27, 0x66, 0x68, 0x6d, 0xa9,
+	0xd3, 0xb4, 0xfe, 0xbf, 0xb3, 0xea, 0xb9, 0xfb, 0xc4, 0xa8, 0xa0, 0x89, 0x8e, 0x1e, 0x1f, 0x46,
+	0x1e, 0x9b, 0xb2, 0xd8, 0x80, 0xb6, 0xd4, 0x51, 0xe8, 0x3a, 0x70, 0x74, 0x06, 0xc6, 0xdf, 0xed,
+	0x10, 0x23, 0x90, 0x7f, 0x62, 0x4b, 0x43, 0x12, 0x2a, 0xf0, 0x47, 0xdc, 0x02, 0xe5, 0xc9, 0x5d,
+	0x3c, 0x32, 0x31, 0x88, 0x06, 0x4d, 0xc1, 0xd7, 0x95, 0x2f, 0x25, 0xf3, 0x73, 0xa8, 0xf2, 0x9a,
+	0xb8, 0x01, 0x6a, 0xb7, 0x3f, 0x3e, 0xeb, 0x13, 0xe7, 0x14, 0x3d, 0xe3, 0xe8, 0xdc, 0x7e, 0x47,
+	0x26, 0xb6, 0xe3, 0x20, 0x09, 0xef, 0x81, 0x26, 0xd0, 0x60, 0x38, 0x20, 0xa8, 0x62, 0xbe, 0x87,
+	0x43, 0xb1, 0x09, 0xca, 0x7e, 0x7e, 0x64, 0x71, 0x92, 0xcf, 0xbb, 0x05, 0x8a, 0xe7, 0xcf, 0xd8,
+	0x2f, 0xa2, 0x86, 0x42, 0x53, 0xc0, 0xa7, 0x1a, 0xcc, 0xe7, 0x31, 0x4b, 0xc4, 0xac, 0x15, 0x9a,
+	0x21, 0x1e, 0x5f, 0x30, 0xff, 0x2e, 0xb9, 0x17, 0xd3, 0x56, 0x68, 0x86, 0xb8, 0x6b, 0xc2, 0xc8,
+	0x0b, 0x22, 0x2f, 0x59, 0x8a, 0x41, 0xab, 0x74, 0x85, 0xcd, 0x3f, 0xa5, 0xac, 0xf2, 0xc8, 0x5d,
+	0x2e, 0x02, 0x77, 0xf6, 0xdf, 0x56, 0x7e, 0x0e, 0xb5, 0x99, 0x77, 0xc7, 0xe2, 0x44, 0xd4, 0xd5,
+	0x68, 0x86, 0xf0, 0x09, 0x28, 0xd3, 0x60, 0xc6, 0xa6, 0xc2, 0x55, 0x4d, 0xeb, 0xa5, 0x98, 0xdb,
+	0x8e, 0x6d, 0x1c, 0xf7, 0x38, 0x8b, 0xa6, 0x64, 0xfc, 0x12, 0xe0, 0xbd, 0x17, 0x31, 0x27, 0xad,
+	0x54, 0x17, 0x95, 0x0a, 0x11, 0xf3, 0x13, 0x50, 0x04, 0x1f, 0xab, 0x50, 0x15, 0xba, 0x3e, 0xc3,
+	0x00, 0xb5, 0xab, 0x81, 0x3d, 0x1a, 0xdd, 0x20, 0x09, 0xd7, 0x41, 0x76, 0x7e, 0x3c, 0x41, 0x15,
+	0xf3, 0x33, 0x68, 0xd9, 0xbe, 0x1f, 0x3c, 0xfa, 0x53, 0x26, 0x6a, 0xfe, 0x63, 0xcf, 0xe6, 0x2b,
+	0xc0, 0x3d, 0xd7, 0x9f, 0xb2, 0xc5, 0xbf, 0xe0, 0xfe, 0x26, 0x41, 0x83, 0x44, 0x51, 0x10, 0x15,
+	0x68, 0x8c, 0xe3, 0xec, 0xb4, 0xa6, 0x60, 0x9d, 0x2c, 0x17, 0xc5, 0x7d, 0x03, 0x55, 0xde, 0xa7,
+	0x90, 0xb0, 0x69, 0x7d, 0x20, 0x34, 0x29, 0x2e, 0x96, 0x02, 0xde, 0x21, 0x15, 0x44, 0xfc, 0x0a,
+	0x50, 0xc4, 0x92, 0x68, 0x69, 0xcf, 0x13, 0x16, 0x5d, 0x7a, 0x8b, 0x85, 0x97, 0x1e, 0x64, 0x85,
+	0x6e, 0xc5, 0xcd, 0xef, 0x40, 0x5b, 0xa5, 0x63, 0x03, 0x5a, 0xa3, 0x3e, 0xe9, 0x91, 0x09, 0x25,
+	0x3f, 0x5c, 0x93, 0xab, 0xf1, 0xe4, 0xcc, 0xee, 0x3b, 0x84, 0x9b, 0xf4, 0x05, 0x1c, 0x96, 0xdf,
+	0x50, 0x32, 0xa6, 0x37, 0x48, 0x32, 0x0f, 0x60, 0xbf, 0x17, 0x3c, 0x84, 0x0b, 0x96, 0xe4, 0x12,
+	0x98, 0xbf, 0xd6, 0xa0, 0x9e, 0xf7, 0x69, 0x40, 0xfd, 0x89, 0x45, 0xb1, 0x17, 0xf8, 0xd9, 0x11,
+	0xc9, 0x21, 0xfe, 0x18, 0xaa, 0xc9, 0x32, 0x4c, 0x4f, 0x49, 0xd3, 0x3a, 0x10, 0x5d, 0xe5, 0x0d,
+	0x8d, 0x97, 0x21, 0xa3, 0xe2, 0x35, 0x7e, 0x0b, 0x6a, 0x7e, 0xf9, 0x08, 0x55, 0x74, 0xab, 0xb5,
+	0xeb, 0x30, 0xd3, 0x15, 0x0b, 0x7f, 0x03, 0x8d, 0xb0, 0x70, 0x64, 0x84, 0x6c, 0xba, 0x65, 0xac,
+	0xad, 0x54, 0x3e, 0x4b, 0xb4, 0xc4, 0x5e, 0x65, 0x67, 0x7e, 0x33, 0x94, 0xcd, 0xec, 0xb2, 0x11,
+	0x69, 0x89, 0x8d, 0xbf, 0x87, 0x3d, 0xb7, 0xe8, 0x20, 0xe1, 0x63, 0x3d, 0xbb, 0x7f, 0x76, 0x79,
+	0x8b, 0x96, 0xf9, 0xf8, 0x2b, 0xd0, 0xa7, 0x6b, 0x53, 0x09, 0x2f, 0xeb, 0xd6, 0x0b, 0x91, 0xbe,
+	0x6d, 0x36, 0x5a, 0xe4, 0xe2, 0x4f, 0x73, 0x4b, 0xa9, 0x22, 0xe9, 0x60, 0xcb, 0x27, 0xb9, 0xcb,
+	0xde, 0x82, 0x3a, 0xcd, 0x46, 0x66, 0x68, 0x05, 0x49, 0x37, 0xe6, 0x48, 0x57, 0x2c, 0xdc, 0x85,
+	0x66, 0x69, 0x9b, 0xe9, 0x1d, 0xa9, 0x5b, 0x47, 0xdb, 0x7d, 0xc5, 0x79, 0xf6, 0x46, 0x06, 0x97,
+	0xa6, 0x28, 0x74, 0x6c, 0xe8, 0x05, 0x69, 0x8a, 0x73, 0x59, 0xad, 0x50, 0xe6, 0x9b, 0xbf, 0x4b,
+	0x50, 0xe5, 0xc6, 0xd8, 0xb8, 0x3e, 0x0f, 0x60, 0xaf, 0xe4, 0x4c, 0x24, 0xad, 0x43, 0x23, 0xfb,
+	0xc6, 0x19, 0xda, 0xa7, 0xa8, 0xc2, 0x43, 0xf6, 0x60, 0x30, 0xbc, 0xe6, 0x41, 0xfe, 0x0a, 0xc9,
+	0x18, 0x41, 0xa3, 0x67, 0x0f, 0x7a, 0xc4, 0xc9, 0x22, 0x55, 0xac, 0x81, 0x42, 0x28, 0x1d, 0x52,
+	0xa4, 0xf0, 0x1a, 0xbd, 0xe1, 0xe5, 0xc8, 0x21, 0x63, 0x82, 0x6a, 0xf8, 0x10, 0xf6, 0x45, 0xf6,
+	0x20, 0x4f, 0xbf, 0x42, 0x75, 0xce, 0xee, 0x9d, 0x0f, 0x2f, 0x08, 0x52, 0xb1, 0x0e, 0xf5, 0xeb,
+	0x41, 0x0a, 0x34, 0x7e, 0x83, 0x5f, 0x10, 0x32, 0xb2, 0x9d, 0xfe, 0x3b, 0x82, 0x80, 0x57, 0x5e,
+	0xc1, 0x89, 0xdd, 0xbb, 0x40, 0x3a, 0xc6, 0xd0, 0x2c, 0x6d, 0xf9, 0x0a, 0x35, 0xcc, 0x6f, 0xe1,
+	0x7f, 0x3b, 0x75, 0xdc, 0xfe, 0x24, 0x57, 0x76, 0x7c, 0x92, 0x4d, 0x07, 0x5a, 0xbb, 0x34, 0xc4,
+	0x27, 0xa0, 0x46, 0xb9, 0xe0, 0x95, 0xb6, 0x5c, 0xb6, 0xf2, 0xc6, 0x41, 0x58, 0x31, 0x6f, 0x6b,
+	0xe2, 0xef, 0xc6, 0x17, 0x7f, 0x0d, 0x00, 0xe3, 0xd2, 0xc1, 0xd0, 0x85, 0x08, 0x00, 0x00,
 }
@@ -28,14 +28,19 @@ type Name string
 
 // Possible event names.
 const (
-	AddTorrent       Name = "add_torrent"
-	AddActiveConn    Name = "add_active_conn"
-	DropActiveConn   Name = "drop_active_conn"
-	BlacklistConn    Name = "blacklist_conn"
-	RequestPiece     Name = "request_piece"
-	ReceivePiece     Name = "receive_piece"
-	TorrentComplete  Name = "torrent_complete"
-	TorrentCancelled Name = "torrent_cancelled"
+	AddTorrent            Name = "add_torrent"
+	AddActiveConn         Name = "add_active_conn"
+	DropActiveConn        Name = "drop_active_conn"
+	BlacklistConn         Name = "blacklist_conn"
+	RequestPiece          Name = "request_piece"
+	RequestExpired        Name = "request_expired"
+	RequestInvalid        Name = "request_invalid"
+	ReceivePiece          Name = "receive_piece"
+	ReceiveDuplicatePiece Name = "receive_duplicate_piece"
+	TorrentComplete       Name = "torrent_complete"
+	TorrentCancelled      Name = "torrent_cancelled"
+	TorrentTeardown       Name = "torrent_teardown"
+	BanPeer               Name = "ban_peer"
 )
 
 // Event consolidates all possible event fields.
@@ -48,9 +53,18 @@ type Event struct {
 	// Optional fields.
 	Peer         string `json:"peer,omitempty"`
 	Piece        int    `json:"piece,omitempty"`
+	Attempt      int    `json:"attempt,omitempty"`
 	Bitfield     []bool `json:"bitfield,omitempty"`
 	DurationMS   int64  `json:"duration_ms,omitempty"`
 	ConnCapacity int    `json:"conn_capacity,omitempty"`
+	Reason       string `json:"reason,omitempty"`
+
+	// PhasesMS breaks the lifetime of a torrent down into named phases, in
+	// milliseconds.
+	PhasesMS map[string]int64 `json:"phases_ms,omitempty"`
+
+	// EndgameCause classifies why a torrent entered endgame, e.g. "slow_tail".
+	EndgameCause string `json:"endgame_cause,omitempty"`
 }
 
 func baseEvent(name Name, h core.InfoHash, self core.PeerID) *Event {
@@ -62,6 +76,26 @@ func baseEvent(name Name, h core.InfoHash, self core.PeerID) *Event {
 	}
 }
 
+// At sets the timestamp of e to t, such that producers with their own clock
+// timestamp events consistently. Returns e for chaining purposes.
+func (e *Event) At(t time.Time) *Event {
+	e.Time = t
+	return e
+}
+
+// WithPhases sets the phases of e, in milliseconds. Returns e for chaining
+// purposes.
+func (e *Event) WithPhases(ms map[string]int64) *Event {
+	e.PhasesMS = ms
+	return e
+}
+
+// WithEndgameCause sets the endgame cause of e. Returns e for chaining purposes.
+func (e *Event) WithEndgameCause(cause string) *Event {
+	e.EndgameCause = cause
+	return e
+}
+
 // JSON converts event into a json string primarely for logging purposes
 func (e *Event) JSON() string {
 	b, err := json.Marshal(e)
@@ -106,11 +140,39 @@ func BlacklistConnEvent(h core.InfoHash, self core.PeerID, peer core.PeerID, dur
 	return e
 }
 
-// RequestPieceEvent returns an event for a piece request sent to a peer.
-func RequestPieceEvent(h core.InfoHash, self core.PeerID, peer core.PeerID, piece int) *Event {
+// RequestPieceEvent returns an event for a piece request sent to a peer, where
+// attempt counts the requests of piece, starting at 1.
+func RequestPieceEvent(
+	h core.InfoHash, self core.PeerID, peer core.PeerID, piece int, attempt int) *Event {
+
 	e := baseEvent(RequestPiece, h, self)
 	e.Peer = peer.String()
 	e.Piece = piece
+	e.Attempt = attempt
+	return e
+}
+
+// RequestExpiredEvent returns an event for a piece request to a peer which
+// timed out.
+func RequestExpiredEvent(
+	h core.InfoHash, self core.PeerID, peer core.PeerID, piece int, attempt int) *Event {
+
+	e := baseEvent(RequestExpired, h, self)
+	e.Peer = peer.String()
+	e.Piece = piece
+	e.Attempt = attempt
+	return e
+}
+
+// RequestInvalidEvent returns an event for a piece request to a peer which
+// failed, or was answered with an invalid piece.
+func RequestInvalidEvent(
+	h core.InfoHash, self core.PeerID, peer core.PeerID, piece int, attempt int) *Event {
+
+	e := baseEvent(RequestInvalid, h, self)
+	e.Peer = peer.String()
+	e.Piece = piece
+	e.Attempt = attempt
 	return e
 }
 
@@ -122,6 +184,17 @@ func ReceivePieceEvent(h core.InfoHash, self core.PeerID, peer core.PeerID, piec
 	return e
 }
 
+// ReceiveDuplicatePieceEvent returns an event for a piece received from a peer
+// which self already had.
+func ReceiveDuplicatePieceEvent(
+	h core.InfoHash, self core.PeerID, peer core.PeerID, piece int) *Event {
+
+	e := baseEvent(ReceiveDuplicatePiece, h, self)
+	e.Peer = peer.String()
+	e.Piece = piece
+	return e
+}
+
 // TorrentCompleteEvent returns an event for a completed torrent.
 func TorrentCompleteEvent(h core.InfoHash, self core.PeerID) *Event {
 	return baseEvent(TorrentComplete, h, self)
@@ -131,3 +204,19 @@ func TorrentCompleteEvent(h core.InfoHash, self core.PeerID) *Event {
 func TorrentCancelledEvent(h core.InfoHash, self core.PeerID) *Event {
 	return baseEvent(TorrentCancelled, h, self)
 }
+
+// TorrentTeardownEvent returns an event for a torrent whose dispatcher was torn
+// down for reason.
+func TorrentTeardownEvent(h core.InfoHash, self core.PeerID, reason string) *Event {
+	e := baseEvent(TorrentTeardown, h, self)
+	e.Reason = reason
+	return e
+}
+
+// BanPeerEvent returns an event for a peer which self banned from a torrent due
+// to repeated invalid pieces.
+func BanPeerEvent(h core.InfoHash, self core.PeerID, peer core.PeerID) *Event {
+	e := baseEvent(BanPeer, h, self)
+	e.Peer = peer.String()
+	return e
+}
@@ -46,13 +46,14 @@ func Filter(events []*Event, names ...Name) []*Event {
 	return f
 }
 
-// StripTimestamps overwrites timestamps in events as empty, allowing clients
-// to check equality of events.
+// StripTimestamps overwrites timestamps and phases, which derive from
+// timestamps, in events as empty, allowing clients to check equality of events.
 //
 // Mutates events in place and returns events for chaining purposes.
 func StripTimestamps(events []*Event) []*Event {
 	for _, e := range events {
 		e.Time = time.Time{}
+		e.PhasesMS = nil
 	}
 	return events
 }
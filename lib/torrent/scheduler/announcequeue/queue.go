@@ -25,6 +25,7 @@ type Queue interface {
 	Add(core.InfoHash)
 	Ready(core.InfoHash)
 	Eject(core.InfoHash)
+	Pull(core.InfoHash) bool
 }
 
 // QueueImpl is the primary implementation of Queue. QueueImpl is not thread
@@ -76,6 +77,20 @@ func (q *QueueImpl) Ready(h core.InfoHash) {
 	q.readyQueue.PushBack(h)
 }
 
+// Pull marks h as pending ahead of its turn, such that it may announce
+// immediately. Returns false if h is not ready, e.g. since it is already
+// pending, in which case h must not announce.
+func (q *QueueImpl) Pull(h core.InfoHash) bool {
+	for e := q.readyQueue.Front(); e != nil; e = e.Next() {
+		if e.Value.(core.InfoHash) == h {
+			q.readyQueue.Remove(e)
+			q.pending[h] = true
+			return true
+		}
+	}
+	return false
+}
+
 // Eject immediately ejects h from the announce queue, preventing it from
 // announcing further.
 func (q *QueueImpl) Eject(h core.InfoHash) {
@@ -108,3 +123,6 @@ func (q DisabledQueue) Ready(core.InfoHash) {}
 
 // Eject noops.
 func (q DisabledQueue) Eject(core.InfoHash) {}
+
+// Pull never returns true.
+func (q DisabledQueue) Pull(core.InfoHash) bool { return false }
@@ -81,3 +81,32 @@ func TestQueueEjectDeletesTorrentInAllStates(t *testing.T) {
 		})
 	}
 }
+
+func TestQueuePullMarksReadyTorrentPending(t *testing.T) {
+	require := require.New(t)
+	q := New()
+	h1 := core.InfoHashFixture()
+	h2 := core.InfoHashFixture()
+
+	q.Add(h1)
+	q.Add(h2)
+
+	require.True(q.Pull(h2))
+	require.True(q.pending[h2])
+
+	// Pending torrents cannot be pulled again until ready.
+	require.False(q.Pull(h2))
+
+	n, ok := q.Next()
+	require.True(ok)
+	require.Equal(h1, n)
+	_, ok = q.Next()
+	require.False(ok)
+
+	q.Ready(h2)
+	n, ok = q.Next()
+	require.True(ok)
+	require.Equal(h2, n)
+
+	require.False(q.Pull(core.InfoHashFixture()))
+}
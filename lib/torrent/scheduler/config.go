@@ -54,6 +54,11 @@ type Config struct {
 
 	ProbeTimeout time.Duration `yaml:"probe_timeout"`
 
+	// InvalidationTimeout is the max duration InvalidateTorrent waits for the
+	// dispatcher of a torrent to stop accessing it, before removing the torrent
+	// regardless.
+	InvalidationTimeout time.Duration `yaml:"invalidation_timeout"`
+
 	ConnState connstate.Config `yaml:"connstate"`
 
 	Conn conn.Config `yaml:"conn"`
@@ -86,5 +91,12 @@ func (c Config) applyDefaults() Config {
 	if c.ProbeTimeout == 0 {
 		c.ProbeTimeout = 3 * time.Second
 	}
+	if c.InvalidationTimeout == 0 {
+		c.InvalidationTimeout = 30 * time.Second
+	}
+	if c.Conn.PieceVerifier == nil {
+		// Advertise the digests which receivers verify.
+		c.Conn.PieceVerifier = c.Dispatch.PieceVerifier
+	}
 	return c
 }
@@ -0,0 +1,121 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package conn
+
+import "sort"
+
+// Capability names an optional protocol extension. Peers list the capabilities
+// they support in their handshakes, and a Conn only uses the capabilities which
+// both peers listed, such that peers which predate an extension never see it.
+type Capability string
+
+const (
+	// PieceDigests marks piece payloads with the digest of the sent bytes, so
+	// receivers can discard pieces which were corrupt at the sender before
+	// reading them.
+	PieceDigests Capability = "piece_digests"
+
+	// AnnouncePieces allows announcing multiple pieces in a single
+	// ANNOUNCE_PIECES message.
+	AnnouncePieces Capability = "announce_pieces"
+
+	// Choke notifies peers with CHOKE and UNCHOKE messages when their piece
+	// requests are no longer served, or served again.
+	Choke Capability = "choke"
+
+	// RetryAfter marks transient piece request rejections with how long the
+	// requester should wait before requesting the piece from the rejecting peer
+	// again.
+	RetryAfter Capability = "retry_after"
+
+	// CompactBitfield allows handshakes to replace the bitfield with HAVE_ALL or
+	// HAVE_NONE if the sender has all or none of the pieces. Since both peers
+	// send their handshakes before knowing the capabilities of the other, only
+	// the acceptor of a connection, which already received the handshake of the
+	// opener, compacts its handshake.
+	CompactBitfield Capability = "compact_bitfield"
+
+	// CompressSnappy and CompressLZ4 allow compressing piece payloads with the
+	// respective codec. The sender picks one of the codecs which the receiver
+	// listed, see NegotiatedCodec.
+	CompressSnappy Capability = "compress_snappy"
+	CompressLZ4    Capability = "compress_lz4"
+
+	// Keepalive allows probing whether peers are alive with KEEPALIVE messages,
+	// which peers answer with KEEPALIVE_ACK.
+	Keepalive Capability = "keepalive"
+
+	// PriorityRequests marks piece requests which the requester needs urgently,
+	// e.g. to unblock a read, such that the sender may serve them ahead of its
+	// other requests.
+	PriorityRequests Capability = "priority_requests"
+
+	// BatchRequests allows requesting multiple pieces in a single
+	// PIECE_REQUESTS message.
+	BatchRequests Capability = "batch_requests"
+)
+
+// capabilities is a set of Capabilities.
+type capabilities map[Capability]bool
+
+func newCapabilities(names []string) capabilities {
+	c := make(capabilities)
+	for _, name := range names {
+		c[Capability(name)] = true
+	}
+	return c
+}
+
+// intersect returns the capabilities which are in both c and o.
+func (c capabilities) intersect(o capabilities) capabilities {
+	r := make(capabilities)
+	for name := range c {
+		if o[name] {
+			r[name] = true
+		}
+	}
+	return r
+}
+
+// numUnknown returns the number of capabilities in c which this version does
+// not implement, e.g. those listed by newer versions.
+func (c capabilities) numUnknown() int {
+	known := Config{}.capabilities()
+	var n int
+	for name := range c {
+		if !known[name] {
+			n++
+		}
+	}
+	return n
+}
+
+// KnownCapabilities returns all capabilities which this version implements,
+// sorted by name.
+func KnownCapabilities() []Capability {
+	var known []Capability
+	for _, name := range (Config{}).capabilities().names() {
+		known = append(known, Capability(name))
+	}
+	return known
+}
+
+func (c capabilities) names() []string {
+	var names []string
+	for name := range c {
+		names = append(names, string(name))
+	}
+	sort.Strings(names)
+	return names
+}
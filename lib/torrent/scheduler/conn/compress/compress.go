@@ -0,0 +1,35 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package compress implements the block codecs which piece payloads may be
+// compressed with. Payloads are compressed as a single block, since their
+// uncompressed length is always known to the receiver.
+package compress
+
+import "errors"
+
+// ErrCorrupt is returned when decoding malformed input.
+var ErrCorrupt = errors.New("corrupt input")
+
+// Codec compresses and decompresses blocks.
+type Codec interface {
+	// Encode returns the compressed block of src.
+	Encode(src []byte) []byte
+
+	// Decode returns the decompressed block of src, which must decompress to
+	// exactly n bytes.
+	Decode(src []byte, n int) ([]byte, error)
+
+	String() string
+}
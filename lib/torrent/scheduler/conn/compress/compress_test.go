@@ -0,0 +1,211 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package compress
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var _codecs = []Codec{Snappy, LZ4}
+
+func randBytes(r *rand.Rand, n int) []byte {
+	b := make([]byte, n)
+	r.Read(b)
+	return b
+}
+
+// textBytes returns n bytes of repetitive text, similar to text heavy layers.
+func textBytes(r *rand.Rand, n int) []byte {
+	words := []string{"kraken", "layer", "blob", "/usr/lib/", "python3", ".so", "\n", "  ", "import"}
+	var b bytes.Buffer
+	for b.Len() < n {
+		b.WriteString(words[r.Intn(len(words))])
+	}
+	return b.Bytes()[:n]
+}
+
+func TestRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+
+	inputs := map[string][]byte{
+		"empty":    {},
+		"one byte": {'a'},
+		"short":    []byte("abcdefghijklm"),
+		"repeated": bytes.Repeat([]byte{'a'}, 100000),
+		"period 3": []byte(strings.Repeat("abc", 1000)),
+		"random":   randBytes(r, 70000),
+		"text":     textBytes(r, 1<<20),
+		"mixed": append(append(textBytes(r, 5000), randBytes(r, 5000)...),
+			textBytes(r, 5000)...),
+	}
+	for _, c := range _codecs {
+		for name, input := range inputs {
+			t.Run(fmt.Sprintf("%s/%s", c, name), func(t *testing.T) {
+				require := require.New(t)
+
+				encoded := c.Encode(input)
+				decoded, err := c.Decode(encoded, len(input))
+				require.NoError(err)
+				require.True(bytes.Equal(input, decoded))
+			})
+		}
+	}
+}
+
+func TestCompressesText(t *testing.T) {
+	input := textBytes(rand.New(rand.NewSource(1)), 1<<20)
+	for _, c := range _codecs {
+		t.Run(c.String(), func(t *testing.T) {
+			n := len(c.Encode(input))
+			require.True(t, n < len(input)/2, "%d of %d bytes", n, len(input))
+		})
+	}
+}
+
+func TestDecodeKnownBlocks(t *testing.T) {
+	tests := []struct {
+		codec    Codec
+		block    []byte
+		expected string
+	}{
+		{Snappy, []byte{0x0c, 0x08, 'a', 'b', 'c', 0x15, 0x03}, strings.Repeat("abc", 4)},
+		{Snappy, []byte{0x05, 0x00, 'a', 0x0e, 0x01, 0x00}, "aaaaa"},
+		{LZ4, []byte{
+			0x3f, 'a', 'b', 'c', 0x03, 0x00, 0x03, 0x50, 'b', 'c', 'a', 'b', 'c',
+		}, strings.Repeat("abc", 10)},
+		{LZ4, []byte{0x00}, ""},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%s/%q", test.codec, test.expected), func(t *testing.T) {
+			require := require.New(t)
+
+			decoded, err := test.codec.Decode(test.block, len(test.expected))
+			require.NoError(err)
+			require.Equal(test.expected, string(decoded))
+		})
+	}
+}
+
+func TestDecodeRejectsWrongLength(t *testing.T) {
+	input := []byte(strings.Repeat("abc", 100))
+	for _, c := range _codecs {
+		t.Run(c.String(), func(t *testing.T) {
+			require := require.New(t)
+
+			encoded := c.Encode(input)
+			_, err := c.Decode(encoded, len(input)-1)
+			require.Equal(ErrCorrupt, err)
+			_, err = c.Decode(encoded, len(input)+1)
+			require.Equal(ErrCorrupt, err)
+		})
+	}
+}
+
+func TestDecodeCorruptBlocks(t *testing.T) {
+	tests := []struct {
+		codec Codec
+		block []byte
+	}{
+		// Copy before any output.
+		{Snappy, []byte{0x04, 0x01, 0x01}},
+		// Literal longer than the input.
+		{Snappy, []byte{0x04, 0x0c, 'a'}},
+		// Truncated varint.
+		{Snappy, []byte{0x80}},
+		{LZ4, []byte{}},
+		// Offset beyond the output.
+		{LZ4, []byte{0x10, 'a', 0x02, 0x00}},
+		// Zero offset.
+		{LZ4, []byte{0x10, 'a', 0x00, 0x00}},
+		// Truncated literal length.
+		{LZ4, []byte{0xf0, 0xff}},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%s/%x", test.codec, test.block), func(t *testing.T) {
+			_, err := test.codec.Decode(test.block, 5)
+			require.Equal(t, ErrCorrupt, err)
+		})
+	}
+}
+
+// TestDecodeMutatedBlocks decodes random mutations of valid blocks, which must
+// fail or succeed without panicking.
+func TestDecodeMutatedBlocks(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+
+	input := append(textBytes(r, 2000), randBytes(r, 100)...)
+	for _, c := range _codecs {
+		t.Run(c.String(), func(t *testing.T) {
+			encoded := c.Encode(input)
+			for i := 0; i < 2000; i++ {
+				mutated := append([]byte(nil), encoded...)
+				for j := r.Intn(4); j >= 0; j-- {
+					mutated[r.Intn(len(mutated))] = byte(r.Intn(256))
+				}
+				if r.Intn(4) == 0 {
+					mutated = mutated[:r.Intn(len(mutated))]
+				}
+				decoded, err := c.Decode(mutated, len(input))
+				if err == nil {
+					require.Len(t, decoded, len(input))
+				}
+			}
+		})
+	}
+}
+
+func benchmarkInputs() map[string][]byte {
+	r := rand.New(rand.NewSource(1))
+	return map[string][]byte{
+		"text":   textBytes(r, 4<<20),
+		"random": randBytes(r, 4<<20),
+	}
+}
+
+func BenchmarkEncode(b *testing.B) {
+	for name, input := range benchmarkInputs() {
+		for _, c := range _codecs {
+			b.Run(fmt.Sprintf("%s/%s", c, name), func(b *testing.B) {
+				b.SetBytes(int64(len(input)))
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					c.Encode(input)
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	for name, input := range benchmarkInputs() {
+		for _, c := range _codecs {
+			encoded := c.Encode(input)
+			b.Run(fmt.Sprintf("%s/%s", c, name), func(b *testing.B) {
+				b.SetBytes(int64(len(input)))
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					if _, err := c.Decode(encoded, len(input)); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
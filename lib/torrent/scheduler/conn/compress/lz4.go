@@ -0,0 +1,61 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package compress
+
+import (
+	"sync"
+
+	"github.com/pierrec/lz4/v4"
+)
+
+// LZ4 is the LZ4 block format, see
+// https://github.com/lz4/lz4/blob/dev/doc/lz4_Block_format.md.
+var LZ4 Codec = lz4Codec{}
+
+// compressors pools LZ4 compressors, whose hash tables are too large to
+// allocate for every block.
+var compressors = sync.Pool{
+	New: func() interface{} { return new(lz4.Compressor) },
+}
+
+type lz4Codec struct{}
+
+func (lz4Codec) String() string { return "lz4" }
+
+func (lz4Codec) Encode(src []byte) []byte {
+	if len(src) == 0 {
+		// A single token without literals, which the compressor does not emit.
+		return []byte{0}
+	}
+	c := compressors.Get().(*lz4.Compressor)
+	defer compressors.Put(c)
+
+	dst := make([]byte, lz4.CompressBlockBound(len(src)))
+	n, err := c.CompressBlock(src, dst)
+	if err != nil {
+		// Cannot happen, since dst fits src even if it is incompressible.
+		panic(err)
+	}
+	return dst[:n]
+}
+
+func (lz4Codec) Decode(src []byte, n int) ([]byte, error) {
+	dst := make([]byte, n)
+	m, err := lz4.UncompressBlock(src, dst)
+	if err != nil || m != n {
+		return nil, ErrCorrupt
+	}
+	return dst, nil
+}
@@ -0,0 +1,42 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package compress
+
+import "github.com/golang/snappy"
+
+// Snappy is the snappy block format, see
+// https://github.com/google/snappy/blob/master/format_description.txt.
+var Snappy Codec = snappyCodec{}
+
+type snappyCodec struct{}
+
+func (snappyCodec) String() string { return "snappy" }
+
+func (snappyCodec) Encode(src []byte) []byte {
+	return snappy.Encode(nil, src)
+}
+
+func (snappyCodec) Decode(src []byte, n int) ([]byte, error) {
+	// Blocks start with their decoded length, such that blocks of the wrong
+	// length are rejected before allocating their output.
+	if l, err := snappy.DecodedLen(src); err != nil || l != n {
+		return nil, ErrCorrupt
+	}
+	dst, err := snappy.Decode(make([]byte, n), src)
+	if err != nil {
+		return nil, ErrCorrupt
+	}
+	return dst, nil
+}
@@ -0,0 +1,115 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package conn
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/uber/kraken/gen/go/proto/p2p"
+	"github.com/uber/kraken/lib/torrent/scheduler/conn/compress"
+	"github.com/uber/kraken/lib/torrent/storage"
+	"github.com/uber/kraken/lib/torrent/storage/piecereader"
+)
+
+type payloadCodec struct {
+	codec      p2p.PiecePayloadMessage_Codec
+	capability Capability
+	impl       compress.Codec
+}
+
+// _payloadCodecs lists the supported payload codecs in order of preference.
+var _payloadCodecs = []payloadCodec{
+	{p2p.PiecePayloadMessage_LZ4, CompressLZ4, compress.LZ4},
+	{p2p.PiecePayloadMessage_SNAPPY, CompressSnappy, compress.Snappy},
+}
+
+func payloadCodecOf(codec p2p.PiecePayloadMessage_Codec) (payloadCodec, bool) {
+	for _, pc := range _payloadCodecs {
+		if pc.codec == codec {
+			return pc, true
+		}
+	}
+	return payloadCodec{}, false
+}
+
+// CodecCapability returns the capability which allows compressing payloads with
+// codec. Returns false if codec is NONE or unsupported.
+func CodecCapability(codec p2p.PiecePayloadMessage_Codec) (Capability, bool) {
+	pc, ok := payloadCodecOf(codec)
+	return pc.capability, ok
+}
+
+// NegotiatedCodec returns the preferred payload codec which m supports, or
+// NONE if m supports none.
+func NegotiatedCodec(m interface{ Supports(Capability) bool }) p2p.PiecePayloadMessage_Codec {
+	for _, pc := range _payloadCodecs {
+		if m.Supports(pc.capability) {
+			return pc.codec
+		}
+	}
+	return p2p.PiecePayloadMessage_NONE
+}
+
+// NewCompressedPieceChunkPayloadMessage returns a Message for sending the
+// payload of a piece chunk starting at offset, compressed with codec. pr is read
+// and closed. If the payload does not shrink, it is sent uncompressed.
+func NewCompressedPieceChunkPayloadMessage(
+	index int, offset int64, pr storage.PieceReader,
+	codec p2p.PiecePayloadMessage_Codec) (*Message, error) {
+
+	pc, ok := payloadCodecOf(codec)
+	if !ok {
+		pr.Close()
+		return nil, fmt.Errorf("unsupported payload codec %s", codec)
+	}
+	b, err := ioutil.ReadAll(pr)
+	pr.Close()
+	if err != nil {
+		return nil, fmt.Errorf("read payload: %s", err)
+	}
+	msg := NewPieceChunkPayloadMessage(index, offset, piecereader.NewBuffer(b))
+	if encoded := pc.impl.Encode(b); len(encoded) < len(b) {
+		msg.Message.PiecePayload.Codec = codec
+		msg.Message.PiecePayload.WireLength = int32(len(encoded))
+		msg.Payload = piecereader.NewBuffer(encoded)
+	}
+	return msg, nil
+}
+
+// DecompressPiecePayload returns the uncompressed payload of msg, which must be
+// msg.Length bytes long. Uncompressed payloads are returned as is, otherwise pr
+// is read and closed.
+func DecompressPiecePayload(
+	msg *p2p.PiecePayloadMessage, pr storage.PieceReader) (storage.PieceReader, error) {
+
+	if msg.Codec == p2p.PiecePayloadMessage_NONE {
+		return pr, nil
+	}
+	defer pr.Close()
+
+	pc, ok := payloadCodecOf(msg.Codec)
+	if !ok {
+		return nil, fmt.Errorf("unsupported payload codec %s", msg.Codec)
+	}
+	b, err := ioutil.ReadAll(pr)
+	if err != nil {
+		return nil, fmt.Errorf("read payload: %s", err)
+	}
+	decoded, err := pc.impl.Decode(b, int(msg.Length))
+	if err != nil {
+		return nil, fmt.Errorf("decode %s payload: %s", msg.Codec, err)
+	}
+	return piecereader.NewBuffer(decoded), nil
+}
@@ -0,0 +1,215 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package conn
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/uber/kraken/gen/go/proto/p2p"
+	"github.com/uber/kraken/lib/torrent/storage"
+	"github.com/uber/kraken/lib/torrent/storage/piecereader"
+	"github.com/uber/kraken/utils/randutil"
+)
+
+type supportedCapabilities capabilities
+
+func (c supportedCapabilities) Supports(capability Capability) bool {
+	return c[capability]
+}
+
+func compressiblePayload(n int) []byte {
+	return bytes.Repeat([]byte("kraken "), n/7+1)[:n]
+}
+
+func TestNegotiatedCodec(t *testing.T) {
+	tests := []struct {
+		desc     string
+		caps     supportedCapabilities
+		expected p2p.PiecePayloadMessage_Codec
+	}{
+		{"all", supportedCapabilities{CompressLZ4: true, CompressSnappy: true}, p2p.PiecePayloadMessage_LZ4},
+		{"snappy only", supportedCapabilities{CompressSnappy: true}, p2p.PiecePayloadMessage_SNAPPY},
+		{"lz4 only", supportedCapabilities{CompressLZ4: true}, p2p.PiecePayloadMessage_LZ4},
+		{"legacy", supportedCapabilities{PieceDigests: true}, p2p.PiecePayloadMessage_NONE},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require.Equal(t, test.expected, NegotiatedCodec(test.caps))
+		})
+	}
+}
+
+func TestNegotiatedCodecOfConn(t *testing.T) {
+	require := require.New(t)
+
+	info := storage.TorrentInfoFixture(1, 1)
+
+	local, remote, cleanup := pipeFixture(Config{}, Config{DisableCompression: true}, info)
+	defer cleanup()
+
+	require.Equal(p2p.PiecePayloadMessage_NONE, NegotiatedCodec(local))
+	require.Equal(p2p.PiecePayloadMessage_NONE, NegotiatedCodec(remote))
+
+	local, _, cleanup = PipeFixture(Config{}, info)
+	defer cleanup()
+
+	require.Equal(p2p.PiecePayloadMessage_LZ4, NegotiatedCodec(local))
+}
+
+func TestConnCompressedPiecePayload(t *testing.T) {
+	for _, codec := range []p2p.PiecePayloadMessage_Codec{
+		p2p.PiecePayloadMessage_LZ4,
+		p2p.PiecePayloadMessage_SNAPPY,
+	} {
+		t.Run(codec.String(), func(t *testing.T) {
+			require := require.New(t)
+
+			local, remote, cleanup := PipeFixture(Config{}, storage.TorrentInfoFixture(4096, 1))
+			defer cleanup()
+
+			payload := compressiblePayload(4096)
+			msg, err := NewCompressedPieceChunkPayloadMessage(
+				0, 0, piecereader.NewBuffer(payload), codec)
+			require.NoError(err)
+			require.NoError(local.Send(msg))
+
+			select {
+			case received := <-remote.Receiver():
+				pm := received.Message.PiecePayload
+				require.Equal(codec, pm.Codec)
+				require.Equal(int32(len(payload)), pm.Length)
+				require.True(pm.WireLength < pm.Length)
+				require.Equal(int(pm.WireLength), received.Payload.Length())
+
+				pr, err := DecompressPiecePayload(pm, received.Payload)
+				require.NoError(err)
+				b, err := ioutil.ReadAll(pr)
+				require.NoError(err)
+				require.Equal(payload, b)
+			case <-time.After(5 * time.Second):
+				require.FailNow("no message received")
+			}
+		})
+	}
+}
+
+func TestIncompressiblePiecePayloadIsSentUncompressed(t *testing.T) {
+	require := require.New(t)
+
+	payload := randutil.Blob(4096)
+	msg, err := NewCompressedPieceChunkPayloadMessage(
+		0, 0, piecereader.NewBuffer(payload), p2p.PiecePayloadMessage_LZ4)
+	require.NoError(err)
+
+	pm := msg.Message.PiecePayload
+	require.Equal(p2p.PiecePayloadMessage_NONE, pm.Codec)
+	require.Equal(int32(0), pm.WireLength)
+	b, err := ioutil.ReadAll(msg.Payload)
+	require.NoError(err)
+	require.Equal(payload, b)
+}
+
+func TestConnClosesOnUnnegotiatedPayloadCodec(t *testing.T) {
+	require := require.New(t)
+
+	local, remote, cleanup := pipeFixture(
+		Config{}, Config{DisableCompression: true}, storage.TorrentInfoFixture(4096, 1))
+	defer cleanup()
+
+	msg, err := NewCompressedPieceChunkPayloadMessage(
+		0, 0, piecereader.NewBuffer(compressiblePayload(4096)), p2p.PiecePayloadMessage_LZ4)
+	require.NoError(err)
+	require.NoError(local.Send(msg))
+
+	select {
+	case _, ok := <-remote.Receiver():
+		require.False(ok)
+	case <-time.After(5 * time.Second):
+		require.FailNow("receiver not closed")
+	}
+}
+
+func TestDecompressPiecePayloadErrors(t *testing.T) {
+	payload := compressiblePayload(4096)
+	encoded := _payloadCodecs[0].impl.Encode(payload)
+
+	tests := []struct {
+		desc string
+		msg  *p2p.PiecePayloadMessage
+		b    []byte
+	}{
+		{"unknown codec", &p2p.PiecePayloadMessage{Codec: 7, Length: 4096}, encoded},
+		{"wrong length", &p2p.PiecePayloadMessage{
+			Codec: p2p.PiecePayloadMessage_LZ4, Length: 4095}, encoded},
+		{"corrupt", &p2p.PiecePayloadMessage{
+			Codec: p2p.PiecePayloadMessage_LZ4, Length: 4096}, encoded[:len(encoded)/2]},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			_, err := DecompressPiecePayload(test.msg, piecereader.NewBuffer(test.b))
+			require.Error(t, err)
+		})
+	}
+}
+
+func BenchmarkNewCompressedPieceChunkPayloadMessage(b *testing.B) {
+	for _, codec := range []p2p.PiecePayloadMessage_Codec{
+		p2p.PiecePayloadMessage_LZ4,
+		p2p.PiecePayloadMessage_SNAPPY,
+	} {
+		b.Run(codec.String(), func(b *testing.B) {
+			payload := compressiblePayload(4 << 20)
+			b.SetBytes(int64(len(payload)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := NewCompressedPieceChunkPayloadMessage(
+					0, 0, piecereader.NewBuffer(payload), codec); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkDecompressPiecePayload(b *testing.B) {
+	for _, codec := range []p2p.PiecePayloadMessage_Codec{
+		p2p.PiecePayloadMessage_LZ4,
+		p2p.PiecePayloadMessage_SNAPPY,
+	} {
+		b.Run(codec.String(), func(b *testing.B) {
+			msg, err := NewCompressedPieceChunkPayloadMessage(
+				0, 0, piecereader.NewBuffer(compressiblePayload(4<<20)), codec)
+			if err != nil {
+				b.Fatal(err)
+			}
+			encoded, err := ioutil.ReadAll(msg.Payload)
+			if err != nil {
+				b.Fatal(err)
+			}
+			pm := msg.Message.PiecePayload
+			b.SetBytes(int64(pm.Length))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := DecompressPiecePayload(pm, piecereader.NewBuffer(encoded)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
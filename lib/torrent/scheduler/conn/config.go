@@ -16,6 +16,7 @@ package conn
 import (
 	"time"
 
+	"github.com/uber/kraken/lib/torrent/storage"
 	"github.com/uber/kraken/utils/bandwidth"
 	"github.com/uber/kraken/utils/memsize"
 )
@@ -37,9 +38,87 @@ type Config struct {
 	// is taking a long time to process a message.
 	ReceiverBufferSize int `yaml:"receiver_buffer_size"`
 
+	// DisablePieceDigests disables the PieceDigests capability, such that
+	// digests of piece payloads are neither sent nor checked.
+	DisablePieceDigests bool `yaml:"disable_piece_digests"`
+
+	// DisableAnnouncePieces disables the AnnouncePieces capability, such that
+	// coalesced announcements are sent one piece per message.
+	DisableAnnouncePieces bool `yaml:"disable_announce_pieces"`
+
+	// DisableChoke disables the Choke capability, such that peers are not
+	// notified when they are choked.
+	DisableChoke bool `yaml:"disable_choke"`
+
+	// DisableRetryAfter disables the RetryAfter capability, such that transient
+	// rejections carry no retry hints, and hints of peers are ignored.
+	DisableRetryAfter bool `yaml:"disable_retry_after"`
+
+	// DisableCompactBitfield disables the CompactBitfield capability, such that
+	// handshakes always carry the full bitfield.
+	DisableCompactBitfield bool `yaml:"disable_compact_bitfield"`
+
+	// DisableCompression disables the compression capabilities, such that peers
+	// never send us compressed piece payloads. Whether we compress the payloads
+	// we send is configured per dispatcher.
+	DisableCompression bool `yaml:"disable_compression"`
+
+	// DisableKeepalive disables the Keepalive capability, such that peers do not
+	// probe us when we are idle, nor detect us as dead.
+	DisableKeepalive bool `yaml:"disable_keepalive"`
+
+	// DisablePriorityRequests disables the PriorityRequests capability, such
+	// that peers do not mark their piece requests to us as urgent, and we do not
+	// mark ours.
+	DisablePriorityRequests bool `yaml:"disable_priority_requests"`
+
+	// DisableBatchRequests disables the BatchRequests capability, such that
+	// pieces are requested with one message each.
+	DisableBatchRequests bool `yaml:"disable_batch_requests"`
+
+	// PieceVerifier, if set, creates the verifier whose digests are sent and
+	// checked for piece payloads. Defaults to the checksums of the torrent
+	// metainfo.
+	PieceVerifier storage.PieceVerifierFactory `yaml:"-" json:"-"`
+
 	Bandwidth bandwidth.Config `yaml:"bandwidth"`
 }
 
+// capabilities returns the protocol extensions which c enables.
+func (c Config) capabilities() capabilities {
+	caps := make(capabilities)
+	if !c.DisablePieceDigests {
+		caps[PieceDigests] = true
+	}
+	if !c.DisableAnnouncePieces {
+		caps[AnnouncePieces] = true
+	}
+	if !c.DisableChoke {
+		caps[Choke] = true
+	}
+	if !c.DisableRetryAfter {
+		caps[RetryAfter] = true
+	}
+	if !c.DisableCompactBitfield {
+		caps[CompactBitfield] = true
+	}
+	if !c.DisableKeepalive {
+		caps[Keepalive] = true
+	}
+	if !c.DisablePriorityRequests {
+		caps[PriorityRequests] = true
+	}
+	if !c.DisableBatchRequests {
+		caps[BatchRequests] = true
+	}
+	if !c.DisableCompression {
+		for _, pc := range _payloadCodecs {
+			caps[pc.capability] = true
+		}
+	}
+	return caps
+}
+
 func (c Config) applyDefaults() Config {
 	if c.HandshakeTimeout == 0 {
 		c.HandshakeTimeout = 5 * time.Second
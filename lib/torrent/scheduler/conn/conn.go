@@ -14,9 +14,11 @@
 package conn
 
 import (
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"sync"
 	"time"
@@ -48,6 +50,8 @@ type Events interface {
 type Conn struct {
 	peerID      core.PeerID
 	infoHash    core.InfoHash
+	info        *storage.TorrentInfo
+	verifier    storage.PieceVerifier
 	createdAt   time.Time
 	localPeerID core.PeerID
 	bandwidth   *bandwidth.Limiter
@@ -67,11 +71,27 @@ type Conn struct {
 	// Marks whether the connection was opened by the remote peer, or the local peer.
 	openedByRemote bool
 
+	// Protocol extensions supported by both peers.
+	capabilities capabilities
+
+	// Number of protocol extensions listed by the remote peer which we do not
+	// implement.
+	unknownCapabilities int
+
 	startOnce sync.Once
 
 	sender   chan *Message
 	receiver chan *Message
 
+	// Track the messages queued in sender and receiver. A message read off the
+	// socket is pending while readLoop waits for room in receiver.
+	sendQueue      *messageQueue
+	receiveQueue   *messageQueue
+	receivePending *atomic.Int32
+
+	// Total bytes written to the wire, including message framing.
+	bytesSent *atomic.Int64
+
 	// The following fields orchestrate the closing of the connection:
 	closed *atomic.Bool
 	done   chan struct{}  // Signals to readLoop / writeLoop to exit.
@@ -92,6 +112,7 @@ func newConn(
 	remotePeerID core.PeerID,
 	info *storage.TorrentInfo,
 	openedByRemote bool,
+	capabilities capabilities,
 	logger *zap.SugaredLogger) (*Conn, error) {
 
 	// Clear all deadlines set during handshake. Once a Conn is created, we
@@ -100,9 +121,16 @@ func newConn(
 		return nil, fmt.Errorf("set deadline: %s", err)
 	}
 
+	verifier, err := storage.NewPieceVerifier(config.PieceVerifier, info)
+	if err != nil {
+		return nil, fmt.Errorf("piece verifier: %s", err)
+	}
+
 	c := &Conn{
 		peerID:         remotePeerID,
 		infoHash:       info.InfoHash(),
+		info:           info,
+		verifier:       verifier,
 		createdAt:      clk.Now(),
 		localPeerID:    localPeerID,
 		bandwidth:      bandwidth,
@@ -113,8 +141,14 @@ func newConn(
 		stats:          stats,
 		networkEvents:  networkEvents,
 		openedByRemote: openedByRemote,
+		capabilities:   capabilities,
 		sender:         make(chan *Message, config.SenderBufferSize),
 		receiver:       make(chan *Message, config.ReceiverBufferSize),
+		sendQueue:      newMessageQueue(clk, config.SenderBufferSize),
+		// One more message may be read while the receiver is full.
+		receiveQueue:   newMessageQueue(clk, config.ReceiverBufferSize+1),
+		receivePending: atomic.NewInt32(0),
+		bytesSent:      atomic.NewInt64(0),
 		closed:         atomic.NewBool(false),
 		done:           make(chan struct{}),
 		logger:         logger,
@@ -150,6 +184,12 @@ func (c *Conn) CreatedAt() time.Time {
 	return c.createdAt
 }
 
+// LocalAddr returns the local address which the connection arrived on, which
+// tells apart the network interfaces of hosts with multiple NICs.
+func (c *Conn) LocalAddr() net.Addr {
+	return c.nc.LocalAddr()
+}
+
 func (c *Conn) String() string {
 	return fmt.Sprintf("Conn(peer=%s, hash=%s, opened_by_remote=%t)",
 		c.peerID, c.infoHash, c.openedByRemote)
@@ -157,18 +197,52 @@ func (c *Conn) String() string {
 
 // Send writes the given message to the underlying connection.
 func (c *Conn) Send(msg *Message) error {
-	select {
-	case <-c.done:
-		return errors.New("conn closed")
-	case c.sender <- msg:
-		return nil
-	default:
-		// TODO(codyg): Consider a timeout here instead.
-		c.stats.Tagged(map[string]string{
-			"dropped_message_type": msg.Message.Type.String(),
-		}).Counter("dropped_messages").Inc(1)
-		return errors.New("send buffer full")
-	}
+	// msg is recorded before it is sent, since it may be written to the socket
+	// as soon as it is sent.
+	return c.sendQueue.push(newQueuedMessage(msg, c.clk.Now()), func() error {
+		select {
+		case <-c.done:
+			return errors.New("conn closed")
+		case c.sender <- msg:
+			return nil
+		default:
+			// TODO(codyg): Consider a timeout here instead.
+			c.stats.Tagged(map[string]string{
+				"dropped_message_type": msg.Message.Type.String(),
+			}).Counter("dropped_messages").Inc(1)
+			return errors.New("send buffer full")
+		}
+	})
+}
+
+// BytesSent returns the total number of bytes written to the connection,
+// including message framing and piece payloads.
+func (c *Conn) BytesSent() int64 {
+	return c.bytesSent.Load()
+}
+
+// SendQueueStats returns stats of the messages which were sent but not yet
+// written to the connection.
+func (c *Conn) SendQueueStats() QueueStats {
+	return c.sendQueue.stats(len(c.sender))
+}
+
+// ReceiveQueueStats returns stats of the messages which were read off the
+// connection but not yet received.
+func (c *Conn) ReceiveQueueStats() QueueStats {
+	return c.receiveQueue.stats(len(c.receiver) + int(c.receivePending.Load()))
+}
+
+// Supports returns true if both peers of c support capability.
+func (c *Conn) Supports(capability Capability) bool {
+	return c.capabilities[capability]
+}
+
+// UnknownCapabilities returns the number of capabilities which the remote peer
+// of c listed in its handshake but this version does not implement, e.g. since
+// the remote peer runs a newer version.
+func (c *Conn) UnknownCapabilities() int {
+	return c.unknownCapabilities
 }
 
 // Receiver returns a read-only channel for reading incoming messages off the connection.
@@ -214,9 +288,29 @@ func (c *Conn) readMessage() (*Message, error) {
 	}
 	var pr storage.PieceReader
 	if p2pMessage.Type == p2p.Message_PIECE_PAYLOAD {
+		if p2pMessage.PiecePayload == nil {
+			// The length of the payload which follows is unknown, so the
+			// connection cannot be read any further.
+			return nil, errors.New("piece payload message without payload header")
+		}
+		if !c.validPieceDigest(p2pMessage.PiecePayload) {
+			// Discard known-bad payloads without buffering them. The message is
+			// still delivered, such that the receiver can fail the request.
+			i := int(p2pMessage.PiecePayload.Index)
+			c.log("piece", i).Info("Discarding piece payload with mismatched digest")
+			c.stats.Counter("piece_digest_mismatches").Inc(1)
+			if err := c.discardPayload(p2pMessage.PiecePayload.Length); err != nil {
+				return nil, fmt.Errorf("discard payload: %s", err)
+			}
+			return &Message{Message: p2pMessage, DigestMismatch: true}, nil
+		}
 		// For payload messages, we must read the actual payload to the connection
 		// after reading the message.
-		payload, err := c.readPayload(p2pMessage.PiecePayload.Length)
+		length, err := c.payloadWireLength(p2pMessage.PiecePayload)
+		if err != nil {
+			return nil, err
+		}
+		payload, err := c.readPayload(length)
 		if err != nil {
 			return nil, fmt.Errorf("read payload: %s", err)
 		}
@@ -224,7 +318,72 @@ func (c *Conn) readMessage() (*Message, error) {
 		pr = piecereader.NewBuffer(payload)
 	}
 
-	return &Message{p2pMessage, pr}, nil
+	return &Message{Message: p2pMessage, Payload: pr}, nil
+}
+
+// payloadWireLength returns the number of bytes of the payload following msg.
+// Compressed payloads must use a codec which we listed, and are only sent if
+// they are smaller than the uncompressed payload.
+func (c *Conn) payloadWireLength(msg *p2p.PiecePayloadMessage) (int32, error) {
+	if msg.Codec == p2p.PiecePayloadMessage_NONE {
+		return msg.Length, nil
+	}
+	pc, ok := payloadCodecOf(msg.Codec)
+	if !ok || !c.Supports(pc.capability) {
+		return 0, fmt.Errorf("unsupported payload codec %s", msg.Codec)
+	}
+	if msg.WireLength <= 0 || msg.WireLength >= msg.Length {
+		return 0, fmt.Errorf(
+			"invalid compressed payload length %d of %d bytes", msg.WireLength, msg.Length)
+	}
+	return msg.WireLength, nil
+}
+
+// validPieceDigest returns false if msg carries a digest which does not match
+// the expected digest of the piece. Payloads without digests, or whose digests
+// were computed with a different hash, are left to the receiver to verify.
+// Compressed payloads carry no digests, and are verified once decompressed.
+func (c *Conn) validPieceDigest(msg *p2p.PiecePayloadMessage) bool {
+	if msg.Digest == "" || msg.Codec != p2p.PiecePayloadMessage_NONE ||
+		!c.Supports(PieceDigests) || !c.fullPiece(msg) {
+		return true
+	}
+	expected := c.verifier.Expected(int(msg.Index))
+	if len(msg.Digest) != hex.EncodedLen(len(expected)) {
+		return true
+	}
+	return msg.Digest == pieceDigest(expected)
+}
+
+// fullPiece returns true if msg is the payload of an entire piece, as opposed
+// to a chunk of one.
+func (c *Conn) fullPiece(msg *p2p.PiecePayloadMessage) bool {
+	i := int(msg.Index)
+	if i < 0 || i >= c.info.NumPieces() {
+		// Out of bounds pieces are rejected by the receiver.
+		return false
+	}
+	return msg.Offset == 0 && int64(msg.Length) == c.info.PieceLength(i)
+}
+
+// digestPayload sets the digest of the piece payload msg to the digest of the
+// bytes which are sent. The payload is buffered to do so.
+func (c *Conn) digestPayload(msg *Message) error {
+	b, err := ioutil.ReadAll(msg.Payload)
+	msg.Payload.Close()
+	if err != nil {
+		return fmt.Errorf("read payload: %s", err)
+	}
+	h := c.verifier.Hash()
+	h.Write(b)
+	msg.Message.PiecePayload.Digest = pieceDigest(h.Sum(nil))
+	msg.Payload = piecereader.NewBuffer(b)
+	return nil
+}
+
+func (c *Conn) discardPayload(length int32) error {
+	_, err := io.CopyN(ioutil.Discard, c.nc, int64(length))
+	return err
 }
 
 // readLoop reads messages off of the underlying connection and sends them to the
@@ -246,7 +405,10 @@ func (c *Conn) readLoop() {
 				c.log().Infof("Error reading message from socket, exiting read loop: %s", err)
 				return
 			}
+			c.receiveQueue.push(newQueuedMessage(msg, c.clk.Now()), nil)
+			c.receivePending.Inc()
 			c.receiver <- msg
+			c.receivePending.Dec()
 		}
 	}
 }
@@ -260,6 +422,7 @@ func (c *Conn) sendPiecePayload(pr storage.PieceReader) error {
 		return fmt.Errorf("egress bandwidth: %s", err)
 	}
 	n, err := io.Copy(c.nc, pr)
+	c.bytesSent.Add(n)
 	if err != nil {
 		return fmt.Errorf("copy to socket: %s", err)
 	}
@@ -268,9 +431,18 @@ func (c *Conn) sendPiecePayload(pr storage.PieceReader) error {
 }
 
 func (c *Conn) sendMessage(msg *Message) error {
+	if msg.Message.Type == p2p.Message_PIECE_PAYLOAD &&
+		msg.Message.PiecePayload.Codec == p2p.PiecePayloadMessage_NONE &&
+		c.Supports(PieceDigests) && c.fullPiece(msg.Message.PiecePayload) {
+
+		if err := c.digestPayload(msg); err != nil {
+			return fmt.Errorf("digest payload: %s", err)
+		}
+	}
 	if err := sendMessage(c.nc, msg.Message); err != nil {
 		return fmt.Errorf("send message: %s", err)
 	}
+	c.bytesSent.Add(int64(messageSize(msg.Message)))
 	if msg.Message.Type == p2p.Message_PIECE_PAYLOAD {
 		// For payload messages, we must write the actual payload to the connection
 		// after writing the message.
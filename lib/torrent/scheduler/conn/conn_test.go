@@ -14,10 +14,19 @@
 package conn
 
 import (
+	"crypto/sha256"
+	"io/ioutil"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
+	"github.com/willf/bitset"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/gen/go/proto/p2p"
+	"github.com/uber/kraken/lib/torrent/storage"
+	"github.com/uber/kraken/lib/torrent/storage/piecereader"
 )
 
 func TestConnClose(t *testing.T) {
@@ -40,3 +49,213 @@ func TestConnClose(t *testing.T) {
 
 	require.True(c.IsClosed())
 }
+
+func TestConnPieceDigest(t *testing.T) {
+	blob := core.SizedBlobFixture(4, 2)
+	info := storage.NewTorrentInfo(blob.MetaInfo, bitset.New(2))
+	good := blob.Content[2:4]
+	corrupt := []byte{good[0] + 1, good[1]}
+
+	disabled := Config{DisablePieceDigests: true}
+	// The custom verifier expects every piece to be "aa".
+	sha256Config := Config{
+		PieceVerifier: storage.PieceVerifierFixture(sha256.New, []byte("aaaa")),
+	}
+
+	tests := []struct {
+		desc          string
+		localConfig   Config
+		remoteConfig  Config
+		offset        int64
+		payload       []byte
+		expectDigest  bool
+		expectDiscard bool
+	}{
+		{"matched", Config{}, Config{}, 0, good, true, false},
+		{"corrupt sender", Config{}, Config{}, 0, corrupt, true, true},
+		{"disabled by sender", disabled, Config{}, 0, corrupt, false, false},
+		{"disabled by receiver", Config{}, disabled, 0, corrupt, false, false},
+		{"chunk", Config{}, Config{}, 1, corrupt[:1], false, false},
+		{"custom verifier matched", sha256Config, sha256Config, 0, []byte("aa"), true, false},
+		{"custom verifier corrupt sender", sha256Config, sha256Config, 0, good, true, true},
+		{"different hashes", sha256Config, Config{}, 0, corrupt, true, false},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+
+			local, remote, cleanup := pipeFixture(test.localConfig, test.remoteConfig, info)
+			defer cleanup()
+
+			msg := NewPieceChunkPayloadMessage(1, test.offset, piecereader.NewBuffer(test.payload))
+			require.NoError(local.Send(msg))
+
+			select {
+			case received := <-remote.Receiver():
+				require.Equal(p2p.Message_PIECE_PAYLOAD, received.Message.Type)
+				require.Equal(int32(1), received.Message.PiecePayload.Index)
+				require.Equal(test.expectDigest, received.Message.PiecePayload.Digest != "")
+				require.Equal(test.expectDiscard, received.DigestMismatch)
+				if test.expectDiscard {
+					require.Nil(received.Payload)
+				} else {
+					b, err := ioutil.ReadAll(received.Payload)
+					require.NoError(err)
+					require.Equal(test.payload, b)
+				}
+			case <-time.After(5 * time.Second):
+				require.FailNow("no message received")
+			}
+
+			// Connection remains usable.
+			require.NoError(local.Send(NewAnnouncePieceMessage(0)))
+			select {
+			case received := <-remote.Receiver():
+				require.Equal(p2p.Message_ANNOUCE_PIECE, received.Message.Type)
+			case <-time.After(5 * time.Second):
+				require.FailNow("no message received")
+			}
+		})
+	}
+}
+
+func TestConnBytesSent(t *testing.T) {
+	require := require.New(t)
+
+	local, remote, cleanup := PipeFixture(Config{}, storage.TorrentInfoFixture(4, 1))
+	defer cleanup()
+
+	announce := NewAnnouncePieceMessage(3)
+	require.NoError(local.Send(announce))
+	payload := NewPiecePayloadMessage(2, piecereader.NewBuffer([]byte{'a'}))
+	require.NoError(local.Send(payload))
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-remote.Receiver():
+		case <-time.After(5 * time.Second):
+			require.FailNow("no message received")
+		}
+	}
+
+	// Digest is filled in before sending, so the payload message size is stable.
+	// Payload bytes are counted once the payload was written, which may be after
+	// it was received.
+	expected := int64(messageSize(announce.Message) + messageSize(payload.Message) + 1)
+	require.Eventually(func() bool {
+		return local.BytesSent() == expected
+	}, 5*time.Second, time.Millisecond)
+}
+
+func TestConnQueueStats(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(4, 1)
+	local, remote, cleanup := PipeFixture(
+		Config{}, storage.NewTorrentInfo(blob.MetaInfo, bitset.New(4)))
+	defer cleanup()
+
+	announce := NewAnnouncePieceMessage(3)
+	require.NoError(local.Send(announce))
+	payload := NewPiecePayloadMessage(2, piecereader.NewBuffer(blob.Content[2:3]))
+	require.NoError(local.Send(payload))
+
+	// Nothing receives from remote, so both messages stay queued.
+	require.Eventually(func() bool {
+		return remote.ReceiveQueueStats().Messages == 2
+	}, 5*time.Second, time.Millisecond)
+	require.Equal(0, local.SendQueueStats().Messages)
+
+	time.Sleep(10 * time.Millisecond)
+	s := remote.ReceiveQueueStats()
+	require.Equal(int64(messageSize(announce.Message)+messageSize(payload.Message)+1), s.Bytes)
+	require.True(s.OldestAge >= 10*time.Millisecond)
+	require.Equal(s.OldestAge, s.OldestControlAge)
+
+	<-remote.Receiver()
+	s = remote.ReceiveQueueStats()
+	require.Equal(1, s.Messages)
+	require.Equal(int64(messageSize(payload.Message)+1), s.Bytes)
+	require.True(s.OldestAge > 0)
+	require.Equal(time.Duration(0), s.OldestControlAge)
+}
+
+func TestConnPriorityPieceRequest(t *testing.T) {
+	disabled := Config{DisablePriorityRequests: true}
+
+	tests := []struct {
+		desc          string
+		localConfig   Config
+		remoteConfig  Config
+		expectSupport bool
+	}{
+		{"both peers support", Config{}, Config{}, true},
+		{"disabled by sender", disabled, Config{}, false},
+		{"disabled by receiver", Config{}, disabled, false},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+
+			local, remote, cleanup := pipeFixture(
+				test.localConfig, test.remoteConfig, storage.TorrentInfoFixture(4, 1))
+			defer cleanup()
+
+			require.Equal(test.expectSupport, local.Supports(PriorityRequests))
+			require.Equal(test.expectSupport, remote.Supports(PriorityRequests))
+
+			require.NoError(local.Send(NewPriorityPieceChunkRequestMessage(2, 0, 1)))
+			select {
+			case received := <-remote.Receiver():
+				require.Equal(p2p.Message_PIECE_REQUEST, received.Message.Type)
+				require.Equal(int32(2), received.Message.PieceRequest.Index)
+				require.True(received.Message.PieceRequest.Priority)
+			case <-time.After(5 * time.Second):
+				require.FailNow("no message received")
+			}
+		})
+	}
+}
+
+func TestConnPieceRequestsMessage(t *testing.T) {
+	require := require.New(t)
+
+	local, remote, cleanup := PipeFixture(Config{}, storage.TorrentInfoFixture(4, 1))
+	defer cleanup()
+
+	require.True(local.Supports(BatchRequests))
+
+	requests := []*p2p.PieceRequestMessage{
+		NewPieceRequestMessage(0, 1).Message.PieceRequest,
+		NewPriorityPieceChunkRequestMessage(2, 0, 1).Message.PieceRequest,
+	}
+	require.NoError(local.Send(NewPieceRequestsMessage(requests)))
+	select {
+	case received := <-remote.Receiver():
+		require.Equal(p2p.Message_PIECE_REQUESTS, received.Message.Type)
+		require.Len(received.Message.PieceRequests.Requests, 2)
+		for i, r := range received.Message.PieceRequests.Requests {
+			require.Equal(requests[i].Index, r.Index)
+			require.Equal(requests[i].Length, r.Length)
+			require.Equal(requests[i].Priority, r.Priority)
+		}
+	case <-time.After(5 * time.Second):
+		require.FailNow("no message received")
+	}
+}
+
+func TestConnClosesOnPiecePayloadWithoutHeader(t *testing.T) {
+	require := require.New(t)
+
+	local, remote, cleanup := PipeFixture(Config{}, storage.TorrentInfoFixture(4, 1))
+	defer cleanup()
+
+	// Written around local, whose sender would not send a malformed message.
+	require.NoError(sendMessage(local.nc, &p2p.Message{Type: p2p.Message_PIECE_PAYLOAD}))
+	select {
+	case _, ok := <-remote.Receiver():
+		require.False(ok)
+	case <-time.After(5 * time.Second):
+		require.FailNow("connection not closed")
+	}
+}
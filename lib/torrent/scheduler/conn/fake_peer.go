@@ -97,7 +97,7 @@ func (p *FakePeer) handshakeConns() error {
 			bitfield:  bitset.New(req.bitfield.Len()),
 			namespace: req.namespace,
 		}
-		respMsg, err := resp.toP2PMessage()
+		respMsg, err := resp.toP2PMessage(false)
 		if err != nil {
 			return err
 		}
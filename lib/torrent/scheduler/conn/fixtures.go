@@ -45,6 +45,16 @@ func (n noopDeadline) SetWriteDeadline(t time.Time) error { return nil }
 func PipeFixture(
 	config Config, info *storage.TorrentInfo) (local *Conn, remote *Conn, cleanupFunc func()) {
 
+	return pipeFixture(config, config, info)
+}
+
+// pipeFixture returns Conns for both sides of a live connection between peers
+// with different configs for testing.
+func pipeFixture(
+	localConfig Config,
+	remoteConfig Config,
+	info *storage.TorrentInfo) (local *Conn, remote *Conn, cleanupFunc func()) {
+
 	var cleanup testutil.Cleanup
 	defer cleanup.Recover()
 
@@ -54,15 +64,15 @@ func PipeFixture(
 
 	var err error
 
-	local, err = HandshakerFixture(config).newConn(
-		noopDeadline{nc1}, core.PeerIDFixture(), info, false)
+	local, err = HandshakerFixture(localConfig).newConn(
+		noopDeadline{nc1}, core.PeerIDFixture(), info, false, remoteConfig.capabilities())
 	if err != nil {
 		panic(err)
 	}
 	local.Start()
 
-	remote, err = HandshakerFixture(config).newConn(
-		noopDeadline{nc2}, core.PeerIDFixture(), info, true)
+	remote, err = HandshakerFixture(remoteConfig).newConn(
+		noopDeadline{nc2}, core.PeerIDFixture(), info, true, localConfig.capabilities())
 	if err != nil {
 		panic(err)
 	}
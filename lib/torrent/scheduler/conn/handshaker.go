@@ -70,30 +70,69 @@ type handshake struct {
 	bitfield        *bitset.BitSet
 	remoteBitfields RemoteBitfields
 	namespace       string
+	capabilities    capabilities
 }
 
-func (h *handshake) toP2PMessage() (*p2p.Message, error) {
-	b, err := h.bitfield.MarshalBinary()
-	if err != nil {
-		return nil, err
-	}
+// toP2PMessage converts h into a bitfield message. If compact is set, the
+// bitfield is replaced with HAVE_ALL or HAVE_NONE where possible.
+func (h *handshake) toP2PMessage(compact bool) (*p2p.Message, error) {
 	rb, err := h.remoteBitfields.marshalBinary()
 	if err != nil {
 		return nil, err
 	}
+	msg := &p2p.BitfieldMessage{
+		PeerID:              h.peerID.String(),
+		Name:                h.digest.Hex(),
+		InfoHash:            h.infoHash.String(),
+		RemoteBitfieldBytes: rb,
+		Namespace:           h.namespace,
+		Capabilities:        h.capabilities.names(),
+	}
+	n := h.bitfield.Len()
+	switch {
+	case compact && n > 0 && h.bitfield.Count() == n:
+		msg.Have = p2p.BitfieldMessage_HAVE_ALL
+		msg.NumPieces = int32(n)
+	case compact && h.bitfield.Count() == 0:
+		msg.Have = p2p.BitfieldMessage_HAVE_NONE
+		msg.NumPieces = int32(n)
+	default:
+		b, err := h.bitfield.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		msg.BitfieldBytes = b
+	}
 	return &p2p.Message{
-		Type: p2p.Message_BITFIELD,
-		Bitfield: &p2p.BitfieldMessage{
-			PeerID:              h.peerID.String(),
-			Name:                h.digest.Hex(),
-			InfoHash:            h.infoHash.String(),
-			BitfieldBytes:       b,
-			RemoteBitfieldBytes: rb,
-			Namespace:           h.namespace,
-		},
+		Type:     p2p.Message_BITFIELD,
+		Bitfield: msg,
 	}, nil
 }
 
+// bitfieldFromP2PMessage returns the bitfield of msg, synthesizing it from
+// HAVE_ALL or HAVE_NONE.
+func bitfieldFromP2PMessage(msg *p2p.BitfieldMessage) (*bitset.BitSet, error) {
+	switch msg.Have {
+	case p2p.BitfieldMessage_BITFIELD:
+		b := bitset.New(0)
+		if err := b.UnmarshalBinary(msg.BitfieldBytes); err != nil {
+			return nil, err
+		}
+		return b, nil
+	case p2p.BitfieldMessage_HAVE_ALL, p2p.BitfieldMessage_HAVE_NONE:
+		if msg.NumPieces < 0 {
+			return nil, fmt.Errorf("invalid num pieces: %d", msg.NumPieces)
+		}
+		b := bitset.New(uint(msg.NumPieces))
+		if msg.Have == p2p.BitfieldMessage_HAVE_ALL {
+			b = b.Complement()
+		}
+		return b, nil
+	default:
+		return nil, fmt.Errorf("unknown have: %s", msg.Have)
+	}
+}
+
 func handshakeFromP2PMessage(m *p2p.Message) (*handshake, error) {
 	if m.Type != p2p.Message_BITFIELD {
 		return nil, fmt.Errorf("expected bitfield message, got %s", m.Type)
@@ -114,8 +153,8 @@ func handshakeFromP2PMessage(m *p2p.Message) (*handshake, error) {
 	if err != nil {
 		return nil, fmt.Errorf("name: %s", err)
 	}
-	bitfield := bitset.New(0)
-	if err := bitfield.UnmarshalBinary(bitfieldMsg.BitfieldBytes); err != nil {
+	bitfield, err := bitfieldFromP2PMessage(bitfieldMsg)
+	if err != nil {
 		return nil, err
 	}
 	remoteBitfields := make(RemoteBitfields)
@@ -130,6 +169,7 @@ func handshakeFromP2PMessage(m *p2p.Message) (*handshake, error) {
 		digest:          d,
 		namespace:       bitfieldMsg.Namespace,
 		remoteBitfields: remoteBitfields,
+		capabilities:    newCapabilities(bitfieldMsg.Capabilities),
 	}, nil
 }
 
@@ -245,10 +285,11 @@ func (h *Handshaker) Establish(
 
 	// Namespace is one-directional: it is only supplied by the connection opener
 	// and is not reciprocated by the connection acceptor.
-	if err := h.sendHandshake(pc.nc, info, remoteBitfields, ""); err != nil {
+	compact := h.config.capabilities().intersect(pc.handshake.capabilities)[CompactBitfield]
+	if err := h.sendHandshake(pc.nc, info, remoteBitfields, "", compact); err != nil {
 		return nil, fmt.Errorf("send handshake: %s", err)
 	}
-	c, err := h.newConn(pc.nc, pc.handshake.peerID, info, true)
+	c, err := h.newConn(pc.nc, pc.handshake.peerID, info, true, pc.handshake.capabilities)
 	if err != nil {
 		return nil, fmt.Errorf("new conn: %s", err)
 	}
@@ -281,7 +322,8 @@ func (h *Handshaker) sendHandshake(
 	nc net.Conn,
 	info *storage.TorrentInfo,
 	remoteBitfields RemoteBitfields,
-	namespace string) error {
+	namespace string,
+	compact bool) error {
 
 	hs := &handshake{
 		peerID:          h.peerID,
@@ -290,8 +332,9 @@ func (h *Handshaker) sendHandshake(
 		bitfield:        info.Bitfield(),
 		remoteBitfields: remoteBitfields,
 		namespace:       namespace,
+		capabilities:    h.config.capabilities(),
 	}
-	msg, err := hs.toP2PMessage()
+	msg, err := hs.toP2PMessage(compact)
 	if err != nil {
 		return err
 	}
@@ -317,7 +360,9 @@ func (h *Handshaker) fullHandshake(
 	remoteBitfields RemoteBitfields,
 	namespace string) (*HandshakeResult, error) {
 
-	if err := h.sendHandshake(nc, info, remoteBitfields, namespace); err != nil {
+	// The capabilities of the remote peer are unknown yet, so the full bitfield
+	// is sent.
+	if err := h.sendHandshake(nc, info, remoteBitfields, namespace, false); err != nil {
 		return nil, fmt.Errorf("send handshake: %s", err)
 	}
 	hs, err := h.readHandshake(nc)
@@ -327,7 +372,7 @@ func (h *Handshaker) fullHandshake(
 	if hs.peerID != peerID {
 		return nil, errors.New("unexpected peer id")
 	}
-	c, err := h.newConn(nc, peerID, info, false)
+	c, err := h.newConn(nc, peerID, info, false, hs.capabilities)
 	if err != nil {
 		return nil, fmt.Errorf("new conn: %s", err)
 	}
@@ -338,9 +383,10 @@ func (h *Handshaker) newConn(
 	nc net.Conn,
 	peerID core.PeerID,
 	info *storage.TorrentInfo,
-	openedByRemote bool) (*Conn, error) {
+	openedByRemote bool,
+	remoteCapabilities capabilities) (*Conn, error) {
 
-	return newConn(
+	c, err := newConn(
 		h.config,
 		h.stats,
 		h.clk,
@@ -352,5 +398,11 @@ func (h *Handshaker) newConn(
 		peerID,
 		info,
 		openedByRemote,
+		h.config.capabilities().intersect(remoteCapabilities),
 		zap.NewNop().Sugar())
+	if err != nil {
+		return nil, err
+	}
+	c.unknownCapabilities = remoteCapabilities.numUnknown()
+	return c, nil
 }
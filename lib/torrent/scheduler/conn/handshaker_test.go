@@ -25,6 +25,7 @@ import (
 	"github.com/uber/kraken/gen/go/proto/p2p"
 	"github.com/uber/kraken/lib/torrent/storage"
 	"github.com/uber/kraken/utils/bitsetutil"
+	"github.com/willf/bitset"
 )
 
 func TestHandshakerSetsConnFieldsProperly(t *testing.T) {
@@ -125,3 +126,195 @@ func TestHandshakerHandlesEmptyBitfield(t *testing.T) {
 
 	wg.Wait()
 }
+
+func TestHandshakerNegotiatesCapabilities(t *testing.T) {
+	disabled := ConfigFixture()
+	disabled.DisablePieceDigests = true
+
+	tests := []struct {
+		desc         string
+		config1      Config
+		config2      Config
+		expectDigest bool
+	}{
+		{"both peers support", ConfigFixture(), ConfigFixture(), true},
+		{"acceptor does not support", disabled, ConfigFixture(), false},
+		{"initiator does not support", ConfigFixture(), disabled, false},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+
+			l1, err := net.Listen("tcp", "localhost:0")
+			require.NoError(err)
+			defer l1.Close()
+
+			h1 := HandshakerFixture(test.config1)
+			h2 := HandshakerFixture(test.config2)
+			info := storage.TorrentInfoFixture(4, 1)
+
+			errc := make(chan error, 1)
+			conns := make(chan *Conn, 1)
+			go func() {
+				nc, err := l1.Accept()
+				if err != nil {
+					errc <- err
+					return
+				}
+				pc, err := h1.Accept(nc)
+				if err != nil {
+					errc <- err
+					return
+				}
+				c, err := h1.Establish(pc, info, make(RemoteBitfields))
+				if err != nil {
+					errc <- err
+					return
+				}
+				conns <- c
+			}()
+
+			r, err := h2.Initialize(h1.peerID, l1.Addr().String(), info, make(RemoteBitfields), "")
+			require.NoError(err)
+			defer r.Conn.Close()
+
+			select {
+			case err := <-errc:
+				require.FailNow(err.Error())
+			case c := <-conns:
+				defer c.Close()
+				require.Equal(test.expectDigest, c.Supports(PieceDigests))
+			}
+			require.Equal(test.expectDigest, r.Conn.Supports(PieceDigests))
+		})
+	}
+}
+
+func TestHandshakerCountsUnknownCapabilities(t *testing.T) {
+	require := require.New(t)
+
+	nc, _ := net.Pipe()
+	defer nc.Close()
+
+	remote := newCapabilities([]string{string(PieceDigests), "from_a_newer_version"})
+	c, err := HandshakerFixture(ConfigFixture()).newConn(
+		noopDeadline{nc}, core.PeerIDFixture(), storage.TorrentInfoFixture(1, 1), false, remote)
+	require.NoError(err)
+
+	require.True(c.Supports(PieceDigests))
+	require.False(c.Supports(Capability("from_a_newer_version")))
+	require.Equal(1, c.UnknownCapabilities())
+}
+
+func TestKnownCapabilities(t *testing.T) {
+	require := require.New(t)
+
+	known := KnownCapabilities()
+	require.Contains(known, PieceDigests)
+	require.Contains(known, CompressLZ4)
+	require.Len(known, len(Config{}.capabilities()))
+	require.Equal(0, Config{}.capabilities().numUnknown())
+}
+
+func TestHandshakerCompactsBitfieldOfAcceptor(t *testing.T) {
+	disabled := ConfigFixture()
+	disabled.DisableCompactBitfield = true
+
+	mi := core.SizedBlobFixture(4, 1).MetaInfo
+
+	tests := []struct {
+		desc          string
+		config1       Config
+		config2       Config
+		bitfield      *bitset.BitSet
+		expectSupport bool
+	}{
+		{"have all", ConfigFixture(), ConfigFixture(), bitsetutil.FromBools(true, true, true, true), true},
+		{"have none", ConfigFixture(), ConfigFixture(), bitsetutil.FromBools(false, false, false, false), true},
+		{"have some", ConfigFixture(), ConfigFixture(), bitsetutil.FromBools(true, false, true, false), true},
+		{"acceptor does not support", disabled, ConfigFixture(), bitsetutil.FromBools(true, true, true, true), false},
+		{"initiator does not support", ConfigFixture(), disabled, bitsetutil.FromBools(true, true, true, true), false},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+
+			l1, err := net.Listen("tcp", "localhost:0")
+			require.NoError(err)
+			defer l1.Close()
+
+			h1 := HandshakerFixture(test.config1)
+			h2 := HandshakerFixture(test.config2)
+			info := storage.NewTorrentInfo(mi, test.bitfield)
+
+			errc := make(chan error, 1)
+			conns := make(chan *Conn, 1)
+			go func() {
+				nc, err := l1.Accept()
+				if err != nil {
+					errc <- err
+					return
+				}
+				pc, err := h1.Accept(nc)
+				if err != nil {
+					errc <- err
+					return
+				}
+				c, err := h1.Establish(pc, info, make(RemoteBitfields))
+				if err != nil {
+					errc <- err
+					return
+				}
+				conns <- c
+			}()
+
+			r, err := h2.Initialize(h1.peerID, l1.Addr().String(), info, make(RemoteBitfields), "")
+			require.NoError(err)
+			defer r.Conn.Close()
+
+			select {
+			case err := <-errc:
+				require.FailNow(err.Error())
+			case c := <-conns:
+				defer c.Close()
+			}
+			require.Equal(test.bitfield, r.Bitfield)
+			require.Equal(test.expectSupport, r.Conn.Supports(CompactBitfield))
+		})
+	}
+}
+
+func TestHandshakeCompactBitfieldMessage(t *testing.T) {
+	tests := []struct {
+		desc     string
+		bitfield *bitset.BitSet
+		have     p2p.BitfieldMessage_Have
+	}{
+		{"have all", bitsetutil.FromBools(true, true, true), p2p.BitfieldMessage_HAVE_ALL},
+		{"have none", bitsetutil.FromBools(false, false, false), p2p.BitfieldMessage_HAVE_NONE},
+		{"have some", bitsetutil.FromBools(false, true, false), p2p.BitfieldMessage_BITFIELD},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+
+			hs := &handshake{
+				peerID:          core.PeerIDFixture(),
+				digest:          core.DigestFixture(),
+				infoHash:        core.InfoHashFixture(),
+				bitfield:        test.bitfield,
+				remoteBitfields: make(RemoteBitfields),
+			}
+			msg, err := hs.toP2PMessage(true)
+			require.NoError(err)
+			require.Equal(test.have, msg.Bitfield.Have)
+			if test.have != p2p.BitfieldMessage_BITFIELD {
+				require.Empty(msg.Bitfield.BitfieldBytes)
+			}
+
+			result, err := handshakeFromP2PMessage(msg)
+			require.NoError(err)
+			require.Equal(test.bitfield, result.bitfield)
+		})
+	}
+}
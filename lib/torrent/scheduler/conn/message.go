@@ -15,6 +15,7 @@ package conn
 
 import (
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"net"
@@ -23,6 +24,7 @@ import (
 	"github.com/golang/protobuf/proto"
 	"github.com/uber/kraken/gen/go/proto/p2p"
 	"github.com/uber/kraken/lib/torrent/storage"
+	"github.com/willf/bitset"
 )
 
 // Message joins a protobuf message with an optional payload. The only p2p.Message
@@ -30,16 +32,27 @@ import (
 type Message struct {
 	Message *p2p.Message
 	Payload storage.PieceReader
+
+	// DigestMismatch marks received piece payloads which were discarded because
+	// their digest did not match the expected digest of the piece. Payload is
+	// nil for such messages.
+	DigestMismatch bool
 }
 
 // NewPiecePayloadMessage returns a Message for sending a piece payload.
 func NewPiecePayloadMessage(index int, pr storage.PieceReader) *Message {
+	return NewPieceChunkPayloadMessage(index, 0, pr)
+}
+
+// NewPieceChunkPayloadMessage returns a Message for sending the payload of a
+// piece chunk starting at offset.
+func NewPieceChunkPayloadMessage(index int, offset int64, pr storage.PieceReader) *Message {
 	return &Message{
 		Message: &p2p.Message{
 			Type: p2p.Message_PIECE_PAYLOAD,
 			PiecePayload: &p2p.PiecePayloadMessage{
 				Index:  int32(index),
-				Offset: 0,
+				Offset: int32(offset),
 				Length: int32(pr.Length()),
 			},
 		},
@@ -49,18 +62,47 @@ func NewPiecePayloadMessage(index int, pr storage.PieceReader) *Message {
 
 // NewPieceRequestMessage returns a Message for requesting a piece.
 func NewPieceRequestMessage(index int, length int64) *Message {
+	return NewPieceChunkRequestMessage(index, 0, length)
+}
+
+// NewPieceChunkRequestMessage returns a Message for requesting the chunk of a
+// piece at offset.
+func NewPieceChunkRequestMessage(index int, offset, length int64) *Message {
 	return &Message{
 		Message: &p2p.Message{
 			Type: p2p.Message_PIECE_REQUEST,
 			PieceRequest: &p2p.PieceRequestMessage{
 				Index:  int32(index),
-				Offset: 0,
+				Offset: int32(offset),
 				Length: int32(length),
 			},
 		},
 	}
 }
 
+// NewPriorityPieceChunkRequestMessage returns a Message for requesting the
+// chunk of a piece at offset urgently. Only for peers which support
+// PriorityRequests.
+func NewPriorityPieceChunkRequestMessage(index int, offset, length int64) *Message {
+	msg := NewPieceChunkRequestMessage(index, offset, length)
+	msg.Message.PieceRequest.Priority = true
+	return msg
+}
+
+// NewPieceRequestsMessage returns a Message for requesting the pieces or chunks
+// of requests at once. Must only be sent over Conns which support
+// BatchRequests.
+func NewPieceRequestsMessage(requests []*p2p.PieceRequestMessage) *Message {
+	return &Message{
+		Message: &p2p.Message{
+			Type: p2p.Message_PIECE_REQUESTS,
+			PieceRequests: &p2p.PieceRequestsMessage{
+				Requests: requests,
+			},
+		},
+	}
+}
+
 // NewErrorMessage returns a Message for indicating an error.
 func NewErrorMessage(index int, code p2p.ErrorMessage_ErrorCode, err error) *Message {
 	return &Message{
@@ -75,6 +117,17 @@ func NewErrorMessage(index int, code p2p.ErrorMessage_ErrorCode, err error) *Mes
 	}
 }
 
+// NewRetryErrorMessage returns a Message for rejecting a piece request
+// transiently, hinting that the piece may be requested again after retryAfter.
+// The hint must only be set for Conns which support RetryAfter.
+func NewRetryErrorMessage(index int, err error, retryAfter time.Duration) *Message {
+	msg := NewErrorMessage(index, p2p.ErrorMessage_PIECE_REQUEST_RETRY, err)
+	if retryAfter > 0 {
+		msg.Message.Error.RetryAfterMillis = int32(retryAfter / time.Millisecond)
+	}
+	return msg
+}
+
 // NewAnnouncePieceMessage returns a Message for announcing a piece.
 func NewAnnouncePieceMessage(index int) *Message {
 	return &Message{
@@ -87,6 +140,75 @@ func NewAnnouncePieceMessage(index int) *Message {
 	}
 }
 
+// NewAnnouncePiecesMessage returns a Message for announcing all pieces set in
+// b at once. Must only be sent over Conns which support AnnouncePieces.
+func NewAnnouncePiecesMessage(b *bitset.BitSet) (*Message, error) {
+	bb, err := b.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return &Message{
+		Message: &p2p.Message{
+			Type: p2p.Message_ANNOUNCE_PIECES,
+			AnnouncePieces: &p2p.AnnouncePiecesMessage{
+				BitfieldBytes: bb,
+			},
+		},
+	}, nil
+}
+
+// NewCancelPieceMessage returns a Message for cancelling a piece request.
+func NewCancelPieceMessage(index int) *Message {
+	return &Message{
+		Message: &p2p.Message{
+			Type: p2p.Message_CANCEL_PIECE,
+			CancelPiece: &p2p.CancelPieceMessage{
+				Index: int32(index),
+			},
+		},
+	}
+}
+
+// NewChokeMessage returns a Message for notifying a peer that its piece
+// requests are no longer served. Must only be sent over Conns which support
+// Choke.
+func NewChokeMessage() *Message {
+	return &Message{
+		Message: &p2p.Message{
+			Type: p2p.Message_CHOKE,
+		},
+	}
+}
+
+// NewUnchokeMessage returns a Message for notifying a peer that its piece
+// requests are served again. Must only be sent over Conns which support Choke.
+func NewUnchokeMessage() *Message {
+	return &Message{
+		Message: &p2p.Message{
+			Type: p2p.Message_UNCHOKE,
+		},
+	}
+}
+
+// NewKeepaliveMessage returns a Message for probing whether a peer is alive.
+// Must only be sent over Conns which support Keepalive.
+func NewKeepaliveMessage() *Message {
+	return &Message{
+		Message: &p2p.Message{
+			Type: p2p.Message_KEEPALIVE,
+		},
+	}
+}
+
+// NewKeepaliveAckMessage returns a Message for answering a keepalive probe.
+func NewKeepaliveAckMessage() *Message {
+	return &Message{
+		Message: &p2p.Message{
+			Type: p2p.Message_KEEPALIVE_ACK,
+		},
+	}
+}
+
 // NewCompleteMessage returns a Message for a completed torrent.
 func NewCompleteMessage() *Message {
 	return &Message{
@@ -96,6 +218,17 @@ func NewCompleteMessage() *Message {
 	}
 }
 
+// pieceDigest formats the digest of a piece as the digest of a
+// PiecePayloadMessage.
+func pieceDigest(digest []byte) string {
+	return hex.EncodeToString(digest)
+}
+
+// messageSize returns the number of bytes sendMessage writes for msg.
+func messageSize(msg *p2p.Message) int {
+	return 4 + proto.Size(msg)
+}
+
 func sendMessage(nc net.Conn, msg *p2p.Message) error {
 	data, err := proto.Marshal(msg)
 	if err != nil {
@@ -0,0 +1,190 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package conn
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+
+	"github.com/uber/kraken/gen/go/proto/p2p"
+)
+
+// QueueStats describes the messages queued in one direction of a Conn, i.e.
+// messages which were sent but not yet written to the socket, or which were
+// read from the socket but not yet received.
+type QueueStats struct {
+	Messages int
+	Bytes    int64 // Includes message framing and piece payloads.
+
+	// Age of the oldest queued message, and of the oldest queued message which
+	// is not a piece payload. Zero if no such message is queued.
+	OldestAge        time.Duration
+	OldestControlAge time.Duration
+}
+
+type queuedMessage struct {
+	queuedAt time.Time
+	size     int64
+	control  bool
+}
+
+// queueEntry records a message pushed onto a messageQueue.
+type queueEntry struct {
+	seq      int64 // Number of messages pushed before the message.
+	bytes    int64 // Number of bytes pushed before the message.
+	queuedAt time.Time
+}
+
+// entryRing retains the most recently pushed entries, up to a fixed capacity.
+// Entries are ordered by seq.
+type entryRing struct {
+	entries []queueEntry
+	start   int
+	len     int
+}
+
+func newEntryRing(capacity int) *entryRing {
+	return &entryRing{entries: make([]queueEntry, capacity)}
+}
+
+// at returns the i-th oldest retained entry.
+func (r *entryRing) at(i int) queueEntry {
+	return r.entries[(r.start+i)%len(r.entries)]
+}
+
+// push adds e, evicting the oldest entry if r is full.
+func (r *entryRing) push(e queueEntry) {
+	if len(r.entries) == 0 {
+		return
+	}
+	if r.len == len(r.entries) {
+		r.start = (r.start + 1) % len(r.entries)
+		r.len--
+	}
+	r.entries[(r.start+r.len)%len(r.entries)] = e
+	r.len++
+}
+
+// pop removes the most recently pushed entry.
+func (r *entryRing) pop() {
+	if r.len > 0 {
+		r.len--
+	}
+}
+
+// first returns the oldest retained entry whose seq is at least seq.
+func (r *entryRing) first(seq int64) (queueEntry, bool) {
+	i := sort.Search(r.len, func(i int) bool { return r.at(i).seq >= seq })
+	if i == r.len {
+		return queueEntry{}, false
+	}
+	return r.at(i), true
+}
+
+// messageQueue tracks when the messages of a channel were queued. Since
+// channels are FIFO, the messages still queued are always the most recently
+// pushed ones, so messageQueue need not observe messages leaving the channel.
+// Only as many messages as the channel can buffer are retained.
+type messageQueue struct {
+	clk clock.Clock
+
+	mu       sync.Mutex // Protects the following fields:
+	pushed   int64      // Number of messages ever pushed.
+	bytes    int64      // Number of bytes ever pushed.
+	all      *entryRing
+	controls *entryRing // Control messages only.
+}
+
+// newMessageQueue creates a messageQueue for a channel which buffers at most
+// capacity messages.
+func newMessageQueue(clk clock.Clock, capacity int) *messageQueue {
+	return &messageQueue{
+		clk:      clk,
+		all:      newEntryRing(capacity),
+		controls: newEntryRing(capacity),
+	}
+}
+
+// newQueuedMessage describes msg before it is queued. Must not be called once
+// msg was queued, since msg is modified before it is written.
+func newQueuedMessage(msg *Message, now time.Time) queuedMessage {
+	e := queuedMessage{
+		queuedAt: now,
+		size:     int64(messageSize(msg.Message)),
+		control:  msg.Message.Type != p2p.Message_PIECE_PAYLOAD,
+	}
+	if !e.control && msg.Payload != nil {
+		e.size += int64(msg.Payload.Length())
+	}
+	return e
+}
+
+// push records that m was queued, and then calls send if not nil, forgetting m
+// if send fails. Pushes are serialized, so as long as send does not block,
+// concurrent pushes are recorded in the order in which they were sent.
+func (q *messageQueue) push(m queuedMessage, send func() error) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	e := queueEntry{seq: q.pushed, bytes: q.bytes, queuedAt: m.queuedAt}
+	q.all.push(e)
+	if m.control {
+		q.controls.push(e)
+	}
+	q.pushed++
+	q.bytes += m.size
+
+	if send == nil {
+		return nil
+	}
+	if err := send(); err != nil {
+		q.all.pop()
+		if m.control {
+			q.controls.pop()
+		}
+		q.pushed--
+		q.bytes -= m.size
+		return err
+	}
+	return nil
+}
+
+// stats returns the stats of the given number of most recently queued
+// messages.
+func (q *messageQueue) stats(queued int) QueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if queued > q.all.len {
+		queued = q.all.len
+	}
+	if queued == 0 {
+		return QueueStats{}
+	}
+	now := q.clk.Now()
+	since := q.pushed - int64(queued)
+	oldest, _ := q.all.first(since)
+	s := QueueStats{
+		Messages:  queued,
+		Bytes:     q.bytes - oldest.bytes,
+		OldestAge: now.Sub(oldest.queuedAt),
+	}
+	if e, ok := q.controls.first(since); ok {
+		s.OldestControlAge = now.Sub(e.queuedAt)
+	}
+	return s
+}
@@ -0,0 +1,98 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package conn
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMessageQueueRetainsAtMostCapacity(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+	q := newMessageQueue(clk, 4)
+
+	for i := 0; i < 100; i++ {
+		require.NoError(q.push(queuedMessage{clk.Now(), int64(i), i%2 == 0}, nil))
+		clk.Add(time.Second)
+	}
+	require.Equal(4, q.all.len)
+	require.Len(q.all.entries, 4)
+
+	// The 3 most recent messages are 97, 98 and 99.
+	s := q.stats(3)
+	require.Equal(3, s.Messages)
+	require.Equal(int64(97+98+99), s.Bytes)
+	require.Equal(3*time.Second, s.OldestAge)
+	require.Equal(2*time.Second, s.OldestControlAge)
+
+	// Cannot report more messages than retained.
+	require.Equal(4, q.stats(10).Messages)
+
+	require.Equal(QueueStats{}, q.stats(0))
+}
+
+func TestMessageQueueForgetsFailedSends(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+	q := newMessageQueue(clk, 4)
+
+	require.NoError(q.push(queuedMessage{clk.Now(), 1, false}, func() error { return nil }))
+	clk.Add(time.Second)
+	err := errors.New("some error")
+	require.Equal(err, q.push(queuedMessage{clk.Now(), 2, true}, func() error { return err }))
+
+	s := q.stats(1)
+	require.Equal(int64(1), s.Bytes)
+	require.Equal(time.Second, s.OldestAge)
+	require.Equal(time.Duration(0), s.OldestControlAge)
+}
+
+func TestMessageQueueRecordsConcurrentPushesInSendOrder(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+	q := newMessageQueue(clk, 1000)
+	c := make(chan int64, 1000)
+
+	var wg sync.WaitGroup
+	for i := 1; i <= 1000; i++ {
+		wg.Add(1)
+		go func(size int64) {
+			defer wg.Done()
+			q.push(queuedMessage{clk.Now(), size, false}, func() error {
+				c <- size
+				return nil
+			})
+		}(int64(i))
+	}
+	wg.Wait()
+
+	// Drain the channel, checking the bytes of the messages still queued.
+	var remaining int64
+	for i := 1; i <= 1000; i++ {
+		remaining += int64(i)
+	}
+	for len(c) > 0 {
+		require.Equal(remaining, q.stats(len(c)).Bytes)
+		remaining -= <-c
+	}
+}
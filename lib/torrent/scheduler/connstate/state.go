@@ -126,6 +126,15 @@ func (s *State) ActiveConns() []*conn.Conn {
 	return active
 }
 
+// ActiveConn returns the active connection of peerID/h, if any.
+func (s *State) ActiveConn(peerID core.PeerID, h core.InfoHash) (*conn.Conn, bool) {
+	e := s.get(h, peerID)
+	if e.status != _active {
+		return nil, false
+	}
+	return e.conn, true
+}
+
 // Saturated returns true if h is at capacity and all the conns are active.
 func (s *State) Saturated(h core.InfoHash) bool {
 	peers, ok := s.conns[h]
@@ -157,7 +166,8 @@ func (s *State) Blacklist(peerID core.PeerID, h core.InfoHash) error {
 	s.log("peer", peerID, "hash", h).Infof(
 		"Connection blacklisted for %s", s.config.BlacklistDuration)
 	s.netevents.Produce(
-		networkevent.BlacklistConnEvent(h, s.localPeerID, peerID, s.config.BlacklistDuration))
+		networkevent.BlacklistConnEvent(
+			h, s.localPeerID, peerID, s.config.BlacklistDuration).At(s.clk.Now()))
 
 	return nil
 }
@@ -222,7 +232,8 @@ func (s *State) MovePendingToActive(c *conn.Conn) error {
 	s.put(c.InfoHash(), c.PeerID(), entry{status: _active, conn: c})
 
 	s.log("hash", c.InfoHash(), "peer", c.PeerID()).Info("Moved conn from pending to active")
-	s.netevents.Produce(networkevent.AddActiveConnEvent(c.InfoHash(), s.localPeerID, c.PeerID()))
+	s.netevents.Produce(networkevent.AddActiveConnEvent(
+		c.InfoHash(), s.localPeerID, c.PeerID()).At(s.clk.Now()))
 
 	return nil
 }
@@ -243,7 +254,7 @@ func (s *State) DeleteActive(c *conn.Conn) {
 	s.log("hash", c.InfoHash(), "peer", c.PeerID()).Infof(
 		"Deleted active conn, capacity now at %d", s.capacity(c.InfoHash()))
 	s.netevents.Produce(networkevent.DropActiveConnEvent(
-		c.InfoHash(), s.localPeerID, c.PeerID()))
+		c.InfoHash(), s.localPeerID, c.PeerID()).At(s.clk.Now()))
 }
 
 func (s *State) numMutualConns(h core.InfoHash, neighbors []core.PeerID) int {
@@ -223,6 +223,31 @@ func TestStateDeleteActiveNoopsWhenConnIsNotActive(t *testing.T) {
 	require.Equal(ErrTorrentAtCapacity, s.AddPending(core.PeerIDFixture(), c.InfoHash(), nil))
 }
 
+func TestStateActiveConn(t *testing.T) {
+	require := require.New(t)
+
+	s := testState(Config{}, clock.New())
+
+	c, cleanup := conn.Fixture()
+	defer cleanup()
+
+	_, ok := s.ActiveConn(c.PeerID(), c.InfoHash())
+	require.False(ok)
+
+	require.NoError(s.AddPending(c.PeerID(), c.InfoHash(), nil))
+	_, ok = s.ActiveConn(c.PeerID(), c.InfoHash())
+	require.False(ok)
+
+	require.NoError(s.MovePendingToActive(c))
+	active, ok := s.ActiveConn(c.PeerID(), c.InfoHash())
+	require.True(ok)
+	require.Equal(c, active)
+
+	s.DeleteActive(c)
+	_, ok = s.ActiveConn(c.PeerID(), c.InfoHash())
+	require.False(ok)
+}
+
 func TestStateActiveConns(t *testing.T) {
 	require := require.New(t)
 
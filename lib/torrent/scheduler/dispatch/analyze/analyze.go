@@ -0,0 +1,282 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package analyze replays recorded piece request lifecycles through alternative
+// dispatcher configurations, projecting how long downloads would have taken, how
+// many duplicate bytes endgame would have cost, and how many requests would have
+// been resent. Piece selection and request expiry reuse the piece request
+// bookkeeping of Dispatchers on a mock clock, so projections only differ from
+// production in how peers are modeled: every peer is assumed to have every
+// piece, and to take as long to deliver it as recorded.
+package analyze
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/torrent/scheduler/dispatch"
+	"github.com/uber/kraken/lib/torrent/scheduler/dispatch/piecerequest"
+	"github.com/uber/kraken/utils/syncutil"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/willf/bitset"
+)
+
+// _stallLimit is how long a replayed download may go without receiving a piece
+// before it is considered to never complete.
+const _stallLimit = time.Hour
+
+// Result is the projected outcome of replaying recordings under Config.
+type Result struct {
+	Config dispatch.Config
+
+	// Duration is the total projected duration of the downloads which completed.
+	Duration time.Duration
+
+	// Delta is the difference between the projected and recorded durations of
+	// the downloads which completed in both, i.e. negative if Config is faster
+	// than the recorded configuration.
+	Delta time.Duration
+
+	// DuplicateBytes is the number of bytes received for pieces which were
+	// already received. It is an upper bound, since peers are assumed to serve
+	// superseded requests regardless of cancellation.
+	DuplicateBytes int64
+
+	// Resends is the number of failed requests which were resent.
+	Resends int
+
+	// Incomplete is the number of downloads which did not complete.
+	Incomplete int
+}
+
+// better returns whether r is preferable to o: fewer incomplete downloads,
+// then faster downloads, then fewer duplicate bytes, then fewer resends.
+func (r Result) better(o Result) bool {
+	if r.Incomplete != o.Incomplete {
+		return r.Incomplete < o.Incomplete
+	}
+	if r.Duration != o.Duration {
+		return r.Duration < o.Duration
+	}
+	if r.DuplicateBytes != o.DuplicateBytes {
+		return r.DuplicateBytes < o.DuplicateBytes
+	}
+	return r.Resends < o.Resends
+}
+
+// Report holds the Results of all analyzed configurations, best first.
+type Report struct {
+	Results []Result
+}
+
+// Best returns the recommended configuration.
+func (r *Report) Best() Result {
+	return r.Results[0]
+}
+
+// Analyze replays recordings under every configuration of matrix, and ranks the
+// configurations by their projected Results. Configurations which tie keep
+// their order in matrix.
+func Analyze(recordings []*Recording, matrix []dispatch.Config) (*Report, error) {
+	if len(recordings) == 0 {
+		return nil, errors.New("no recordings")
+	}
+	if len(matrix) == 0 {
+		return nil, errors.New("no configurations")
+	}
+	report := &Report{}
+	for _, config := range matrix {
+		result := Result{Config: config}
+		for _, r := range recordings {
+			p, err := replay(r, config)
+			if err != nil {
+				return nil, fmt.Errorf("replay torrent %s of %s: %s", r.Torrent, r.Self, err)
+			}
+			result.DuplicateBytes += p.duplicateBytes
+			result.Resends += p.resends
+			if !p.complete {
+				result.Incomplete++
+				continue
+			}
+			result.Duration += p.duration
+			if recorded, ok := r.Duration(); ok {
+				result.Delta += p.duration - recorded
+			}
+		}
+		report.Results = append(report.Results, result)
+	}
+	sort.SliceStable(report.Results, func(i, j int) bool {
+		return report.Results[i].better(report.Results[j])
+	})
+	return report, nil
+}
+
+// projection is the projected outcome of replaying a single Recording.
+type projection struct {
+	complete       bool
+	duration       time.Duration
+	duplicateBytes int64
+	resends        int
+}
+
+// replayClock is a clock which replay advances directly. Unlike clock.Mock, it
+// does not yield on every advance, which replays of long downloads cannot afford.
+// Timers are never used by piece request bookkeeping.
+type replayClock struct {
+	clock.Clock
+	now time.Time
+}
+
+func (c *replayClock) Now() time.Time { return c.now }
+
+// arrival is a piece delivery scheduled by replay.
+type arrival struct {
+	at    time.Time
+	peer  core.PeerID
+	piece int
+}
+
+// arrivals is a min-heap of arrivals by time.
+type arrivals []arrival
+
+func (a arrivals) Len() int            { return len(a) }
+func (a arrivals) Less(i, j int) bool  { return a[i].at.Before(a[j].at) }
+func (a arrivals) Swap(i, j int)       { a[i], a[j] = a[j], a[i] }
+func (a *arrivals) Push(x interface{}) { *a = append(*a, x.(arrival)) }
+
+func (a *arrivals) Pop() interface{} {
+	old := *a
+	x := old[len(old)-1]
+	*a = old[:len(old)-1]
+	return x
+}
+
+// replay simulates the download of r under config. Like Dispatchers, it requests
+// pieces from every peer at first, and then from peers which delivered a piece.
+// Every half request timeout, failed requests are resent to the fastest other
+// peer.
+func replay(r *Recording, config dispatch.Config) (projection, error) {
+	config = config.WithDefaults()
+	clk := &replayClock{Clock: clock.NewMock(), now: r.Start}
+	m, timeout, err := config.NewPieceRequestManager(clk, r.PieceLength)
+	if err != nil {
+		return projection{}, err
+	}
+	model := newPeerModel(r)
+
+	var peers []core.PeerID
+	names := make(map[core.PeerID]string)
+	for _, name := range r.Peers() {
+		peerID, err := core.NewPeerID(name)
+		if err != nil {
+			return projection{}, fmt.Errorf("peer %q: %s", name, err)
+		}
+		peers = append(peers, peerID)
+		names[peerID] = name
+	}
+	byLatency := model.byLatency(peers, names)
+
+	missing := bitset.New(uint(r.NumPieces))
+	numPeersByPiece := syncutil.NewCounters(r.NumPieces)
+	for i := 0; i < r.NumPieces; i++ {
+		if !r.Have[i] {
+			missing.Set(uint(i))
+		}
+		numPeersByPiece.Set(i, len(peers))
+	}
+
+	var p projection
+	var pending arrivals
+	request := func(peerID core.PeerID, candidates *bitset.BitSet) (bool, error) {
+		pieces, err := m.ReservePieces(
+			peerID, candidates, numPeersByPiece, config.InEndgame(int(missing.Count())))
+		if err != nil {
+			return false, err
+		}
+		for _, i := range pieces {
+			if l, ok := model.latency(names[peerID], i); ok {
+				heap.Push(&pending, arrival{clk.Now().Add(l), peerID, i})
+			}
+		}
+		return len(pieces) > 0, nil
+	}
+
+	for _, peerID := range peers {
+		if _, err := request(peerID, missing); err != nil {
+			return projection{}, err
+		}
+	}
+	lastProgress := clk.Now()
+	nextCheck := clk.Now().Add(timeout / 2)
+	for missing.Any() {
+		next := nextCheck
+		if len(pending) > 0 && pending[0].at.Before(next) {
+			next = pending[0].at
+		}
+		if next.Sub(lastProgress) > _stallLimit {
+			return p, nil
+		}
+		clk.now = next
+
+		for len(pending) > 0 && !pending[0].at.After(clk.Now()) {
+			a := heap.Pop(&pending).(arrival)
+			if !missing.Test(uint(a.piece)) {
+				p.duplicateBytes += r.PieceLength
+				continue
+			}
+			m.RecordPieceReceived(a.peer, a.piece)
+			m.MarkComplete(a.piece)
+			missing.Clear(uint(a.piece))
+			lastProgress = clk.Now()
+			if _, err := request(a.peer, missing); err != nil {
+				return projection{}, err
+			}
+		}
+
+		if clk.Now().Before(nextCheck) {
+			continue
+		}
+		nextCheck = nextCheck.Add(timeout / 2)
+		m.NextRound()
+		for _, req := range m.GetFailedRequests() {
+			if !missing.Test(uint(req.Piece)) {
+				continue
+			}
+			p.resends++
+			if req.Status == piecerequest.StatusExpired {
+				m.RecordPieceFailed(req.PeerID, req.Piece)
+			}
+			for _, peerID := range byLatency {
+				if peerID == req.PeerID {
+					continue
+				}
+				ok, err := request(peerID, bitset.New(missing.Len()).Set(uint(req.Piece)))
+				if err != nil {
+					return projection{}, err
+				}
+				if ok {
+					break
+				}
+			}
+		}
+	}
+	p.complete = true
+	p.duration = clk.Now().Sub(r.Start)
+	return p, nil
+}
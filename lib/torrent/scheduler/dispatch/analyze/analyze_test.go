@@ -0,0 +1,257 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package analyze
+
+import (
+	"testing"
+	"time"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/torrent/networkevent"
+	"github.com/uber/kraken/lib/torrent/scheduler/dispatch"
+	"github.com/uber/kraken/lib/torrent/scheduler/dispatch/piecerequest"
+	"github.com/uber/kraken/utils/bitsetutil"
+
+	"github.com/stretchr/testify/require"
+)
+
+const _pieceLength = 1024
+
+// recorder records the network events of a synthetic download.
+type recorder struct {
+	h      core.InfoHash
+	self   core.PeerID
+	start  time.Time
+	events []*networkevent.Event
+}
+
+func newRecorder(have ...bool) *recorder {
+	r := &recorder{
+		h:     core.InfoHashFixture(),
+		self:  core.PeerIDFixture(),
+		start: time.Unix(1000, 0),
+	}
+	r.events = append(r.events, networkevent.AddTorrentEvent(
+		r.h, r.self, bitsetutil.FromBools(have...), 10).At(r.start))
+	return r
+}
+
+func (r *recorder) request(peer core.PeerID, piece int, at time.Duration) {
+	r.events = append(r.events, networkevent.RequestPieceEvent(
+		r.h, r.self, peer, piece, 1).At(r.start.Add(at)))
+}
+
+func (r *recorder) receive(peer core.PeerID, piece int, at time.Duration) {
+	r.events = append(r.events, networkevent.ReceivePieceEvent(
+		r.h, r.self, peer, piece).At(r.start.Add(at)))
+}
+
+func (r *recorder) complete(at time.Duration) {
+	r.events = append(r.events, networkevent.TorrentCompleteEvent(
+		r.h, r.self).At(r.start.Add(at)))
+}
+
+func (r *recorder) recordings(t *testing.T) []*Recording {
+	recordings, err := ParseEvents(r.events, _pieceLength)
+	require.NoError(t, err)
+	return recordings
+}
+
+func sequential(c dispatch.Config) dispatch.Config {
+	c.PieceRequestPolicy = piecerequest.SequentialPolicy
+	return c
+}
+
+func TestParseEvents(t *testing.T) {
+	require := require.New(t)
+
+	r := newRecorder(true, false, false)
+	p1 := core.PeerIDFixture()
+	p2 := core.PeerIDFixture()
+	r.request(p1, 1, 0)
+	r.request(p2, 2, 0)
+	r.request(p1, 1, time.Second)
+	r.receive(p1, 1, 3*time.Second)
+	r.complete(4 * time.Second)
+
+	// Seeders request no pieces and are skipped.
+	seeder := newRecorder(true, true, true)
+	events := append(r.events, seeder.events...)
+
+	recordings, err := ParseEvents(events, _pieceLength)
+	require.NoError(err)
+	require.Len(recordings, 1)
+
+	rec := recordings[0]
+	require.Equal(r.h.String(), rec.Torrent)
+	require.Equal(r.self.String(), rec.Self)
+	require.Equal(3, rec.NumPieces)
+	require.Equal(int64(_pieceLength), rec.PieceLength)
+	require.Equal(map[int]bool{0: true}, rec.Have)
+	require.Equal([]string{p1.String(), p2.String()}, rec.Peers())
+
+	d, ok := rec.Duration()
+	require.True(ok)
+	require.Equal(4*time.Second, d)
+
+	// Receipts are matched to the earliest unanswered request.
+	require.Equal([]RequestSample{
+		{Peer: p1.String(), Piece: 1, SentAt: r.start, Latency: 3 * time.Second, Received: true},
+		{Peer: p2.String(), Piece: 2, SentAt: r.start},
+		{Peer: p1.String(), Piece: 1, SentAt: r.start.Add(time.Second)},
+	}, rec.Requests)
+}
+
+func TestParseEventsWithoutRequests(t *testing.T) {
+	_, err := ParseEvents(newRecorder(true).events, _pieceLength)
+	require.Error(t, err)
+}
+
+func TestAnalyzeRanksEndgameFirstWithStallingPeer(t *testing.T) {
+	require := require.New(t)
+
+	// stall never delivers, so piece 0 is only received once its request to
+	// stall expired and it was resent to fast.
+	r := newRecorder(false, false, false, false)
+	stall := core.PeerIDFixture()
+	fast := core.PeerIDFixture()
+	r.request(stall, 0, 0)
+	for i := 1; i < 4; i++ {
+		r.request(fast, i, 0)
+		r.receive(fast, i, 100*time.Millisecond)
+	}
+	r.request(fast, 0, 6*time.Second)
+	r.receive(fast, 0, 6*time.Second+100*time.Millisecond)
+	r.complete(6*time.Second + 100*time.Millisecond)
+
+	noEndgame := sequential(dispatch.Config{DisableEndgame: true})
+	endgame := sequential(dispatch.Config{EndgameThreshold: 4})
+
+	report, err := Analyze(r.recordings(t), []dispatch.Config{noEndgame, endgame})
+	require.NoError(err)
+	require.Len(report.Results, 2)
+
+	best := report.Best()
+	require.Equal(endgame, best.Config)
+	require.Equal(0, best.Incomplete)
+	require.Equal(200*time.Millisecond, best.Duration)
+	require.Equal(-5900*time.Millisecond, best.Delta)
+	require.Equal(0, best.Resends)
+
+	worst := report.Results[1]
+	require.Equal(noEndgame, worst.Config)
+	require.Equal(0, worst.Incomplete)
+	require.True(worst.Duration > best.Duration)
+	require.True(worst.Resends > 0)
+}
+
+func TestAnalyzeRanksDeeperPipelinesFirst(t *testing.T) {
+	require := require.New(t)
+
+	// A single peer answers each request after 100ms, one at a time.
+	r := newRecorder(make([]bool, 10)...)
+	p := core.PeerIDFixture()
+	for i := 0; i < 10; i++ {
+		at := time.Duration(i) * 100 * time.Millisecond
+		r.request(p, i, at)
+		r.receive(p, i, at+100*time.Millisecond)
+	}
+	r.complete(time.Second)
+
+	var matrix []dispatch.Config
+	for _, limit := range []int{1, 5, 2} {
+		matrix = append(matrix, sequential(dispatch.Config{
+			PipelineLimit:  limit,
+			DisableEndgame: true,
+		}))
+	}
+
+	report, err := Analyze(r.recordings(t), matrix)
+	require.NoError(err)
+
+	var limits []int
+	var durations []time.Duration
+	for _, result := range report.Results {
+		limits = append(limits, result.Config.PipelineLimit)
+		durations = append(durations, result.Duration)
+	}
+	require.Equal([]int{5, 2, 1}, limits)
+	require.Equal([]time.Duration{
+		200 * time.Millisecond, 500 * time.Millisecond, time.Second,
+	}, durations)
+	require.Equal(-800*time.Millisecond, report.Best().Delta)
+}
+
+func TestAnalyzeRanksNoEndgameFirstWithoutStragglers(t *testing.T) {
+	require := require.New(t)
+
+	// Both peers deliver every piece within 100ms, so endgame only wastes bytes.
+	r := newRecorder(make([]bool, 6)...)
+	p1 := core.PeerIDFixture()
+	p2 := core.PeerIDFixture()
+	for i := 0; i < 6; i++ {
+		p := p1
+		if i >= 3 {
+			p = p2
+		}
+		r.request(p, i, 0)
+		r.receive(p, i, 100*time.Millisecond)
+	}
+	r.complete(100 * time.Millisecond)
+
+	endgame := sequential(dispatch.Config{EndgameThreshold: 6})
+	noEndgame := sequential(dispatch.Config{DisableEndgame: true})
+
+	report, err := Analyze(r.recordings(t), []dispatch.Config{endgame, noEndgame})
+	require.NoError(err)
+
+	best := report.Best()
+	require.Equal(noEndgame, best.Config)
+	require.Equal(100*time.Millisecond, best.Duration)
+	require.Equal(time.Duration(0), best.Delta)
+	require.Equal(int64(0), best.DuplicateBytes)
+
+	require.Equal(endgame, report.Results[1].Config)
+	require.True(report.Results[1].DuplicateBytes > 0)
+}
+
+func TestAnalyzeCountsIncompleteDownloads(t *testing.T) {
+	require := require.New(t)
+
+	// The only peer never delivers.
+	r := newRecorder(false)
+	r.request(core.PeerIDFixture(), 0, 0)
+
+	report, err := Analyze(r.recordings(t), []dispatch.Config{{}})
+	require.NoError(err)
+	require.Equal(1, report.Best().Incomplete)
+	require.Equal(time.Duration(0), report.Best().Duration)
+}
+
+func TestAnalyzeErrors(t *testing.T) {
+	require := require.New(t)
+
+	r := newRecorder(false)
+	r.request(core.PeerIDFixture(), 0, 0)
+	recordings := r.recordings(t)
+
+	_, err := Analyze(nil, []dispatch.Config{{}})
+	require.Error(err)
+
+	_, err = Analyze(recordings, nil)
+	require.Error(err)
+
+	_, err = Analyze(recordings, []dispatch.Config{{PieceRequestPolicy: "invalid"}})
+	require.Error(err)
+}
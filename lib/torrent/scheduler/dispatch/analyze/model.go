@@ -0,0 +1,118 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package analyze
+
+import (
+	"sort"
+	"time"
+
+	"github.com/uber/kraken/core"
+)
+
+// peerModel predicts how long peers take to answer piece requests, based on
+// how long they took in a Recording.
+type peerModel struct {
+	// latencies holds the first observed latency of each piece of each peer.
+	latencies map[requestKey]time.Duration
+
+	// stalls holds pieces which peers were requested but never delivered,
+	// although nobody else delivered them for as long as the peer ever took.
+	stalls map[requestKey]bool
+
+	// typical holds the median latency of each peer, which is assumed for
+	// pieces the peer was never requested. Peers which never delivered any
+	// piece are absent, and are assumed to never deliver.
+	typical map[string]time.Duration
+}
+
+func newPeerModel(r *Recording) *peerModel {
+	m := &peerModel{
+		latencies: make(map[requestKey]time.Duration),
+		stalls:    make(map[requestKey]bool),
+		typical:   make(map[string]time.Duration),
+	}
+
+	// When each piece was first delivered by anyone.
+	receivedAt := make(map[int]time.Time)
+	observed := make(map[string][]time.Duration)
+	for _, s := range r.Requests {
+		if !s.Received {
+			continue
+		}
+		k := requestKey{s.Peer, s.Piece}
+		if _, ok := m.latencies[k]; !ok {
+			m.latencies[k] = s.Latency
+		}
+		observed[s.Peer] = append(observed[s.Peer], s.Latency)
+		at := s.SentAt.Add(s.Latency)
+		if t, ok := receivedAt[s.Piece]; !ok || at.Before(t) {
+			receivedAt[s.Piece] = at
+		}
+	}
+	for peer, ls := range observed {
+		sort.Slice(ls, func(i, j int) bool { return ls[i] < ls[j] })
+		m.typical[peer] = ls[len(ls)/2]
+	}
+
+	for _, s := range r.Requests {
+		k := requestKey{s.Peer, s.Piece}
+		if s.Received {
+			continue
+		}
+		if _, ok := m.latencies[k]; ok {
+			continue
+		}
+		ls, ok := observed[s.Peer]
+		if !ok {
+			continue
+		}
+		// Requests superseded by another peer delivering the piece first say
+		// nothing about the peer.
+		deadline := s.SentAt.Add(ls[len(ls)-1])
+		if t, ok := receivedAt[s.Piece]; ok && t.Before(deadline) {
+			continue
+		}
+		m.stalls[k] = true
+	}
+	return m
+}
+
+// latency returns how long peer takes to deliver piece. Returns false if peer
+// never delivers piece.
+func (m *peerModel) latency(peer string, piece int) (time.Duration, bool) {
+	k := requestKey{peer, piece}
+	if l, ok := m.latencies[k]; ok {
+		return l, true
+	}
+	if m.stalls[k] {
+		return 0, false
+	}
+	l, ok := m.typical[peer]
+	return l, ok
+}
+
+// byLatency orders peers by their typical latency, fastest first. Peers which
+// never deliver come last.
+func (m *peerModel) byLatency(peers []core.PeerID, names map[core.PeerID]string) []core.PeerID {
+	sorted := append([]core.PeerID(nil), peers...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		li, iok := m.typical[names[sorted[i]]]
+		lj, jok := m.typical[names[sorted[j]]]
+		if iok != jok {
+			return iok
+		}
+		return li < lj
+	})
+	return sorted
+}
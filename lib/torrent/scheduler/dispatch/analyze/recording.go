@@ -0,0 +1,172 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package analyze
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/uber/kraken/lib/torrent/networkevent"
+)
+
+// RequestSample is the lifecycle of a single piece request.
+type RequestSample struct {
+	Peer   string
+	Piece  int
+	SentAt time.Time
+
+	// Latency is the time from sending the request until the piece was received
+	// from Peer. Only set if Received is true.
+	Latency  time.Duration
+	Received bool
+}
+
+// Recording holds the piece request lifecycles of a single torrent download,
+// as seen by the downloading peer.
+type Recording struct {
+	Torrent string
+	Self    string
+
+	NumPieces   int
+	PieceLength int64
+
+	// Have holds pieces which the downloading peer had from the start.
+	Have map[int]bool
+
+	Start time.Time
+
+	// Complete is when the download completed. Zero if it never did.
+	Complete time.Time
+
+	Requests []RequestSample
+}
+
+// Duration returns how long the recorded download took. Returns false if the
+// download never completed.
+func (r *Recording) Duration() (time.Duration, bool) {
+	if r.Complete.IsZero() {
+		return 0, false
+	}
+	return r.Complete.Sub(r.Start), true
+}
+
+// Peers returns the peers which were sent requests, in order of their first
+// request.
+func (r *Recording) Peers() []string {
+	var peers []string
+	seen := make(map[string]bool)
+	for _, s := range r.Requests {
+		if !seen[s.Peer] {
+			seen[s.Peer] = true
+			peers = append(peers, s.Peer)
+		}
+	}
+	return peers
+}
+
+type recordingKey struct {
+	torrent string
+	self    string
+}
+
+type requestKey struct {
+	peer  string
+	piece int
+}
+
+// ParseEvents builds a Recording for every torrent download in events, which
+// are network events emitted by the downloading peers. Pieces are assumed to be
+// pieceLength bytes, since network events do not carry piece lengths.
+// Receipts are matched to the earliest unanswered request of the same piece to
+// the same peer, and requests which were never answered are recorded as such.
+func ParseEvents(events []*networkevent.Event, pieceLength int64) ([]*Recording, error) {
+	events = networkevent.Filter(
+		events,
+		networkevent.AddTorrent,
+		networkevent.RequestPiece,
+		networkevent.ReceivePiece,
+		networkevent.TorrentComplete)
+	networkevent.Sort(events)
+
+	var recordings []*Recording
+	byKey := make(map[recordingKey]*Recording)
+	unanswered := make(map[recordingKey]map[requestKey][]int)
+	for _, e := range events {
+		k := recordingKey{e.Torrent, e.Self}
+		r, ok := byKey[k]
+		if !ok {
+			r = &Recording{
+				Torrent:     e.Torrent,
+				Self:        e.Self,
+				PieceLength: pieceLength,
+				Have:        make(map[int]bool),
+				Start:       e.Time,
+			}
+			byKey[k] = r
+			unanswered[k] = make(map[requestKey][]int)
+			recordings = append(recordings, r)
+		}
+		switch e.Name {
+		case networkevent.AddTorrent:
+			r.Start = e.Time
+			r.NumPieces = len(e.Bitfield)
+			for i, has := range e.Bitfield {
+				if has {
+					r.Have[i] = true
+				}
+			}
+		case networkevent.RequestPiece:
+			rk := requestKey{e.Peer, e.Piece}
+			unanswered[k][rk] = append(unanswered[k][rk], len(r.Requests))
+			r.Requests = append(r.Requests, RequestSample{
+				Peer:   e.Peer,
+				Piece:  e.Piece,
+				SentAt: e.Time,
+			})
+		case networkevent.ReceivePiece:
+			rk := requestKey{e.Peer, e.Piece}
+			pending := unanswered[k][rk]
+			if len(pending) == 0 {
+				continue
+			}
+			s := &r.Requests[pending[0]]
+			s.Latency = e.Time.Sub(s.SentAt)
+			s.Received = true
+			unanswered[k][rk] = pending[1:]
+		case networkevent.TorrentComplete:
+			r.Complete = e.Time
+		}
+	}
+	// Seeders never request pieces, so there is nothing to replay for them.
+	var downloads []*Recording
+	for _, r := range recordings {
+		if len(r.Requests) == 0 {
+			continue
+		}
+		for _, s := range r.Requests {
+			if s.Piece >= r.NumPieces {
+				r.NumPieces = s.Piece + 1
+			}
+		}
+		downloads = append(downloads, r)
+	}
+	if len(downloads) == 0 {
+		return nil, errors.New("no piece requests in events")
+	}
+	sort.SliceStable(downloads, func(i, j int) bool {
+		return downloads[i].Start.Before(downloads[j].Start)
+	})
+	return downloads, nil
+}
@@ -0,0 +1,146 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/willf/bitset"
+)
+
+// announceCoalescer collects the pieces which peers announce to a Dispatcher
+// within a window, such that pieces announced by many peers at once, e.g. once
+// a popular piece finished at the origin, are requested in a single selection
+// pass over all announcers rather than a request cycle per announcement. Each
+// needed piece is requested from its least loaded announcer, i.e. the one with
+// the fewest pending requests.
+type announceCoalescer struct {
+	d      *Dispatcher
+	window time.Duration
+
+	mu      sync.Mutex // Protects the following fields:
+	pending map[int][]*peer
+	timer   *clock.Timer
+	closed  bool
+}
+
+func newAnnounceCoalescer(d *Dispatcher, window time.Duration) *announceCoalescer {
+	return &announceCoalescer{
+		d:       d,
+		window:  window,
+		pending: make(map[int][]*peer),
+	}
+}
+
+// add buffers piece i announced by p until the window elapses. Returns false if
+// i is not needed, in which case the announcement is handled as usual.
+func (c *announceCoalescer) add(p *peer, i int) bool {
+	if c.d.torrent.HasPiece(i) {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return false
+	}
+	for _, q := range c.pending[i] {
+		if q == p {
+			return true
+		}
+	}
+	c.pending[i] = append(c.pending[i], p)
+	c.d.stats.Counter("coalesced_announces").Inc(1)
+	if c.timer == nil {
+		c.timer = c.d.clk.AfterFunc(c.window, c.flush)
+	}
+	return true
+}
+
+// flush requests the pieces announced within the window in a single selection
+// pass.
+func (c *announceCoalescer) flush() {
+	c.mu.Lock()
+	pending := c.pending
+	c.pending = make(map[int][]*peer)
+	c.timer = nil
+	closed := c.closed
+	c.mu.Unlock()
+
+	if closed || len(pending) == 0 {
+		return
+	}
+	c.d.stats.Counter("announce_selection_passes").Inc(1)
+
+	pieces := make([]int, 0, len(pending))
+	for i := range pending {
+		pieces = append(pieces, i)
+	}
+	sort.Ints(pieces)
+
+	// Loads count the pending requests of announcers, including the pieces
+	// assigned to them in this pass.
+	loads := make(map[*peer]int)
+	assigned := make(map[*peer]*bitset.BitSet)
+	var order []*peer
+	for _, i := range pieces {
+		if c.d.torrent.HasPiece(i) {
+			continue
+		}
+		var best *peer
+		for _, p := range pending[i] {
+			if _, ok := loads[p]; !ok {
+				loads[p] = len(c.d.pieceRequestManager.PendingPieces(p.id))
+			}
+			if !c.d.pieceRequestManager.HasReservationRoom(p.id) {
+				continue
+			}
+			if best == nil || loads[p] < loads[best] {
+				best = p
+			}
+		}
+		if best == nil {
+			continue
+		}
+		b, ok := assigned[best]
+		if !ok {
+			b = bitset.New(uint(c.d.torrent.NumPieces()))
+			assigned[best] = b
+			order = append(order, best)
+		}
+		b.Set(uint(i))
+		loads[best]++
+	}
+	for _, p := range order {
+		c.d.maybeSendPieceRequests(p, assigned[p])
+	}
+}
+
+// close drops pending announcements, which are not worth requesting once d is
+// torn down.
+func (c *announceCoalescer) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closed = true
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	c.pending = nil
+}
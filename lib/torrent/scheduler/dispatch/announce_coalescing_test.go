@@ -0,0 +1,151 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/torrent/scheduler/conn"
+	"github.com/uber/kraken/lib/torrent/storage/agentstorage"
+	"github.com/uber/kraken/utils/bitsetutil"
+)
+
+// synchronizedAnnounces sets up peers with 2, 1 and 0 pending requests, which
+// then announce piece 0 at once. Returns the peers and the number of selection
+// passes caused by the announcements.
+func synchronizedAnnounces(
+	t *testing.T, window time.Duration) (tally.TestScope, []*peer, int64) {
+
+	require := require.New(t)
+
+	torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(4, 1).MetaInfo)
+	defer cleanup()
+
+	clk := clock.NewMock()
+	stats := tally.NewTestScope("", nil)
+	d := testDispatcher(Config{
+		PipelineLimit:          4,
+		AnnounceCoalesceWindow: window,
+		DisableEndgame:         true,
+		DisableKeepalive:       true,
+	}, clk, torrent)
+	d.stats = stats
+
+	var peers []*peer
+	for _, have := range [][]bool{
+		{false, true, true, false},
+		{false, false, false, true},
+		{false, false, false, false},
+	} {
+		p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(have...), newMockMessages())
+		require.NoError(err)
+		_, err = d.maybeRequestMorePieces(p)
+		require.NoError(err)
+		peers = append(peers, p)
+	}
+	passes := func() int64 {
+		return stats.Snapshot().Counters()["piece_selection_passes+"].Value()
+	}
+	before := passes()
+
+	for _, p := range peers {
+		require.NoError(d.dispatch(p, conn.NewAnnouncePieceMessage(0)))
+	}
+	clk.Add(window)
+
+	return stats, peers, passes() - before
+}
+
+func TestDispatcherCoalescesSynchronizedAnnounces(t *testing.T) {
+	for _, window := range []time.Duration{0, 10 * time.Millisecond} {
+		t.Run(fmt.Sprintf("window=%s", window), func(t *testing.T) {
+			require := require.New(t)
+
+			stats, peers, passes := synchronizedAnnounces(t, window)
+
+			var requestedFrom []int
+			for j, p := range peers {
+				for _, i := range requestedPieces(p.messages) {
+					if i == 0 {
+						requestedFrom = append(requestedFrom, j)
+					}
+				}
+			}
+			counters := stats.Snapshot().Counters()
+			if window == 0 {
+				// Each announcement causes a selection pass, and the first
+				// announcer is requested the piece regardless of its load.
+				require.Equal(int64(3), passes)
+				require.Equal([]int{0}, requestedFrom)
+				require.NotContains(counters, "announce_selection_passes+")
+				return
+			}
+			// All announcements are considered in one pass, which requests the
+			// piece from the least loaded announcer.
+			require.Equal(int64(1), passes)
+			require.Equal([]int{2}, requestedFrom)
+			require.Equal(int64(1), counters["announce_selection_passes+"].Value())
+			require.Equal(int64(3), counters["coalesced_announces+"].Value())
+		})
+	}
+}
+
+func TestAnnounceCoalescerSkipsPiecesWhichAreNotNeeded(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(2, 1)
+	torrent, cleanup := completeTorrentFixture(t, blob)
+	defer cleanup()
+
+	d := testDispatcher(Config{
+		AnnounceCoalesceWindow: time.Second,
+		DisableKeepalive:       true,
+	}, clock.NewMock(), torrent)
+
+	p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false, false), newMockMessages())
+	require.NoError(err)
+
+	require.False(d.coalescer.add(p, 0))
+	require.Empty(d.coalescer.pending)
+}
+
+func TestAnnounceCoalescerDropsPendingAnnouncesOnTearDown(t *testing.T) {
+	require := require.New(t)
+
+	torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(2, 1).MetaInfo)
+	defer cleanup()
+
+	clk := clock.NewMock()
+	d := testDispatcher(Config{
+		AnnounceCoalesceWindow: time.Second,
+		DisableKeepalive:       true,
+	}, clk, torrent)
+
+	p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false, false), newMockMessages())
+	require.NoError(err)
+
+	require.NoError(d.dispatch(p, conn.NewAnnouncePieceMessage(0)))
+	d.TearDown()
+	clk.Add(time.Second)
+
+	require.Empty(requestedPieces(p.messages))
+	require.False(d.coalescer.add(p, 1))
+}
@@ -0,0 +1,346 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/uber/kraken/lib/torrent/scheduler/conn"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/willf/bitset"
+	"golang.org/x/time/rate"
+)
+
+// AnnounceBudget limits the rate at which piece announcements are sent by all
+// Dispatchers which share it, e.g. all Dispatchers of an agent.
+type AnnounceBudget struct {
+	clk      clock.Clock
+	interval time.Duration
+	limiter  *rate.Limiter
+}
+
+// NewAnnounceBudget creates a new AnnounceBudget which allows messagesPerSec
+// announce messages per second, in bursts of at most burst messages.
+func NewAnnounceBudget(
+	clk clock.Clock, messagesPerSec float64, burst int) (*AnnounceBudget, error) {
+
+	if messagesPerSec <= 0 {
+		return nil, errors.New("messages per sec must be positive")
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &AnnounceBudget{
+		clk:      clk,
+		interval: time.Duration(float64(time.Second) / messagesPerSec),
+		limiter:  rate.NewLimiter(rate.Limit(messagesPerSec), burst),
+	}, nil
+}
+
+// allow returns true if a message may be sent now.
+func (b *AnnounceBudget) allow() bool {
+	return b.limiter.AllowN(b.clk.Now(), 1)
+}
+
+// announcer announces pieces to the peers of a Dispatcher within its
+// AnnounceBudget. Once the budget is exhausted, pieces announced to a peer are
+// coalesced until the budget allows a message to the peer, which then announces
+// all of them at once. Peers which do not support conn.AnnouncePieces are
+// instead sent one pending piece per message allowed by the budget. Peers are
+// sent coalesced announcements in the order their oldest pending piece was
+// announced. Without a budget, pieces are announced immediately.
+//
+// If batching is enabled, pieces announced to peers which support
+// conn.AnnouncePieces are always coalesced, and sent once batchSize pieces are
+// pending to the peer or batchInterval elapsed, whichever comes first. Batched
+// pieces are flushed on close, such that peers learn of the last pieces we
+// received.
+type announcer struct {
+	d             *Dispatcher
+	budget        *AnnounceBudget
+	batchInterval time.Duration
+	batchSize     int
+
+	mu         sync.Mutex // Protects the following fields:
+	pending    map[*peer]*bitset.BitSet
+	queue      []*peer
+	numPending int
+	timer      *clock.Timer
+	closed     bool
+}
+
+func newAnnouncer(
+	d *Dispatcher,
+	budget *AnnounceBudget,
+	batchInterval time.Duration,
+	batchSize int) *announcer {
+
+	return &announcer{
+		d:             d,
+		budget:        budget,
+		batchInterval: batchInterval,
+		batchSize:     batchSize,
+		pending:       make(map[*peer]*bitset.BitSet),
+	}
+}
+
+// batches returns true if pieces announced to p are batched.
+func (a *announcer) batches(p *peer) bool {
+	return a.batchInterval > 0 && p.messages.Supports(conn.AnnouncePieces)
+}
+
+// allow returns true if a message may be sent within the budget, if any.
+func (a *announcer) allow() bool {
+	return a.budget == nil || a.budget.allow()
+}
+
+// announce announces piece i to p, unless p is a seeder, p already has i, or i
+// is not advertised. Whether p has i is checked without
+// synchronizing with p announcing i to us, so p may still be announced pieces
+// which it is about to announce itself.
+func (a *announcer) announce(p *peer, i int) {
+	if p.completed.Load() {
+		a.countSuppressed("completed", 1)
+		return
+	}
+	if p.bitfield.Has(uint(i)) {
+		a.countSuppressed("has_piece", 1)
+		return
+	}
+	if !a.d.advertised(i) {
+		return
+	}
+	batch := a.batches(p)
+	if a.budget == nil && !batch {
+		a.d.send(p, conn.NewAnnouncePieceMessage(i))
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.closed || a.d.Complete() {
+		// Peers are sent complete messages instead.
+		return
+	}
+	b, ok := a.pending[p]
+	if ok {
+		if b.Test(uint(i)) {
+			return
+		}
+		b.Set(uint(i))
+	} else {
+		if !batch && a.budget.allow() {
+			a.d.send(p, conn.NewAnnouncePieceMessage(i))
+			return
+		}
+		b = bitset.New(uint(a.d.torrent.NumPieces())).Set(uint(i))
+		a.pending[p] = b
+		a.queue = append(a.queue, p)
+	}
+	a.numPending++
+	if batch && int(b.Count()) >= a.batchSize && a.allow() {
+		a.sendBatchLocked(p, "size")
+	}
+	a.updatePendingLocked()
+	if a.timer == nil && len(a.queue) > 0 {
+		interval := a.batchInterval
+		if !batch {
+			interval = a.budget.interval
+		}
+		a.timer = a.d.clk.AfterFunc(interval, a.flush)
+	}
+}
+
+func (a *announcer) flush() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.timer = nil
+	if a.closed {
+		return
+	}
+	for len(a.queue) > 0 && a.allow() {
+		p := a.queue[0]
+		a.queue = a.queue[1:]
+		b := a.pending[p]
+		a.excludeLocked(p, b)
+		if b.None() {
+			delete(a.pending, p)
+			continue
+		}
+		if b.Count() > 1 && !p.messages.Supports(conn.AnnouncePieces) {
+			i, _ := b.NextSet(0)
+			b.Clear(i)
+			a.numPending--
+			a.queue = append(a.queue, p)
+			a.d.send(p, conn.NewAnnouncePieceMessage(int(i)))
+			continue
+		}
+		if a.batches(p) {
+			a.countBatchFlush("timer")
+		}
+		delete(a.pending, p)
+		a.numPending -= int(b.Count())
+		a.sendLocked(p, b)
+	}
+	a.updatePendingLocked()
+	if len(a.queue) > 0 {
+		// Only the budget holds back pending pieces once flushed.
+		a.timer = a.d.clk.AfterFunc(a.budget.interval, a.flush)
+	}
+}
+
+// removeLocked removes p from the pending peers, returning the pieces pending
+// to p, if any.
+func (a *announcer) removeLocked(p *peer) (*bitset.BitSet, bool) {
+	b, ok := a.pending[p]
+	if !ok {
+		return nil, false
+	}
+	delete(a.pending, p)
+	for j, q := range a.queue {
+		if q == p {
+			a.queue = append(a.queue[:j], a.queue[j+1:]...)
+			break
+		}
+	}
+	a.numPending -= int(b.Count())
+	return b, true
+}
+
+// sendBatchLocked announces all pieces pending to p in a single message ahead
+// of the batch interval.
+func (a *announcer) sendBatchLocked(p *peer, trigger string) {
+	if b, ok := a.pending[p]; ok {
+		a.excludeLocked(p, b)
+	}
+	b, ok := a.removeLocked(p)
+	if !ok {
+		return
+	}
+	if b.Any() {
+		a.countBatchFlush(trigger)
+		a.sendLocked(p, b)
+	}
+}
+
+// countBatchFlush counts batches sent due to trigger, i.e. batch size, batch
+// interval or teardown.
+func (a *announcer) countBatchFlush(trigger string) {
+	a.d.stats.Tagged(map[string]string{
+		"trigger": trigger,
+	}).Counter("announce_batch_flushes").Inc(1)
+}
+
+// countSuppressed counts n announcements which were not sent since the peer
+// had no use for them, for reason.
+func (a *announcer) countSuppressed(reason string, n int) {
+	a.d.stats.Tagged(map[string]string{
+		"reason": reason,
+	}).Counter("suppressed_announces").Inc(int64(n))
+}
+
+// excludeLocked clears the pieces from b, pending to p, which are no longer
+// advertised, or which p gained while pending.
+func (a *announcer) excludeLocked(p *peer, b *bitset.BitSet) {
+	var suppressed int
+	for i, ok := b.NextSet(0); ok; i, ok = b.NextSet(i + 1) {
+		if !a.d.advertised(int(i)) {
+			b.Clear(i)
+			a.numPending--
+		} else if p.bitfield.Has(i) {
+			b.Clear(i)
+			a.numPending--
+			suppressed++
+		}
+	}
+	if suppressed > 0 {
+		a.countSuppressed("has_piece", suppressed)
+	}
+}
+
+// sendLocked announces all pieces set in b to p in a single message.
+func (a *announcer) sendLocked(p *peer, b *bitset.BitSet) {
+	if b.Count() == 1 {
+		i, _ := b.NextSet(0)
+		a.d.send(p, conn.NewAnnouncePieceMessage(int(i)))
+		return
+	}
+	msg, err := conn.NewAnnouncePiecesMessage(b)
+	if err != nil {
+		a.d.log("peer", p).Errorf("Error creating coalesced announce message: %s", err)
+		return
+	}
+	a.d.send(p, msg)
+	a.d.stats.Counter("coalesced_announce_messages").Inc(1)
+	a.d.useCapability(conn.AnnouncePieces)
+}
+
+// drop discards the pieces pending to p, e.g. once p was removed or notified
+// that we completed the torrent.
+func (a *announcer) drop(p *peer) {
+	if a.budget == nil && a.batchInterval == 0 {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, ok := a.removeLocked(p); ok {
+		a.updatePendingLocked()
+	}
+}
+
+// numPeers returns the number of peers with pending announcements.
+func (a *announcer) numPeers() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return len(a.pending)
+}
+
+// updatePendingLocked reports the number of announcements awaiting budget,
+// i.e. how much announcements are coalesced.
+func (a *announcer) updatePendingLocked() {
+	a.d.stats.Gauge("coalesced_announces").Update(float64(a.numPending))
+}
+
+// close stops all future announcements. Batched pieces are flushed regardless
+// of the budget, whereas other pending announcements are discarded.
+func (a *announcer) close() {
+	if a.budget == nil && a.batchInterval == 0 {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.closed = true
+	if a.timer != nil {
+		a.timer.Stop()
+		a.timer = nil
+	}
+	for _, p := range append([]*peer(nil), a.queue...) {
+		if a.batches(p) {
+			a.sendBatchLocked(p, "teardown")
+		} else {
+			a.removeLocked(p)
+		}
+	}
+	a.updatePendingLocked()
+}
@@ -0,0 +1,487 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"testing"
+	"time"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/gen/go/proto/p2p"
+	"github.com/uber/kraken/lib/torrent/scheduler/conn"
+	"github.com/uber/kraken/lib/torrent/storage/agentstorage"
+	"github.com/uber/kraken/lib/torrent/storage/piecereader"
+	"github.com/uber/kraken/utils/bitsetutil"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+	"github.com/willf/bitset"
+)
+
+// announcedBy returns the announce messages sent to p, and the pieces they
+// announced.
+func announcedBy(t *testing.T, p *peer) (int, []int) {
+	var n int
+	var pieces []int
+	for _, msg := range p.messages.(*mockMessages).getSent() {
+		switch msg.Message.Type {
+		case p2p.Message_ANNOUCE_PIECE:
+			n++
+			pieces = append(pieces, int(msg.Message.AnnouncePiece.Index))
+		case p2p.Message_ANNOUNCE_PIECES:
+			n++
+			b := bitset.New(0)
+			require.NoError(t, b.UnmarshalBinary(msg.Message.AnnouncePieces.BitfieldBytes))
+			for i, e := b.NextSet(0); e; i, e = b.NextSet(i + 1) {
+				pieces = append(pieces, int(i))
+			}
+		}
+	}
+	return n, pieces
+}
+
+func TestAnnounceBudgetSharedByDispatchers(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+
+	budget, err := NewAnnounceBudget(clk, 2, 1)
+	require.NoError(err)
+
+	blob := core.SizedBlobFixture(8, 1)
+	written := []int{0, 1, 2, 3, 4, 5}
+
+	var dispatchers []*Dispatcher
+	var stats []tally.TestScope
+	var peers []*peer
+	for j := 0; j < 3; j++ {
+		torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+		defer cleanup()
+
+		d := testDispatcher(Config{AnnounceBudget: budget}, clk, torrent)
+		s := tally.NewTestScope("", nil)
+		d.stats = s
+
+		p, err := d.addPeer(core.PeerIDFixture(), bitset.New(8), newMockMessages())
+		require.NoError(err)
+
+		dispatchers = append(dispatchers, d)
+		stats = append(stats, s)
+		peers = append(peers, p)
+	}
+
+	for _, i := range written {
+		for _, d := range dispatchers {
+			require.NoError(d.torrent.WritePiece(piecereader.NewBuffer(blob.Content[i:i+1]), i))
+			d.NotifyPiecesWritten([]int{i})
+		}
+	}
+
+	total := func() int {
+		var sum int
+		for _, p := range peers {
+			n, _ := announcedBy(t, p)
+			sum += n
+		}
+		return sum
+	}
+	coalesced := func() float64 {
+		var sum float64
+		for _, s := range stats {
+			if g, ok := s.Snapshot().Gauges()["coalesced_announces+"]; ok {
+				sum += g.Value()
+			}
+		}
+		return sum
+	}
+
+	// Only the burst is sent immediately, all other announcements are coalesced.
+	require.Equal(1, total())
+	require.Equal(float64(3*len(written)-1), coalesced())
+
+	// The aggregate rate never exceeds the budget.
+	var elapsed time.Duration
+	for elapsed < 5*time.Second {
+		clk.Add(100 * time.Millisecond)
+		elapsed += 100 * time.Millisecond
+		require.True(total() <= 1+int(2*elapsed.Seconds()))
+	}
+
+	// All announcements are eventually delivered, coalesced into one message
+	// per peer.
+	require.Equal(4, total())
+	require.Zero(coalesced())
+	for _, p := range peers {
+		_, pieces := announcedBy(t, p)
+		require.ElementsMatch(written, pieces)
+	}
+}
+
+func TestAnnouncerDropsPendingOnComplete(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+
+	budget, err := NewAnnounceBudget(clk, 1, 1)
+	require.NoError(err)
+
+	blob := core.SizedBlobFixture(3, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(Config{AnnounceBudget: budget}, clk, torrent)
+
+	p, err := d.addPeer(core.PeerIDFixture(), bitset.New(3), newMockMessages())
+	require.NoError(err)
+
+	for i := 0; i < 3; i++ {
+		require.NoError(torrent.WritePiece(piecereader.NewBuffer(blob.Content[i:i+1]), i))
+		d.NotifyPiecesWritten([]int{i})
+	}
+
+	// The complete message is sent regardless of the budget, and supersedes the
+	// pending announcement.
+	d.completeNotifications.Wait()
+	require.True(hasComplete(p.messages))
+	clk.Add(5 * time.Second)
+	n, pieces := announcedBy(t, p)
+	require.Equal(1, n)
+	require.Equal([]int{0}, pieces)
+}
+
+func TestAnnouncerSendsSinglePiecesToLegacyPeers(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+
+	budget, err := NewAnnounceBudget(clk, 2, 1)
+	require.NoError(err)
+
+	blob := core.SizedBlobFixture(4, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(Config{AnnounceBudget: budget}, clk, torrent)
+
+	p, err := d.addPeer(
+		core.PeerIDFixture(), bitset.New(4), newLegacyMockMessages(conn.AnnouncePieces))
+	require.NoError(err)
+
+	written := []int{0, 1, 2}
+	for _, i := range written {
+		require.NoError(torrent.WritePiece(piecereader.NewBuffer(blob.Content[i:i+1]), i))
+		d.NotifyPiecesWritten([]int{i})
+	}
+
+	// Each message announces a single piece, within the budget.
+	var elapsed time.Duration
+	for elapsed < 2*time.Second {
+		clk.Add(100 * time.Millisecond)
+		elapsed += 100 * time.Millisecond
+		n, _ := announcedBy(t, p)
+		require.True(n <= 1+int(2*elapsed.Seconds()))
+	}
+	for _, msg := range p.messages.(*mockMessages).getSent() {
+		require.Equal(p2p.Message_ANNOUCE_PIECE, msg.Message.Type)
+	}
+	_, pieces := announcedBy(t, p)
+	require.Equal(written, pieces)
+}
+
+func TestAnnouncerExcludesUnadvertisedPieces(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+
+	budget, err := NewAnnounceBudget(clk, 1, 1)
+	require.NoError(err)
+
+	config := Config{
+		AnnounceBudget:            budget,
+		SlowServeThreshold:        time.Second,
+		SlowServeLimit:            1,
+		SlowServeRecoveryInterval: time.Minute,
+	}
+
+	blob := core.SizedBlobFixture(5, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(config, clk, torrent)
+
+	p, err := d.addPeer(core.PeerIDFixture(), bitset.New(5), newMockMessages())
+	require.NoError(err)
+
+	for i := 0; i < 3; i++ {
+		require.NoError(torrent.WritePiece(piecereader.NewBuffer(blob.Content[i:i+1]), i))
+		d.NotifyPiecesWritten([]int{i})
+	}
+
+	// Piece 1 becomes unadvertised while its announcement is pending.
+	d.recordServeLatency(p, 1, 2*time.Second)
+	clk.Add(time.Second)
+	_, pieces := announcedBy(t, p)
+	require.Equal([]int{0, 2}, pieces)
+
+	// Completing the torrent announces the advertised pieces instead of a
+	// complete message.
+	for i := 3; i < 5; i++ {
+		require.NoError(torrent.WritePiece(piecereader.NewBuffer(blob.Content[i:i+1]), i))
+		d.NotifyPiecesWritten([]int{i})
+	}
+	d.completeNotifications.Wait()
+	require.False(hasComplete(p.messages))
+	_, pieces = announcedBy(t, p)
+	require.Equal([]int{0, 2, 0, 2, 3, 4}, pieces)
+
+	clk.Add(time.Minute)
+	_, pieces = announcedBy(t, p)
+	require.Equal([]int{0, 2, 0, 2, 3, 4, 1}, pieces)
+}
+
+func TestAnnouncerBatchesPiecesWithinInterval(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+
+	blob := core.SizedBlobFixture(5, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(Config{
+		AnnounceBatchInterval: 100 * time.Millisecond,
+		AnnounceBatchSize:     10,
+	}, clk, torrent)
+	stats := tally.NewTestScope("", nil)
+	d.stats = stats
+
+	p, err := d.addPeer(core.PeerIDFixture(), bitset.New(5), newMockMessages())
+	require.NoError(err)
+	legacy, err := d.addPeer(
+		core.PeerIDFixture(), bitset.New(5), newLegacyMockMessages(conn.AnnouncePieces))
+	require.NoError(err)
+
+	written := []int{0, 1, 2}
+	for _, i := range written {
+		require.NoError(torrent.WritePiece(piecereader.NewBuffer(blob.Content[i:i+1]), i))
+		d.NotifyPiecesWritten([]int{i})
+	}
+
+	// Legacy peers are announced each piece immediately.
+	n, pieces := announcedBy(t, legacy)
+	require.Equal(3, n)
+	require.Equal(written, pieces)
+
+	n, _ = announcedBy(t, p)
+	require.Equal(0, n)
+
+	clk.Add(100 * time.Millisecond)
+	n, pieces = announcedBy(t, p)
+	require.Equal(1, n)
+	require.Equal(written, pieces)
+	require.Equal(
+		int64(1), stats.Snapshot().Counters()["announce_batch_flushes+trigger=timer"].Value())
+}
+
+func TestAnnouncerFlushesFullBatchesAndBatchesOnTearDown(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+
+	blob := core.SizedBlobFixture(5, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(Config{
+		AnnounceBatchInterval: time.Minute,
+		AnnounceBatchSize:     2,
+	}, clk, torrent)
+	stats := tally.NewTestScope("", nil)
+	d.stats = stats
+
+	p, err := d.addPeer(core.PeerIDFixture(), bitset.New(5), newMockMessages())
+	require.NoError(err)
+
+	written := []int{0, 1, 2}
+	for _, i := range written {
+		require.NoError(torrent.WritePiece(piecereader.NewBuffer(blob.Content[i:i+1]), i))
+		d.NotifyPiecesWritten([]int{i})
+	}
+
+	// The first two pieces fill a batch, the last is pending.
+	n, pieces := announcedBy(t, p)
+	require.Equal(1, n)
+	require.Equal([]int{0, 1}, pieces)
+
+	// The last piece is not lost on teardown.
+	d.TearDown()
+	n, pieces = announcedBy(t, p)
+	require.Equal(2, n)
+	require.Equal(written, pieces)
+
+	counters := stats.Snapshot().Counters()
+	require.Equal(int64(1), counters["announce_batch_flushes+trigger=size"].Value())
+	require.Equal(int64(1), counters["announce_batch_flushes+trigger=teardown"].Value())
+}
+
+func TestAnnouncerSuppressesAnnouncesToPeersWithPiece(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(3, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(Config{}, clock.NewMock(), torrent)
+	stats := tally.NewTestScope("", nil)
+	d.stats = stats
+
+	sender, err := d.addPeer(
+		core.PeerIDFixture(), bitsetutil.FromBools(true, true, true), newMockMessages())
+	require.NoError(err)
+	hasPiece, err := d.addPeer(
+		core.PeerIDFixture(), bitsetutil.FromBools(true, false, false), newMockMessages())
+	require.NoError(err)
+	missingPiece, err := d.addPeer(
+		core.PeerIDFixture(), bitsetutil.FromBools(false, true, false), newMockMessages())
+	require.NoError(err)
+	seeder, err := d.addPeer(
+		core.PeerIDFixture(), bitsetutil.FromBools(true, true, true), newMockMessages())
+	require.NoError(err)
+
+	require.NoError(d.dispatch(
+		sender, conn.NewPiecePayloadMessage(0, piecereader.NewBuffer(blob.Content[0:1]))))
+
+	_, pieces := announcedBy(t, missingPiece)
+	require.Equal([]int{0}, pieces)
+	for _, p := range []*peer{sender, hasPiece, seeder} {
+		n, _ := announcedBy(t, p)
+		require.Equal(0, n)
+	}
+
+	counters := stats.Snapshot().Counters()
+	require.Equal(int64(1), counters["suppressed_announces+reason=has_piece"].Value())
+	require.Equal(int64(1), counters["suppressed_announces+reason=completed"].Value())
+}
+
+func TestAnnouncerSuppressesBatchedPiecesWhichPeerGained(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+
+	blob := core.SizedBlobFixture(3, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(Config{
+		AnnounceBatchInterval: 100 * time.Millisecond,
+		AnnounceBatchSize:     10,
+	}, clk, torrent)
+	stats := tally.NewTestScope("", nil)
+	d.stats = stats
+
+	p, err := d.addPeer(core.PeerIDFixture(), bitset.New(3), newMockMessages())
+	require.NoError(err)
+
+	for _, i := range []int{0, 1} {
+		require.NoError(torrent.WritePiece(piecereader.NewBuffer(blob.Content[i:i+1]), i))
+		d.NotifyPiecesWritten([]int{i})
+	}
+
+	// p announces a pending piece itself before the batch is sent.
+	require.NoError(d.dispatch(p, conn.NewAnnouncePieceMessage(1)))
+
+	clk.Add(100 * time.Millisecond)
+	_, pieces := announcedBy(t, p)
+	require.Equal([]int{0}, pieces)
+	require.Equal(
+		int64(1), stats.Snapshot().Counters()["suppressed_announces+reason=has_piece"].Value())
+}
+
+func TestDispatcherHandleAnnouncePieces(t *testing.T) {
+	require := require.New(t)
+
+	torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(4, 1).MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(Config{}, clock.NewMock(), torrent)
+
+	p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, false, false, false), newMockMessages())
+	require.NoError(err)
+
+	msg, err := conn.NewAnnouncePiecesMessage(bitsetutil.FromBools(false, true, false, true))
+	require.NoError(err)
+	require.NoError(d.dispatch(p, msg))
+
+	// Announced pieces add to the pieces p already had.
+	require.True(p.bitfield.Has(0))
+	require.True(p.bitfield.Has(1))
+	require.False(p.bitfield.Has(2))
+	require.True(p.bitfield.Has(3))
+}
+
+func TestDispatcherRejectsRepeatedBitfield(t *testing.T) {
+	require := require.New(t)
+
+	torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(4, 1).MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(Config{}, clock.NewMock(), torrent)
+
+	p, err := d.addPeer(core.PeerIDFixture(), bitset.New(4), newMockMessages())
+	require.NoError(err)
+
+	msg := &conn.Message{
+		Message: &p2p.Message{
+			Type:     p2p.Message_BITFIELD,
+			Bitfield: &p2p.BitfieldMessage{},
+		},
+	}
+	require.Equal(protocolViolationError(errRepeatedBitfieldMessage), d.dispatch(p, msg))
+	require.Empty(p.bitfield.GetAllSet())
+	require.Equal(1, p.stats().ProtocolViolations)
+}
+
+func TestDispatcherBansPeerAfterRepeatedBitfieldsAndUnknownMessages(t *testing.T) {
+	require := require.New(t)
+
+	torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(4, 1).MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(Config{MaxProtocolViolations: 1}, clock.NewMock(), torrent)
+
+	p, err := d.addPeer(core.PeerIDFixture(), bitset.New(4), newMockMessages())
+	require.NoError(err)
+
+	bitfield := &conn.Message{
+		Message: &p2p.Message{
+			Type:     p2p.Message_BITFIELD,
+			Bitfield: &p2p.BitfieldMessage{},
+		},
+	}
+	require.Equal(ErrorProtocolViolation, Category(d.dispatch(p, bitfield)))
+	require.False(p.messages.(*mockMessages).isClosed())
+
+	unknown := &conn.Message{Message: &p2p.Message{Type: p2p.Message_Type(1000)}}
+	require.Equal(ErrorProtocolViolation, Category(d.dispatch(p, unknown)))
+	require.Equal(2, p.stats().ProtocolViolations)
+	require.True(p.messages.(*mockMessages).isClosed())
+}
@@ -0,0 +1,202 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/uber/kraken/core"
+)
+
+// AuditVersion is the version of the serialized form of AuditRecord. It is
+// bumped whenever fields are renamed, removed or change meaning, such that
+// offline consumers can tell records apart. Added fields do not bump it.
+const AuditVersion = 1
+
+// ErrAuditUnavailable occurs when a Dispatcher is exported for audit before it
+// completed or was torn down.
+var ErrAuditUnavailable = errors.New("dispatcher neither complete nor torn down")
+
+// AuditSink receives the AuditRecord of each Dispatcher once, when the
+// Dispatcher is torn down. Called synchronously by TearDown, so must not block.
+type AuditSink interface {
+	Audit(r *AuditRecord)
+}
+
+// AuditRecord is a compact, JSON-serializable summary of the lifecycle of a
+// Dispatcher, for offline audits of swarm fairness, i.e. of who uploads and who
+// downloads how much across the fleet. Its size is bounded regardless of the
+// number of peers and pieces.
+type AuditRecord struct {
+	Version     int       `json:"version"`
+	InfoHash    string    `json:"info_hash"`
+	Digest      string    `json:"digest"`
+	LocalPeerID string    `json:"local_peer_id"`
+	CreatedAt   time.Time `json:"created_at"`
+	Complete    bool      `json:"complete"`
+
+	// FinalReason is empty unless the Dispatcher was torn down.
+	FinalReason string `json:"final_reason,omitempty"`
+
+	NumPieces       int   `json:"num_pieces"`
+	Length          int64 `json:"length"`
+	BytesUploaded   int64 `json:"bytes_uploaded"`
+	BytesDownloaded int64 `json:"bytes_downloaded"`
+
+	// PhasesMS are the phases of the Dispatcher, see Phases.Millis.
+	PhasesMS map[string]int64 `json:"phases_ms,omitempty"`
+
+	// Utilization is how much of its configured request parallelism the
+	// Dispatcher sustained while downloading, see Dispatcher.Utilization. Nil
+	// if utilization was never sampled.
+	Utilization *Utilization `json:"utilization,omitempty"`
+
+	// PiecesByAttempts is the number of pieces by the number of piece requests
+	// sent for them. Pieces which were never requested, e.g. since the torrent
+	// had them from the start, count under zero attempts.
+	PiecesByAttempts map[int]int `json:"pieces_by_attempts"`
+
+	// Peers are every peer ever added to the Dispatcher, by most bytes
+	// transferred in either direction, up to Config.MaxAuditPeers. The remaining
+	// peers, including those compacted before, are aggregated into OtherPeers.
+	Peers      []AuditPeer `json:"peers"`
+	OtherPeers *AuditPeer  `json:"other_peers,omitempty"`
+}
+
+// AuditPeer sums up the transfers between a Dispatcher and one or more peers.
+type AuditPeer struct {
+	// PeerID is empty for aggregates of NumPeers peers.
+	PeerID   string `json:"peer_id,omitempty"`
+	NumPeers int    `json:"num_peers,omitempty"`
+
+	BytesUploaded           int64 `json:"bytes_uploaded"`
+	BytesDownloaded         int64 `json:"bytes_downloaded"`
+	PieceRequestsSent       int   `json:"piece_requests_sent"`
+	PieceRequestsReceived   int   `json:"piece_requests_received"`
+	PiecesSent              int   `json:"pieces_sent"`
+	GoodPiecesReceived      int   `json:"good_pieces_received"`
+	DuplicatePiecesReceived int   `json:"duplicate_pieces_received"`
+}
+
+func newAuditPeer(peerID string, t peerStatsTotals) AuditPeer {
+	return AuditPeer{
+		PeerID:                  peerID,
+		BytesUploaded:           t.bytesUploaded,
+		BytesDownloaded:         t.bytesDownloaded,
+		PieceRequestsSent:       t.pieceRequestsSent,
+		PieceRequestsReceived:   t.pieceRequestsReceived,
+		PiecesSent:              t.piecesSent,
+		GoodPiecesReceived:      t.goodPiecesReceived,
+		DuplicatePiecesReceived: t.duplicatePiecesReceived,
+	}
+}
+
+// ExportAudit returns the AuditRecord of d. Returns ErrAuditUnavailable unless
+// d is complete or was torn down.
+func (d *Dispatcher) ExportAudit() (*AuditRecord, error) {
+	reason, tornDown := d.FinalReason()
+	if !d.Complete() && !tornDown {
+		return nil, ErrAuditUnavailable
+	}
+	r := &AuditRecord{
+		Version:          AuditVersion,
+		InfoHash:         d.torrent.InfoHash().Hex(),
+		Digest:           d.torrent.Digest().Hex(),
+		LocalPeerID:      d.localPeerID.String(),
+		CreatedAt:        d.createdAt,
+		Complete:         d.Complete(),
+		NumPieces:        d.torrent.NumPieces(),
+		Length:           d.torrent.Length(),
+		BytesUploaded:    d.bytesUploaded.Load(),
+		BytesDownloaded:  d.bytesDownloaded.Load(),
+		PhasesMS:         d.Phases().Millis(),
+		PiecesByAttempts: make(map[int]int),
+	}
+	if tornDown {
+		r.FinalReason = reason.String()
+	}
+	if u := d.Utilization(); u.Samples > 0 {
+		r.Utilization = &u
+	}
+	for i := 0; i < r.NumPieces; i++ {
+		r.PiecesByAttempts[d.pieceAttempts.Get(i)]++
+	}
+	compacted, numCompacted := d.peerStats.aggregate()
+	r.Peers, r.OtherPeers = auditPeers(
+		d.peerStats.all(), compacted, numCompacted, d.config.MaxAuditPeers)
+	return r, nil
+}
+
+// auditPeers returns the audit entries of the max peers in stats which
+// transferred the most bytes, ties going to the lower peer id, and the
+// aggregate of all other peers, including numCompacted compacted peers whose
+// totals are compacted. The aggregate is nil if there are no other peers.
+func auditPeers(
+	stats map[core.PeerID]*peerStats,
+	compacted peerStatsTotals,
+	numCompacted int,
+	max int) ([]AuditPeer, *AuditPeer) {
+
+	type entry struct {
+		peerID string
+		totals peerStatsTotals
+	}
+	entries := make([]entry, 0, len(stats))
+	for peerID, s := range stats {
+		entries = append(entries, entry{peerID.String(), s.totals()})
+	}
+	transferred := func(t peerStatsTotals) int64 {
+		return t.bytesUploaded + t.bytesDownloaded
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		ti, tj := transferred(entries[i].totals), transferred(entries[j].totals)
+		if ti != tj {
+			return ti > tj
+		}
+		return entries[i].peerID < entries[j].peerID
+	})
+
+	peers := make([]AuditPeer, 0, len(entries))
+	for i, e := range entries {
+		if i < max {
+			peers = append(peers, newAuditPeer(e.peerID, e.totals))
+			continue
+		}
+		compacted.add(e.totals)
+		numCompacted++
+	}
+	if numCompacted == 0 {
+		return peers, nil
+	}
+	other := newAuditPeer("", compacted)
+	other.NumPeers = numCompacted
+	return peers, &other
+}
+
+// deliverAudit hands the AuditRecord of d to Config.AuditSink, if set. Called
+// once, when d is torn down.
+func (d *Dispatcher) deliverAudit() {
+	if d.config.AuditSink == nil {
+		return
+	}
+	r, err := d.ExportAudit()
+	if err != nil {
+		d.log().Errorf("Error exporting audit record: %s", err)
+		return
+	}
+	d.config.AuditSink.Audit(r)
+	d.stats.Counter("audit_records").Inc(1)
+}
@@ -0,0 +1,236 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/torrent/scheduler/conn"
+	"github.com/uber/kraken/lib/torrent/storage/agentstorage"
+	"github.com/uber/kraken/lib/torrent/storage/piecereader"
+	"github.com/uber/kraken/utils/bitsetutil"
+)
+
+var updateGolden = flag.Bool("update-golden", false, "update golden files in testdata")
+
+// requireGolden requires that b equals the golden file name in testdata.
+func requireGolden(t *testing.T, name string, b []byte) {
+	path := "testdata/" + name
+	if *updateGolden {
+		require.NoError(t, ioutil.WriteFile(path, b, 0644))
+	}
+	expected, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, string(expected), string(b))
+}
+
+// recordingAuditSink records the audit records it receives.
+type recordingAuditSink struct {
+	mu      sync.Mutex
+	records []*AuditRecord
+}
+
+func (s *recordingAuditSink) Audit(r *AuditRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.records = append(s.records, r)
+}
+
+func (s *recordingAuditSink) get() []*AuditRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]*AuditRecord(nil), s.records...)
+}
+
+func auditPeerID(t *testing.T, b byte) core.PeerID {
+	id, err := core.NewPeerID(string([]byte{
+		'0', b, '0', b, '0', b, '0', b, '0', b, '0', b, '0', b, '0', b, '0', b, '0', b,
+		'0', b, '0', b, '0', b, '0', b, '0', b, '0', b, '0', b, '0', b, '0', b, '0', b,
+	}))
+	require.NoError(t, err)
+	return id
+}
+
+func TestAuditRecordGolden(t *testing.T) {
+	stats := map[core.PeerID]*peerStats{
+		auditPeerID(t, '1'): {piecesSent: 3, pieceRequestsReceived: 3, bytesUploaded: 3 << 20},
+		auditPeerID(t, '2'): {
+			pieceRequestsSent:       5,
+			goodPiecesReceived:      4,
+			duplicatePiecesReceived: 1,
+			bytesDownloaded:         5 << 20,
+		},
+		auditPeerID(t, '3'): {pieceRequestsSent: 1, goodPiecesReceived: 1, bytesDownloaded: 1 << 20},
+	}
+	compacted := peerStatsTotals{piecesSent: 2, pieceRequestsReceived: 2, bytesUploaded: 2 << 20}
+
+	r := &AuditRecord{
+		Version:          AuditVersion,
+		InfoHash:         "5b2adc464b3b764a8406478e9d7d4c03ba1fad34",
+		Digest:           "964c18ea2c8676660dd5c06dac11671e289c102b6986189aba5f4007e77b36fe",
+		LocalPeerID:      auditPeerID(t, 'f').String(),
+		CreatedAt:        time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC),
+		Complete:         true,
+		FinalReason:      TearDownCompleted.String(),
+		NumPieces:        5,
+		Length:           5 << 20,
+		BytesUploaded:    5 << 20,
+		BytesDownloaded:  6 << 20,
+		PhasesMS:         map[string]int64{"to_first_peer": 10, "transfer": 2000, "endgame": 300},
+		PiecesByAttempts: map[int]int{1: 4, 2: 1},
+	}
+	r.Peers, r.OtherPeers = auditPeers(stats, compacted, 1, 2)
+
+	b, err := json.MarshalIndent(r, "", "  ")
+	require.NoError(t, err)
+	requireGolden(t, "audit_record.json", b)
+}
+
+func TestAuditPeersWithinLimit(t *testing.T) {
+	require := require.New(t)
+
+	stats := map[core.PeerID]*peerStats{
+		auditPeerID(t, '1'): {bytesUploaded: 1},
+		auditPeerID(t, '2'): {bytesUploaded: 1},
+	}
+	peers, other := auditPeers(stats, peerStatsTotals{}, 0, 2)
+	require.Nil(other)
+	// Ties go to the lower peer id.
+	require.Equal([]string{auditPeerID(t, '1').String(), auditPeerID(t, '2').String()},
+		[]string{peers[0].PeerID, peers[1].PeerID})
+}
+
+func TestDispatcherExportAudit(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(2, 1)
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	sink := &recordingAuditSink{}
+	d := testDispatcher(Config{
+		AuditSink:        sink,
+		DisableEndgame:   true,
+		DisableKeepalive: true,
+	}, clock.NewMock(), torrent)
+
+	departed, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, true), newMockMessages())
+	require.NoError(err)
+	leecher, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false, false), newMockMessages())
+	require.NoError(err)
+
+	_, err = d.ExportAudit()
+	require.Equal(ErrAuditUnavailable, err)
+
+	// Both pieces are requested twice, since the first peer they are requested
+	// from departs.
+	_, err = d.maybeRequestMorePieces(departed)
+	require.NoError(err)
+	require.Len(requestedPieces(departed.messages), 2)
+	seeder, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, true), newMockMessages())
+	require.NoError(err)
+	require.NoError(d.RemovePeer(departed.id))
+	d.runPendingKick()
+	for i := 0; i < 2; i++ {
+		require.NoError(d.dispatch(
+			seeder, conn.NewPiecePayloadMessage(i, piecereader.NewBuffer(blob.Content[i:i+1]))))
+	}
+	require.True(d.Complete())
+	require.NoError(d.dispatch(leecher, conn.NewPieceRequestMessage(1, 1)))
+	waitForServes(t, leecher)
+
+	r, err := d.ExportAudit()
+	require.NoError(err)
+	require.True(r.Complete)
+	require.Empty(r.FinalReason)
+	require.Equal(map[int]int{2: 2}, r.PiecesByAttempts)
+	require.Equal(int64(2), r.BytesDownloaded)
+	require.Equal(int64(1), r.BytesUploaded)
+	require.Equal([]AuditPeer{{
+		PeerID:             seeder.id.String(),
+		BytesDownloaded:    2,
+		PieceRequestsSent:  2,
+		GoodPiecesReceived: 2,
+	}, {
+		PeerID:                leecher.id.String(),
+		BytesUploaded:         1,
+		PieceRequestsReceived: 1,
+		PiecesSent:            1,
+	}, {
+		PeerID:            departed.id.String(),
+		PieceRequestsSent: 2,
+	}}, r.Peers)
+	require.Nil(r.OtherPeers)
+	require.Empty(sink.get())
+
+	// The sink receives exactly one record, however often d is torn down.
+	d.TearDownWithReason(TearDownCompleted)
+	d.TearDown()
+	records := sink.get()
+	require.Len(records, 1)
+	require.Equal(TearDownCompleted.String(), records[0].FinalReason)
+	require.Equal(r.Peers, records[0].Peers)
+}
+
+func TestDispatcherAuditAggregatesPeersBeyondLimit(t *testing.T) {
+	require := require.New(t)
+
+	torrent, cleanup := completeTorrentFixture(t, core.SizedBlobFixture(4, 1))
+	defer cleanup()
+
+	sink := &recordingAuditSink{}
+	d := testDispatcher(Config{
+		AuditSink:        sink,
+		MaxAuditPeers:    1,
+		DisableKeepalive: true,
+	}, clock.NewMock(), torrent)
+
+	// The first peer requests most pieces, and is listed. All other peers,
+	// including removed ones, are aggregated.
+	var peers []*peer
+	for n := 3; n > 0; n-- {
+		p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false, false, false, false), newMockMessages())
+		require.NoError(err)
+		for i := 0; i < n; i++ {
+			require.NoError(d.dispatch(p, conn.NewPieceRequestMessage(i, 1)))
+		}
+		waitForServes(t, p)
+		peers = append(peers, p)
+	}
+	require.NoError(d.RemovePeer(peers[2].id))
+
+	d.TearDown()
+	records := sink.get()
+	require.Len(records, 1)
+	require.Len(records[0].Peers, 1)
+	require.Equal(peers[0].id.String(), records[0].Peers[0].PeerID)
+	require.Equal(int64(3), records[0].Peers[0].BytesUploaded)
+	require.Equal(&AuditPeer{
+		NumPeers:              2,
+		BytesUploaded:         3,
+		PieceRequestsReceived: 3,
+		PiecesSent:            3,
+	}, records[0].OtherPeers)
+}
@@ -0,0 +1,116 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"sync"
+
+	"github.com/willf/bitset"
+
+	"github.com/uber/kraken/lib/torrent/storage"
+)
+
+// BitfieldSnapshot is the bitfield which was sent to a peer at handshake, and
+// the BitfieldVersion of the Dispatcher as of taking it, see AddPeerSince.
+type BitfieldSnapshot struct {
+	Bitfield *bitset.BitSet
+	Version  int
+}
+
+// pieceLog records the pieces which a Dispatcher wrote in the order they were
+// written, such that the pieces written since a bitfield snapshot can be told
+// by the version of the snapshot. Each piece is recorded at most once, so the
+// log holds at most as many entries as the torrent has pieces.
+type pieceLog struct {
+	mu      sync.Mutex
+	pieces  []int
+	written *bitset.BitSet
+}
+
+func newPieceLog(numPieces int) *pieceLog {
+	return &pieceLog{written: bitset.New(uint(numPieces))}
+}
+
+// add records piece i. No-op if i was already recorded.
+func (l *pieceLog) add(i int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.written.Test(uint(i)) {
+		return
+	}
+	l.written.Set(uint(i))
+	l.pieces = append(l.pieces, i)
+}
+
+// version returns the number of recorded pieces.
+func (l *pieceLog) version() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return len(l.pieces)
+}
+
+// since returns the pieces recorded since version, in the order they were
+// recorded.
+func (l *pieceLog) since(version int) []int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if version < 0 {
+		version = 0
+	}
+	if version >= len(l.pieces) {
+		return nil
+	}
+	return append([]int(nil), l.pieces[version:]...)
+}
+
+// BitfieldVersion returns the version of the bitfield of d, which counts the
+// pieces d wrote since it was created. A bitfield taken after reading the
+// version lacks at most the pieces which d wrote since.
+func (d *Dispatcher) BitfieldVersion() int {
+	return d.written.version()
+}
+
+// StatWithVersion returns Stat, along with the BitfieldVersion as of taking it.
+// Both are to be sent to a peer at handshake, see AddPeerSince.
+func (d *Dispatcher) StatWithVersion() (*storage.TorrentInfo, int) {
+	version := d.BitfieldVersion()
+	return d.Stat(), version
+}
+
+// announceMissed announces to p the pieces which d wrote since snapshot was
+// taken, and which snapshot thus lacks. p must already be added, such that each
+// piece written concurrently is announced to p either here or by the writer.
+// If d is complete, p is notified of the completion instead.
+func (d *Dispatcher) announceMissed(p *peer, snapshot BitfieldSnapshot) {
+	var missed []int
+	for _, i := range d.written.since(snapshot.Version) {
+		if !snapshot.Bitfield.Test(uint(i)) {
+			missed = append(missed, i)
+		}
+	}
+	if len(missed) == 0 {
+		return
+	}
+	d.stats.Counter("backfilled_announces").Inc(int64(len(missed)))
+	if d.Complete() {
+		d.notifyPeerComplete(p)
+		return
+	}
+	for _, i := range missed {
+		d.announcer.announce(p, i)
+	}
+}
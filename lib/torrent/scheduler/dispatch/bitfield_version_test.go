@@ -0,0 +1,130 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"testing"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+	"github.com/willf/bitset"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/gen/go/proto/p2p"
+	"github.com/uber/kraken/lib/torrent/scheduler/conn"
+	"github.com/uber/kraken/lib/torrent/storage/agentstorage"
+	"github.com/uber/kraken/lib/torrent/storage/piecereader"
+)
+
+func TestPieceLog(t *testing.T) {
+	require := require.New(t)
+
+	l := newPieceLog(4)
+	require.Equal(0, l.version())
+	require.Empty(l.since(0))
+
+	l.add(2)
+	l.add(0)
+	l.add(2)
+	require.Equal(2, l.version())
+	require.Equal([]int{2, 0}, l.since(0))
+	require.Equal([]int{0}, l.since(1))
+	require.Empty(l.since(2))
+	require.Empty(l.since(3))
+}
+
+func TestDispatcherAnnouncesPiecesMissedWhileHandshaking(t *testing.T) {
+	require := require.New(t)
+
+	const numPieces = 10
+	blob := core.SizedBlobFixture(numPieces, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	stats := tally.NewTestScope("", nil)
+	d := testDispatcher(Config{DisableKeepalive: true}, clock.NewMock(), torrent)
+	d.stats = stats
+
+	seeder, err := d.addPeer(
+		core.PeerIDFixture(), bitset.New(numPieces).Complement(), newMockMessages())
+	require.NoError(err)
+	write := func(i int) {
+		require.NoError(d.dispatch(
+			seeder, conn.NewPiecePayloadMessage(i, piecereader.NewBuffer(blob.Content[i:i+1]))))
+	}
+
+	for i := 0; i < 3; i++ {
+		write(i)
+	}
+
+	// The peer handshakes while pieces are being written.
+	info, version := d.StatWithVersion()
+	require.Equal(3, version)
+	for i := 3; i < 7; i++ {
+		write(i)
+	}
+	messages := newMockMessages()
+	peerID := core.PeerIDFixture()
+	require.NoError(d.AddPeerSince(
+		peerID, bitset.New(numPieces), messages, BitfieldSnapshot{info.Bitfield(), version}))
+	for i := 7; i < 9; i++ {
+		write(i)
+	}
+
+	// The peer is announced exactly the pieces missing from its handshake.
+	require.Equal([]int{3, 4, 5, 6, 7, 8}, announcedPieces(messages))
+	view := info.Bitfield().Clone()
+	for _, i := range announcedPieces(messages) {
+		view.Set(uint(i))
+	}
+	require.True(view.Equal(torrent.Bitfield()))
+	require.Equal(0, numSent(messages, p2p.Message_BITFIELD))
+	require.Equal(int64(4), stats.Snapshot().Counters()["backfilled_announces+"].Value())
+
+	require.NoError(d.RemovePeer(peerID))
+}
+
+func TestDispatcherNotifiesCompletionMissedWhileHandshaking(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(2, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(Config{DisableKeepalive: true}, clock.NewMock(), torrent)
+
+	seeder, err := d.addPeer(core.PeerIDFixture(), bitset.New(2).Complement(), newMockMessages())
+	require.NoError(err)
+
+	info, version := d.StatWithVersion()
+	for i := 0; i < 2; i++ {
+		require.NoError(d.dispatch(
+			seeder, conn.NewPiecePayloadMessage(i, piecereader.NewBuffer(blob.Content[i:i+1]))))
+	}
+	d.completeNotifications.Wait()
+
+	messages := newMockMessages()
+	peerID := core.PeerIDFixture()
+	require.NoError(d.AddPeerSince(
+		peerID, bitset.New(2), messages, BitfieldSnapshot{info.Bitfield(), version}))
+
+	// The completion supersedes announcing every piece.
+	require.Equal(1, numSent(messages, p2p.Message_COMPLETE))
+	require.Empty(announcedPieces(messages))
+
+	require.NoError(d.RemovePeer(peerID))
+}
@@ -0,0 +1,136 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"sync"
+
+	"github.com/uber/kraken/lib/torrent/scheduler/conn"
+)
+
+// unknownCapabilityCounter is implemented by Messages which count the
+// capabilities the peer listed but we do not implement, such as conn.Conn.
+type unknownCapabilityCounter interface {
+	UnknownCapabilities() int
+}
+
+// negotiatedCapabilities returns the known capabilities which messages
+// supports, sorted by name, and the number of unknown capabilities the peer
+// listed, if messages counts them.
+func negotiatedCapabilities(messages Messages) ([]conn.Capability, int) {
+	var caps []conn.Capability
+	for _, c := range conn.KnownCapabilities() {
+		if messages.Supports(c) {
+			caps = append(caps, c)
+		}
+	}
+	var unknown int
+	if u, ok := messages.(unknownCapabilityCounter); ok {
+		unknown = u.UnknownCapabilities()
+	}
+	return caps, unknown
+}
+
+// capabilityStats tracks the adoption of capabilities among the peers of a
+// Dispatcher, and how often the Dispatcher exercised each capability, e.g. to
+// follow the rollout of protocol extensions across a mixed-version fleet.
+type capabilityStats struct {
+	mu           sync.Mutex
+	peers        map[conn.Capability]int
+	unknownPeers int // Peers which listed unknown capabilities.
+	usage        map[conn.Capability]int64
+}
+
+func newCapabilityStats() *capabilityStats {
+	return &capabilityStats{
+		peers: make(map[conn.Capability]int),
+		usage: make(map[conn.Capability]int64),
+	}
+}
+
+// update adds delta to the peer counts of the capabilities of p, returning the
+// updated counts of all known capabilities and of peers which listed unknown
+// capabilities.
+func (s *capabilityStats) update(p *peer, delta int) (map[conn.Capability]int, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, c := range p.capabilities {
+		s.peers[c] += delta
+	}
+	if p.unknownCapabilities > 0 {
+		s.unknownPeers += delta
+	}
+	counts := make(map[conn.Capability]int)
+	for _, c := range conn.KnownCapabilities() {
+		counts[c] = s.peers[c]
+	}
+	return counts, s.unknownPeers
+}
+
+func (s *capabilityStats) use(c conn.Capability) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.usage[c]++
+}
+
+// peerCounts returns the number of peers which negotiated each capability,
+// omitting capabilities which no peer negotiated, and the number of peers
+// which listed unknown capabilities.
+func (s *capabilityStats) peerCounts() (map[string]int, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counts := make(map[string]int)
+	for c, n := range s.peers {
+		if n > 0 {
+			counts[string(c)] = n
+		}
+	}
+	return counts, s.unknownPeers
+}
+
+// usageCounts returns how often each capability was exercised.
+func (s *capabilityStats) usageCounts() map[string]int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counts := make(map[string]int64, len(s.usage))
+	for c, n := range s.usage {
+		counts[string(c)] = n
+	}
+	return counts
+}
+
+// updateCapabilityPeers adds delta to the peer counts of the capabilities of p,
+// and reports the counts of all known capabilities.
+func (d *Dispatcher) updateCapabilityPeers(p *peer, delta int) {
+	counts, unknown := d.capabilityStats.update(p, delta)
+	for c, n := range counts {
+		d.stats.Tagged(map[string]string{
+			"capability": string(c),
+		}).Gauge("peers_with_capability").Update(float64(n))
+	}
+	d.stats.Gauge("peers_with_unknown_capabilities").Update(float64(unknown))
+}
+
+// useCapability records that d exercised capability c with a peer, e.g. sent a
+// message which only peers supporting c understand.
+func (d *Dispatcher) useCapability(c conn.Capability) {
+	d.capabilityStats.use(c)
+	d.stats.Tagged(map[string]string{
+		"capability": string(c),
+	}).Counter("capability_usage").Inc(1)
+}
@@ -0,0 +1,147 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"testing"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/gen/go/proto/p2p"
+	"github.com/uber/kraken/lib/torrent/scheduler/conn"
+	"github.com/uber/kraken/lib/torrent/storage/agentstorage"
+	"github.com/uber/kraken/utils/bitsetutil"
+)
+
+// newerMockMessages are mockMessages of a peer which runs a newer version, and
+// listed unknown capabilities in its handshake.
+type newerMockMessages struct {
+	*mockMessages
+	unknown int
+}
+
+func (m newerMockMessages) UnknownCapabilities() int { return m.unknown }
+
+func peersWithCapability(s tally.Snapshot, c conn.Capability) float64 {
+	return s.Gauges()["peers_with_capability+capability="+string(c)].Value()
+}
+
+func TestDispatcherCapabilityAdoption(t *testing.T) {
+	require := require.New(t)
+
+	torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(2, 1).MetaInfo)
+	defer cleanup()
+
+	stats := tally.NewTestScope("", nil)
+	d := testDispatcher(Config{}, clock.NewMock(), torrent)
+	d.stats = stats
+
+	current, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false, false), newMockMessages())
+	require.NoError(err)
+	legacy, err := d.addPeer(
+		core.PeerIDFixture(),
+		bitsetutil.FromBools(false, false),
+		newLegacyMockMessages(conn.AnnouncePieces, conn.Choke))
+	require.NoError(err)
+	newer, err := d.addPeer(
+		core.PeerIDFixture(),
+		bitsetutil.FromBools(false, false),
+		newerMockMessages{newMockMessages(), 2})
+	require.NoError(err)
+
+	s := stats.Snapshot()
+	require.Equal(2.0, peersWithCapability(s, conn.AnnouncePieces))
+	require.Equal(2.0, peersWithCapability(s, conn.Choke))
+	require.Equal(3.0, peersWithCapability(s, conn.Keepalive))
+	require.Equal(1.0, s.Gauges()["peers_with_unknown_capabilities+"].Value())
+
+	stats0, ok := d.PeerStats(current.id)
+	require.True(ok)
+	require.Equal(conn.KnownCapabilities(), stats0.Capabilities)
+	require.Equal(0, stats0.UnknownCapabilities)
+
+	stats1, ok := d.PeerStats(legacy.id)
+	require.True(ok)
+	require.NotContains(stats1.Capabilities, conn.AnnouncePieces)
+	require.NotContains(stats1.Capabilities, conn.Choke)
+	require.Len(stats1.Capabilities, len(conn.KnownCapabilities())-2)
+
+	stats2, ok := d.PeerStats(newer.id)
+	require.True(ok)
+	require.Equal(2, stats2.UnknownCapabilities)
+
+	for _, p := range d.Snapshot().Peers {
+		if p.PeerID == newer.id.String() {
+			require.Equal(2, p.UnknownCapabilities)
+			require.Equal(conn.KnownCapabilities(), p.Capabilities)
+		}
+	}
+
+	dump := d.Dump()
+	require.Equal(2, dump.PeersByCapability[string(conn.AnnouncePieces)])
+	require.Equal(3, dump.PeersByCapability[string(conn.PieceDigests)])
+	require.Equal(1, dump.PeersWithUnknownCapabilities)
+
+	// Removed peers no longer count.
+	require.NoError(d.RemovePeer(newer.id))
+	require.NoError(d.RemovePeer(legacy.id))
+
+	s = stats.Snapshot()
+	require.Equal(1.0, peersWithCapability(s, conn.AnnouncePieces))
+	require.Equal(1.0, peersWithCapability(s, conn.Keepalive))
+	require.Equal(0.0, s.Gauges()["peers_with_unknown_capabilities+"].Value())
+}
+
+func TestDispatcherCapabilityUsage(t *testing.T) {
+	require := require.New(t)
+
+	torrent, cleanup := completeTorrentFixture(t, core.SizedBlobFixture(4, 1))
+	defer cleanup()
+
+	stats := tally.NewTestScope("", nil)
+	d := testDispatcher(Config{}, clock.NewMock(), torrent)
+	d.stats = stats
+
+	current, err := d.addPeer(
+		core.PeerIDFixture(), bitsetutil.FromBools(false, false, false, false), newMockMessages())
+	require.NoError(err)
+	legacy, err := d.addPeer(
+		core.PeerIDFixture(),
+		bitsetutil.FromBools(false, false, false, false),
+		newLegacyMockMessages(conn.AnnouncePieces, conn.Choke))
+	require.NoError(err)
+
+	for _, p := range []*peer{current, legacy} {
+		d.announceAdvertised(p)
+		d.sendChokeState(p, true)
+	}
+
+	// Only the current peer is sent batched announcements and chokes.
+	require.Equal(1, numSent(current.messages, p2p.Message_ANNOUNCE_PIECES))
+	require.Equal(1, numSent(current.messages, p2p.Message_CHOKE))
+	require.Equal([]int{0, 1, 2, 3}, announcedPieces(legacy.messages))
+	require.Equal(0, numSent(legacy.messages, p2p.Message_CHOKE))
+
+	counters := stats.Snapshot().Counters()
+	require.Equal(int64(1), counters["capability_usage+capability=announce_pieces"].Value())
+	require.Equal(int64(1), counters["capability_usage+capability=choke"].Value())
+
+	require.Equal(map[string]int64{
+		string(conn.AnnouncePieces): 1,
+		string(conn.Choke):          1,
+	}, d.Dump().CapabilityUsage)
+}
@@ -0,0 +1,227 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"sort"
+	"time"
+
+	"github.com/uber/kraken/lib/torrent/scheduler/conn"
+)
+
+// addPeerChoked chokes p if all upload slots are taken by other peers, such
+// that the requests of p are held until p is unchoked by rechoke.
+func (d *Dispatcher) addPeerChoked(p *peer) {
+	if !d.config.EnableChoking {
+		return
+	}
+	d.chokeMu.Lock()
+	defer d.chokeMu.Unlock()
+
+	var unchoked int
+	d.peers.Range(func(k, v interface{}) bool {
+		if pp := v.(*peer); pp != p && !pp.serves.isChoked() {
+			unchoked++
+		}
+		return true
+	})
+	if unchoked >= d.config.UploadSlots {
+		p.serves.choke()
+		d.sendChokeState(p, true)
+	} else {
+		p.touchUnchokedAt(true)
+	}
+	d.updateChokedPeers()
+}
+
+// chokeCandidate is a peer competing for an upload slot.
+type chokeCandidate struct {
+	p             *peer
+	received      int64 // Bytes received from p within the reciprocity window.
+	sent          int64 // Bytes sent to p within the reciprocity window.
+	rate          float64
+	unchokedAt    time.Time
+	unchokedSince time.Time
+}
+
+// waitedLonger returns true if c should get an upload slot before o, all else
+// being equal: either c held no slot for longer than o, or both hold a slot and
+// c got its slot more recently.
+func (c chokeCandidate) waitedLonger(o chokeCandidate) bool {
+	if !c.unchokedAt.Equal(o.unchokedAt) {
+		return c.unchokedAt.Before(o.unchokedAt)
+	}
+	if !c.unchokedSince.Equal(o.unchokedSince) {
+		return c.unchokedSince.After(o.unchokedSince)
+	}
+	return c.p.id.LessThan(o.p.id)
+}
+
+// rechoke assigns upload slots to interested peers, i.e. peers which have not
+// completed the torrent. All but one slot go to the peers which reciprocate
+// the most while we download, see Config.ReciprocityWindow, with ties going to
+// the peers which waited the longest, such that seeders rotate through their
+// peers. Unless disabled, local peers take up to Config.LocalityWeight of these
+// slots first. The remaining slot is an optimistic unchoke of the peer which
+// waited the longest, such that new and remote peers get a chance to
+// reciprocate. All other peers are choked.
+func (d *Dispatcher) rechoke() {
+	d.chokeMu.Lock()
+	defer d.chokeMu.Unlock()
+
+	all, interested := d.chokeCandidates()
+
+	unchoke := make(map[*peer]bool)
+	regular := d.config.UploadSlots - 1
+	local := d.localUploadSlots(regular)
+	for i := 0; i < len(interested) && len(unchoke) < local; i++ {
+		if d.preferLocal(interested[i].p) {
+			unchoke[interested[i].p] = true
+		}
+	}
+	for i := 0; i < len(interested) && len(unchoke) < regular; i++ {
+		unchoke[interested[i].p] = true
+	}
+	var optimistic *chokeCandidate
+	for i := 0; regular >= 0 && i < len(interested); i++ {
+		if unchoke[interested[i].p] {
+			continue
+		}
+		if optimistic == nil || interested[i].waitedLonger(*optimistic) {
+			optimistic = &interested[i]
+		}
+	}
+	if optimistic != nil {
+		unchoke[optimistic.p] = true
+	}
+
+	for _, p := range all {
+		if unchoke[p] {
+			// Peers which keep their slot rank behind choked peers next time.
+			changed, start := p.serves.unchoke()
+			p.touchUnchokedAt(changed)
+			if changed {
+				d.sendChokeState(p, false)
+			}
+			if start {
+				go d.serve(p)
+			}
+		} else if p.serves.choke() {
+			d.sendChokeState(p, true)
+		}
+	}
+	d.updateChokedPeers()
+}
+
+// chokeCandidates returns all peers of d, and its interested peers in the order
+// in which they get regular upload slots, see chokeCandidate.ranksBefore.
+func (d *Dispatcher) chokeCandidates() (all []*peer, interested []chokeCandidate) {
+	leeching := !d.Complete()
+	var freeRiders int
+	d.peers.Range(func(k, v interface{}) bool {
+		p := v.(*peer)
+		all = append(all, p)
+		if p.bitfield.Complete() {
+			return true
+		}
+		c := chokeCandidate{p: p}
+		c.unchokedAt, c.unchokedSince = p.getUnchokedAt()
+		if d.config.DisableTitForTat {
+			c.rate = p.getDownloadRate()
+		} else if leeching {
+			c.received, c.sent = p.getExchange()
+			if c.freeRiding() {
+				freeRiders++
+			}
+		}
+		interested = append(interested, c)
+		return true
+	})
+	sort.Slice(interested, func(i, j int) bool {
+		return interested[i].ranksBefore(interested[j])
+	})
+	d.stats.Gauge("free_riding_peers").Update(float64(freeRiders))
+	return all, interested
+}
+
+// sendChokeState notifies p that it was choked or unchoked, if p supports it.
+// Requests held for a notified peer are dropped, since the peer requests those
+// pieces elsewhere once choked.
+func (d *Dispatcher) sendChokeState(p *peer, choked bool) {
+	if !p.messages.Supports(conn.Choke) {
+		return
+	}
+	if choked {
+		if n := p.serves.clear(); n > 0 {
+			d.stats.Counter("dropped_choked_piece_requests").Inc(int64(n))
+		}
+		d.send(p, conn.NewChokeMessage())
+	} else {
+		d.send(p, conn.NewUnchokeMessage())
+	}
+	d.useCapability(conn.Choke)
+}
+
+// handleChoke stops requesting pieces from p, and hands the requests pending
+// with p to other peers.
+func (d *Dispatcher) handleChoke(p *peer) {
+	p.requestMu.Lock()
+	defer p.requestMu.Unlock()
+
+	if p.chokedByRemote {
+		return
+	}
+	p.chokedByRemote = true
+	if d.SeedOnly() {
+		return
+	}
+	for _, i := range d.pieceRequestManager.PendingPieces(p.id) {
+		d.pieceRequestManager.MarkRejected(p.id, i)
+	}
+	d.stats.Counter("choked_by_peer").Inc(1)
+}
+
+// handleUnchoke resumes requesting pieces from p.
+func (d *Dispatcher) handleUnchoke(p *peer) {
+	p.requestMu.Lock()
+	changed := p.chokedByRemote
+	p.chokedByRemote = false
+	p.requestMu.Unlock()
+
+	if changed {
+		d.maybeRequestMorePieces(p)
+	}
+}
+
+func (d *Dispatcher) updateChokedPeers() {
+	var n int
+	d.peers.Range(func(k, v interface{}) bool {
+		if v.(*peer).serves.isChoked() {
+			n++
+		}
+		return true
+	})
+	d.stats.Gauge("choked_peers").Update(float64(n))
+}
+
+func (d *Dispatcher) watchChokes() {
+	for {
+		select {
+		case <-d.clk.After(d.config.ChokeInterval):
+			d.rechoke()
+		case <-d.tornDown:
+			return
+		}
+	}
+}
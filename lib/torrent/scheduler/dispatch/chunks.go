@@ -0,0 +1,162 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/torrent/storage"
+)
+
+// chunkAssembler buffers received chunks of pieces until all chunks of a piece
+// have arrived. Which chunks were received is tracked by piecerequest.Manager.
+type chunkAssembler struct {
+	mu           sync.Mutex // Protects the following fields:
+	buffers      map[int][]byte
+	received     map[int]int64
+	contributors map[int]map[core.PeerID]bool
+}
+
+func newChunkAssembler() *chunkAssembler {
+	return &chunkAssembler{
+		buffers:      make(map[int][]byte),
+		received:     make(map[int]int64),
+		contributors: make(map[int]map[core.PeerID]bool),
+	}
+}
+
+// addLocked copies chunk, received from peerID, into the buffer of piece i at
+// offset. Caller must hold mu.
+func (a *chunkAssembler) addLocked(
+	i int, pieceLength, offset int64, chunk []byte, peerID core.PeerID) {
+
+	buf, ok := a.buffers[i]
+	if !ok {
+		buf = make([]byte, pieceLength)
+		a.buffers[i] = buf
+		a.contributors[i] = make(map[core.PeerID]bool)
+	}
+	copy(buf[offset:], chunk)
+	a.received[i] += int64(len(chunk))
+	a.contributors[i][peerID] = true
+}
+
+// takeLocked removes the buffer of piece i, returning it along with the peers
+// which contributed chunks to it. Caller must hold mu.
+func (a *chunkAssembler) takeLocked(i int) ([]byte, map[core.PeerID]bool) {
+	buf, contributors := a.buffers[i], a.contributors[i]
+	delete(a.buffers, i)
+	delete(a.received, i)
+	delete(a.contributors, i)
+	return buf, contributors
+}
+
+// drop discards the buffer of piece i, returning the number of received bytes
+// which were buffered.
+func (a *chunkAssembler) drop(i int) int64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	n := a.received[i]
+	a.takeLocked(i)
+	return n
+}
+
+// numContributors returns the number of peers which contributed chunks to
+// buffered pieces, counting a peer once per piece.
+func (a *chunkAssembler) numContributors() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var n int
+	for _, c := range a.contributors {
+		n += len(c)
+	}
+	return n
+}
+
+// chunkRange returns the offset and length of chunk c of piece i.
+func (d *Dispatcher) chunkRange(i, c int) (offset, length int64) {
+	offset = int64(c) * d.config.ChunkSize
+	length = d.pieceLengths.get(i) - offset
+	if length > d.config.ChunkSize {
+		length = d.config.ChunkSize
+	}
+	return offset, length
+}
+
+// numChunks returns the number of chunks of piece i. Returns 1 if chunking is
+// disabled.
+func (d *Dispatcher) numChunks(i int) int {
+	if d.config.ChunkSize == 0 {
+		return 1
+	}
+	length := d.pieceLengths.get(i)
+	n := length / d.config.ChunkSize
+	if length%d.config.ChunkSize != 0 {
+		n++
+	}
+	return int(n)
+}
+
+// chunkIndex returns the chunk of piece i which offset and length select. Returns
+// false if they do not select exactly one chunk.
+func (d *Dispatcher) chunkIndex(i int, offset, length int64) (int, bool) {
+	if d.config.ChunkSize == 0 || offset < 0 || offset%d.config.ChunkSize != 0 {
+		return 0, false
+	}
+	c := int(offset / d.config.ChunkSize)
+	if c >= d.numChunks(i) {
+		return 0, false
+	}
+	if _, l := d.chunkRange(i, c); l != length {
+		return 0, false
+	}
+	return c, true
+}
+
+// validRange returns true if offset and length select a non-empty range of
+// piece i.
+func (d *Dispatcher) validRange(i int, offset, length int64) bool {
+	return offset >= 0 && length > 0 && offset+length <= d.pieceLengths.get(i)
+}
+
+// chunkReader is a storage.PieceReader which reads a range of a piece.
+type chunkReader struct {
+	io.Reader
+	closer io.Closer
+	length int
+}
+
+// newChunkReader returns a reader of length bytes of pr starting at offset.
+// Closing the returned reader closes pr.
+func newChunkReader(pr storage.PieceReader, offset, length int64) (storage.PieceReader, error) {
+	if _, err := io.CopyN(ioutil.Discard, pr, offset); err != nil {
+		pr.Close()
+		return nil, fmt.Errorf("skip to offset: %s", err)
+	}
+	return &chunkReader{io.LimitReader(pr, length), pr, int(length)}, nil
+}
+
+func (r *chunkReader) Close() error {
+	return r.closer.Close()
+}
+
+func (r *chunkReader) Length() int {
+	return r.length
+}
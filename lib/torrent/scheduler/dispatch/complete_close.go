@@ -0,0 +1,138 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/uber/kraken/lib/torrent/scheduler/conn"
+)
+
+// closeCompletedPeer closes the connection to p once both d and p completed.
+// Unless Config.ImmediateCompletedPeerClose is set, the close is paced: if d has
+// the lower peer id, d closes the connection at a random delay within
+// Config.CompletedPeerCloseWindow. Otherwise, d sends p its completion such that
+// p closes the connection, and only closes it itself once the window elapsed.
+// Scheduled at most once per peer. Scheduled closes are carried out by
+// closeDueCompletedPeers, which checks for due closes every tenth of the window.
+func (d *Dispatcher) closeCompletedPeer(p *peer) {
+	if d.config.ImmediateCompletedPeerClose {
+		d.closeCompletedPeerNow(p)
+		return
+	}
+	if !p.completeCloseScheduled.CAS(false, true) {
+		return
+	}
+	window := d.config.CompletedPeerCloseWindow
+	delay := time.Duration(rand.Int63n(int64(window)))
+	if !d.localPeerID.LessThan(p.id) {
+		// p learns that we completed and closes the connection first, unless
+		// p never does, e.g. since p runs an older version.
+		if p.notifiedComplete.CAS(false, true) {
+			d.send(p, conn.NewCompleteMessage())
+		}
+		delay += window
+		d.stats.Counter("deferred_completed_peer_closes").Inc(1)
+	}
+	d.completeCloses.schedule(p, d.clk.Now().Add(delay))
+}
+
+// watchCompletedPeerCloses closes completed peers whose close is due every tenth
+// of Config.CompletedPeerCloseWindow, until d is torn down.
+func (d *Dispatcher) watchCompletedPeerCloses() {
+	for {
+		select {
+		case <-d.clk.After(d.config.CompletedPeerCloseWindow / 10):
+			d.closeDueCompletedPeers()
+		case <-d.tornDown:
+			return
+		}
+	}
+}
+
+// closeDueCompletedPeers closes the completed peers whose close scheduled by
+// closeCompletedPeer is due.
+func (d *Dispatcher) closeDueCompletedPeers() {
+	for _, p := range d.completeCloses.popDue(d.clk.Now()) {
+		if v, ok := d.peers.Load(p.id); !ok || v.(*peer) != p {
+			// Closed by p meanwhile.
+			continue
+		}
+		d.closeCompletedPeerNow(p)
+	}
+}
+
+func (d *Dispatcher) closeCompletedPeerNow(p *peer) {
+	if p.closedComplete.CAS(false, true) {
+		d.log("peer", p).Info("Closing connection to completed peer")
+		d.stats.Counter("completed_peer_closes").Inc(1)
+		p.messages.Close()
+	}
+}
+
+// completeCloses tracks when the connections to completed peers are due to be
+// closed. Peers are dropped once removed, and all of them once d is torn down.
+type completeCloses struct {
+	mu  sync.Mutex
+	due map[*peer]time.Time
+}
+
+func newCompleteCloses() *completeCloses {
+	return &completeCloses{due: make(map[*peer]time.Time)}
+}
+
+func (c *completeCloses) schedule(p *peer, at time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.due[p] = at
+}
+
+// popDue removes and returns the peers whose close is due at now.
+func (c *completeCloses) popDue(now time.Time) []*peer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var due []*peer
+	for p, at := range c.due {
+		if !at.After(now) {
+			due = append(due, p)
+			delete(c.due, p)
+		}
+	}
+	return due
+}
+
+func (c *completeCloses) drop(p *peer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.due, p)
+}
+
+func (c *completeCloses) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.due = make(map[*peer]time.Time)
+}
+
+func (c *completeCloses) size() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.due)
+}
@@ -0,0 +1,317 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/gen/go/proto/p2p"
+	"github.com/uber/kraken/lib/torrent/scheduler/conn"
+	"github.com/uber/kraken/lib/torrent/storage/agentstorage"
+	"github.com/uber/kraken/lib/torrent/storage/piecereader"
+	"github.com/uber/kraken/utils/bitsetutil"
+)
+
+// link connects two dispatchers like a conn: closing either end closes both,
+// and both dispatchers remove the peer as their feed loops would.
+type link struct {
+	clk clock.Clock
+
+	mu       sync.Mutex
+	ends     [2]*linkEnd
+	closes   int
+	closer   core.PeerID
+	closedAt time.Time
+
+	// Whether both ends classified the close as completed, i.e. whether
+	// neither side has reason to redial.
+	completed bool
+}
+
+type linkEnd struct {
+	*mockMessages
+	link *link
+	d    *Dispatcher
+	p    *peer
+}
+
+func (e *linkEnd) Close() {
+	l := e.link
+	l.mu.Lock()
+	l.closes++
+	first := l.closes == 1
+	if first {
+		l.closer = e.d.localPeerID
+		l.closedAt = l.clk.Now()
+		l.completed = true
+		for _, end := range l.ends {
+			if end.d.closedReason(end.p) != PeerRemovalCompleted {
+				l.completed = false
+			}
+		}
+	}
+	l.mu.Unlock()
+
+	if !first {
+		return
+	}
+	for _, end := range l.ends {
+		end.mockMessages.Close()
+		end.d.removePeer(end.p)
+	}
+}
+
+func (e *linkEnd) remote() *linkEnd {
+	if e.link.ends[0] == e {
+		return e.link.ends[1]
+	}
+	return e.link.ends[0]
+}
+
+func TestDispatcherPacesCompletedPeerClosesAcrossSwarm(t *testing.T) {
+	require := require.New(t)
+
+	const n = 8
+	window := 5 * time.Second
+
+	blob := core.SizedBlobFixture(1, 1)
+	clk := clock.NewMock()
+	stats := tally.NewTestScope("", nil)
+
+	var dispatchers []*Dispatcher
+	for i := 0; i < n; i++ {
+		torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+		defer cleanup()
+
+		d := testDispatcher(Config{
+			CompletedPeerCloseWindow: window,
+			DisableKeepalive:         true,
+		}, clk, torrent)
+		d.stats = stats
+		dispatchers = append(dispatchers, d)
+	}
+
+	var links []*link
+	for i := 0; i < n; i++ {
+		for j := i + 1; j < n; j++ {
+			l := &link{clk: clk}
+			for k, pair := range [][2]*Dispatcher{
+				{dispatchers[i], dispatchers[j]},
+				{dispatchers[j], dispatchers[i]},
+			} {
+				end := &linkEnd{mockMessages: newMockMessages(), link: l, d: pair[0]}
+				p, err := pair[0].addPeer(pair[1].localPeerID, bitsetutil.FromBools(false), end)
+				require.NoError(err)
+				end.p = p
+				l.ends[k] = end
+			}
+			links = append(links, l)
+		}
+	}
+
+	// All dispatchers complete at once, and notify their peers.
+	for _, d := range dispatchers {
+		var p *peer
+		d.peers.Range(func(k, v interface{}) bool {
+			p = v.(*peer)
+			return false
+		})
+		require.NoError(d.dispatch(
+			p, conn.NewPiecePayloadMessage(0, piecereader.NewBuffer(blob.Content[0:1]))))
+		d.completeNotifications.Wait()
+	}
+	for _, l := range links {
+		for _, end := range l.ends {
+			for _, msg := range end.getSent() {
+				if msg.Message.Type == p2p.Message_COMPLETE {
+					remote := end.remote()
+					require.NoError(remote.d.dispatch(remote.p, msg))
+				}
+			}
+		}
+	}
+
+	// No connection is closed right away.
+	for _, l := range links {
+		require.Equal(0, l.closes)
+	}
+
+	start := clk.Now()
+	for i := 0; i < 20; i++ {
+		clk.Add(window / 10)
+		for _, d := range dispatchers {
+			d.closeDueCompletedPeers()
+		}
+	}
+
+	closedAt := make(map[time.Time]bool)
+	for _, l := range links {
+		// Each connection is closed once, by the side with the lower peer id,
+		// and classified as completed on both sides.
+		require.Equal(1, l.closes)
+		lower := l.ends[0].d.localPeerID
+		if l.ends[1].d.localPeerID.LessThan(lower) {
+			lower = l.ends[1].d.localPeerID
+		}
+		require.Equal(lower, l.closer)
+		require.True(l.closedAt.Sub(start) <= window)
+		require.True(l.completed)
+		closedAt[l.closedAt] = true
+	}
+	// Closes are spread across the window rather than all at once.
+	require.True(len(closedAt) > 1)
+
+	for _, d := range dispatchers {
+		d.peers.Range(func(k, v interface{}) bool {
+			require.Fail("peer not removed")
+			return true
+		})
+	}
+
+	counters := stats.Snapshot().Counters()
+	require.Equal(int64(len(links)), counters["completed_peer_closes+"].Value())
+	require.Equal(int64(len(links)), counters["deferred_completed_peer_closes+"].Value())
+}
+
+func TestDispatcherClosesCompletedPeerAfterWindowIfRemoteDoesNot(t *testing.T) {
+	require := require.New(t)
+
+	window := 5 * time.Second
+
+	blob := core.SizedBlobFixture(1, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	clk := clock.NewMock()
+	stats := tally.NewTestScope("", nil)
+	d := testDispatcher(Config{
+		CompletedPeerCloseWindow: window,
+		DisableKeepalive:         true,
+	}, clk, torrent)
+	d.stats = stats
+
+	// A remote with a lower peer id is expected to close the connection.
+	peerID := core.PeerIDFixture()
+	for !peerID.LessThan(d.localPeerID) {
+		peerID = core.PeerIDFixture()
+	}
+	p, err := d.addPeer(peerID, bitsetutil.FromBools(true), newMockMessages())
+	require.NoError(err)
+
+	require.NoError(d.dispatch(
+		p, conn.NewPiecePayloadMessage(0, piecereader.NewBuffer(blob.Content[0:1]))))
+	d.completeNotifications.Wait()
+
+	// Thus we send our completion rather than closing the connection.
+	require.Equal(1, numSent(p.messages, p2p.Message_COMPLETE))
+	clk.Add(window - time.Nanosecond)
+	d.closeDueCompletedPeers()
+	require.False(closed(p.messages))
+
+	// Until the remote never did by the end of the window.
+	clk.Add(window)
+	d.closeDueCompletedPeers()
+	require.True(closed(p.messages))
+
+	counters := stats.Snapshot().Counters()
+	require.Equal(int64(1), counters["completed_peer_closes+"].Value())
+	require.Equal(int64(1), counters["deferred_completed_peer_closes+"].Value())
+
+	require.NoError(d.removePeer(p))
+	require.Equal(PeerRemovalCompleted, d.closedReason(p))
+}
+
+func TestDispatcherClosesCompletedPeerWithinWindow(t *testing.T) {
+	require := require.New(t)
+
+	window := 5 * time.Second
+
+	blob := core.SizedBlobFixture(1, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	clk := clock.NewMock()
+	d := testDispatcher(Config{
+		CompletedPeerCloseWindow: window,
+		DisableKeepalive:         true,
+	}, clk, torrent)
+
+	peerID := core.PeerIDFixture()
+	for !d.localPeerID.LessThan(peerID) {
+		peerID = core.PeerIDFixture()
+	}
+	p, err := d.addPeer(peerID, bitsetutil.FromBools(true), newMockMessages())
+	require.NoError(err)
+
+	require.NoError(d.dispatch(
+		p, conn.NewPiecePayloadMessage(0, piecereader.NewBuffer(blob.Content[0:1]))))
+	d.completeNotifications.Wait()
+
+	// With the lower peer id, we close the connection within the window,
+	// without sending our completion.
+	require.False(closed(p.messages))
+	clk.Add(window)
+	d.closeDueCompletedPeers()
+	require.True(closed(p.messages))
+	require.Equal(0, numSent(p.messages, p2p.Message_COMPLETE))
+}
+
+func TestDispatcherTearDownDropsScheduledCompletedPeerCloses(t *testing.T) {
+	require := require.New(t)
+
+	window := 5 * time.Second
+
+	blob := core.SizedBlobFixture(1, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	clk := clock.NewMock()
+	d := testDispatcher(Config{
+		CompletedPeerCloseWindow: window,
+		DisableKeepalive:         true,
+	}, clk, torrent)
+
+	p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true), newMockMessages())
+	require.NoError(err)
+
+	require.NoError(d.dispatch(
+		p, conn.NewPiecePayloadMessage(0, piecereader.NewBuffer(blob.Content[0:1]))))
+	d.completeNotifications.Wait()
+	require.Equal(1, d.completeCloses.size())
+
+	d.TearDown()
+	require.Equal(0, d.completeCloses.size())
+
+	// Nothing is left to close once the window elapsed.
+	clk.Add(2 * window)
+	d.closeDueCompletedPeers()
+	require.Equal(0, d.completeCloses.size())
+}
+
+func TestConfigDefaultsNonPositiveCompletedPeerCloseWindow(t *testing.T) {
+	for _, window := range []time.Duration{0, -time.Second} {
+		config := Config{CompletedPeerCloseWindow: window}.applyDefaults()
+		require.Equal(t, 5*time.Second, config.CompletedPeerCloseWindow)
+	}
+}
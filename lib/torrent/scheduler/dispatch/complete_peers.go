@@ -0,0 +1,150 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"math"
+	"sort"
+
+	"github.com/willf/bitset"
+)
+
+// reservePieces reserves candidates under p. Unless disabled, pieces which
+// complete peers hold too are only reserved under incomplete peers within
+// Config.IncompletePeerPipelineShare of their pipeline, and pieces which local
+// peers hold too are only reserved under other peers within 1 -
+// Config.LocalityWeight of their pipeline, after all other candidates. In
+// endgame, pieces are reserved under all peers alike, and under multiple peers
+// unless some missing piece has no source. Pieces which are being written are
+// never reserved.
+func (d *Dispatcher) reservePieces(p *peer, candidates *bitset.BitSet) ([]int, error) {
+	candidates = d.excludePiecesBeingWritten(candidates)
+	endgame := d.endgame()
+	if endgame {
+		d.activateEndgame()
+	}
+	duplicates := endgame && !d.hasSourcelessPieces()
+	if endgame && !duplicates {
+		d.stats.Counter("suppressed_endgame_duplicates").Inc(1)
+	}
+	shares := d.pipelineShares(p, candidates, endgame)
+	if len(shares) == 0 {
+		return d.pieceRequestManager.ReservePieces(p.id, candidates, d.numPeersByPiece, duplicates)
+	}
+	unrestricted := candidates
+	for _, s := range shares {
+		unrestricted = unrestricted.Difference(s.pieces)
+	}
+	pieces, err := d.pieceRequestManager.ReservePieces(
+		p.id, unrestricted, d.numPeersByPiece, duplicates)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range shares {
+		more, err := d.pieceRequestManager.ReservePiecesUpTo(
+			p.id, s.pieces, d.numPeersByPiece, duplicates, s.limit)
+		if err != nil {
+			return nil, err
+		}
+		if len(more) > 0 {
+			d.stats.Counter(s.counter).Inc(int64(len(more)))
+		}
+		pieces = append(pieces, more...)
+	}
+	return pieces, nil
+}
+
+// pipelineShare restricts the reservation of pieces under a peer to limit
+// pending requests.
+type pipelineShare struct {
+	pieces  *bitset.BitSet
+	limit   int
+	counter string
+}
+
+// pipelineShares returns the candidates of p which may only be reserved within
+// a share of the pipeline of p, ordered by decreasing limit. Pieces subject to
+// multiple shares are only part of the share with the lowest limit, such that
+// they are reserved last.
+func (d *Dispatcher) pipelineShares(
+	p *peer, candidates *bitset.BitSet, endgame bool) []pipelineShare {
+
+	var shares []pipelineShare
+	pipeline := float64(d.pipelineLimit(p))
+	if shared := d.heldByCompletePeers(p, candidates, endgame); shared != nil {
+		shares = append(shares, pipelineShare{
+			shared,
+			int(math.Ceil(d.config.IncompletePeerPipelineShare * pipeline)),
+			"shared_pieces_reserved_under_incomplete_peers",
+		})
+	}
+	if shared := d.heldByLocalPeers(p, candidates, endgame); shared != nil {
+		shares = append(shares, pipelineShare{
+			shared,
+			int(math.Ceil((1 - d.config.LocalityWeight) * pipeline)),
+			"shared_pieces_reserved_under_remote_peers",
+		})
+	}
+	sort.SliceStable(shares, func(i, j int) bool { return shares[i].limit > shares[j].limit })
+	for i := range shares {
+		for _, s := range shares[i+1:] {
+			shares[i].pieces = shares[i].pieces.Difference(s.pieces)
+		}
+	}
+	return shares
+}
+
+// heldByCompletePeers returns the candidates of incomplete peer p which complete
+// peers other than p hold too, or nil if there are none or pieces are reserved
+// under all peers alike.
+func (d *Dispatcher) heldByCompletePeers(
+	p *peer, candidates *bitset.BitSet, endgame bool) *bitset.BitSet {
+
+	if d.config.DisableCompletePeerPreference || endgame || d.completePeer(p) {
+		return nil
+	}
+	var held *bitset.BitSet
+	d.peers.Range(func(k, v interface{}) bool {
+		q := v.(*peer)
+		if q == p || !d.completePeer(q) {
+			return true
+		}
+		if q.bitfield.Complete() {
+			held = candidates
+			return false
+		}
+		b := q.bitfield.Copy()
+		if held == nil {
+			held = b
+		} else {
+			held.InPlaceUnion(b)
+		}
+		return true
+	})
+	if held == nil {
+		return nil
+	}
+	shared := candidates.Intersection(held)
+	if shared.None() {
+		return nil
+	}
+	return shared
+}
+
+// completePeer returns true if p holds at least Config.CompletePeerThreshold
+// of all pieces.
+func (d *Dispatcher) completePeer(p *peer) bool {
+	n := d.torrent.NumPieces()
+	return int(p.bitfield.Count()) >= int(math.Ceil(d.config.CompletePeerThreshold*float64(n)))
+}
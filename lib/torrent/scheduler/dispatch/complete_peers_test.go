@@ -0,0 +1,113 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/torrent/storage/agentstorage"
+	"github.com/uber/kraken/utils/bitsetutil"
+)
+
+func TestDispatcherPrefersCompletePeers(t *testing.T) {
+	all := []bool{true, true, true, true, true, true, true, true}
+	tests := []struct {
+		desc      string
+		config    Config
+		peer      []bool
+		other     []bool
+		expected  int // Pieces requested from peer.
+		unique    []int
+		requested int64 // Shared pieces requested from peer.
+	}{
+		{
+			"complete peer holds all pieces",
+			Config{},
+			[]bool{true, true, true, true, false, false, false, false},
+			all,
+			2, nil, 2,
+		}, {
+			"disabled",
+			Config{DisableCompletePeerPreference: true},
+			[]bool{true, true, true, true, false, false, false, false},
+			all,
+			4, nil, 0,
+		}, {
+			"pieces only peer holds come first",
+			Config{CompletePeerThreshold: 0.75},
+			[]bool{true, true, false, false, false, false, true, true},
+			[]bool{true, true, true, true, true, true, false, false},
+			2, []int{6, 7}, 0,
+		}, {
+			"nearly complete peers are incomplete by default",
+			Config{},
+			[]bool{true, true, false, false, false, false, true, true},
+			[]bool{true, true, true, true, true, true, false, false},
+			4, nil, 0,
+		}, {
+			"endgame",
+			Config{EndgameThreshold: 8},
+			[]bool{true, true, true, true, false, false, false, false},
+			all,
+			4, nil, 0,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+
+			torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(8, 1).MetaInfo)
+			defer cleanup()
+
+			stats := tally.NewTestScope("", nil)
+			test.config.PipelineLimit = 4
+			test.config.DisableKeepalive = true
+			if test.config.EndgameThreshold == 0 {
+				test.config.DisableEndgame = true
+			}
+			d := testDispatcher(test.config, clock.NewMock(), torrent)
+			d.stats = stats
+
+			other, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(test.other...), newMockMessages())
+			require.NoError(err)
+			p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(test.peer...), newMockMessages())
+			require.NoError(err)
+
+			_, err = d.maybeRequestMorePieces(p)
+			require.NoError(err)
+			requested := requestedPieces(p.messages)
+			require.Len(requested, test.expected, fmt.Sprint(requested))
+			if test.unique != nil {
+				require.ElementsMatch(test.unique, requested)
+			}
+
+			// The complete peer is requested the remaining pieces.
+			_, err = d.maybeRequestMorePieces(other)
+			require.NoError(err)
+			require.NotEmpty(requestedPieces(other.messages))
+
+			var shared int64
+			if c, ok := stats.Snapshot().Counters()["shared_pieces_reserved_under_incomplete_peers+"]; ok {
+				shared = c.Value()
+			}
+			require.Equal(test.requested, shared)
+		})
+	}
+}
@@ -14,12 +14,39 @@
 package dispatch
 
 import (
+	"fmt"
 	"math"
 	"time"
 
 	"github.com/uber/kraken/lib/torrent/scheduler/dispatch/piecerequest"
+	"github.com/uber/kraken/lib/torrent/storage"
 	"github.com/uber/kraken/utils/memsize"
 	"github.com/uber/kraken/utils/timeutil"
+
+	"github.com/andres-erbsen/clock"
+)
+
+// Download orders, see Config.DownloadOrder.
+const (
+	// RandomDownloadOrder downloads pieces in the order of
+	// Config.PieceRequestPolicy, e.g. rarest first.
+	RandomDownloadOrder = "random"
+
+	// SequentialDownloadOrder downloads the lowest indexed pieces first, such
+	// that pieces arrive roughly in order, e.g. to stream a blob as it
+	// downloads.
+	SequentialDownloadOrder = "sequential"
+)
+
+// Peer replacement policies, see Config.PeerReplacementPolicy.
+const (
+	// RejectNewPeers rejects new peers while at Config.MaxPeers.
+	RejectNewPeers = "reject_new"
+
+	// EvictWorstPeer evicts the least useful idle peer to make room for a new
+	// peer while at Config.MaxPeers, and rejects the new peer if no peer is
+	// idle, i.e. every peer recently connected or transferred a piece.
+	EvictWorstPeer = "evict_worst"
 )
 
 // Config defines the configuration for piece dispatch.
@@ -33,38 +60,746 @@ type Config struct {
 	// timeouts based on the piece size (in megabytes).
 	PieceRequestTimeoutPerMb time.Duration `yaml:"piece_request_timeout_per_mb"`
 
+	// PieceRequestMaxResendBackoff caps the backoff between resends of a piece
+	// whose requests keep failing. The backoff starts at half of the piece
+	// request timeout, i.e. the interval at which failed requests are resent,
+	// and doubles with every retry.
+	PieceRequestMaxResendBackoff time.Duration `yaml:"piece_request_max_resend_backoff"`
+
+	DisablePieceRequestResendBackoff bool `yaml:"disable_piece_request_resend_backoff"`
+
+	// AdaptivePieceRequestTimeout, if set, adapts the piece request timeout to
+	// the observed latencies of piece requests, rather than deriving it from
+	// the piece size alone. The timeout is the exponentially weighted moving
+	// average of latencies, weighing each new latency by
+	// PieceRequestLatencyWeight, plus PieceRequestTimeoutDeviations standard
+	// deviations, within [PieceRequestTimeoutFloor, PieceRequestTimeoutCeiling].
+	// The static timeout applies until the first latency is observed. Expired
+	// requests count as latencies of the timeout they expired after.
+	//
+	// PieceRequestTimeoutCeiling defaults to 4 times the static timeout.
+	AdaptivePieceRequestTimeout   bool          `yaml:"adaptive_piece_request_timeout"`
+	PieceRequestLatencyWeight     float64       `yaml:"piece_request_latency_weight"`
+	PieceRequestTimeoutDeviations float64       `yaml:"piece_request_timeout_deviations"`
+	PieceRequestTimeoutFloor      time.Duration `yaml:"piece_request_timeout_floor"`
+	PieceRequestTimeoutCeiling    time.Duration `yaml:"piece_request_timeout_ceiling"`
+
+	// PieceRequestEvents emits network events for piece requests which expired
+	// or were invalid, and for duplicate pieces received, on top of sent
+	// requests and received pieces. Off by default, since these events are
+	// higher volume than other network events.
+	PieceRequestEvents bool `yaml:"piece_request_events"`
+
 	// PieceRequestPolicy is the policy that is used to decide which pieces to request
-	// from a peer.
+	// from a peer. Defaults to piecerequest.DefaultPolicy, which selects pieces
+	// randomly. piecerequest.RarestFirstPolicy selects the pieces the fewest
+	// peers have first.
 	PieceRequestPolicy string `yaml:"piece_request_policy"`
 
+	// DownloadOrder decides the order in which pieces are downloaded, see
+	// RandomDownloadOrder and SequentialDownloadOrder.
+	DownloadOrder string `yaml:"download_order"`
+
 	// PipelineLimit limits the total number of requests can be sent to a peer
 	// at the same time.
 	PipelineLimit int `yaml:"pipeline_limit"`
 
+	// MinPipelineLimit and MaxPipelineLimit bound the pipeline limit of each
+	// peer, which starts at PipelineLimit and adapts to how fast the peer returns
+	// pieces: it grows while the peer returns pieces well under the piece request
+	// timeout, and shrinks when requests to the peer expire or yield invalid
+	// pieces. Both default to PipelineLimit, i.e. pipeline limits do not adapt.
+	MinPipelineLimit int `yaml:"min_pipeline_limit"`
+	MaxPipelineLimit int `yaml:"max_pipeline_limit"`
+
+	// MaxReservationsPerPeer caps the total number of outstanding piece requests
+	// to each peer, including endgame duplicates and expired requests which the
+	// peer has yet to answer. Pipeline limits only count unexpired requests, so
+	// without the cap, peers which stall keep receiving new requests as old ones
+	// expire. Unlimited if zero, the default.
+	MaxReservationsPerPeer int `yaml:"max_reservations_per_peer"`
+
+	// PriorityHedgeFactor caps the pending requests of each prioritized piece,
+	// see Dispatcher.PrioritizePieces, i.e. the number of peers a prioritized
+	// piece is requested from at once. Defaults to 2, i.e. one hedged duplicate
+	// on top of the primary request.
+	PriorityHedgeFactor int `yaml:"priority_hedge_factor"`
+
 	// EndgameThreshold is the number pieces required to complete the torrent
 	// before the torrent enters "endgame", where we start overloading piece
 	// requests to multiple peers.
 	EndgameThreshold int `yaml:"endgame_threshold"`
 
 	DisableEndgame bool `yaml:"disable_endgame"`
+
+	// ChunkSize, if set, splits piece requests into requests for chunks of at
+	// most ChunkSize bytes. Pieces are only written once all of their chunks
+	// have been received. Chunk requests from peers are always served.
+	ChunkSize int64 `yaml:"chunk_size"`
+
+	// PieceRequestAgingRate is how much the rarity of a piece improves for every
+	// round in which the piece was needed but not selected, such that no piece is
+	// deferred indefinitely under the rarest first policy. A round is one check
+	// for failed piece requests, i.e. half of the piece request timeout. Rates
+	// below 1 improve the rarity of a piece by less than one peer per round.
+	PieceRequestAgingRate float64 `yaml:"piece_request_aging_rate"`
+
+	DisablePieceRequestAging bool `yaml:"disable_piece_request_aging"`
+
+	// EnableAsymmetricPeerDetection enables detection of asymmetric peers, i.e.
+	// peers which we can serve pieces to but never receive pieces from (e.g. due
+	// to NAT or firewalls). A peer is asymmetric once we sent it at least
+	// AsymmetricPeerMinPiecesSent pieces and AsymmetricPeerMinExpiredRequests
+	// consecutive requests to it expired. Asymmetric peers are excluded from
+	// piece selection, but are still served. Every AsymmetricPeerProbeInterval,
+	// pieces are requested from an asymmetric peer again, and a single further
+	// expired request excludes it again.
+	EnableAsymmetricPeerDetection    bool          `yaml:"enable_asymmetric_peer_detection"`
+	AsymmetricPeerMinPiecesSent      int           `yaml:"asymmetric_peer_min_pieces_sent"`
+	AsymmetricPeerMinExpiredRequests int           `yaml:"asymmetric_peer_min_expired_requests"`
+	AsymmetricPeerProbeInterval      time.Duration `yaml:"asymmetric_peer_probe_interval"`
+
+	// NumSlowestServes is the number of slowest piece serves to keep track of.
+	NumSlowestServes int `yaml:"num_slowest_serves"`
+
+	// If set, pieces which take longer than SlowServeThreshold to serve at least
+	// SlowServeLimit times are no longer announced nor included in the bitfields
+	// sent to new peers, such that peers fetch them elsewhere. Peers which
+	// already know of such pieces are still served. A piece is advertised again
+	// once it is served within SlowServeThreshold, or after
+	// SlowServeRecoveryInterval.
+	SlowServeThreshold        time.Duration `yaml:"slow_serve_threshold"`
+	SlowServeLimit            int           `yaml:"slow_serve_limit"`
+	SlowServeRecoveryInterval time.Duration `yaml:"slow_serve_recovery_interval"`
+
+	// LoadAdmission, if set, is consulted before serving each piece, such that
+	// serves can be deferred or rejected while the host is busy. Deferred serves
+	// are retried every ServeDeferInterval, and at most MaxDeferredServes serves
+	// may be deferred at once.
+	LoadAdmission      LoadAdmission `yaml:"-"`
+	ServeDeferInterval time.Duration `yaml:"serve_defer_interval"`
+	MaxDeferredServes  int           `yaml:"max_deferred_serves"`
+
+	// AnnounceBudget, if set, limits the rate at which pieces are announced to
+	// peers, across all Dispatchers sharing the budget. Once the budget is
+	// exhausted, the pieces announced to each peer are coalesced into a single
+	// announce pieces message, which is sent once the budget allows. Complete
+	// and error messages are never limited.
+	AnnounceBudget *AnnounceBudget `yaml:"-"`
+
+	// AnnounceBatchInterval, if set, batches the pieces announced to peers which
+	// support conn.AnnouncePieces, such that each peer is sent a single announce
+	// pieces message per AnnounceBatchInterval, or once AnnounceBatchSize pieces
+	// are pending to the peer. Batched pieces are flushed on teardown. Other peers
+	// are announced each piece as usual.
+	AnnounceBatchInterval time.Duration `yaml:"announce_batch_interval"`
+	AnnounceBatchSize     int           `yaml:"announce_batch_size"`
+
+	// AnnounceCoalesceWindow, if set, coalesces the pieces which peers announce
+	// to us within the window, such that needed pieces announced by many peers
+	// at once are requested in a single selection pass, each from its least
+	// loaded announcer, rather than in a request cycle per announcement.
+	// Disabled by default.
+	AnnounceCoalesceWindow time.Duration `yaml:"announce_coalesce_window"`
+
+	// StatusListener, if set, is notified of peer, progress and state changes
+	// at most once per StatusInterval.
+	StatusListener StatusListener `yaml:"-"`
+	StatusInterval time.Duration  `yaml:"status_interval"`
+
+	// Runner, if set, runs the periodic work of the Dispatcher, such as resend
+	// ticks, rechokes, sweeps and keepalives, on the workers it shares with
+	// other Dispatchers, rather than on dedicated goroutines. The Dispatcher
+	// must use the clock of the Runner.
+	Runner *Runner `yaml:"-"`
+
+	// EventListenerTimeout is the maximum time a listener registered via
+	// WithEventListeners may take to consume an event before it is dropped.
+	// EventListenerQueueSize bounds the events queued for each listener, beyond
+	// which it is dropped as well. The primary Events passed to New is never
+	// dropped. Defaults to 5s and 1024 events.
+	EventListenerTimeout   time.Duration `yaml:"event_listener_timeout"`
+	EventListenerQueueSize int           `yaml:"event_listener_queue_size"`
+
+	// PeerRateWindow is the time constant with which peer download rates are
+	// smoothed.
+	PeerRateWindow time.Duration `yaml:"peer_rate_window"`
+
+	// PieceRTTWeight is the weight of the latest sample in the moving average
+	// of the time between requesting a piece from a peer and receiving it.
+	// Peers with higher averages than the fastest peer get proportionally
+	// smaller pipeline limits, but never less than one request, unless
+	// DisableLatencyPreference is set.
+	PieceRTTWeight           float64 `yaml:"piece_rtt_weight"`
+	DisableLatencyPreference bool    `yaml:"disable_latency_preference"`
+
+	// IncompletePeerPipelineShare is the share of the pipeline of an incomplete
+	// peer which may hold requests for pieces that complete peers hold too,
+	// rounded up. Requesting such pieces from complete peers, e.g. origins,
+	// leaves the upload of incomplete peers for pieces only they have, while
+	// the remaining share keeps incomplete peers from being starved. Peers
+	// holding at least CompletePeerThreshold of all pieces count as complete.
+	// Defaults to 0.5 and 1, respectively. DisableCompletePeerPreference
+	// requests pieces from all peers alike.
+	IncompletePeerPipelineShare   float64 `yaml:"incomplete_peer_pipeline_share"`
+	CompletePeerThreshold         float64 `yaml:"complete_peer_threshold"`
+	DisableCompletePeerPreference bool    `yaml:"disable_complete_peer_preference"`
+
+	// LocalityWeight biases piece requests and upload slots toward local peers,
+	// i.e. peers which share the locality of the Dispatcher, e.g. its zone, see
+	// WithLocality. Other peers may hold at most 1 - LocalityWeight of their
+	// pipeline, rounded up, in requests for pieces which local peers hold too,
+	// while pieces which no local peer holds are requested from them freely.
+	// LocalityWeight of the upload slots other than the optimistic unchoke,
+	// rounded up, go to local peers first. Defaults to 0.5.
+	// DisableLocalityPreference treats all peers alike.
+	LocalityWeight            float64 `yaml:"locality_weight"`
+	DisableLocalityPreference bool    `yaml:"disable_locality_preference"`
+
+	// NetworkInterfaces label the local network interfaces of hosts with
+	// multiple NICs, e.g. to tell peers on a storage network apart from WAN
+	// peers. Peers are labeled by the interface their connection arrived on,
+	// "other" if it arrived on none of the interfaces and "unknown" if its local
+	// address is unknown. If set, throughput and latency metrics are tagged by
+	// the label of the peer, and pieces are requested from peers on preferred
+	// interfaces first, see NetworkInterface.Preference.
+	NetworkInterfaces []NetworkInterface `yaml:"network_interfaces"`
+
+	// EgressBytesPerSec limits the rate at which pieces are served to all peers
+	// of a torrent. Serves exceeding the limit are queued, and fail once more than
+	// MaxQueuedEgressServes serves are queued. Zero disables the limit.
+	EgressBytesPerSec     int64 `yaml:"egress_bytes_per_sec"`
+	MaxQueuedEgressServes int   `yaml:"max_queued_egress_serves"`
+
+	// ServeSchedulingPolicy decides which queued serves are served first once
+	// egress is available, see FIFOServePolicy and CompletionServePolicy.
+	// ServeScheduler, if set, is used instead.
+	ServeSchedulingPolicy string         `yaml:"serve_scheduling_policy"`
+	ServeScheduler        ServeScheduler `yaml:"-"`
+
+	// PriorityServePercent bounds how often piece requests which peers marked
+	// as urgent, see conn.PriorityRequests, are served ahead of other requests:
+	// while both kinds of requests are queued, priority requests receive at most
+	// PriorityServePercent percent of serves, such that bulk requests are not
+	// starved. Applies to the serves queued for egress and to the requests
+	// queued by each peer.
+	PriorityServePercent int `yaml:"priority_serve_percent"`
+
+	// IngressBytesPerSec limits the rate at which pieces are downloaded, by
+	// deferring new piece requests while the limit is exceeded. Zero disables
+	// the limit. May be adjusted at runtime via Dispatcher.SetIngressLimit.
+	IngressBytesPerSec int64 `yaml:"ingress_bytes_per_sec"`
+
+	// PieceUnavailableTimeout, if set, is how long missing pieces may have no
+	// peer to request them from before Events.PiecesUnavailable is emitted, such
+	// that they can be fetched out-of-band. Pieces which no peer has once endgame
+	// is entered are reported right away.
+	PieceUnavailableTimeout time.Duration `yaml:"piece_unavailable_timeout"`
+
+	// StallTimeout, if set, is how long an incomplete torrent may receive no
+	// piece before Events.DispatcherStalled is emitted, such that the scheduler
+	// may look for fresh peers. Checked every half piece request timeout.
+	StallTimeout time.Duration `yaml:"stall_timeout"`
+
+	// UtilizationWeight is the weight of the latest sample in the moving
+	// average of the fraction of the theoretical maximum of piece requests in
+	// flight, sampled every half piece request timeout, see
+	// Dispatcher.Utilization. Samples below LowUtilizationThreshold attribute
+	// the low utilization to why peers were sent no piece requests, see the
+	// low_utilization_declines metric.
+	UtilizationWeight       float64 `yaml:"utilization_weight"`
+	LowUtilizationThreshold float64 `yaml:"low_utilization_threshold"`
+
+	// RejectPieceRequestsWhilePaused rejects piece requests of peers with a
+	// retryable error while the Dispatcher is paused, see Dispatcher.Pause,
+	// such that peers request pieces elsewhere. Otherwise, pieces are served
+	// while paused.
+	RejectPieceRequestsWhilePaused bool `yaml:"reject_piece_requests_while_paused"`
+
+	// DecisionBufferSize, if set, keeps the last DecisionBufferSize piece
+	// selections, peer evictions, piece request resends and peer bans of each
+	// Dispatcher in memory, for debugging decisions after the fact, see
+	// Dispatcher.Decisions. Disabled if zero, the default.
+	DecisionBufferSize int `yaml:"decision_buffer_size"`
+
+	// DisableStatsGuard emits all metrics inline. Otherwise, handlers are
+	// guarded against a slow metrics backend: one in StatsSampleRate metric
+	// emissions is timed, and once an emission takes SlowStatsThreshold or
+	// longer, metrics are aggregated locally and flushed to the backend every
+	// StatsFlushInterval, until a flush finds the backend fast again. At most
+	// MaxAggregatedMetrics distinct metrics are aggregated between flushes. See
+	// Dispatcher.StatsGuard.
+	DisableStatsGuard    bool          `yaml:"disable_stats_guard"`
+	StatsSampleRate      int           `yaml:"stats_sample_rate"`
+	SlowStatsThreshold   time.Duration `yaml:"slow_stats_threshold"`
+	StatsFlushInterval   time.Duration `yaml:"stats_flush_interval"`
+	MaxAggregatedMetrics int           `yaml:"max_aggregated_metrics"`
+
+	// EnableChoking limits the number of peers which are served at the same time
+	// to UploadSlots. Requests from other, choked peers are held until they are
+	// unchoked, and rejected once more than MaxChokedRequests requests are held
+	// per peer. Upload slots are reassigned every ChokeInterval. Peers which
+	// support conn.Choke are notified when they are choked or unchoked, and
+	// request pieces elsewhere meanwhile. Other peers are not notified, so their
+	// held requests may time out.
+	EnableChoking     bool          `yaml:"enable_choking"`
+	UploadSlots       int           `yaml:"upload_slots"`
+	MaxChokedRequests int           `yaml:"max_choked_requests"`
+	ChokeInterval     time.Duration `yaml:"choke_interval"`
+
+	// ReciprocityWindow is the sliding window over which the piece bytes
+	// received from and sent to each peer are counted. While we download, the
+	// regular upload slots go to the peers which sent us the most bytes within
+	// the window, with ties going to the peers we sent the fewest bytes, such
+	// that peers which download from us without reciprocating are served last.
+	// Seeders receive nothing, so they rotate their slots among their peers
+	// instead. Defaults to 30s. DisableTitForTat ranks peers by their download
+	// rate, see PeerRateWindow.
+	ReciprocityWindow time.Duration `yaml:"reciprocity_window"`
+	DisableTitForTat  bool          `yaml:"disable_tit_for_tat"`
+
+	// MaxQueuedServes is the maximum number of piece requests which may be queued
+	// per unchoked peer. Further requests are rejected, so a peer cannot grow
+	// its queue without bound by requesting faster than it is served.
+	MaxQueuedServes int `yaml:"max_queued_serves"`
+
+	// MaxRetryAfter caps how long pieces which a peer rejected transiently are
+	// withheld from the peer, if the peer hinted when to retry. Peers which
+	// support conn.RetryAfter are sent hints when we reject their requests, i.e.
+	// when the choke is reassigned, when the serve queue or the egress queue is
+	// estimated to drain, or after ServeDeferInterval when shedding load.
+	MaxRetryAfter time.Duration `yaml:"max_retry_after"`
+
+	// QueueSampleInterval is the interval at which the message queues of peer
+	// connections are sampled. Peers whose oldest queued control message is
+	// older than HeadOfLineBlockingThreshold are considered head-of-line
+	// blocked, and their connections are closed if ResetHeadOfLineBlockedConns
+	// is set.
+	QueueSampleInterval         time.Duration `yaml:"queue_sample_interval"`
+	HeadOfLineBlockingThreshold time.Duration `yaml:"head_of_line_blocking_threshold"`
+	ResetHeadOfLineBlockedConns bool          `yaml:"reset_head_of_line_blocked_conns"`
+
+	// UsefulPiecesCacheBytes limits the memory used to cache the pieces each
+	// peer has which we do not. Peers beyond the limit compute their useful
+	// pieces whenever pieces are requested from them.
+	UsefulPiecesCacheBytes int64 `yaml:"useful_pieces_cache_bytes"`
+
+	// ServePrefetchDepth, if set, is the number of pieces which are read ahead
+	// for a peer whose piece requests ascend, such that they are served from
+	// memory once requested. Prefetched pieces which are not requested within
+	// ServePrefetchTTL are discarded, and at most ServePrefetchBytes may be
+	// prefetched at once.
+	ServePrefetchDepth int           `yaml:"serve_prefetch_depth"`
+	ServePrefetchTTL   time.Duration `yaml:"serve_prefetch_ttl"`
+	ServePrefetchBytes int64         `yaml:"serve_prefetch_bytes"`
+
+	// PieceVerifier, if set, creates the verifier which received pieces must
+	// pass as they are written, in addition to the verifier of storage. Pieces
+	// read back by ServeVerifyInterval are verified by it, or by the checksums
+	// of the torrent metainfo if unset.
+	PieceVerifier storage.PieceVerifierFactory `yaml:"-" json:"-"`
+
+	// MaxInvalidPieces and InvalidPieceWindow define when a peer is banned: once
+	// it sent more than MaxInvalidPieces invalid pieces within
+	// InvalidPieceWindow, the peer is removed and reported via Events.PeerBanned.
+	// Pieces which another peer delivered first do not count as invalid.
+	MaxInvalidPieces   int           `yaml:"max_invalid_pieces"`
+	InvalidPieceWindow time.Duration `yaml:"invalid_piece_window"`
+
+	// MaxProtocolViolations defines when a peer is banned for malformed
+	// messages: once it committed more than MaxProtocolViolations protocol
+	// violations, such as announcements of pieces out of range.
+	MaxProtocolViolations int `yaml:"max_protocol_violations"`
+
+	DisablePeerBans bool `yaml:"disable_peer_bans"`
+
+	// Superseed, if set, hides the bitfield of a Dispatcher which is complete
+	// when created, e.g. an origin seeding a new blob, from its peers. Each peer
+	// is instead revealed SuperseedPieces pieces at a time, distinct from the
+	// pieces revealed to other peers, and is revealed another piece once it
+	// announces a revealed piece back. Off by default.
+	Superseed       bool `yaml:"superseed"`
+	SuperseedPieces int  `yaml:"superseed_pieces"`
+
+	// CompletedPeerCloseWindow spreads the closes of connections to completed
+	// peers once a Dispatcher completes, such that torrents which complete on
+	// many agents at once do not disconnect and redial in storms. Of both sides
+	// of a connection, only the one with the lower peer id closes it, at a
+	// random delay within the window. The other side sends its completion
+	// instead, and only closes the connection once the window elapsed, in case
+	// the remote never does. ImmediateCompletedPeerClose closes connections to
+	// completed peers right away on both sides instead. Windows of zero or less
+	// default to 5s.
+	CompletedPeerCloseWindow    time.Duration `yaml:"completed_peer_close_window"`
+	ImmediateCompletedPeerClose bool          `yaml:"immediate_completed_peer_close"`
+
+	// MaxPeers, if set, limits the number of peers of a Dispatcher. Once it has
+	// MaxPeers peers, AddPeer makes room as decided by PeerReplacementPolicy,
+	// see RejectNewPeers and EvictWorstPeer, or fails with ErrTooManyPeers.
+	MaxPeers              int    `yaml:"max_peers"`
+	PeerReplacementPolicy string `yaml:"peer_replacement_policy"`
+
+	// ReadOnly, if set, only serves the torrent of a Dispatcher, which must be
+	// complete when created: received piece payloads are protocol violations,
+	// pieces are never written, and no piece requests are tracked. Dispatchers
+	// over a storage.ReadOnlyTorrent are always read-only.
+	ReadOnly bool `yaml:"read_only"`
+
+	// SeedOnly, if set, never requests pieces, and only serves the pieces which
+	// the torrent of a Dispatcher has. Dispatchers over torrents which are
+	// complete when created are always seed-only, and Dispatchers which
+	// complete become seed-only: no piece requests are tracked, announcements
+	// of peers merely update their bitfields, and received piece payloads are
+	// discarded as duplicates. Unlike ReadOnly, the torrent may be incomplete.
+	SeedOnly bool `yaml:"seed_only"`
+
+	// MaxCorruptPieces, if set, is the number of received pieces which may fail
+	// verification before the download fails with TearDownCorruption.
+	MaxCorruptPieces int `yaml:"max_corrupt_pieces"`
+
+	// DownloadDeadline, if set, fails the download with TearDownDeadline if the
+	// torrent is not complete within DownloadDeadline of the Dispatcher's creation.
+	DownloadDeadline time.Duration `yaml:"download_deadline"`
+
+	// ServeVerifyInterval, if set, reads back and verifies one in every
+	// ServeVerifyInterval pieces before they are served, such that a seeder
+	// whose storage was corrupted fails requests for the corrupt pieces instead
+	// of serving them.
+	ServeVerifyInterval int `yaml:"serve_verify_interval"`
+
+	// QuarantineSuspectPieces, if set, quarantines pieces which fail sampled
+	// serve verification, or which cannot be read from storage for a serve.
+	// Quarantined pieces are no longer advertised and requests for them are
+	// rejected, while the torrent stays complete and the other pieces are
+	// served as usual. Events.PiecesQuarantined lists the quarantined pieces,
+	// such that they may be fetched again. If QuarantineReverifyInterval is
+	// set, quarantined pieces are verified again at that interval, and released
+	// from quarantine once they pass.
+	QuarantineSuspectPieces    bool          `yaml:"quarantine_suspect_pieces"`
+	QuarantineReverifyInterval time.Duration `yaml:"quarantine_reverify_interval"`
+
+	// MaxErrorMessages and ErrorMessageInterval limit the error messages sent
+	// to each peer for piece requests which we failed to serve, e.g. due to disk
+	// errors: a peer is sent at most MaxErrorMessages error messages per
+	// ErrorMessageInterval, and further error messages are dropped, such that a
+	// peer which retries in a tight loop does not cause an error storm.
+	MaxErrorMessages         int           `yaml:"max_error_messages"`
+	ErrorMessageInterval     time.Duration `yaml:"error_message_interval"`
+	DisableErrorMessageLimit bool          `yaml:"disable_error_message_limit"`
+
+	// MaxConsecutiveServeFailures, if set, closes the connection to a peer once
+	// this many serves to the peer failed in a row, such that the peer looks
+	// for a healthier source. Off by default.
+	MaxConsecutiveServeFailures int `yaml:"max_consecutive_serve_failures"`
+
+	// DisablePayloadCompression disables compressing the piece payloads we serve,
+	// e.g. on origins serving blobs which are already compressed. Otherwise
+	// payloads are compressed with the codec negotiated with each peer, if any,
+	// and sent uncompressed if they do not shrink. Received payloads are
+	// decompressed regardless.
+	DisablePayloadCompression bool `yaml:"disable_payload_compression"`
+
+	// KeepaliveInterval and MaxMissedKeepalives define when a peer is considered
+	// dead, e.g. since its host was power-cycled and the connection lingers
+	// half-open: peers which sent us no message within KeepaliveInterval are sent
+	// a keepalive, and once a peer left MaxMissedKeepalives keepalives in a row
+	// unanswered for KeepaliveInterval each, it is removed. Only applies to peers
+	// which support conn.Keepalive.
+	KeepaliveInterval   time.Duration `yaml:"keepalive_interval"`
+	MaxMissedKeepalives int           `yaml:"max_missed_keepalives"`
+	DisableKeepalive    bool          `yaml:"disable_keepalive"`
+
+	// PeerCompactionInterval, PeerDetailTTL and MaxPeerDetails bound the detail
+	// kept about peers after they are removed, such as their transfer stats:
+	// every PeerCompactionInterval, the detail of peers removed longer than
+	// PeerDetailTTL ago is folded into aggregates which preserve totals, and so
+	// is the detail of the longest removed peers beyond MaxPeerDetails removed
+	// peers per map. See the compacted_peer_entries metric.
+	PeerCompactionInterval time.Duration `yaml:"peer_compaction_interval"`
+	PeerDetailTTL          time.Duration `yaml:"peer_detail_ttl"`
+	MaxPeerDetails         int           `yaml:"max_peer_details"`
+	DisablePeerCompaction  bool          `yaml:"disable_peer_compaction"`
+
+	// PeerActivityWindow is how recently a piece must have been transferred to
+	// or from a removed peer for the peer to count as still active when it was
+	// removed, see the removed_peers metric.
+	PeerActivityWindow time.Duration `yaml:"peer_activity_window"`
+
+	// PeerIdleTimeout, if set, evicts peers which transferred no piece in
+	// either direction for this long, unless they are the only peer which has
+	// some piece we still need. Disabled if zero, the default.
+	PeerIdleTimeout time.Duration `yaml:"peer_idle_timeout"`
+
+	// PieceWriteWorkers, if set, writes and verifies received pieces on at most
+	// PieceWriteWorkers goroutines, rather than on the goroutines which handle
+	// the messages of peers, such that a slow disk does not stall the other
+	// messages of peers. Once all workers are busy, the goroutines of peers
+	// which delivered pieces wait for a worker. Zero, the default, writes
+	// pieces synchronously.
+	PieceWriteWorkers int `yaml:"piece_write_workers"`
+
+	// SendQueueSize, if set, queues up to SendQueueSize messages to each peer
+	// in front of its connection, such that a peer which stops reading does
+	// not stall sending messages to other peers. Messages to a peer whose queue
+	// is full are dropped, except for piece payloads and requests, which wait up
+	// to SendQueueBlockTimeout for room. Peers whose queue stays full for
+	// SendQueueFullTimeout are closed, as are peers whose queued messages fail
+	// to send. Zero, the default, hands messages to connections directly.
+	SendQueueSize         int           `yaml:"send_queue_size"`
+	SendQueueBlockTimeout time.Duration `yaml:"send_queue_block_timeout"`
+	SendQueueFullTimeout  time.Duration `yaml:"send_queue_full_timeout"`
+
+	// AuditSink, if set, receives the AuditRecord of each Dispatcher when it is
+	// torn down. Records list at most MaxAuditPeers peers individually, and
+	// aggregate all others.
+	AuditSink     AuditSink `yaml:"-"`
+	MaxAuditPeers int       `yaml:"max_audit_peers"`
+
+	// SizeBuckets are ascending torrent sizes in bytes, which split torrents
+	// into buckets tagging the metrics of their Dispatchers as size_bucket,
+	// such that small blobs and large images are not aggregated together.
+	// Defaults to 10MB, 100MB and 1GB.
+	SizeBuckets []int64 `yaml:"size_buckets"`
 }
 
 func (c Config) applyDefaults() Config {
 	if c.PieceRequestPolicy == "" {
 		c.PieceRequestPolicy = piecerequest.DefaultPolicy
 	}
+	if c.DownloadOrder == "" {
+		c.DownloadOrder = RandomDownloadOrder
+	}
+	if c.PeerReplacementPolicy == "" {
+		c.PeerReplacementPolicy = RejectNewPeers
+	}
+	if c.DownloadOrder == SequentialDownloadOrder {
+		c.PieceRequestPolicy = piecerequest.SequentialPolicy
+	}
 	if c.PieceRequestMinTimeout == 0 {
 		c.PieceRequestMinTimeout = 4 * time.Second
 	}
 	if c.PieceRequestTimeoutPerMb == 0 {
 		c.PieceRequestTimeoutPerMb = 4 * time.Second
 	}
+	if c.PieceRequestMaxResendBackoff == 0 {
+		c.PieceRequestMaxResendBackoff = 2 * time.Minute
+	}
+	if c.PieceRequestLatencyWeight == 0 {
+		c.PieceRequestLatencyWeight = 0.125
+	}
+	if c.PieceRequestTimeoutDeviations == 0 {
+		c.PieceRequestTimeoutDeviations = 4
+	}
+	if c.PieceRequestTimeoutFloor == 0 {
+		c.PieceRequestTimeoutFloor = time.Second
+	}
+	if c.DisablePieceRequestResendBackoff {
+		c.PieceRequestMaxResendBackoff = 0
+	}
 	if c.PipelineLimit == 0 {
 		c.PipelineLimit = 3
 	}
+	if c.SuperseedPieces == 0 {
+		c.SuperseedPieces = 2
+	}
+	if c.ServeSchedulingPolicy == "" {
+		c.ServeSchedulingPolicy = FIFOServePolicy
+	}
+	if c.MinPipelineLimit == 0 || c.MinPipelineLimit > c.PipelineLimit {
+		c.MinPipelineLimit = c.PipelineLimit
+	}
+	if c.MaxPipelineLimit < c.PipelineLimit {
+		c.MaxPipelineLimit = c.PipelineLimit
+	}
 	if c.EndgameThreshold == 0 {
 		c.EndgameThreshold = c.PipelineLimit
 	}
+	if c.PriorityHedgeFactor == 0 {
+		c.PriorityHedgeFactor = 2
+	}
+	if c.PieceRequestAgingRate == 0 {
+		c.PieceRequestAgingRate = 0.1
+	}
+	if c.DisablePieceRequestAging {
+		c.PieceRequestAgingRate = 0
+	}
+	if c.IncompletePeerPipelineShare == 0 {
+		c.IncompletePeerPipelineShare = 0.5
+	}
+	if c.CompletePeerThreshold == 0 {
+		c.CompletePeerThreshold = 1
+	}
+	if c.LocalityWeight == 0 {
+		c.LocalityWeight = 0.5
+	}
+	if c.LocalityWeight > 1 {
+		c.LocalityWeight = 1
+	}
+	if c.AsymmetricPeerMinPiecesSent == 0 {
+		c.AsymmetricPeerMinPiecesSent = 1
+	}
+	if c.AsymmetricPeerMinExpiredRequests == 0 {
+		c.AsymmetricPeerMinExpiredRequests = 2 * c.PipelineLimit
+	}
+	if c.AsymmetricPeerProbeInterval == 0 {
+		c.AsymmetricPeerProbeInterval = time.Minute
+	}
+	if c.AnnounceBatchSize == 0 {
+		c.AnnounceBatchSize = 64
+	}
+	if c.MaxInvalidPieces == 0 {
+		c.MaxInvalidPieces = 5
+	}
+	if c.InvalidPieceWindow == 0 {
+		c.InvalidPieceWindow = 10 * time.Minute
+	}
+	if c.MaxProtocolViolations == 0 {
+		c.MaxProtocolViolations = 3
+	}
+	if c.DisablePeerBans {
+		c.MaxInvalidPieces = 0
+		c.MaxProtocolViolations = 0
+	}
+	if c.MaxErrorMessages == 0 {
+		c.MaxErrorMessages = 10
+	}
+	if c.ErrorMessageInterval == 0 {
+		c.ErrorMessageInterval = time.Second
+	}
+	if c.DisableErrorMessageLimit {
+		c.MaxErrorMessages = 0
+	}
+	if c.NumSlowestServes == 0 {
+		c.NumSlowestServes = 10
+	}
+	if c.SlowServeLimit == 0 {
+		c.SlowServeLimit = 3
+	}
+	if c.SlowServeRecoveryInterval == 0 {
+		c.SlowServeRecoveryInterval = 5 * time.Minute
+	}
+	if c.ServeDeferInterval == 0 {
+		c.ServeDeferInterval = 100 * time.Millisecond
+	}
+	if c.MaxDeferredServes == 0 {
+		c.MaxDeferredServes = 64
+	}
+	if c.StatusInterval == 0 {
+		c.StatusInterval = time.Second
+	}
+	if c.EventListenerTimeout == 0 {
+		c.EventListenerTimeout = 5 * time.Second
+	}
+	if c.EventListenerQueueSize == 0 {
+		c.EventListenerQueueSize = 1024
+	}
+	if c.PeerRateWindow == 0 {
+		c.PeerRateWindow = 10 * time.Second
+	}
+	if c.PieceRTTWeight == 0 {
+		c.PieceRTTWeight = 0.2
+	}
+	if c.UtilizationWeight == 0 {
+		c.UtilizationWeight = 0.2
+	}
+	if c.LowUtilizationThreshold == 0 {
+		c.LowUtilizationThreshold = 0.5
+	}
+	if c.StatsSampleRate == 0 {
+		c.StatsSampleRate = 64
+	}
+	if c.SlowStatsThreshold == 0 {
+		c.SlowStatsThreshold = 10 * time.Millisecond
+	}
+	if c.StatsFlushInterval == 0 {
+		c.StatsFlushInterval = time.Second
+	}
+	if c.MaxAggregatedMetrics == 0 {
+		c.MaxAggregatedMetrics = 1024
+	}
+	if c.PriorityServePercent == 0 {
+		c.PriorityServePercent = 50
+	}
+	if c.PriorityServePercent > 100 {
+		c.PriorityServePercent = 100
+	}
+	if c.MaxQueuedEgressServes == 0 {
+		c.MaxQueuedEgressServes = 64
+	}
+	if c.UploadSlots == 0 {
+		c.UploadSlots = 4
+	}
+	if c.MaxChokedRequests == 0 {
+		c.MaxChokedRequests = 2 * c.PipelineLimit
+	}
+	if c.MaxQueuedServes == 0 {
+		c.MaxQueuedServes = 4 * c.PipelineLimit
+	}
+	if c.ChokeInterval == 0 {
+		c.ChokeInterval = 10 * time.Second
+	}
+	if c.ReciprocityWindow == 0 {
+		c.ReciprocityWindow = 30 * time.Second
+	}
+	if c.MaxRetryAfter == 0 {
+		c.MaxRetryAfter = 30 * time.Second
+	}
+	if c.QueueSampleInterval == 0 {
+		c.QueueSampleInterval = 5 * time.Second
+	}
+	if c.HeadOfLineBlockingThreshold == 0 {
+		c.HeadOfLineBlockingThreshold = 10 * time.Second
+	}
+	if c.UsefulPiecesCacheBytes == 0 {
+		c.UsefulPiecesCacheBytes = int64(memsize.MB)
+	}
+	if c.ServePrefetchTTL == 0 {
+		c.ServePrefetchTTL = 5 * time.Second
+	}
+	if c.ServePrefetchBytes == 0 {
+		c.ServePrefetchBytes = int64(16 * memsize.MB)
+	}
+	if c.KeepaliveInterval == 0 {
+		c.KeepaliveInterval = 30 * time.Second
+	}
+	if c.MaxMissedKeepalives == 0 {
+		c.MaxMissedKeepalives = 3
+	}
+	if c.DisableKeepalive {
+		c.KeepaliveInterval = 0
+	}
+	if c.PeerActivityWindow == 0 {
+		c.PeerActivityWindow = 10 * time.Second
+	}
+	if c.SendQueueBlockTimeout == 0 {
+		c.SendQueueBlockTimeout = 5 * time.Second
+	}
+	if c.SendQueueFullTimeout == 0 {
+		c.SendQueueFullTimeout = 30 * time.Second
+	}
+	if c.MaxAuditPeers == 0 {
+		c.MaxAuditPeers = 100
+	}
+	if c.PeerCompactionInterval == 0 {
+		c.PeerCompactionInterval = 10 * time.Minute
+	}
+	if c.PeerDetailTTL == 0 {
+		c.PeerDetailTTL = time.Hour
+	}
+	if c.MaxPeerDetails == 0 {
+		c.MaxPeerDetails = 1000
+	}
+	if c.CompletedPeerCloseWindow <= 0 {
+		c.CompletedPeerCloseWindow = 5 * time.Second
+	}
+	if c.DisablePeerCompaction {
+		c.PeerCompactionInterval = 0
+	}
+	if len(c.SizeBuckets) == 0 {
+		c.SizeBuckets = []int64{
+			int64(10 * memsize.MB), int64(100 * memsize.MB), int64(memsize.GB),
+		}
+	}
 	return c
 }
 
@@ -73,3 +808,70 @@ func (c Config) calcPieceRequestTimeout(maxPieceLength int64) time.Duration {
 	d := time.Duration(math.Ceil(n))
 	return timeutil.MaxDuration(d, c.PieceRequestMinTimeout)
 }
+
+// WithDefaults returns c with defaults applied to all unset fields, i.e. the
+// configuration Dispatchers actually run with.
+func (c Config) WithDefaults() Config {
+	return c.applyDefaults()
+}
+
+// NewPieceRequestManager creates the piece request bookkeeping of Dispatchers for
+// torrents whose largest piece is maxPieceLength bytes, and returns it along with
+// the piece request timeout. Offline tools use it to replay piece requests
+// exactly as Dispatchers make them, except that the timeout stays static even if
+// AdaptivePieceRequestTimeout is set.
+func (c Config) NewPieceRequestManager(
+	clk clock.Clock, maxPieceLength int64) (*piecerequest.Manager, time.Duration, error) {
+
+	c = c.applyDefaults()
+	timeout := c.calcPieceRequestTimeout(maxPieceLength)
+	m, err := c.newPieceRequestManager(clk, timeout, piecerequest.FixedTimeout(timeout))
+	if err != nil {
+		return nil, 0, err
+	}
+	return m, timeout, nil
+}
+
+// newPieceRequestManager creates a piece request manager whose requests expire
+// after the timeout returned by provider. The resend backoff starts at half of
+// the static timeout. Defaults must be applied to c.
+func (c Config) newPieceRequestManager(
+	clk clock.Clock,
+	timeout time.Duration,
+	provider piecerequest.TimeoutProvider) (*piecerequest.Manager, error) {
+
+	m, err := piecerequest.NewManager(
+		clk, provider, c.PieceRequestPolicy, c.PipelineLimit, c.PieceRequestAgingRate)
+	if err != nil {
+		return nil, fmt.Errorf("piece request manager: %s", err)
+	}
+	m.SetPipelineBounds(c.MinPipelineLimit, c.MaxPipelineLimit)
+	m.SetResendBackoff(timeout/2, c.PieceRequestMaxResendBackoff)
+	m.SetMaxReservationsPerPeer(c.MaxReservationsPerPeer)
+	m.SetHedgeFactor(c.PriorityHedgeFactor)
+	return m, nil
+}
+
+// newAdaptiveTimeout returns the adaptive piece request timeout of Dispatchers
+// for torrents whose largest piece is maxPieceLength bytes, or nil if
+// AdaptivePieceRequestTimeout is unset. Defaults must be applied to c.
+func (c Config) newAdaptiveTimeout(maxPieceLength int64) *adaptiveTimeout {
+	if !c.AdaptivePieceRequestTimeout {
+		return nil
+	}
+	timeout := c.calcPieceRequestTimeout(maxPieceLength)
+	ceiling := c.PieceRequestTimeoutCeiling
+	if ceiling == 0 {
+		ceiling = 4 * timeout
+	}
+	return newAdaptiveTimeout(
+		timeout, c.PieceRequestLatencyWeight, c.PieceRequestTimeoutDeviations,
+		c.PieceRequestTimeoutFloor, ceiling)
+}
+
+// InEndgame returns whether a download with remaining pieces left is in endgame,
+// i.e. may request pieces from several peers at once. Defaults are expected to
+// be applied to c, see WithDefaults.
+func (c Config) InEndgame(remaining int) bool {
+	return !c.DisableEndgame && remaining <= c.EndgameThreshold
+}
@@ -0,0 +1,214 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"context"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+	"go.uber.org/zap"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/torrent/networkevent"
+	"github.com/uber/kraken/lib/torrent/scheduler/conn"
+	"github.com/uber/kraken/lib/torrent/scheduler/torrentlog"
+	"github.com/uber/kraken/lib/torrent/storage"
+	"github.com/uber/kraken/lib/torrent/storage/agentstorage"
+	"github.com/uber/kraken/utils/bitsetutil"
+)
+
+func contextDispatcher(
+	ctx context.Context, config Config, clk clock.Clock, t storage.Torrent) (*Dispatcher, error) {
+
+	return NewWithContext(
+		ctx,
+		config,
+		tally.NoopScope,
+		clk,
+		networkevent.NewTestProducer(),
+		noopEvents{},
+		core.PeerIDFixture(),
+		t,
+		zap.NewNop().Sugar(),
+		torrentlog.NewNopLogger())
+}
+
+func TestDispatchersDoNotLeakGoroutinesOnceContextCanceled(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+	torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(4, 1).MetaInfo)
+	defer cleanup()
+
+	config := Config{
+		EnableChoking:   true,
+		PeerIdleTimeout: time.Minute,
+		SendQueueSize:   4,
+	}
+
+	before := runtime.NumGoroutine()
+	const n = 100
+	var dispatchers []*Dispatcher
+	var cancels []context.CancelFunc
+	var messages []*mockMessages
+	for i := 0; i < n; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancels = append(cancels, cancel)
+		d, err := contextDispatcher(ctx, config, clk, torrent)
+		require.NoError(err)
+		dispatchers = append(dispatchers, d)
+		for j := 0; j < 2; j++ {
+			m := newMockMessages()
+			messages = append(messages, m)
+			require.NoError(d.AddPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, false, true, false), m))
+		}
+	}
+	require.True(runtime.NumGoroutine() > before)
+
+	for _, cancel := range cancels {
+		cancel()
+	}
+
+	// Every Dispatcher is torn down and closes its peers, and none of their
+	// goroutines remain.
+	require.Eventually(func() bool {
+		for _, d := range dispatchers {
+			if reason, ok := d.FinalReason(); !ok || reason != TearDownCanceled {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 5*time.Millisecond)
+	for _, m := range messages {
+		require.True(m.isClosed())
+	}
+	// Polled by hand, since require.Eventually runs its own goroutines.
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		if runtime.NumGoroutine() <= before {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	require.True(runtime.NumGoroutine() <= before, "goroutines leaked")
+}
+
+func TestDispatcherTearDownCancelsItsContext(t *testing.T) {
+	require := require.New(t)
+
+	torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(1, 1).MetaInfo)
+	defer cleanup()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d, err := contextDispatcher(ctx, Config{}, clock.NewMock(), torrent)
+	require.NoError(err)
+
+	d.TearDown()
+	require.Error(d.ctx.Err())
+	require.NoError(ctx.Err())
+
+	// Canceling the context afterwards changes nothing.
+	cancel()
+	reason, ok := d.FinalReason()
+	require.True(ok)
+	require.Equal(TearDownUnspecified, reason)
+}
+
+func TestDispatcherContextCutsDrainShort(t *testing.T) {
+	require := require.New(t)
+
+	torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(1, 1).MetaInfo)
+	defer cleanup()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d, err := newDispatcher(
+		Config{DisableKeepalive: true},
+		tally.NoopScope,
+		clock.NewMock(),
+		networkevent.NewTestProducer(),
+		noopEvents{},
+		core.PeerIDFixture(),
+		torrent,
+		zap.NewNop().Sugar(),
+		torrentlog.NewNopLogger(),
+		withContext(ctx))
+	require.NoError(err)
+	stats := tally.NewTestScope("", nil)
+	d.stats = stats
+
+	// A serve in flight keeps d draining.
+	d.inflight.begin()
+	drained := make(chan struct{})
+	go func() {
+		d.Drain(TearDownRemoved, time.Hour)
+		close(drained)
+	}()
+	require.Eventually(d.Draining, time.Second, 5*time.Millisecond)
+
+	cancel()
+	select {
+	case <-drained:
+	case <-time.After(5 * time.Second):
+		require.FailNow("Drain not cut short")
+	}
+	reason, ok := d.FinalReason()
+	require.True(ok)
+	require.Equal(TearDownCanceled, reason)
+	require.Equal(int64(1), stats.Snapshot().Counters()["drain_cancellations+"].Value())
+}
+
+func TestDispatcherContextCutsBlockedSendShort(t *testing.T) {
+	require := require.New(t)
+
+	torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(1, 1).MetaInfo)
+	defer cleanup()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d, err := newDispatcher(
+		Config{SendQueueSize: 1, SendQueueBlockTimeout: time.Hour, DisableKeepalive: true},
+		tally.NoopScope,
+		clock.NewMock(),
+		networkevent.NewTestProducer(),
+		noopEvents{},
+		core.PeerIDFixture(),
+		torrent,
+		zap.NewNop().Sugar(),
+		torrentlog.NewNopLogger(),
+		withContext(ctx))
+	require.NoError(err)
+	defer d.TearDown()
+
+	// The queue of p is never drained.
+	p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true), newStuckMessages())
+	require.NoError(err)
+	require.NoError(d.send(p, conn.NewKeepaliveMessage()))
+
+	result := make(chan error, 1)
+	go func() { result <- d.sendBlocking(p, conn.NewPieceRequestMessage(0, 1)) }()
+
+	cancel()
+	select {
+	case err := <-result:
+		require.Equal(errSendQueueClosed, err)
+	case <-time.After(5 * time.Second):
+		require.FailNow("send not cut short")
+	}
+}
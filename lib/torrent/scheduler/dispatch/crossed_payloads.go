@@ -0,0 +1,59 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+// _unknownVersion labels peers whose version is unknown.
+const _unknownVersion = "unknown"
+
+// remoteVersioner is implemented by Messages which report the version of the
+// remote peer, e.g. as listed in its handshake.
+type remoteVersioner interface {
+	RemoteVersion() string
+}
+
+// remoteVersion returns the version of the remote peer of messages, or
+// "unknown" if messages does not report it.
+func remoteVersion(messages Messages) string {
+	if v, ok := messages.(remoteVersioner); ok && v.RemoteVersion() != "" {
+		return v.RemoteVersion()
+	}
+	return _unknownVersion
+}
+
+// crossedPayload returns whether the payload of piece i received from p is
+// crossed, i.e. we did not request i from p but are awaiting i from another
+// peer, which hints at p mixing up the peers requesting pieces from it.
+func (d *Dispatcher) crossedPayload(p *peer, i int) bool {
+	awaiting := d.pieceRequestManager.AwaitingPeers(i)
+	for _, id := range awaiting {
+		if id == p.id {
+			return false
+		}
+	}
+	return len(awaiting) > 0
+}
+
+// crossedPayloadReceived records that p sent a crossed payload of piece i, and
+// flags p as unreliable for request attribution: the latencies of its payloads
+// no longer feed the piece RTT of p nor the adaptive request timeout, since
+// they may measure requests sent to other peers.
+func (d *Dispatcher) crossedPayloadReceived(p *peer, i int) {
+	d.stats.Tagged(map[string]string{
+		"remote_version": remoteVersion(p.messages),
+	}).Counter("crossed_piece_payloads").Inc(1)
+	if p.recordCrossedPayload() {
+		d.log("peer", p, "piece", i).Warn(
+			"Received piece requested from another peer, excluding peer from latency estimates")
+	}
+}
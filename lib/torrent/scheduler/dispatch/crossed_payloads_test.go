@@ -0,0 +1,158 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/torrent/scheduler/conn"
+	"github.com/uber/kraken/lib/torrent/storage/agentstorage"
+	"github.com/uber/kraken/lib/torrent/storage/piecereader"
+	"github.com/uber/kraken/utils/bitsetutil"
+)
+
+// versionedMessages reports the version of the remote peer.
+type versionedMessages struct {
+	*mockMessages
+	version string
+}
+
+func (m versionedMessages) RemoteVersion() string { return m.version }
+
+func TestDispatcherAcceptsAndFlagsCrossedPayloads(t *testing.T) {
+	for _, version := range []string{"", "v1.2.3"} {
+		t.Run(fmt.Sprintf("version=%q", version), func(t *testing.T) {
+			require := require.New(t)
+
+			blob := core.SizedBlobFixture(2, 1)
+			torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+			defer cleanup()
+
+			clk := clock.NewMock()
+			stats := tally.NewTestScope("", nil)
+			d := testDispatcher(Config{
+				PipelineLimit:               1,
+				DisableEndgame:              true,
+				DisableKeepalive:            true,
+				AdaptivePieceRequestTimeout: true,
+			}, clk, torrent)
+			d.stats = stats
+
+			m := newMockMessages()
+			var messages Messages = m
+			if version != "" {
+				messages = versionedMessages{m, version}
+			}
+			confused, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, true), messages)
+			require.NoError(err)
+			other, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, true), newMockMessages())
+			require.NoError(err)
+
+			// Each peer is requested a different piece.
+			_, err = d.maybeRequestMorePieces(confused)
+			require.NoError(err)
+			_, err = d.maybeRequestMorePieces(other)
+			require.NoError(err)
+			requested := requestedPieces(m)
+			require.Len(requested, 1)
+			mine := requested[0]
+			theirs := 1 - mine
+			require.Equal([]int{theirs}, requestedPieces(other.messages))
+			timeout := d.currentPieceRequestTimeout()
+
+			// The confused peer answers the request sent to the other peer. The
+			// payload is accepted, but the confused peer is flagged.
+			clk.Add(time.Second)
+			require.NoError(d.dispatch(confused, conn.NewPiecePayloadMessage(
+				theirs, piecereader.NewBuffer(blob.Content[theirs:theirs+1]))))
+			require.True(d.torrent.HasPiece(theirs))
+			require.True(confused.stats().UnreliableAttribution)
+			require.Equal(1, confused.stats().CrossedPayloads)
+			require.False(other.stats().UnreliableAttribution)
+
+			expectedVersion := version
+			if version == "" {
+				expectedVersion = "unknown"
+			}
+			require.Equal(
+				int64(1),
+				stats.Snapshot().Counters()["crossed_piece_payloads+remote_version="+expectedVersion].Value())
+			var flagged []string
+			for _, ps := range d.Snapshot().Peers {
+				if ps.UnreliableAttribution {
+					flagged = append(flagged, ps.PeerID)
+				}
+			}
+			require.Equal([]string{confused.id.String()}, flagged)
+
+			// The payload of the piece requested from the confused peer is
+			// accepted, but its latency feeds neither the piece RTT of the peer
+			// nor the request timeout.
+			clk.Add(time.Second)
+			require.NoError(d.dispatch(confused, conn.NewPiecePayloadMessage(
+				mine, piecereader.NewBuffer(blob.Content[mine:mine+1]))))
+			require.True(d.Complete())
+			require.Zero(confused.stats().PieceRTT)
+			require.Equal(timeout, d.currentPieceRequestTimeout())
+			require.Equal(1, confused.stats().CrossedPayloads)
+		})
+	}
+}
+
+func TestDispatcherDoesNotFlagSolicitedPayloads(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(2, 1)
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	clk := clock.NewMock()
+	stats := tally.NewTestScope("", nil)
+	d := testDispatcher(Config{
+		PipelineLimit:               1,
+		DisableEndgame:              true,
+		DisableKeepalive:            true,
+		AdaptivePieceRequestTimeout: true,
+	}, clk, torrent)
+	d.stats = stats
+
+	p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, true), newMockMessages())
+	require.NoError(err)
+	_, err = d.maybeRequestMorePieces(p)
+	require.NoError(err)
+	i := requestedPieces(p.messages)[0]
+
+	// An unsolicited payload which no peer was asked for is not crossed.
+	j := 1 - i
+	require.NoError(d.dispatch(p, conn.NewPiecePayloadMessage(
+		j, piecereader.NewBuffer(blob.Content[j:j+1]))))
+
+	// The payload of the piece requested from p, which arrives after its
+	// request expired, is not crossed either, and its latency is sampled.
+	clk.Add(d.currentPieceRequestTimeout() + time.Second)
+	require.NoError(d.dispatch(p, conn.NewPiecePayloadMessage(
+		i, piecereader.NewBuffer(blob.Content[i:i+1]))))
+	require.True(d.Complete())
+
+	require.False(p.stats().UnreliableAttribution)
+	require.NotZero(p.stats().PieceRTT)
+	require.Empty(stats.Snapshot().Counters()["crossed_piece_payloads+remote_version=unknown"])
+}
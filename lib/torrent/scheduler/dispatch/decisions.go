@@ -0,0 +1,342 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/willf/bitset"
+	"go.uber.org/atomic"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/torrent/scheduler/dispatch/piecerequest"
+)
+
+// DecisionKind enumerates the decisions of a Dispatcher which are recorded, see
+// Config.DecisionBufferSize.
+type DecisionKind string
+
+// DecisionKinds.
+const (
+	// SelectionDecision is a piece selection pass for a peer: which of the
+	// candidate pieces of the peer were requested from it.
+	SelectionDecision DecisionKind = "selection"
+
+	// EvictionDecision is the eviction of an idle peer to make room for a new
+	// peer, chosen among the idle peers.
+	EvictionDecision DecisionKind = "eviction"
+
+	// ResendDecision is the resend of a failed piece request, or of a request
+	// pending with a removed peer, to another peer.
+	ResendDecision DecisionKind = "resend"
+
+	// BanDecision is the ban of a peer which misbehaved too often.
+	BanDecision DecisionKind = "ban"
+)
+
+// Outcomes of resend decisions.
+const (
+	_resendSent    = "sent"
+	_resendStale   = "stale"
+	_resendNowhere = "nowhere"
+)
+
+// Reasons of ban decisions.
+const (
+	_banInvalidPieces      = "invalid_pieces"
+	_banProtocolViolations = "protocol_violations"
+)
+
+// Decision is a JSON-serializable record of a decision of a Dispatcher, for
+// debugging decisions after the fact. Which fields are set depends on Kind.
+type Decision struct {
+	// Seq orders the decisions of a Dispatcher.
+	Seq  uint64       `json:"seq"`
+	Time time.Time    `json:"time"`
+	Kind DecisionKind `json:"kind"`
+
+	// PeerID is the peer which pieces were requested from, or which was
+	// evicted or banned. Empty if a resend found no peer.
+	PeerID string `json:"peer_id,omitempty"`
+
+	// Candidates is the number of pieces of the peer which a selection chose
+	// from, and PipelineLimit the limit of requests pending with the peer.
+	Candidates    int `json:"candidates,omitempty"`
+	PipelineLimit int `json:"pipeline_limit,omitempty"`
+
+	// Pieces are the pieces requested by a selection, or the piece of a resend.
+	Pieces []int `json:"pieces,omitempty"`
+
+	// FromPeerID and Status are the peer and status of the failed request of a
+	// resend. Outcome is "sent", "stale" if the piece was received meanwhile,
+	// or "nowhere" if no peer could take the request.
+	FromPeerID string `json:"from_peer_id,omitempty"`
+	Status     string `json:"status,omitempty"`
+	Outcome    string `json:"outcome,omitempty"`
+
+	// EvictionCandidates are the idle peers which an eviction chose from.
+	EvictionCandidates []EvictionCandidate `json:"eviction_candidates,omitempty"`
+
+	// Reason is why a peer was banned, after Count invalid pieces or protocol
+	// violations.
+	Reason string `json:"reason,omitempty"`
+	Count  int    `json:"count,omitempty"`
+}
+
+// EvictionCandidate is an idle peer considered for eviction, with the keys it
+// was ranked by: complete peers go first once the Dispatcher is complete, then
+// the peer whose last transfer is oldest, then the peer added first.
+type EvictionCandidate struct {
+	PeerID       string    `json:"peer_id"`
+	Complete     bool      `json:"complete,omitempty"`
+	LastTransfer time.Time `json:"last_transfer"`
+	AddedAt      time.Time `json:"added_at"`
+}
+
+// decisionRecord is the compact form of a Decision, which is only formatted
+// when read.
+type decisionRecord struct {
+	seq        uint64
+	at         time.Time
+	kind       DecisionKind
+	peer       core.PeerID
+	candidates int
+	limit      int
+	pieces     []int
+	from       core.PeerID
+	status     piecerequest.Status
+	outcome    string
+	evictable  []evictionCandidate
+	reason     string
+	count      int
+}
+
+type evictionCandidate struct {
+	peer         core.PeerID
+	complete     bool
+	lastTransfer time.Time
+	addedAt      time.Time
+}
+
+// decisionSlot holds one record of a decisionLog.
+type decisionSlot struct {
+	mu sync.Mutex
+	r  decisionRecord
+}
+
+// decisionLog is a ring of the most recent decisions of a Dispatcher. Writers
+// only contend for the same slot when the ring wraps around concurrently. All
+// methods are no-ops on a nil decisionLog.
+type decisionLog struct {
+	slots  []decisionSlot
+	next   *atomic.Uint64
+	closed *atomic.Bool
+}
+
+func newDecisionLog(size int) *decisionLog {
+	if size <= 0 {
+		return nil
+	}
+	return &decisionLog{
+		slots:  make([]decisionSlot, size),
+		next:   atomic.NewUint64(0),
+		closed: atomic.NewBool(false),
+	}
+}
+
+// record adds r to l, overwriting the oldest record once l is full.
+func (l *decisionLog) record(r decisionRecord) {
+	if l == nil || l.closed.Load() {
+		return
+	}
+	r.seq = l.next.Inc()
+	s := &l.slots[r.seq%uint64(len(l.slots))]
+	s.mu.Lock()
+	// A writer which lapped a slower writer of the same slot wins.
+	if r.seq > s.r.seq {
+		s.r = r
+	}
+	s.mu.Unlock()
+}
+
+// records returns the records of l, oldest first.
+func (l *decisionLog) records() []decisionRecord {
+	if l == nil {
+		return nil
+	}
+	var records []decisionRecord
+	for i := range l.slots {
+		s := &l.slots[i]
+		s.mu.Lock()
+		if s.r.seq > 0 {
+			records = append(records, s.r)
+		}
+		s.mu.Unlock()
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].seq < records[j].seq })
+	return records
+}
+
+// clear drops all records of l, and stops recording.
+func (l *decisionLog) clear() {
+	if l == nil {
+		return
+	}
+	l.closed.Store(true)
+	for i := range l.slots {
+		s := &l.slots[i]
+		s.mu.Lock()
+		s.r = decisionRecord{}
+		s.mu.Unlock()
+	}
+}
+
+// Decisions returns the most recent decisions of d, oldest first, if
+// Config.DecisionBufferSize is set. Empty once d was torn down.
+func (d *Dispatcher) Decisions() []Decision {
+	var decisions []Decision
+	for _, r := range d.decisions.records() {
+		decisions = append(decisions, r.decision())
+	}
+	return decisions
+}
+
+func (r decisionRecord) decision() Decision {
+	dec := Decision{
+		Seq:           r.seq,
+		Time:          r.at,
+		Kind:          r.kind,
+		PeerID:        peerIDString(r.peer),
+		Candidates:    r.candidates,
+		PipelineLimit: r.limit,
+		Pieces:        r.pieces,
+		FromPeerID:    peerIDString(r.from),
+		Outcome:       r.outcome,
+		Reason:        r.reason,
+		Count:         r.count,
+	}
+	if r.kind == ResendDecision {
+		dec.Status = requestStatusName(r.status)
+	}
+	for _, c := range r.evictable {
+		dec.EvictionCandidates = append(dec.EvictionCandidates, EvictionCandidate{
+			PeerID:       c.peer.String(),
+			Complete:     c.complete,
+			LastTransfer: c.lastTransfer,
+			AddedAt:      c.addedAt,
+		})
+	}
+	return dec
+}
+
+// peerIDString returns the string of peerID, or empty if peerID is zero.
+func peerIDString(peerID core.PeerID) string {
+	if peerID == (core.PeerID{}) {
+		return ""
+	}
+	return peerID.String()
+}
+
+func requestStatusName(s piecerequest.Status) string {
+	switch s {
+	case piecerequest.StatusPending:
+		return "pending"
+	case piecerequest.StatusExpired:
+		return "expired"
+	case piecerequest.StatusUnsent:
+		return "unsent"
+	case piecerequest.StatusInvalid:
+		return "invalid"
+	case piecerequest.StatusRejected:
+		return "rejected"
+	default:
+		return "unknown"
+	}
+}
+
+// recordSelection records that pieces were requested from p out of candidates,
+// under pipeline limit.
+func (d *Dispatcher) recordSelection(p *peer, candidates *bitset.BitSet, limit int, pieces []int) {
+	if d.decisions == nil {
+		return
+	}
+	d.decisions.record(decisionRecord{
+		at:         d.clk.Now(),
+		kind:       SelectionDecision,
+		peer:       p.id,
+		candidates: int(candidates.Count()),
+		limit:      limit,
+		pieces:     pieces,
+	})
+}
+
+// recordEviction records that p was evicted among itself and the idle peers of
+// others.
+func (d *Dispatcher) recordEviction(p *peer, others []*peer) {
+	if d.decisions == nil {
+		return
+	}
+	seeding := d.Complete()
+	now := d.clk.Now()
+	evictable := make([]evictionCandidate, 0, len(others)+1)
+	for _, c := range append([]*peer{p}, others...) {
+		if c != p && !d.idlePeer(c, now) {
+			continue
+		}
+		evictable = append(evictable, evictionCandidate{
+			peer:         c.id,
+			complete:     seeding && c.bitfield.Complete(),
+			lastTransfer: c.lastTransfer(),
+			addedAt:      c.addedAt,
+		})
+	}
+	d.decisions.record(decisionRecord{
+		at:        now,
+		kind:      EvictionDecision,
+		peer:      p.id,
+		evictable: evictable,
+	})
+}
+
+// recordResend records the outcome of resending r, to target if sent.
+func (d *Dispatcher) recordResend(r piecerequest.Request, target core.PeerID, outcome string) {
+	if d.decisions == nil {
+		return
+	}
+	d.decisions.record(decisionRecord{
+		at:      d.clk.Now(),
+		kind:    ResendDecision,
+		peer:    target,
+		pieces:  []int{r.Piece},
+		from:    r.PeerID,
+		status:  r.Status,
+		outcome: outcome,
+	})
+}
+
+// recordBan records that p was banned after count offenses of reason.
+func (d *Dispatcher) recordBan(p *peer, reason string, count int) {
+	if d.decisions == nil {
+		return
+	}
+	d.decisions.record(decisionRecord{
+		at:     d.clk.Now(),
+		kind:   BanDecision,
+		peer:   p.id,
+		reason: reason,
+		count:  count,
+	})
+}
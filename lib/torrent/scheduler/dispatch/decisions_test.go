@@ -0,0 +1,187 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/torrent/storage/agentstorage"
+	"github.com/uber/kraken/utils/bitsetutil"
+)
+
+func TestDecisionLogKeepsMostRecentRecords(t *testing.T) {
+	require := require.New(t)
+
+	var disabled *decisionLog
+	disabled.record(decisionRecord{kind: BanDecision})
+	require.Empty(disabled.records())
+	disabled.clear()
+
+	l := newDecisionLog(3)
+	for i := 0; i < 5; i++ {
+		l.record(decisionRecord{kind: SelectionDecision, pieces: []int{i}})
+	}
+	records := l.records()
+	require.Len(records, 3)
+	for i, r := range records {
+		require.Equal(uint64(i+3), r.seq)
+		require.Equal([]int{i + 2}, r.pieces)
+	}
+
+	l.clear()
+	require.Empty(l.records())
+	l.record(decisionRecord{kind: SelectionDecision})
+	require.Empty(l.records())
+}
+
+func TestDecisionLogConcurrentWrites(t *testing.T) {
+	require := require.New(t)
+
+	l := newDecisionLog(16)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				l.record(decisionRecord{kind: SelectionDecision})
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Each slot holds the newest of the records written to it.
+	records := l.records()
+	require.Len(records, 16)
+	for i, r := range records {
+		require.Equal(uint64(785+i), r.seq)
+	}
+}
+
+func TestDispatcherRecordsDecisions(t *testing.T) {
+	require := require.New(t)
+
+	torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(2, 1).MetaInfo)
+	defer cleanup()
+
+	clk := clock.NewMock()
+	d := testDispatcher(Config{
+		DecisionBufferSize:    16,
+		MaxPeers:              2,
+		PeerReplacementPolicy: EvictWorstPeer,
+		PeerActivityWindow:    10 * time.Second,
+		PipelineLimit:         1,
+		MaxProtocolViolations: 1,
+		DisableEndgame:        true,
+		DisableKeepalive:      true,
+	}, clk, torrent)
+
+	first, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, true), newMockMessages())
+	require.NoError(err)
+	_, err = d.maybeRequestMorePieces(first)
+	require.NoError(err)
+	requested := requestedPieces(first.messages)
+	require.Len(requested, 1)
+	evictedAt := clk.Now()
+
+	clk.Add(time.Second)
+	second, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, true), newMockMessages())
+	require.NoError(err)
+
+	// Both peers are idle, so the first added is evicted for the third, and its
+	// expired request is resent to the second.
+	clk.Add(time.Minute)
+	third, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false, false), newMockMessages())
+	require.NoError(err)
+	require.True(closed(first.messages))
+	d.resendFailedPieceRequests()
+	require.Equal(requested, requestedPieces(second.messages))
+
+	d.protocolViolation(third)
+	d.protocolViolation(third)
+	require.True(closed(third.messages))
+
+	now := clk.Now()
+	expected := []Decision{{
+		Seq:           1,
+		Time:          evictedAt,
+		Kind:          SelectionDecision,
+		PeerID:        first.id.String(),
+		Candidates:    2,
+		PipelineLimit: 1,
+		Pieces:        requested,
+	}, {
+		Seq:    2,
+		Time:   now,
+		Kind:   EvictionDecision,
+		PeerID: first.id.String(),
+		EvictionCandidates: []EvictionCandidate{
+			{PeerID: first.id.String(), AddedAt: first.addedAt},
+			{PeerID: second.id.String(), AddedAt: second.addedAt},
+		},
+	}, {
+		Seq:           3,
+		Time:          now,
+		Kind:          SelectionDecision,
+		PeerID:        second.id.String(),
+		Candidates:    1,
+		PipelineLimit: 1,
+		Pieces:        requested,
+	}, {
+		Seq:        4,
+		Time:       now,
+		Kind:       ResendDecision,
+		PeerID:     second.id.String(),
+		Pieces:     requested,
+		FromPeerID: first.id.String(),
+		Status:     "expired",
+		Outcome:    "sent",
+	}, {
+		Seq:    5,
+		Time:   now,
+		Kind:   BanDecision,
+		PeerID: third.id.String(),
+		Reason: "protocol_violations",
+		Count:  2,
+	}}
+	require.Equal(expected, d.Decisions())
+	require.Equal(expected, d.Dump().Decisions)
+	require.Equal(expected, d.Snapshot().Decisions)
+
+	d.TearDown()
+	require.Empty(d.Decisions())
+}
+
+func TestDispatcherRecordsNoDecisionsByDefault(t *testing.T) {
+	require := require.New(t)
+
+	torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(2, 1).MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(Config{DisableKeepalive: true}, clock.NewMock(), torrent)
+
+	p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, true), newMockMessages())
+	require.NoError(err)
+	sent, err := d.maybeRequestMorePieces(p)
+	require.NoError(err)
+	require.True(sent)
+
+	require.Nil(d.Decisions())
+}
@@ -14,8 +14,12 @@
 package dispatch
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
 	"sync"
 	"time"
 
@@ -25,27 +29,78 @@ import (
 	"github.com/uber/kraken/lib/torrent/scheduler/conn"
 	"github.com/uber/kraken/lib/torrent/scheduler/dispatch/piecerequest"
 	"github.com/uber/kraken/lib/torrent/scheduler/torrentlog"
+	"github.com/uber/kraken/lib/torrent/scheduler/wire"
 	"github.com/uber/kraken/lib/torrent/storage"
+	"github.com/uber/kraken/lib/torrent/storage/piecereader"
 	"github.com/uber/kraken/utils/syncutil"
 
 	"github.com/andres-erbsen/clock"
 	"github.com/uber-go/tally"
 	"github.com/willf/bitset"
+	"go.uber.org/atomic"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 	"golang.org/x/sync/syncmap"
+	"golang.org/x/time/rate"
 )
 
 var (
 	errPeerAlreadyDispatched   = errors.New("peer is already dispatched for the torrent")
+	errPeerNotDispatched       = errors.New("peer is not dispatched for the torrent")
 	errPieceOutOfBounds        = errors.New("piece index out of bounds")
-	errChunkNotSupported       = errors.New("reading / writing chunk of piece not supported")
+	errInvalidChunk            = errors.New("invalid piece chunk")
 	errRepeatedBitfieldMessage = errors.New("received repeated bitfield message")
+	errServeRejected           = errors.New("piece serve rejected due to load")
+	errEgressQueueFull         = errors.New("piece serve rejected due to egress limit")
+	errPeerChoked              = errors.New("piece request rejected while choked")
+	errServeQueueFull          = errors.New("piece request rejected due to full serve queue")
+	errReadOnlyPayload         = errors.New("received piece payload while read-only")
+	errPieceQuarantined        = errors.New("piece request rejected for quarantined piece")
 )
 
-// Events defines Dispatcher events.
+var _pieceRequestLatencyBuckets = tally.MustMakeExponentialDurationBuckets(time.Millisecond, 2, 16)
+
+// Events defines Dispatcher events. Events of a Dispatcher are delivered serially
+// from a single goroutine in the order in which they occurred, i.e. no event is
+// delivered before DispatcherComplete which occurred after completion. Events
+// which occur after TearDown are dropped.
 type Events interface {
 	DispatcherComplete(*Dispatcher)
+
+	// DispatcherFailed is called at most once, if the download of the torrent
+	// failed for reason, i.e. reason.Failure() is true. The Dispatcher keeps
+	// running until it is torn down, which consumers are expected to do with
+	// reason.
+	DispatcherFailed(*Dispatcher, TearDownReason)
+
+	// PeerRemoved is called once a peer was removed, i.e. when its messages
+	// closed or it was removed via RemovePeer, such that a replacement may be
+	// sought. Like all events, it is called asynchronously, never while the
+	// Dispatcher holds its locks.
 	PeerRemoved(core.PeerID, core.InfoHash)
+
+	// PeerBanned is called when a peer was removed because it sent more than
+	// Config.MaxInvalidPieces invalid pieces within Config.InvalidPieceWindow,
+	// such that the peer may be blacklisted. PeerRemoved is called as well.
+	PeerBanned(core.PeerID, core.InfoHash)
+
+	// PiecesUnavailable is called when pieces have had no peer to request
+	// them from for longer than Config.PieceUnavailableTimeout, if set. The
+	// pieces may be fetched out-of-band, after which
+	// Dispatcher.NotifyPiecesWritten must be called.
+	PiecesUnavailable(core.InfoHash, []int)
+
+	// PiecesQuarantined is called with all quarantined pieces whenever a piece
+	// is quarantined, see Config.QuarantineSuspectPieces. The pieces may be
+	// fetched again out-of-band, e.g. from the origin, and are released once
+	// they pass re-verification.
+	PiecesQuarantined(core.InfoHash, []int)
+
+	// DispatcherStalled is called when the Dispatcher, which is incomplete,
+	// received no piece for Config.StallTimeout, e.g. since none of its peers
+	// has the pieces it needs, such that fresh peers may be sought. Called at
+	// most once per stall, i.e. again only after the Dispatcher made progress.
+	DispatcherStalled(*Dispatcher)
 }
 
 // Messages defines a subset of conn.Conn methods which Dispatcher requires to
@@ -54,6 +109,7 @@ type Messages interface {
 	Send(msg *conn.Message) error
 	Receiver() <-chan *conn.Message
 	Close()
+	Supports(capability conn.Capability) bool
 }
 
 // Dispatcher coordinates torrent state with sending / receiving messages between multiple
@@ -64,23 +120,90 @@ type Dispatcher struct {
 	stats                 tally.Scope
 	clk                   clock.Clock
 	createdAt             time.Time
+	phases                *phaseClock
 	localPeerID           core.PeerID
 	torrent               *torrentAccessWatcher
-	peers                 syncmap.Map // core.PeerID -> *peer
-	peerStats             syncmap.Map // core.PeerID -> *peerStats, persists on peer removal.
+	pieceLengths          pieceLengths
+	peers                 syncmap.Map   // core.PeerID -> *peer
+	numPeers              *atomic.Int32 // Size of peers, which syncmap.Map lacks.
+	peerLimitMu           sync.Mutex    // Serializes admission of peers, see Config.MaxPeers.
+	peerStats             *peerStatsMap // Persists on peer removal until compacted.
+	capabilityStats       *capabilityStats
 	numPeersByPiece       syncutil.Counters
+	pieceAttempts         syncutil.Counters // Piece requests sent, by piece.
+	pieceWrites           *pieceWrites      // Nil if feeds write pieces themselves.
+	written               *pieceLog         // Pieces written since creation, see BitfieldVersion.
+	numAsymmetricPeers    *atomic.Int32
+	numSeeders            *atomic.Int32
+	usefulPiecesBytes     *atomic.Int64
+	numDeferredServes     *atomic.Int32
+	bytesDownloaded       *atomic.Int64 // Piece payload bytes received from all peers.
+	bytesUploaded         *atomic.Int64 // Piece payload bytes sent to all peers.
+	rttBaseline           *atomic.Int64 // Fastest piece round-trip time of all peers, in ns.
 	netevents             networkevent.Producer
-	pieceRequestTimeout   time.Duration
-	pieceRequestManager   *piecerequest.Manager
+	pieceRequestTimeout   time.Duration         // Static timeout, see calcPieceRequestTimeout.
+	requestTimeout        *adaptiveTimeout      // Nil unless Config.AdaptivePieceRequestTimeout.
+	pieceRequestManager   *piecerequest.Manager // Nil if seed-only since creation.
+	readOnly              bool                  // See Config.ReadOnly.
+	seedOnly              *atomic.Bool          // See Config.SeedOnly.
+	verifier              storage.PieceVerifier
+	verifyReceived        bool // Whether received pieces are verified before storage.
+	numFullServes         *atomic.Int64
+	serveLatency          *serveLatencyTracker
+	interfaces            *networkInterfaces
+	quarantine            *pieceQuarantine
+	egress                *egressLimiter   // Nil if egress is unlimited.
+	prefetch              *servePrefetcher // Nil if serve prefetching is disabled.
+	superseed             *superseeder     // Nil unless superseeding.
+	ingress               *ingressLimiter
+	requestsDeferred      *atomic.Bool   // Whether deferred requests are scheduled.
+	kicks                 chan time.Time // Holds the time of a pending Kick.
+	removedRequestsMu     sync.Mutex
+	removedRequests       []piecerequest.Request // Awaited from peers closePeer removed.
+	partialPieces         *partialPieces
+	chunks                *chunkAssembler
+	unavailablePieces     *unavailablePieces
 	pendingPiecesDoneOnce sync.Once
 	pendingPiecesDone     chan struct{}
-	completeOnce          sync.Once
-	events                Events
+	tearDownOnce          sync.Once
+	tornDown              chan struct{}
+	draining              *atomic.Bool  // Whether Drain was called.
+	invalidating          *atomic.Bool  // Whether BeginInvalidation was called.
+	paused                *atomic.Bool  // Whether Pause was called without Resume.
+	resumedAt             *atomic.Int64 // Unix nanos of the last Resume.
+	invalidationOnce      sync.Once
+	invalidated           chan struct{}  // Closed once d.torrent may be deleted.
+	inflight              inflight       // Payload writes and serves, see Drain.
+	chokeMu               sync.Mutex     // Serializes choking decisions.
+	completed             *atomic.Bool   // Set once by complete.
+	completeNotifications sync.WaitGroup // Tracks notifyPeersComplete.
+	completeMu            sync.Mutex     // Orders completeNotifications.Add before Wait.
+	completeWaited        bool           // Set by TearDown before waiting for notifications.
+	failOnce              sync.Once
+	auditOnce             sync.Once // Delivers the audit record on teardown.
+	corruptPieces         *atomic.Int32
+	finalReason           *atomic.Int32 // -1 until torn down.
+	endgameCause          *atomic.Int32 // 0 until endgame is entered.
+	emitter               *eventEmitter
+	status                *statusNotifier
+	announcer             *announcer
+	coalescer             *announceCoalescer // Nil unless announces are coalesced.
+	stall                 *stallWatcher      // Nil unless stalls are detected.
+	decisions             *decisionLog       // Nil unless decisions are recorded.
+	completeCloses        *completeCloses
+	statsGuard            *statsGuard        // Nil if Config.DisableStatsGuard is set.
+	runner                *runnerGroup       // Nil unless Config.Runner is set.
+	ctx                   context.Context    // Done once d is torn down.
+	cancel                context.CancelFunc // Cancels ctx.
+	locality              string             // See WithLocality.
+	utilization           *utilizationTracker
 	logger                *zap.SugaredLogger
+	base                  *zap.Logger // logger, desugared once for log and logw.
+	torrentField          zap.Field   // The torrent as log field, marshaled lazily.
 	torrentlog            *torrentlog.Logger
 }
 
-// New creates a new Dispatcher.
+// New creates a new Dispatcher, which runs until it is torn down.
 func New(
 	config Config,
 	stats tally.Scope,
@@ -90,15 +213,46 @@ func New(
 	peerID core.PeerID,
 	t storage.Torrent,
 	logger *zap.SugaredLogger,
-	tlog *torrentlog.Logger) (*Dispatcher, error) {
+	tlog *torrentlog.Logger,
+	opts ...Option) (*Dispatcher, error) {
+
+	return NewWithContext(
+		context.Background(), config, stats, clk, netevents, events, peerID, t, logger, tlog, opts...)
+}
+
+// NewWithContext creates a new Dispatcher like New, which is torn down with
+// TearDownCanceled once ctx is done, such that its goroutines and peers do
+// not outlive ctx even if the caller never tears it down.
+func NewWithContext(
+	ctx context.Context,
+	config Config,
+	stats tally.Scope,
+	clk clock.Clock,
+	netevents networkevent.Producer,
+	events Events,
+	peerID core.PeerID,
+	t storage.Torrent,
+	logger *zap.SugaredLogger,
+	tlog *torrentlog.Logger,
+	opts ...Option) (*Dispatcher, error) {
 
-	d, err := newDispatcher(config, stats, clk, netevents, events, peerID, t, logger, tlog)
+	d, err := newDispatcher(
+		config, stats, clk, netevents, events, peerID, t, logger, tlog,
+		append(opts, withContext(ctx))...)
 	if err != nil {
 		return nil, err
 	}
 
-	// Exits when d.pendingPiecesDone is closed.
-	go d.watchPendingPieceRequests()
+	if ctx.Done() != nil {
+		// Exits when d is torn down.
+		go d.watchContext()
+	}
+
+	if d.runner != nil {
+		d.startRunnerLoops()
+	} else {
+		d.startLoops()
+	}
 
 	if t.Complete() {
 		d.complete()
@@ -117,37 +271,230 @@ func newDispatcher(
 	peerID core.PeerID,
 	t storage.Torrent,
 	logger *zap.SugaredLogger,
-	tlog *torrentlog.Logger) (*Dispatcher, error) {
+	tlog *torrentlog.Logger,
+	opts ...Option) (*Dispatcher, error) {
 
 	config = config.applyDefaults()
 
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	sizeBucket, err := torrentSizeBucket(config.SizeBuckets, t.Length())
+	if err != nil {
+		return nil, err
+	}
 	stats = stats.Tagged(map[string]string{
-		"module": "dispatch",
+		"module":      "dispatch",
+		"size_bucket": sizeBucket,
 	})
+	var guard *statsGuard
+	if !config.DisableStatsGuard {
+		guard = newStatsGuard(stats, clk, config, logger, t)
+		stats = guard.scope()
+	}
+
+	switch config.DownloadOrder {
+	case RandomDownloadOrder, SequentialDownloadOrder:
+	default:
+		return nil, fmt.Errorf("invalid download order: %s", config.DownloadOrder)
+	}
+
+	switch config.PeerReplacementPolicy {
+	case RejectNewPeers, EvictWorstPeer:
+	default:
+		return nil, fmt.Errorf("invalid peer replacement policy: %s", config.PeerReplacementPolicy)
+	}
+
+	if config.Runner != nil && config.Runner.clk != clk {
+		return nil, errors.New("dispatcher does not share the clock of its runner")
+	}
+
+	interfaces, err := newNetworkInterfaces(config.NetworkInterfaces)
+	if err != nil {
+		return nil, err
+	}
+
+	readOnly := config.ReadOnly || storage.IsReadOnly(t)
+	if readOnly && !t.Complete() {
+		return nil, fmt.Errorf("read-only torrent is incomplete: %s", t)
+	}
+
+	// Seed-only dispatchers never request pieces.
+	seedOnly := readOnly || config.SeedOnly || t.Complete()
+	var pieceRequestManager *piecerequest.Manager
+	var pieceRequestTimeout time.Duration
+	var requestTimeout *adaptiveTimeout
+	if !seedOnly {
+		pieceRequestTimeout = config.calcPieceRequestTimeout(t.MaxPieceLength())
+		provider := piecerequest.FixedTimeout(pieceRequestTimeout)
+		if requestTimeout = config.newAdaptiveTimeout(t.MaxPieceLength()); requestTimeout != nil {
+			provider = requestTimeout.get
+		}
+		var err error
+		pieceRequestManager, err = config.newPieceRequestManager(clk, pieceRequestTimeout, provider)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	pieceRequestTimeout := config.calcPieceRequestTimeout(t.MaxPieceLength())
-	pieceRequestManager, err := piecerequest.NewManager(
-		clk, pieceRequestTimeout, config.PieceRequestPolicy, config.PipelineLimit)
+	verifier, err := storage.NewPieceVerifier(config.PieceVerifier, t.Stat())
 	if err != nil {
-		return nil, fmt.Errorf("piece request manager: %s", err)
+		return nil, fmt.Errorf("piece verifier: %s", err)
 	}
 
-	return &Dispatcher{
+	emitter := newEventEmitter(
+		events, o.listeners, config.EventListenerTimeout, config.EventListenerQueueSize,
+		clk, stats, logger)
+
+	serveLatency := newServeLatencyTracker(
+		config.NumSlowestServes, config.SlowServeThreshold, config.SlowServeLimit)
+
+	d := &Dispatcher{
 		config:              config,
 		stats:               stats,
+		statsGuard:          guard,
+		locality:            o.locality,
 		clk:                 clk,
 		createdAt:           clk.Now(),
+		phases:              newPhaseClock(clk.Now()),
 		localPeerID:         peerID,
 		torrent:             newTorrentAccessWatcher(t, clk),
+		pieceLengths:        newPieceLengths(t),
+		peerStats:           newPeerStatsMap(),
+		capabilityStats:     newCapabilityStats(),
+		numPeers:            atomic.NewInt32(0),
 		numPeersByPiece:     syncutil.NewCounters(t.NumPieces()),
+		pieceAttempts:       syncutil.NewCounters(t.NumPieces()),
+		written:             newPieceLog(t.NumPieces()),
+		numAsymmetricPeers:  atomic.NewInt32(0),
+		numSeeders:          atomic.NewInt32(0),
+		usefulPiecesBytes:   atomic.NewInt64(0),
+		numDeferredServes:   atomic.NewInt32(0),
+		bytesDownloaded:     atomic.NewInt64(0),
+		bytesUploaded:       atomic.NewInt64(0),
+		rttBaseline:         atomic.NewInt64(0),
+		corruptPieces:       atomic.NewInt32(0),
+		finalReason:         atomic.NewInt32(-1),
+		endgameCause:        atomic.NewInt32(0),
 		netevents:           netevents,
 		pieceRequestTimeout: pieceRequestTimeout,
+		requestTimeout:      requestTimeout,
 		pieceRequestManager: pieceRequestManager,
+		readOnly:            readOnly,
+		seedOnly:            atomic.NewBool(seedOnly),
+		verifier:            verifier,
+		verifyReceived:      config.PieceVerifier != nil,
+		numFullServes:       atomic.NewInt64(0),
+		serveLatency:        serveLatency,
+		interfaces:          interfaces,
+		quarantine:          newPieceQuarantine(),
+		chunks:              newChunkAssembler(),
+		unavailablePieces:   newUnavailablePieces(config.PieceUnavailableTimeout),
+		ingress:             newIngressLimiter(clk, config.IngressBytesPerSec, t.MaxPieceLength()),
+		requestsDeferred:    atomic.NewBool(false),
+		kicks:               make(chan time.Time, 1),
 		pendingPiecesDone:   make(chan struct{}),
-		events:              events,
+		tornDown:            make(chan struct{}),
+		draining:            atomic.NewBool(false),
+		paused:              atomic.NewBool(false),
+		resumedAt:           atomic.NewInt64(0),
+		invalidating:        atomic.NewBool(false),
+		invalidated:         make(chan struct{}),
+		completed:           atomic.NewBool(false),
+		emitter:             emitter,
 		logger:              logger,
+		base:                logger.Desugar().WithOptions(zap.AddCallerSkip(2)),
+		torrentField:        zap.Any("torrent", t),
 		torrentlog:          tlog,
-	}, nil
+	}
+	if config.EgressBytesPerSec > 0 {
+		scheduler := config.ServeScheduler
+		if scheduler == nil {
+			scheduler, err = newServeScheduler(config.ServeSchedulingPolicy)
+			if err != nil {
+				return nil, err
+			}
+		}
+		d.egress = newEgressLimiter(
+			clk, config.EgressBytesPerSec, t.MaxPieceLength(), config.MaxQueuedEgressServes, scheduler,
+			config.PriorityServePercent)
+	}
+	if t.Complete() {
+		d.phases.mark(_completed, d.createdAt)
+	}
+	if config.Superseed && t.Complete() {
+		d.superseed = newSuperseeder(t.NumPieces(), config.SuperseedPieces)
+	}
+	if config.PieceWriteWorkers > 0 && !d.SeedOnly() {
+		d.pieceWrites = newPieceWrites(config.PieceWriteWorkers, t.NumPieces())
+	}
+	if config.ServePrefetchDepth > 0 {
+		d.prefetch = newServePrefetcher(
+			config.ServePrefetchDepth, config.ServePrefetchTTL, config.ServePrefetchBytes)
+	}
+	d.status = newStatusNotifier(d, config.StatusListener, config.StatusInterval, clk)
+	d.announcer = newAnnouncer(
+		d, config.AnnounceBudget, config.AnnounceBatchInterval, config.AnnounceBatchSize)
+	if config.AnnounceCoalesceWindow > 0 {
+		d.coalescer = newAnnounceCoalescer(d, config.AnnounceCoalesceWindow)
+	}
+	if config.StallTimeout > 0 {
+		d.stall = newStallWatcher(config.StallTimeout, t.Bitfield().Count(), d.createdAt)
+	}
+	d.decisions = newDecisionLog(config.DecisionBufferSize)
+	d.completeCloses = newCompleteCloses()
+	d.utilization = newUtilizationTracker(config.UtilizationWeight, config.LowUtilizationThreshold)
+	// Progress is reported in whole percents, so there is no point in checking
+	// it more often than once per percent of the torrent received.
+	d.partialPieces = newPartialPieces(t.Length()/100, d.status.progress)
+	if config.Runner != nil {
+		d.runner = config.Runner.register()
+	}
+	parent := o.ctx
+	if parent == nil {
+		parent = context.Background()
+	}
+	d.ctx, d.cancel = context.WithCancel(parent)
+
+	return d, nil
+}
+
+// startLoops starts the dedicated goroutines which run the periodic work of d.
+func (d *Dispatcher) startLoops() {
+	if !d.SeedOnly() {
+		// Exits when d.pendingPiecesDone is closed.
+		go d.watchPendingPieceRequests()
+	}
+
+	if d.config.EnableChoking {
+		// Exits when d.tornDown is closed.
+		go d.watchChokes()
+	}
+
+	// Exits when d.tornDown is closed.
+	go d.watchQueues()
+
+	if d.config.PeerCompactionInterval > 0 {
+		// Exits when d.tornDown is closed.
+		go d.watchPeerCompaction()
+	}
+
+	if d.config.PeerIdleTimeout > 0 {
+		// Exits when d.tornDown is closed.
+		go d.watchIdlePeers()
+	}
+
+	if d.config.DownloadDeadline > 0 && !d.torrent.Complete() {
+		// Exits when d.pendingPiecesDone is closed.
+		go d.watchDeadline()
+	}
+
+	if !d.config.ImmediateCompletedPeerClose {
+		// Exits when d.tornDown is closed.
+		go d.watchCompletedPeerCloses()
+	}
 }
 
 // Digest returns the blob digest for d's torrent.
@@ -165,9 +512,24 @@ func (d *Dispatcher) Length() int64 {
 	return d.torrent.Length()
 }
 
-// Stat returns d's TorrentInfo.
+// Stat returns d's TorrentInfo. Its bitfield only includes the pieces which
+// d advertises, i.e. excludes HiddenPieces.
 func (d *Dispatcher) Stat() *storage.TorrentInfo {
-	return d.torrent.Stat()
+	return d.torrent.Stat().ExcludePieces(d.HiddenPieces()...)
+}
+
+// HiddenPieces returns the pieces which are excluded from the bitfield d sends
+// to new peers, in ascending order: the UnadvertisedPieces and
+// QuarantinedPieces, or every piece if d superseeds, see Config.Superseed.
+func (d *Dispatcher) HiddenPieces() []int {
+	if d.superseed == nil {
+		return mergePieces(d.UnadvertisedPieces(), d.QuarantinedPieces())
+	}
+	pieces := make([]int, d.torrent.NumPieces())
+	for i := range pieces {
+		pieces[i] = i
+	}
+	return pieces
 }
 
 // Complete returns true if d's torrent is complete.
@@ -175,6 +537,12 @@ func (d *Dispatcher) Complete() bool {
 	return d.torrent.Complete()
 }
 
+// completedBytes returns the number of bytes of d's torrent which have been
+// received, including bytes of partially received pieces.
+func (d *Dispatcher) completedBytes() int64 {
+	return d.torrent.BytesDownloaded() + d.partialPieces.total(d.torrent.HasPiece)
+}
+
 // CreatedAt returns when d was created.
 func (d *Dispatcher) CreatedAt() time.Time {
 	return d.createdAt
@@ -199,6 +567,39 @@ func (d *Dispatcher) LastPieceSent(peerID core.PeerID) time.Time {
 	return v.(*peer).getLastPieceSent()
 }
 
+// PeerStats returns transfer statistics of peerID. Returns false if peerID is
+// not connected.
+func (d *Dispatcher) PeerStats(peerID core.PeerID) (PeerStats, bool) {
+	v, ok := d.peers.Load(peerID)
+	if !ok {
+		return PeerStats{}, false
+	}
+	return v.(*peer).stats(), true
+}
+
+// AllPeerStats returns transfer statistics of all connected peers.
+func (d *Dispatcher) AllPeerStats() []PeerStats {
+	var stats []PeerStats
+	d.peers.Range(func(k, v interface{}) bool {
+		stats = append(stats, v.(*peer).stats())
+		return true
+	})
+	return stats
+}
+
+// WireEfficiency returns the approximate ratio of piece payload bytes to total
+// bytes sent to all connected peers. Returns zero if unknown.
+func (d *Dispatcher) WireEfficiency() float64 {
+	var payload, wire int64
+	for _, s := range d.AllPeerStats() {
+		if s.WireBytesSent > 0 {
+			payload += s.BytesUploaded
+			wire += s.WireBytesSent
+		}
+	}
+	return wireEfficiency(payload, wire)
+}
+
 // LastReadTime returns when d's torrent was last read from.
 func (d *Dispatcher) LastReadTime() time.Time {
 	return d.torrent.getLastReadTime()
@@ -211,12 +612,27 @@ func (d *Dispatcher) LastWriteTime() time.Time {
 
 // Empty returns true if the Dispatcher has no peers.
 func (d *Dispatcher) Empty() bool {
-	empty := true
+	return d.NumPeers() == 0
+}
+
+// NumPeers returns the number of peers of the Dispatcher.
+func (d *Dispatcher) NumPeers() int {
+	return int(d.numPeers.Load())
+}
+
+// PeerIDs returns the ids of the peers of the Dispatcher, in no particular order.
+func (d *Dispatcher) PeerIDs() []core.PeerID {
+	peerIDs := make([]core.PeerID, 0, d.NumPeers())
 	d.peers.Range(func(k, v interface{}) bool {
-		empty = false
-		return false
+		peerIDs = append(peerIDs, k.(core.PeerID))
+		return true
 	})
-	return empty
+	return peerIDs
+}
+
+// SlowestServes returns the slowest piece serves of d, slowest first.
+func (d *Dispatcher) SlowestServes() []ServeLatency {
+	return d.serveLatency.getSlowest()
 }
 
 // RemoteBitfields returns the bitfields of peers connected to the dispatcher.
@@ -232,363 +648,2324 @@ func (d *Dispatcher) RemoteBitfields() conn.RemoteBitfields {
 
 // AddPeer registers a new peer with the Dispatcher.
 func (d *Dispatcher) AddPeer(
-	peerID core.PeerID, b *bitset.BitSet, messages Messages) error {
+	peerID core.PeerID, b *bitset.BitSet, messages Messages, opts ...PeerOption) error {
 
-	p, err := d.addPeer(peerID, b, messages)
+	p, err := d.addPeer(peerID, b, messages, opts...)
 	if err != nil {
 		return err
 	}
-	go d.maybeRequestMorePieces(p)
-	go d.feed(p)
+	d.startPeer(p)
+	return nil
+}
+
+// AddPeerSince registers a new peer like AddPeer, which was sent snapshot at
+// handshake. Pieces written while handshaking were not announced to the peer,
+// so the pieces written since snapshot was taken which it lacks are announced
+// to the peer once added.
+func (d *Dispatcher) AddPeerSince(
+	peerID core.PeerID,
+	b *bitset.BitSet,
+	messages Messages,
+	snapshot BitfieldSnapshot,
+	opts ...PeerOption) error {
+
+	p, err := d.addPeer(peerID, b, messages, opts...)
+	if err != nil {
+		return err
+	}
+	d.announceMissed(p, snapshot)
+	d.startPeer(p)
 	return nil
 }
 
+// startPeer starts requesting pieces from and handling messages of p, which
+// was just added.
+func (d *Dispatcher) startPeer(p *peer) {
+	if !d.SeedOnly() {
+		go d.maybeRequestMorePieces(p)
+	}
+	if p.sendQueue != nil {
+		p.sendQueue.start()
+	}
+	go d.feed(p)
+	d.watchKeepalive(p)
+}
+
 // addPeer creates and inserts a new peer into the Dispatcher. Split from AddPeer
 // with no goroutine side-effects for testing purposes.
 func (d *Dispatcher) addPeer(
-	peerID core.PeerID, b *bitset.BitSet, messages Messages) (*peer, error) {
+	peerID core.PeerID, b *bitset.BitSet, messages Messages, opts ...PeerOption) (*peer, error) {
 
-	pstats := &peerStats{}
-	if s, ok := d.peerStats.LoadOrStore(peerID, pstats); ok {
-		pstats = s.(*peerStats)
+	if n := uint(d.torrent.NumPieces()); b.Len() != n {
+		return nil, &bitfieldLengthError{b.Len(), n}
+	}
+
+	if d.config.MaxPeers > 0 {
+		d.peerLimitMu.Lock()
+		defer d.peerLimitMu.Unlock()
+
+		if _, ok := d.peers.Load(peerID); ok {
+			return nil, errors.New("peer already exists")
+		}
+		if err := d.makeRoomForPeer(); err != nil {
+			return nil, err
+		}
 	}
 
-	p := newPeer(peerID, b, messages, d.clk, pstats)
+	p := newPeer(
+		peerID, b, messages, d.clk, d.peerStats.connect(peerID),
+		d.config.PeerRateWindow, d.config.ReciprocityWindow, d.config.PieceRTTWeight)
+	if n := d.config.MaxErrorMessages; n > 0 {
+		p.errorMessages = rate.NewLimiter(rate.Every(d.config.ErrorMessageInterval/time.Duration(n)), n)
+	}
+	if n := d.config.SendQueueSize; n > 0 {
+		p.sendQueue = newSendQueue(messages, d.clk, n, d.ctx.Done(), func(msg *conn.Message, err error) {
+			d.sendQueueFailed(p, msg, err)
+		})
+	}
+	if messages.Supports(conn.PriorityRequests) {
+		p.serves.enablePriority(d.config.PriorityServePercent)
+	}
+	p.localAddr = localAddr(messages)
+	if d.interfaces.configured() {
+		p.iface = d.interfaces.classify(p.localAddr)
+	}
+	var po peerOptions
+	for _, opt := range opts {
+		opt(&po)
+	}
+	p.locality = po.locality
+	p.local = p.locality != "" && p.locality == d.locality
 	if _, ok := d.peers.LoadOrStore(peerID, p); ok {
 		return nil, errors.New("peer already exists")
 	}
+	d.numPeers.Inc()
+	d.phases.mark(_firstPeer, d.clk.Now())
+	d.updateCapabilityPeers(p, 1)
 
 	for _, i := range p.bitfield.GetAllSet() {
 		d.numPeersByPiece.Increment(int(i))
 	}
+	d.cacheUsefulPieces(p)
+	d.addPeerChoked(p)
+	d.status.notify(PeersChanged)
+	if p.bitfield.Complete() {
+		p.requestMu.Lock()
+		completed := d.markPeerCompletedLocked(p)
+		p.requestMu.Unlock()
+		if completed {
+			d.peerCompleted(p, _completedAtHandshake)
+		}
+	} else if d.superseed != nil {
+		d.superseed.add(p.id)
+		d.superseedReveal(p)
+	}
 	return p, nil
 }
 
-func (d *Dispatcher) removePeer(p *peer) error {
-	d.peers.Delete(p.id)
-	d.pieceRequestManager.ClearPeer(p.id)
+// RemovePeer removes peerID from the Dispatcher and closes its messages. Piece
+// requests pending with the peer are resent to other peers by the background
+// loop of d right away, rather than once they time out, and never by the
+// caller. Safe to call while the messages of the peer close on their own.
+func (d *Dispatcher) RemovePeer(peerID core.PeerID) error {
+	return d.RemovePeerWithReason(peerID, PeerRemovalUnspecified)
+}
 
-	for _, i := range p.bitfield.GetAllSet() {
-		d.numPeersByPiece.Decrement(int(i))
+// RemovePeerWithReason removes peerID like RemovePeer, recording reason as why
+// the peer was removed.
+func (d *Dispatcher) RemovePeerWithReason(peerID core.PeerID, reason PeerRemovalReason) error {
+	v, ok := d.peers.Load(peerID)
+	if !ok {
+		return errPeerNotDispatched
 	}
-	return nil
+	return d.closePeer(v.(*peer), reason)
 }
 
-// TearDown closes all Dispatcher connections.
-func (d *Dispatcher) TearDown() {
-	d.pendingPiecesDoneOnce.Do(func() {
-		close(d.pendingPiecesDone)
-	})
-
-	d.peers.Range(func(k, v interface{}) bool {
-		p := v.(*peer)
-		d.log("peer", p).Info("Dispatcher teardown closing connection")
-		p.messages.Close()
-		return true
-	})
+// closePeer removes p from the Dispatcher for reason and closes its messages,
+// see RemovePeer.
+func (d *Dispatcher) closePeer(p *peer, reason PeerRemovalReason) error {
+	requests, err := d.detachPeer(p, reason)
+	if err != nil {
+		return err
+	}
+	p.messages.Close()
+	h := d.torrent.InfoHash()
+	d.emitter.emit(func(e Events) { e.PeerRemoved(p.id, h) })
+
+	if len(requests) > 0 {
+		// Resends may block on the send queues of other peers, so they are
+		// left to the background loop of d rather than run on the caller.
+		d.log("peer", p).Infof("Queueing %d piece requests of removed peer for resend", len(requests))
+		d.removedRequestsMu.Lock()
+		d.removedRequests = append(d.removedRequests, requests...)
+		d.removedRequestsMu.Unlock()
+		d.Kick()
+	}
+	return nil
+}
 
-	summaries := make(torrentlog.LeecherSummaries, 0)
-	d.peerStats.Range(func(k, v interface{}) bool {
-		peerID := k.(core.PeerID)
-		pstats := v.(*peerStats)
-		summaries = append(summaries, torrentlog.LeecherSummary{
-			PeerID:           peerID,
-			RequestsReceived: pstats.getPieceRequestsReceived(),
-			PiecesSent:       pstats.getPiecesSent(),
-		})
-		return true
-	})
+// takeRemovedRequests returns and forgets the piece requests of peers which
+// closePeer removed since the last call.
+func (d *Dispatcher) takeRemovedRequests() []piecerequest.Request {
+	d.removedRequestsMu.Lock()
+	defer d.removedRequestsMu.Unlock()
 
-	if err := d.torrentlog.LeecherSummaries(
-		d.torrent.Digest(), d.torrent.InfoHash(), summaries); err != nil {
-		d.log().Errorf("Error logging incoming piece request summary: %s", err)
-	}
+	requests := d.removedRequests
+	d.removedRequests = nil
+	return requests
 }
 
-func (d *Dispatcher) String() string {
-	return fmt.Sprintf("Dispatcher(%s)", d.torrent)
+// removePeer removes p from the Dispatcher once its messages closed. Returns
+// errPeerNotDispatched if p was already removed.
+func (d *Dispatcher) removePeer(p *peer) error {
+	_, err := d.detachPeer(p, d.closedReason(p))
+	return err
 }
 
-func (d *Dispatcher) complete() {
-	d.completeOnce.Do(func() { go d.events.DispatcherComplete(d) })
-	d.pendingPiecesDoneOnce.Do(func() { close(d.pendingPiecesDone) })
+// detachPeer removes p from the Dispatcher for reason, returning the piece
+// requests which were still awaited from p. Returns errPeerNotDispatched if p
+// was already removed.
+func (d *Dispatcher) detachPeer(
+	p *peer, reason PeerRemovalReason) ([]piecerequest.Request, error) {
+
+	// Wait for in-flight reservations to p before clearing its requests, such
+	// that every request reserved for p is returned.
+	p.requestMu.Lock()
+	if p.removed {
+		p.requestMu.Unlock()
+		return nil, errPeerNotDispatched
+	}
+	p.removed = true
+	d.peers.Delete(p.id)
+	d.numPeers.Dec()
+	d.peerStats.disconnect(p.id, d.clk.Now())
+	d.updateCapabilityPeers(p, -1)
+	var requests []piecerequest.Request
+	if !d.SeedOnly() {
+		requests = d.pieceRequestManager.ClearPeer(p.id)
+	}
+	d.releaseUsefulPiecesLocked(p)
+	if p.completed.Load() {
+		d.updateSeeders(-1)
+	}
+	p.requestMu.Unlock()
 
-	d.peers.Range(func(k, v interface{}) bool {
-		p := v.(*peer)
-		if p.bitfield.Complete() {
-			// Close connections to other completed peers since those connections
-			// are now useless.
-			d.log("peer", p).Info("Closing connection to completed peer")
-			p.messages.Close()
-		} else {
-			// Notify in-progress peers that we have completed the torrent and
-			// all pieces are available.
-			p.messages.Send(conn.NewCompleteMessage())
-		}
-		return true
-	})
+	if rtt := p.getPieceRTT(); rtt > 0 && int64(rtt) <= d.rttBaseline.Load() {
+		// p may have been the fastest peer.
+		d.refreshRTTBaseline()
+	}
 
-	var piecesRequestedTotal int
-	summaries := make(torrentlog.SeederSummaries, 0)
-	d.peerStats.Range(func(k, v interface{}) bool {
-		peerID := k.(core.PeerID)
-		pstats := v.(*peerStats)
-		requested := pstats.getPieceRequestsSent()
-		piecesRequestedTotal += requested
-		summary := torrentlog.SeederSummary{
-			PeerID:         peerID,
-			RequestsSent:   requested,
-			GoodPiecesReceived: pstats.getGoodPiecesReceived(),
-			DuplicatePiecesReceived: pstats.getDuplicatePiecesReceived(),
-		}
-		summaries = append(summaries, summary)
-		return true
-	})
+	p.serves.clear()
+	if p.sendQueue != nil {
+		p.sendQueue.stop()
+	}
+	d.announcer.drop(p)
+	d.completeCloses.drop(p)
+	if d.superseed != nil {
+		d.superseed.drop(p.id)
+	}
 
-	// Only log if we actually requested pieces from others.
-	if piecesRequestedTotal > 0 {
-		if err := d.torrentlog.SeederSummaries(
-			d.torrent.Digest(), d.torrent.InfoHash(), summaries); err != nil {
-			d.log().Errorf("Error logging outgoing piece request summary: %s", err)
-		}
+	if d.prefetch != nil {
+		d.countWastedPrefetches(d.prefetch.clear(p.id))
 	}
-}
 
-func (d *Dispatcher) endgame() bool {
-	if d.config.DisableEndgame {
-		return false
+	if d.config.EnableChoking && !p.serves.isChoked() {
+		// Hand the upload slot of p to another peer.
+		d.rechoke()
 	}
-	remaining := d.torrent.NumPieces() - int(d.torrent.Bitfield().Count())
-	return remaining <= d.config.EndgameThreshold
-}
 
-func (d *Dispatcher) maybeRequestMorePieces(p *peer) (bool, error) {
-	candidates := p.bitfield.Intersection(d.torrent.Bitfield().Complement())
+	if p.setAsymmetric(false) {
+		d.log("peer", p).Info("Removed asymmetric peer")
+		d.updateAsymmetricPeers(-1)
+	}
 
-	return d.maybeSendPieceRequests(p, candidates)
+	for _, i := range p.bitfield.GetAllSet() {
+		d.numPeersByPiece.Decrement(int(i))
+	}
+	d.status.notify(PeersChanged)
+	d.recordPeerRemoval(p, reason, len(requests) > 0)
+	return requests, nil
 }
 
-func (d *Dispatcher) maybeSendPieceRequests(p *peer, candidates *bitset.BitSet) (bool, error) {
-	pieces, err := d.pieceRequestManager.ReservePieces(p.id, candidates, d.numPeersByPiece, d.endgame())
-	if err != nil {
-		return false, err
+// peerHasPiece sets piece i in the bitfield of p. Pieces are counted towards
+// numPeersByPiece once per peer, and never after p was removed, such that the
+// counts stay correct when removePeer discounts the bitfield of p. Once p has
+// all pieces, it transitions to a seeder, counted under trigger. An empty
+// trigger defers the transition until p announces its pieces itself, e.g. when
+// we merely assume that p received a piece we served. Returns an error if i is
+// out of range.
+func (d *Dispatcher) peerHasPiece(p *peer, i int, trigger string) error {
+	var completed bool
+	var err error
+	p.requestMu.Lock()
+	if !p.removed {
+		var changed bool
+		changed, err = p.bitfield.Set(uint(i), true)
+		if changed {
+			d.peerGainedPieceLocked(p, i)
+		}
+		completed = d.maybeMarkPeerCompletedLocked(p, trigger)
 	}
-	if len(pieces) == 0 {
-		return false, nil
+	p.requestMu.Unlock()
+
+	if completed {
+		d.peerCompleted(p, trigger)
 	}
-	for _, i := range pieces {
-		if err := p.messages.Send(conn.NewPieceRequestMessage(i, d.torrent.PieceLength(i))); err != nil {
-			// Connection closed.
-			d.pieceRequestManager.MarkUnsent(p.id, i)
-			return false, err
-		}
-		d.netevents.Produce(
-			networkevent.RequestPieceEvent(d.torrent.InfoHash(), d.localPeerID, p.id, i))
-			p.pstats.incrementPieceRequestsSent()
-		}
-	return true, nil
+	return err
 }
 
-func (d *Dispatcher) resendFailedPieceRequests() {
-	failedRequests := d.pieceRequestManager.GetFailedRequests()
-	if len(failedRequests) > 0 {
-		d.log().Infof("Resending %d failed piece requests", len(failedRequests))
-		d.stats.Counter("piece_request_failures").Inc(int64(len(failedRequests)))
+// peerHasPieces sets all pieces of diff in the bitfield of p. See peerHasPiece.
+// If any piece of diff is out of range, none are set.
+func (d *Dispatcher) peerHasPieces(p *peer, diff *bitset.BitSet, trigger string) error {
+	var completed bool
+	var err error
+	p.requestMu.Lock()
+	if !p.removed {
+		var changed []uint
+		changed, err = p.bitfield.Apply(diff)
+		for _, i := range changed {
+			d.peerGainedPieceLocked(p, int(i))
+		}
+		completed = d.maybeMarkPeerCompletedLocked(p, trigger)
 	}
+	p.requestMu.Unlock()
 
-	var sent int
-	for _, r := range failedRequests {
-		d.peers.Range(func(k, v interface{}) bool {
-			p := v.(*peer)
-			if (r.Status == piecerequest.StatusExpired || r.Status == piecerequest.StatusInvalid) &&
-				r.PeerID == p.id {
-				// Do not resend to the same peer for expired or invalid requests.
-				return true
-			}
-
-			b := d.torrent.Bitfield()
-			candidates := p.bitfield.Intersection(b.Complement())
-			if candidates.Test(uint(r.Piece)) {
-				nb := bitset.New(b.Len()).Set(uint(r.Piece))
-				if sent, err := d.maybeSendPieceRequests(p, nb); sent && err == nil {
-					return false
-				}
-			}
-			return true
-		})
+	if completed {
+		d.peerCompleted(p, trigger)
 	}
+	return err
+}
 
-	unsent := len(failedRequests) - sent
-	if unsent > 0 {
-		d.log().Infof("Nowhere to resend %d / %d failed piece requests", unsent, len(failedRequests))
+// peerPiecesIn returns the pieces of b which p has. The bitfields of peers are
+// validated to match the number of pieces of the torrent when added, so b must
+// be of that length, otherwise no pieces are returned.
+func (d *Dispatcher) peerPiecesIn(p *peer, b *bitset.BitSet) *bitset.BitSet {
+	r, err := p.bitfield.Intersection(b)
+	if err != nil {
+		d.log("peer", p).Errorf("Error intersecting peer bitfield: %s", err)
+		return bitset.New(b.Len())
 	}
+	return r
 }
 
-func (d *Dispatcher) watchPendingPieceRequests() {
-	for {
-		select {
-		case <-d.clk.After(d.pieceRequestTimeout / 2):
-			d.resendFailedPieceRequests()
-		case <-d.pendingPiecesDone:
-			return
-		}
+// peerGainedPieceLocked counts piece i, which was just set in the bitfield of
+// p. Caller must hold p.requestMu.
+func (d *Dispatcher) peerGainedPieceLocked(p *peer, i int) {
+	d.numPeersByPiece.Increment(i)
+	if p.useful != nil && !d.torrent.HasPiece(i) {
+		p.useful.Set(uint(i))
 	}
 }
 
-// feed reads off of peer and handles incoming messages. When peer's messages close,
-// the feed goroutine removes peer from the Dispatcher and exits.
-func (d *Dispatcher) feed(p *peer) {
-	for msg := range p.messages.Receiver() {
-		if err := d.dispatch(p, msg); err != nil {
-			d.log().Errorf("Error dispatching message: %s", err)
-		}
+// maybeMarkPeerCompletedLocked marks p completed under trigger once it has all
+// pieces, see peerHasPiece. Caller must hold p.requestMu, and must call
+// peerCompleted if true is returned.
+func (d *Dispatcher) maybeMarkPeerCompletedLocked(p *peer, trigger string) bool {
+	if p.completed.Load() || !p.bitfield.Complete() {
+		return false
+	}
+	if trigger == "" {
+		d.releaseUsefulPiecesLocked(p)
+		return false
 	}
-	d.removePeer(p)
-	d.events.PeerRemoved(p.id, d.torrent.InfoHash())
+	return d.markPeerCompletedLocked(p)
 }
 
+// peerHasAllPieces sets all pieces in the bitfield of p. See peerHasPiece.
+func (d *Dispatcher) peerHasAllPieces(p *peer) {
+	var completed bool
+	p.requestMu.Lock()
+	if !p.removed {
+		for _, i := range p.bitfield.SetAll(true) {
+			d.numPeersByPiece.Increment(int(i))
+		}
+		completed = d.markPeerCompletedLocked(p)
+	}
+	p.requestMu.Unlock()
+
+	if completed {
+		d.peerCompleted(p, _completedByComplete)
+	}
+}
+
+// Triggers of peers transitioning to seeders.
+const (
+	_completedAtHandshake = "handshake"
+	_completedByAnnounce  = "announce"
+	_completedByComplete  = "complete"
+)
+
+// markPeerCompletedLocked counts p as a seeder and drops its cached useful
+// pieces, which complete peers do not need. Returns false if p was already
+// marked. Caller must hold p.requestMu, and must call peerCompleted if true is
+// returned.
+func (d *Dispatcher) markPeerCompletedLocked(p *peer) bool {
+	if !p.completed.CAS(false, true) {
+		return false
+	}
+	d.releaseUsefulPiecesLocked(p)
+	d.updateSeeders(1)
+	return true
+}
+
+// peerCompleted finishes the transition of p to a seeder, regardless of whether
+// p announced its final piece, sent a complete message, or had all pieces at
+// handshake: p is sent no further announces, and the connection to p is closed
+// if we are complete too.
+func (d *Dispatcher) peerCompleted(p *peer, trigger string) {
+	d.stats.Tagged(map[string]string{
+		"trigger": trigger,
+	}).Counter("peer_completions").Inc(1)
+	d.announcer.drop(p)
+	if d.superseed != nil {
+		d.superseed.drop(p.id)
+	}
+
+	if d.Complete() {
+		d.notifyPeerComplete(p)
+	}
+}
+
+func (d *Dispatcher) updateSeeders(delta int32) {
+	n := d.numSeeders.Add(delta)
+	d.stats.Gauge("seeders").Update(float64(n))
+}
+
+// NumSeeders returns the number of connected peers which have all pieces.
+func (d *Dispatcher) NumSeeders() int {
+	return int(d.numSeeders.Load())
+}
+
+// PrioritizePieces requests indices ahead of all other pieces. Prioritized
+// pieces are hedged, i.e. they may be requested from multiple peers at once.
+func (d *Dispatcher) PrioritizePieces(indices []int) {
+	if d.SeedOnly() {
+		return
+	}
+	var pieces []int
+	for _, i := range indices {
+		if i < 0 || i >= d.torrent.NumPieces() || d.torrent.HasPiece(i) {
+			continue
+		}
+		pieces = append(pieces, i)
+	}
+	d.pieceRequestManager.Prioritize(pieces)
+}
+
+// PieceRange is a range of pieces, from Start inclusive to End exclusive.
+type PieceRange struct {
+	Start int
+	End   int
+}
+
+// SetPiecePriorities biases piece selection towards ranges, replacing previous
+// priorities: missing pieces within ranges are requested ahead of all other
+// pieces but those of PrioritizePieces, until they complete. Unlike
+// PrioritizePieces, pieces within ranges are not hedged until the remaining
+// pieces within ranges fall below the endgame threshold. Nil ranges restore
+// normal piece selection.
+func (d *Dispatcher) SetPiecePriorities(ranges []PieceRange) {
+	if d.SeedOnly() {
+		return
+	}
+	var pieces []int
+	for _, r := range ranges {
+		start := r.Start
+		if start < 0 {
+			start = 0
+		}
+		for i := start; i < r.End && i < d.torrent.NumPieces(); i++ {
+			if !d.torrent.HasPiece(i) {
+				pieces = append(pieces, i)
+			}
+		}
+	}
+	var endgameThreshold int
+	if !d.config.DisableEndgame {
+		endgameThreshold = d.config.EndgameThreshold
+	}
+	d.pieceRequestManager.SetPreferred(pieces, endgameThreshold)
+
+	// Prioritized pieces may be requestable from peers which are idle.
+	d.requestMorePiecesFromAll()
+}
+
+// DeprioritizePieces reverts PrioritizePieces for indices, cancelling hedged
+// requests while leaving the primary request of each piece intact. No-op for
+// completed or never prioritized pieces.
+func (d *Dispatcher) DeprioritizePieces(indices []int) {
+	if d.SeedOnly() {
+		return
+	}
+	for _, r := range d.pieceRequestManager.Deprioritize(indices) {
+		d.cancelPieceRequest(r.PeerID, r.Piece)
+	}
+}
+
+// SetIngressLimit limits the rate at which d downloads pieces to bytesPerSec.
+// Zero disables the limit.
+func (d *Dispatcher) SetIngressLimit(bytesPerSec int64) {
+	d.ingress.setLimit(bytesPerSec)
+
+	// Requests deferred under the previous limit may be sendable now.
+	d.requestMorePiecesFromAll()
+}
+
+// NotifyPiecesWritten notifies d that pieces were written to its torrent
+// out-of-band, e.g. fetched from the origin after PiecesUnavailable. Pieces the
+// torrent does not have are ignored. Completes d if all pieces were written.
+func (d *Dispatcher) NotifyPiecesWritten(pieces []int) {
+	if d.readOnly {
+		// Read-only torrents are complete since creation.
+		return
+	}
+	var written []int
+	for _, i := range pieces {
+		if d.torrent.HasPiece(i) {
+			written = append(written, i)
+		}
+	}
+	d.clearUsefulPieces(written...)
+	for _, i := range written {
+		d.written.add(i)
+		d.partialPieces.remove(i, d.chunks.drop(i))
+		if !d.SeedOnly() {
+			for _, r := range d.pieceRequestManager.MarkComplete(i) {
+				d.cancelPieceRequest(r.PeerID, i)
+			}
+		}
+		d.peers.Range(func(k, v interface{}) bool {
+			d.announcer.announce(v.(*peer), i)
+			return true
+		})
+	}
+	if d.torrent.Complete() {
+		d.complete()
+	}
+}
+
+// TearDown closes all Dispatcher connections. Events occurring after TearDown
+// are not delivered. Equivalent to TearDownWithReason(TearDownUnspecified).
+func (d *Dispatcher) TearDown() {
+	d.TearDownWithReason(TearDownUnspecified)
+}
+
+// TearDownWithReason closes all Dispatcher connections, recording reason as the
+// final reason of d. If d is torn down multiple times, the first reason is kept.
+func (d *Dispatcher) TearDownWithReason(reason TearDownReason) {
+	d.finalReason.CAS(-1, int32(reason))
+	d.log("reason", reason).Info("Tearing down dispatcher")
+
+	d.pendingPiecesDoneOnce.Do(func() {
+		close(d.pendingPiecesDone)
+	})
+	d.tearDownOnce.Do(func() {
+		close(d.tornDown)
+		// Cuts blocking sends and drains short.
+		d.cancel()
+		d.phases.mark(_tornDown, d.clk.Now())
+		phases := d.Phases()
+		if d.Complete() {
+			d.recordPhase("complete_to_teardown", phases.CompleteToTeardown)
+		}
+		reason, _ := d.FinalReason()
+		d.netevents.Produce(networkevent.TorrentTeardownEvent(
+			d.torrent.InfoHash(), d.localPeerID, reason.String()).
+			WithPhases(phases.Millis()).
+			At(d.clk.Now()))
+	})
+
+	// Writes in flight may complete d, and are waited for first.
+	if d.pieceWrites != nil {
+		d.pieceWrites.close()
+	}
+
+	// Peers are notified of completion before their connections are closed.
+	// Completions from here on skip the notification, since Add must not race
+	// with Wait and the connections are about to be closed anyway.
+	d.completeMu.Lock()
+	d.completeWaited = true
+	d.completeMu.Unlock()
+	d.completeNotifications.Wait()
+
+	d.emitter.close()
+	d.status.close()
+	d.announcer.close()
+	if d.coalescer != nil {
+		d.coalescer.close()
+	}
+	d.decisions.clear()
+	d.completeCloses.clear()
+
+	// Wire counters are only available while peers are connected.
+	d.stats.Gauge("wire_efficiency").Update(d.WireEfficiency())
+	efficiency := make(map[core.PeerID]float64)
+	for _, s := range d.AllPeerStats() {
+		efficiency[s.PeerID] = s.WireEfficiency
+	}
+
+	d.peers.Range(func(k, v interface{}) bool {
+		p := v.(*peer)
+		d.log("peer", p).Info("Dispatcher teardown closing connection")
+		p.messages.Close()
+		return true
+	})
+
+	summaries := make(torrentlog.LeecherSummaries, 0)
+	for peerID, pstats := range d.peerStats.all() {
+		summaries = append(summaries, torrentlog.LeecherSummary{
+			PeerID:           peerID,
+			RequestsReceived: pstats.getPieceRequestsReceived(),
+			PiecesSent:       pstats.getPiecesSent(),
+			WireEfficiency:   efficiency[peerID],
+		})
+	}
+	if compacted, n := d.peerStats.aggregate(); n > 0 {
+		// Compacted peers are summarized under the zero peer id.
+		summaries = append(summaries, torrentlog.LeecherSummary{
+			RequestsReceived: compacted.pieceRequestsReceived,
+			PiecesSent:       compacted.piecesSent,
+		})
+	}
+
+	if err := d.torrentlog.LeecherSummaries(
+		d.torrent.Digest(), d.torrent.InfoHash(), summaries); err != nil {
+		d.log().Errorf("Error logging incoming piece request summary: %s", err)
+	}
+
+	d.auditOnce.Do(d.deliverAudit)
+
+	d.runner.stop()
+	d.statsGuard.close()
+}
+
+// FinalReason returns why d was torn down. Returns false if d was not torn down.
+func (d *Dispatcher) FinalReason() (TearDownReason, bool) {
+	r := d.finalReason.Load()
+	if r < 0 {
+		return TearDownUnspecified, false
+	}
+	return TearDownReason(r), true
+}
+
+// fail notifies Events that the download of d's torrent failed for reason.
+// Only the first failure is notified.
+func (d *Dispatcher) fail(reason TearDownReason) {
+	d.failOnce.Do(func() {
+		d.log("reason", reason).Error("Dispatcher failed")
+		d.stats.Tagged(map[string]string{
+			"reason": reason.String(),
+		}).Counter("dispatcher_failures").Inc(1)
+		d.emitter.emit(func(e Events) { e.DispatcherFailed(d, reason) })
+		d.status.notify(StateChanged)
+	})
+}
+
+// watchDeadline fails d with TearDownDeadline if its torrent is not complete
+// within Config.DownloadDeadline of its creation.
+func (d *Dispatcher) watchDeadline() {
+	select {
+	case <-d.clk.After(d.config.DownloadDeadline):
+		d.checkDeadline()
+	case <-d.pendingPiecesDone:
+	}
+}
+
+// watchContext tears d down with TearDownCanceled once the context of d is
+// done, unless d was torn down first.
+func (d *Dispatcher) watchContext() {
+	<-d.ctx.Done()
+	select {
+	case <-d.tornDown:
+		// Torn down by the caller, which canceled the context.
+	default:
+		d.log().Info("Dispatcher context done")
+		d.TearDownWithReason(TearDownCanceled)
+	}
+}
+
+// checkDeadline fails d unless its torrent completed by its download deadline.
+func (d *Dispatcher) checkDeadline() {
+	if !d.torrent.Complete() {
+		d.fail(TearDownDeadline)
+	}
+}
+
+// invalidPieceReceived records that p sent an invalid piece, and bans p once it
+// sent more than Config.MaxInvalidPieces invalid pieces within
+// Config.InvalidPieceWindow. Pieces which we completed in the meantime are not
+// invalid and must not be recorded.
+func (d *Dispatcher) invalidPieceReceived(p *peer) {
+	n := p.recordInvalidPiece(d.config.InvalidPieceWindow)
+	if d.config.MaxInvalidPieces == 0 || n <= d.config.MaxInvalidPieces {
+		return
+	}
+	if d.banPeer(p) {
+		d.recordBan(p, _banInvalidPieces, n)
+		d.log("peer", p).Warnf(
+			"Banned peer after %d invalid pieces within %s", n, d.config.InvalidPieceWindow)
+	}
+}
+
+// protocolViolation records that p sent a malformed message, and bans p once it
+// committed more than Config.MaxProtocolViolations violations. The handler of
+// the message returns the violation as an ErrorProtocolViolation error.
+func (d *Dispatcher) protocolViolation(p *peer) {
+	n := p.recordProtocolViolation()
+	d.stats.Counter("protocol_violations").Inc(1)
+	if d.config.MaxProtocolViolations == 0 || n <= d.config.MaxProtocolViolations {
+		return
+	}
+	if d.banPeer(p) {
+		d.recordBan(p, _banProtocolViolations, n)
+		d.log("peer", p).Warnf("Banned peer after %d protocol violations", n)
+	}
+}
+
+// banPeer removes p and reports it as banned. Returns false if p was already
+// removed, e.g. banned concurrently.
+func (d *Dispatcher) banPeer(p *peer) bool {
+	if err := d.closePeer(p, PeerRemovalBanned); err != nil {
+		return false
+	}
+	d.stats.Counter("banned_peers").Inc(1)
+	h := d.torrent.InfoHash()
+	d.netevents.Produce(networkevent.BanPeerEvent(h, d.localPeerID, p.id).At(d.clk.Now()))
+	d.emitter.emit(func(e Events) { e.PeerBanned(p.id, h) })
+	return true
+}
+
+// pieceCorrupted records that a piece received from a peer failed verification,
+// failing d with TearDownCorruption once Config.MaxCorruptPieces is exceeded.
+func (d *Dispatcher) pieceCorrupted() {
+	n := d.corruptPieces.Inc()
+	if d.config.MaxCorruptPieces > 0 && int(n) > d.config.MaxCorruptPieces {
+		d.fail(TearDownCorruption)
+	}
+}
+
+func (d *Dispatcher) String() string {
+	return fmt.Sprintf("Dispatcher(%s)", d.torrent)
+}
+
+// complete transitions d to complete. Construction, received payloads and
+// NotifyPiecesWritten may all trigger it concurrently, but only the first
+// trigger transitions d, and peers are notified at most once each.
+func (d *Dispatcher) complete() {
+	if d.completed.CAS(false, true) {
+		d.phases.mark(_completed, d.clk.Now())
+		phases := d.Phases()
+		d.recordPhase("to_first_peer", phases.ToFirstPeer)
+		d.recordPhase("to_first_piece", phases.ToFirstPiece)
+		d.recordPhase("transfer", phases.Transfer)
+		d.recordPhase("endgame", phases.Endgame)
+		d.emitter.emit(func(e Events) { e.DispatcherComplete(d) })
+		d.status.notify(StateChanged)
+		d.stats.Gauge("wire_efficiency").Update(d.WireEfficiency())
+		d.logUtilization()
+
+		// Notifying every peer takes a while with many peers, so it must not
+		// delay the handler which received the final piece. TearDown waits
+		// for the notifications to finish.
+		d.completeMu.Lock()
+		if !d.completeWaited {
+			d.completeNotifications.Add(1)
+			go func() {
+				defer d.completeNotifications.Done()
+				d.notifyPeersComplete()
+				d.logSeederSummaries()
+			}()
+		}
+		d.completeMu.Unlock()
+	}
+	d.pendingPiecesDoneOnce.Do(func() { close(d.pendingPiecesDone) })
+	d.becomeSeedOnly()
+}
+
+// notifyPeersComplete notifies all peers that d completed.
+func (d *Dispatcher) notifyPeersComplete() {
+	start := d.clk.Now()
+	d.peers.Range(func(k, v interface{}) bool {
+		d.notifyPeerComplete(v.(*peer))
+		return true
+	})
+	d.stats.Timer("complete_notification_time").Record(d.clk.Now().Sub(start))
+}
+
+// notifyPeerComplete notifies p that d completed, closing the connection to p if
+// p is complete too. Peers added while d completes may be notified by both
+// notifyPeersComplete and peerCompleted, so p is sent at most one notification
+// and closed at most once.
+func (d *Dispatcher) notifyPeerComplete(p *peer) {
+	if p.bitfield.Complete() {
+		// Close connections to other completed peers since those connections
+		// are now useless.
+		d.closeCompletedPeer(p)
+		return
+	}
+	if !p.notifiedComplete.CAS(false, true) {
+		return
+	}
+	d.announcer.drop(p)
+	if d.serveLatency.numUnadvertised() > 0 || d.quarantine.size() > 0 {
+		// A complete message would advertise slow and quarantined pieces as
+		// well, so only the advertised pieces are announced instead.
+		d.announceAdvertised(p)
+	} else {
+		// Notify in-progress peers that we have completed the torrent and
+		// all pieces are available, which supersedes pending announcements.
+		d.send(p, conn.NewCompleteMessage())
+	}
+}
+
+func (d *Dispatcher) logSeederSummaries() {
+	var piecesRequestedTotal int
+	summaries := make(torrentlog.SeederSummaries, 0)
+	for peerID, pstats := range d.peerStats.all() {
+		requested := pstats.getPieceRequestsSent()
+		piecesRequestedTotal += requested
+		summary := torrentlog.SeederSummary{
+			PeerID:                  peerID,
+			RequestsSent:            requested,
+			GoodPiecesReceived:      pstats.getGoodPiecesReceived(),
+			DuplicatePiecesReceived: pstats.getDuplicatePiecesReceived(),
+		}
+		summaries = append(summaries, summary)
+	}
+	if compacted, n := d.peerStats.aggregate(); n > 0 {
+		// Compacted peers are summarized under the zero peer id.
+		piecesRequestedTotal += compacted.pieceRequestsSent
+		summaries = append(summaries, torrentlog.SeederSummary{
+			RequestsSent:            compacted.pieceRequestsSent,
+			GoodPiecesReceived:      compacted.goodPiecesReceived,
+			DuplicatePiecesReceived: compacted.duplicatePiecesReceived,
+		})
+	}
+
+	// Only log if we actually requested pieces from others.
+	if piecesRequestedTotal > 0 {
+		if err := d.torrentlog.SeederSummaries(
+			d.torrent.Digest(), d.torrent.InfoHash(), summaries); err != nil {
+			d.log().Errorf("Error logging outgoing piece request summary: %s", err)
+		}
+	}
+}
+
+func (d *Dispatcher) endgame() bool {
+	remaining := d.torrent.NumPieces() - int(d.torrent.Bitfield().Count())
+	if !d.config.InEndgame(remaining) {
+		return false
+	}
+	if remaining > 0 {
+		d.phases.mark(_endgame, d.clk.Now())
+	}
+	return true
+}
+
+// Phases returns the wall-clock phases d went through so far.
+func (d *Dispatcher) Phases() Phases {
+	return d.phases.phases()
+}
+
+// recordPhase records phase as a timer metric. Skipped phases are not recorded.
+func (d *Dispatcher) recordPhase(phase string, duration time.Duration) {
+	if duration == 0 {
+		return
+	}
+	d.stats.Tagged(map[string]string{
+		"phase": phase,
+	}).Timer("dispatcher_phase").Record(duration)
+}
+
+func (d *Dispatcher) maybeRequestMorePieces(p *peer) (bool, error) {
+	return d.maybeSendPieceRequests(p, nil)
+}
+
+// maybeSendPieceRequests requests candidates from p. If candidates is nil, all
+// pieces p has which we do not are candidates.
+func (d *Dispatcher) maybeSendPieceRequests(p *peer, candidates *bitset.BitSet) (bool, error) {
+	if d.SeedOnly() {
+		return false, nil
+	}
+	if !d.probeAsymmetricPeer(p) {
+		// Do not request pieces from peers which cannot send them to us.
+		d.declinePieceRequests(declineAsymmetric)
+		return false, nil
+	}
+
+	if delay := d.ingress.delay(); delay > 0 {
+		d.deferPieceRequests(delay)
+		d.declinePieceRequests(declineIngressThrottled)
+		return false, nil
+	}
+
+	p.requestMu.Lock()
+	defer p.requestMu.Unlock()
+
+	if p.removed || d.draining.Load() || d.invalidating.Load() || d.paused.Load() {
+		return false, nil
+	}
+	if p.chokedByRemote {
+		d.declinePieceRequests(declineChoked)
+		return false, nil
+	}
+	if candidates == nil {
+		candidates = d.usefulPiecesLocked(p)
+	}
+	d.stats.Counter("piece_selection_passes").Inc(1)
+	limit := d.pipelineLimit(p)
+	if !d.config.DisableLatencyPreference {
+		d.pieceRequestManager.SetPipelineLimit(p.id, limit)
+	}
+	pieces, err := d.reservePieces(p, candidates)
+	if err != nil {
+		return false, err
+	}
+	if len(pieces) == 0 {
+		if candidates.Any() {
+			d.declinePieceRequests(declineNoReservation)
+			d.recordSelection(p, candidates, limit, nil)
+		} else {
+			d.declinePieceRequests(declineNoCandidates)
+		}
+		return false, nil
+	}
+	batch := p.messages.Supports(conn.BatchRequests)
+	var batched, requested []int
+	var requests []*conn.Message
+	var sent bool
+	for _, i := range pieces {
+		if d.torrent.HasPiece(i) {
+			// i was received after candidates were computed, so the reservation
+			// is stale.
+			d.pieceRequestManager.MarkComplete(i)
+			d.stats.Counter("stale_piece_requests").Inc(1)
+			continue
+		}
+		if batch {
+			// Requested at once below.
+			batched = append(batched, i)
+			requests = append(requests, d.pieceRequestMessages(p, i)...)
+			continue
+		}
+		if err := d.sendPieceRequest(p, i); err != nil {
+			// Connection closed.
+			d.pieceRequestManager.MarkUnsent(p.id, i)
+			d.declinePieceRequests(declineSendFailed)
+			d.recordSelection(p, candidates, limit, requested)
+			return false, err
+		}
+		d.pieceRequestSent(p, i)
+		requested = append(requested, i)
+		sent = true
+	}
+	if len(batched) > 0 {
+		if err := d.sendPieceRequestBatch(p, requests); err != nil {
+			// Connection closed.
+			for _, i := range batched {
+				d.pieceRequestManager.MarkUnsent(p.id, i)
+			}
+			d.declinePieceRequests(declineSendFailed)
+			d.recordSelection(p, candidates, limit, requested)
+			return sent, err
+		}
+		for _, i := range batched {
+			d.pieceRequestSent(p, i)
+		}
+		requested = append(requested, batched...)
+		sent = true
+	}
+	d.recordSelection(p, candidates, limit, requested)
+	if sent {
+		d.updateOutstandingRequests()
+	}
+	return sent, nil
+}
+
+// pieceRequestSent records that piece i was requested from p.
+func (d *Dispatcher) pieceRequestSent(p *peer, i int) {
+	p.touchPieceRequestSent(i)
+	d.netevents.Produce(
+		networkevent.RequestPieceEvent(
+			d.torrent.InfoHash(), d.localPeerID, p.id, i,
+			d.pieceRequestManager.Retries(i)+1).At(d.clk.Now()))
+	p.pstats.incrementPieceRequestsSent()
+	d.pieceAttempts.Increment(i)
+}
+
+// deferPieceRequests requests more pieces from all peers after delay. Only one
+// deferral is scheduled at a time.
+func (d *Dispatcher) deferPieceRequests(delay time.Duration) {
+	if !d.requestsDeferred.CAS(false, true) {
+		return
+	}
+	d.stats.Counter("deferred_piece_requests").Inc(1)
+	d.clk.AfterFunc(delay, func() {
+		d.requestsDeferred.Store(false)
+		select {
+		case <-d.pendingPiecesDone:
+			// Completed or torn down.
+			return
+		default:
+		}
+		d.requestMorePiecesFromAll()
+	})
+}
+
+// requestMorePiecesFromAll requests pieces from the fastest peers first, see
+// peersByLatency.
+func (d *Dispatcher) requestMorePiecesFromAll() {
+	for _, p := range d.peersByLatency() {
+		d.maybeRequestMorePieces(p)
+	}
+}
+
+// sendPieceRequest requests piece i from p.
+func (d *Dispatcher) sendPieceRequest(p *peer, i int) error {
+	for _, msg := range d.pieceRequestMessages(p, i) {
+		if err := d.sendBlocking(p, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pieceRequestMessages returns the messages requesting piece i from p. If
+// chunking is enabled, only chunks of i which were not received yet are
+// requested. Prioritized pieces are requested as priority requests from peers
+// which support them.
+func (d *Dispatcher) pieceRequestMessages(p *peer, i int) []*conn.Message {
+	priority := p.messages.Supports(conn.PriorityRequests) && d.pieceRequestManager.IsPrioritized(i)
+	if priority {
+		d.stats.Counter("priority_piece_requests_sent").Inc(1)
+		d.useCapability(conn.PriorityRequests)
+	}
+	n := d.numChunks(i)
+	if n == 1 {
+		return []*conn.Message{
+			wire.NewPieceRequestMessage(p.messages, i, 0, d.pieceLengths.get(i), priority),
+		}
+	}
+	var msgs []*conn.Message
+	for _, c := range d.pieceRequestManager.MissingChunks(i, n) {
+		offset, length := d.chunkRange(i, c)
+		msgs = append(msgs, wire.NewPieceRequestMessage(p.messages, i, offset, length, priority))
+	}
+	return msgs
+}
+
+// sendPieceRequestBatch sends requests to p, which supports batched requests,
+// in a single message. A lone request is sent as is.
+func (d *Dispatcher) sendPieceRequestBatch(p *peer, requests []*conn.Message) error {
+	batch, ok := wire.NewPieceRequestsMessage(p.messages, requests)
+	if !ok || len(requests) == 1 {
+		for _, msg := range requests {
+			if err := d.sendBlocking(p, msg); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := d.sendBlocking(p, batch); err != nil {
+		return err
+	}
+	d.stats.Counter("piece_request_batches").Inc(1)
+	d.stats.Counter("batched_piece_requests").Inc(int64(len(requests)))
+	d.useCapability(conn.BatchRequests)
+	return nil
+}
+
+func (d *Dispatcher) resendFailedPieceRequests() {
+	// Each check for failed requests is a piece selection round.
+	d.pieceRequestManager.NextRound()
+
+	if n := d.pieceRequestManager.ReconcileSlots(); n > 0 {
+		d.log().Errorf("Corrected %d inconsistent piece request slots", n)
+		d.stats.Counter("piece_request_slot_corrections").Inc(int64(n))
+	}
+
+	d.stats.Gauge("oldest_unrequested_piece_age").Update(
+		d.pieceRequestManager.OldestUnrequestedAge().Seconds())
+	d.updateOutstandingRequests()
+
+	// Requests to departed peers will never complete, so resend them immediately.
+	orphaned := d.pieceRequestManager.ClearUnknownPeers(func(peerID core.PeerID) bool {
+		_, ok := d.peers.Load(peerID)
+		return ok
+	})
+	if len(orphaned) > 0 {
+		d.log().Infof("Cleared %d piece requests to departed peers", len(orphaned))
+	}
+
+	// Requests of removed peers did not fail, so they are resent as is.
+	if removed := d.takeRemovedRequests(); len(removed) > 0 {
+		d.log().Infof("Resending %d piece requests of removed peers", len(removed))
+		d.resendPieceRequests(removed)
+	}
+
+	failedRequests := append(d.pieceRequestManager.GetFailedRequests(), orphaned...)
+	if len(failedRequests) > 0 {
+		d.log().Infof("Resending %d failed piece requests", len(failedRequests))
+	}
+
+	var failures, firstFailures, retriedFailures, rejections int64
+	for _, r := range failedRequests {
+		if r.Status == piecerequest.StatusRejected {
+			// Transient rejections do not count against the peer.
+			rejections++
+			continue
+		}
+		failures++
+		if r.Retries == 0 {
+			firstFailures++
+		} else {
+			retriedFailures++
+		}
+		if r.Status == piecerequest.StatusExpired {
+			if d.config.PieceRequestEvents {
+				d.netevents.Produce(networkevent.RequestExpiredEvent(
+					d.torrent.InfoHash(), d.localPeerID, r.PeerID, r.Piece, r.Retries+1).At(d.clk.Now()))
+			}
+			d.recordExpiredRequest(r)
+			d.pieceRequestManager.RecordPieceFailed(r.PeerID, r.Piece)
+			if v, ok := d.peers.Load(r.PeerID); ok {
+				// The request took at least until now.
+				if rtt, ok := v.(*peer).samplePieceRTT(r.Piece); ok {
+					d.samplePieceRequestLatency(rtt)
+				}
+			}
+			// The piece is requested elsewhere, so the peer need not serve it.
+			d.cancelPieceRequest(r.PeerID, r.Piece)
+		}
+	}
+	if failures > 0 {
+		d.stats.Counter("piece_request_failures").Inc(failures)
+	}
+	if firstFailures > 0 {
+		d.stats.Counter("piece_request_first_failures").Inc(firstFailures)
+	}
+	if retriedFailures > 0 {
+		d.stats.Counter("piece_request_retried_failures").Inc(retriedFailures)
+	}
+	if rejections > 0 {
+		d.stats.Counter("piece_request_rejections").Inc(rejections)
+	}
+
+	d.resendPieceRequests(failedRequests)
+}
+
+// resendPieceRequests sends the pieces of requests, which failed or are about to,
+// to the fastest peers which have them.
+func (d *Dispatcher) resendPieceRequests(requests []piecerequest.Request) {
+	var sent, stale, capped int
+	var peers []*peer
+	if len(requests) > 0 {
+		// Rank peers once per pass rather than once per request.
+		peers = d.peersByLatency()
+	}
+	for _, r := range requests {
+		if d.torrent.HasPiece(r.Piece) {
+			// r was received from another peer since it failed.
+			stale++
+			d.recordResend(r, core.PeerID{}, _resendStale)
+			continue
+		}
+		var target core.PeerID
+		for _, p := range peers {
+			if (r.Status == piecerequest.StatusExpired ||
+				r.Status == piecerequest.StatusInvalid ||
+				r.Status == piecerequest.StatusRejected) && r.PeerID == p.id {
+				// Do not resend to the same peer for expired, invalid or
+				// rejected requests.
+				continue
+			}
+			if !d.pieceRequestManager.HasReservationRoom(p.id) {
+				// Do not pile failed requests onto peers which are already
+				// sitting on as many requests as they may.
+				capped++
+				continue
+			}
+
+			b := d.torrent.Bitfield()
+			candidates := d.peerPiecesIn(p, b.Complement())
+			if candidates.Test(uint(r.Piece)) {
+				nb := bitset.New(b.Len()).Set(uint(r.Piece))
+				if ok, err := d.maybeSendPieceRequests(p, nb); ok && err == nil {
+					sent++
+					target = p.id
+					break
+				}
+			}
+		}
+		if target == (core.PeerID{}) {
+			d.recordResend(r, target, _resendNowhere)
+		} else {
+			d.recordResend(r, target, _resendSent)
+		}
+	}
+
+	if stale > 0 {
+		d.stats.Counter("stale_piece_resends").Inc(int64(stale))
+	}
+	if capped > 0 {
+		d.stats.Counter("capped_piece_resend_peers").Inc(int64(capped))
+	}
+
+	unsent := len(requests) - sent - stale
+	if unsent > 0 {
+		d.log().Infof("Nowhere to resend %d / %d failed piece requests", unsent, len(requests))
+	}
+}
+
+// markPieceRequestInvalid marks the request for piece i to peerID as invalid,
+// such that i is requested elsewhere.
+func (d *Dispatcher) markPieceRequestInvalid(peerID core.PeerID, i int) {
+	if d.config.PieceRequestEvents {
+		d.netevents.Produce(networkevent.RequestInvalidEvent(
+			d.torrent.InfoHash(), d.localPeerID, peerID, i,
+			d.pieceRequestManager.Retries(i)+1).At(d.clk.Now()))
+	}
+	d.pieceRequestManager.MarkInvalid(peerID, i)
+}
+
+// recordExpiredRequest detects asymmetric peers, i.e. peers which we have served
+// pieces to but whose piece requests from us always expire.
+func (d *Dispatcher) recordExpiredRequest(r piecerequest.Request) {
+	if !d.config.EnableAsymmetricPeerDetection {
+		return
+	}
+	v, ok := d.peers.Load(r.PeerID)
+	if !ok {
+		return
+	}
+	p := v.(*peer)
+	expired := p.recordExpiredRequest()
+	if expired < d.config.AsymmetricPeerMinExpiredRequests ||
+		p.pstats.getPiecesSent() < d.config.AsymmetricPeerMinPiecesSent {
+		return
+	}
+	if p.setAsymmetric(true) {
+		d.log("peer", p).Infof(
+			"Excluding asymmetric peer from piece selection after %d expired requests", expired)
+		d.updateAsymmetricPeers(1)
+	}
+}
+
+// probeAsymmetricPeer returns whether pieces may be requested from p. Pieces are
+// requested from asymmetric peers once they were excluded from piece selection
+// for Config.AsymmetricPeerProbeInterval. Since the expired requests of p are
+// only reset by a good piece, a single expired probe excludes p again.
+func (d *Dispatcher) probeAsymmetricPeer(p *peer) bool {
+	since, ok := p.getAsymmetricSince()
+	if !ok {
+		return true
+	}
+	if d.clk.Now().Sub(since) < d.config.AsymmetricPeerProbeInterval {
+		return false
+	}
+	if p.setAsymmetric(false) {
+		d.log("peer", p).Info("Probing asymmetric peer")
+		d.stats.Counter("asymmetric_peer_probes").Inc(1)
+		d.updateAsymmetricPeers(-1)
+	}
+	return true
+}
+
+func (d *Dispatcher) updateAsymmetricPeers(delta int32) {
+	n := d.numAsymmetricPeers.Add(delta)
+	d.stats.Gauge("asymmetric_peers").Update(float64(n))
+}
+
+// checkUnavailablePieces emits PiecesUnavailable for missing pieces which no
+// peer has been able to send us for longer than the configured timeout.
+// Asymmetric peers are not considered sources, since pieces are never
+// requested from them.
+func (d *Dispatcher) checkUnavailablePieces() {
+	if d.config.PieceUnavailableTimeout == 0 {
+		return
+	}
+	missing := d.torrent.Bitfield().Complement()
+	available := bitset.New(missing.Len())
+	d.peers.Range(func(k, v interface{}) bool {
+		p := v.(*peer)
+		if !p.isAsymmetric() {
+			available.InPlaceUnion(d.peerPiecesIn(p, missing))
+		}
+		return true
+	})
+	var unavailable []int
+	for i, ok := missing.NextSet(0); ok; i, ok = missing.NextSet(i + 1) {
+		if !available.Test(i) {
+			unavailable = append(unavailable, int(i))
+		}
+	}
+	d.stats.Gauge("unavailable_pieces").Update(float64(len(unavailable)))
+
+	pieces := d.unavailablePieces.update(unavailable, d.clk.Now())
+	if len(pieces) == 0 {
+		return
+	}
+	d.log().Infof("No peer can send %d pieces, notifying pieces unavailable", len(pieces))
+	d.stats.Counter("pieces_unavailable").Inc(int64(len(pieces)))
+	h := d.torrent.InfoHash()
+	d.emitter.emit(func(e Events) { e.PiecesUnavailable(h, pieces) })
+}
+
+func (d *Dispatcher) watchPendingPieceRequests() {
+	for {
+		select {
+		case <-d.clk.After(d.currentPieceRequestTimeout() / 2):
+			d.checkPendingPieceRequests()
+		case kickedAt := <-d.kicks:
+			d.kick(kickedAt)
+		case <-d.pendingPiecesDone:
+			return
+		}
+	}
+}
+
+// checkPendingPieceRequests runs a tick of the pending piece requests of d.
+func (d *Dispatcher) checkPendingPieceRequests() {
+	d.resendFailedPieceRequests()
+	d.checkUnavailablePieces()
+	d.checkStalled()
+	d.sampleUtilization()
+	d.updateRequestStats()
+}
+
+// feed reads off of peer and handles incoming messages. When peer's messages close,
+// the feed goroutine removes peer from the Dispatcher and exits.
+func (d *Dispatcher) feed(p *peer) {
+	for msg := range p.messages.Receiver() {
+		if err := d.dispatch(p, msg); err != nil {
+			d.handlerFailed(p, msg.Message.Type, err)
+		}
+	}
+	if err := d.removePeer(p); err != nil {
+		// Already removed via RemovePeer.
+		return
+	}
+	h := d.torrent.InfoHash()
+	d.emitter.emit(func(e Events) { e.PeerRemoved(p.id, h) })
+}
+
+// dispatch handles msg received from p. Returns a *HandlerError if the handler of
+// msg failed.
 func (d *Dispatcher) dispatch(p *peer, msg *conn.Message) error {
+	p.touchLastMessageReceived()
+
+	// Messages are read through wire, such that fields of extensions which were
+	// not negotiated with p are never read.
 	switch msg.Message.Type {
 	case p2p.Message_ERROR:
-		d.handleError(p, msg.Message.Error)
+		e, ok := wire.Error(msg.Message)
+		if !ok {
+			return d.unreadableMessage(p, msg)
+		}
+		d.handleError(p, e)
 	case p2p.Message_ANNOUCE_PIECE:
-		d.handleAnnouncePiece(p, msg.Message.AnnouncePiece)
+		i, ok := wire.AnnouncePiece(msg.Message)
+		if !ok {
+			return d.unreadableMessage(p, msg)
+		}
+		return d.handleAnnouncePiece(p, i)
 	case p2p.Message_PIECE_REQUEST:
-		d.handlePieceRequest(p, msg.Message.PieceRequest)
+		r, ok := wire.PieceRequest(p.messages, msg.Message)
+		if !ok {
+			return d.unreadableMessage(p, msg)
+		}
+		d.handlePieceRequest(p, r)
+	case p2p.Message_PIECE_REQUESTS:
+		requests, ok := wire.PieceRequests(p.messages, msg.Message)
+		if !ok {
+			return d.unreadableMessage(p, msg)
+		}
+		return d.handlePieceRequests(p, requests)
 	case p2p.Message_PIECE_PAYLOAD:
-		d.handlePiecePayload(p, msg.Message.PiecePayload, msg.Payload)
+		pm, ok := wire.PiecePayload(msg.Message)
+		if !ok {
+			return d.unreadableMessage(p, msg)
+		}
+		if d.readOnly {
+			return d.rejectReadOnlyPayload(p, msg)
+		}
+		if d.SeedOnly() {
+			d.discardSeedOnlyPayload(p, pm, msg.Payload)
+			return nil
+		}
+		if d.invalidating.Load() {
+			d.discardInvalidatingPayload(msg)
+			return nil
+		}
+		d.inflight.begin()
+		defer d.inflight.end()
+		if msg.DigestMismatch {
+			return d.handlePieceDigestMismatch(p, pm)
+		}
+		return d.handlePiecePayload(p, pm, msg.Payload)
 	case p2p.Message_CANCEL_PIECE:
-		d.handleCancelPiece(p, msg.Message.CancelPiece)
+		i, ok := wire.CancelPiece(msg.Message)
+		if !ok {
+			return d.unreadableMessage(p, msg)
+		}
+		d.handleCancelPiece(p, i)
+	case p2p.Message_ANNOUNCE_PIECES:
+		b, ok := wire.AnnouncePieces(p.messages, msg.Message)
+		if !ok {
+			return d.unreadableMessage(p, msg)
+		}
+		return d.handleAnnouncePieces(p, b)
 	case p2p.Message_BITFIELD:
-		d.handleBitfield(p, msg.Message.Bitfield)
+		d.protocolViolation(p)
+		return protocolViolationError(errRepeatedBitfieldMessage)
 	case p2p.Message_COMPLETE:
 		d.handleComplete(p)
+	case p2p.Message_CHOKE:
+		d.handleChoke(p)
+	case p2p.Message_UNCHOKE:
+		d.handleUnchoke(p)
+	case p2p.Message_KEEPALIVE:
+		d.handleKeepalive(p)
+	case p2p.Message_KEEPALIVE_ACK:
+		// Any message proves that p is alive.
+	default:
+		d.protocolViolation(p)
+		return protocolViolationError(unknownMessageTypeError{msg.Message.Type})
+	}
+	return nil
+}
+
+// unreadableMessage discards msg, which p sent without its body or although the
+// extension it belongs to was not negotiated.
+func (d *Dispatcher) unreadableMessage(p *peer, msg *conn.Message) error {
+	if msg.Payload != nil {
+		msg.Payload.Close()
+	}
+	d.protocolViolation(p)
+	return protocolViolationError(unreadableMessageError{msg.Message.Type})
+}
+
+func (d *Dispatcher) handleError(p *peer, msg *p2p.ErrorMessage) {
+	if d.SeedOnly() {
+		// We request no pieces which could fail.
+		return
+	}
+	if i := int(msg.Index); i < 0 || i >= d.torrent.NumPieces() {
+		d.log("peer", p).Debugf("Ignoring error for invalid piece %d: %s", i, msg.Error)
+		return
+	}
+	switch msg.Code {
+	case p2p.ErrorMessage_PIECE_REQUEST_FAILED:
+		d.log("peer", p).Errorf("Piece request failed: %s", msg.Error)
+		d.markPieceRequestInvalid(p.id, int(msg.Index))
+	case p2p.ErrorMessage_PIECE_REQUEST_RETRY:
+		d.log("peer", p).Debugf("Piece request rejected: %s", msg.Error)
+		retryAfter, ok := wire.RetryAfter(p.messages, msg)
+		if !ok {
+			d.pieceRequestManager.MarkRejected(p.id, int(msg.Index))
+			return
+		}
+		if retryAfter > d.config.MaxRetryAfter {
+			retryAfter = d.config.MaxRetryAfter
+		}
+		if !d.pieceRequestManager.MarkRejectedFor(p.id, int(msg.Index), retryAfter) {
+			// Unsolicited hints are dropped, so they cannot accumulate state.
+			return
+		}
+		d.stats.Counter("piece_request_retry_hints").Inc(1)
+		d.useCapability(conn.RetryAfter)
+		d.deferRetry(p, retryAfter)
+	}
+}
+
+// rejectPieceRequest rejects the request of p for piece i transiently, hinting
+// that p may request i again after retryAfter if p supports conn.RetryAfter.
+// Zero retryAfter sends no hint.
+func (d *Dispatcher) rejectPieceRequest(p *peer, i int, err error, retryAfter time.Duration) {
+	if retryAfter > 0 && p.messages.Supports(conn.RetryAfter) {
+		d.useCapability(conn.RetryAfter)
+	}
+	d.send(p, wire.NewRetryErrorMessage(p.messages, i, err, retryAfter))
+}
+
+// deferRetry requests pieces from p again once retryAfter elapsed, since pieces
+// which p rejected with a retry hint are withheld from p until then. At most one
+// retry is scheduled per peer at a time.
+func (d *Dispatcher) deferRetry(p *peer, retryAfter time.Duration) {
+	if p.deferRetry(d.clk.Now().Add(retryAfter)) {
+		d.clk.AfterFunc(retryAfter, func() { d.retry(p) })
+	}
+}
+
+func (d *Dispatcher) retry(p *peer) {
+	if delay := p.retryDelay(); delay > 0 {
+		d.clk.AfterFunc(delay, func() { d.retry(p) })
+		return
+	}
+	select {
+	case <-d.tornDown:
+		return
 	default:
-		return fmt.Errorf("unknown message type: %d", msg.Message.Type)
+	}
+	if v, ok := d.peers.Load(p.id); !ok || v.(*peer) != p {
+		// Peer was removed meanwhile.
+		return
+	}
+	d.maybeRequestMorePieces(p)
+}
+
+func (d *Dispatcher) handleAnnouncePiece(p *peer, i int) error {
+	if err := d.peerHasPiece(p, i, _completedByAnnounce); err != nil {
+		d.protocolViolation(p)
+		return protocolViolationError(fmt.Errorf("announce piece: %s", err))
+	}
+	if d.superseed != nil && d.superseed.announced(p.id, i) {
+		d.superseedReveal(p)
+	}
+
+	if d.coalescer != nil && !d.SeedOnly() && d.coalescer.add(p, i) {
+		// Requested once the coalescing window elapses.
+		return nil
+	}
+	d.maybeRequestMorePieces(p)
+	return nil
+}
+
+// superseedReveal announces the next superseed pieces to p. Pieces which p has
+// or which are not advertised are skipped.
+func (d *Dispatcher) superseedReveal(p *peer) {
+	pieces := d.superseed.reveal(p.id, func(i int) bool {
+		return p.bitfield.Has(uint(i)) || !d.advertised(i)
+	})
+	for _, i := range pieces {
+		d.send(p, conn.NewAnnouncePieceMessage(i))
+	}
+	d.stats.Counter("superseed_revealed_pieces").Inc(int64(len(pieces)))
+}
+
+func (d *Dispatcher) isFullPiece(i int, offset, length int64) bool {
+	return offset == 0 && length == d.pieceLengths.get(i)
+}
+
+// handlePieceRequests handles a batch of piece requests, each of which is served
+// or fails like a single request, such that one bad request fails only its own
+// piece.
+func (d *Dispatcher) handlePieceRequests(p *peer, requests []*p2p.PieceRequestMessage) error {
+	d.stats.Counter("piece_request_batches_received").Inc(1)
+	var malformed int
+	for _, r := range requests {
+		r, ok := wire.Request(p.messages, r)
+		if !ok {
+			malformed++
+			continue
+		}
+		d.handlePieceRequest(p, r)
+	}
+	if malformed > 0 {
+		d.protocolViolation(p)
+		return protocolViolationError(fmt.Errorf(
+			"%d of %d batched piece requests are empty", malformed, len(requests)))
 	}
 	return nil
 }
 
-func (d *Dispatcher) handleError(p *peer, msg *p2p.ErrorMessage) {
-	switch msg.Code {
-	case p2p.ErrorMessage_PIECE_REQUEST_FAILED:
-		d.log().Errorf("Piece request failed: %s", msg.Error)
-		d.pieceRequestManager.MarkInvalid(p.id, int(msg.Index))
+func (d *Dispatcher) handlePieceRequest(p *peer, msg *p2p.PieceRequestMessage) {
+	p.pstats.incrementPieceRequestsReceived()
+
+	if msg.Priority {
+		// Read through wire, so only set if negotiated.
+		d.stats.Counter("priority_piece_requests_received").Inc(1)
+	}
+
+	if d.draining.Load() {
+		// The peer requests the piece elsewhere.
+		d.stats.Counter("rejected_draining_piece_requests").Inc(1)
+		d.rejectPieceRequest(p, int(msg.Index), errDraining, 0)
+		return
+	}
+
+	if d.invalidating.Load() {
+		// The peer requests the piece elsewhere.
+		d.stats.Counter("rejected_invalidating_piece_requests").Inc(1)
+		d.rejectPieceRequest(p, int(msg.Index), errTorrentInvalidated, 0)
+		return
+	}
+
+	if d.config.RejectPieceRequestsWhilePaused && d.paused.Load() {
+		// The peer requests the piece elsewhere.
+		d.stats.Counter("rejected_paused_piece_requests").Inc(1)
+		d.rejectPieceRequest(p, int(msg.Index), errPaused, 0)
+		return
 	}
-}
 
-func (d *Dispatcher) handleAnnouncePiece(p *peer, msg *p2p.AnnouncePieceMessage) {
-	if int(msg.Index) >= d.torrent.NumPieces() {
-		d.log().Errorf("Announce piece out of bounds: %d >= %d", msg.Index, d.torrent.NumPieces())
+	if p.serves.isChoked() {
+		d.stats.Counter("choked_piece_requests").Inc(1)
+		if p.messages.Supports(conn.Choke) || p.serves.len() >= d.config.MaxChokedRequests {
+			// The peer requests the piece elsewhere. Requests of peers which
+			// were notified of the choke are never held.
+			d.stats.Counter("rejected_choked_piece_requests").Inc(1)
+			d.rejectPieceRequest(p, int(msg.Index), errPeerChoked, d.config.ChokeInterval)
+			return
+		}
+	} else if p.serves.len() >= d.config.MaxQueuedServes {
+		d.stats.Counter("rejected_queued_piece_requests").Inc(1)
+		// The queue drains in about as long as serving its requests takes.
+		d.rejectPieceRequest(
+			p, int(msg.Index), errServeQueueFull, time.Duration(p.serves.len())*p.getServeTime())
 		return
 	}
+
+	// Serve asynchronously such that cancels received while the request is
+	// queued or being read from disk abort the serve.
+	if p.serves.push(msg) {
+		d.startServe(p)
+	}
+}
+
+// serve serves queued piece requests of p until its queue is empty.
+func (d *Dispatcher) serve(p *peer) {
+	for {
+		msg, ok := p.serves.next()
+		if !ok {
+			return
+		}
+		if err := d.servePiece(p, msg); err != nil {
+			d.handlerFailed(p, p2p.Message_PIECE_REQUEST, err)
+		}
+	}
+}
+
+// servePiece serves the piece request msg of p. Returns a *HandlerError if the
+// request failed, in which case p was sent an error.
+func (d *Dispatcher) servePiece(p *peer, msg *p2p.PieceRequestMessage) error {
 	i := int(msg.Index)
-	p.bitfield.Set(uint(i), true)
-	d.numPeersByPiece.Increment(int(i))
+	offset, length := int64(msg.Offset), int64(msg.Length)
+	if !d.validRange(i, offset, length) {
+		d.serveFailed(p, i, errInvalidChunk)
+		return validationError(fmt.Errorf(
+			"piece request: invalid range piece=%d offset=%d length=%d", i, offset, length))
+	}
 
-	d.maybeRequestMorePieces(p)
+	if d.quarantine.has(i) {
+		// Permanent until i is released, so the peer requests i elsewhere.
+		d.stats.Counter("rejected_quarantined_piece_requests").Inc(1)
+		d.sendServeError(p, i, errPieceQuarantined)
+		return nil
+	}
+
+	if !d.admitServe(p, msg) {
+		return nil
+	}
+
+	if offset == 0 {
+		if err := d.sampleServeVerification(i); err != nil {
+			d.suspectPiece(i, err)
+			d.serveFailed(p, i, storage.ErrPieceDigestMismatch)
+			return storageReadError(fmt.Errorf("sampled serve verification of piece %d: %s", i, err))
+		}
+	}
+
+	if d.egress != nil && !d.egress.wait(p, i, length, msg.Priority) {
+		d.stats.Counter("egress_rejected_serves").Inc(1)
+		d.rejectPieceRequest(p, i, errEgressQueueFull, d.egress.retryAfter())
+		return nil
+	}
+
+	start := d.clk.Now()
+
+	payload, err := d.getServeReader(p, i)
+	if err == errTorrentInvalidated {
+		// The request was accepted just before invalidation, so the peer
+		// requests the piece elsewhere.
+		d.stats.Counter("rejected_invalidating_piece_requests").Inc(1)
+		d.rejectPieceRequest(p, i, errTorrentInvalidated, 0)
+		return nil
+	}
+	if err != nil {
+		d.suspectPiece(i, err)
+		d.serveFailed(p, i, err)
+		return storageReadError(fmt.Errorf("get reader for piece %d: %s", i, err))
+	}
+
+	if !d.isFullPiece(i, offset, length) {
+		payload, err = newChunkReader(payload, offset, length)
+		if err != nil {
+			d.serveFailed(p, i, err)
+			return storageReadError(fmt.Errorf("read chunk of piece %d: %s", i, err))
+		}
+	}
+
+	if p.serves.currentCancelled() {
+		payload.Close()
+		d.stats.Counter("cancelled_serves").Inc(1)
+		return nil
+	}
+
+	pm, err := d.newPayloadMessage(p, i, offset, payload)
+	if err != nil {
+		d.serveFailed(p, i, err)
+		return internalError(fmt.Errorf("compress piece %d: %s", i, err))
+	}
+	if err := d.sendBlocking(p, pm); err != nil {
+		return nil
+	}
+	p.recordServeSuccess()
+
+	d.recordServeLatency(p, i, d.clk.Now().Sub(start))
+	p.sampleServeTime(d.clk.Now().Sub(start))
+
+	p.touchLastPieceSent()
+	p.addBytesUploaded(length)
+	p.pstats.addBytesUploaded(length)
+	d.bytesUploaded.Add(length)
+	d.interfaceStats(p).Counter("uploaded_piece_bytes").Inc(length)
+	if d.egress != nil {
+		d.stats.Gauge("egress_utilization").Update(d.egress.sentBytes(length))
+	}
+
+	if offset+length == d.pieceLengths.get(i) {
+		// Only count the final chunk of a piece as a sent piece.
+		p.pstats.incrementPiecesSent()
+
+		// Assume that the peer successfully received the piece.
+		d.peerHasPiece(p, i, "")
+
+		if d.prefetch != nil {
+			d.prefetchAfterServe(p, i)
+		}
+	}
+	return nil
 }
 
-func (d *Dispatcher) isFullPiece(i, offset, length int) bool {
-	return offset == 0 && length == int(d.torrent.PieceLength(i))
+// sampleServeVerification reads back and verifies piece i before it is served,
+// once every Config.ServeVerifyInterval serves. Returns an error if piece i
+// failed verification, in which case storage is corrupt and i must not be served.
+func (d *Dispatcher) sampleServeVerification(i int) error {
+	if d.config.ServeVerifyInterval == 0 ||
+		d.numFullServes.Inc()%int64(d.config.ServeVerifyInterval) != 0 {
+		return nil
+	}
+	pr, err := d.torrent.GetPieceReader(i)
+	if err != nil {
+		// Serving fails regardless.
+		return nil
+	}
+	defer pr.Close()
+	d.stats.Counter("verified_serves").Inc(1)
+	if err := storage.VerifyPieceReader(d.verifier, i, pr); err != nil {
+		d.stats.Counter("corrupt_served_pieces").Inc(1)
+		return err
+	}
+	return nil
 }
 
-func (d *Dispatcher) handlePieceRequest(p *peer, msg *p2p.PieceRequestMessage) {
-	p.pstats.incrementPieceRequestsReceived()
+// getServeReader returns a reader for piece i requested by p, which is read
+// from memory if i was prefetched for p.
+func (d *Dispatcher) getServeReader(p *peer, i int) (storage.PieceReader, error) {
+	if d.prefetch != nil {
+		b, wasted := d.prefetch.take(p.id, i)
+		if b != nil {
+			d.stats.Counter("serve_prefetch_hits").Inc(1)
+			return piecereader.NewBuffer(b), nil
+		}
+		if wasted {
+			// Still being read, so it is cheaper to read i again.
+			d.countWastedPrefetches(1)
+		}
+	}
+	return d.torrent.GetPieceReader(i)
+}
 
-	i := int(msg.Index)
-	if !d.isFullPiece(i, int(msg.Offset), int(msg.Length)) {
-		d.log("peer", p, "piece", i).Error("Rejecting piece request: chunk not supported")
-		p.messages.Send(conn.NewErrorMessage(i, p2p.ErrorMessage_PIECE_REQUEST_FAILED, errChunkNotSupported))
+// prefetchAfterServe prefetches the pieces p is likely to request after piece i
+// was served to it.
+func (d *Dispatcher) prefetchAfterServe(p *peer, i int) {
+	if d.invalidating.Load() {
 		return
 	}
+	pieces, wasted := d.prefetch.served(p.id, i, d.clk.Now(), func(j int) (int64, bool) {
+		if j >= d.torrent.NumPieces() || !d.torrent.HasPiece(j) || p.bitfield.Has(uint(j)) {
+			return 0, false
+		}
+		return d.pieceLengths.get(j), true
+	})
+	d.countWastedPrefetches(wasted)
+	if len(pieces) == 0 {
+		return
+	}
+	d.stats.Counter("serve_prefetches").Inc(int64(len(pieces)))
+	go func() {
+		for _, j := range pieces {
+			b, err := d.readPiece(j)
+			if err != nil {
+				d.log("peer", p, "piece", j).Errorf("Error prefetching piece: %s", err)
+				d.prefetch.drop(p.id, j)
+				continue
+			}
+			d.prefetch.loaded(p.id, j, b)
+		}
+	}()
+}
 
-	payload, err := d.torrent.GetPieceReader(i)
+func (d *Dispatcher) readPiece(i int) ([]byte, error) {
+	pr, err := d.torrent.GetPieceReader(i)
 	if err != nil {
-		d.log("peer", p, "piece", i).Errorf("Error getting reader for requested piece: %s", err)
-		p.messages.Send(conn.NewErrorMessage(i, p2p.ErrorMessage_PIECE_REQUEST_FAILED, err))
+		return nil, err
+	}
+	defer pr.Close()
+	return ioutil.ReadAll(pr)
+}
+
+func (d *Dispatcher) countWastedPrefetches(n int) {
+	if n > 0 {
+		d.stats.Counter("serve_prefetch_wasted").Inc(int64(n))
+	}
+}
+
+// admitServe consults the configured LoadAdmission, returning true if the piece
+// request may be served now. Deferred requests are served asynchronously.
+func (d *Dispatcher) admitServe(p *peer, msg *p2p.PieceRequestMessage) bool {
+	if d.config.LoadAdmission == nil {
+		return true
+	}
+	i := int(msg.Index)
+	decision := d.config.LoadAdmission.AdmitServe(i, d.pieceLengths.get(i))
+	if decision == AdmissionDefer && !d.deferServe(p, msg) {
+		decision = AdmissionReject
+	}
+	d.stats.Tagged(map[string]string{
+		"decision": decision.String(),
+	}).Counter("serve_admissions").Inc(1)
+
+	switch decision {
+	case AdmissionDefer:
+		return false
+	case AdmissionReject:
+		d.rejectPieceRequest(p, i, errServeRejected, d.config.ServeDeferInterval)
+		return false
+	default:
+		return true
+	}
+}
+
+// deferServe retries serving msg after ServeDeferInterval. Returns false if too
+// many serves are already deferred.
+func (d *Dispatcher) deferServe(p *peer, msg *p2p.PieceRequestMessage) bool {
+	if int(d.numDeferredServes.Inc()) > d.config.MaxDeferredServes {
+		d.numDeferredServes.Dec()
+		return false
+	}
+	d.clk.AfterFunc(d.config.ServeDeferInterval, func() {
+		d.numDeferredServes.Dec()
+		if v, ok := d.peers.Load(p.id); !ok || v.(*peer) != p {
+			// Peer was removed while the serve was deferred.
+			return
+		}
+		if p.serves.push(msg) {
+			d.startServe(p)
+		}
+	})
+	return true
+}
+
+func (d *Dispatcher) recordServeLatency(p *peer, i int, t time.Duration) {
+	d.interfaceStats(p).Histogram("piece_serve_latency", _serveLatencyBuckets).RecordDuration(t)
+	switch d.serveLatency.record(i, t) {
+	case pieceUnadvertised:
+		d.log("piece", i).Warnf("No longer advertising piece after repeated slow serves")
+		d.stats.Counter("unadvertised_slow_pieces").Inc(1)
+		d.clk.AfterFunc(d.config.SlowServeRecoveryInterval, func() {
+			if d.serveLatency.readvertise(i) {
+				d.log("piece", i).Info("Advertising slow piece again after recovery interval")
+				d.stats.Counter("readvertised_slow_pieces").Inc(1)
+				d.announceToAll(i)
+			}
+		})
+	case pieceRecovered:
+		d.log("piece", i).Info("Advertising slow piece again after fast serve")
+		d.stats.Counter("readvertised_slow_pieces").Inc(1)
+		d.announceToAll(i)
+	}
+}
+
+// announceToAll announces piece i, which is advertised again after it recovered
+// from slow serves or was released from quarantine, to all peers which do not
+// have it. Unlike regular announcements, i is announced even if the torrent is
+// complete, since i was excluded from the bitfields sent to peers meanwhile.
+// No-op if i is still not advertised for the other reason.
+func (d *Dispatcher) announceToAll(i int) {
+	if !d.advertised(i) {
 		return
 	}
+	select {
+	case <-d.tornDown:
+		return
+	default:
+	}
+	d.peers.Range(func(k, v interface{}) bool {
+		p := v.(*peer)
+		if !p.bitfield.Has(uint(i)) {
+			d.send(p, conn.NewAnnouncePieceMessage(i))
+		}
+		return true
+	})
+}
 
-	if err := p.messages.Send(conn.NewPiecePayloadMessage(i, payload)); err != nil {
+// announceAdvertised announces all advertised pieces which p does not have to
+// p, in a single message if p supports conn.AnnouncePieces.
+func (d *Dispatcher) announceAdvertised(p *peer) {
+	b := d.Stat().Bitfield().Difference(p.bitfield.Copy())
+	if b.None() {
+		return
+	}
+	if p.messages.Supports(conn.AnnouncePieces) {
+		msg, err := conn.NewAnnouncePiecesMessage(b)
+		if err != nil {
+			d.log("peer", p).Errorf("Error creating announce pieces message: %s", err)
+			return
+		}
+		d.send(p, msg)
+		d.useCapability(conn.AnnouncePieces)
 		return
 	}
+	for i, ok := b.NextSet(0); ok; i, ok = b.NextSet(i + 1) {
+		d.send(p, conn.NewAnnouncePieceMessage(int(i)))
+	}
+}
 
-	p.touchLastPieceSent()
-	p.pstats.incrementPiecesSent()
+// UnadvertisedPieces returns the pieces which d no longer advertises due to
+// repeated slow serves, in ascending order. Unadvertised pieces are still
+// served to peers which request them.
+func (d *Dispatcher) UnadvertisedPieces() []int {
+	return d.serveLatency.getUnadvertised()
+}
 
-	// Assume that the peer successfully received the piece.
-	p.bitfield.Set(uint(i), true)
+// rejectReadOnlyPayload discards a piece payload p sent although d is read-only,
+// i.e. never requested a piece from p.
+func (d *Dispatcher) rejectReadOnlyPayload(p *peer, msg *conn.Message) error {
+	if msg.Payload != nil {
+		msg.Payload.Close()
+	}
+	d.protocolViolation(p)
+	return protocolViolationError(errReadOnlyPayload)
 }
 
 func (d *Dispatcher) handlePiecePayload(
-	p *peer, msg *p2p.PiecePayloadMessage, payload storage.PieceReader) {
+	p *peer, msg *p2p.PiecePayloadMessage, payload storage.PieceReader) error {
+
+	// Ingress is limited by the bytes received over the wire, which are less
+	// than the piece bytes if the payload is compressed.
+	d.ingress.received(int64(payload.Length()))
+	payload, err := d.decompressPayload(p, msg, payload)
+	if err != nil {
+		return err
+	}
 
-	defer payload.Close()
+	p.addBytesDownloaded(int64(payload.Length()))
+	p.pstats.addBytesDownloaded(int64(payload.Length()))
+	d.bytesDownloaded.Add(int64(payload.Length()))
+	d.interfaceStats(p).Counter("downloaded_piece_bytes").Inc(int64(payload.Length()))
 
 	i := int(msg.Index)
-	if !d.isFullPiece(i, int(msg.Offset), int(msg.Length)) {
-		d.log("peer", p, "piece", i).Error("Rejecting piece payload: chunk not supported")
-		d.pieceRequestManager.MarkInvalid(p.id, i)
-		return
+	if d.crossedPayload(p, i) {
+		// The data is accepted nonetheless, since it is verified once written.
+		d.crossedPayloadReceived(p, i)
+	}
+	p.samplePieceRTT(i)
+	offset, length, ok := wire.Chunk(msg)
+	if !ok || !d.isFullPiece(i, offset, length) {
+		// Malformed ranges fail as invalid chunks.
+		defer payload.Close()
+		return d.handleChunkPayload(p, i, offset, length, payload)
 	}
 
-	if err := d.torrent.WritePiece(payload, i); err != nil {
-		if err != storage.ErrPieceComplete {
-			d.log("peer", p, "piece", i).Errorf("Error writing piece payload: %s", err)
-			d.pieceRequestManager.MarkInvalid(p.id, i)
-		} else {
-			p.pstats.incrementDuplicatePiecesReceived()
+	// Partially received bytes are dropped once the piece is either written or
+	// failed to write.
+	r := d.partialPieces.track(i, payload)
+	n := int64(payload.Length())
+	return d.writeReceivedPiece(p, i, func() error {
+		defer payload.Close()
+
+		err := d.writePiece(r, i)
+		r.release()
+		if err != nil {
+			if err == storage.ErrPieceComplete || err == storage.ErrPieceWriteConflict {
+				// Another peer delivered i first, which is no fault of p.
+				d.duplicatePieceReceived(p, i, n)
+				return nil
+			}
+			d.markPieceRequestInvalid(p.id, i)
+			d.invalidPieceReceived(p)
+			d.pieceCorrupted()
+			return pieceWriteError(i, err)
 		}
-		return
+
+		d.recordPieceReceived(p, i)
+		d.pieceWritten(p, i)
+		return nil
+	}, func(inFlight bool) {
+		r.release()
+		payload.Close()
+		if inFlight {
+			// Another peer delivered i first, which is no fault of p.
+			d.duplicatePieceReceived(p, i, n)
+		}
+	})
+}
+
+// recordPieceReceived records the latency of the request for piece i to p, which
+// delivered i. Must be called before the request for i is cleared.
+func (d *Dispatcher) recordPieceReceived(p *peer, i int) {
+	if latency, retries, ok := d.pieceRequestManager.RequestLatency(p.id, i); ok {
+		if !p.unreliableAttribution() {
+			d.samplePieceRequestLatency(latency)
+		}
+		attempt := "first"
+		if retries > 0 {
+			attempt = "retry"
+		}
+		d.interfaceStats(p).Tagged(map[string]string{
+			"attempt": attempt,
+			"endgame": strconv.FormatBool(d.endgame()),
+		}).Histogram("piece_request_latency", _pieceRequestLatencyBuckets).RecordDuration(latency)
+	}
+	d.pieceRequestManager.RecordPieceReceived(p.id, i)
+}
+
+func (d *Dispatcher) updateOutstandingRequests() {
+	d.stats.Gauge("outstanding_piece_requests").Update(
+		float64(d.pieceRequestManager.NumPending()))
+}
+
+// updateRequestStats publishes the number of piece requests of each status,
+// tagged by whether d is in endgame. The gauges of the other endgame tag are
+// zeroed, such that they do not keep reporting stale counts once endgame was
+// entered.
+func (d *Dispatcher) updateRequestStats() {
+	s := d.pieceRequestManager.Stats()
+	endgame := d.endgame()
+	for _, e := range []bool{false, true} {
+		counts := map[string]int{
+			"pending":  s.Pending,
+			"expired":  s.Expired,
+			"unsent":   s.Unsent,
+			"invalid":  s.Invalid,
+			"rejected": s.Rejected,
+		}
+		for status, n := range counts {
+			if e != endgame {
+				n = 0
+			}
+			d.stats.Tagged(map[string]string{
+				"status":  status,
+				"endgame": strconv.FormatBool(e),
+			}).Gauge("piece_requests_by_status").Update(float64(n))
+		}
+	}
+}
+
+// handlePieceDigestMismatch handles piece payloads which the conn discarded
+// because p sent a digest other than the expected one, i.e. p's copy of the
+// piece is corrupt.
+func (d *Dispatcher) handlePieceDigestMismatch(p *peer, msg *p2p.PiecePayloadMessage) error {
+	i := int(msg.Index)
+	d.stats.Counter("piece_digest_mismatches").Inc(1)
+	d.markPieceRequestInvalid(p.id, i)
+	d.invalidPieceReceived(p)
+	d.pieceCorrupted()
+	return validationError(fmt.Errorf("piece %d: %s", i, storage.ErrPieceDigestMismatch))
+}
+
+// handleChunkPayload buffers chunk payloads of piece i until all chunks of i
+// have been received, and then writes the assembled piece.
+func (d *Dispatcher) handleChunkPayload(
+	p *peer, i int, offset, length int64, payload storage.PieceReader) error {
+
+	c, ok := d.chunkIndex(i, offset, length)
+	if !ok {
+		d.markPieceRequestInvalid(p.id, i)
+		d.invalidPieceReceived(p)
+		return validationError(fmt.Errorf(
+			"piece payload: invalid chunk piece=%d offset=%d length=%d", i, offset, length))
+	}
+	chunk := make([]byte, length)
+	if _, err := io.ReadFull(payload, chunk); err != nil {
+		// The payload is shorter than its length.
+		d.markPieceRequestInvalid(p.id, i)
+		d.invalidPieceReceived(p)
+		return validationError(fmt.Errorf("read chunk payload of piece %d: %s", i, err))
+	}
+
+	n := d.numChunks(i)
+
+	d.chunks.mu.Lock()
+	if d.torrent.HasPiece(i) || !d.pieceRequestManager.MarkChunkReceived(i, c, n) {
+		d.chunks.mu.Unlock()
+		d.duplicatePieceReceived(p, i, length)
+		return nil
+	}
+	d.chunks.addLocked(i, d.pieceLengths.get(i), offset, chunk, p.id)
+	var buf []byte
+	var contributors map[core.PeerID]bool
+	complete := len(d.pieceRequestManager.MissingChunks(i, n)) == 0
+	if complete {
+		buf, contributors = d.chunks.takeLocked(i)
+	}
+	d.chunks.mu.Unlock()
+
+	d.partialPieces.add(i, length)
+	if !complete {
+		return nil
+	}
+	return d.writeReceivedPiece(p, i, func() error {
+		err := d.writePiece(piecereader.NewBuffer(buf), i)
+		d.partialPieces.remove(i, int64(len(buf)))
+		if err != nil {
+			if err == storage.ErrPieceComplete {
+				// Another peer delivered i in full first.
+				d.duplicatePieceReceived(p, i, int64(len(buf)))
+				return nil
+			}
+			// Start over, since the concurrent write of i may fail.
+			d.pieceRequestManager.ClearChunks(i)
+			if err == storage.ErrPieceWriteConflict {
+				return nil
+			}
+			// Any chunk may have been corrupt.
+			d.pieceCorrupted()
+			for peerID := range contributors {
+				d.markPieceRequestInvalid(peerID, i)
+				if v, ok := d.peers.Load(peerID); ok {
+					d.invalidPieceReceived(v.(*peer))
+				}
+			}
+			return pieceWriteError(i, err)
+		}
+
+		d.recordPieceReceived(p, i)
+		d.pieceWritten(p, i)
+		return nil
+	}, func(bool) {
+		d.partialPieces.remove(i, int64(len(buf)))
+		// Start over, since the write of i in flight may fail.
+		d.pieceRequestManager.ClearChunks(i)
+	})
+}
+
+// writePiece writes piece i from pr. If Config.PieceVerifier is set, the piece
+// is verified as it is written, such that storage fails the write of a piece
+// which does not match. Storage verifies pieces regardless.
+func (d *Dispatcher) writePiece(pr storage.PieceReader, i int) error {
+	if d.verifyReceived {
+		pr = storage.NewVerifyingReader(d.verifier, i, pr)
+	}
+	return d.torrent.WritePiece(pr, i)
+}
+
+// duplicatePieceReceived records n bytes of piece i received from p although we
+// already had i. In endgame, these are usually the payloads of duplicate
+// requests which were already on their way when we cancelled them. Otherwise,
+// another peer delivered i first, e.g. after the request to p expired. Either
+// way, p delivered what we requested, so p counts as having sent a good piece,
+// and is requested more pieces since its request for i is answered.
+func (d *Dispatcher) duplicatePieceReceived(p *peer, i int, n int64) {
+	p.pstats.incrementDuplicatePiecesReceived()
+	p.touchLastGoodPieceReceived()
+
+	endgame := d.endgame()
+	if endgame {
+		d.stats.Counter("endgame_wasted_bytes").Inc(n)
 	}
+	s := d.stats.Tagged(map[string]string{
+		"endgame": strconv.FormatBool(endgame),
+	})
+	s.Counter("duplicate_pieces_received").Inc(1)
+	s.Counter("duplicate_piece_bytes").Inc(n)
+
+	if d.config.PieceRequestEvents {
+		d.netevents.Produce(networkevent.ReceiveDuplicatePieceEvent(
+			d.torrent.InfoHash(), d.localPeerID, p.id, i).At(d.clk.Now()))
+	}
+
+	d.maybeRequestMorePieces(p)
+}
+
+// pieceWritten updates d after piece i, received from p, was written.
+func (d *Dispatcher) pieceWritten(p *peer, i int) {
+	d.phases.mark(_firstPiece, d.clk.Now())
+
+	// Discard chunks of i buffered from other peers.
+	d.partialPieces.remove(i, d.chunks.drop(i))
+	d.clearUsefulPieces(i)
 
 	d.netevents.Produce(
-		networkevent.ReceivePieceEvent(d.torrent.InfoHash(), d.localPeerID, p.id, i))
+		networkevent.ReceivePieceEvent(d.torrent.InfoHash(), d.localPeerID, p.id, i).At(d.clk.Now()))
 
 	p.pstats.incrementGoodPiecesReceived()
 	p.touchLastGoodPieceReceived()
+	if p.setAsymmetric(false) {
+		d.log("peer", p).Info("Asymmetric peer sent good piece, including in piece selection")
+		d.updateAsymmetricPeers(-1)
+	}
+	// Other peers need not serve i anymore. Cleared before completing, which
+	// cancels all requests which are still pending.
+	for _, r := range d.pieceRequestManager.MarkComplete(i) {
+		if r.PeerID != p.id {
+			d.cancelPieceRequest(r.PeerID, i)
+		}
+	}
+	d.updateOutstandingRequests()
+
 	if d.torrent.Complete() {
 		d.complete()
 	}
 
-	d.pieceRequestManager.Clear(i)
-
 	d.maybeRequestMorePieces(p)
 
+	// Peers added from now on are announced i by announceMissed instead.
+	d.written.add(i)
 	d.peers.Range(func(k, v interface{}) bool {
 		if k.(core.PeerID) == p.id {
 			return true
 		}
-		pp := v.(*peer)
-
-		pp.messages.Send(conn.NewAnnouncePieceMessage(i))
+		d.announcer.announce(v.(*peer), i)
 
 		return true
 	})
 }
 
-func (d *Dispatcher) handleCancelPiece(p *peer, msg *p2p.CancelPieceMessage) {
-	// No-op: cancelling not supported because all received messages are synchronized,
-	// therefore if we receive a cancel it is already too late -- we've already read
-	// the piece.
+// cancelPieceRequest notifies peerID that our request for piece i is superseded.
+func (d *Dispatcher) cancelPieceRequest(peerID core.PeerID, i int) {
+	v, ok := d.peers.Load(peerID)
+	if !ok {
+		return
+	}
+	p := v.(*peer)
+	p.forgetPieceRequest(i)
+	d.send(p, conn.NewCancelPieceMessage(i))
+}
+
+func (d *Dispatcher) handleCancelPiece(p *peer, i int) {
+	// Cancels of requests which were already served are ignored, since the
+	// payload is already on its way.
+	n := p.serves.cancel(i)
+	d.stats.Counter("cancelled_serves").Inc(int64(n))
 }
 
-func (d *Dispatcher) handleBitfield(p *peer, msg *p2p.BitfieldMessage) {
-	d.log("peer", p).Error("Unexpected bitfield message from established conn")
+// handleAnnouncePieces handles announcements of multiple pieces at once, e.g.
+// coalesced under an AnnounceBudget.
+func (d *Dispatcher) handleAnnouncePieces(p *peer, bitfield []byte) error {
+	b := bitset.New(0)
+	if err := b.UnmarshalBinary(bitfield); err != nil {
+		return validationError(fmt.Errorf("unmarshal announce pieces: %s", err))
+	}
+	if err := d.peerHasPieces(p, b, _completedByAnnounce); err != nil {
+		d.protocolViolation(p)
+		return protocolViolationError(fmt.Errorf("announce pieces: %s", err))
+	}
+	if d.superseed != nil {
+		var reveal bool
+		for i, e := b.NextSet(0); e; i, e = b.NextSet(i + 1) {
+			if d.superseed.announced(p.id, int(i)) {
+				reveal = true
+			}
+		}
+		if reveal {
+			d.superseedReveal(p)
+		}
+	}
+
+	d.maybeRequestMorePieces(p)
+	return nil
 }
 
 func (d *Dispatcher) handleComplete(p *peer) {
-	if d.Complete() {
-		d.log("peer", p).Info("Closing connection to completed peer")
-		p.messages.Close()
-	} else {
-		p.bitfield.SetAll(true)
+	d.peerHasAllPieces(p)
+	if !d.Complete() {
 		d.maybeRequestMorePieces(p)
 	}
 }
 
-func (d *Dispatcher) log(args ...interface{}) *zap.SugaredLogger {
-	args = append(args, "torrent", d.torrent)
-	return d.logger.With(args...)
+// log returns a logger with the key-value pairs args and the torrent as fields.
+// Neither the message nor the fields are formatted unless the entry is written,
+// i.e. if its level is enabled and it is not sampled out.
+func (d *Dispatcher) log(args ...interface{}) fieldLogger {
+	return fieldLogger{d, args}
+}
+
+// logw logs msg at lvl with fields and the torrent as fields, in the same order
+// as log. Like log, fields are only formatted if the entry is written.
+func (d *Dispatcher) logw(lvl zapcore.Level, msg string, fields ...zap.Field) {
+	d.write(lvl, msg, fields)
+}
+
+func (d *Dispatcher) write(lvl zapcore.Level, msg string, fields []zap.Field) {
+	if ce := d.base.Check(lvl, msg); ce != nil {
+		ce.Write(append(fields, d.torrentField)...)
+	}
+}
+
+// fieldLogger provides the leveled methods of zap.SugaredLogger which the
+// Dispatcher uses, with the fields of log.
+type fieldLogger struct {
+	d    *Dispatcher
+	args []interface{} // Key-value pairs, as in zap.SugaredLogger.With.
+}
+
+func (l fieldLogger) Debugf(template string, args ...interface{}) {
+	l.logf(zap.DebugLevel, template, args)
+}
+
+func (l fieldLogger) Info(args ...interface{}) {
+	l.logf(zap.InfoLevel, "", args)
+}
+
+func (l fieldLogger) Infof(template string, args ...interface{}) {
+	l.logf(zap.InfoLevel, template, args)
+}
+
+func (l fieldLogger) Warn(args ...interface{}) {
+	l.logf(zap.WarnLevel, "", args)
+}
+
+func (l fieldLogger) Warnf(template string, args ...interface{}) {
+	l.logf(zap.WarnLevel, template, args)
+}
+
+func (l fieldLogger) Error(args ...interface{}) {
+	l.logf(zap.ErrorLevel, "", args)
+}
+
+func (l fieldLogger) Errorf(template string, args ...interface{}) {
+	l.logf(zap.ErrorLevel, template, args)
+}
+
+// logf formats the message from template and args like zap.SugaredLogger, i.e.
+// with fmt.Sprint if template is empty, but only if lvl is enabled.
+func (l fieldLogger) logf(lvl zapcore.Level, template string, args []interface{}) {
+	if !l.d.base.Core().Enabled(lvl) {
+		return
+	}
+	msg := template
+	switch {
+	case len(args) == 0:
+	case template == "":
+		msg = fmt.Sprint(args...)
+	default:
+		msg = fmt.Sprintf(template, args...)
+	}
+	if ce := l.d.base.Check(lvl, msg); ce != nil {
+		ce.Write(l.fields()...)
+	}
+}
+
+func (l fieldLogger) fields() []zap.Field {
+	fields := make([]zap.Field, 0, len(l.args)/2+1)
+	for i := 0; i+1 < len(l.args); i += 2 {
+		key, ok := l.args[i].(string)
+		if !ok {
+			key = fmt.Sprint(l.args[i])
+		}
+		fields = append(fields, zap.Any(key, l.args[i+1]))
+	}
+	return append(fields, l.d.torrentField)
 }
@@ -14,7 +14,16 @@
 package dispatch
 
 import (
+	"crypto/md5"
+	"crypto/sha256"
 	"errors"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net"
+	"runtime"
 	"sync"
 	"testing"
 	"time"
@@ -23,6 +32,7 @@ import (
 	"github.com/uber/kraken/gen/go/proto/p2p"
 	"github.com/uber/kraken/lib/torrent/networkevent"
 	"github.com/uber/kraken/lib/torrent/scheduler/conn"
+	"github.com/uber/kraken/lib/torrent/scheduler/dispatch/piecerequest"
 	"github.com/uber/kraken/lib/torrent/scheduler/torrentlog"
 	"github.com/uber/kraken/lib/torrent/storage"
 	"github.com/uber/kraken/lib/torrent/storage/agentstorage"
@@ -30,24 +40,44 @@ import (
 	"github.com/uber/kraken/utils/bitsetutil"
 	"github.com/uber/kraken/utils/memsize"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
 
 	"github.com/andres-erbsen/clock"
+	"github.com/golang/protobuf/proto"
 	"github.com/stretchr/testify/require"
 	"github.com/uber-go/tally"
 	"github.com/willf/bitset"
 )
 
 type mockMessages struct {
-	sent     []*conn.Message
-	receiver chan *conn.Message
-	closed   bool
+	mu          sync.Mutex
+	sent        []*conn.Message
+	receiver    chan *conn.Message
+	closed      bool
+	unsupported map[conn.Capability]bool
+	localAddr   net.Addr
 }
 
 func newMockMessages() *mockMessages {
 	return &mockMessages{receiver: make(chan *conn.Message)}
 }
 
+// newLegacyMockMessages returns mockMessages of a peer which supports none of
+// capabilities.
+func newLegacyMockMessages(capabilities ...conn.Capability) *mockMessages {
+	m := newMockMessages()
+	m.unsupported = make(map[conn.Capability]bool)
+	for _, c := range capabilities {
+		m.unsupported[c] = true
+	}
+	return m
+}
+
 func (m *mockMessages) Send(msg *conn.Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	if m.closed {
 		return errors.New("messages closed")
 	}
@@ -57,7 +87,14 @@ func (m *mockMessages) Send(msg *conn.Message) error {
 
 func (m *mockMessages) Receiver() <-chan *conn.Message { return m.receiver }
 
+func (m *mockMessages) Supports(c conn.Capability) bool { return !m.unsupported[c] }
+
+func (m *mockMessages) LocalAddr() net.Addr { return m.localAddr }
+
 func (m *mockMessages) Close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	if m.closed {
 		return
 	}
@@ -65,19 +102,54 @@ func (m *mockMessages) Close() {
 	m.closed = true
 }
 
+func (m *mockMessages) getSent() []*conn.Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]*conn.Message(nil), m.sent...)
+}
+
+func (m *mockMessages) isClosed() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.closed
+}
+
+// sentPieceRequests returns the piece requests sent to messages, including those
+// sent in batches.
+func sentPieceRequests(messages Messages) []*p2p.PieceRequestMessage {
+	var requests []*p2p.PieceRequestMessage
+	for _, msg := range messages.(*mockMessages).getSent() {
+		switch msg.Message.Type {
+		case p2p.Message_PIECE_REQUEST:
+			requests = append(requests, msg.Message.PieceRequest)
+		case p2p.Message_PIECE_REQUESTS:
+			requests = append(requests, msg.Message.PieceRequests.Requests...)
+		}
+	}
+	return requests
+}
+
 func numRequestsPerPiece(messages Messages) map[int]int {
 	requests := make(map[int]int)
-	for _, msg := range messages.(*mockMessages).sent {
-		if msg.Message.Type == p2p.Message_PIECE_REQUEST {
-			requests[int(msg.Message.PieceRequest.Index)]++
-		}
+	for _, r := range sentPieceRequests(messages) {
+		requests[int(r.Index)]++
 	}
 	return requests
 }
 
+func requestedPieces(messages Messages) []int {
+	var ps []int
+	for _, r := range sentPieceRequests(messages) {
+		ps = append(ps, int(r.Index))
+	}
+	return ps
+}
+
 func announcedPieces(messages Messages) []int {
 	var ps []int
-	for _, msg := range messages.(*mockMessages).sent {
+	for _, msg := range messages.(*mockMessages).getSent() {
 		if msg.Message.Type == p2p.Message_ANNOUCE_PIECE {
 			ps = append(ps, int(msg.Message.AnnouncePiece.Index))
 		}
@@ -85,8 +157,18 @@ func announcedPieces(messages Messages) []int {
 	return ps
 }
 
+func cancelledPieces(messages Messages) []int {
+	var ps []int
+	for _, msg := range messages.(*mockMessages).getSent() {
+		if msg.Message.Type == p2p.Message_CANCEL_PIECE {
+			ps = append(ps, int(msg.Message.CancelPiece.Index))
+		}
+	}
+	return ps
+}
+
 func hasComplete(messages Messages) bool {
-	for _, m := range messages.(*mockMessages).sent {
+	for _, m := range messages.(*mockMessages).getSent() {
 		if m.Message.Type == p2p.Message_COMPLETE {
 			return true
 		}
@@ -95,15 +177,25 @@ func hasComplete(messages Messages) bool {
 }
 
 func closed(messages Messages) bool {
-	return messages.(*mockMessages).closed
+	return messages.(*mockMessages).isClosed()
 }
 
 type noopEvents struct{}
 
 func (e noopEvents) DispatcherComplete(*Dispatcher) {}
 
+func (e noopEvents) DispatcherFailed(*Dispatcher, TearDownReason) {}
+
 func (e noopEvents) PeerRemoved(core.PeerID, core.InfoHash) {}
 
+func (e noopEvents) PeerBanned(core.PeerID, core.InfoHash) {}
+
+func (e noopEvents) PiecesUnavailable(core.InfoHash, []int) {}
+
+func (e noopEvents) PiecesQuarantined(core.InfoHash, []int) {}
+
+func (e noopEvents) DispatcherStalled(*Dispatcher) {}
+
 func testDispatcher(config Config, clk clock.Clock, t storage.Torrent) *Dispatcher {
 	d, err := newDispatcher(
 		config,
@@ -121,6 +213,11 @@ func testDispatcher(config Config, clk clock.Clock, t storage.Torrent) *Dispatch
 	return d
 }
 
+// waitForServes waits until all piece requests received from p are served.
+func waitForServes(t *testing.T, p *peer) {
+	require.Eventually(t, p.serves.idle, time.Second, time.Millisecond)
+}
+
 func TestDispatcherSendUniquePieceRequestsWithinLimit(t *testing.T) {
 	require := require.New(t)
 
@@ -231,244 +328,4163 @@ func TestDispatcherResendFailedPieceRequests(t *testing.T) {
 	}, numRequestsPerPiece(p3.messages))
 }
 
-func TestDispatcherSendErrorsMarksPieceRequestsUnsent(t *testing.T) {
-	require := require.New(t)
-
-	config := Config{
-		DisableEndgame: true,
+func TestDispatcherResendRespectsMaxReservationsPerPeer(t *testing.T) {
+	tests := []struct {
+		desc            string
+		maxReservations int
+		expected        map[int]int // Piece requests sent to p2.
+		capped          int64
+	}{
+		{"unlimited", 0, map[int]int{0: 1, 1: 1}, 0},
+		{"capped", 1, map[int]int{1: 1}, 2},
 	}
-	clk := clock.NewMock()
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
 
-	torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(1, 1).MetaInfo)
-	defer cleanup()
+			config := Config{
+				DisableEndgame:         true,
+				PipelineLimit:          1,
+				MaxReservationsPerPeer: test.maxReservations,
+			}
+			clk := clock.NewMock()
+			stats := tally.NewTestScope("", nil)
 
-	d := testDispatcher(config, clk, torrent)
+			torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(2, 1).MetaInfo)
+			defer cleanup()
 
-	p1, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true), newMockMessages())
-	require.NoError(err)
+			d := testDispatcher(config, clk, torrent)
+			d.stats = stats
 
-	p1.messages.Close()
+			// p1 only has piece 0, and p2 is left with piece 1.
+			p1, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, false), newMockMessages())
+			require.NoError(err)
+			d.maybeRequestMorePieces(p1)
+			p2, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, true), newMockMessages())
+			require.NoError(err)
+			d.maybeRequestMorePieces(p2)
+			require.Equal(map[int]int{0: 1}, numRequestsPerPiece(p1.messages))
+			require.Equal(map[int]int{1: 1}, numRequestsPerPiece(p2.messages))
 
-	// Send should fail since p1 messages are closed.
-	d.maybeRequestMorePieces(p1)
+			// Both requests expire. The expired request of p2 frees its
+			// pipeline, but p2 may still send piece 1, so it stays reserved.
+			clk.Add(d.pieceRequestTimeout + 1)
+			d.resendFailedPieceRequests()
 
-	require.Equal(map[int]int{}, numRequestsPerPiece(p1.messages))
+			require.Equal(map[int]int{0: 1}, numRequestsPerPiece(p1.messages))
+			require.Equal(test.expected, numRequestsPerPiece(p2.messages))
 
-	p2, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true), newMockMessages())
-	require.NoError(err)
+			var capped int64
+			if c, ok := stats.Snapshot().Counters()["capped_piece_resend_peers+"]; ok {
+				capped = c.Value()
+			}
+			require.Equal(test.capped, capped)
+		})
+	}
+}
 
-	// Send should succeed since pending requests were marked unsent.
-	d.maybeRequestMorePieces(p2)
+func TestDispatcherBacksOffResendsOfFailingPieces(t *testing.T) {
+	for _, disabled := range []bool{false, true} {
+		t.Run(fmt.Sprintf("disabled=%t", disabled), func(t *testing.T) {
+			require := require.New(t)
 
-	require.Equal(map[int]int{
-		0: 1,
-	}, numRequestsPerPiece(p2.messages))
-}
+			config := Config{
+				DisableEndgame:                   true,
+				PipelineLimit:                    1,
+				DisablePieceRequestResendBackoff: disabled,
+			}
+			clk := clock.NewMock()
+			stats := tally.NewTestScope("", nil)
 
-func TestDispatcherCalcPieceRequestTimeout(t *testing.T) {
-	config := Config{
-		PieceRequestMinTimeout:   5 * time.Second,
-		PieceRequestTimeoutPerMb: 2 * time.Second,
-	}
+			torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(1, 1).MetaInfo)
+			defer cleanup()
 
-	tests := []struct {
-		maxPieceLength uint64
-		expected       time.Duration
-	}{
-		{512 * memsize.KB, 5 * time.Second},
-		{memsize.MB, 5 * time.Second},
-		{4 * memsize.MB, 8 * time.Second},
-		{8 * memsize.MB, 16 * time.Second},
-	}
-	for _, test := range tests {
-		t.Run(memsize.Format(test.maxPieceLength), func(t *testing.T) {
-			timeout := config.calcPieceRequestTimeout(int64(test.maxPieceLength))
-			require.Equal(t, test.expected, timeout)
+			d := testDispatcher(config, clk, torrent)
+			d.stats = stats
+
+			p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true), newMockMessages())
+			require.NoError(err)
+			d.maybeRequestMorePieces(p)
+			require.Equal(map[int]int{0: 1}, numRequestsPerPiece(p.messages))
+
+			// No other peer has piece 0, so its expired request fails every round.
+			clk.Add(d.pieceRequestTimeout + 1)
+			d.resendFailedPieceRequests()
+			d.resendFailedPieceRequests()
+			clk.Add(d.pieceRequestTimeout / 2)
+			d.resendFailedPieceRequests()
+
+			counters := stats.Snapshot().Counters()
+			require.Equal(int64(1), counters["piece_request_first_failures+"].Value())
+			if disabled {
+				require.Equal(int64(3), counters["piece_request_failures+"].Value())
+				require.Equal(int64(2), counters["piece_request_retried_failures+"].Value())
+			} else {
+				// The second round is skipped under backoff.
+				require.Equal(int64(2), counters["piece_request_failures+"].Value())
+				require.Equal(int64(1), counters["piece_request_retried_failures+"].Value())
+			}
 		})
 	}
 }
 
-func TestDispatcherEndgame(t *testing.T) {
+func numRecorded(h tally.HistogramSnapshot) int64 {
+	var n int64
+	for _, c := range h.Durations() {
+		n += c
+	}
+	return n
+}
+
+func TestDispatcherRecordsPieceRequestLatency(t *testing.T) {
 	require := require.New(t)
 
 	config := Config{
-		PipelineLimit:    1,
-		EndgameThreshold: 1,
+		DisableEndgame:                   true,
+		PipelineLimit:                    1,
+		DisablePieceRequestResendBackoff: true,
 	}
 	clk := clock.NewMock()
+	stats := tally.NewTestScope("", nil)
 
-	torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(1, 1).MetaInfo)
+	blob := core.SizedBlobFixture(2, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
 	defer cleanup()
 
 	d := testDispatcher(config, clk, torrent)
+	d.stats = stats
 
-	p1, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true), newMockMessages())
+	p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, true), newMockMessages())
 	require.NoError(err)
+	d.maybeRequestMorePieces(p)
+	require.Len(requestedPieces(p.messages), 1)
+	first := requestedPieces(p.messages)[0]
+	require.Equal(float64(1), stats.Snapshot().Gauges()["outstanding_piece_requests+"].Value())
 
-	d.maybeRequestMorePieces(p1)
-	require.Equal(map[int]int{0: 1}, numRequestsPerPiece(p1.messages))
+	clk.Add(3 * time.Second)
+	require.NoError(d.dispatch(p, conn.NewPiecePayloadMessage(
+		first, piecereader.NewBuffer(blob.Content[first:first+1]))))
 
-	p2, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true), newMockMessages())
+	h := stats.Snapshot().Histograms()["piece_request_latency+attempt=first,endgame=false"]
+	require.NotNil(h)
+	require.Equal(int64(1), numRecorded(h))
+	require.Equal(int64(1), h.Durations()[4096*time.Millisecond])
+
+	// The request for the remaining piece expires and is resent to p2.
+	p2, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, true), newMockMessages())
 	require.NoError(err)
+	require.Len(requestedPieces(p.messages), 2)
+	second := requestedPieces(p.messages)[1]
+	clk.Add(d.pieceRequestTimeout + 1)
+	d.resendFailedPieceRequests()
+	require.Equal([]int{second}, requestedPieces(p2.messages))
+	require.Equal(float64(1), stats.Snapshot().Gauges()["outstanding_piece_requests+"].Value())
 
-	// Should send duplicate request for piece 0 since we're in endgame.
-	d.maybeRequestMorePieces(p2)
-	require.Equal(map[int]int{0: 1}, numRequestsPerPiece(p2.messages))
+	clk.Add(time.Second)
+	require.NoError(d.dispatch(p2, conn.NewPiecePayloadMessage(
+		second, piecereader.NewBuffer(blob.Content[second:second+1]))))
+
+	h = stats.Snapshot().Histograms()["piece_request_latency+attempt=retry,endgame=false"]
+	require.NotNil(h)
+	require.Equal(int64(1), numRecorded(h))
+	require.Equal(int64(1), h.Durations()[1024*time.Millisecond])
+	require.Equal(float64(0), stats.Snapshot().Gauges()["outstanding_piece_requests+"].Value())
 }
 
-func TestDispatcherHandlePiecePayloadAnnouncesPiece(t *testing.T) {
+func TestDispatcherPublishesPieceRequestsByStatus(t *testing.T) {
 	require := require.New(t)
 
-	blob := core.SizedBlobFixture(2, 1)
+	clk := clock.NewMock()
+	stats := tally.NewTestScope("", nil)
 
+	blob := core.SizedBlobFixture(3, 1)
 	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
 	defer cleanup()
 
-	d := testDispatcher(Config{}, clock.NewMock(), torrent)
+	d := testDispatcher(Config{
+		EndgameThreshold: 2,
+		PipelineLimit:    3,
+		DisableKeepalive: true,
+	}, clk, torrent)
+	d.stats = stats
 
-	p1, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false, false), newMockMessages())
-	require.NoError(err)
+	gauges := func(endgame bool) map[string]float64 {
+		d.updateRequestStats()
+		values := make(map[string]float64)
+		for _, status := range []string{"pending", "expired", "unsent", "invalid", "rejected"} {
+			key := fmt.Sprintf("piece_requests_by_status+endgame=%t,status=%s", endgame, status)
+			g, ok := stats.Snapshot().Gauges()[key]
+			require.True(ok, key)
+			if v := g.Value(); v > 0 {
+				values[status] = v
+			}
+		}
+		return values
+	}
 
-	p2, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false, false), newMockMessages())
+	p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, true, true), newMockMessages())
+	require.NoError(err)
+	_, err = d.maybeRequestMorePieces(p)
 	require.NoError(err)
+	require.Len(requestedPieces(p.messages), 3)
+	require.Equal(map[string]float64{"pending": 3}, gauges(false))
+	require.Empty(gauges(true))
 
-	msg := conn.NewPiecePayloadMessage(0, piecereader.NewBuffer(blob.Content[0:1]))
+	// Receiving the first piece enters endgame, and zeroes the gauges of
+	// requests outside of endgame.
+	first := requestedPieces(p.messages)[0]
+	require.NoError(d.dispatch(p, conn.NewPiecePayloadMessage(
+		first, piecereader.NewBuffer(blob.Content[first:first+1]))))
+	require.Equal(map[string]float64{"pending": 2}, gauges(true))
+	require.Empty(gauges(false))
 
-	require.NoError(d.dispatch(p1, msg))
+	clk.Add(d.pieceRequestTimeout + 1)
+	require.Equal(map[string]float64{"expired": 2}, gauges(true))
+	require.Empty(gauges(false))
+}
 
-	// Should not announce to the peer who sent the payload.
-	require.Empty(announcedPieces(p1.messages))
+func TestDispatcherPieceRequestLifecycleEvents(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		t.Run(fmt.Sprintf("enabled=%t", enabled), func(t *testing.T) {
+			require := require.New(t)
 
-	// Should announce to other peers.
-	require.Equal([]int{0}, announcedPieces(p2.messages))
+			config := Config{
+				DisableEndgame:                   true,
+				PipelineLimit:                    1,
+				DisablePieceRequestResendBackoff: true,
+				PieceRequestEvents:               enabled,
+			}
+			clk := clock.NewMock()
+
+			torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(1, 1).MetaInfo)
+			defer cleanup()
+
+			d := testDispatcher(config, clk, torrent)
+
+			p1, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true), newMockMessages())
+			require.NoError(err)
+			d.maybeRequestMorePieces(p1)
+
+			// The request to p1 expires and is resent to p2, which fails it.
+			p2, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true), newMockMessages())
+			require.NoError(err)
+			clk.Add(d.pieceRequestTimeout + 1)
+			d.resendFailedPieceRequests()
+			require.Equal([]int{0}, requestedPieces(p2.messages))
+			require.NoError(d.dispatch(p2, conn.NewErrorMessage(
+				0, p2p.ErrorMessage_PIECE_REQUEST_FAILED, errors.New("some error"))))
+
+			type lifecycle struct {
+				name    networkevent.Name
+				peer    core.PeerID
+				attempt int
+			}
+			var lifecycles []lifecycle
+			for _, e := range networkevent.Filter(
+				d.netevents.(*networkevent.TestProducer).Events(),
+				networkevent.RequestPiece,
+				networkevent.RequestExpired,
+				networkevent.RequestInvalid) {
+
+				peerID, err := core.NewPeerID(e.Peer)
+				require.NoError(err)
+				require.Equal(0, e.Piece)
+				lifecycles = append(lifecycles, lifecycle{e.Name, peerID, e.Attempt})
+			}
+			expected := []lifecycle{
+				{networkevent.RequestPiece, p1.id, 1},
+				{networkevent.RequestPiece, p2.id, 2},
+			}
+			if enabled {
+				expected = []lifecycle{
+					{networkevent.RequestPiece, p1.id, 1},
+					{networkevent.RequestExpired, p1.id, 1},
+					{networkevent.RequestPiece, p2.id, 2},
+					{networkevent.RequestInvalid, p2.id, 2},
+				}
+			}
+			require.Equal(expected, lifecycles)
+		})
+	}
 }
 
-func TestDispatcherHandlePiecePayloadSendsCompleteMessage(t *testing.T) {
+func TestDispatcherRetryableRejectionIsNotAFailure(t *testing.T) {
 	require := require.New(t)
 
-	blob := core.SizedBlobFixture(1, 1)
+	config := Config{
+		DisableEndgame: true,
+		PipelineLimit:  2,
+	}
+	clk := clock.NewMock()
+	stats := tally.NewTestScope("", nil)
 
-	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(2, 1).MetaInfo)
 	defer cleanup()
 
-	d := testDispatcher(Config{}, clock.NewMock(), torrent)
+	d := testDispatcher(config, clk, torrent)
+	d.stats = stats
 
-	p1, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false), newMockMessages())
+	p1, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, true), newMockMessages())
 	require.NoError(err)
+	d.maybeRequestMorePieces(p1)
+	require.Equal(map[int]int{0: 1, 1: 1}, numRequestsPerPiece(p1.messages))
 
-	p2, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false), newMockMessages())
+	p2, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, false), newMockMessages())
 	require.NoError(err)
 
-	msg := conn.NewPiecePayloadMessage(0, piecereader.NewBuffer(blob.Content[0:1]))
+	// p1 sheds load and rejects piece 0.
+	require.NoError(d.dispatch(p1, conn.NewErrorMessage(
+		0, p2p.ErrorMessage_PIECE_REQUEST_RETRY, errServeRejected)))
+	require.Equal(2, d.pieceRequestManager.PipelineDepth(p1.id))
 
-	require.NoError(d.dispatch(p1, msg))
+	// Piece 0 is requested from p2 instead.
+	d.resendFailedPieceRequests()
+	require.Equal(map[int]int{0: 1}, numRequestsPerPiece(p2.messages))
+	require.Equal(map[int]int{0: 1, 1: 1}, numRequestsPerPiece(p1.messages))
 
-	require.True(hasComplete(p1.messages))
-	require.True(hasComplete(p2.messages))
+	counters := stats.Snapshot().Counters()
+	require.Equal(int64(1), counters["piece_request_rejections+"].Value())
+	require.Nil(counters["piece_request_failures+"])
 }
 
-func TestDispatcherClosesCompletedPeersWhenComplete(t *testing.T) {
+func TestDispatcherHonorsRetryAfterHints(t *testing.T) {
 	require := require.New(t)
 
-	blob := core.SizedBlobFixture(1, 1)
+	config := Config{
+		DisableEndgame: true,
+	}
+	clk := clock.NewMock()
+	stats := tally.NewTestScope("", nil)
 
-	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(1, 1).MetaInfo)
 	defer cleanup()
 
-	d := testDispatcher(Config{}, clock.NewMock(), torrent)
+	d := testDispatcher(config, clk, torrent)
+	d.stats = stats
 
-	completedPeer, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true), newMockMessages())
+	p1, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true), newMockMessages())
 	require.NoError(err)
+	d.maybeRequestMorePieces(p1)
+	require.Equal(map[int]int{0: 1}, numRequestsPerPiece(p1.messages))
 
-	incompletePeer, err := d.addPeer(
-		core.PeerIDFixture(), bitsetutil.FromBools(false), newMockMessages())
+	p2, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true), newMockMessages())
 	require.NoError(err)
 
-	msg := conn.NewPiecePayloadMessage(0, piecereader.NewBuffer(blob.Content[0:1]))
+	// p1 hints to retry piece 0 in 5 seconds, so it is requested from p2 meanwhile.
+	require.NoError(d.dispatch(p1, conn.NewRetryErrorMessage(0, errServeRejected, 5*time.Second)))
+	d.resendFailedPieceRequests()
+	require.Equal(map[int]int{0: 1}, numRequestsPerPiece(p2.messages))
 
-	// Completed peers are closed when the dispatcher completes.
-	require.NoError(d.dispatch(completedPeer, msg))
-	require.True(closed(completedPeer.messages))
-	require.False(closed(incompletePeer.messages))
+	// p2 rejects piece 0 without a hint, but p1 is not asked again before its hint
+	// elapsed.
+	require.NoError(d.dispatch(p2, conn.NewRetryErrorMessage(0, errServeRejected, 0)))
+	clk.Add(4 * time.Second)
+	d.maybeRequestMorePieces(p1)
+	require.Equal(map[int]int{0: 1}, numRequestsPerPiece(p1.messages))
 
-	// Peers which send complete messages are closed if the dispatcher is complete.
-	require.NoError(d.dispatch(incompletePeer, conn.NewCompleteMessage()))
-	require.True(closed(incompletePeer.messages))
+	// Once the hint elapsed, piece 0 is requested from p1 again.
+	clk.Add(time.Second)
+	require.Eventually(func() bool {
+		return numRequestsPerPiece(p1.messages)[0] == 2
+	}, time.Second, time.Millisecond)
+
+	require.Equal(int64(1), stats.Snapshot().Counters()["piece_request_retry_hints+"].Value())
 }
 
-func TestDispatcherHandleCompleteRequestsPieces(t *testing.T) {
+func TestDispatcherIgnoresUnsolicitedRetryAfterHints(t *testing.T) {
 	require := require.New(t)
 
-	blob := core.SizedBlobFixture(1, 1)
+	config := Config{
+		DisableEndgame: true,
+	}
+	clk := clock.NewMock()
+	stats := tally.NewTestScope("", nil)
 
-	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(2, 1).MetaInfo)
 	defer cleanup()
 
-	d := testDispatcher(Config{}, clock.NewMock(), torrent)
+	d := testDispatcher(config, clk, torrent)
+	d.stats = stats
 
-	p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false), newMockMessages())
+	p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, true), newMockMessages())
 	require.NoError(err)
 
-	require.Empty(numRequestsPerPiece(p.messages))
+	// p was sent no request for piece 1, nor is piece 1000 in range.
+	require.NoError(d.dispatch(p, conn.NewRetryErrorMessage(1, errServeRejected, 5*time.Second)))
+	require.NoError(d.dispatch(p, conn.NewRetryErrorMessage(1000, errServeRejected, 5*time.Second)))
+	require.NoError(d.dispatch(p, conn.NewRetryErrorMessage(-1, errServeRejected, 5*time.Second)))
 
-	require.NoError(d.dispatch(p, conn.NewCompleteMessage()))
+	require.Equal(time.Duration(0), p.retryDelay())
+	require.Nil(stats.Snapshot().Counters()["piece_request_retry_hints+"])
 
-	require.Equal(map[int]int{0: 1}, numRequestsPerPiece(p.messages))
-	require.False(closed(p.messages))
+	// Both pieces may still be requested from p.
+	d.maybeRequestMorePieces(p)
+	require.Equal(map[int]int{0: 1, 1: 1}, numRequestsPerPiece(p.messages))
 }
 
-func TestDispatcherPeerPieceCounts(t *testing.T) {
+func TestDispatcherIgnoresRetryAfterHintsWithoutCapability(t *testing.T) {
 	require := require.New(t)
 
-	blob := core.SizedBlobFixture(3, 1)
+	config := Config{
+		DisableEndgame: true,
+	}
+	clk := clock.NewMock()
 
-	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(1, 1).MetaInfo)
 	defer cleanup()
 
-	d := testDispatcher(Config{}, clock.NewMock(), torrent)
-
-	var err error
+	d := testDispatcher(config, clk, torrent)
 
-	p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false, false, false), newMockMessages())
+	p, err := d.addPeer(
+		core.PeerIDFixture(), bitsetutil.FromBools(true), newLegacyMockMessages(conn.RetryAfter))
 	require.NoError(err)
+	d.maybeRequestMorePieces(p)
 
-	require.Equal(0, d.numPeersByPiece.Get(0))
-	require.Equal(0, d.numPeersByPiece.Get(1))
-	require.Equal(0, d.numPeersByPiece.Get(2))
-
-	d.dispatch(p, conn.NewAnnouncePieceMessage(2))
+	require.NoError(d.dispatch(p, conn.NewRetryErrorMessage(0, errServeRejected, 5*time.Second)))
+	d.maybeRequestMorePieces(p)
+	require.Equal(map[int]int{0: 2}, numRequestsPerPiece(p.messages))
+}
 
-	require.Equal(1, d.numPeersByPiece.Get(2))
+func TestDispatcherSendsRetryAfterHints(t *testing.T) {
+	require := require.New(t)
 
-	d.dispatch(p, conn.NewAnnouncePieceMessage(0))
-	d.dispatch(p, conn.NewAnnouncePieceMessage(0))
+	blob := core.SizedBlobFixture(1, 1)
 
-	require.Equal(2, d.numPeersByPiece.Get(0))
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
 
-	_, err = d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, true, true), newMockMessages())
-	require.NoError(err)
+	require.NoError(torrent.WritePiece(piecereader.NewBuffer(blob.Content), 0))
 
-	require.Equal(3, d.numPeersByPiece.Get(0))
-	require.Equal(1, d.numPeersByPiece.Get(1))
-	require.Equal(2, d.numPeersByPiece.Get(2))
+	config := Config{
+		LoadAdmission: admissionFunc(func(piece int, length int64) AdmissionDecision {
+			return AdmissionReject
+		}),
+		ServeDeferInterval: 250 * time.Millisecond,
+	}
+	d := testDispatcher(config, clock.NewMock(), torrent)
 
-	_, err = d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, false, true), newMockMessages())
+	p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false), newMockMessages())
+	require.NoError(err)
+	legacy, err := d.addPeer(
+		core.PeerIDFixture(), bitsetutil.FromBools(false), newLegacyMockMessages(conn.RetryAfter))
 	require.NoError(err)
 
-	require.Equal(4, d.numPeersByPiece.Get(0))
-	require.Equal(1, d.numPeersByPiece.Get(1))
-	require.Equal(3, d.numPeersByPiece.Get(2))
-
+	retryAfter := func(p *peer) int32 {
+		for _, msg := range p.messages.(*mockMessages).getSent() {
+			if msg.Message.Type == p2p.Message_ERROR {
+				require.Equal(p2p.ErrorMessage_PIECE_REQUEST_RETRY, msg.Message.Error.Code)
+				return msg.Message.Error.RetryAfterMillis
+			}
+		}
+		return -1
+	}
+
+	for _, p := range []*peer{p, legacy} {
+		require.NoError(d.dispatch(p, conn.NewPieceRequestMessage(0, 1)))
+		waitForServes(t, p)
+	}
+	require.Equal(int32(250), retryAfter(p))
+	require.Equal(int32(0), retryAfter(legacy))
+}
+
+func TestDispatcherPieceDigestMismatchFailsRequest(t *testing.T) {
+	require := require.New(t)
+
+	config := Config{
+		DisableEndgame: true,
+	}
+	clk := clock.NewMock()
+	stats := tally.NewTestScope("", nil)
+
+	torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(1, 1).MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(config, clk, torrent)
+	d.stats = stats
+
+	p1, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true), newMockMessages())
+	require.NoError(err)
+	d.maybeRequestMorePieces(p1)
+	require.Equal(map[int]int{0: 1}, numRequestsPerPiece(p1.messages))
+
+	p2, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true), newMockMessages())
+	require.NoError(err)
+
+	// The conn discarded p1's payload of piece 0.
+	msg := conn.NewPiecePayloadMessage(0, piecereader.NewBuffer([]byte{0}))
+	msg.Payload = nil
+	msg.DigestMismatch = true
+	require.Equal(ErrorValidation, Category(d.dispatch(p1, msg)))
+
+	s, ok := d.PeerStats(p1.id)
+	require.True(ok)
+	require.Equal(1, s.InvalidPiecesReceived)
+	require.Equal(int64(1), stats.Snapshot().Counters()["piece_digest_mismatches+"].Value())
+	require.False(d.torrent.HasPiece(0))
+
+	// Piece 0 is requested from p2 instead.
+	d.resendFailedPieceRequests()
+	require.Equal(map[int]int{0: 1}, numRequestsPerPiece(p2.messages))
+}
+
+func TestDispatcherSendErrorsMarksPieceRequestsUnsent(t *testing.T) {
+	require := require.New(t)
+
+	config := Config{
+		DisableEndgame: true,
+	}
+	clk := clock.NewMock()
+
+	torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(1, 1).MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(config, clk, torrent)
+
+	p1, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true), newMockMessages())
+	require.NoError(err)
+
+	p1.messages.Close()
+
+	// Send should fail since p1 messages are closed.
+	d.maybeRequestMorePieces(p1)
+
+	require.Equal(map[int]int{}, numRequestsPerPiece(p1.messages))
+
+	p2, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true), newMockMessages())
+	require.NoError(err)
+
+	// Send should succeed since pending requests were marked unsent.
+	d.maybeRequestMorePieces(p2)
+
+	require.Equal(map[int]int{
+		0: 1,
+	}, numRequestsPerPiece(p2.messages))
+}
+
+func TestDispatcherCalcPieceRequestTimeout(t *testing.T) {
+	config := Config{
+		PieceRequestMinTimeout:   5 * time.Second,
+		PieceRequestTimeoutPerMb: 2 * time.Second,
+	}
+
+	tests := []struct {
+		maxPieceLength uint64
+		expected       time.Duration
+	}{
+		{512 * memsize.KB, 5 * time.Second},
+		{memsize.MB, 5 * time.Second},
+		{4 * memsize.MB, 8 * time.Second},
+		{8 * memsize.MB, 16 * time.Second},
+	}
+	for _, test := range tests {
+		t.Run(memsize.Format(test.maxPieceLength), func(t *testing.T) {
+			timeout := config.calcPieceRequestTimeout(int64(test.maxPieceLength))
+			require.Equal(t, test.expected, timeout)
+		})
+	}
+}
+
+func TestDispatcherEndgame(t *testing.T) {
+	require := require.New(t)
+
+	config := Config{
+		PipelineLimit:    1,
+		EndgameThreshold: 1,
+	}
+	clk := clock.NewMock()
+
+	torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(1, 1).MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(config, clk, torrent)
+
+	p1, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true), newMockMessages())
+	require.NoError(err)
+
+	d.maybeRequestMorePieces(p1)
+	require.Equal(map[int]int{0: 1}, numRequestsPerPiece(p1.messages))
+
+	p2, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true), newMockMessages())
+	require.NoError(err)
+
+	// Should send duplicate request for piece 0 since we're in endgame.
+	d.maybeRequestMorePieces(p2)
+	require.Equal(map[int]int{0: 1}, numRequestsPerPiece(p2.messages))
+}
+
+func TestDispatcherEndgameCancelsDuplicateRequests(t *testing.T) {
+	require := require.New(t)
+
+	config := Config{
+		PipelineLimit:    1,
+		EndgameThreshold: 2,
+	}
+	blob := core.SizedBlobFixture(2, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	stats := tally.NewTestScope("", nil)
+
+	d := testDispatcher(config, clock.NewMock(), torrent)
+	d.stats = stats
+
+	p1, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, false), newMockMessages())
+	require.NoError(err)
+	p2, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, false), newMockMessages())
+	require.NoError(err)
+	// Requests are only duplicated while every missing piece has a source.
+	_, err = d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false, true), newMockMessages())
+	require.NoError(err)
+
+	d.maybeRequestMorePieces(p1)
+	d.maybeRequestMorePieces(p2)
+	require.ElementsMatch([]core.PeerID{p1.id, p2.id}, d.pieceRequestManager.PendingPeers(0))
+
+	require.NoError(d.dispatch(
+		p1, conn.NewPiecePayloadMessage(0, piecereader.NewBuffer(blob.Content[0:1]))))
+
+	require.Empty(cancelledPieces(p1.messages))
+	require.Equal([]int{0}, cancelledPieces(p2.messages))
+	require.Empty(d.pieceRequestManager.PendingPeers(0))
+
+	// The duplicate payload may still arrive after the cancel.
+	require.NoError(d.dispatch(
+		p2, conn.NewPiecePayloadMessage(0, piecereader.NewBuffer(blob.Content[0:1]))))
+
+	counters := stats.Snapshot().Counters()
+	require.Equal(int64(1), counters["endgame_wasted_bytes+"].Value())
+	require.Equal(int64(1), counters["duplicate_pieces_received+endgame=true"].Value())
+	require.Equal(int64(1), counters["duplicate_piece_bytes+endgame=true"].Value())
+	require.Equal(1, p2.pstats.getDuplicatePiecesReceived())
+}
+
+func TestDispatcherCountsDuplicatePieces(t *testing.T) {
+	require := require.New(t)
+
+	config := Config{
+		PipelineLimit:      1,
+		DisableEndgame:     true,
+		PieceRequestEvents: true,
+	}
+	blob := core.SizedBlobFixture(3, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	clk := clock.NewMock()
+	stats := tally.NewTestScope("", nil)
+
+	d := testDispatcher(config, clk, torrent)
+	d.stats = stats
+
+	p1, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, false, false), newMockMessages())
+	require.NoError(err)
+	p2, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, true, false), newMockMessages())
+	require.NoError(err)
+
+	d.maybeRequestMorePieces(p1)
+	require.NoError(d.dispatch(
+		p1, conn.NewPiecePayloadMessage(0, piecereader.NewBuffer(blob.Content[0:1]))))
+
+	// p2 delivers piece 0 too, e.g. since our request to p2 expired earlier.
+	clk.Add(time.Second)
+	require.NoError(d.dispatch(
+		p2, conn.NewPiecePayloadMessage(0, piecereader.NewBuffer(blob.Content[0:1]))))
+
+	counters := stats.Snapshot().Counters()
+	require.Equal(int64(1), counters["duplicate_pieces_received+endgame=false"].Value())
+	require.Equal(int64(1), counters["duplicate_piece_bytes+endgame=false"].Value())
+	require.Equal(1, p2.pstats.getDuplicatePiecesReceived())
+
+	// p2 is not penalized, and its pipeline keeps flowing.
+	require.Equal(clk.Now(), p2.getLastGoodPieceReceived())
+	require.Equal([]int{1}, requestedPieces(p2.messages))
+
+	var duplicates []int
+	for _, e := range d.netevents.(*networkevent.TestProducer).Events() {
+		if e.Name == networkevent.ReceiveDuplicatePiece {
+			require.Equal(p2.id.String(), e.Peer)
+			duplicates = append(duplicates, e.Piece)
+		}
+	}
+	require.Equal([]int{0}, duplicates)
+}
+
+func TestDispatcherHandlePiecePayloadAnnouncesPiece(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(2, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(Config{}, clock.NewMock(), torrent)
+
+	p1, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false, false), newMockMessages())
+	require.NoError(err)
+
+	p2, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false, false), newMockMessages())
+	require.NoError(err)
+
+	msg := conn.NewPiecePayloadMessage(0, piecereader.NewBuffer(blob.Content[0:1]))
+
+	require.NoError(d.dispatch(p1, msg))
+
+	// Should not announce to the peer who sent the payload.
+	require.Empty(announcedPieces(p1.messages))
+
+	// Should announce to other peers.
+	require.Equal([]int{0}, announcedPieces(p2.messages))
+}
+
+func TestDispatcherHandlePiecePayloadSendsCompleteMessage(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(1, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(Config{}, clock.NewMock(), torrent)
+
+	p1, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false), newMockMessages())
+	require.NoError(err)
+
+	p2, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false), newMockMessages())
+	require.NoError(err)
+
+	msg := conn.NewPiecePayloadMessage(0, piecereader.NewBuffer(blob.Content[0:1]))
+
+	require.NoError(d.dispatch(p1, msg))
+	d.completeNotifications.Wait()
+
+	require.True(hasComplete(p1.messages))
+	require.True(hasComplete(p2.messages))
+}
+
+func TestDispatcherCompleteAfterTearDownSkipsNotifications(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(1, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(Config{}, clock.NewMock(), torrent)
+
+	p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false), newMockMessages())
+	require.NoError(err)
+
+	d.TearDown()
+
+	require.NoError(d.dispatch(p, conn.NewPiecePayloadMessage(0, piecereader.NewBuffer(blob.Content[0:1]))))
+	d.completeNotifications.Wait()
+
+	require.True(d.Complete())
+	require.False(hasComplete(p.messages))
+}
+
+// blockingCompleteMessages blocks complete messages until unblock is closed.
+type blockingCompleteMessages struct {
+	*mockMessages
+	unblock chan struct{}
+}
+
+func (m blockingCompleteMessages) Send(msg *conn.Message) error {
+	if msg.Message.Type == p2p.Message_COMPLETE {
+		<-m.unblock
+	}
+	return m.mockMessages.Send(msg)
+}
+
+func numComplete(messages *mockMessages) int {
+	var n int
+	for _, m := range messages.getSent() {
+		if m.Message.Type == p2p.Message_COMPLETE {
+			n++
+		}
+	}
+	return n
+}
+
+func TestDispatcherCompleteNotifiesPeersAsynchronously(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(1, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	events := &recordingEvents{}
+	d := testDispatcher(Config{}, clock.NewMock(), torrent)
+	d.emitter = testEmitter(events, tally.NoopScope)
+
+	unblock := make(chan struct{})
+	var peers []*mockMessages
+	for i := 0; i < 1000; i++ {
+		m := newMockMessages()
+		_, err := d.addPeer(
+			core.PeerIDFixture(),
+			bitsetutil.FromBools(false),
+			blockingCompleteMessages{m, unblock})
+		require.NoError(err)
+		peers = append(peers, m)
+	}
+	p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true), newMockMessages())
+	require.NoError(err)
+
+	// The final piece is handled while every complete message is blocked.
+	msg := conn.NewPiecePayloadMessage(0, piecereader.NewBuffer(blob.Content[0:1]))
+	require.NoError(d.dispatch(p, msg))
+	require.True(d.Complete())
+
+	require.Eventually(func() bool {
+		return len(events.get()) == 1
+	}, time.Second, 5*time.Millisecond)
+	require.Equal([]string{"complete"}, events.get())
+	for _, m := range peers {
+		require.Equal(0, numComplete(m))
+	}
+
+	close(unblock)
+	d.TearDown()
+
+	for _, m := range peers {
+		require.Equal(1, numComplete(m))
+	}
+}
+
+func TestDispatcherCompletionTriggersNotifyEachPeerOnce(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		testDispatcherCompletionTriggersNotifyEachPeerOnce(t)
+	}
+}
+
+func testDispatcherCompletionTriggersNotifyEachPeerOnce(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(2, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	require.NoError(torrent.WritePiece(piecereader.NewBuffer(blob.Content[0:1]), 0))
+
+	events := &recordingEvents{}
+	logCore, logs := observer.New(zap.InfoLevel)
+	d, err := newDispatcher(
+		Config{ImmediateCompletedPeerClose: true},
+		tally.NoopScope,
+		clock.NewMock(),
+		networkevent.NewTestProducer(),
+		noopEvents{},
+		core.PeerIDFixture(),
+		torrent,
+		zap.New(logCore).Sugar(),
+		torrentlog.NewNopLogger())
+	require.NoError(err)
+	d.emitter = testEmitter(events, tally.NoopScope)
+
+	seeder, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, true), newMockMessages())
+	require.NoError(err)
+
+	const numAdders = 4
+	const peersPerAdder = 10
+
+	var mu sync.Mutex
+	var seeders, leechers []*peer
+	seeders = append(seeders, seeder)
+
+	errc := make(chan error, 3+numAdders)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(3 + numAdders)
+
+	// Payload-complete.
+	go func() {
+		defer wg.Done()
+		<-start
+		msg := conn.NewPiecePayloadMessage(1, piecereader.NewBuffer(blob.Content[1:2]))
+		errc <- d.dispatch(seeder, msg)
+	}()
+	// Out-of-band completion check.
+	go func() {
+		defer wg.Done()
+		<-start
+		for !torrent.HasPiece(1) {
+			runtime.Gosched()
+		}
+		d.NotifyPiecesWritten([]int{1})
+		errc <- nil
+	}()
+	// Construction-complete, i.e. the torrent completed before d was created.
+	go func() {
+		defer wg.Done()
+		<-start
+		for !torrent.Complete() {
+			runtime.Gosched()
+		}
+		d.complete()
+		errc <- nil
+	}()
+	for i := 0; i < numAdders; i++ {
+		go func() {
+			defer wg.Done()
+			<-start
+			for j := 0; j < peersPerAdder; j++ {
+				complete := j%2 == 0
+				p, err := d.addPeer(
+					core.PeerIDFixture(), bitsetutil.FromBools(complete, complete), newMockMessages())
+				if err != nil {
+					errc <- err
+					return
+				}
+				mu.Lock()
+				if complete {
+					seeders = append(seeders, p)
+				} else {
+					leechers = append(leechers, p)
+				}
+				mu.Unlock()
+			}
+			errc <- nil
+		}()
+	}
+	close(start)
+	wg.Wait()
+	close(errc)
+	for err := range errc {
+		require.NoError(err)
+	}
+	d.completeNotifications.Wait()
+
+	require.True(d.Complete())
+	require.Eventually(func() bool {
+		return len(events.get()) > 0
+	}, time.Second, time.Millisecond)
+	require.Equal([]string{"complete"}, events.get())
+
+	for _, p := range leechers {
+		require.True(numComplete(p.messages.(*mockMessages)) <= 1)
+	}
+	for _, p := range seeders {
+		require.True(closed(p.messages))
+	}
+	closes := make(map[string]int)
+	for _, e := range logs.FilterMessage("Closing connection to completed peer").All() {
+		closes[fmt.Sprint(e.ContextMap()["peer"])]++
+	}
+	require.Len(closes, len(seeders))
+	for _, n := range closes {
+		require.Equal(1, n)
+	}
+
+	d.TearDown()
+}
+
+func TestDispatcherClosesCompletedPeersWhenComplete(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(1, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(Config{ImmediateCompletedPeerClose: true}, clock.NewMock(), torrent)
+
+	completedPeer, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true), newMockMessages())
+	require.NoError(err)
+
+	incompletePeer, err := d.addPeer(
+		core.PeerIDFixture(), bitsetutil.FromBools(false), newMockMessages())
+	require.NoError(err)
+
+	msg := conn.NewPiecePayloadMessage(0, piecereader.NewBuffer(blob.Content[0:1]))
+
+	// Completed peers are closed when the dispatcher completes.
+	require.NoError(d.dispatch(completedPeer, msg))
+	d.completeNotifications.Wait()
+	require.True(closed(completedPeer.messages))
+	require.False(closed(incompletePeer.messages))
+
+	// Peers which send complete messages are closed if the dispatcher is complete.
+	require.NoError(d.dispatch(incompletePeer, conn.NewCompleteMessage()))
+	require.True(closed(incompletePeer.messages))
+}
+
+func TestDispatcherPeerSeederTransition(t *testing.T) {
+	triggers := []struct {
+		trigger string
+		has     []bool
+		run     func(d *Dispatcher, p *peer) error
+	}{
+		{_completedAtHandshake, []bool{true, true, true}, func(*Dispatcher, *peer) error {
+			return nil
+		}},
+		{_completedByAnnounce, []bool{true, true, false}, func(d *Dispatcher, p *peer) error {
+			return d.dispatch(p, conn.NewAnnouncePieceMessage(2))
+		}},
+		{_completedByComplete, []bool{false, false, false}, func(d *Dispatcher, p *peer) error {
+			return d.dispatch(p, conn.NewCompleteMessage())
+		}},
+	}
+	for _, test := range triggers {
+		for _, complete := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s/complete=%t", test.trigger, complete), func(t *testing.T) {
+				require := require.New(t)
+
+				blob := core.SizedBlobFixture(3, 1)
+
+				torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+				defer cleanup()
+
+				if complete {
+					for i := 0; i < 3; i++ {
+						require.NoError(torrent.WritePiece(
+							piecereader.NewBuffer(blob.Content[i:i+1]), i))
+					}
+				}
+
+				d := testDispatcher(Config{
+					PieceRequestPolicy:          piecerequest.RarestFirstPolicy,
+					ImmediateCompletedPeerClose: true,
+				}, clock.NewMock(), torrent)
+				stats := tally.NewTestScope("", nil)
+				d.stats = stats
+
+				p, err := d.addPeer(
+					core.PeerIDFixture(), bitsetutil.FromBools(test.has...), newMockMessages())
+				require.NoError(err)
+				require.NoError(test.run(d, p))
+
+				// Repeated completion signals do not transition p again.
+				require.NoError(d.dispatch(p, conn.NewCompleteMessage()))
+				require.NoError(d.dispatch(p, conn.NewAnnouncePieceMessage(2)))
+
+				require.Equal(1, d.NumSeeders())
+				require.True(p.bitfield.Complete())
+				require.Nil(p.useful)
+				for i := 0; i < 3; i++ {
+					require.Equal(1, d.numPeersByPiece.Get(i))
+				}
+				counters := stats.Snapshot().Counters()
+				for _, other := range triggers {
+					c, ok := counters["peer_completions+trigger="+other.trigger]
+					if other.trigger == test.trigger {
+						require.Equal(int64(1), c.Value())
+					} else {
+						require.False(ok)
+					}
+				}
+
+				// Seeders are sent no announces.
+				d.announcer.announce(p, 0)
+				require.Empty(announcedPieces(p.messages))
+
+				// Seeders are closed only if we are complete.
+				require.Equal(complete, closed(p.messages))
+
+				require.NoError(d.removePeer(p))
+				require.Equal(0, d.NumSeeders())
+			})
+		}
+	}
+}
+
+func TestDispatcherSuperseedRevealsDistinctPieces(t *testing.T) {
+	require := require.New(t)
+
+	config := Config{
+		Superseed:       true,
+		SuperseedPieces: 2,
+	}
+
+	blob := core.SizedBlobFixture(6, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	for i := 0; i < 6; i++ {
+		require.NoError(torrent.WritePiece(piecereader.NewBuffer(blob.Content[i:i+1]), i))
+	}
+
+	d := testDispatcher(config, clock.NewMock(), torrent)
+
+	// New peers are sent no pieces in their handshake.
+	require.Equal([]int{0, 1, 2, 3, 4, 5}, d.HiddenPieces())
+	require.Equal(uint(0), d.Stat().Bitfield().Count())
+
+	var peers []*peer
+	for i := 0; i < 3; i++ {
+		p, err := d.addPeer(core.PeerIDFixture(), bitset.New(6), newMockMessages())
+		require.NoError(err)
+		peers = append(peers, p)
+	}
+	require.Equal([]int{0, 1}, announcedPieces(peers[0].messages))
+	require.Equal([]int{2, 3}, announcedPieces(peers[1].messages))
+	require.Equal([]int{4, 5}, announcedPieces(peers[2].messages))
+
+	// Announcing a piece which was not revealed to the peer reveals nothing.
+	require.NoError(d.dispatch(peers[0], conn.NewAnnouncePieceMessage(4)))
+	require.Equal([]int{0, 1}, announcedPieces(peers[0].messages))
+
+	// Announcing a revealed piece back reveals the next piece the peer lacks.
+	require.NoError(d.dispatch(peers[0], conn.NewAnnouncePieceMessage(0)))
+	require.Equal([]int{0, 1, 2}, announcedPieces(peers[0].messages))
+
+	require.NoError(d.dispatch(peers[1], conn.NewAnnouncePieceMessage(3)))
+	require.Equal([]int{2, 3, 4}, announcedPieces(peers[1].messages))
+}
+
+func TestDispatcherSuperseedOffByDefault(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(2, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	for i := 0; i < 2; i++ {
+		require.NoError(torrent.WritePiece(piecereader.NewBuffer(blob.Content[i:i+1]), i))
+	}
+
+	d := testDispatcher(Config{}, clock.NewMock(), torrent)
+	require.Empty(d.HiddenPieces())
+	require.Equal(uint(2), d.Stat().Bitfield().Count())
+
+	p, err := d.addPeer(core.PeerIDFixture(), bitset.New(2), newMockMessages())
+	require.NoError(err)
+	require.Empty(announcedPieces(p.messages))
+}
+
+func TestDispatcherSuperseedOnlyWhenSeeding(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(2, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(Config{Superseed: true}, clock.NewMock(), torrent)
+	require.Nil(d.superseed)
+	require.Empty(d.HiddenPieces())
+}
+
+func teardownPhases(t *testing.T, d *Dispatcher) map[string]int64 {
+	for _, e := range d.netevents.(*networkevent.TestProducer).Events() {
+		if e.Name == networkevent.TorrentTeardown {
+			return e.PhasesMS
+		}
+	}
+	require.FailNow(t, "no teardown event")
+	return nil
+}
+
+func TestDispatcherPhases(t *testing.T) {
+	require := require.New(t)
+
+	config := Config{
+		EndgameThreshold: 1,
+	}
+	clk := clock.NewMock()
+
+	blob := core.SizedBlobFixture(4, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(config, clk, torrent)
+	stats := tally.NewTestScope("", nil)
+	d.stats = stats
+
+	writePiece := func(p *peer, i int) {
+		require.NoError(d.dispatch(
+			p, conn.NewPiecePayloadMessage(i, piecereader.NewBuffer(blob.Content[i:i+1]))))
+	}
+
+	clk.Add(time.Second)
+	p, err := d.addPeer(
+		core.PeerIDFixture(), bitsetutil.FromBools(true, true, true, true), newMockMessages())
+	require.NoError(err)
+
+	clk.Add(2 * time.Second)
+	writePiece(p, 0)
+
+	// Phases which have not ended are zero.
+	require.Equal(Phases{
+		ToFirstPeer:  time.Second,
+		ToFirstPiece: 2 * time.Second,
+	}, d.Phases())
+	require.Nil(d.Dump().Phases)
+
+	clk.Add(4 * time.Second)
+	writePiece(p, 1)
+	clk.Add(time.Second)
+	writePiece(p, 2) // Enters endgame.
+
+	clk.Add(2 * time.Second)
+	writePiece(p, 3)
+	require.True(d.Complete())
+
+	expected := Phases{
+		ToFirstPeer:  time.Second,
+		ToFirstPiece: 2 * time.Second,
+		Transfer:     5 * time.Second,
+		Endgame:      2 * time.Second,
+	}
+	require.Equal(expected, d.Phases())
+	require.Equal(&expected, d.Dump().Phases)
+
+	clk.Add(5 * time.Second)
+	d.TearDown()
+
+	expected.CompleteToTeardown = 5 * time.Second
+	require.Equal(expected, d.Phases())
+	require.Equal(map[string]int64{
+		"to_first_peer":        1000,
+		"to_first_piece":       2000,
+		"transfer":             5000,
+		"endgame":              2000,
+		"complete_to_teardown": 5000,
+	}, teardownPhases(t, d))
+
+	timers := stats.Snapshot().Timers()
+	for name, duration := range map[string]time.Duration{
+		"to_first_peer":        time.Second,
+		"to_first_piece":       2 * time.Second,
+		"transfer":             5 * time.Second,
+		"endgame":              2 * time.Second,
+		"complete_to_teardown": 5 * time.Second,
+	} {
+		timer, ok := timers["dispatcher_phase+phase="+name]
+		require.True(ok, name)
+		require.Equal([]time.Duration{duration}, timer.Values(), name)
+	}
+}
+
+func TestDispatcherPhasesCreatedComplete(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+
+	blob := core.SizedBlobFixture(1, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	require.NoError(torrent.WritePiece(piecereader.NewBuffer(blob.Content), 0))
+
+	d := testDispatcher(Config{}, clk, torrent)
+	require.Equal(Phases{}, d.Phases())
+	require.Equal(&Phases{}, d.Dump().Phases)
+
+	// Peers added after completion do not start any phase.
+	clk.Add(time.Second)
+	_, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false), newMockMessages())
+	require.NoError(err)
+
+	clk.Add(2 * time.Second)
+	d.TearDown()
+	require.Equal(Phases{CompleteToTeardown: 3 * time.Second}, d.Phases())
+}
+
+func TestDispatcherPhasesWithoutPeers(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+
+	blob := core.SizedBlobFixture(1, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(Config{}, clk, torrent)
+
+	clk.Add(5 * time.Second)
+	require.Equal(Phases{}, d.Phases())
+
+	// The whole lifetime was spent waiting for a peer.
+	d.TearDown()
+	require.Equal(Phases{ToFirstPeer: 5 * time.Second}, d.Phases())
+	require.Equal(int64(5000), teardownPhases(t, d)["to_first_peer"])
+}
+
+func TestDispatcherSequentialDownloadOrder(t *testing.T) {
+	require := require.New(t)
+
+	config := Config{
+		DownloadOrder: SequentialDownloadOrder,
+		PipelineLimit: 1,
+	}
+
+	blob := core.SizedBlobFixture(8, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(config, clock.NewMock(), torrent)
+
+	// download receives every piece requested from p, in order, until p has no
+	// more pieces to offer.
+	var completed []int
+	download := func(p *peer) {
+		d.maybeRequestMorePieces(p)
+		for n := 0; ; n++ {
+			requested := requestedPieces(p.messages)
+			if len(requested) == n {
+				return
+			}
+			i := requested[n]
+			require.NoError(d.dispatch(
+				p, conn.NewPiecePayloadMessage(i, piecereader.NewBuffer(blob.Content[i:i+1]))))
+			completed = append(completed, i)
+		}
+	}
+
+	// The first peer lacks pieces 2 and 5, which only the second peer has.
+	p1, err := d.addPeer(
+		core.PeerIDFixture(),
+		bitsetutil.FromBools(true, true, false, true, true, false, true, true),
+		newMockMessages())
+	require.NoError(err)
+	download(p1)
+	require.Equal([]int{0, 1, 3, 4, 6, 7}, completed)
+
+	p2, err := d.addPeer(
+		core.PeerIDFixture(),
+		bitsetutil.FromBools(false, false, true, false, false, true, false, false),
+		newMockMessages())
+	require.NoError(err)
+	download(p2)
+	require.Equal([]int{0, 1, 3, 4, 6, 7, 2, 5}, completed)
+	require.True(d.Complete())
+}
+
+func TestDispatcherSetPiecePriorities(t *testing.T) {
+	require := require.New(t)
+
+	config := Config{
+		PipelineLimit: 2,
+	}
+
+	blob := core.SizedBlobFixture(8, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	require.NoError(torrent.WritePiece(piecereader.NewBuffer(blob.Content[5:6]), 5))
+
+	d := testDispatcher(config, clock.NewMock(), torrent)
+
+	p, err := d.addPeer(
+		core.PeerIDFixture(),
+		bitsetutil.FromBools(true, true, true, true, true, true, true, true),
+		newMockMessages())
+	require.NoError(err)
+
+	// Pieces we already have and pieces out of bounds are ignored.
+	d.SetPiecePriorities([]PieceRange{{Start: 4, End: 6}, {Start: 7, End: 10}})
+	require.ElementsMatch([]int{4, 7}, requestedPieces(p.messages))
+
+	// Once the prioritized pieces complete, selection falls back to normal.
+	for _, i := range []int{4, 7} {
+		require.NoError(d.dispatch(
+			p, conn.NewPiecePayloadMessage(i, piecereader.NewBuffer(blob.Content[i:i+1]))))
+	}
+	require.Len(requestedPieces(p.messages), 4)
+}
+
+func TestDispatcherInvalidDownloadOrder(t *testing.T) {
+	blob := core.SizedBlobFixture(1, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	_, err := newDispatcher(
+		Config{DownloadOrder: "backwards"},
+		tally.NoopScope,
+		clock.NewMock(),
+		networkevent.NewTestProducer(),
+		noopEvents{},
+		core.PeerIDFixture(),
+		torrent,
+		zap.NewNop().Sugar(),
+		torrentlog.NewNopLogger())
+	require.Error(t, err)
+}
+
+func TestDispatcherHandleCompleteRequestsPieces(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(1, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(Config{}, clock.NewMock(), torrent)
+
+	p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false), newMockMessages())
+	require.NoError(err)
+
+	require.Empty(numRequestsPerPiece(p.messages))
+
+	require.NoError(d.dispatch(p, conn.NewCompleteMessage()))
+
+	require.Equal(map[int]int{0: 1}, numRequestsPerPiece(p.messages))
+	require.False(closed(p.messages))
+}
+
+func TestDispatcherPeerPieceCounts(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(3, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(Config{}, clock.NewMock(), torrent)
+
+	var err error
+
+	p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false, false, false), newMockMessages())
+	require.NoError(err)
+
+	require.Equal(0, d.numPeersByPiece.Get(0))
+	require.Equal(0, d.numPeersByPiece.Get(1))
+	require.Equal(0, d.numPeersByPiece.Get(2))
+
+	d.dispatch(p, conn.NewAnnouncePieceMessage(2))
+
+	require.Equal(1, d.numPeersByPiece.Get(2))
+
+	// Repeated announces count once.
+	d.dispatch(p, conn.NewAnnouncePieceMessage(0))
+	d.dispatch(p, conn.NewAnnouncePieceMessage(0))
+
+	require.Equal(1, d.numPeersByPiece.Get(0))
+
+	_, err = d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, true, true), newMockMessages())
+	require.NoError(err)
+
+	require.Equal(2, d.numPeersByPiece.Get(0))
+	require.Equal(1, d.numPeersByPiece.Get(1))
+	require.Equal(2, d.numPeersByPiece.Get(2))
+
+	_, err = d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, false, true), newMockMessages())
+	require.NoError(err)
+
+	require.Equal(3, d.numPeersByPiece.Get(0))
+	require.Equal(1, d.numPeersByPiece.Get(1))
+	require.Equal(3, d.numPeersByPiece.Get(2))
+
 	_, err = d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false, false, false), newMockMessages())
 	require.NoError(err)
 
-	require.Equal(4, d.numPeersByPiece.Get(0))
+	require.Equal(3, d.numPeersByPiece.Get(0))
+	require.Equal(1, d.numPeersByPiece.Get(1))
+	require.Equal(3, d.numPeersByPiece.Get(2))
+
+	d.removePeer(p)
+
+	require.Equal(2, d.numPeersByPiece.Get(0))
+	require.Equal(1, d.numPeersByPiece.Get(1))
+	require.Equal(2, d.numPeersByPiece.Get(2))
+}
+
+func TestDispatcherDeprioritizePiecesCancelsHedgedRequests(t *testing.T) {
+	require := require.New(t)
+
+	config := Config{
+		PipelineLimit:  2,
+		DisableEndgame: true,
+	}
+
+	torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(4, 1).MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(config, clock.NewMock(), torrent)
+
+	d.PrioritizePieces([]int{0, 1})
+
+	p1, err := d.addPeer(
+		core.PeerIDFixture(), bitsetutil.FromBools(true, true, true, true), newMockMessages())
+	require.NoError(err)
+	d.maybeRequestMorePieces(p1)
+	require.Equal(map[int]int{0: 1, 1: 1}, numRequestsPerPiece(p1.messages))
+
+	// Prioritized pieces are hedged to p2.
+	p2, err := d.addPeer(
+		core.PeerIDFixture(), bitsetutil.FromBools(true, true, true, true), newMockMessages())
+	require.NoError(err)
+	d.maybeRequestMorePieces(p2)
+	require.Equal(map[int]int{0: 1, 1: 1}, numRequestsPerPiece(p2.messages))
+
+	// Piece 3 was never prioritized.
+	d.DeprioritizePieces([]int{0, 1, 3})
+
+	require.Empty(cancelledPieces(p1.messages))
+	require.ElementsMatch([]int{0, 1}, cancelledPieces(p2.messages))
+
+	require.Equal([]int{0, 1}, d.pieceRequestManager.PendingPieces(p1.id))
+	require.Empty(d.pieceRequestManager.PendingPieces(p2.id))
+
+	// Repeated calls are no-ops.
+	d.DeprioritizePieces([]int{0, 1})
+	require.Len(cancelledPieces(p2.messages), 2)
+}
+
+func TestDispatcherDeprioritizeCompletedPieceIsNoop(t *testing.T) {
+	require := require.New(t)
+
+	config := Config{
+		PipelineLimit:  1,
+		DisableEndgame: true,
+	}
+
+	blob := core.SizedBlobFixture(2, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(config, clock.NewMock(), torrent)
+
+	d.PrioritizePieces([]int{0})
+
+	p1, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, true), newMockMessages())
+	require.NoError(err)
+	d.maybeRequestMorePieces(p1)
+
+	p2, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, true), newMockMessages())
+	require.NoError(err)
+	d.maybeRequestMorePieces(p2)
+
+	require.Equal(map[int]int{0: 1}, numRequestsPerPiece(p1.messages))
+	require.Equal(map[int]int{0: 1}, numRequestsPerPiece(p2.messages))
+
+	msg := conn.NewPiecePayloadMessage(0, piecereader.NewBuffer(blob.Content[0:1]))
+	require.NoError(d.dispatch(p1, msg))
+
+	// The superseded request to p2 is cancelled once p1 delivers the piece.
+	require.Equal([]int{0}, cancelledPieces(p2.messages))
+
+	d.DeprioritizePieces([]int{0})
+
+	require.Empty(cancelledPieces(p1.messages))
+	require.Equal([]int{0}, cancelledPieces(p2.messages))
+}
+
+func TestDispatcherDeprioritizeConcurrentWithPayloads(t *testing.T) {
+	require := require.New(t)
+
+	config := Config{
+		PipelineLimit:  8,
+		DisableEndgame: true,
+	}
+
+	blob := core.SizedBlobFixture(8, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(config, clock.NewMock(), torrent)
+
+	all := []int{0, 1, 2, 3, 4, 5, 6, 7}
+	d.PrioritizePieces(all)
+
+	var peers []*peer
+	for i := 0; i < 2; i++ {
+		p, err := d.addPeer(
+			core.PeerIDFixture(), bitsetutil.FromBools(make([]bool, 8)...).Complement(), newMockMessages())
+		require.NoError(err)
+		d.maybeRequestMorePieces(p)
+		peers = append(peers, p)
+	}
+	for _, p := range peers {
+		require.Len(numRequestsPerPiece(p.messages), 8)
+	}
+
+	// Payloads for the hedged pieces arrive from both peers while the pieces
+	// are deprioritized.
+	var wg sync.WaitGroup
+	for _, p := range peers {
+		wg.Add(1)
+		go func(p *peer) {
+			defer wg.Done()
+			for _, i := range all {
+				d.dispatch(p, conn.NewPiecePayloadMessage(i, piecereader.NewBuffer(blob.Content[i:i+1])))
+			}
+		}(p)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for _, i := range all {
+			d.DeprioritizePieces([]int{i})
+		}
+	}()
+	wg.Wait()
+
+	require.True(d.Complete())
+	for _, p := range peers {
+		require.Empty(d.pieceRequestManager.PendingPieces(p.id))
+
+		// Each piece is cancelled at most once per peer.
+		seen := make(map[int]bool)
+		for _, i := range cancelledPieces(p.messages) {
+			require.False(seen[i])
+			seen[i] = true
+		}
+	}
+}
+
+func TestDispatcherExcludesAsymmetricPeersFromPieceSelection(t *testing.T) {
+	require := require.New(t)
+
+	config := Config{
+		PipelineLimit:                    1,
+		DisableEndgame:                   true,
+		EnableAsymmetricPeerDetection:    true,
+		AsymmetricPeerMinPiecesSent:      1,
+		AsymmetricPeerMinExpiredRequests: 2,
+		AsymmetricPeerProbeInterval:      time.Minute,
+	}
+	clk := clock.NewMock()
+
+	blob := core.SizedBlobFixture(2, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(config, clk, torrent)
+
+	seeder, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, false), newMockMessages())
+	require.NoError(err)
+	require.NoError(d.dispatch(
+		seeder, conn.NewPiecePayloadMessage(0, piecereader.NewBuffer(blob.Content[0:1]))))
+
+	p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false, true), newMockMessages())
+	require.NoError(err)
+
+	expire := func() {
+		clk.Add(d.pieceRequestTimeout + 1)
+		d.resendFailedPieceRequests()
+	}
+
+	// We serve p, but our requests to p expire. Expirations are consecutive
+	// even though the same piece is requested each time.
+	require.NoError(d.dispatch(p, conn.NewPieceRequestMessage(0, 1)))
+	waitForServes(t, p)
+	d.maybeRequestMorePieces(p)
+	expire()
+	require.False(p.isAsymmetric())
+	d.maybeRequestMorePieces(p)
+	require.Equal(map[int]int{1: 2}, numRequestsPerPiece(p.messages))
+	expire()
+
+	require.True(p.isAsymmetric())
+	require.Equal(int32(1), d.numAsymmetricPeers.Load())
+	stats, ok := d.PeerStats(p.id)
+	require.True(ok)
+	require.True(stats.Asymmetric)
+
+	// p is excluded from piece selection...
+	d.maybeRequestMorePieces(p)
+	require.Equal(map[int]int{1: 2}, numRequestsPerPiece(p.messages))
+
+	// ...but is still served.
+	require.NoError(d.dispatch(p, conn.NewPieceRequestMessage(0, 1)))
+	waitForServes(t, p)
+	require.Equal(2, p.pstats.getPiecesSent())
+
+	// p is probed once the probe interval elapsed, and a single expired probe
+	// excludes it again.
+	clk.Add(time.Minute)
+	d.maybeRequestMorePieces(p)
+	require.Equal(map[int]int{1: 3}, numRequestsPerPiece(p.messages))
+	require.False(p.isAsymmetric())
+	expire()
+	require.True(p.isAsymmetric())
+	d.maybeRequestMorePieces(p)
+	require.Equal(map[int]int{1: 3}, numRequestsPerPiece(p.messages))
+
+	// Receiving a good piece from p clears the flag.
+	require.NoError(d.dispatch(
+		p, conn.NewPiecePayloadMessage(1, piecereader.NewBuffer(blob.Content[1:2]))))
+	require.False(p.isAsymmetric())
+	require.Equal(int32(0), d.numAsymmetricPeers.Load())
+	stats, ok = d.PeerStats(p.id)
+	require.True(ok)
+	require.False(stats.Asymmetric)
+}
+
+func TestDispatcherAsymmetricPeerDetectionIsOptIn(t *testing.T) {
+	require := require.New(t)
+
+	config := Config{
+		PipelineLimit:                    1,
+		DisableEndgame:                   true,
+		AsymmetricPeerMinPiecesSent:      1,
+		AsymmetricPeerMinExpiredRequests: 1,
+	}
+	clk := clock.NewMock()
+
+	blob := core.SizedBlobFixture(2, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(config, clk, torrent)
+
+	seeder, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, false), newMockMessages())
+	require.NoError(err)
+	require.NoError(d.dispatch(
+		seeder, conn.NewPiecePayloadMessage(0, piecereader.NewBuffer(blob.Content[0:1]))))
+
+	p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false, true), newMockMessages())
+	require.NoError(err)
+
+	require.NoError(d.dispatch(p, conn.NewPieceRequestMessage(0, 1)))
+	waitForServes(t, p)
+	d.maybeRequestMorePieces(p)
+	clk.Add(d.pieceRequestTimeout + 1)
+	d.resendFailedPieceRequests()
+
+	require.False(p.isAsymmetric())
+	d.maybeRequestMorePieces(p)
+	require.Equal(map[int]int{1: 2}, numRequestsPerPiece(p.messages))
+}
+
+// slowTorrent advances a mock clock when reading slow pieces.
+type slowTorrent struct {
+	storage.Torrent
+	clk *clock.Mock
+
+	mu    sync.Mutex
+	delay map[int]time.Duration
+}
+
+func (t *slowTorrent) setDelay(piece int, d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.delay[piece] = d
+}
+
+func (t *slowTorrent) GetPieceReader(piece int) (storage.PieceReader, error) {
+	t.mu.Lock()
+	d := t.delay[piece]
+	t.mu.Unlock()
+
+	t.clk.Add(d)
+	return t.Torrent.GetPieceReader(piece)
+}
+
+func TestDispatcherTracksSlowestServes(t *testing.T) {
+	require := require.New(t)
+
+	config := Config{
+		NumSlowestServes:   2,
+		SlowServeThreshold: time.Second,
+		SlowServeLimit:     2,
+	}
+	clk := clock.NewMock()
+
+	blob := core.SizedBlobFixture(4, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	for i := 0; i < 4; i++ {
+		require.NoError(torrent.WritePiece(piecereader.NewBuffer(blob.Content[i:i+1]), i))
+	}
+
+	d := testDispatcher(config, clk, &slowTorrent{
+		Torrent: torrent,
+		clk:     clk,
+		delay: map[int]time.Duration{
+			0: 10 * time.Millisecond,
+			1: 5 * time.Second,
+			2: 3 * time.Second,
+			3: 20 * time.Millisecond,
+		},
+	})
+	stats := tally.NewTestScope("", nil)
+	d.stats = stats
+
+	p, err := d.addPeer(
+		core.PeerIDFixture(), bitsetutil.FromBools(false, false, false, false), newMockMessages())
+	require.NoError(err)
+
+	for i := 0; i < 4; i++ {
+		require.NoError(d.dispatch(p, conn.NewPieceRequestMessage(i, 1)))
+		waitForServes(t, p)
+	}
+
+	require.Equal([]ServeLatency{
+		{Piece: 1, Duration: 5 * time.Second},
+		{Piece: 2, Duration: 3 * time.Second},
+	}, d.SlowestServes())
+
+	// Pieces are still advertised until they exceed the slow serve limit.
+	require.Equal(4, p.pstats.getPiecesSent())
+	require.Empty(d.UnadvertisedPieces())
+
+	require.NoError(d.dispatch(p, conn.NewPieceRequestMessage(1, 1)))
+	waitForServes(t, p)
+	require.Equal([]int{1}, d.UnadvertisedPieces())
+	require.Equal(
+		int64(1), stats.Snapshot().Counters()["unadvertised_slow_pieces+"].Value())
+
+	// Unadvertised pieces are excluded from the bitfield sent to new peers, and
+	// exposed in the dump.
+	require.Equal(bitsetutil.FromBools(true, false, true, true), d.Stat().Bitfield())
+	dump := d.Dump()
+	require.Equal([]int{1}, dump.UnadvertisedPieces)
+	require.Equal(d.SlowestServes(), dump.SlowestServes)
+
+	// Peers which already know of piece 1 are still served.
+	require.NoError(d.dispatch(p, conn.NewPieceRequestMessage(1, 1)))
+	waitForServes(t, p)
+	require.Equal(6, p.pstats.getPiecesSent())
+	for _, msg := range p.messages.(*mockMessages).getSent() {
+		require.NotEqual(p2p.Message_ERROR, msg.Message.Type)
+	}
+}
+
+func TestDispatcherReadvertisesRecoveredSlowPieces(t *testing.T) {
+	require := require.New(t)
+
+	config := Config{
+		SlowServeThreshold:        time.Second,
+		SlowServeLimit:            1,
+		SlowServeRecoveryInterval: time.Minute,
+	}
+	clk := clock.NewMock()
+
+	blob := core.SizedBlobFixture(2, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	for i := 0; i < 2; i++ {
+		require.NoError(torrent.WritePiece(piecereader.NewBuffer(blob.Content[i:i+1]), i))
+	}
+
+	st := &slowTorrent{
+		Torrent: torrent,
+		clk:     clk,
+		delay:   map[int]time.Duration{0: 2 * time.Second, 1: 2 * time.Second},
+	}
+	d := testDispatcher(config, clk, st)
+	stats := tally.NewTestScope("", nil)
+	d.stats = stats
+
+	p1, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false, false), newMockMessages())
+	require.NoError(err)
+	p2, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false, false), newMockMessages())
+	require.NoError(err)
+
+	for i := 0; i < 2; i++ {
+		require.NoError(d.dispatch(p1, conn.NewPieceRequestMessage(i, 1)))
+		waitForServes(t, p1)
+	}
+	require.Equal([]int{0, 1}, d.UnadvertisedPieces())
+
+	// A fast serve re-advertises piece 0 to peers which lack it.
+	st.setDelay(0, 10*time.Millisecond)
+	require.NoError(d.dispatch(p1, conn.NewPieceRequestMessage(0, 1)))
+	waitForServes(t, p1)
+	require.Equal([]int{1}, d.UnadvertisedPieces())
+	require.Equal([]int{0}, announcedPieces(p2.messages))
+	require.Empty(announcedPieces(p1.messages))
+
+	// Piece 1 is re-advertised once the recovery interval elapses.
+	clk.Add(time.Minute)
+	require.Empty(d.UnadvertisedPieces())
+	require.Equal([]int{0, 1}, announcedPieces(p2.messages))
+	require.Equal(int64(2), stats.Snapshot().Counters()["readvertised_slow_pieces+"].Value())
+}
+
+// chunkedPieceReader reads a piece in fixed size chunks, invoking onRead before
+// each chunk.
+type chunkedPieceReader struct {
+	storage.PieceReader
+	chunkSize int
+	onRead    func()
+}
+
+func (r *chunkedPieceReader) Read(p []byte) (int, error) {
+	r.onRead()
+	if len(p) > r.chunkSize {
+		p = p[:r.chunkSize]
+	}
+	return r.PieceReader.Read(p)
+}
+
+func TestDispatcherProgressIncludesPartialPieces(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(128, 64)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(Config{}, clock.NewMock(), torrent)
+
+	p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, true), newMockMessages())
+	require.NoError(err)
+
+	receive := func(i int, content []byte) ([]int64, error) {
+		var progress []int64
+		pr := &chunkedPieceReader{
+			PieceReader: piecereader.NewBuffer(content),
+			chunkSize:   8,
+			onRead:      func() { progress = append(progress, d.completedBytes()) },
+		}
+		err := d.dispatch(p, conn.NewPiecePayloadMessage(i, pr))
+		for j := 1; j < len(progress); j++ {
+			require.True(progress[j] > progress[j-1], "progress not increasing: %v", progress)
+		}
+		return progress, err
+	}
+
+	// Corrupt payloads are rolled back once they fail verification.
+	corrupt := make([]byte, 64)
+	progress, err := receive(0, corrupt)
+	require.Equal(ErrorValidation, Category(err))
+	require.True(len(progress) > 1)
+	require.Equal(int64(56), progress[len(progress)-2])
+	require.Equal(int64(0), d.completedBytes())
+
+	_, err = receive(0, blob.Content[:64])
+	require.NoError(err)
+	require.Equal(int64(64), d.completedBytes())
+
+	progress, err = receive(1, blob.Content[64:])
+	require.NoError(err)
+	require.Equal(int64(64), progress[0])
+	require.Equal(int64(128), d.completedBytes())
+}
+
+func TestDispatcherPieceVerifier(t *testing.T) {
+	blob := core.SizedBlobFixture(8, 8)
+	other := core.SizedBlobFixture(8, 8)
+
+	hashes := []struct {
+		desc    string
+		newHash func() hash.Hash
+	}{
+		{"sha256", sha256.New},
+		{"md5", md5.New},
+	}
+	tests := []struct {
+		desc      string
+		chunkSize int64
+		content   []byte
+		accepted  bool
+	}{
+		{"piece verified", 0, blob.Content, true},
+		{"piece rejected", 0, other.Content, false},
+		{"chunks verified", 4, blob.Content, true},
+		{"chunks rejected", 4, other.Content, false},
+	}
+	for _, h := range hashes {
+		for _, test := range tests {
+			t.Run(h.desc+" "+test.desc, func(t *testing.T) {
+				require := require.New(t)
+
+				torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+				defer cleanup()
+
+				config := Config{
+					ChunkSize:     test.chunkSize,
+					PieceVerifier: storage.PieceVerifierFixture(h.newHash, test.content),
+				}
+				d := testDispatcher(config, clock.NewMock(), torrent)
+
+				p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true), newMockMessages())
+				require.NoError(err)
+
+				_, err = d.maybeRequestMorePieces(p)
+				require.NoError(err)
+
+				if test.chunkSize == 0 {
+					err = d.dispatch(p, conn.NewPiecePayloadMessage(0, piecereader.NewBuffer(blob.Content)))
+				} else {
+					require.NoError(d.dispatch(p, chunkPayloadMessage(0, 0, blob.Content[:4])))
+					err = d.dispatch(p, chunkPayloadMessage(0, 4, blob.Content[4:]))
+				}
+
+				require.Equal(test.accepted, torrent.HasPiece(0))
+				stats, ok := d.PeerStats(p.id)
+				require.True(ok)
+				if test.accepted {
+					require.NoError(err)
+					require.Equal(0, stats.InvalidPiecesReceived)
+				} else {
+					require.Equal(ErrorValidation, Category(err))
+					require.Equal(1, stats.InvalidPiecesReceived)
+					require.Equal(int64(0), d.completedBytes())
+				}
+			})
+		}
+	}
+}
+
+func TestDispatcherSampledServeVerification(t *testing.T) {
+	blob := core.SizedBlobFixture(8, 2)
+	other := core.SizedBlobFixture(8, 2)
+
+	tests := []struct {
+		desc     string
+		verifier storage.PieceVerifierFactory
+		failures int
+	}{
+		{"metainfo checksums", nil, 0},
+		{"sha256 verifier", storage.PieceVerifierFixture(sha256.New, blob.Content), 0},
+		{"corrupt sha256", storage.PieceVerifierFixture(sha256.New, other.Content), 2},
+		{"corrupt md5", storage.PieceVerifierFixture(md5.New, other.Content), 2},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+
+			torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+			defer cleanup()
+			for i := 0; i < 4; i++ {
+				require.NoError(torrent.WritePiece(piecereader.NewBuffer(blob.Content[2*i:2*i+2]), i))
+			}
+
+			stats := tally.NewTestScope("", nil)
+			config := Config{
+				PieceVerifier:       test.verifier,
+				ServeVerifyInterval: 2,
+			}
+			d, err := newDispatcher(
+				config, stats, clock.NewMock(), networkevent.NewTestProducer(), noopEvents{},
+				core.PeerIDFixture(), torrent, zap.NewNop().Sugar(), torrentlog.NewNopLogger())
+			require.NoError(err)
+
+			messages := newMockMessages()
+			p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false, false, false, false), messages)
+			require.NoError(err)
+
+			for i := 0; i < 4; i++ {
+				require.NoError(d.dispatch(p, conn.NewPieceRequestMessage(i, 2)))
+			}
+			waitForServes(t, p)
+
+			var failed []int
+			for _, msg := range messages.getSent() {
+				if msg.Message.Type == p2p.Message_ERROR {
+					failed = append(failed, int(msg.Message.Error.Index))
+				}
+			}
+			// Every second serve is verified.
+			if test.failures > 0 {
+				require.Equal([]int{1, 3}, failed)
+			} else {
+				require.Empty(failed)
+			}
+			counters := stats.Snapshot().Counters()
+			require.Equal(int64(2), counters["verified_serves+module=dispatch,size_bucket=under_10MB"].Value())
+			if c, ok := counters["corrupt_served_pieces+module=dispatch,size_bucket=under_10MB"]; ok {
+				require.Equal(int64(test.failures), c.Value())
+			} else {
+				require.Zero(test.failures)
+			}
+		})
+	}
+}
+
+func TestNewDispatcherPieceVerifierError(t *testing.T) {
+	require := require.New(t)
+
+	torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(1, 1).MetaInfo)
+	defer cleanup()
+
+	config := Config{
+		PieceVerifier: func(*storage.TorrentInfo) (storage.PieceVerifier, error) {
+			return nil, errors.New("some error")
+		},
+	}
+	_, err := newDispatcher(
+		config,
+		tally.NoopScope,
+		clock.NewMock(),
+		networkevent.NewTestProducer(),
+		noopEvents{},
+		core.PeerIDFixture(),
+		torrent,
+		zap.NewNop().Sugar(),
+		torrentlog.NewNopLogger())
+	require.Error(err)
+}
+
+func TestDispatcherTimestampsFollowClock(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(4, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	// The clock never advances, so any timestamp not taken from it differs.
+	clk := clock.NewMock()
+	clk.Set(time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC))
+	now := clk.Now()
+
+	netevents := networkevent.NewTestProducer()
+	logCore, logs := observer.New(zap.DebugLevel)
+
+	d, err := newDispatcher(
+		Config{PipelineLimit: 4},
+		tally.NoopScope,
+		clk,
+		netevents,
+		noopEvents{},
+		core.PeerIDFixture(),
+		torrent,
+		zap.New(logCore).Sugar(),
+		torrentlog.NewNopLogger())
+	require.NoError(err)
+
+	seeder, err := d.addPeer(
+		core.PeerIDFixture(), bitsetutil.FromBools(true, true, true, true), newMockMessages())
+	require.NoError(err)
+	leecher, err := d.addPeer(
+		core.PeerIDFixture(), bitsetutil.FromBools(false, false, false, false), newMockMessages())
+	require.NoError(err)
+
+	_, err = d.maybeRequestMorePieces(seeder)
+	require.NoError(err)
+	for i := 0; i < 4; i++ {
+		require.NoError(d.dispatch(seeder, conn.NewPiecePayloadMessage(
+			i, piecereader.NewBuffer(blob.Content[i:i+1]))))
+	}
+	require.True(d.Complete())
+
+	require.NoError(d.dispatch(leecher, conn.NewPieceRequestMessage(0, 1)))
+	waitForServes(t, leecher)
+
+	events := netevents.Events()
+	require.Len(networkevent.Filter(events, networkevent.RequestPiece), 4)
+	require.Len(networkevent.Filter(events, networkevent.ReceivePiece), 4)
+	for _, e := range events {
+		require.Equal(now, e.Time, "event %s", e.JSON())
+	}
+
+	for _, entry := range logs.All() {
+		enc := zapcore.NewMapObjectEncoder()
+		for _, f := range entry.Context {
+			f.AddTo(enc)
+		}
+		for k, v := range enc.Fields {
+			if ts, ok := v.(time.Time); ok {
+				require.Equal(now, ts, "log %q field %s", entry.Message, k)
+			}
+		}
+	}
+
+	require.Equal(now, d.CreatedAt())
+	require.Equal(now, d.LastReadTime())
+	require.Equal(now, d.LastWriteTime())
+	require.Equal(now, d.LastGoodPieceReceived(seeder.id))
+	require.Equal(now, d.LastPieceSent(leecher.id))
+}
+
+func TestDispatcherFinalReason(t *testing.T) {
+	tests := []struct {
+		desc     string
+		teardown func(*Dispatcher)
+		expected TearDownReason
+	}{
+		{"legacy", func(d *Dispatcher) { d.TearDown() }, TearDownUnspecified},
+		{"idle", func(d *Dispatcher) { d.TearDownWithReason(TearDownIdle) }, TearDownIdle},
+		{"removed", func(d *Dispatcher) { d.TearDownWithReason(TearDownRemoved) }, TearDownRemoved},
+		{"shutdown", func(d *Dispatcher) { d.TearDownWithReason(TearDownShutdown) }, TearDownShutdown},
+		{"completed", func(d *Dispatcher) { d.TearDownWithReason(TearDownCompleted) }, TearDownCompleted},
+		{"corruption", func(d *Dispatcher) { d.TearDownWithReason(TearDownCorruption) }, TearDownCorruption},
+		{"deadline", func(d *Dispatcher) { d.TearDownWithReason(TearDownDeadline) }, TearDownDeadline},
+		{"first reason wins", func(d *Dispatcher) {
+			d.TearDownWithReason(TearDownIdle)
+			d.TearDownWithReason(TearDownShutdown)
+		}, TearDownIdle},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+
+			torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(1, 1).MetaInfo)
+			defer cleanup()
+
+			d := testDispatcher(Config{}, clock.NewMock(), torrent)
+
+			_, ok := d.FinalReason()
+			require.False(ok)
+			require.Empty(d.Dump().FinalReason)
+
+			test.teardown(d)
+
+			reason, ok := d.FinalReason()
+			require.True(ok)
+			require.Equal(test.expected, reason)
+			require.Equal(test.expected.String(), d.Dump().FinalReason)
+
+			// The teardown lifecycle event is produced once, with the final reason.
+			var teardowns []string
+			for _, e := range d.netevents.(*networkevent.TestProducer).Events() {
+				if e.Name == networkevent.TorrentTeardown {
+					teardowns = append(teardowns, e.Reason)
+				}
+			}
+			require.Equal([]string{test.expected.String()}, teardowns)
+		})
+	}
+}
+
+func TestDispatcherFailsOnCorruptPieces(t *testing.T) {
+	blob := core.SizedBlobFixture(8, 2)
+	other := core.SizedBlobFixture(8, 2)
+
+	tests := []struct {
+		desc      string
+		chunkSize int64
+	}{
+		{"streaming", 0},
+		{"chunked", 1},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+
+			torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+			defer cleanup()
+
+			events := &recordingEvents{}
+			d := testDispatcher(Config{MaxCorruptPieces: 1, ChunkSize: test.chunkSize}, clock.NewMock(), torrent)
+			d.emitter = testEmitter(events, tally.NoopScope)
+
+			p, err := d.addPeer(
+				core.PeerIDFixture(), bitsetutil.FromBools(true, true, true, true), newMockMessages())
+			require.NoError(err)
+
+			corrupt := func(i int) {
+				b := other.Content[2*i : 2*i+2]
+				if test.chunkSize == 0 {
+					require.Equal(ErrorValidation, Category(
+						d.dispatch(p, conn.NewPiecePayloadMessage(i, piecereader.NewBuffer(b)))))
+				} else {
+					require.NoError(d.dispatch(p, chunkPayloadMessage(i, 0, b[:1])))
+					require.Equal(ErrorValidation, Category(d.dispatch(p, chunkPayloadMessage(i, 1, b[1:]))))
+				}
+			}
+
+			_, err = d.maybeRequestMorePieces(p)
+			require.NoError(err)
+
+			// The first corrupt piece is tolerated.
+			corrupt(0)
+			require.Equal(1, d.Dump().CorruptPieces)
+			require.Never(func() bool { return len(events.get()) > 0 }, 50*time.Millisecond, 5*time.Millisecond)
+
+			// Failure is only notified once.
+			corrupt(1)
+			corrupt(2)
+			require.Eventually(func() bool {
+				return len(events.get()) == 1
+			}, time.Second, 5*time.Millisecond)
+			require.Equal([]string{"failed:corruption"}, events.get())
+		})
+	}
+}
+
+func TestDispatcherBansPeerAfterInvalidPieces(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(16, 2)
+	other := core.SizedBlobFixture(16, 2)
+
+	clk := clock.NewMock()
+	stats := tally.NewTestScope("", nil)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	config := Config{
+		MaxInvalidPieces:   2,
+		InvalidPieceWindow: time.Minute,
+	}
+	events := &recordingEvents{}
+	d := testDispatcher(config, clk, torrent)
+	d.stats = stats
+	d.emitter = testEmitter(events, tally.NoopScope)
+
+	all := bitsetutil.FromBools(true, true, true, true, true, true, true, true)
+	p, err := d.addPeer(core.PeerIDFixture(), all, newMockMessages())
+	require.NoError(err)
+	seeder, err := d.addPeer(core.PeerIDFixture(), all, newMockMessages())
+	require.NoError(err)
+
+	send := func(p *peer, i int, b *core.BlobFixture) error {
+		return d.dispatch(
+			p, conn.NewPiecePayloadMessage(i, piecereader.NewBuffer(b.Content[2*i:2*i+2])))
+	}
+	sendInvalid := func(p *peer, i int) {
+		require.Equal(ErrorValidation, Category(send(p, i, other)))
+	}
+
+	// Invalid pieces only count within the window.
+	sendInvalid(p, 0)
+	clk.Add(time.Minute)
+	sendInvalid(p, 1)
+	sendInvalid(p, 2)
+
+	// Pieces which another peer delivered first are not invalid.
+	require.NoError(send(seeder, 3, blob))
+	require.NoError(send(p, 3, blob))
+	require.NoError(send(p, 3, other))
+
+	require.Equal(3, p.stats().InvalidPiecesReceived)
+	require.False(p.messages.(*mockMessages).isClosed())
+	require.Nil(stats.Snapshot().Counters()["banned_peers+"])
+
+	// The third invalid piece within the window bans p.
+	sendInvalid(p, 4)
+	require.True(p.messages.(*mockMessages).isClosed())
+	_, ok := d.peers.Load(p.id)
+	require.False(ok)
+	require.Equal(int64(1), stats.Snapshot().Counters()["banned_peers+"].Value())
+
+	require.Eventually(func() bool {
+		return len(events.get()) == 2
+	}, time.Second, 5*time.Millisecond)
+	require.Equal([]string{"removed:" + p.id.String(), "banned:" + p.id.String()}, events.get())
+
+	var bans []string
+	for _, e := range d.netevents.(*networkevent.TestProducer).Events() {
+		if e.Name == networkevent.BanPeer {
+			bans = append(bans, e.Peer)
+		}
+	}
+	require.Equal([]string{p.id.String()}, bans)
+
+	// The seeder is unaffected.
+	require.False(seeder.messages.(*mockMessages).isClosed())
+}
+
+func TestDispatcherAddPeerRejectsBitfieldOfWrongLength(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(8, 2)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(Config{}, clock.NewMock(), torrent)
+
+	for _, b := range []*bitset.BitSet{
+		bitsetutil.FromBools(true, true, true),
+		bitsetutil.FromBools(false, false, false, false, false),
+	} {
+		_, err := d.addPeer(core.PeerIDFixture(), b, newMockMessages())
+		require.Equal(&bitfieldLengthError{b.Len(), 4}, err)
+	}
+	require.Empty(d.RemoteBitfields())
+	for i := 0; i < 4; i++ {
+		require.Equal(0, d.numPeersByPiece.Get(i))
+	}
+}
+
+func TestDispatcherBansPeerAfterProtocolViolations(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(8, 2)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	stats := tally.NewTestScope("", nil)
+	events := &recordingEvents{}
+	d := testDispatcher(Config{MaxProtocolViolations: 2}, clock.NewMock(), torrent)
+	d.stats = stats
+	d.emitter = testEmitter(events, tally.NoopScope)
+
+	p, err := d.addPeer(
+		core.PeerIDFixture(), bitsetutil.FromBools(false, false, false, false), newMockMessages())
+	require.NoError(err)
+
+	// An announcement which is partially out of range is rejected as a whole.
+	msg, err := conn.NewAnnouncePiecesMessage(bitsetutil.FromBools(true, false, false, false, true))
+	require.NoError(err)
+	require.Equal(ErrorProtocolViolation, Category(d.dispatch(p, msg)))
+	require.Equal(ErrorProtocolViolation, Category(d.dispatch(p, conn.NewAnnouncePieceMessage(-1))))
+
+	require.Equal("0000", p.bitfield.String())
+	require.Equal(0, d.numPeersByPiece.Get(0))
+	require.Equal(2, p.stats().ProtocolViolations)
+	require.False(p.messages.(*mockMessages).isClosed())
+
+	// In range announcements are unaffected.
+	require.NoError(d.dispatch(p, conn.NewAnnouncePieceMessage(1)))
+	require.Equal("0100", p.bitfield.String())
+
+	// The third violation bans p.
+	require.Equal(ErrorProtocolViolation, Category(d.dispatch(p, conn.NewAnnouncePieceMessage(4))))
+	require.True(p.messages.(*mockMessages).isClosed())
+	_, ok := d.peers.Load(p.id)
+	require.False(ok)
+
+	counters := stats.Snapshot().Counters()
+	require.Equal(int64(3), counters["protocol_violations+"].Value())
+	require.Equal(int64(1), counters["banned_peers+"].Value())
+
+	require.Eventually(func() bool {
+		return len(events.get()) == 2
+	}, time.Second, 5*time.Millisecond)
+	require.Equal([]string{"removed:" + p.id.String(), "banned:" + p.id.String()}, events.get())
+}
+
+func TestDispatcherFailsOnDownloadDeadline(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(2, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	clk := clock.NewMock()
+	events := &recordingEvents{}
+	d := testDispatcher(Config{DownloadDeadline: time.Minute}, clk, torrent)
+	d.emitter = testEmitter(events, tally.NoopScope)
+
+	done := make(chan struct{})
+	go func() {
+		d.watchDeadline()
+		close(done)
+	}()
+
+	require.Eventually(func() bool {
+		clk.Add(time.Second)
+		return len(events.get()) == 1
+	}, time.Second, time.Millisecond)
+	require.Equal([]string{"failed:deadline"}, events.get())
+	<-done
+	require.True(clk.Now().Sub(d.CreatedAt()) >= time.Minute)
+}
+
+func TestDispatcherMeetsDownloadDeadline(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(1, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	clk := clock.NewMock()
+	events := &recordingEvents{}
+	d := testDispatcher(Config{DownloadDeadline: time.Minute}, clk, torrent)
+	d.emitter = testEmitter(events, tally.NoopScope)
+
+	done := make(chan struct{})
+	go func() {
+		d.watchDeadline()
+		close(done)
+	}()
+
+	p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true), newMockMessages())
+	require.NoError(err)
+	require.NoError(d.dispatch(
+		p, conn.NewPiecePayloadMessage(0, piecereader.NewBuffer(blob.Content))))
+	require.True(d.Complete())
+
+	// Completion stops the deadline.
+	<-done
+	clk.Add(time.Hour)
+	require.Eventually(func() bool {
+		return len(events.get()) > 0
+	}, time.Second, 5*time.Millisecond)
+	require.Equal("complete", events.get()[0])
+	require.NotContains(events.get(), "failed:deadline")
+}
+
+func TestDispatcherNoPendingRequestsForRemovedPeers(t *testing.T) {
+	require := require.New(t)
+
+	torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(8, 1).MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(Config{PipelineLimit: 8}, clock.NewMock(), torrent)
+
+	for i := 0; i < 200; i++ {
+		p, err := d.addPeer(core.PeerIDFixture(), bitset.New(8).Complement(), newMockMessages())
+		require.NoError(err)
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			d.maybeRequestMorePieces(p)
+		}()
+		go func() {
+			defer wg.Done()
+			require.NoError(d.removePeer(p))
+		}()
+		wg.Wait()
+
+		require.Empty(d.pieceRequestManager.PendingPieces(p.id))
+	}
+}
+
+func TestDispatcherResendsRequestsOfDepartedPeers(t *testing.T) {
+	require := require.New(t)
+
+	torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(1, 1).MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(Config{}, clock.NewMock(), torrent)
+
+	p1, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true), newMockMessages())
+	require.NoError(err)
+	_, err = d.maybeRequestMorePieces(p1)
+	require.NoError(err)
+
+	p2, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true), newMockMessages())
+	require.NoError(err)
+
+	// Simulate p1 departing without its pending requests being cleared.
+	d.peers.Delete(p1.id)
+
+	d.resendFailedPieceRequests()
+
+	require.Empty(d.pieceRequestManager.PendingPieces(p1.id))
+	require.Equal([]int{0}, d.pieceRequestManager.PendingPieces(p2.id))
+}
+
+func TestDispatcherRemovePeer(t *testing.T) {
+	require := require.New(t)
+
+	torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(2, 1).MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(Config{}, clock.NewMock(), torrent)
+
+	p1, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, true), newMockMessages())
+	require.NoError(err)
+	_, err = d.maybeRequestMorePieces(p1)
+	require.NoError(err)
+	require.Equal([]int{0, 1}, d.pieceRequestManager.PendingPieces(p1.id))
+
+	p2, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, false), newMockMessages())
+	require.NoError(err)
+
+	require.NoError(d.RemovePeer(p1.id))
+
+	require.True(p1.messages.(*mockMessages).isClosed())
+	_, ok := d.peers.Load(p1.id)
+	require.False(ok)
+	require.Equal(1, d.numPeersByPiece.Get(0))
+	require.Equal(0, d.numPeersByPiece.Get(1))
+
+	// Pieces of p1 are resent on the next pass rather than by RemovePeer,
+	// without waiting for their requests to time out.
+	require.Empty(numRequestsPerPiece(p2.messages))
+	d.runPendingKick()
+	require.Empty(d.pieceRequestManager.PendingPieces(p1.id))
+	require.Equal([]int{0}, d.pieceRequestManager.PendingPieces(p2.id))
+	require.Equal(map[int]int{0: 1}, numRequestsPerPiece(p2.messages))
+
+	require.Equal(errPeerNotDispatched, d.RemovePeer(p1.id))
+}
+
+func TestDispatcherNumPeersAndPeerIDs(t *testing.T) {
+	require := require.New(t)
+
+	torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(2, 1).MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(Config{}, clock.NewMock(), torrent)
+	require.True(d.Empty())
+	require.Equal(0, d.NumPeers())
+	require.Empty(d.PeerIDs())
+
+	var peers []*peer
+	var peerIDs []core.PeerID
+	for i := 0; i < 3; i++ {
+		p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, false), newMockMessages())
+		require.NoError(err)
+		peers = append(peers, p)
+		peerIDs = append(peerIDs, p.id)
+	}
+	_, err := d.addPeer(peerIDs[0], bitsetutil.FromBools(true, false), newMockMessages())
+	require.Error(err)
+	require.False(d.Empty())
+	require.Equal(3, d.NumPeers())
+	require.ElementsMatch(peerIDs, d.PeerIDs())
+
+	// Removed via RemovePeer, and once its messages closed.
+	require.NoError(d.RemovePeer(peerIDs[0]))
+	require.NoError(d.removePeer(peers[1]))
+	require.Error(d.removePeer(peers[0]))
+	require.Equal(1, d.NumPeers())
+	require.Equal(peerIDs[2:], d.PeerIDs())
+	require.Equal(1, d.Progress().NumPeers)
+
+	require.NoError(d.RemovePeer(peerIDs[2]))
+	require.True(d.Empty())
+	require.Empty(d.PeerIDs())
+}
+
+func TestDispatcherRemovePeerWhileMessagesClose(t *testing.T) {
+	require := require.New(t)
+
+	torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(8, 1).MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(Config{}, clock.NewMock(), torrent)
+
+	for i := 0; i < 100; i++ {
+		peerID := core.PeerIDFixture()
+		messages := newMockMessages()
+		require.NoError(d.AddPeer(peerID, bitset.New(8).Complement(), messages))
+
+		errc := make(chan error, 1)
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			messages.Close()
+		}()
+		go func() {
+			defer wg.Done()
+			errc <- d.RemovePeer(peerID)
+		}()
+		wg.Wait()
+		if err := <-errc; err != nil {
+			require.Equal(errPeerNotDispatched, err)
+		}
+
+		require.Eventually(d.Empty, time.Second, time.Millisecond)
+		require.Empty(d.pieceRequestManager.PendingPieces(peerID))
+		for j := 0; j < 8; j++ {
+			require.Equal(0, d.numPeersByPiece.Get(j))
+		}
+	}
+}
+
+func TestDispatcherRemovePeerResendsConcurrentReservations(t *testing.T) {
+	require := require.New(t)
+
+	config := Config{
+		PipelineLimit:  4,
+		DisableEndgame: true,
+	}
+
+	for i := 0; i < 50; i++ {
+		torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(4, 1).MetaInfo)
+
+		d := testDispatcher(config, clock.NewMock(), torrent)
+
+		p1, err := d.addPeer(core.PeerIDFixture(), bitset.New(4).Complement(), newMockMessages())
+		require.NoError(err)
+		p2, err := d.addPeer(core.PeerIDFixture(), bitset.New(4).Complement(), newMockMessages())
+		require.NoError(err)
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			d.maybeRequestMorePieces(p1)
+		}()
+		go func() {
+			defer wg.Done()
+			d.RemovePeer(p1.id)
+		}()
+		wg.Wait()
+		d.runPendingKick()
+
+		// Every piece reserved for p1 was resent to p2.
+		pending := d.pieceRequestManager.PendingPieces(p2.id)
+		for j := range numRequestsPerPiece(p1.messages) {
+			require.Contains(pending, j)
+		}
+
+		cleanup()
+	}
+}
+
+// admissionFunc is a LoadAdmission backed by a scripted function.
+type admissionFunc func(piece int, length int64) AdmissionDecision
+
+func (f admissionFunc) AdmitServe(piece int, length int64) AdmissionDecision {
+	return f(piece, length)
+}
+
+func TestDispatcherLoadAdmission(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(4, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	for i := 0; i < 3; i++ {
+		require.NoError(torrent.WritePiece(piecereader.NewBuffer(blob.Content[i:i+1]), i))
+	}
+
+	var mu sync.Mutex
+	decisions := map[int]AdmissionDecision{
+		0: AdmissionAllow,
+		1: AdmissionReject,
+		2: AdmissionDefer,
+	}
+	setDecision := func(i int, decision AdmissionDecision) {
+		mu.Lock()
+		defer mu.Unlock()
+		decisions[i] = decision
+	}
+
+	config := Config{
+		LoadAdmission: admissionFunc(func(piece int, length int64) AdmissionDecision {
+			mu.Lock()
+			defer mu.Unlock()
+			return decisions[piece]
+		}),
+		ServeDeferInterval: time.Second,
+		MaxDeferredServes:  1,
+	}
+	clk := clock.NewMock()
+	stats := tally.NewTestScope("", nil)
+
+	d := testDispatcher(config, clk, torrent)
+	d.stats = stats
+
+	p, err := d.addPeer(
+		core.PeerIDFixture(), bitsetutil.FromBools(false, false, false, true), newMockMessages())
+	require.NoError(err)
+
+	served := func() []int {
+		var pieces []int
+		for _, msg := range p.messages.(*mockMessages).getSent() {
+			if msg.Message.Type == p2p.Message_PIECE_PAYLOAD {
+				pieces = append(pieces, int(msg.Message.PiecePayload.Index))
+			}
+		}
+		return pieces
+	}
+	rejected := func() []int {
+		var pieces []int
+		for _, msg := range p.messages.(*mockMessages).getSent() {
+			if msg.Message.Type == p2p.Message_ERROR {
+				require.Equal(p2p.ErrorMessage_PIECE_REQUEST_RETRY, msg.Message.Error.Code)
+				pieces = append(pieces, int(msg.Message.Error.Index))
+			}
+		}
+		return pieces
+	}
+
+	for i := 0; i < 3; i++ {
+		require.NoError(d.dispatch(p, conn.NewPieceRequestMessage(i, 1)))
+		waitForServes(t, p)
+	}
+	require.Equal([]int{0}, served())
+	require.Equal([]int{1}, rejected())
+
+	// Deferred queue is full.
+	require.NoError(d.dispatch(p, conn.NewPieceRequestMessage(2, 1)))
+	waitForServes(t, p)
+	require.Equal([]int{1, 2}, rejected())
+
+	// Still deferred.
+	clk.Add(time.Second)
+	waitForServes(t, p)
+	require.Equal([]int{0}, served())
+
+	setDecision(2, AdmissionAllow)
+	clk.Add(time.Second)
+	waitForServes(t, p)
+	require.Equal([]int{0, 2}, served())
+
+	counters := stats.Snapshot().Counters()
+	require.Equal(int64(2), counters["serve_admissions+decision=allow"].Value())
+	require.Equal(int64(2), counters["serve_admissions+decision=reject"].Value())
+	require.Equal(int64(2), counters["serve_admissions+decision=defer"].Value())
+
+	// Leeching is unaffected.
+	setDecision(3, AdmissionReject)
+	_, err = d.maybeRequestMorePieces(p)
+	require.NoError(err)
+	require.NoError(d.dispatch(
+		p, conn.NewPiecePayloadMessage(3, piecereader.NewBuffer(blob.Content[3:4]))))
+	require.True(d.Complete())
+}
+
+func chunkRequests(messages Messages) [][3]int64 {
+	var requests [][3]int64
+	for _, r := range sentPieceRequests(messages) {
+		requests = append(requests, [3]int64{int64(r.Index), int64(r.Offset), int64(r.Length)})
+	}
+	return requests
+}
+
+func chunkPayloadMessage(i int, offset int64, b []byte) *conn.Message {
+	return conn.NewPieceChunkPayloadMessage(i, offset, piecereader.NewBuffer(b))
+}
+
+func TestDispatcherRequestsChunks(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(10, 10)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(Config{ChunkSize: 4}, clock.NewMock(), torrent)
+
+	p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true), newMockMessages())
+	require.NoError(err)
+
+	_, err = d.maybeRequestMorePieces(p)
+	require.NoError(err)
+
+	// Final chunk is short.
+	require.Equal([][3]int64{{0, 0, 4}, {0, 4, 4}, {0, 8, 2}}, chunkRequests(p.messages))
+}
+
+func TestDispatcherServesChunks(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(10, 10)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	require.NoError(torrent.WritePiece(piecereader.NewBuffer(blob.Content), 0))
+
+	d := testDispatcher(Config{}, clock.NewMock(), torrent)
+
+	p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false), newMockMessages())
+	require.NoError(err)
+
+	require.NoError(d.dispatch(p, conn.NewPieceChunkRequestMessage(0, 4, 4)))
+	waitForServes(t, p)
+	require.NoError(d.dispatch(p, conn.NewPieceChunkRequestMessage(0, 8, 4)))
+	waitForServes(t, p)
+
+	sent := p.messages.(*mockMessages).getSent()
+	require.Len(sent, 2)
+
+	payload := sent[0].Message.PiecePayload
+	require.Equal(int32(4), payload.Offset)
+	require.Equal(int32(4), payload.Length)
+	b, err := ioutil.ReadAll(sent[0].Payload)
+	require.NoError(err)
+	require.Equal(blob.Content[4:8], b)
+
+	// Out of range.
+	require.Equal(p2p.Message_ERROR, sent[1].Message.Type)
+
+	// Peer is not assumed to have the piece until its final chunk is served.
+	require.False(p.bitfield.Has(0))
+	require.Equal(0, p.pstats.getPiecesSent())
+}
+
+func TestDispatcherAssemblesChunksFromMultiplePeers(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(10, 10)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(Config{ChunkSize: 4}, clock.NewMock(), torrent)
+
+	p1, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true), newMockMessages())
+	require.NoError(err)
+	p2, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true), newMockMessages())
+	require.NoError(err)
+
+	_, err = d.maybeRequestMorePieces(p1)
+	require.NoError(err)
+
+	require.NoError(d.dispatch(p1, chunkPayloadMessage(0, 8, blob.Content[8:])))
+	require.Equal(int64(2), d.completedBytes())
+
+	// p1 disconnects mid-piece, so only missing chunks are requested from p2.
+	require.NoError(d.removePeer(p1))
+	_, err = d.maybeRequestMorePieces(p2)
+	require.NoError(err)
+	require.Equal([][3]int64{{0, 0, 4}, {0, 4, 4}}, chunkRequests(p2.messages))
+
+	require.NoError(d.dispatch(p2, chunkPayloadMessage(0, 4, blob.Content[4:8])))
+
+	// Duplicate chunks are ignored.
+	require.NoError(d.dispatch(p2, chunkPayloadMessage(0, 8, blob.Content[8:])))
+	require.Equal(1, p2.pstats.getDuplicatePiecesReceived())
+	require.Equal(int64(6), d.completedBytes())
+	require.False(torrent.HasPiece(0))
+
+	require.NoError(d.dispatch(p2, chunkPayloadMessage(0, 0, blob.Content[:4])))
+	require.True(d.Complete())
+	require.Equal(int64(10), d.completedBytes())
+
+	r, err := torrent.GetPieceReader(0)
+	require.NoError(err)
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	require.NoError(err)
+	require.Equal(blob.Content, b)
+}
+
+func TestDispatcherDiscardsCorruptAssembledPiece(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(8, 8)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(Config{ChunkSize: 4}, clock.NewMock(), torrent)
+
+	p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true), newMockMessages())
+	require.NoError(err)
+
+	_, err = d.maybeRequestMorePieces(p)
+	require.NoError(err)
+
+	// Misaligned chunks are rejected.
+	require.Equal(ErrorValidation, Category(d.dispatch(p, chunkPayloadMessage(0, 2, blob.Content[2:6]))))
+	require.Equal(int64(0), d.completedBytes())
+
+	require.NoError(d.dispatch(p, chunkPayloadMessage(0, 0, blob.Content[:4])))
+	require.Equal(ErrorValidation, Category(d.dispatch(p, chunkPayloadMessage(0, 4, make([]byte, 4)))))
+
+	require.False(torrent.HasPiece(0))
+	require.Equal(int64(0), d.completedBytes())
+	require.Equal([]int{0, 1}, d.pieceRequestManager.MissingChunks(0, 2))
+
+	failed := d.pieceRequestManager.GetFailedRequests()
+	require.Len(failed, 1)
+	require.Equal(p.id, failed[0].PeerID)
+}
+
+func TestDispatcherRejectsShortChunkPayload(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(8, 8)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(Config{ChunkSize: 4}, clock.NewMock(), torrent)
+
+	p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true), newMockMessages())
+	require.NoError(err)
+
+	_, err = d.maybeRequestMorePieces(p)
+	require.NoError(err)
+
+	// The chunk claims 4 bytes, but carries only 2.
+	msg := chunkPayloadMessage(0, 4, blob.Content[4:6])
+	msg.Message.PiecePayload.Length = 4
+	require.Equal(ErrorValidation, Category(d.dispatch(p, msg)))
+
+	require.Equal(1, p.stats().InvalidPiecesReceived)
+	failed := d.pieceRequestManager.GetFailedRequests()
+	require.Len(failed, 1)
+	require.Equal(p.id, failed[0].PeerID)
+}
+
+// gatedTorrent blocks reads of pieces until their gate is closed.
+type gatedTorrent struct {
+	storage.Torrent
+	reading chan int
+	gates   map[int]chan struct{}
+}
+
+func (t *gatedTorrent) GetPieceReader(piece int) (storage.PieceReader, error) {
+	if gate, ok := t.gates[piece]; ok {
+		t.reading <- piece
+		<-gate
+	}
+	return t.Torrent.GetPieceReader(piece)
+}
+
+func servedPieces(messages Messages) []int {
+	var pieces []int
+	for _, msg := range messages.(*mockMessages).getSent() {
+		if msg.Message.Type == p2p.Message_PIECE_PAYLOAD {
+			pieces = append(pieces, int(msg.Message.PiecePayload.Index))
+		}
+	}
+	return pieces
+}
+
+func TestDispatcherCancelPieceAbortsServe(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(3, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	for i := 0; i < 3; i++ {
+		require.NoError(torrent.WritePiece(piecereader.NewBuffer(blob.Content[i:i+1]), i))
+	}
+
+	gated := &gatedTorrent{
+		Torrent: torrent,
+		reading: make(chan int, 1),
+		gates:   map[int]chan struct{}{0: make(chan struct{})},
+	}
+	stats := tally.NewTestScope("", nil)
+	d := testDispatcher(Config{}, clock.NewMock(), gated)
+	d.stats = stats
+
+	p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false, false, false), newMockMessages())
+	require.NoError(err)
+
+	for i := 0; i < 3; i++ {
+		require.NoError(d.dispatch(p, conn.NewPieceRequestMessage(i, 1)))
+	}
+
+	// Piece 0 is being read while pieces 1 and 2 are queued.
+	require.Equal(0, <-gated.reading)
+
+	require.NoError(d.dispatch(p, conn.NewCancelPieceMessage(0)))
+	require.NoError(d.dispatch(p, conn.NewCancelPieceMessage(1)))
+	close(gated.gates[0])
+	waitForServes(t, p)
+
+	require.Equal([]int{2}, servedPieces(p.messages))
+	require.Equal(1, p.pstats.getPiecesSent())
+	require.Equal(int64(2), stats.Snapshot().Counters()["cancelled_serves+"].Value())
+
+	// Cancels do not affect later requests of the same piece.
+	require.NoError(d.dispatch(p, conn.NewPieceRequestMessage(0, 1)))
+	require.Equal(0, <-gated.reading)
+	waitForServes(t, p)
+	require.Equal([]int{2, 0}, servedPieces(p.messages))
+
+	// Late cancels are harmless.
+	require.NoError(d.dispatch(p, conn.NewCancelPieceMessage(0)))
+	require.Equal([]int{2, 0}, servedPieces(p.messages))
+	require.Equal(2, p.pstats.getPiecesSent())
+}
+
+func TestDispatcherCancelsExpiredPieceRequests(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+
+	torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(1, 1).MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(Config{}, clk, torrent)
+
+	p1, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true), newMockMessages())
+	require.NoError(err)
+	_, err = d.maybeRequestMorePieces(p1)
+	require.NoError(err)
+
+	p2, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true), newMockMessages())
+	require.NoError(err)
+
+	clk.Add(d.pieceRequestTimeout + 1)
+	d.resendFailedPieceRequests()
+
+	// The request is reassigned to p2, so p1 need not serve it.
+	require.Equal([]int{0}, cancelledPieces(p1.messages))
+	require.Equal([]int{0}, d.pieceRequestManager.PendingPieces(p2.id))
+	require.Empty(cancelledPieces(p2.messages))
+}
+
+func TestDispatcherChunksOneByteLastPiece(t *testing.T) {
+	require := require.New(t)
+
+	// Pieces are 4, 4 and 1 bytes long.
+	blob := core.SizedBlobFixture(9, 4)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(Config{ChunkSize: 2, PipelineLimit: 3}, clock.NewMock(), torrent)
+
+	require.Equal(1, d.numChunks(2))
+	_, ok := d.chunkIndex(2, 0, 2)
+	require.False(ok)
+
+	p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, true, true), newMockMessages())
+	require.NoError(err)
+
+	_, err = d.maybeRequestMorePieces(p)
+	require.NoError(err)
+
+	requests := chunkRequests(p.messages)
+	require.ElementsMatch([][3]int64{
+		{0, 0, 2}, {0, 2, 2}, {1, 0, 2}, {1, 2, 2}, {2, 0, 1},
+	}, requests)
+
+	for _, r := range requests {
+		i, offset, length := int(r[0]), r[1], r[2]
+		start := int64(i)*4 + offset
+		require.NoError(d.dispatch(p, chunkPayloadMessage(i, offset, blob.Content[start:start+length])))
+	}
+	require.True(d.Complete())
+	require.Equal(int64(9), d.completedBytes())
+
+	// The last piece is served whole to peers requesting it.
+	p2, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false, false, false), newMockMessages())
+	require.NoError(err)
+	require.NoError(d.dispatch(p2, conn.NewPieceRequestMessage(2, 1)))
+	waitForServes(t, p2)
+	require.Equal([]int{2}, servedPieces(p2.messages))
+	require.True(p2.bitfield.Has(2))
+}
+
+func TestDispatcherPeerStats(t *testing.T) {
+	require := require.New(t)
+
+	config := Config{
+		PipelineLimit:  3,
+		PeerRateWindow: 10 * time.Second,
+	}
+	clk := clock.NewMock()
+
+	blob := core.SizedBlobFixture(3, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(config, clk, torrent)
+
+	p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, true, true), newMockMessages())
+	require.NoError(err)
+
+	_, ok := d.PeerStats(core.PeerIDFixture())
+	require.False(ok)
+
+	_, err = d.maybeRequestMorePieces(p)
+	require.NoError(err)
+
+	require.NoError(d.dispatch(p, conn.NewPiecePayloadMessage(0, piecereader.NewBuffer(blob.Content[0:1]))))
+	clk.Add(time.Second)
+	require.Equal(ErrorValidation, Category(
+		d.dispatch(p, conn.NewPiecePayloadMessage(1, piecereader.NewBuffer([]byte{^blob.Content[1]})))))
+
+	stats, ok := d.PeerStats(p.id)
+	require.True(ok)
+	require.Equal(p.id, stats.PeerID)
+	require.Equal(int64(2), stats.BytesDownloaded)
+	require.Equal(1, stats.GoodPiecesReceived)
+	require.Equal(1, stats.InvalidPiecesReceived)
+	require.InDelta(0.1*math.Exp(-0.1)+0.1, stats.DownloadRate, 1e-9)
+
+	// All pieces were requested at once, and received after 0s and 1s.
+	require.Equal(200*time.Millisecond, stats.PieceRTT)
+
+	// Rates decay while nothing is downloaded.
+	clk.Add(10 * time.Second)
+	stats, _ = d.PeerStats(p.id)
+	require.InDelta((0.1*math.Exp(-0.1)+0.1)*math.Exp(-1), stats.DownloadRate, 1e-9)
+
+	// Uploads are counted once the payload is sent.
+	require.NoError(d.dispatch(p, conn.NewPieceRequestMessage(0, 1)))
+	waitForServes(t, p)
+	stats, _ = d.PeerStats(p.id)
+	require.Equal(int64(1), stats.BytesUploaded)
+
+	require.Equal([]PeerStats{stats}, d.AllPeerStats())
+}
+
+func TestDispatcherEgressLimit(t *testing.T) {
+	require := require.New(t)
+
+	config := Config{
+		EgressBytesPerSec:     2,
+		MaxQueuedEgressServes: 1,
+	}
+	clk := clock.NewMock()
+	stats := tally.NewTestScope("", nil)
+
+	blob := core.SizedBlobFixture(4, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	for i := 0; i < 4; i++ {
+		require.NoError(torrent.WritePiece(piecereader.NewBuffer(blob.Content[i:i+1]), i))
+	}
+
+	d := testDispatcher(config, clk, torrent)
+	d.stats = stats
+
+	p1, err := d.addPeer(
+		core.PeerIDFixture(), bitsetutil.FromBools(false, false, false, false), newMockMessages())
+	require.NoError(err)
+	p2, err := d.addPeer(
+		core.PeerIDFixture(), bitsetutil.FromBools(false, false, false, false), newMockMessages())
+	require.NoError(err)
+
+	// Bursts are served immediately.
+	for i := 0; i < 2; i++ {
+		require.NoError(d.dispatch(p1, conn.NewPieceRequestMessage(i, 1)))
+		waitForServes(t, p1)
+	}
+	require.Equal([]int{0, 1}, servedPieces(p1.messages))
+
+	// The bucket is empty, so the next serve is queued...
+	require.NoError(d.dispatch(p1, conn.NewPieceRequestMessage(2, 1)))
+	require.Eventually(func() bool {
+		return d.egress.numQueued() == 1
+	}, time.Second, time.Millisecond)
+	require.Equal([]int{0, 1}, servedPieces(p1.messages))
+
+	// ...and serves beyond the queue limit fail.
+	require.NoError(d.dispatch(p2, conn.NewPieceRequestMessage(3, 1)))
+	waitForServes(t, p2)
+	require.Empty(servedPieces(p2.messages))
+	sent := p2.messages.(*mockMessages).getSent()
+	require.Len(sent, 1)
+	require.Equal(p2p.Message_ERROR, sent[0].Message.Type)
+
+	// Tokens refill at the configured rate.
+	require.Eventually(func() bool {
+		clk.Add(100 * time.Millisecond)
+		return len(servedPieces(p1.messages)) == 3
+	}, time.Second, time.Millisecond)
+	require.Equal([]int{0, 1, 2}, servedPieces(p1.messages))
+	waitForServes(t, p1)
+
+	snapshot := stats.Snapshot()
+	require.Equal(int64(1), snapshot.Counters()["egress_rejected_serves+"].Value())
+	require.True(snapshot.Gauges()["egress_utilization+"].Value() > 0)
+}
+
+// wireMessages is a mockMessages which counts the bytes its messages would occupy
+// on the wire, scaled by overhead.
+type wireMessages struct {
+	*mockMessages
+	overhead float64
+
+	mu    sync.Mutex
+	bytes int64
+}
+
+func newWireMessages(overhead float64) *wireMessages {
+	return &wireMessages{mockMessages: newMockMessages(), overhead: overhead}
+}
+
+func (m *wireMessages) Send(msg *conn.Message) error {
+	if err := m.mockMessages.Send(msg); err != nil {
+		return err
+	}
+	n := int64(4 + proto.Size(msg.Message))
+	if msg.Payload != nil {
+		n += int64(msg.Payload.Length())
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bytes += int64(float64(n) * m.overhead)
+	return nil
+}
+
+func (m *wireMessages) BytesSent() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.bytes
+}
+
+func TestDispatcherWireEfficiency(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(1000, 100)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	require.NoError(torrent.WritePiece(piecereader.NewBuffer(blob.Content[:100]), 0))
+
+	d := testDispatcher(Config{}, clock.NewMock(), torrent)
+
+	serve := func(messages Messages) PeerStats {
+		p, err := d.addPeer(core.PeerIDFixture(), bitset.New(10), messages)
+		require.NoError(err)
+		require.NoError(d.dispatch(p, conn.NewPieceRequestMessage(0, 100)))
+		waitForServes(t, p)
+		stats, ok := d.PeerStats(p.id)
+		require.True(ok)
+		return stats
+	}
+
+	// Requests are sent to the peer since it has no pieces.
+	exact := newWireMessages(1)
+	stats := serve(exact)
+	require.Equal(exact.BytesSent(), stats.WireBytesSent)
+	require.Equal(int64(100), stats.BytesUploaded)
+	expected := float64(100) / float64(exact.BytesSent())
+	require.InDelta(expected, stats.WireEfficiency, 1e-9)
+	require.True(stats.WireEfficiency > 0.5 && stats.WireEfficiency < 1)
+
+	// Wire counters lagging behind payload counters are clamped.
+	lagging := newWireMessages(0.25)
+	stats = serve(lagging)
+	require.Equal(float64(1), stats.WireEfficiency)
+
+	// Unknown without wire counters.
+	stats = serve(newMockMessages())
+	require.Zero(stats.WireEfficiency)
+
+	// Peers without wire counters are excluded, and the aggregate is clamped.
+	require.True(exact.BytesSent()+lagging.BytesSent() < 200)
+	require.Equal(float64(1), d.WireEfficiency())
+}
+
+// staleBitfieldTorrent returns a fixed bitfield, simulating pieces completing
+// after the bitfield was read.
+type staleBitfieldTorrent struct {
+	storage.Torrent
+	bitfield *bitset.BitSet
+}
+
+func (t *staleBitfieldTorrent) Bitfield() *bitset.BitSet {
+	return t.bitfield.Clone()
+}
+
+func TestDispatcherDoesNotResendCompletedPieces(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+	stats := tally.NewTestScope("", nil)
+
+	blob := core.SizedBlobFixture(2, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(Config{PipelineLimit: 1}, clk, &staleBitfieldTorrent{torrent, bitset.New(2)})
+	d.stats = stats
+
+	p1, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, false), newMockMessages())
+	require.NoError(err)
+	_, err = d.maybeRequestMorePieces(p1)
+	require.NoError(err)
+	require.Equal(map[int]int{0: 1}, numRequestsPerPiece(p1.messages))
+
+	p2, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, false), newMockMessages())
+	require.NoError(err)
+
+	// The request to p1 expires, and the piece completes before the resend.
+	clk.Add(d.pieceRequestTimeout + 1)
+	require.NoError(torrent.WritePiece(piecereader.NewBuffer(blob.Content[:1]), 0))
+	d.resendFailedPieceRequests()
+
+	require.Empty(numRequestsPerPiece(p2.messages))
+	require.Equal(int64(1), stats.Snapshot().Counters()["stale_piece_resends+"].Value())
+
+	// Stale candidates are not requested either.
+	sent, err := d.maybeRequestMorePieces(p2)
+	require.NoError(err)
+	require.False(sent)
+	require.Empty(numRequestsPerPiece(p2.messages))
+	require.Equal(int64(1), stats.Snapshot().Counters()["stale_piece_requests+"].Value())
+
+	// The piece is never reserved again.
+	require.Empty(d.pieceRequestManager.PendingPieces(p2.id))
+	sent, err = d.maybeRequestMorePieces(p2)
+	require.NoError(err)
+	require.False(sent)
+	require.Equal(int64(1), stats.Snapshot().Counters()["stale_piece_requests+"].Value())
+}
+
+func TestDispatcherIngressLimit(t *testing.T) {
+	require := require.New(t)
+
+	config := Config{
+		PipelineLimit:      1,
+		IngressBytesPerSec: 10,
+	}
+	clk := clock.NewMock()
+
+	blob := core.SizedBlobFixture(40, 10)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(config, clk, torrent)
+
+	p, err := d.addPeer(
+		core.PeerIDFixture(), bitsetutil.FromBools(true, true, true, true), newMockMessages())
+	require.NoError(err)
+
+	requested := func() []int { return requestedPieces(p.messages) }
+	receive := func(i int) {
+		require.NoError(d.dispatch(p, conn.NewPiecePayloadMessage(
+			i, piecereader.NewBuffer(blob.Content[i*10:(i+1)*10]))))
+	}
+
+	_, err = d.maybeRequestMorePieces(p)
+	require.NoError(err)
+	require.Len(requested(), 1)
+
+	// The first piece drains the bucket, and the second exceeds it.
+	receive(requested()[0])
+	require.Len(requested(), 2)
+	receive(requested()[1])
+	require.Len(requested(), 2)
+
+	// Requests resume once the bucket refills.
+	clk.Add(500 * time.Millisecond)
+	require.Len(requested(), 2)
+	clk.Add(500 * time.Millisecond)
+	require.Len(requested(), 3)
+
+	// Lifting the limit resumes requests immediately.
+	receive(requested()[2])
+	require.Len(requested(), 3)
+	d.SetIngressLimit(0)
+	require.Len(requested(), 4)
+
+	receive(requested()[3])
+	require.True(d.Complete())
+}
+
+func TestDispatcherPiecesUnavailable(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(4, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	clk := clock.NewMock()
+	events := &recordingEvents{}
+	d := testDispatcher(Config{PieceUnavailableTimeout: 10 * time.Second}, clk, torrent)
+	d.emitter = testEmitter(events, tally.NoopScope)
+
+	p1, err := d.addPeer(
+		core.PeerIDFixture(), bitsetutil.FromBools(true, true, false, false), newMockMessages())
+	require.NoError(err)
+
+	// Pieces are never requested from asymmetric peers, so p2 is no source of 2.
+	p2, err := d.addPeer(
+		core.PeerIDFixture(), bitsetutil.FromBools(false, false, true, false), newMockMessages())
+	require.NoError(err)
+	p2.setAsymmetric(true)
+
+	d.checkUnavailablePieces()
+	clk.Add(5 * time.Second)
+	d.checkUnavailablePieces()
+	require.Empty(events.get())
+
+	clk.Add(5 * time.Second)
+	d.checkUnavailablePieces()
+	require.Eventually(func() bool {
+		return len(events.get()) == 1
+	}, time.Second, 5*time.Millisecond)
+	require.Equal([]string{"unavailable:[2 3]"}, events.get())
+
+	// Stuck pieces are only reported once.
+	clk.Add(time.Minute)
+	d.checkUnavailablePieces()
+
+	for i := 0; i < 2; i++ {
+		require.NoError(d.dispatch(
+			p1, conn.NewPiecePayloadMessage(i, piecereader.NewBuffer(blob.Content[i:i+1]))))
+	}
+	require.False(d.Complete())
+
+	// Fetch the stuck pieces out-of-band.
+	for _, i := range []int{2, 3} {
+		require.NoError(torrent.WritePiece(piecereader.NewBuffer(blob.Content[i:i+1]), i))
+	}
+	d.NotifyPiecesWritten([]int{2, 3})
+	d.completeNotifications.Wait()
+
+	require.True(d.Complete())
+	require.Equal([]int{2, 3}, announcedPieces(p1.messages))
+	// p2 is not announced the piece it has.
+	require.Equal([]int{0, 1, 3}, announcedPieces(p2.messages))
+	require.True(hasComplete(p1.messages))
+	require.Eventually(func() bool {
+		return len(events.get()) == 2
+	}, time.Second, 5*time.Millisecond)
+	require.Equal([]string{"unavailable:[2 3]", "complete"}, events.get())
+}
+
+func TestDispatcherReportsPiecesUnavailableAfterReannouncingPeerLeaves(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(2, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	events := &recordingEvents{}
+	d := testDispatcher(Config{
+		PieceUnavailableTimeout: 10 * time.Second,
+		EndgameThreshold:        1,
+	}, clock.NewMock(), torrent)
+	d.emitter = testEmitter(events, tally.NoopScope)
+
+	p1, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false, true), newMockMessages())
+	require.NoError(err)
+
+	// p2 is the only source of piece 0, which it announces repeatedly.
+	p2, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false, false), newMockMessages())
+	require.NoError(err)
+	for i := 0; i < 3; i++ {
+		require.NoError(d.dispatch(p2, conn.NewAnnouncePieceMessage(0)))
+	}
+	require.Equal(1, d.numPeersByPiece.Get(0))
+
+	d.removePeer(p2)
+	require.Equal(0, d.numPeersByPiece.Get(0))
 	require.Equal(1, d.numPeersByPiece.Get(1))
-	require.Equal(3, d.numPeersByPiece.Get(2))
 
-	d.removePeer(p)
+	// Endgame starts once piece 1 arrives, and finds no source of piece 0.
+	require.NoError(d.dispatch(p1, conn.NewPiecePayloadMessage(1, piecereader.NewBuffer(blob.Content[1:2]))))
+	cause, ok := d.EndgameCause()
+	require.True(ok)
+	require.Equal(EndgameAvailabilityLimited, cause)
+	require.Eventually(func() bool {
+		return len(events.get()) == 1
+	}, time.Second, 5*time.Millisecond)
+	require.Equal([]string{"unavailable:[0]"}, events.get())
+	require.False(closed(p1.messages))
+}
 
-	require.Equal(3, d.numPeersByPiece.Get(0))
-	require.Equal(1, d.numPeersByPiece.Get(1))
-	require.Equal(2, d.numPeersByPiece.Get(2))
+func unchokedPeers(peers ...*peer) []bool {
+	var unchoked []bool
+	for _, p := range peers {
+		unchoked = append(unchoked, !p.serves.isChoked())
+	}
+	return unchoked
+}
+
+// blockingTorrent blocks reads of pieces until release is closed, signalling
+// reading once per read.
+type blockingTorrent struct {
+	storage.Torrent
+	reading chan int
+	release chan struct{}
+}
+
+func (t *blockingTorrent) GetPieceReader(piece int) (storage.PieceReader, error) {
+	t.reading <- piece
+	<-t.release
+	return t.Torrent.GetPieceReader(piece)
+}
+
+func TestDispatcherRejectsRequestsBeyondMaxQueuedServes(t *testing.T) {
+	require := require.New(t)
+
+	config := Config{
+		MaxQueuedServes: 2,
+	}
+	stats := tally.NewTestScope("", nil)
+
+	blob := core.SizedBlobFixture(4, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	for i := 0; i < 4; i++ {
+		require.NoError(torrent.WritePiece(piecereader.NewBuffer(blob.Content[i:i+1]), i))
+	}
+
+	bt := &blockingTorrent{
+		Torrent: torrent,
+		reading: make(chan int, 4),
+		release: make(chan struct{}),
+	}
+	d := testDispatcher(config, clock.NewMock(), bt)
+	d.stats = stats
+
+	p, err := d.addPeer(
+		core.PeerIDFixture(), bitsetutil.FromBools(false, false, false, false), newMockMessages())
+	require.NoError(err)
+
+	// Piece 0 is being served, so pieces 1 and 2 fill the queue.
+	require.NoError(d.dispatch(p, conn.NewPieceRequestMessage(0, 1)))
+	require.Equal(0, <-bt.reading)
+	require.NoError(d.dispatch(p, conn.NewPieceRequestMessage(1, 1)))
+	require.NoError(d.dispatch(p, conn.NewPieceRequestMessage(2, 1)))
+	require.Equal(2, p.serves.len())
+
+	require.NoError(d.dispatch(p, conn.NewPieceRequestMessage(3, 1)))
+	require.Equal(2, p.serves.len())
+	sent := p.messages.(*mockMessages).getSent()
+	require.Len(sent, 1)
+	require.Equal(p2p.Message_ERROR, sent[0].Message.Type)
+	require.Equal(int32(3), sent[0].Message.Error.Index)
+	require.Equal(p2p.ErrorMessage_PIECE_REQUEST_RETRY, sent[0].Message.Error.Code)
+	require.Equal(
+		int64(1), stats.Snapshot().Counters()["rejected_queued_piece_requests+"].Value())
+
+	close(bt.release)
+	waitForServes(t, p)
+	require.Equal([]int{0, 1, 2}, servedPieces(p.messages))
+}
+
+func TestDispatcherChokesPeersBeyondUploadSlots(t *testing.T) {
+	require := require.New(t)
+
+	config := Config{
+		EnableChoking:     true,
+		UploadSlots:       2,
+		MaxChokedRequests: 1,
+	}
+	clk := clock.NewMock()
+	stats := tally.NewTestScope("", nil)
+
+	blob := core.SizedBlobFixture(4, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	for i := 0; i < 4; i++ {
+		require.NoError(torrent.WritePiece(piecereader.NewBuffer(blob.Content[i:i+1]), i))
+	}
+
+	d := testDispatcher(config, clk, torrent)
+	d.stats = stats
+
+	// Peers are not notified of chokes, so their requests are held.
+	var peers []*peer
+	for i := 0; i < 3; i++ {
+		p, err := d.addPeer(
+			core.PeerIDFixture(), bitsetutil.FromBools(false, false, false, false),
+			newLegacyMockMessages(conn.Choke))
+		require.NoError(err)
+		peers = append(peers, p)
+	}
+	p1, p3 := peers[0], peers[2]
+	require.Equal([]bool{true, true, false}, unchokedPeers(peers...))
+
+	require.NoError(d.dispatch(p1, conn.NewPieceRequestMessage(0, 1)))
+	waitForServes(t, p1)
+	require.Equal([]int{0}, servedPieces(p1.messages))
+
+	// Requests of choked peers are held...
+	require.NoError(d.dispatch(p3, conn.NewPieceRequestMessage(0, 1)))
+	require.Equal(1, p3.serves.len())
+
+	// ...until too many are held.
+	require.NoError(d.dispatch(p3, conn.NewPieceRequestMessage(1, 1)))
+	sent := p3.messages.(*mockMessages).getSent()
+	require.Len(sent, 1)
+	require.Equal(p2p.Message_ERROR, sent[0].Message.Type)
+	require.Equal(int32(1), sent[0].Message.Error.Index)
+	require.Equal(p2p.ErrorMessage_PIECE_REQUEST_RETRY, sent[0].Message.Error.Code)
+
+	counters := stats.Snapshot().Counters()
+	require.Equal(int64(2), counters["choked_piece_requests+"].Value())
+	require.Equal(int64(1), counters["rejected_choked_piece_requests+"].Value())
+
+	// p3 was choked the longest, so it takes over an upload slot and its held
+	// request is served.
+	clk.Add(time.Second)
+	d.rechoke()
+	require.True(unchokedPeers(p3)[0])
+	waitForServes(t, p3)
+	require.Equal([]int{0}, servedPieces(p3.messages))
+
+	// Removing an unchoked peer hands its slot to the choked peer.
+	unchoked, choked := peers[0], peers[1]
+	if unchoked.serves.isChoked() {
+		unchoked, choked = choked, unchoked
+	}
+	require.Equal([]bool{true, false}, unchokedPeers(unchoked, choked))
+	require.NoError(d.removePeer(unchoked))
+	require.Equal([]bool{true, true}, unchokedPeers(choked, p3))
+}
+
+func TestDispatcherRechokePrefersFastestPeers(t *testing.T) {
+	require := require.New(t)
+
+	config := Config{
+		EnableChoking: true,
+		UploadSlots:   2,
+	}
+	clk := clock.NewMock()
+
+	blob := core.SizedBlobFixture(4, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(config, clk, torrent)
+
+	var peers []*peer
+	for i := 0; i < 4; i++ {
+		p, err := d.addPeer(
+			core.PeerIDFixture(), bitsetutil.FromBools(true, false, false, false), newMockMessages())
+		require.NoError(err)
+		peers = append(peers, p)
+	}
+	p1, p2, p3, p4 := peers[0], peers[1], peers[2], peers[3]
+	require.Equal([]bool{true, true, false, false}, unchokedPeers(peers...))
+
+	require.NoError(d.dispatch(
+		p2, conn.NewPiecePayloadMessage(0, piecereader.NewBuffer(blob.Content[0:1]))))
+
+	// p2 keeps its slot since we download from it, while the other slot is an
+	// optimistic unchoke of a peer which was never unchoked.
+	clk.Add(time.Second)
+	d.rechoke()
+	require.Equal([]bool{false, true}, unchokedPeers(p1, p2))
+	optimistic := unchokedPeers(p3, p4)
+	require.ElementsMatch([]bool{true, false}, optimistic)
+
+	// The optimistic unchoke rotates to the other peer which was never unchoked.
+	clk.Add(time.Second)
+	d.rechoke()
+	require.Equal([]bool{false, true}, unchokedPeers(p1, p2))
+	require.Equal([]bool{!optimistic[0], !optimistic[1]}, unchokedPeers(p3, p4))
+}
+
+func TestDispatcherRechokeRotatesSlotsAmongSeeders(t *testing.T) {
+	require := require.New(t)
+
+	config := Config{
+		EnableChoking: true,
+		UploadSlots:   2,
+	}
+	clk := clock.NewMock()
+
+	torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(4, 1).MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(config, clk, torrent)
+
+	var peers []*peer
+	for i := 0; i < 3; i++ {
+		p, err := d.addPeer(core.PeerIDFixture(), bitset.New(4), newMockMessages())
+		require.NoError(err)
+		peers = append(peers, p)
+	}
+
+	// We download from nobody, so slots rotate such that no peer is choked in
+	// two consecutive rounds.
+	choked := func() *peer {
+		var c []*peer
+		for _, p := range peers {
+			if p.serves.isChoked() {
+				c = append(c, p)
+			}
+		}
+		require.Len(c, 1)
+		return c[0]
+	}
+	prev := choked()
+	chokedAny := map[*peer]bool{prev: true}
+	for i := 0; i < 6; i++ {
+		clk.Add(time.Second)
+		d.rechoke()
+		next := choked()
+		require.NotEqual(prev, next)
+		chokedAny[next] = true
+		prev = next
+	}
+	require.Len(chokedAny, 3)
+}
+
+func TestDispatcherNotifiesChokeState(t *testing.T) {
+	require := require.New(t)
+
+	config := Config{
+		EnableChoking:     true,
+		UploadSlots:       1,
+		MaxChokedRequests: 10,
+	}
+	clk := clock.NewMock()
+	stats := tally.NewTestScope("", nil)
+
+	blob := core.SizedBlobFixture(2, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(config, clk, torrent)
+	d.stats = stats
+
+	p1, err := d.addPeer(core.PeerIDFixture(), bitset.New(2), newMockMessages())
+	require.NoError(err)
+	p2, err := d.addPeer(core.PeerIDFixture(), bitset.New(2), newMockMessages())
+	require.NoError(err)
+
+	types := func(p *peer) []p2p.Message_Type {
+		var ts []p2p.Message_Type
+		for _, msg := range p.messages.(*mockMessages).getSent() {
+			ts = append(ts, msg.Message.Type)
+		}
+		return ts
+	}
+	require.Empty(types(p1))
+	require.Equal([]p2p.Message_Type{p2p.Message_CHOKE}, types(p2))
+
+	// Notified peers are not held for, so their requests are rejected with a
+	// retryable error.
+	require.NoError(d.dispatch(p2, conn.NewPieceRequestMessage(0, 1)))
+	sent := p2.messages.(*mockMessages).getSent()
+	require.Len(sent, 2)
+	require.Equal(p2p.ErrorMessage_PIECE_REQUEST_RETRY, sent[1].Message.Error.Code)
+	require.Equal(0, p2.serves.len())
+
+	// The slot rotates to p2, and both peers are notified.
+	clk.Add(time.Second)
+	d.rechoke()
+	require.Equal([]p2p.Message_Type{p2p.Message_CHOKE}, types(p1))
+	require.Equal(p2p.Message_UNCHOKE, types(p2)[2])
+}
+
+func TestDispatcherStopsRequestingWhileChokedByPeer(t *testing.T) {
+	require := require.New(t)
+
+	config := Config{
+		DisableEndgame: true,
+	}
+	clk := clock.NewMock()
+
+	torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(2, 1).MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(config, clk, torrent)
+
+	p1, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, true), newMockMessages())
+	require.NoError(err)
+	d.maybeRequestMorePieces(p1)
+	require.Equal(map[int]int{0: 1, 1: 1}, numRequestsPerPiece(p1.messages))
+
+	p2, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, false), newMockMessages())
+	require.NoError(err)
+
+	// Requests pending with p1 are requested elsewhere once p1 chokes us.
+	require.NoError(d.dispatch(p1, conn.NewChokeMessage()))
+	require.Empty(d.pieceRequestManager.PendingPieces(p1.id))
+	d.resendFailedPieceRequests()
+	require.Equal(map[int]int{0: 1}, numRequestsPerPiece(p2.messages))
+
+	// Nothing is requested from p1 while it chokes us.
+	ok, err := d.maybeRequestMorePieces(p1)
+	require.NoError(err)
+	require.False(ok)
+	require.Equal(map[int]int{0: 1, 1: 1}, numRequestsPerPiece(p1.messages))
+
+	require.NoError(d.dispatch(p1, conn.NewUnchokeMessage()))
+	require.Equal(map[int]int{0: 1, 1: 2}, numRequestsPerPiece(p1.messages))
+}
+
+// queuedMessages is a mockMessages which reports fixed queue stats.
+type queuedMessages struct {
+	*mockMessages
+	send, receive conn.QueueStats
+}
+
+func (m *queuedMessages) SendQueueStats() conn.QueueStats    { return m.send }
+func (m *queuedMessages) ReceiveQueueStats() conn.QueueStats { return m.receive }
+
+func TestDispatcherDetectsHeadOfLineBlocking(t *testing.T) {
+	require := require.New(t)
+
+	config := Config{
+		HeadOfLineBlockingThreshold: 10 * time.Second,
+		ResetHeadOfLineBlockedConns: true,
+	}
+	stats := tally.NewTestScope("", nil)
+
+	blob := core.SizedBlobFixture(4, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(config, clock.NewMock(), torrent)
+	d.stats = stats
+
+	healthy, err := d.addPeer(core.PeerIDFixture(), bitset.New(4), &queuedMessages{
+		mockMessages: newMockMessages(),
+		send:         conn.QueueStats{Messages: 1, Bytes: 10, OldestAge: time.Second},
+	})
+	require.NoError(err)
+
+	// A control message is stuck behind a large payload.
+	stuck, err := d.addPeer(core.PeerIDFixture(), bitset.New(4), &queuedMessages{
+		mockMessages: newMockMessages(),
+		send: conn.QueueStats{
+			Messages:         2,
+			Bytes:            1000,
+			OldestAge:        time.Minute,
+			OldestControlAge: 30 * time.Second,
+		},
+		receive: conn.QueueStats{Messages: 1, Bytes: 5, OldestAge: time.Millisecond},
+	})
+	require.NoError(err)
+
+	d.sampleQueues()
+
+	require.False(healthy.messages.(*queuedMessages).isClosed())
+	require.True(stuck.messages.(*queuedMessages).isClosed())
+
+	s, ok := d.PeerStats(stuck.id)
+	require.True(ok)
+	require.Equal(1, s.HeadOfLineBlocks)
+	s, ok = d.PeerStats(healthy.id)
+	require.True(ok)
+	require.Equal(0, s.HeadOfLineBlocks)
+
+	snapshot := stats.Snapshot()
+	counters := snapshot.Counters()
+	require.Equal(int64(1), counters["head_of_line_blocked_peers+direction=send"].Value())
+	require.NotContains(counters, "head_of_line_blocked_peers+direction=receive")
+	require.Equal(int64(1), counters["head_of_line_conn_resets+"].Value())
+
+	gauges := snapshot.Gauges()
+	require.Equal(float64(1010), gauges["queued_bytes+direction=send"].Value())
+	require.Equal(float64(5), gauges["queued_bytes+direction=receive"].Value())
+	for bucket, n := range map[string]float64{"100ms": 0, "1s": 1, "10s": 0, "inf": 1} {
+		key := fmt.Sprintf("peers_by_oldest_queued_message+age=%s,direction=send", bucket)
+		require.Equal(n, gauges[key].Value(), bucket)
+	}
+	require.Equal(float64(2),
+		gauges["peers_by_oldest_queued_message+age=100ms,direction=receive"].Value())
+}
+
+func TestDispatcherPeerPieceCountsUnderChurn(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(3, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	require.NoError(torrent.WritePiece(piecereader.NewBuffer(blob.Content[1:2]), 1))
+
+	d := testDispatcher(
+		Config{PieceRequestPolicy: piecerequest.RarestFirstPolicy}, clock.NewMock(), torrent)
+
+	counts := func() []int {
+		var c []int
+		for i := 0; i < 3; i++ {
+			c = append(c, d.numPeersByPiece.Get(i))
+		}
+		return c
+	}
+
+	p1, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, false, false), newMockMessages())
+	require.NoError(err)
+	p2, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false, false, true), newMockMessages())
+	require.NoError(err)
+	require.Equal([]int{1, 0, 1}, counts())
+
+	// Completion only counts pieces p1 did not announce before.
+	require.NoError(d.dispatch(p1, conn.NewAnnouncePieceMessage(2)))
+	require.NoError(d.dispatch(p1, conn.NewCompleteMessage()))
+	require.Equal([]int{1, 1, 2}, counts())
+
+	// Serving a piece counts it for p2, once.
+	require.NoError(d.dispatch(p2, conn.NewPieceRequestMessage(1, 1)))
+	waitForServes(t, p2)
+	require.NoError(d.dispatch(p2, conn.NewAnnouncePieceMessage(1)))
+	require.Equal([]int{1, 2, 2}, counts())
+
+	require.NoError(d.removePeer(p1))
+	require.Equal([]int{0, 1, 1}, counts())
+
+	// Pieces are not counted for removed peers.
+	require.NoError(d.removePeer(p2))
+	d.peerHasPiece(p2, 0, _completedByAnnounce)
+	d.peerHasAllPieces(p2)
+	require.Equal([]int{0, 0, 0}, counts())
+
+	p3, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false, true, false), newMockMessages())
+	require.NoError(err)
+	require.Equal([]int{0, 1, 0}, counts())
+	require.NoError(d.removePeer(p3))
+	require.Equal([]int{0, 0, 0}, counts())
+}
+
+func TestDispatcherRequestsRarestPiecesFirst(t *testing.T) {
+	require := require.New(t)
+
+	config := Config{
+		PieceRequestPolicy: piecerequest.RarestFirstPolicy,
+		PipelineLimit:      1,
+		DisableEndgame:     true,
+	}
+
+	blob := core.SizedBlobFixture(4, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(config, clock.NewMock(), torrent)
+
+	for _, b := range [][]bool{
+		{true, true, true, false},
+		{true, true, false, false},
+		{true, false, false, false},
+	} {
+		_, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(b...), newMockMessages())
+		require.NoError(err)
+	}
+	seeder, err := d.addPeer(
+		core.PeerIDFixture(), bitsetutil.FromBools(true, true, true, true), newMockMessages())
+	require.NoError(err)
+
+	// Each request to the seeder is for the rarest remaining piece, and receiving
+	// the piece requests the next one.
+	_, err = d.maybeRequestMorePieces(seeder)
+	require.NoError(err)
+	for _, i := range []int{3, 2, 1, 0} {
+		require.Equal(map[int]int{i: 1}, numRequestsPerPiece(seeder.messages))
+
+		seeder.messages = newMockMessages()
+		require.NoError(d.dispatch(
+			seeder, conn.NewPiecePayloadMessage(i, piecereader.NewBuffer(blob.Content[i:i+1]))))
+	}
+	require.True(d.Complete())
+}
+
+// simulatePieceRequestChurn runs rounds in which the peers of d are replaced,
+// such that piece 0 is always just above a random rarest piece, and a new
+// seeder is sent a single piece request. Returns the maximum number of
+// consecutive rounds any piece went unrequested.
+func simulatePieceRequestChurn(t *testing.T, config Config, numPieces, rounds int) int {
+	require := require.New(t)
+
+	torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(uint64(numPieces), 1).MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(config, clock.NewMock(), torrent)
+
+	rng := rand.New(rand.NewSource(0))
+
+	all := func(except ...int) *bitset.BitSet {
+		b := bitset.New(uint(numPieces)).Complement()
+		for _, i := range except {
+			b.Clear(uint(i))
+		}
+		return b
+	}
+
+	lastRequested := make([]int, numPieces)
+	var maxWait int
+	var peers []*peer
+	for round := 1; round <= rounds; round++ {
+		// All peers of the previous round depart.
+		for _, p := range peers {
+			require.NoError(d.removePeer(p))
+		}
+		peers = nil
+
+		// Piece 0 is held by two peers, the rarest piece by one, and all other
+		// pieces by three.
+		rarest := 1 + rng.Intn(numPieces-1)
+		for _, b := range []*bitset.BitSet{all(), all(rarest), all(rarest, 0)} {
+			p, err := d.addPeer(core.PeerIDFixture(), b, newMockMessages())
+			require.NoError(err)
+			peers = append(peers, p)
+		}
+		seeder, err := d.addPeer(core.PeerIDFixture(), all(), newMockMessages())
+		require.NoError(err)
+		peers = append(peers, seeder)
+
+		_, err = d.maybeRequestMorePieces(seeder)
+		require.NoError(err)
+		requests := numRequestsPerPiece(seeder.messages)
+		require.Len(requests, 1)
+		for i := range requests {
+			lastRequested[i] = round
+		}
+
+		d.resendFailedPieceRequests()
+
+		for i := 0; i < numPieces; i++ {
+			if wait := round - lastRequested[i]; wait > maxWait {
+				maxWait = wait
+			}
+		}
+	}
+	return maxWait
+}
+
+func TestDispatcherPieceRequestAgingUnderChurn(t *testing.T) {
+	numPieces := 10
+	rounds := 200
+
+	// Without aging, piece 0 is never requested.
+	require.Equal(t, rounds, simulatePieceRequestChurn(t, Config{
+		PieceRequestPolicy:       piecerequest.RarestFirstPolicy,
+		PipelineLimit:            1,
+		DisableEndgame:           true,
+		DisablePieceRequestAging: true,
+	}, numPieces, rounds))
+
+	// With aging, every piece is requested within a bounded number of rounds.
+	require.True(t, simulatePieceRequestChurn(t, Config{
+		PieceRequestPolicy:    piecerequest.RarestFirstPolicy,
+		PipelineLimit:         1,
+		DisableEndgame:        true,
+		PieceRequestAgingRate: 0.5,
+	}, numPieces, rounds) <= 2*numPieces)
+}
+
+func TestDispatcherAdaptivePipelineLimit(t *testing.T) {
+	require := require.New(t)
+
+	config := Config{
+		PipelineLimit:    4,
+		MinPipelineLimit: 1,
+		MaxPipelineLimit: 8,
+		DisableEndgame:   true,
+	}
+	clk := clock.NewMock()
+
+	blob := core.SizedBlobFixture(32, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(config, clk, torrent)
+
+	p, err := d.addPeer(
+		core.PeerIDFixture(), bitsetutil.FromBools(make([]bool, 32)...).Complement(), newMockMessages())
+	require.NoError(err)
+
+	requested := func() []int { return requestedPieces(p.messages) }
+	send := func(i int, b []byte) error {
+		return d.dispatch(p, conn.NewPiecePayloadMessage(i, piecereader.NewBuffer(b)))
+	}
+
+	_, err = d.maybeRequestMorePieces(p)
+	require.NoError(err)
+	require.Len(d.pieceRequestManager.PendingPieces(p.id), 4)
+
+	// Pieces received well under the timeout grow the limit.
+	clk.Add(10 * time.Millisecond)
+	for _, i := range d.pieceRequestManager.PendingPieces(p.id) {
+		require.NoError(send(i, blob.Content[i:i+1]))
+	}
+	require.Equal(5, d.pieceRequestManager.PipelineDepth(p.id))
+	require.Len(d.pieceRequestManager.PendingPieces(p.id), 5)
+
+	// Expired requests halve the limit once.
+	clk.Add(5 * time.Second)
+	d.resendFailedPieceRequests()
+	require.Equal(2, d.pieceRequestManager.PipelineDepth(p.id))
+
+	n := len(requested())
+	_, err = d.maybeRequestMorePieces(p)
+	require.NoError(err)
+	pending := requested()[n:]
+	require.Len(pending, 2)
+
+	// Invalid pieces halve it again.
+	i := pending[0]
+	require.Equal(ErrorValidation, Category(send(i, []byte{^blob.Content[i]})))
+	require.Equal(1, d.pieceRequestManager.PipelineDepth(p.id))
 }
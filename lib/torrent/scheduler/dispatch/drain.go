@@ -0,0 +1,108 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var errDraining = errors.New("piece request rejected while draining")
+
+// inflight counts operations which graceful teardown waits for, i.e. piece
+// payloads being written and pieces being served. Unlike a sync.WaitGroup,
+// operations may begin while others wait for idleness.
+type inflight struct {
+	mu   sync.Mutex
+	n    int
+	idle chan struct{} // Closed once n drops to zero. Nil while n is zero.
+}
+
+func (f *inflight) begin() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.n == 0 {
+		f.idle = make(chan struct{})
+	}
+	f.n++
+}
+
+func (f *inflight) end() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.n--
+	if f.n == 0 {
+		close(f.idle)
+		f.idle = nil
+	}
+}
+
+// done returns a channel which is closed once no operations are in flight.
+func (f *inflight) done() <-chan struct{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.idle == nil {
+		c := make(chan struct{})
+		close(c)
+		return c
+	}
+	return f.idle
+}
+
+// Drain tears d down gracefully with reason: d stops requesting pieces and
+// rejects new piece requests of peers, and then waits up to timeout for piece
+// payloads being written and pieces being served before closing connections.
+// TearDownWithReason remains the hard path for emergency shutdowns, and cuts
+// Drain short, as does the context of d being done, see NewWithContext.
+func (d *Dispatcher) Drain(reason TearDownReason, timeout time.Duration) {
+	if d.draining.CAS(false, true) {
+		d.log("reason", reason).Info("Draining dispatcher")
+	}
+	start := d.clk.Now()
+	select {
+	case <-d.inflight.done():
+	case <-d.clk.After(timeout):
+		d.log().Warnf("Dispatcher not drained within %s, tearing down", timeout)
+		d.stats.Counter("drain_timeouts").Inc(1)
+	case <-d.tornDown:
+	case <-d.ctx.Done():
+		select {
+		case <-d.tornDown:
+		default:
+			d.log().Warn("Dispatcher context done while draining, tearing down")
+			d.stats.Counter("drain_cancellations").Inc(1)
+			reason = TearDownCanceled
+		}
+	}
+	d.stats.Timer("drain_time").Record(d.clk.Now().Sub(start))
+	d.TearDownWithReason(reason)
+}
+
+// Draining returns whether d is being drained, see Drain.
+func (d *Dispatcher) Draining() bool {
+	return d.draining.Load()
+}
+
+// startServe serves the queued piece requests of p asynchronously.
+func (d *Dispatcher) startServe(p *peer) {
+	d.inflight.begin()
+	go func() {
+		defer d.inflight.end()
+		d.serve(p)
+	}()
+}
@@ -0,0 +1,214 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"testing"
+	"time"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/gen/go/proto/p2p"
+	"github.com/uber/kraken/lib/torrent/scheduler/conn"
+	"github.com/uber/kraken/lib/torrent/storage"
+	"github.com/uber/kraken/lib/torrent/storage/agentstorage"
+	"github.com/uber/kraken/lib/torrent/storage/piecereader"
+	"github.com/uber/kraken/utils/bitsetutil"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+)
+
+// blockingWriteTorrent blocks writes of pieces until release is closed,
+// signalling writing once per write.
+type blockingWriteTorrent struct {
+	storage.Torrent
+	writing chan int
+	release chan struct{}
+}
+
+func (t *blockingWriteTorrent) WritePiece(src storage.PieceReader, piece int) error {
+	t.writing <- piece
+	<-t.release
+	return t.Torrent.WritePiece(src, piece)
+}
+
+func isDone(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+// drainingDispatcher starts receiving piece 0 from p, blocked in its write to
+// torrent, and drains d in the background. The returned channels are closed once
+// the payload was handled and once d was torn down, respectively.
+func drainingDispatcher(
+	t *testing.T, clk clock.Clock, blob *core.BlobFixture, fixture storage.Torrent) (
+	d *Dispatcher, p *peer, torrent *blockingWriteTorrent, handled, drained chan struct{}) {
+
+	require := require.New(t)
+
+	torrent = &blockingWriteTorrent{
+		Torrent: fixture,
+		writing: make(chan int),
+		release: make(chan struct{}),
+	}
+
+	d = testDispatcher(Config{}, clk, torrent)
+	d.stats = tally.NewTestScope("", nil)
+
+	p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, true), newMockMessages())
+	require.NoError(err)
+	_, err = d.maybeRequestMorePieces(p)
+	require.NoError(err)
+
+	handled = make(chan struct{})
+	go func() {
+		defer close(handled)
+		d.dispatch(p, conn.NewPiecePayloadMessage(0, piecereader.NewBuffer(blob.Content[0:1])))
+	}()
+	require.Equal(0, <-torrent.writing)
+
+	drained = make(chan struct{})
+	go func() {
+		defer close(drained)
+		d.Drain(TearDownShutdown, time.Minute)
+	}()
+	require.Eventually(d.Draining, time.Second, time.Millisecond)
+
+	return d, p, torrent, handled, drained
+}
+
+func TestDispatcherDrainCommitsInFlightPayload(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(2, 1)
+	fixture, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	d, p, torrent, handled, drained := drainingDispatcher(t, clock.NewMock(), blob, fixture)
+
+	// Connections stay open while the payload is written...
+	require.False(isDone(drained))
+	require.False(closed(p.messages))
+	require.True(d.Dump().Draining)
+
+	// ...but no pieces are requested, and piece requests are rejected.
+	numSent := len(p.messages.(*mockMessages).getSent())
+	sent, err := d.maybeRequestMorePieces(p)
+	require.NoError(err)
+	require.False(sent)
+	require.NoError(d.dispatch(p, conn.NewPieceRequestMessage(1, 1)))
+	msgs := p.messages.(*mockMessages).getSent()[numSent:]
+	require.Len(msgs, 1)
+	require.Equal(p2p.Message_ERROR, msgs[0].Message.Type)
+	require.Equal(p2p.ErrorMessage_PIECE_REQUEST_RETRY, msgs[0].Message.Error.Code)
+
+	close(torrent.release)
+	<-handled
+	<-drained
+
+	require.True(torrent.HasPiece(0))
+	require.True(closed(p.messages))
+	reason, ok := d.FinalReason()
+	require.True(ok)
+	require.Equal(TearDownShutdown, reason)
+
+	counters := d.stats.(tally.TestScope).Snapshot().Counters()
+	require.Equal(int64(1), counters["rejected_draining_piece_requests+"].Value())
+	require.Nil(counters["drain_timeouts+"])
+}
+
+func TestDispatcherDrainTimesOut(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+	blob := core.SizedBlobFixture(2, 1)
+	fixture, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	d, p, torrent, handled, drained := drainingDispatcher(t, clk, blob, fixture)
+
+	require.Eventually(func() bool {
+		clk.Add(time.Minute)
+		return isDone(drained)
+	}, time.Second, time.Millisecond)
+	require.True(closed(p.messages))
+
+	counters := d.stats.(tally.TestScope).Snapshot().Counters()
+	require.Equal(int64(1), counters["drain_timeouts+"].Value())
+
+	close(torrent.release)
+	<-handled
+}
+
+func TestDispatcherTearDownCutsDrainShort(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(2, 1)
+	fixture, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	d, p, torrent, handled, drained := drainingDispatcher(t, clock.NewMock(), blob, fixture)
+
+	d.TearDownWithReason(TearDownRemoved)
+	<-drained
+	require.True(closed(p.messages))
+
+	// The first reason is kept.
+	reason, ok := d.FinalReason()
+	require.True(ok)
+	require.Equal(TearDownRemoved, reason)
+
+	close(torrent.release)
+	<-handled
+}
+
+func TestDispatcherDrainWaitsForServes(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(1, 1)
+
+	fixture, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+	require.NoError(fixture.WritePiece(piecereader.NewBuffer(blob.Content), 0))
+
+	torrent := &blockingTorrent{
+		Torrent: fixture,
+		reading: make(chan int),
+		release: make(chan struct{}),
+	}
+	d := testDispatcher(Config{}, clock.NewMock(), torrent)
+
+	p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false), newMockMessages())
+	require.NoError(err)
+	require.NoError(d.dispatch(p, conn.NewPieceRequestMessage(0, 1)))
+	require.Equal(0, <-torrent.reading)
+
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		d.Drain(TearDownShutdown, time.Minute)
+	}()
+	require.Eventually(d.Draining, time.Second, time.Millisecond)
+	require.False(isDone(drained))
+
+	close(torrent.release)
+	<-drained
+	require.Equal([]int{0}, servedPieces(p.messages))
+	require.True(closed(p.messages))
+}
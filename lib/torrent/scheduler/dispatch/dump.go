@@ -0,0 +1,148 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import "time"
+
+// Dump is a JSON-serializable summary of the state of a Dispatcher, for
+// debugging purposes.
+type Dump struct {
+	InfoHash      string    `json:"info_hash"`
+	Digest        string    `json:"digest"`
+	CreatedAt     time.Time `json:"created_at"`
+	Complete      bool      `json:"complete"`
+	Progress      Progress  `json:"progress"`
+	CorruptPieces int       `json:"corrupt_pieces"`
+
+	// SlowestServes and UnadvertisedPieces are the slow serve outliers of the
+	// Dispatcher, see Dispatcher.SlowestServes and Dispatcher.UnadvertisedPieces.
+	SlowestServes      []ServeLatency `json:"slowest_serves"`
+	UnadvertisedPieces []int          `json:"unadvertised_pieces"`
+
+	// QuarantinedPieces are the pieces suspected to be corrupt in storage, see
+	// Dispatcher.QuarantinedPieces.
+	QuarantinedPieces []int `json:"quarantined_pieces,omitempty"`
+
+	// Phases is only set once the torrent is complete.
+	Phases *Phases `json:"phases,omitempty"`
+
+	// EndgameCause is only set once the Dispatcher entered endgame, see
+	// Dispatcher.EndgameCause.
+	EndgameCause string `json:"endgame_cause,omitempty"`
+
+	// Draining is set once the Dispatcher is being drained, see Dispatcher.Drain.
+	Draining bool `json:"draining,omitempty"`
+
+	// Invalidating is set once the torrent of the Dispatcher is being deleted by
+	// the storage layer, see Dispatcher.BeginInvalidation.
+	Invalidating bool `json:"invalidating,omitempty"`
+
+	// SeedOnly is set once the Dispatcher neither requests nor tracks pieces,
+	// see Config.SeedOnly.
+	SeedOnly bool `json:"seed_only,omitempty"`
+
+	// FinalReason is empty until the Dispatcher is torn down.
+	FinalReason string `json:"final_reason,omitempty"`
+
+	// CompactedPeers is the number of removed peers whose detail was folded
+	// into aggregates, see Config.PeerDetailTTL.
+	CompactedPeers int `json:"compacted_peers,omitempty"`
+
+	// PeersByCapability is the number of connected peers which negotiated each
+	// capability, out of Progress.NumPeers. PeersWithUnknownCapabilities is the
+	// number of connected peers which listed capabilities we do not implement.
+	PeersByCapability            map[string]int `json:"peers_by_capability"`
+	PeersWithUnknownCapabilities int            `json:"peers_with_unknown_capabilities"`
+
+	// CapabilityUsage is how often the Dispatcher exercised each capability,
+	// e.g. sent batched announcements to peers which negotiated AnnouncePieces.
+	CapabilityUsage map[string]int64 `json:"capability_usage"`
+
+	// Utilization is how much of its configured request parallelism the
+	// Dispatcher sustained, see Dispatcher.Utilization.
+	Utilization Utilization `json:"utilization"`
+
+	// StatsGuard is the state of the guard around the metric emissions of the
+	// Dispatcher, see Dispatcher.StatsGuard.
+	StatsGuard StatsGuardState `json:"stats_guard"`
+
+	// Decisions are the most recent decisions of the Dispatcher, see
+	// Dispatcher.Decisions.
+	Decisions []Decision `json:"decisions,omitempty"`
+
+	// PeerStateSizes is the number of entries in each map of the Dispatcher
+	// which holds per-peer state, by name. Sizes which grow with the number of
+	// peers ever seen rather than with the number of connected peers indicate
+	// a leak in long-lived Dispatchers.
+	PeerStateSizes map[string]int `json:"peer_state_sizes"`
+}
+
+// Dump returns a summary of the state of d. Safe to call after d was torn down.
+func (d *Dispatcher) Dump() Dump {
+	dump := Dump{
+		InfoHash:           d.torrent.InfoHash().Hex(),
+		Digest:             d.torrent.Digest().Hex(),
+		CreatedAt:          d.createdAt,
+		Complete:           d.torrent.Complete(),
+		Progress:           d.Progress(),
+		CorruptPieces:      int(d.corruptPieces.Load()),
+		SlowestServes:      d.SlowestServes(),
+		UnadvertisedPieces: d.UnadvertisedPieces(),
+		QuarantinedPieces:  d.QuarantinedPieces(),
+		Draining:           d.Draining(),
+		Invalidating:       d.Invalidating(),
+		SeedOnly:           d.SeedOnly(),
+	}
+	if dump.Complete {
+		phases := d.Phases()
+		dump.Phases = &phases
+	}
+	if cause, ok := d.EndgameCause(); ok {
+		dump.EndgameCause = cause.String()
+	}
+	if reason, ok := d.FinalReason(); ok {
+		dump.FinalReason = reason.String()
+	}
+	_, dump.CompactedPeers = d.peerStats.aggregate()
+	dump.PeersByCapability, dump.PeersWithUnknownCapabilities = d.capabilityStats.peerCounts()
+	dump.CapabilityUsage = d.capabilityStats.usageCounts()
+	dump.Utilization = d.Utilization()
+	dump.StatsGuard = d.StatsGuard()
+	dump.Decisions = d.Decisions()
+	dump.PeerStateSizes = d.peerStateSizes()
+	return dump
+}
+
+// peerStateSizes returns the number of entries in each map of d which holds
+// per-peer state.
+func (d *Dispatcher) peerStateSizes() map[string]int {
+	sizes := map[string]int{
+		"peers":              d.NumPeers(),
+		"announcer_pending":  d.announcer.numPeers(),
+		"chunk_contributors": d.chunks.numContributors(),
+	}
+	if !d.SeedOnly() {
+		for name, n := range d.pieceRequestManager.PeerStateSizes() {
+			sizes["piece_requests_"+name] = n
+		}
+	}
+	sizes["peer_stats"], sizes["peer_stats_disconnected"] = d.peerStats.size()
+	if d.prefetch != nil {
+		sizes["prefetch_peers"] = d.prefetch.numPeers()
+	}
+	if d.superseed != nil {
+		sizes["superseed_peers"] = d.superseed.numPeers()
+	}
+	return sizes
+}
@@ -0,0 +1,195 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"sync"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"golang.org/x/time/rate"
+)
+
+// Window with which egress utilization is smoothed.
+const _egressRateWindow = time.Second
+
+// egressLimiter limits the rate at which a Dispatcher serves piece bytes to all
+// of its peers via a token bucket. Serves which must wait for tokens are queued,
+// up to maxQueued serves, and are granted tokens in the order of a
+// ServeScheduler. Serves of priority requests are granted ahead of other serves,
+// within the bounds of a priorityShare.
+type egressLimiter struct {
+	clk         clock.Clock
+	bytesPerSec int64
+	maxQueued   int
+	limiter     *rate.Limiter
+	scheduler   ServeScheduler
+
+	mu       sync.Mutex // Protects the following fields:
+	waiting  []*egressWaiter
+	timer    *clock.Timer
+	sent     *rateEstimator
+	priority *priorityShare
+}
+
+// egressWaiter is a serve of n bytes to p waiting for tokens.
+type egressWaiter struct {
+	p        *peer
+	piece    int
+	n        int64
+	priority bool
+	queuedAt time.Time
+	ready    chan struct{}
+}
+
+func newEgressLimiter(
+	clk clock.Clock,
+	bytesPerSec, maxPieceLength int64,
+	maxQueued int,
+	scheduler ServeScheduler,
+	priorityPercent int) *egressLimiter {
+
+	// Bursts must fit at least one piece, else the piece can never be served.
+	burst := bytesPerSec
+	if burst < maxPieceLength {
+		burst = maxPieceLength
+	}
+	return &egressLimiter{
+		clk:         clk,
+		bytesPerSec: bytesPerSec,
+		maxQueued:   maxQueued,
+		limiter:     rate.NewLimiter(rate.Limit(bytesPerSec), int(burst)),
+		scheduler:   scheduler,
+		sent:        newRateEstimator(_egressRateWindow, clk.Now()),
+		priority:    newPriorityShare(priorityPercent),
+	}
+}
+
+// wait blocks until n bytes of piece may be sent to p. priority is whether p
+// requested piece urgently. Returns false without blocking if the bytes cannot
+// be sent immediately and too many serves are already queued.
+func (l *egressLimiter) wait(p *peer, piece int, n int64, priority bool) bool {
+	l.mu.Lock()
+	now := l.clk.Now()
+	if len(l.waiting) == 0 && l.limiter.AllowN(now, int(n)) {
+		l.mu.Unlock()
+		return true
+	}
+	if len(l.waiting) >= l.maxQueued {
+		l.mu.Unlock()
+		return false
+	}
+	w := &egressWaiter{p, piece, n, priority, now, make(chan struct{})}
+	l.waiting = append(l.waiting, w)
+	l.releaseLocked()
+	l.mu.Unlock()
+
+	<-w.ready
+	return true
+}
+
+// numQueued returns the number of queued serves.
+func (l *egressLimiter) numQueued() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return len(l.waiting)
+}
+
+// retryAfter estimates how long it takes until the queued serves were granted
+// tokens, i.e. when a serve rejected now could be queued again.
+func (l *egressLimiter) retryAfter() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var n int64
+	for _, w := range l.waiting {
+		n += w.n
+	}
+	return time.Duration(float64(n) / float64(l.bytesPerSec) * float64(time.Second))
+}
+
+func (l *egressLimiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.timer = nil
+	l.releaseLocked()
+}
+
+// releaseLocked grants tokens to queued serves in the order of the scheduler
+// until tokens run out, and then waits until the next serve may be granted.
+// The next serve is picked anew every time, such that serves queued in the
+// meantime and changes to the peers are taken into account.
+func (l *egressLimiter) releaseLocked() {
+	if l.timer != nil {
+		return
+	}
+	now := l.clk.Now()
+	for len(l.waiting) > 0 {
+		j, contested := l.priority.pick(l.nextLocked)
+		w := l.waiting[j]
+		r := l.limiter.ReserveN(now, int(w.n))
+		if delay := r.DelayFrom(now); delay > 0 {
+			r.CancelAt(now)
+			l.timer = l.clk.AfterFunc(delay, l.release)
+			return
+		}
+		if contested {
+			l.priority.record(w.priority)
+		}
+		l.waiting = append(l.waiting[:j], l.waiting[j+1:]...)
+		close(w.ready)
+	}
+}
+
+// nextLocked returns the index of the queued serve of the given priority to
+// grant next, or -1 if there is none. Serves which the scheduler does not order
+// are granted in the order they were queued.
+func (l *egressLimiter) nextLocked(priority bool) int {
+	best := -1
+	var bestServe QueuedServe
+	for j, w := range l.waiting {
+		if w.priority != priority {
+			continue
+		}
+		qs := w.queuedServe()
+		if best < 0 || l.scheduler.Less(qs, bestServe) {
+			best, bestServe = j, qs
+		}
+	}
+	return best
+}
+
+func (w *egressWaiter) queuedServe() QueuedServe {
+	return QueuedServe{
+		PeerID:              w.p.id,
+		Piece:               w.piece,
+		Priority:            w.priority,
+		QueuedAt:            w.queuedAt,
+		PeerCompletion:      w.p.completion(),
+		PeerBytesDownloaded: w.p.getBytesDownloaded(),
+	}
+}
+
+// sentBytes records that n bytes were sent, returning the current utilization of
+// the limit as a fraction.
+func (l *egressLimiter) sentBytes(n int64) float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.clk.Now()
+	l.sent.add(n, now)
+	return l.sent.get(now) / float64(l.bytesPerSec)
+}
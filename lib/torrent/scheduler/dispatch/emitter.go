@@ -0,0 +1,249 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/uber-go/tally"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+)
+
+// eventEmitter delivers Events serially, in the order in which they were
+// emitted. Events emitted after the emitter is closed are dropped.
+//
+// The scheduler depends on every event reaching the primary Events, so its
+// queue is unbounded, and it is never dropped nor waited for on close. Listeners
+// registered via WithEventListeners are best effort instead: each consumes at
+// most queueSize queued events, and is dropped once it falls behind or blocks
+// for longer than listenerTimeout. Panics of any consumer are recovered.
+type eventEmitter struct {
+	events          Events
+	listeners       []*eventListener
+	listenerTimeout time.Duration
+	clk             clock.Clock
+	stats           tally.Scope
+	logger          *zap.SugaredLogger
+
+	mu      sync.Mutex // Serializes emits, such that consumers agree on order.
+	closed  bool
+	pending []func(Events) // Queued for the primary Events.
+	wakeup  *sync.Cond     // Signals pending events, or close, to the primary.
+	started bool           // Whether the primary goroutine was started.
+}
+
+type eventListener struct {
+	events    Events
+	queue     chan func(Events)
+	busySince *atomic.Int64 // Start of the delivery in flight in Unix nanos, or 0.
+	dropped   *atomic.Bool
+	started   bool          // Guarded by eventEmitter.mu.
+	done      chan struct{} // Closed once the goroutine of the listener exited.
+}
+
+func newEventEmitter(
+	events Events,
+	listeners []Events,
+	listenerTimeout time.Duration,
+	queueSize int,
+	clk clock.Clock,
+	stats tally.Scope,
+	logger *zap.SugaredLogger) *eventEmitter {
+
+	e := &eventEmitter{
+		events:          events,
+		listenerTimeout: listenerTimeout,
+		clk:             clk,
+		stats:           stats,
+		logger:          logger,
+	}
+	e.wakeup = sync.NewCond(&e.mu)
+	for _, events := range listeners {
+		l := &eventListener{
+			events:    events,
+			queue:     make(chan func(Events), queueSize),
+			busySince: atomic.NewInt64(0),
+			dropped:   atomic.NewBool(false),
+			done:      make(chan struct{}),
+		}
+		e.listeners = append(e.listeners, l)
+	}
+	return e
+}
+
+// emit enqueues f for delivery to the primary Events and every listener. Never
+// blocks.
+func (e *eventEmitter) emit(f func(Events)) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.closed {
+		e.stats.Counter("dropped_events").Inc(1)
+		return
+	}
+
+	// Dispatchers sharing a Runner must not cost goroutines until they have
+	// events to deliver, so consumers are started on their first event.
+	e.pending = append(e.pending, f)
+	e.wakeup.Signal()
+	if !e.started {
+		e.started = true
+		go e.runPrimary()
+	}
+
+	for _, l := range e.listeners {
+		if l.dropped.Load() {
+			continue
+		}
+		if blocked := e.blockedFor(l); blocked >= e.listenerTimeout {
+			e.drop(l, fmt.Sprintf("blocked for %s", blocked))
+			continue
+		}
+		select {
+		case l.queue <- f:
+		default:
+			e.drop(l, fmt.Sprintf("has %d events queued", cap(l.queue)))
+			continue
+		}
+		if !l.started {
+			l.started = true
+			go e.run(l)
+		}
+	}
+}
+
+// close stops accepting new events. The primary Events still receives the
+// events emitted before close, but close does not wait for them, since the
+// scheduler tears down Dispatchers from the goroutine which consumes them.
+// close does wait for listeners to consume their queued events, and drops those
+// which do not within listenerTimeout altogether. Listeners which are blocked
+// for listenerTimeout already are dropped without waiting.
+func (e *eventEmitter) close() {
+	e.mu.Lock()
+	if e.closed {
+		e.mu.Unlock()
+		return
+	}
+	e.closed = true
+	e.wakeup.Signal()
+	for _, l := range e.listeners {
+		close(l.queue)
+		if !l.started {
+			close(l.done)
+		}
+	}
+	e.mu.Unlock()
+
+	// All listeners share one deadline, such that close takes listenerTimeout at
+	// most however many listeners block.
+	var deadline <-chan time.Time
+	var expired bool
+	for _, l := range e.listeners {
+		if l.dropped.Load() {
+			continue
+		}
+		if blocked := e.blockedFor(l); blocked >= e.listenerTimeout {
+			e.drop(l, fmt.Sprintf("blocked for %s", blocked))
+			continue
+		}
+		if expired {
+			select {
+			case <-l.done:
+			default:
+				e.drop(l, fmt.Sprintf("blocked for over %s", e.listenerTimeout))
+			}
+			continue
+		}
+		if deadline == nil {
+			deadline = e.clk.After(e.listenerTimeout)
+		}
+		select {
+		case <-l.done:
+		case <-deadline:
+			expired = true
+			e.drop(l, fmt.Sprintf("blocked for over %s", e.listenerTimeout))
+		}
+	}
+}
+
+// runPrimary delivers the pending events of the primary Events until the
+// emitter is closed and no events are pending.
+func (e *eventEmitter) runPrimary() {
+	for {
+		e.mu.Lock()
+		for len(e.pending) == 0 && !e.closed {
+			e.wakeup.Wait()
+		}
+		if len(e.pending) == 0 {
+			e.mu.Unlock()
+			return
+		}
+		f := e.pending[0]
+		e.pending[0] = nil
+		e.pending = e.pending[1:]
+		e.mu.Unlock()
+
+		e.recoverPanic(e.events, f)
+	}
+}
+
+// run delivers the queued events of l until the emitter is closed or l is
+// dropped.
+func (e *eventEmitter) run(l *eventListener) {
+	defer close(l.done)
+
+	for f := range l.queue {
+		if l.dropped.Load() {
+			return
+		}
+		l.busySince.Store(e.clk.Now().UnixNano())
+		e.recoverPanic(l.events, f)
+		l.busySince.Store(0)
+	}
+}
+
+// recoverPanic calls f on events, recovering from panics.
+func (e *eventEmitter) recoverPanic(events Events, f func(Events)) {
+	defer func() {
+		if r := recover(); r != nil {
+			e.stats.Counter("event_listener_panics").Inc(1)
+			e.logger.Errorf("Recovered from panic in event listener %T: %v", events, r)
+		}
+	}()
+	f(events)
+}
+
+// blockedFor returns how long the delivery in flight to l has taken, or zero if
+// l is idle.
+func (e *eventEmitter) blockedFor(l *eventListener) time.Duration {
+	since := l.busySince.Load()
+	if since == 0 {
+		return 0
+	}
+	return e.clk.Now().Sub(time.Unix(0, since))
+}
+
+// drop stops delivering events to l. Its delivery in flight, if any, is left to
+// return on its own.
+func (e *eventEmitter) drop(l *eventListener, reason string) {
+	if !l.dropped.CAS(false, true) {
+		return
+	}
+	e.stats.Counter("dropped_event_listeners").Inc(1)
+	e.logger.Errorf("Dropping event listener %T which %s", l.events, reason)
+}
@@ -0,0 +1,359 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/torrent/scheduler/conn"
+	"github.com/uber/kraken/lib/torrent/storage/agentstorage"
+	"github.com/uber/kraken/lib/torrent/storage/piecereader"
+	"github.com/uber/kraken/utils/bitsetutil"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+	"go.uber.org/zap"
+)
+
+// recordingEvents records the names of all received events in order.
+type recordingEvents struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (e *recordingEvents) record(name string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.events = append(e.events, name)
+}
+
+func (e *recordingEvents) get() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]string(nil), e.events...)
+}
+
+func (e *recordingEvents) DispatcherComplete(*Dispatcher) {
+	e.record("complete")
+}
+
+func (e *recordingEvents) DispatcherFailed(d *Dispatcher, reason TearDownReason) {
+	e.record("failed:" + reason.String())
+}
+
+func (e *recordingEvents) PeerRemoved(peerID core.PeerID, h core.InfoHash) {
+	e.record("removed:" + peerID.String())
+}
+
+func (e *recordingEvents) PeerBanned(peerID core.PeerID, h core.InfoHash) {
+	e.record("banned:" + peerID.String())
+}
+
+func (e *recordingEvents) PiecesUnavailable(h core.InfoHash, pieces []int) {
+	e.record(fmt.Sprintf("unavailable:%v", pieces))
+}
+
+func (e *recordingEvents) PiecesQuarantined(h core.InfoHash, pieces []int) {
+	e.record(fmt.Sprintf("quarantined:%v", pieces))
+}
+
+func (e *recordingEvents) DispatcherStalled(*Dispatcher) {
+	e.record("stalled")
+}
+
+func testEmitter(events Events, stats tally.Scope, listeners ...Events) *eventEmitter {
+	return newEventEmitter(
+		events, listeners, 100*time.Millisecond, 1024, clock.New(), stats, zap.NewNop().Sugar())
+}
+
+func TestEventEmitterDeliversInOrder(t *testing.T) {
+	require := require.New(t)
+
+	events := &recordingEvents{}
+	e := testEmitter(events, tally.NoopScope)
+
+	var expected []string
+	for i := 0; i < 1000; i++ {
+		name := fmt.Sprintf("event-%d", i)
+		expected = append(expected, name)
+		e.emit(func(Events) { events.record(name) })
+	}
+
+	require.Eventually(func() bool {
+		return len(events.get()) == len(expected)
+	}, time.Second, 5*time.Millisecond)
+	require.Equal(expected, events.get())
+}
+
+func TestEventEmitterDropsEventsAfterClose(t *testing.T) {
+	require := require.New(t)
+
+	stats := tally.NewTestScope("", nil)
+	events := &recordingEvents{}
+	e := testEmitter(events, stats)
+
+	e.emit(func(e Events) { e.DispatcherComplete(nil) })
+	e.close()
+	e.emit(func(e Events) { e.DispatcherComplete(nil) })
+
+	require.Eventually(func() bool {
+		return len(events.get()) == 1
+	}, time.Second, 5*time.Millisecond)
+
+	require.Equal(int64(1), stats.Snapshot().Counters()["dropped_events+"].Value())
+}
+
+func TestDispatcherCompleteRacesDeliverOrderedEvents(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(1, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	events := &recordingEvents{}
+	d := testDispatcher(Config{ImmediateCompletedPeerClose: true}, clock.NewMock(), torrent)
+	d.emitter = testEmitter(events, tally.NoopScope)
+
+	p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true), newMockMessages())
+	require.NoError(err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.complete()
+		}()
+	}
+	require.NoError(d.dispatch(
+		p, conn.NewPiecePayloadMessage(0, piecereader.NewBuffer(blob.Content[0:1]))))
+	wg.Wait()
+
+	// Completion closes p, which exits the feed goroutine.
+	d.feed(p)
+
+	d.TearDown()
+
+	// Peers removed after teardown are not delivered.
+	p2, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true), newMockMessages())
+	require.NoError(err)
+	p2.messages.Close()
+	d.feed(p2)
+
+	expected := []string{"complete", "removed:" + p.id.String()}
+	require.Eventually(func() bool {
+		return len(events.get()) == len(expected)
+	}, time.Second, 5*time.Millisecond)
+	require.Equal(expected, events.get())
+}
+
+type panickingEvents struct{}
+
+func (panickingEvents) DispatcherComplete(*Dispatcher)               { panic("complete") }
+func (panickingEvents) DispatcherFailed(*Dispatcher, TearDownReason) { panic("failed") }
+func (panickingEvents) PeerRemoved(core.PeerID, core.InfoHash)       { panic("removed") }
+func (panickingEvents) PeerBanned(core.PeerID, core.InfoHash)        { panic("banned") }
+func (panickingEvents) PiecesUnavailable(core.InfoHash, []int)       { panic("unavailable") }
+func (panickingEvents) PiecesQuarantined(core.InfoHash, []int)       { panic("quarantined") }
+func (panickingEvents) DispatcherStalled(*Dispatcher)                { panic("stalled") }
+
+// blockingEvents blocks on every event until unblock is closed.
+type blockingEvents struct {
+	unblock chan struct{}
+}
+
+func (e blockingEvents) DispatcherComplete(*Dispatcher)               { <-e.unblock }
+func (e blockingEvents) DispatcherFailed(*Dispatcher, TearDownReason) { <-e.unblock }
+func (e blockingEvents) PeerRemoved(core.PeerID, core.InfoHash)       { <-e.unblock }
+func (e blockingEvents) PeerBanned(core.PeerID, core.InfoHash)        { <-e.unblock }
+func (e blockingEvents) PiecesUnavailable(core.InfoHash, []int)       { <-e.unblock }
+func (e blockingEvents) PiecesQuarantined(core.InfoHash, []int)       { <-e.unblock }
+func (e blockingEvents) DispatcherStalled(*Dispatcher)                { <-e.unblock }
+
+func TestEventEmitterIsolatesListeners(t *testing.T) {
+	require := require.New(t)
+
+	stats := tally.NewTestScope("", nil)
+	primary := &recordingEvents{}
+	healthy := &recordingEvents{}
+	blocking := blockingEvents{make(chan struct{})}
+	defer close(blocking.unblock)
+
+	e := testEmitter(primary, stats, panickingEvents{}, blocking, healthy)
+
+	var expected []string
+	for i := 0; i < 5; i++ {
+		peerID := core.PeerIDFixture()
+		expected = append(expected, "removed:"+peerID.String())
+		e.emit(func(e Events) { e.PeerRemoved(peerID, core.InfoHashFixture()) })
+	}
+	e.emit(func(e Events) { e.DispatcherComplete(nil) })
+	expected = append(expected, "complete")
+
+	require.Eventually(func() bool {
+		return len(healthy.get()) == len(expected)
+	}, 5*time.Second, 5*time.Millisecond)
+	require.Equal(expected, primary.get())
+	require.Equal(expected, healthy.get())
+
+	// The blocking listener never consumes its queue, so close drops it instead
+	// of waiting.
+	e.close()
+
+	counters := stats.Snapshot().Counters()
+	require.Equal(int64(len(expected)), counters["event_listener_panics+"].Value())
+	require.Equal(int64(1), counters["dropped_event_listeners+"].Value())
+}
+
+func TestEventEmitterCloseWaitsForBlockedListenersOnce(t *testing.T) {
+	require := require.New(t)
+
+	stats := tally.NewTestScope("", nil)
+	clk := clock.NewMock()
+	var listeners []Events
+	for i := 0; i < 3; i++ {
+		blocking := blockingEvents{make(chan struct{})}
+		defer close(blocking.unblock)
+		listeners = append(listeners, blocking)
+	}
+	e := newEventEmitter(
+		&recordingEvents{}, listeners, time.Second, 16, clk, stats, zap.NewNop().Sugar())
+	e.emit(func(e Events) { e.DispatcherStalled(nil) })
+	start := clk.Now()
+
+	closed := make(chan struct{})
+	go func() {
+		e.close()
+		close(closed)
+	}()
+
+	// A single listener timeout drops all blocked listeners.
+	require.Eventually(func() bool {
+		clk.Add(100 * time.Millisecond)
+		select {
+		case <-closed:
+			return true
+		default:
+			return false
+		}
+	}, 5*time.Second, time.Millisecond)
+	require.True(clk.Now().Sub(start) < 2*time.Second)
+	require.Equal(int64(3), stats.Snapshot().Counters()["dropped_event_listeners+"].Value())
+}
+
+func TestEventEmitterCloseDropsListenersBlockedAlready(t *testing.T) {
+	require := require.New(t)
+
+	stats := tally.NewTestScope("", nil)
+	clk := clock.NewMock()
+	blocking := blockingEvents{make(chan struct{})}
+	defer close(blocking.unblock)
+	e := newEventEmitter(
+		&recordingEvents{}, []Events{blocking}, time.Second, 16, clk, stats, zap.NewNop().Sugar())
+	// The mock clock starts at zero Unix nanos, which marks listeners as idle.
+	clk.Add(time.Hour)
+	e.emit(func(e Events) { e.DispatcherStalled(nil) })
+
+	require.Eventually(func() bool {
+		return e.listeners[0].busySince.Load() != 0
+	}, time.Second, time.Millisecond)
+	clk.Add(time.Second)
+
+	// Returns without the clock advancing any further.
+	e.close()
+	require.Equal(int64(1), stats.Snapshot().Counters()["dropped_event_listeners+"].Value())
+}
+
+func TestEventEmitterDropsListenersWhichFallBehind(t *testing.T) {
+	require := require.New(t)
+
+	stats := tally.NewTestScope("", nil)
+	healthy := &recordingEvents{}
+	blocking := blockingEvents{make(chan struct{})}
+	defer close(blocking.unblock)
+
+	e := newEventEmitter(
+		panickingEvents{}, []Events{blocking, healthy},
+		time.Minute, 2, clock.New(), stats, zap.NewNop().Sugar())
+
+	var expected []string
+	for i := 0; i < 5; i++ {
+		name := fmt.Sprintf("event-%d", i)
+		expected = append(expected, name)
+		e.emit(func(e Events) {
+			if r, ok := e.(*recordingEvents); ok {
+				r.record(name)
+			}
+			e.DispatcherStalled(nil)
+		})
+		// Let the healthy listener keep up with its queue.
+		require.Eventually(func() bool {
+			return len(healthy.get()) == 2*(i+1)
+		}, time.Second, time.Millisecond)
+	}
+	e.close()
+
+	var got []string
+	for i, name := range healthy.get() {
+		if i%2 == 0 {
+			got = append(got, name)
+		}
+	}
+	require.Equal(expected, got)
+
+	// The blocking listener is dropped once its queue fills up, while the
+	// panicking primary keeps receiving events.
+	counters := stats.Snapshot().Counters()
+	require.Equal(int64(1), counters["dropped_event_listeners+"].Value())
+	require.Equal(int64(len(expected)), counters["event_listener_panics+"].Value())
+}
+
+func TestEventEmitterNeverDropsPrimary(t *testing.T) {
+	require := require.New(t)
+
+	stats := tally.NewTestScope("", nil)
+	primary := &recordingEvents{}
+	e := testEmitter(primary, stats)
+
+	// The primary blocks on the first event for longer than the listener
+	// timeout, while more events are emitted than a listener may queue.
+	unblock := make(chan struct{})
+	e.emit(func(Events) { <-unblock })
+	var expected []string
+	for i := 0; i < 2000; i++ {
+		name := fmt.Sprintf("event-%d", i)
+		expected = append(expected, name)
+		e.emit(func(Events) { primary.record(name) })
+		if i == 0 {
+			time.Sleep(200 * time.Millisecond)
+		}
+	}
+
+	// Teardown does not wait for the primary.
+	e.close()
+	require.Empty(primary.get())
+
+	close(unblock)
+	require.Eventually(func() bool {
+		return len(primary.get()) == len(expected)
+	}, time.Second, 5*time.Millisecond)
+	require.Equal(expected, primary.get())
+	require.Zero(stats.Snapshot().Counters()["dropped_event_listeners+"])
+}
@@ -0,0 +1,113 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"fmt"
+
+	"github.com/willf/bitset"
+)
+
+// EndgameCause classifies why a Dispatcher entered endgame.
+type EndgameCause int
+
+const (
+	// EndgameSlowTail means every remaining piece had a peer to request it
+	// from, i.e. the download was only waiting for slow peers.
+	EndgameSlowTail EndgameCause = iota + 1
+
+	// EndgameAvailabilityLimited means some remaining pieces had no peer to
+	// request them from, such that duplicate requests cannot speed up the
+	// download.
+	EndgameAvailabilityLimited
+)
+
+func (c EndgameCause) String() string {
+	switch c {
+	case EndgameSlowTail:
+		return "slow_tail"
+	case EndgameAvailabilityLimited:
+		return "availability_limited"
+	default:
+		return fmt.Sprintf("EndgameCause(%d)", int(c))
+	}
+}
+
+// EndgameCause returns why d entered endgame, or false if d has not reserved
+// pieces in endgame yet.
+func (d *Dispatcher) EndgameCause() (EndgameCause, bool) {
+	c := d.endgameCause.Load()
+	if c == 0 {
+		return 0, false
+	}
+	return EndgameCause(c), true
+}
+
+// activateEndgame classifies the activation of endgame duplication, i.e. the
+// first piece reservation in endgame, such that torrents which are in endgame
+// from the start are not classified before their first peer. If some pieces
+// have no source, Events.PiecesUnavailable is emitted for them right away
+// rather than after Config.PieceUnavailableTimeout, unless already reported.
+func (d *Dispatcher) activateEndgame() {
+	if d.endgameCause.Load() != 0 {
+		return
+	}
+	missing := d.torrent.Bitfield().Complement()
+	if missing.None() {
+		return
+	}
+	sourceless := d.sourcelessPieces(missing)
+	cause := EndgameSlowTail
+	if len(sourceless) > 0 {
+		cause = EndgameAvailabilityLimited
+	}
+	if !d.endgameCause.CAS(0, int32(cause)) {
+		return
+	}
+	d.stats.Tagged(map[string]string{
+		"cause": cause.String(),
+	}).Counter("endgame_activations").Inc(1)
+	d.log(
+		"remaining", missing.Count(),
+		"sourceless", len(sourceless)).Infof("Entered endgame: %s", cause)
+
+	if len(sourceless) == 0 || d.config.PieceUnavailableTimeout == 0 {
+		return
+	}
+	pieces := d.unavailablePieces.report(sourceless, d.clk.Now())
+	if len(pieces) == 0 {
+		return
+	}
+	d.stats.Counter("pieces_unavailable").Inc(int64(len(pieces)))
+	h := d.torrent.InfoHash()
+	d.emitter.emit(func(e Events) { e.PiecesUnavailable(h, pieces) })
+}
+
+// sourcelessPieces returns the pieces in missing which no connected peer has.
+func (d *Dispatcher) sourcelessPieces(missing *bitset.BitSet) []int {
+	var pieces []int
+	for i, ok := missing.NextSet(0); ok; i, ok = missing.NextSet(i + 1) {
+		if d.numPeersByPiece.Get(int(i)) == 0 {
+			pieces = append(pieces, int(i))
+		}
+	}
+	return pieces
+}
+
+// hasSourcelessPieces returns whether some missing piece has no source. Endgame
+// duplicate requests are pointless meanwhile, since the download waits for
+// pieces which no peer has regardless.
+func (d *Dispatcher) hasSourcelessPieces() bool {
+	return len(d.sourcelessPieces(d.torrent.Bitfield().Complement())) > 0
+}
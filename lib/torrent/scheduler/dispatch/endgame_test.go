@@ -0,0 +1,133 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"testing"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/torrent/storage/agentstorage"
+	"github.com/uber/kraken/lib/torrent/storage/piecereader"
+	"github.com/uber/kraken/utils/bitsetutil"
+)
+
+func TestDispatcherSlowTailEndgameDuplicatesRequests(t *testing.T) {
+	require := require.New(t)
+
+	torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(2, 1).MetaInfo)
+	defer cleanup()
+
+	stats := tally.NewTestScope("", nil)
+	d := testDispatcher(Config{
+		PipelineLimit:    2,
+		EndgameThreshold: 2,
+		DisableKeepalive: true,
+	}, clock.NewMock(), torrent)
+	d.stats = stats
+
+	_, ok := d.EndgameCause()
+	require.False(ok)
+
+	p1, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, true), newMockMessages())
+	require.NoError(err)
+	p2, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, true), newMockMessages())
+	require.NoError(err)
+
+	_, err = d.maybeRequestMorePieces(p1)
+	require.NoError(err)
+	_, err = d.maybeRequestMorePieces(p2)
+	require.NoError(err)
+
+	// Both peers are requested all pieces.
+	require.ElementsMatch([]int{0, 1}, requestedPieces(p1.messages))
+	require.ElementsMatch([]int{0, 1}, requestedPieces(p2.messages))
+
+	cause, ok := d.EndgameCause()
+	require.True(ok)
+	require.Equal(EndgameSlowTail, cause)
+	require.Equal("slow_tail", d.Dump().EndgameCause)
+
+	counters := stats.Snapshot().Counters()
+	require.Equal(int64(1), counters["endgame_activations+cause=slow_tail"].Value())
+	require.NotContains(counters, "endgame_activations+cause=availability_limited")
+	require.NotContains(counters, "suppressed_endgame_duplicates+")
+}
+
+func TestDispatcherAvailabilityLimitedEndgameSuppressesDuplicates(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(3, 1)
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	stats := tally.NewTestScope("", nil)
+	events := &recordingEvents{}
+	d := testDispatcher(Config{
+		PipelineLimit:           3,
+		EndgameThreshold:        3,
+		PieceUnavailableTimeout: time.Minute,
+		DisableKeepalive:        true,
+	}, clock.NewMock(), torrent)
+	d.stats = stats
+	d.emitter = testEmitter(events, tally.NoopScope)
+
+	// No peer has piece 2.
+	p1, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, true, false), newMockMessages())
+	require.NoError(err)
+	p2, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, true, false), newMockMessages())
+	require.NoError(err)
+
+	_, err = d.maybeRequestMorePieces(p1)
+	require.NoError(err)
+	_, err = d.maybeRequestMorePieces(p2)
+	require.NoError(err)
+
+	// Pieces pending under p1 are not duplicated to p2.
+	require.ElementsMatch([]int{0, 1}, requestedPieces(p1.messages))
+	require.Empty(requestedPieces(p2.messages))
+
+	cause, ok := d.EndgameCause()
+	require.True(ok)
+	require.Equal(EndgameAvailabilityLimited, cause)
+	require.Equal("availability_limited", d.Dump().EndgameCause)
+
+	// Piece 2 is reported without waiting for PieceUnavailableTimeout.
+	require.Eventually(func() bool {
+		return len(events.get()) == 1
+	}, time.Second, 5*time.Millisecond)
+	require.Equal([]string{"unavailable:[2]"}, events.get())
+
+	counters := stats.Snapshot().Counters()
+	require.Equal(int64(1), counters["endgame_activations+cause=availability_limited"].Value())
+	require.Equal(int64(1), counters["pieces_unavailable+"].Value())
+	require.Equal(int64(2), counters["suppressed_endgame_duplicates+"].Value())
+
+	// Once piece 2 was fetched out-of-band, the remaining pieces are duplicated.
+	require.NoError(torrent.WritePiece(piecereader.NewBuffer(blob.Content[2:3]), 2))
+	d.NotifyPiecesWritten([]int{2})
+	_, err = d.maybeRequestMorePieces(p2)
+	require.NoError(err)
+	require.ElementsMatch([]int{0, 1}, requestedPieces(p2.messages))
+
+	// The activation is only classified once.
+	cause, _ = d.EndgameCause()
+	require.Equal(EndgameAvailabilityLimited, cause)
+	counters = stats.Snapshot().Counters()
+	require.NotContains(counters, "endgame_activations+cause=slow_tail")
+}
@@ -0,0 +1,158 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/uber/kraken/gen/go/proto/p2p"
+	"github.com/uber/kraken/lib/torrent/storage"
+
+	"go.uber.org/zap"
+)
+
+// ErrorCategory classifies why a message handler failed.
+type ErrorCategory int
+
+const (
+	// ErrorInternal denotes a failure of the Dispatcher itself, and is the
+	// category of uncategorized errors.
+	ErrorInternal ErrorCategory = iota
+
+	// ErrorValidation denotes a message whose contents are invalid, e.g. a
+	// piece range out of bounds or a piece which failed verification.
+	ErrorValidation
+
+	// ErrorStorageRead denotes a failure to read a piece from storage.
+	ErrorStorageRead
+
+	// ErrorStorageWrite denotes a failure to write a piece to storage.
+	ErrorStorageWrite
+
+	// ErrorProtocolViolation denotes a message which the peer must not have
+	// sent at all.
+	ErrorProtocolViolation
+)
+
+func (c ErrorCategory) String() string {
+	switch c {
+	case ErrorInternal:
+		return "internal"
+	case ErrorValidation:
+		return "validation"
+	case ErrorStorageRead:
+		return "storage_read"
+	case ErrorStorageWrite:
+		return "storage_write"
+	case ErrorProtocolViolation:
+		return "protocol_violation"
+	default:
+		return fmt.Sprintf("ErrorCategory(%d)", int(c))
+	}
+}
+
+// HandlerError is the error of a message handler, wrapping its cause.
+type HandlerError struct {
+	Category ErrorCategory
+	Err      error
+}
+
+func (e *HandlerError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Category, e.Err)
+}
+
+// Unwrap returns the cause of e.
+func (e *HandlerError) Unwrap() error { return e.Err }
+
+// Category returns the category of err, which is ErrorInternal unless err wraps
+// a HandlerError.
+func Category(err error) ErrorCategory {
+	c, _ := categorize(err)
+	return c
+}
+
+// categorize returns the category and the cause of err.
+func categorize(err error) (ErrorCategory, error) {
+	var herr *HandlerError
+	if errors.As(err, &herr) {
+		return herr.Category, herr.Err
+	}
+	return ErrorInternal, err
+}
+
+func validationError(err error) error {
+	return &HandlerError{ErrorValidation, err}
+}
+
+func storageReadError(err error) error {
+	return &HandlerError{ErrorStorageRead, err}
+}
+
+func storageWriteError(err error) error {
+	return &HandlerError{ErrorStorageWrite, err}
+}
+
+func protocolViolationError(err error) error {
+	return &HandlerError{ErrorProtocolViolation, err}
+}
+
+func internalError(err error) error {
+	return &HandlerError{ErrorInternal, err}
+}
+
+// pieceWriteError categorizes err, the failure to write received piece i.
+// Pieces which fail verification are invalid rather than failed by storage.
+func pieceWriteError(i int, err error) error {
+	werr := fmt.Errorf("write piece %d: %s", i, err)
+	if err == storage.ErrPieceDigestMismatch {
+		return validationError(werr)
+	}
+	return storageWriteError(werr)
+}
+
+// unknownMessageTypeError is the cause of messages of types which we do not
+// implement.
+type unknownMessageTypeError struct {
+	t p2p.Message_Type
+}
+
+func (e unknownMessageTypeError) Error() string {
+	return fmt.Sprintf("unknown message type: %d", e.t)
+}
+
+// unreadableMessageError is the cause of messages which lack their body, or
+// belong to extensions which were not negotiated.
+type unreadableMessageError struct {
+	t p2p.Message_Type
+}
+
+func (e unreadableMessageError) Error() string {
+	return fmt.Sprintf("unreadable %s message: missing body or extension not negotiated", e.t)
+}
+
+// handlerFailed counts err, the failure of the handler of a message of type t
+// received from p, by category and logs it. The log message is fixed such that
+// sampled loggers rate-limit it, with the specifics in its fields.
+func (d *Dispatcher) handlerFailed(p *peer, t p2p.Message_Type, err error) {
+	c, cause := categorize(err)
+	d.stats.Tagged(map[string]string{
+		"category": c.String(),
+	}).Counter("handler_errors").Inc(1)
+	d.logw(zap.ErrorLevel, "Error dispatching message",
+		zap.Object("peer", p),
+		zap.String("category", c.String()),
+		zap.Int32("message_type", int32(t)),
+		zap.NamedError("error", cause))
+}
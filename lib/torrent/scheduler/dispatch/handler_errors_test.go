@@ -0,0 +1,247 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/gen/go/proto/p2p"
+	"github.com/uber/kraken/lib/torrent/networkevent"
+	"github.com/uber/kraken/lib/torrent/scheduler/conn"
+	"github.com/uber/kraken/lib/torrent/scheduler/torrentlog"
+	"github.com/uber/kraken/lib/torrent/storage"
+	"github.com/uber/kraken/lib/torrent/storage/agentstorage"
+	"github.com/uber/kraken/lib/torrent/storage/piecereader"
+	"github.com/uber/kraken/utils/bitsetutil"
+)
+
+// failingWriteTorrent is a storage.Torrent whose piece writes fail.
+type failingWriteTorrent struct {
+	storage.Torrent
+}
+
+func (t failingWriteTorrent) WritePiece(storage.PieceReader, int) error {
+	return errors.New("disk full")
+}
+
+func TestDispatcherCategorizesHandlerErrors(t *testing.T) {
+	blob := core.SizedBlobFixture(1, 1)
+
+	tests := []struct {
+		desc     string
+		torrent  func(storage.Torrent) storage.Torrent
+		msg      func() *conn.Message
+		category ErrorCategory
+	}{
+		{
+			"digest mismatch",
+			nil,
+			func() *conn.Message {
+				msg := conn.NewPiecePayloadMessage(0, piecereader.NewBuffer(blob.Content[0:1]))
+				msg.DigestMismatch = true
+				return msg
+			},
+			ErrorValidation,
+		}, {
+			"corrupt piece",
+			nil,
+			func() *conn.Message {
+				return conn.NewPiecePayloadMessage(0, piecereader.NewBuffer([]byte{blob.Content[0] + 1}))
+			},
+			ErrorValidation,
+		}, {
+			"request of missing piece",
+			nil,
+			func() *conn.Message { return conn.NewPieceRequestMessage(0, 1) },
+			ErrorStorageRead,
+		}, {
+			"failed piece write",
+			func(t storage.Torrent) storage.Torrent { return failingWriteTorrent{t} },
+			func() *conn.Message {
+				return conn.NewPiecePayloadMessage(0, piecereader.NewBuffer(blob.Content[0:1]))
+			},
+			ErrorStorageWrite,
+		}, {
+			"repeated bitfield",
+			nil,
+			func() *conn.Message {
+				return &conn.Message{Message: &p2p.Message{
+					Type:     p2p.Message_BITFIELD,
+					Bitfield: &p2p.BitfieldMessage{},
+				}}
+			},
+			ErrorProtocolViolation,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+
+			fixture, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+			defer cleanup()
+
+			var torrent storage.Torrent = fixture
+			if test.torrent != nil {
+				torrent = test.torrent(fixture)
+			}
+
+			logCore, logs := observer.New(zap.ErrorLevel)
+			stats := tally.NewTestScope("", nil)
+			d, err := newDispatcher(
+				Config{DisableKeepalive: true},
+				tally.NoopScope,
+				clock.NewMock(),
+				networkevent.NewTestProducer(),
+				noopEvents{},
+				core.PeerIDFixture(),
+				torrent,
+				zap.New(logCore).Sugar(),
+				torrentlog.NewNopLogger())
+			require.NoError(err)
+			d.stats = stats
+
+			messages := newMockMessages()
+			peerID := core.PeerIDFixture()
+			require.NoError(d.AddPeer(peerID, bitsetutil.FromBools(false), messages))
+
+			msg := test.msg()
+			messages.receiver <- msg
+
+			require.Eventually(func() bool {
+				return logs.FilterMessage("Error dispatching message").Len() == 1
+			}, 5*time.Second, 5*time.Millisecond)
+
+			fields := logs.FilterMessage("Error dispatching message").All()[0].ContextMap()
+			require.Equal(test.category.String(), fields["category"])
+			require.Equal(int32(msg.Message.Type), fields["message_type"])
+			require.Equal(map[string]interface{}{"id": peerID.String()}, fields["peer"])
+
+			counters := stats.Snapshot().Counters()
+			c, ok := counters["handler_errors+category="+test.category.String()]
+			require.True(ok)
+			require.Equal(int64(1), c.Value())
+		})
+	}
+}
+
+func TestDispatcherLogsUnknownMessageType(t *testing.T) {
+	require := require.New(t)
+
+	torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(1, 1).MetaInfo)
+	defer cleanup()
+
+	logCore, logs := observer.New(zap.ErrorLevel)
+	stats := tally.NewTestScope("", nil)
+	d, err := newDispatcher(
+		Config{DisableKeepalive: true},
+		tally.NoopScope,
+		clock.NewMock(),
+		networkevent.NewTestProducer(),
+		noopEvents{},
+		core.PeerIDFixture(),
+		torrent,
+		zap.New(logCore).Sugar(),
+		torrentlog.NewNopLogger())
+	require.NoError(err)
+	d.stats = stats
+
+	messages := newMockMessages()
+	require.NoError(d.AddPeer(core.PeerIDFixture(), bitsetutil.FromBools(false), messages))
+
+	messages.receiver <- &conn.Message{Message: &p2p.Message{Type: p2p.Message_Type(999)}}
+
+	require.Eventually(func() bool {
+		return logs.FilterMessage("Error dispatching message").Len() == 1
+	}, 5*time.Second, 5*time.Millisecond)
+
+	fields := logs.FilterMessage("Error dispatching message").All()[0].ContextMap()
+	require.Equal("protocol_violation", fields["category"])
+	require.Equal(int32(999), fields["message_type"])
+	require.Equal("unknown message type: 999", fields["error"])
+
+	c := stats.Snapshot().Counters()["handler_errors+category=protocol_violation"]
+	require.Equal(int64(1), c.Value())
+}
+
+func TestErrorCategory(t *testing.T) {
+	require := require.New(t)
+
+	cause := errors.New("some error")
+
+	require.Equal(ErrorInternal, Category(cause))
+	require.Equal(ErrorInternal, Category(internalError(cause)))
+	require.Equal(ErrorValidation, Category(validationError(cause)))
+	require.Equal(ErrorStorageWrite, Category(storageWriteError(cause)))
+	require.Equal(ErrorValidation, Category(pieceWriteError(0, storage.ErrPieceDigestMismatch)))
+	require.Equal(ErrorStorageWrite, Category(pieceWriteError(0, cause)))
+
+	// Categories are found through further wrapping.
+	err := fmt.Errorf("wrapped: %w", storageReadError(cause))
+	require.Equal(ErrorStorageRead, Category(err))
+	require.True(errors.Is(err, cause))
+}
+
+func TestDispatcherRejectsUnreadableMessages(t *testing.T) {
+	tests := []struct {
+		desc     string
+		messages *mockMessages
+		msg      *p2p.Message
+	}{
+		{"error without body", newMockMessages(), &p2p.Message{Type: p2p.Message_ERROR}},
+		{"announce without body", newMockMessages(), &p2p.Message{Type: p2p.Message_ANNOUCE_PIECE}},
+		{"request without body", newMockMessages(), &p2p.Message{Type: p2p.Message_PIECE_REQUEST}},
+		{"payload without body", newMockMessages(), &p2p.Message{Type: p2p.Message_PIECE_PAYLOAD}},
+		{"cancel without body", newMockMessages(), &p2p.Message{Type: p2p.Message_CANCEL_PIECE}},
+		{
+			"batch without batch_requests",
+			newLegacyMockMessages(conn.BatchRequests),
+			conn.NewPieceRequestsMessage([]*p2p.PieceRequestMessage{{Index: 0, Length: 1}}).Message,
+		}, {
+			"announce pieces without announce_pieces",
+			newLegacyMockMessages(conn.AnnouncePieces),
+			&p2p.Message{
+				Type:           p2p.Message_ANNOUNCE_PIECES,
+				AnnouncePieces: &p2p.AnnouncePiecesMessage{},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+
+			torrent, cleanup := completeTorrentFixture(t, core.SizedBlobFixture(1, 1))
+			defer cleanup()
+
+			d := testDispatcher(Config{DisableKeepalive: true}, clock.NewMock(), torrent)
+
+			p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false), test.messages)
+			require.NoError(err)
+
+			err = d.dispatch(p, &conn.Message{Message: test.msg})
+			require.Equal(protocolViolationError(unreadableMessageError{test.msg.Type}), err)
+			require.Equal(1, p.stats().ProtocolViolations)
+			require.Empty(test.messages.getSent())
+		})
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"time"
+
+	"github.com/willf/bitset"
+)
+
+// watchIdlePeers evicts idle peers every half Config.PeerIdleTimeout, until d is
+// torn down.
+func (d *Dispatcher) watchIdlePeers() {
+	for {
+		select {
+		case <-d.clk.After(d.config.PeerIdleTimeout / 2):
+			d.evictIdlePeers()
+		case <-d.tornDown:
+			return
+		}
+	}
+}
+
+// evictIdlePeers closes peers which transferred no piece in either direction
+// within Config.PeerIdleTimeout, and have no serves queued. Peers which are the
+// only source of pieces d still needs are kept. Like any removal, Events are
+// notified of the evicted peers, and their pending piece requests are resent.
+func (d *Dispatcher) evictIdlePeers() {
+	if d.paused.Load() {
+		// Peers are kept while paused.
+		return
+	}
+	now := d.clk.Now()
+	var missing *bitset.BitSet
+	if !d.SeedOnly() {
+		missing = d.torrent.Bitfield().Complement()
+	}
+	var idle []*peer
+	d.peers.Range(func(k, v interface{}) bool {
+		p := v.(*peer)
+		if d.peerIdle(p, now) {
+			idle = append(idle, p)
+		}
+		return true
+	})
+	for _, p := range idle {
+		if missing != nil && d.soleSource(p, missing) {
+			d.stats.Counter("idle_peers_kept_as_sole_source").Inc(1)
+			continue
+		}
+		if err := d.closePeer(p, PeerRemovalIdle); err != nil {
+			// Removed concurrently.
+			continue
+		}
+		d.log("peer", p).Infof(
+			"Evicted peer which transferred no piece for %s", d.config.PeerIdleTimeout)
+		d.stats.Counter("idle_peer_evictions").Inc(1)
+	}
+}
+
+// peerIdle returns whether p neither connected nor transferred a piece within
+// Config.PeerIdleTimeout before now, and has no serves queued. Time spent
+// paused does not count.
+func (d *Dispatcher) peerIdle(p *peer, now time.Time) bool {
+	last := p.lastTransfer()
+	if p.addedAt.After(last) {
+		last = p.addedAt
+	}
+	if resumed := d.lastResumed(); resumed.After(last) {
+		last = resumed
+	}
+	return now.Sub(last) >= d.config.PeerIdleTimeout && p.serves.idle()
+}
+
+// soleSource returns whether no peer other than p has some piece in missing
+// which p has.
+func (d *Dispatcher) soleSource(p *peer, missing *bitset.BitSet) bool {
+	held := d.peerPiecesIn(p, missing)
+	for i, ok := held.NextSet(0); ok; i, ok = held.NextSet(i + 1) {
+		if d.numPeersByPiece.Get(int(i)) <= 1 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,107 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"testing"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/torrent/storage/agentstorage"
+	"github.com/uber/kraken/utils/bitsetutil"
+)
+
+func TestDispatcherEvictIdlePeers(t *testing.T) {
+	require := require.New(t)
+
+	torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(3, 1).MetaInfo)
+	defer cleanup()
+
+	clk := clock.NewMock()
+	stats := tally.NewTestScope("", nil)
+	events := &recordingEvents{}
+	d := testDispatcher(Config{
+		PeerIdleTimeout:  time.Minute,
+		PipelineLimit:    1,
+		DisableEndgame:   true,
+		DisableKeepalive: true,
+	}, clk, torrent)
+	d.stats = stats
+	d.emitter = testEmitter(events, tally.NoopScope)
+
+	idle, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, false, false), newMockMessages())
+	require.NoError(err)
+	// Only soleSource has piece 1.
+	soleSource, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, true, false), newMockMessages())
+	require.NoError(err)
+	active, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, false, false), newMockMessages())
+	require.NoError(err)
+
+	_, err = d.maybeRequestMorePieces(idle)
+	require.NoError(err)
+	require.Equal([]int{0}, requestedPieces(idle.messages))
+
+	// Recently connected peers are not idle.
+	clk.Add(30 * time.Second)
+	d.evictIdlePeers()
+	require.Equal(3, d.NumPeers())
+
+	clk.Add(30 * time.Second)
+	active.touchLastPieceSent()
+	d.evictIdlePeers()
+
+	require.Equal(2, d.NumPeers())
+	require.True(idle.messages.(*mockMessages).isClosed())
+	require.False(soleSource.messages.(*mockMessages).isClosed())
+	require.False(active.messages.(*mockMessages).isClosed())
+
+	// The piece request pending with the evicted peer is resent elsewhere.
+	d.runPendingKick()
+	pending := d.pieceRequestManager.PendingPeers(0)
+	require.Len(pending, 1)
+	require.NotEqual(idle.id, pending[0])
+
+	require.Eventually(func() bool {
+		return len(events.get()) == 1
+	}, time.Second, 5*time.Millisecond)
+	require.Equal([]string{"removed:" + idle.id.String()}, events.get())
+
+	counters := stats.Snapshot().Counters()
+	require.Equal(int64(1), counters["idle_peer_evictions+"].Value())
+	require.Equal(int64(1), counters["idle_peers_kept_as_sole_source+"].Value())
+	require.Equal(int64(1), counters["removed_peers+active=true,reason=idle,useful=false"].Value())
+}
+
+func TestDispatcherEvictIdlePeersWhileSeeding(t *testing.T) {
+	require := require.New(t)
+
+	torrent, cleanup := completeTorrentFixture(t, core.SizedBlobFixture(2, 1))
+	defer cleanup()
+
+	clk := clock.NewMock()
+	d := testDispatcher(Config{PeerIdleTimeout: time.Minute, DisableKeepalive: true}, clk, torrent)
+
+	// Nothing is needed from a seeder's peers, however rare their pieces.
+	p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, false), newMockMessages())
+	require.NoError(err)
+
+	clk.Add(time.Minute)
+	d.evictIdlePeers()
+	require.Equal(0, d.NumPeers())
+	require.True(p.messages.(*mockMessages).isClosed())
+}
@@ -0,0 +1,82 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"sync"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"golang.org/x/time/rate"
+)
+
+// ingressLimiter limits the rate at which a Dispatcher downloads piece bytes.
+// Received bytes are charged against a token bucket, and new piece requests are
+// deferred while the bucket is in debt. Thread-safe.
+type ingressLimiter struct {
+	clk            clock.Clock
+	maxPieceLength int64
+
+	mu      sync.Mutex // Protects limiter.
+	limiter *rate.Limiter
+}
+
+func newIngressLimiter(clk clock.Clock, bytesPerSec, maxPieceLength int64) *ingressLimiter {
+	l := &ingressLimiter{
+		clk:            clk,
+		maxPieceLength: maxPieceLength,
+	}
+	l.setLimit(bytesPerSec)
+	return l
+}
+
+// setLimit sets the limit to bytesPerSec, starting with a full bucket. Zero
+// disables the limit.
+func (l *ingressLimiter) setLimit(bytesPerSec int64) {
+	limiter := rate.NewLimiter(rate.Inf, 0)
+	if bytesPerSec > 0 {
+		// Bursts must fit at least one piece, else received pieces are never
+		// charged.
+		burst := bytesPerSec
+		if burst < l.maxPieceLength {
+			burst = l.maxPieceLength
+		}
+		limiter = rate.NewLimiter(rate.Limit(bytesPerSec), int(burst))
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.limiter = limiter
+}
+
+func (l *ingressLimiter) get() *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.limiter
+}
+
+// received charges n received bytes against the limit.
+func (l *ingressLimiter) received(n int64) {
+	l.get().ReserveN(l.clk.Now(), int(n))
+}
+
+// delay returns how long new piece requests must be deferred until the bytes
+// received so far are within the limit.
+func (l *ingressLimiter) delay() time.Duration {
+	now := l.clk.Now()
+	// Reserving zero tokens consumes nothing, but reports the current debt.
+	return l.get().ReserveN(now, 0).DelayFrom(now)
+}
@@ -0,0 +1,481 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package integration provides fixtures which connect real Dispatchers with
+// real Conns over TCP loopback, backed by real storage, such that the contract
+// between the dispatcher and conn is tested end-to-end.
+package integration
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/uber-go/tally"
+	"go.uber.org/zap"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/torrent/networkevent"
+	"github.com/uber/kraken/lib/torrent/scheduler/conn"
+	"github.com/uber/kraken/lib/torrent/scheduler/dispatch"
+	"github.com/uber/kraken/lib/torrent/scheduler/torrentlog"
+	"github.com/uber/kraken/lib/torrent/storage"
+	"github.com/uber/kraken/lib/torrent/storage/agentstorage"
+	"github.com/uber/kraken/lib/torrent/storage/piecereader"
+)
+
+// errTimeout is returned when waiting for a condition times out.
+var errTimeout = errors.New("timed out")
+
+// notifier wakes up waiters whenever the state it guards changes.
+type notifier struct {
+	mu      sync.Mutex
+	changed chan struct{}
+}
+
+func newNotifier() *notifier {
+	return &notifier{changed: make(chan struct{})}
+}
+
+// update applies f under the lock of n and wakes up all waiters.
+func (n *notifier) update(f func()) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	f()
+	close(n.changed)
+	n.changed = make(chan struct{})
+}
+
+// wait waits until cond, which is evaluated under the lock of n, is true.
+func (n *notifier) wait(timeout time.Duration, cond func() bool) error {
+	deadline := time.After(timeout)
+	for {
+		n.mu.Lock()
+		ok := cond()
+		changed := n.changed
+		n.mu.Unlock()
+
+		if ok {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			return errTimeout
+		}
+	}
+}
+
+// Events records the Events of a Dispatcher.
+type Events struct {
+	n        *notifier
+	complete bool
+	failed   []dispatch.TearDownReason
+	removed  map[core.PeerID]int
+}
+
+func newEvents() *Events {
+	return &Events{
+		n:       newNotifier(),
+		removed: make(map[core.PeerID]int),
+	}
+}
+
+// DispatcherComplete implements dispatch.Events.
+func (e *Events) DispatcherComplete(*dispatch.Dispatcher) {
+	e.n.update(func() { e.complete = true })
+}
+
+// DispatcherFailed implements dispatch.Events.
+func (e *Events) DispatcherFailed(_ *dispatch.Dispatcher, reason dispatch.TearDownReason) {
+	e.n.update(func() { e.failed = append(e.failed, reason) })
+}
+
+// PeerRemoved implements dispatch.Events.
+func (e *Events) PeerRemoved(peerID core.PeerID, _ core.InfoHash) {
+	e.n.update(func() { e.removed[peerID]++ })
+}
+
+// PeerBanned implements dispatch.Events.
+func (e *Events) PeerBanned(core.PeerID, core.InfoHash) {}
+
+// PiecesUnavailable implements dispatch.Events.
+func (e *Events) PiecesUnavailable(core.InfoHash, []int) {}
+
+// PiecesQuarantined implements dispatch.Events.
+func (e *Events) PiecesQuarantined(core.InfoHash, []int) {}
+
+// DispatcherStalled implements dispatch.Events.
+func (e *Events) DispatcherStalled(*dispatch.Dispatcher) {}
+
+// WaitComplete waits until the Dispatcher completed.
+func (e *Events) WaitComplete(timeout time.Duration) error {
+	return e.n.wait(timeout, func() bool { return e.complete })
+}
+
+// WaitPeerRemoved waits until peerID was removed from the Dispatcher n times in
+// total.
+func (e *Events) WaitPeerRemoved(peerID core.PeerID, n int, timeout time.Duration) error {
+	return e.n.wait(timeout, func() bool { return e.removed[peerID] >= n })
+}
+
+// Failures returns the reasons which the Dispatcher failed with.
+func (e *Events) Failures() []dispatch.TearDownReason {
+	e.n.mu.Lock()
+	defer e.n.mu.Unlock()
+
+	return append([]dispatch.TearDownReason(nil), e.failed...)
+}
+
+type noopConnEvents struct{}
+
+func (noopConnEvents) ConnClosed(*conn.Conn) {}
+
+// Host is a peer which accepts connections on TCP loopback. Torrents of the same
+// Host share its peer id and Handshaker, like torrents of a scheduler do.
+type Host struct {
+	PeerID core.PeerID
+
+	// Clock is the clock of the Dispatchers of the Host. Conns use the wall
+	// clock, since they set deadlines on real sockets.
+	Clock *clock.Mock
+
+	config     conn.Config
+	handshaker *conn.Handshaker
+	listener   *net.TCPListener
+
+	// Serializes accepting connections, such that each Connect accepts its own.
+	acceptMu sync.Mutex
+
+	mu       sync.Mutex
+	torrents []*Torrent
+}
+
+// NewHost creates a Host listening on a random port of TCP loopback.
+func NewHost(config conn.Config) (*Host, error) {
+	peerID := core.PeerIDFixture()
+	h, err := conn.NewHandshaker(
+		config,
+		tally.NoopScope,
+		clock.New(),
+		networkevent.NewTestProducer(),
+		peerID,
+		noopConnEvents{},
+		zap.NewNop().Sugar())
+	if err != nil {
+		return nil, fmt.Errorf("handshaker: %s", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("listen: %s", err)
+	}
+	return &Host{
+		PeerID:     peerID,
+		Clock:      clock.NewMock(),
+		config:     config,
+		handshaker: h,
+		listener:   l.(*net.TCPListener),
+	}, nil
+}
+
+// Addr returns the address which h listens on.
+func (h *Host) Addr() string {
+	return h.listener.Addr().String()
+}
+
+// Close tears down all torrents of h, deletes their storage and stops
+// listening.
+func (h *Host) Close() {
+	h.mu.Lock()
+	torrents := h.torrents
+	h.torrents = nil
+	h.mu.Unlock()
+
+	for _, t := range torrents {
+		t.ReleaseServes()
+		t.Dispatcher.TearDown()
+		t.cleanup()
+	}
+	h.listener.Close()
+}
+
+// Seed creates a Dispatcher for blob on h, whose storage holds all pieces of
+// blob.
+func (h *Host) Seed(config dispatch.Config, blob *core.BlobFixture) (*Torrent, error) {
+	return h.addTorrent(config, blob, true)
+}
+
+// Leech creates a Dispatcher for blob on h, whose storage holds no pieces.
+func (h *Host) Leech(config dispatch.Config, blob *core.BlobFixture) (*Torrent, error) {
+	return h.addTorrent(config, blob, false)
+}
+
+func (h *Host) addTorrent(
+	config dispatch.Config, blob *core.BlobFixture, complete bool) (*Torrent, error) {
+
+	st, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+
+	if complete {
+		for i := 0; i < st.NumPieces(); i++ {
+			start := int64(i) * st.MaxPieceLength()
+			end := start + st.PieceLength(i)
+			if err := st.WritePiece(piecereader.NewBuffer(blob.Content[start:end]), i); err != nil {
+				cleanup()
+				return nil, fmt.Errorf("write piece %d: %s", i, err)
+			}
+		}
+	}
+
+	t := &Torrent{
+		Events:  newEvents(),
+		Blob:    blob,
+		host:    h,
+		storage: &gatedTorrent{Torrent: st, n: newNotifier(), allowed: -1},
+		cleanup: cleanup,
+	}
+	d, err := dispatch.New(
+		config,
+		tally.NoopScope,
+		h.Clock,
+		networkevent.NewTestProducer(),
+		t.Events,
+		h.PeerID,
+		t.storage,
+		zap.NewNop().Sugar(),
+		torrentlog.NewNopLogger())
+	if err != nil {
+		cleanup()
+		return nil, fmt.Errorf("new dispatcher: %s", err)
+	}
+	t.Dispatcher = d
+
+	h.mu.Lock()
+	h.torrents = append(h.torrents, t)
+	h.mu.Unlock()
+
+	return t, nil
+}
+
+// Torrent is a Dispatcher of a Host, backed by real storage.
+type Torrent struct {
+	Dispatcher *dispatch.Dispatcher
+	Events     *Events
+	Blob       *core.BlobFixture
+
+	host    *Host
+	storage *gatedTorrent
+	cleanup func()
+}
+
+// HoldServesAfter lets the next n pieces be read for serves to peers, and holds
+// back further reads until ReleaseServes is called. This stops transfers from t
+// mid-way deterministically.
+func (t *Torrent) HoldServesAfter(n int) {
+	t.storage.n.update(func() { t.storage.allowed = n })
+}
+
+// ReleaseServes releases all serves held back by HoldServesAfter.
+func (t *Torrent) ReleaseServes() {
+	t.storage.n.update(func() { t.storage.allowed = -1 })
+}
+
+// WaitServeHeld waits until a serve of t is held back by HoldServesAfter.
+func (t *Torrent) WaitServeHeld(timeout time.Duration) error {
+	return t.storage.n.wait(timeout, func() bool { return t.storage.held > 0 })
+}
+
+// WaitPiecesWritten waits until at least n pieces were written to t.
+func (t *Torrent) WaitPiecesWritten(n int, timeout time.Duration) error {
+	return t.storage.n.wait(timeout, func() bool { return t.storage.written >= n })
+}
+
+// VerifyContent checks that t holds the complete content of its blob.
+func (t *Torrent) VerifyContent() error {
+	var b bytes.Buffer
+	for i := 0; i < t.storage.NumPieces(); i++ {
+		pr, err := t.storage.Torrent.GetPieceReader(i)
+		if err != nil {
+			return fmt.Errorf("get piece reader %d: %s", i, err)
+		}
+		p, err := ioutil.ReadAll(pr)
+		pr.Close()
+		if err != nil {
+			return fmt.Errorf("read piece %d: %s", i, err)
+		}
+		b.Write(p)
+	}
+	if !bytes.Equal(t.Blob.Content, b.Bytes()) {
+		return errors.New("content mismatch")
+	}
+	return nil
+}
+
+// gatedTorrent is a storage.Torrent which can hold back piece reads, and counts
+// piece writes.
+type gatedTorrent struct {
+	storage.Torrent
+	n *notifier
+
+	// Number of further piece reads allowed, unlimited if negative.
+	allowed int
+	held    int
+	written int
+}
+
+// allowLocked consumes an allowed piece read. Caller must hold the lock of g.n.
+func (g *gatedTorrent) allowLocked() bool {
+	if g.allowed < 0 {
+		return true
+	}
+	if g.allowed > 0 {
+		g.allowed--
+		return true
+	}
+	return false
+}
+
+func (g *gatedTorrent) GetPieceReader(piece int) (storage.PieceReader, error) {
+	var allowed bool
+	g.n.update(func() {
+		if allowed = g.allowLocked(); !allowed {
+			g.held++
+		}
+	})
+	if !allowed {
+		err := g.n.wait(time.Minute, g.allowLocked)
+		g.n.update(func() { g.held-- })
+		if err != nil {
+			return nil, fmt.Errorf("held piece %d: %s", piece, err)
+		}
+	}
+	return g.Torrent.GetPieceReader(piece)
+}
+
+func (g *gatedTorrent) WritePiece(src storage.PieceReader, piece int) error {
+	if err := g.Torrent.WritePiece(src, piece); err != nil {
+		return err
+	}
+	g.n.update(func() { g.written++ })
+	return nil
+}
+
+// Link is a connection between Dispatchers of two Hosts, established by
+// Connect.
+type Link struct {
+	// Local is the Conn of the Dispatcher which opened the connection, Remote the
+	// one of the Dispatcher which accepted it.
+	Local  *conn.Conn
+	Remote *conn.Conn
+
+	nc net.Conn
+}
+
+// Kill closes the socket of l abruptly, without closing either Conn, as if the
+// network failed. Both Conns observe read errors.
+func (l *Link) Kill() {
+	l.nc.Close()
+}
+
+type accepted struct {
+	c   *conn.Conn
+	nc  net.Conn
+	err error
+}
+
+// Connect opens a connection from local to remote, which must be torrents of
+// the same blob on different Hosts, and adds the Conns to both Dispatchers like
+// the scheduler does.
+func Connect(local, remote *Torrent) (*Link, error) {
+	if local.Blob.MetaInfo.InfoHash() != remote.Blob.MetaInfo.InfoHash() {
+		return nil, errors.New("torrents of different blobs")
+	}
+	rh := remote.host
+	rh.acceptMu.Lock()
+	defer rh.acceptMu.Unlock()
+
+	timeout := rh.config.HandshakeTimeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	if err := rh.listener.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, fmt.Errorf("set deadline: %s", err)
+	}
+	acceptc := make(chan accepted, 1)
+	go func() {
+		c, nc, err := remote.accept()
+		acceptc <- accepted{c, nc, err}
+	}()
+
+	r, err := local.host.handshaker.Initialize(
+		rh.PeerID,
+		rh.Addr(),
+		local.storage.Stat(),
+		local.Dispatcher.RemoteBitfields(),
+		"")
+	if err != nil {
+		if a := <-acceptc; a.nc != nil {
+			a.nc.Close()
+		}
+		return nil, fmt.Errorf("initialize: %s", err)
+	}
+	r.Conn.Start()
+	if err := local.Dispatcher.AddPeer(rh.PeerID, r.Bitfield, r.Conn); err != nil {
+		r.Conn.Close()
+		if a := <-acceptc; a.c != nil {
+			a.c.Close()
+		}
+		return nil, fmt.Errorf("add peer to local dispatcher: %s", err)
+	}
+	a := <-acceptc
+	if a.err != nil {
+		r.Conn.Close()
+		return nil, fmt.Errorf("accept: %s", a.err)
+	}
+	return &Link{r.Conn, a.c, a.nc}, nil
+}
+
+// accept accepts a connection opened to t, and adds it to the Dispatcher of t.
+func (t *Torrent) accept() (*conn.Conn, net.Conn, error) {
+	h := t.host
+	nc, err := h.listener.Accept()
+	if err != nil {
+		return nil, nil, err
+	}
+	pc, err := h.handshaker.Accept(nc)
+	if err != nil {
+		nc.Close()
+		return nil, nil, fmt.Errorf("handshake: %s", err)
+	}
+	if pc.InfoHash() != t.storage.InfoHash() {
+		nc.Close()
+		return nil, nil, errors.New("unexpected info hash")
+	}
+	c, err := h.handshaker.Establish(pc, t.storage.Stat(), t.Dispatcher.RemoteBitfields())
+	if err != nil {
+		nc.Close()
+		return nil, nil, fmt.Errorf("establish: %s", err)
+	}
+	c.Start()
+	if err := t.Dispatcher.AddPeer(pc.PeerID(), pc.Bitfield(), c); err != nil {
+		c.Close()
+		return nil, nil, fmt.Errorf("add peer to remote dispatcher: %s", err)
+	}
+	return c, nc, nil
+}
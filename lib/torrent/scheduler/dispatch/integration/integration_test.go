@@ -0,0 +1,239 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package integration
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/torrent/scheduler/conn"
+	"github.com/uber/kraken/lib/torrent/scheduler/dispatch"
+
+	"github.com/stretchr/testify/require"
+)
+
+// _timeout bounds waiting for transfers over loopback. Transfers normally take
+// milliseconds.
+const _timeout = 5 * time.Second
+
+func newHosts(t *testing.T, n int) ([]*Host, func()) {
+	var hosts []*Host
+	cleanup := func() {
+		for _, h := range hosts {
+			h.Close()
+		}
+	}
+	for i := 0; i < n; i++ {
+		h, err := NewHost(conn.ConfigFixture())
+		if err != nil {
+			cleanup()
+			require.NoError(t, err)
+		}
+		hosts = append(hosts, h)
+	}
+	return hosts, cleanup
+}
+
+func TestCleanCompletion(t *testing.T) {
+	require := require.New(t)
+
+	hosts, cleanup := newHosts(t, 2)
+	defer cleanup()
+
+	blob := core.SizedBlobFixture(4096, 64)
+
+	seeder, err := hosts[0].Seed(dispatch.Config{}, blob)
+	require.NoError(err)
+	leecher, err := hosts[1].Leech(dispatch.Config{}, blob)
+	require.NoError(err)
+
+	_, err = Connect(leecher, seeder)
+	require.NoError(err)
+
+	require.NoError(leecher.Events.WaitComplete(_timeout))
+	require.NoError(leecher.VerifyContent())
+	require.Equal(blob.Length(), leecher.Dispatcher.Progress().BytesDownloaded)
+	require.Empty(leecher.Events.Failures())
+	require.Empty(seeder.Events.Failures())
+}
+
+func TestConnKilledMidTransfer(t *testing.T) {
+	require := require.New(t)
+
+	hosts, cleanup := newHosts(t, 2)
+	defer cleanup()
+
+	blob := core.SizedBlobFixture(4096, 64)
+
+	seeder, err := hosts[0].Seed(dispatch.Config{}, blob)
+	require.NoError(err)
+	leecher, err := hosts[1].Leech(dispatch.Config{}, blob)
+	require.NoError(err)
+
+	seeder.HoldServesAfter(16)
+
+	link, err := Connect(leecher, seeder)
+	require.NoError(err)
+
+	require.NoError(leecher.WaitPiecesWritten(16, _timeout))
+	require.NoError(seeder.WaitServeHeld(_timeout))
+
+	// Both Dispatchers must observe the failed connection via their Receivers
+	// closing, and remove each other.
+	link.Kill()
+	require.NoError(seeder.Events.WaitPeerRemoved(hosts[1].PeerID, 1, _timeout))
+	require.NoError(leecher.Events.WaitPeerRemoved(hosts[0].PeerID, 1, _timeout))
+	require.True(link.Local.IsClosed())
+	require.True(link.Remote.IsClosed())
+	require.False(leecher.Dispatcher.Complete())
+
+	// The held serve fails to send over the dead connection.
+	seeder.ReleaseServes()
+
+	// Reconnecting resumes the transfer where it stopped.
+	_, err = Connect(leecher, seeder)
+	require.NoError(err)
+	require.NoError(leecher.Events.WaitComplete(_timeout))
+	require.NoError(leecher.VerifyContent())
+}
+
+func TestTearDownDuringTransfer(t *testing.T) {
+	require := require.New(t)
+
+	hosts, cleanup := newHosts(t, 3)
+	defer cleanup()
+
+	blob := core.SizedBlobFixture(4096, 64)
+
+	seeder, err := hosts[0].Seed(dispatch.Config{}, blob)
+	require.NoError(err)
+	leecher, err := hosts[1].Leech(dispatch.Config{}, blob)
+	require.NoError(err)
+
+	seeder.HoldServesAfter(16)
+
+	link, err := Connect(leecher, seeder)
+	require.NoError(err)
+
+	require.NoError(seeder.WaitServeHeld(_timeout))
+
+	leecher.Dispatcher.TearDown()
+	require.True(link.Local.IsClosed())
+	require.NoError(seeder.Events.WaitPeerRemoved(hosts[1].PeerID, 1, _timeout))
+	require.False(leecher.Dispatcher.Complete())
+	reason, ok := leecher.Dispatcher.FinalReason()
+	require.True(ok)
+	require.Equal(dispatch.TearDownUnspecified, reason)
+
+	// The seeder keeps serving other peers once its held serves fail.
+	seeder.ReleaseServes()
+	other, err := hosts[2].Leech(dispatch.Config{}, blob)
+	require.NoError(err)
+	_, err = Connect(other, seeder)
+	require.NoError(err)
+	require.NoError(other.Events.WaitComplete(_timeout))
+	require.NoError(other.VerifyContent())
+	require.Empty(seeder.Events.Failures())
+}
+
+func TestBidirectionalTransferOfTwoTorrents(t *testing.T) {
+	require := require.New(t)
+
+	hosts, cleanup := newHosts(t, 2)
+	defer cleanup()
+
+	blob1 := core.SizedBlobFixture(4096, 64)
+	blob2 := core.SizedBlobFixture(4096, 128)
+
+	seeder1, err := hosts[0].Seed(dispatch.Config{}, blob1)
+	require.NoError(err)
+	leecher1, err := hosts[1].Leech(dispatch.Config{}, blob1)
+	require.NoError(err)
+
+	seeder2, err := hosts[1].Seed(dispatch.Config{}, blob2)
+	require.NoError(err)
+	leecher2, err := hosts[0].Leech(dispatch.Config{}, blob2)
+	require.NoError(err)
+
+	// Each host opens the connection for the torrent it leeches.
+	_, err = Connect(leecher1, seeder1)
+	require.NoError(err)
+	_, err = Connect(leecher2, seeder2)
+	require.NoError(err)
+
+	require.NoError(leecher1.Events.WaitComplete(_timeout))
+	require.NoError(leecher2.Events.WaitComplete(_timeout))
+	require.NoError(leecher1.VerifyContent())
+	require.NoError(leecher2.VerifyContent())
+}
+
+// compressibleBlobFixture returns a blob of n pieces which compress well.
+func compressibleBlobFixture(pieceLength, n int) *core.BlobFixture {
+	b := bytes.Repeat([]byte("kraken "), pieceLength*n/7+1)[:pieceLength*n]
+	d, err := core.NewDigester().FromBytes(b)
+	if err != nil {
+		panic(err)
+	}
+	mi, err := core.NewMetaInfo(d, bytes.NewReader(b), int64(pieceLength))
+	if err != nil {
+		panic(err)
+	}
+	return core.CustomBlobFixture(b, d, mi)
+}
+
+func TestCompressedTransfer(t *testing.T) {
+	tests := []struct {
+		desc       string
+		config     dispatch.Config
+		compressed bool
+	}{
+		{"compressed", dispatch.Config{}, true},
+		{"disabled by seeder", dispatch.Config{DisablePayloadCompression: true}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+
+			hosts, cleanup := newHosts(t, 2)
+			defer cleanup()
+
+			blob := compressibleBlobFixture(4096, 16)
+
+			seeder, err := hosts[0].Seed(test.config, blob)
+			require.NoError(err)
+			leecher, err := hosts[1].Leech(dispatch.Config{}, blob)
+			require.NoError(err)
+
+			link, err := Connect(leecher, seeder)
+			require.NoError(err)
+
+			require.NoError(leecher.Events.WaitComplete(_timeout))
+			require.NoError(leecher.VerifyContent())
+			require.Equal(blob.Length(), leecher.Dispatcher.Progress().BytesDownloaded)
+			require.Empty(leecher.Events.Failures())
+
+			// Payload bytes are counted once written, which may be after the
+			// leecher completed.
+			if test.compressed {
+				require.True(link.Remote.BytesSent() < blob.Length())
+			} else {
+				require.Eventually(func() bool {
+					return link.Remote.BytesSent() >= blob.Length()
+				}, _timeout, time.Millisecond)
+			}
+		})
+	}
+}
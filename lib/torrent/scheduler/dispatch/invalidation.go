@@ -0,0 +1,70 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"errors"
+
+	"github.com/uber/kraken/lib/torrent/scheduler/conn"
+)
+
+var errTorrentInvalidated = errors.New("piece request rejected while torrent is invalidated")
+
+// BeginInvalidation prepares d for the storage layer deleting its torrent, e.g.
+// to evict it under cache pressure. Like Drain, d stops requesting pieces and
+// rejects new piece requests of peers with a retryable error, such that peers
+// request pieces elsewhere rather than counting failures against d, while
+// serves in flight finish. Unlike Drain, d is not torn down.
+//
+// Returns a channel which is closed once serves and piece writes finished and
+// all piece readers were closed. From then on, d neither reads nor writes the
+// torrent, so its files may be deleted. Subsequent calls return the same
+// channel.
+func (d *Dispatcher) BeginInvalidation() <-chan struct{} {
+	d.invalidationOnce.Do(func() {
+		d.invalidating.Store(true)
+		d.log().Info("Invalidating torrent")
+		d.stats.Counter("invalidations").Inc(1)
+		d.status.notify(StateChanged)
+		go d.awaitInvalidation()
+	})
+	return d.invalidated
+}
+
+// Invalidating returns whether d is being invalidated, see BeginInvalidation.
+func (d *Dispatcher) Invalidating() bool {
+	return d.invalidating.Load()
+}
+
+// discardInvalidatingPayload discards piece payloads received while d is being
+// invalidated, which are not worth writing to a torrent which will be deleted.
+func (d *Dispatcher) discardInvalidatingPayload(msg *conn.Message) {
+	if msg.Payload != nil {
+		msg.Payload.Close()
+	}
+	d.stats.Counter("discarded_invalidating_payloads").Inc(1)
+}
+
+// awaitInvalidation closes d.invalidated once d no longer accesses its torrent.
+// Serves of requests accepted just before d.invalidating was set may begin after
+// d.inflight went idle: their readers are either waited for, or refused once
+// the torrent was invalidated, in which case the requests are rejected.
+func (d *Dispatcher) awaitInvalidation() {
+	start := d.clk.Now()
+	<-d.inflight.done()
+	<-d.torrent.invalidate()
+	d.stats.Timer("invalidation_time").Record(d.clk.Now().Sub(start))
+	d.log().Info("Torrent invalidated, safe to delete")
+	close(d.invalidated)
+}
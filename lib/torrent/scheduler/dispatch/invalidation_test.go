@@ -0,0 +1,151 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"testing"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/gen/go/proto/p2p"
+	"github.com/uber/kraken/lib/torrent/scheduler/conn"
+	"github.com/uber/kraken/lib/torrent/storage/piecereader"
+	"github.com/uber/kraken/utils/bitsetutil"
+)
+
+// errorCodes returns the codes of the error messages sent to messages.
+func errorCodes(messages Messages) []p2p.ErrorMessage_ErrorCode {
+	var codes []p2p.ErrorMessage_ErrorCode
+	for _, msg := range messages.(*mockMessages).getSent() {
+		if msg.Message.Type == p2p.Message_ERROR {
+			codes = append(codes, msg.Message.Error.Code)
+		}
+	}
+	return codes
+}
+
+func TestDispatcherInvalidationWaitsForServes(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(4, 1)
+	fixture, cleanup := completeTorrentFixture(t, blob)
+	defer cleanup()
+
+	torrent := &blockingTorrent{
+		Torrent: fixture,
+		reading: make(chan int),
+		release: make(chan struct{}),
+	}
+	stats := tally.NewTestScope("", nil)
+	d := testDispatcher(Config{DisableKeepalive: true}, clock.NewMock(), torrent)
+	d.stats = stats
+
+	p1, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false, false, false, false), newMockMessages())
+	require.NoError(err)
+	p2, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false, false, false, false), newMockMessages())
+	require.NoError(err)
+
+	// Both peers are being served while the torrent is invalidated.
+	require.NoError(d.dispatch(p1, conn.NewPieceRequestMessage(0, 1)))
+	require.NoError(d.dispatch(p2, conn.NewPieceRequestMessage(1, 1)))
+	reading := []int{<-torrent.reading, <-torrent.reading}
+	require.ElementsMatch([]int{0, 1}, reading)
+
+	invalidated := d.BeginInvalidation()
+	require.True(d.Invalidating())
+	require.True(d.Dump().Invalidating)
+	require.True(d.Snapshot().Invalidating)
+	require.Equal(invalidated, d.BeginInvalidation())
+	require.False(isDone(invalidated))
+
+	// New piece requests are rejected as retryable, without reading pieces.
+	require.NoError(d.dispatch(p1, conn.NewPieceRequestMessage(2, 1)))
+	require.NoError(d.dispatch(p2, conn.NewPieceRequestMessage(3, 1)))
+	require.False(isDone(invalidated))
+
+	close(torrent.release)
+	require.Eventually(func() bool { return isDone(invalidated) }, time.Second, time.Millisecond)
+
+	require.Equal([]int{0}, servedPieces(p1.messages))
+	require.Equal([]int{1}, servedPieces(p2.messages))
+	for _, p := range []*peer{p1, p2} {
+		require.Equal(
+			[]p2p.ErrorMessage_ErrorCode{p2p.ErrorMessage_PIECE_REQUEST_RETRY}, errorCodes(p.messages))
+	}
+	require.False(closed(p1.messages))
+
+	counters := stats.Snapshot().Counters()
+	require.Equal(int64(1), counters["invalidations+"].Value())
+	require.Equal(int64(2), counters["rejected_invalidating_piece_requests+"].Value())
+}
+
+func TestDispatcherInvalidationRefusesReadsOfAcceptedRequests(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(2, 1)
+	torrent, cleanup := completeTorrentFixture(t, blob)
+	defer cleanup()
+
+	d := testDispatcher(Config{DisableKeepalive: true}, clock.NewMock(), torrent)
+
+	p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false, false), newMockMessages())
+	require.NoError(err)
+
+	<-d.BeginInvalidation()
+
+	// A request which was accepted just before invalidation is served after
+	// the torrent was invalidated.
+	require.NoError(d.servePiece(p, conn.NewPieceRequestMessage(0, 1).Message.PieceRequest))
+	require.Empty(servedPieces(p.messages))
+	require.Equal([]p2p.ErrorMessage_ErrorCode{p2p.ErrorMessage_PIECE_REQUEST_RETRY}, errorCodes(p.messages))
+	require.Empty(d.QuarantinedPieces())
+
+	// Payloads are discarded rather than written.
+	require.NoError(d.dispatch(p, conn.NewPiecePayloadMessage(0, piecereader.NewBuffer(blob.Content[0:1]))))
+	_, err = d.torrent.GetPieceReader(0)
+	require.Equal(errTorrentInvalidated, err)
+	require.Equal(errTorrentInvalidated, d.torrent.WritePiece(piecereader.NewBuffer(blob.Content[0:1]), 0))
+}
+
+func TestDispatcherInvalidationWaitsForOpenReaders(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(2, 1)
+	torrent, cleanup := completeTorrentFixture(t, blob)
+	defer cleanup()
+
+	d := testDispatcher(Config{DisableKeepalive: true}, clock.NewMock(), torrent)
+
+	pr, err := d.torrent.GetPieceReader(0)
+	require.NoError(err)
+	_, err = d.torrent.GetPieceReader(2)
+	require.Error(err)
+
+	invalidated := d.BeginInvalidation()
+	time.Sleep(10 * time.Millisecond)
+	require.False(isDone(invalidated))
+
+	require.NoError(pr.Close())
+	require.Eventually(func() bool { return isDone(invalidated) }, time.Second, time.Millisecond)
+
+	// Closing a reader twice does not release it twice.
+	require.NoError(pr.Close())
+	d.torrent.mu.Lock()
+	require.Equal(0, d.torrent.accesses)
+	d.torrent.mu.Unlock()
+}
@@ -0,0 +1,69 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import "github.com/uber/kraken/lib/torrent/scheduler/conn"
+
+// watchKeepalive sends p a keepalive whenever p sent us no message within
+// Config.KeepaliveInterval, and removes p once it leaves
+// Config.MaxMissedKeepalives keepalives in a row unanswered. Otherwise, the feed
+// of a peer whose connection lingers half-open blocks forever, and pieces
+// reserved for the peer only move on as their requests time out. Peers which do
+// not support conn.Keepalive are never probed, since they may legitimately stay
+// silent indefinitely, e.g. once both sides completed.
+func (d *Dispatcher) watchKeepalive(p *peer) {
+	if d.config.KeepaliveInterval <= 0 || !p.messages.Supports(conn.Keepalive) {
+		return
+	}
+	d.afterFunc(d.config.KeepaliveInterval, func() { d.checkKeepalive(p) })
+}
+
+func (d *Dispatcher) checkKeepalive(p *peer) {
+	select {
+	case <-d.tornDown:
+		return
+	default:
+	}
+	if v, ok := d.peers.Load(p.id); !ok || v.(*peer) != p {
+		// Peer was removed meanwhile.
+		return
+	}
+	wait, send, dead := p.nextKeepalive(d.config.KeepaliveInterval, d.config.MaxMissedKeepalives)
+	if dead {
+		d.peerTimedOut(p)
+		return
+	}
+	if send {
+		d.stats.Counter("keepalives_sent").Inc(1)
+		d.useCapability(conn.Keepalive)
+		d.send(p, conn.NewKeepaliveMessage())
+	}
+	d.afterFunc(wait, func() { d.checkKeepalive(p) })
+}
+
+// peerTimedOut removes p, which is considered dead. Piece requests reserved for
+// p are resent to other peers.
+func (d *Dispatcher) peerTimedOut(p *peer) {
+	if err := d.closePeer(p, PeerRemovalTimeout); err != nil {
+		// Already removed.
+		return
+	}
+	d.log("peer", p).Infof(
+		"Removed peer which left %d keepalives unanswered", d.config.MaxMissedKeepalives)
+	d.stats.Counter("peer_timeouts").Inc(1)
+}
+
+func (d *Dispatcher) handleKeepalive(p *peer) {
+	d.send(p, conn.NewKeepaliveAckMessage())
+}
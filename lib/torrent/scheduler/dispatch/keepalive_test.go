@@ -0,0 +1,183 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"testing"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/gen/go/proto/p2p"
+	"github.com/uber/kraken/lib/torrent/scheduler/conn"
+	"github.com/uber/kraken/lib/torrent/storage/agentstorage"
+	"github.com/uber/kraken/utils/bitsetutil"
+)
+
+func numSent(messages Messages, t p2p.Message_Type) int {
+	var n int
+	for _, msg := range messages.(*mockMessages).getSent() {
+		if msg.Message.Type == t {
+			n++
+		}
+	}
+	return n
+}
+
+func keepaliveConfig() Config {
+	return Config{
+		KeepaliveInterval:   time.Second,
+		MaxMissedKeepalives: 2,
+		DisableEndgame:      true,
+	}
+}
+
+func TestDispatcherRemovesPeerWhichMissesKeepalives(t *testing.T) {
+	require := require.New(t)
+
+	torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(4, 1).MetaInfo)
+	defer cleanup()
+
+	clk := clock.NewMock()
+	stats := tally.NewTestScope("", nil)
+	d := testDispatcher(keepaliveConfig(), clk, torrent)
+	d.stats = stats
+
+	all := bitsetutil.FromBools(true, true, true, true)
+	p, err := d.addPeer(core.PeerIDFixture(), all, newMockMessages())
+	require.NoError(err)
+	d.watchKeepalive(p)
+
+	_, err = d.maybeRequestMorePieces(p)
+	require.NoError(err)
+	require.Len(requestedPieces(p.messages), 3)
+
+	other, err := d.addPeer(core.PeerIDFixture(), all, newMockMessages())
+	require.NoError(err)
+
+	clk.Add(time.Second)
+	require.Equal(1, numSent(p.messages, p2p.Message_KEEPALIVE))
+	clk.Add(time.Second)
+	require.Equal(2, numSent(p.messages, p2p.Message_KEEPALIVE))
+	require.Equal(2, p.stats().UnansweredKeepalives)
+	require.False(closed(p.messages))
+
+	clk.Add(time.Second)
+	require.Equal(2, numSent(p.messages, p2p.Message_KEEPALIVE))
+	require.True(closed(p.messages))
+	_, ok := d.peers.Load(p.id)
+	require.False(ok)
+	require.Equal(int64(1), stats.Snapshot().Counters()["peer_timeouts+"].Value())
+
+	// Pieces reserved for the dead peer are requested from others on the next
+	// pass, without waiting for their requests to time out.
+	d.runPendingKick()
+	require.ElementsMatch(requestedPieces(p.messages), requestedPieces(other.messages))
+}
+
+func TestDispatcherKeepsPeerWhichAnswersKeepalives(t *testing.T) {
+	require := require.New(t)
+
+	torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(1, 1).MetaInfo)
+	defer cleanup()
+
+	clk := clock.NewMock()
+	d := testDispatcher(keepaliveConfig(), clk, torrent)
+
+	p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false), newMockMessages())
+	require.NoError(err)
+	d.watchKeepalive(p)
+
+	for i := 1; i <= 10; i++ {
+		clk.Add(time.Second)
+		require.Equal(i, numSent(p.messages, p2p.Message_KEEPALIVE))
+		require.NoError(d.dispatch(p, conn.NewKeepaliveAckMessage()))
+	}
+	require.False(closed(p.messages))
+	require.Equal(0, p.stats().UnansweredKeepalives)
+}
+
+func TestDispatcherOnlySendsKeepalivesToIdlePeers(t *testing.T) {
+	require := require.New(t)
+
+	torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(1, 1).MetaInfo)
+	defer cleanup()
+
+	clk := clock.NewMock()
+	d := testDispatcher(keepaliveConfig(), clk, torrent)
+
+	p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false), newMockMessages())
+	require.NoError(err)
+	d.watchKeepalive(p)
+
+	// Any message counts, and p is only probed a full interval after it.
+	for i := 0; i < 10; i++ {
+		clk.Add(500 * time.Millisecond)
+		require.NoError(d.dispatch(p, conn.NewAnnouncePieceMessage(0)))
+	}
+	require.Equal(0, numSent(p.messages, p2p.Message_KEEPALIVE))
+
+	clk.Add(999 * time.Millisecond)
+	require.Equal(0, numSent(p.messages, p2p.Message_KEEPALIVE))
+	clk.Add(time.Millisecond)
+	require.Equal(1, numSent(p.messages, p2p.Message_KEEPALIVE))
+}
+
+func TestDispatcherNeverTimesOutPeersWithoutKeepalive(t *testing.T) {
+	tests := []struct {
+		desc     string
+		config   Config
+		messages *mockMessages
+	}{
+		{"legacy peer", keepaliveConfig(), newLegacyMockMessages(conn.Keepalive)},
+		{"disabled", Config{DisableKeepalive: true}, newMockMessages()},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+
+			torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(1, 1).MetaInfo)
+			defer cleanup()
+
+			clk := clock.NewMock()
+			d := testDispatcher(test.config, clk, torrent)
+
+			p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false), test.messages)
+			require.NoError(err)
+			d.watchKeepalive(p)
+
+			clk.Add(time.Hour)
+			require.Equal(0, numSent(p.messages, p2p.Message_KEEPALIVE))
+			require.False(closed(p.messages))
+		})
+	}
+}
+
+func TestDispatcherAnswersKeepalives(t *testing.T) {
+	require := require.New(t)
+
+	torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(1, 1).MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(Config{}, clock.NewMock(), torrent)
+
+	p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false), newMockMessages())
+	require.NoError(err)
+
+	require.NoError(d.dispatch(p, conn.NewKeepaliveMessage()))
+	require.Equal(1, numSent(p.messages, p2p.Message_KEEPALIVE_ACK))
+}
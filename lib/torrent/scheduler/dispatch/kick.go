@@ -0,0 +1,60 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import "time"
+
+// Kick asks d to re-evaluate piece requests right away rather than on its next
+// tick, e.g. once the scheduler blacklisted a peer or the tracker returned new
+// peers. The pass runs on the background loop of d, not on the caller: expired
+// and failed piece requests are resent, and more pieces are requested from all
+// peers. Kicks which arrive before the pass began are coalesced into it. No-op
+// once d stopped requesting pieces.
+func (d *Dispatcher) Kick() {
+	d.stats.Counter("kicks").Inc(1)
+	select {
+	case d.kicks <- d.clk.Now():
+		if d.runner != nil {
+			d.runner.after(0, d.runPendingKick)
+		}
+	default:
+		// A pass is pending already.
+		d.stats.Counter("coalesced_kicks").Inc(1)
+	}
+}
+
+// runPendingKick runs the pass of a pending Kick on the Runner of d, unless d
+// stopped requesting pieces.
+func (d *Dispatcher) runPendingKick() {
+	if d.SeedOnly() {
+		return
+	}
+	select {
+	case <-d.pendingPiecesDone:
+		return
+	default:
+	}
+	select {
+	case kickedAt := <-d.kicks:
+		d.kick(kickedAt)
+	default:
+	}
+}
+
+// kick runs the pass requested by a Kick at kickedAt.
+func (d *Dispatcher) kick(kickedAt time.Time) {
+	d.stats.Timer("kick_latency").Record(d.clk.Now().Sub(kickedAt))
+	d.resendFailedPieceRequests()
+	d.requestMorePiecesFromAll()
+}
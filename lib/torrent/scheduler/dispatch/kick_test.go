@@ -0,0 +1,129 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"testing"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/torrent/storage/agentstorage"
+	"github.com/uber/kraken/utils/bitsetutil"
+)
+
+func TestDispatcherKickMovesRequestsOfBlacklistedPeer(t *testing.T) {
+	require := require.New(t)
+
+	torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(4, 1).MetaInfo)
+	defer cleanup()
+
+	stats := tally.NewTestScope("", nil)
+	d := testDispatcher(Config{
+		PipelineLimit:    4,
+		DisableEndgame:   true,
+		DisableKeepalive: true,
+	}, clock.NewMock(), torrent)
+	d.stats = stats
+	defer d.TearDown()
+
+	blacklisted, err := d.addPeer(
+		core.PeerIDFixture(), bitsetutil.FromBools(true, true, true, true), newMockMessages())
+	require.NoError(err)
+	other, err := d.addPeer(
+		core.PeerIDFixture(), bitsetutil.FromBools(true, true, true, true), newMockMessages())
+	require.NoError(err)
+
+	_, err = d.maybeRequestMorePieces(blacklisted)
+	require.NoError(err)
+	_, err = d.maybeRequestMorePieces(other)
+	require.NoError(err)
+	require.Len(requestedPieces(blacklisted.messages), 4)
+	require.Empty(requestedPieces(other.messages))
+
+	// The scheduler closes the conn of the blacklisted peer, which drops its
+	// requests.
+	require.NoError(d.removePeer(blacklisted))
+
+	go d.watchPendingPieceRequests()
+
+	// The pieces move to the other peer without the clock reaching the next
+	// tick.
+	d.Kick()
+	require.Eventually(func() bool {
+		return len(requestedPieces(other.messages)) == 4
+	}, time.Second, time.Millisecond)
+
+	snapshot := stats.Snapshot()
+	require.Equal(int64(1), snapshot.Counters()["kicks+"].Value())
+	require.NotContains(snapshot.Counters(), "coalesced_kicks+")
+	require.Equal([]time.Duration{0}, snapshot.Timers()["kick_latency+"].Values())
+}
+
+func TestDispatcherCoalescesKicks(t *testing.T) {
+	require := require.New(t)
+
+	torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(2, 1).MetaInfo)
+	defer cleanup()
+
+	clk := clock.NewMock()
+	stats := tally.NewTestScope("", nil)
+	d := testDispatcher(Config{DisableEndgame: true, DisableKeepalive: true}, clk, torrent)
+	d.stats = stats
+	defer d.TearDown()
+
+	p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, true), newMockMessages())
+	require.NoError(err)
+
+	// Kicks before the loop picks up the first one are coalesced into a single
+	// pass, whose latency is measured from the first kick.
+	d.Kick()
+	clk.Add(time.Second)
+	d.Kick()
+	d.Kick()
+
+	go d.watchPendingPieceRequests()
+
+	require.Eventually(func() bool {
+		return len(requestedPieces(p.messages)) == 2
+	}, time.Second, time.Millisecond)
+	require.Eventually(func() bool {
+		_, ok := stats.Snapshot().Timers()["kick_latency+"]
+		return ok
+	}, time.Second, time.Millisecond)
+
+	snapshot := stats.Snapshot()
+	require.Equal(int64(3), snapshot.Counters()["kicks+"].Value())
+	require.Equal(int64(2), snapshot.Counters()["coalesced_kicks+"].Value())
+	require.Equal([]time.Duration{time.Second}, snapshot.Timers()["kick_latency+"].Values())
+}
+
+func TestDispatcherKickNoopsOnceComplete(t *testing.T) {
+	require := require.New(t)
+
+	torrent, cleanup := completeTorrentFixture(t, core.SizedBlobFixture(1, 1))
+	defer cleanup()
+
+	d := testDispatcher(Config{DisableKeepalive: true}, clock.NewMock(), torrent)
+	defer d.TearDown()
+
+	// Nobody services the kicks of a complete Dispatcher, which must not block.
+	for i := 0; i < 3; i++ {
+		d.Kick()
+	}
+	require.True(d.Complete())
+}
@@ -0,0 +1,118 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"sort"
+	"time"
+)
+
+// pipelineLimit returns the number of piece requests which may be pending to p,
+// based on the adaptive pipeline limit of p. Peers which are slower than the
+// fastest peer get proportionally fewer requests, such that the pieces they
+// share with faster peers are mostly requested from the faster peers. Slow
+// peers still get at least one request, which keeps their round-trip estimates
+// fresh.
+//
+// The fastest round-trip time is read from the cached swarm baseline, which is
+// recomputed once per pass over all peers, so pipelineLimit is O(1).
+func (d *Dispatcher) pipelineLimit(p *peer) int {
+	limit := d.pieceRequestManager.PipelineDepth(p.id)
+	rtt := p.getPieceRTT()
+	if d.config.DisableLatencyPreference || rtt == 0 {
+		return limit
+	}
+	return scaledPipelineLimit(limit, rtt, d.lowerRTTBaseline(rtt))
+}
+
+// lowerRTTBaseline lowers the swarm baseline to rtt if rtt is faster, and
+// returns the resulting baseline.
+func (d *Dispatcher) lowerRTTBaseline(rtt time.Duration) time.Duration {
+	for {
+		best := d.rttBaseline.Load()
+		if best > 0 && best <= int64(rtt) {
+			return time.Duration(best)
+		}
+		if d.rttBaseline.CAS(best, int64(rtt)) {
+			return rtt
+		}
+	}
+}
+
+// refreshRTTBaseline recomputes the swarm baseline from all current peers,
+// such that it rises again once the fastest peer slows down or leaves.
+func (d *Dispatcher) refreshRTTBaseline() {
+	var best time.Duration
+	d.peers.Range(func(k, v interface{}) bool {
+		if r := v.(*peer).getPieceRTT(); r > 0 && (best == 0 || r < best) {
+			best = r
+		}
+		return true
+	})
+	d.rttBaseline.Store(int64(best))
+}
+
+// scaledPipelineLimit scales limit by the ratio of best to rtt, rounding up.
+func scaledPipelineLimit(limit int, rtt, best time.Duration) int {
+	if rtt <= best {
+		return limit
+	}
+	n := int((int64(limit)*int64(best) + int64(rtt) - 1) / int64(rtt))
+	if n < 1 {
+		return 1
+	}
+	return n
+}
+
+// peersByLatency returns all peers ordered by their piece round-trip time,
+// fastest first. Peers without estimates are ordered last. Peers on network
+// interfaces with a higher preference are ordered ahead of all other peers,
+// even if latency preference is disabled, see Config.NetworkInterfaces. As a
+// side effect, the swarm baseline used by pipelineLimit is recomputed.
+func (d *Dispatcher) peersByLatency() []*peer {
+	type rankedPeer struct {
+		p   *peer
+		rtt time.Duration
+	}
+	var ranked []rankedPeer
+	var best time.Duration
+	d.peers.Range(func(k, v interface{}) bool {
+		p := v.(*peer)
+		r := p.getPieceRTT()
+		if r > 0 && (best == 0 || r < best) {
+			best = r
+		}
+		ranked = append(ranked, rankedPeer{p, r})
+		return true
+	})
+	d.rttBaseline.Store(int64(best))
+	sort.SliceStable(ranked, func(i, j int) bool {
+		if a, b := ranked[i].p.iface.preference, ranked[j].p.iface.preference; a != b {
+			return a > b
+		}
+		if d.config.DisableLatencyPreference {
+			return false
+		}
+		a, b := ranked[i].rtt, ranked[j].rtt
+		if (a == 0) != (b == 0) {
+			return b == 0
+		}
+		return a < b
+	})
+	peers := make([]*peer, len(ranked))
+	for i, r := range ranked {
+		peers[i] = r.p
+	}
+	return peers
+}
@@ -0,0 +1,160 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"testing"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/torrent/scheduler/conn"
+	"github.com/uber/kraken/lib/torrent/storage/agentstorage"
+	"github.com/uber/kraken/lib/torrent/storage/piecereader"
+	"github.com/uber/kraken/utils/bitsetutil"
+)
+
+func TestRTTEstimator(t *testing.T) {
+	require := require.New(t)
+
+	e := newRTTEstimator(0.5)
+	require.Equal(time.Duration(0), e.get())
+
+	e.add(0)
+	require.Equal(time.Duration(0), e.get())
+
+	e.add(100 * time.Millisecond)
+	require.Equal(50*time.Millisecond, e.get())
+
+	e.add(150 * time.Millisecond)
+	require.Equal(100*time.Millisecond, e.get())
+}
+
+func TestScaledPipelineLimit(t *testing.T) {
+	tests := []struct {
+		desc     string
+		rtt      time.Duration
+		best     time.Duration
+		expected int
+	}{
+		{"fastest", 10 * time.Millisecond, 10 * time.Millisecond, 8},
+		{"twice as slow", 20 * time.Millisecond, 10 * time.Millisecond, 4},
+		{"rounds up", 30 * time.Millisecond, 10 * time.Millisecond, 3},
+		{"trickle", time.Second, 10 * time.Millisecond, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require.Equal(t, test.expected, scaledPipelineLimit(8, test.rtt, test.best))
+		})
+	}
+}
+
+// setPieceRTT makes p sample rtt for a single piece request.
+func setPieceRTT(clk *clock.Mock, p *peer, rtt time.Duration) {
+	p.touchPieceRequestSent(-1)
+	clk.Add(rtt)
+	p.samplePieceRTT(-1)
+}
+
+func TestDispatcherPeersByLatency(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+
+	torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(1, 1).MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(Config{PipelineLimit: 4}, clk, torrent)
+
+	var peers []*peer
+	for i := 0; i < 4; i++ {
+		p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true), newMockMessages())
+		require.NoError(err)
+		peers = append(peers, p)
+	}
+	setPieceRTT(clk, peers[0], 30*time.Millisecond)
+	setPieceRTT(clk, peers[1], 10*time.Millisecond)
+	setPieceRTT(clk, peers[2], 20*time.Millisecond)
+
+	// peers[3] has no estimate yet.
+	require.Equal(
+		[]*peer{peers[1], peers[2], peers[0], peers[3]}, d.peersByLatency())
+
+	require.Equal(4, d.pipelineLimit(peers[1]))
+	require.Equal(2, d.pipelineLimit(peers[2]))
+	require.Equal(4, d.pipelineLimit(peers[3]))
+
+	// The baseline rises once the fastest peer leaves.
+	require.NoError(d.removePeer(peers[1]))
+	require.Equal(4, d.pipelineLimit(peers[2]))
+	require.Equal(3, d.pipelineLimit(peers[0]))
+}
+
+func TestDispatcherPrefersLowLatencyPeers(t *testing.T) {
+	require := require.New(t)
+
+	config := Config{
+		PipelineLimit:  4,
+		DisableEndgame: true,
+	}
+	clk := clock.NewMock()
+
+	blob := core.SizedBlobFixture(16, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(config, clk, torrent)
+
+	b := bitsetutil.FromBools(make([]bool, 16)...).Complement()
+	fast, err := d.addPeer(core.PeerIDFixture(), b, newMockMessages())
+	require.NoError(err)
+	slow, err := d.addPeer(core.PeerIDFixture(), b, newMockMessages())
+	require.NoError(err)
+
+	receive := func(p *peer) {
+		i := d.pieceRequestManager.PendingPieces(p.id)[0]
+		require.NoError(d.dispatch(
+			p, conn.NewPiecePayloadMessage(i, piecereader.NewBuffer(blob.Content[i:i+1]))))
+	}
+
+	// Without estimates, both peers get the full pipeline.
+	_, err = d.maybeRequestMorePieces(fast)
+	require.NoError(err)
+	clk.Add(10 * time.Millisecond)
+	receive(fast)
+
+	_, err = d.maybeRequestMorePieces(slow)
+	require.NoError(err)
+	require.Len(d.pieceRequestManager.PendingPieces(slow.id), 4)
+	clk.Add(90 * time.Millisecond)
+	receive(slow)
+
+	stats, ok := d.PeerStats(slow.id)
+	require.True(ok)
+	require.Equal(90*time.Millisecond, stats.PieceRTT)
+
+	// The slow peer is not sent new requests until its backlog drains below
+	// its scaled limit of a single request.
+	require.Equal(1, d.pipelineLimit(slow))
+	require.Len(d.pieceRequestManager.PendingPieces(slow.id), 3)
+
+	// Requests to all peers are sent to the fast peer first.
+	d.pieceRequestManager.ClearPeer(slow.id)
+	d.requestMorePiecesFromAll()
+	require.Len(d.pieceRequestManager.PendingPieces(fast.id), 4)
+	require.Len(d.pieceRequestManager.PendingPieces(slow.id), 1)
+}
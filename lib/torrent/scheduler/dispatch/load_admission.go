@@ -0,0 +1,93 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"fmt"
+
+	"go.uber.org/atomic"
+)
+
+// AdmissionDecision is the result of consulting LoadAdmission before serving a
+// piece.
+type AdmissionDecision int
+
+const (
+	// AdmissionAllow serves the piece immediately.
+	AdmissionAllow AdmissionDecision = iota
+
+	// AdmissionDefer retries serving the piece later. If too many serves are
+	// already deferred, the piece request is rejected instead.
+	AdmissionDefer
+
+	// AdmissionReject fails the piece request, such that the peer requests the
+	// piece elsewhere.
+	AdmissionReject
+)
+
+func (d AdmissionDecision) String() string {
+	switch d {
+	case AdmissionAllow:
+		return "allow"
+	case AdmissionDefer:
+		return "defer"
+	case AdmissionReject:
+		return "reject"
+	default:
+		return fmt.Sprintf("AdmissionDecision(%d)", int(d))
+	}
+}
+
+// LoadAdmission decides whether pieces may be served given the current system
+// load. It is consulted before reading pieces from disk, and must be thread-safe.
+type LoadAdmission interface {
+	AdmitServe(piece int, length int64) AdmissionDecision
+}
+
+// LoadGaugeAdmission is a LoadAdmission which admits serves based on a load
+// value updated by the caller, e.g. from CPU or disk utilization.
+type LoadGaugeAdmission struct {
+	deferAbove  float64
+	rejectAbove float64
+	load        *atomic.Float64
+}
+
+// NewLoadGaugeAdmission creates a new LoadGaugeAdmission which defers serves
+// while load is above deferAbove and rejects serves while load is above
+// rejectAbove.
+func NewLoadGaugeAdmission(deferAbove, rejectAbove float64) *LoadGaugeAdmission {
+	return &LoadGaugeAdmission{
+		deferAbove:  deferAbove,
+		rejectAbove: rejectAbove,
+		load:        atomic.NewFloat64(0),
+	}
+}
+
+// Update sets the current load.
+func (a *LoadGaugeAdmission) Update(load float64) {
+	a.load.Store(load)
+}
+
+// AdmitServe admits serves based on the current load.
+func (a *LoadGaugeAdmission) AdmitServe(piece int, length int64) AdmissionDecision {
+	load := a.load.Load()
+	switch {
+	case load > a.rejectAbove:
+		return AdmissionReject
+	case load > a.deferAbove:
+		return AdmissionDefer
+	default:
+		return AdmissionAllow
+	}
+}
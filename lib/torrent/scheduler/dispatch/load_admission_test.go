@@ -0,0 +1,36 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadGaugeAdmission(t *testing.T) {
+	require := require.New(t)
+
+	a := NewLoadGaugeAdmission(0.5, 0.9)
+	require.Equal(AdmissionAllow, a.AdmitServe(0, 1))
+
+	a.Update(0.7)
+	require.Equal(AdmissionDefer, a.AdmitServe(0, 1))
+
+	a.Update(0.95)
+	require.Equal(AdmissionReject, a.AdmitServe(0, 1))
+
+	a.Update(0.1)
+	require.Equal(AdmissionAllow, a.AdmitServe(0, 1))
+}
@@ -0,0 +1,73 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"math"
+
+	"github.com/willf/bitset"
+)
+
+// Locality returns the locality label of d, see WithLocality.
+func (d *Dispatcher) Locality() string {
+	return d.locality
+}
+
+// preferLocal returns true if p is a local peer, which is preferred for piece
+// requests and upload slots, see Config.LocalityWeight.
+func (d *Dispatcher) preferLocal(p *peer) bool {
+	return p.local && !d.config.DisableLocalityPreference
+}
+
+// heldByLocalPeers returns the candidates of p which local peers other than p
+// hold too, or nil if p is local itself, there are none, or pieces are
+// reserved under all peers alike.
+func (d *Dispatcher) heldByLocalPeers(
+	p *peer, candidates *bitset.BitSet, endgame bool) *bitset.BitSet {
+
+	if d.locality == "" || d.config.DisableLocalityPreference || endgame || p.local {
+		return nil
+	}
+	var held *bitset.BitSet
+	d.peers.Range(func(k, v interface{}) bool {
+		q := v.(*peer)
+		if q == p || !q.local {
+			return true
+		}
+		b := q.bitfield.Copy()
+		if held == nil {
+			held = b
+		} else {
+			held.InPlaceUnion(b)
+		}
+		return true
+	})
+	if held == nil {
+		return nil
+	}
+	shared := candidates.Intersection(held)
+	if shared.None() {
+		return nil
+	}
+	return shared
+}
+
+// localUploadSlots returns how many of the regular upload slots go to local
+// peers first.
+func (d *Dispatcher) localUploadSlots(regular int) int {
+	if d.locality == "" || d.config.DisableLocalityPreference || regular <= 0 {
+		return 0
+	}
+	return int(math.Ceil(d.config.LocalityWeight * float64(regular)))
+}
@@ -0,0 +1,175 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+	"github.com/willf/bitset"
+	"go.uber.org/zap"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/torrent/networkevent"
+	"github.com/uber/kraken/lib/torrent/scheduler/torrentlog"
+	"github.com/uber/kraken/lib/torrent/storage"
+	"github.com/uber/kraken/lib/torrent/storage/agentstorage"
+	"github.com/uber/kraken/utils/bitsetutil"
+)
+
+func localityDispatcher(config Config, clk clock.Clock, t storage.Torrent, locality string) *Dispatcher {
+	d, err := newDispatcher(
+		config,
+		tally.NoopScope,
+		clk,
+		networkevent.NewTestProducer(),
+		noopEvents{},
+		core.PeerIDFixture(),
+		t,
+		zap.NewNop().Sugar(),
+		torrentlog.NewNopLogger(),
+		WithLocality(locality))
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+func TestDispatcherPrefersLocalPeersForSharedPieces(t *testing.T) {
+	for _, disabled := range []bool{false, true} {
+		t.Run(fmt.Sprintf("disable_locality_preference=%t", disabled), func(t *testing.T) {
+			require := require.New(t)
+
+			torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(6, 1).MetaInfo)
+			defer cleanup()
+
+			stats := tally.NewTestScope("", nil)
+			d := localityDispatcher(Config{
+				PipelineLimit:                 6,
+				DisableEndgame:                true,
+				DisableCompletePeerPreference: true,
+				DisableLocalityPreference:     disabled,
+				DisableKeepalive:              true,
+			}, clock.NewMock(), torrent, "zone1")
+			d.stats = stats
+
+			// Only the remote peer holds pieces 4 and 5.
+			remote, err := d.addPeer(
+				core.PeerIDFixture(),
+				bitsetutil.FromBools(true, true, true, true, true, true),
+				newMockMessages(),
+				WithPeerLocality("zone2"))
+			require.NoError(err)
+			local, err := d.addPeer(
+				core.PeerIDFixture(),
+				bitsetutil.FromBools(true, true, true, true, false, false),
+				newMockMessages(),
+				WithPeerLocality("zone1"))
+			require.NoError(err)
+
+			_, err = d.maybeRequestMorePieces(remote)
+			require.NoError(err)
+			_, err = d.maybeRequestMorePieces(local)
+			require.NoError(err)
+
+			if disabled {
+				require.Len(requestedPieces(remote.messages), 6)
+				require.Empty(requestedPieces(local.messages))
+				return
+			}
+			// The remote peer holds half its pipeline: pieces only it holds,
+			// and one piece the local peer holds too.
+			fromRemote := requestedPieces(remote.messages)
+			require.Len(fromRemote, 3)
+			require.Subset(fromRemote, []int{4, 5})
+			require.Len(requestedPieces(local.messages), 3)
+			require.Equal(
+				int64(1), stats.Snapshot().Counters()["shared_pieces_reserved_under_remote_peers+"].Value())
+		})
+	}
+}
+
+func TestDispatcherPrefersLocalPeersForUploadSlots(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+	blob := core.SizedBlobFixture(4, 1)
+	torrent, cleanup := completeTorrentFixture(t, blob)
+	defer cleanup()
+
+	d := localityDispatcher(Config{
+		EnableChoking:    true,
+		UploadSlots:      3,
+		DisableKeepalive: true,
+	}, clk, torrent, "zone1")
+
+	var remote []*peer
+	for i := 0; i < 6; i++ {
+		p, err := d.addPeer(core.PeerIDFixture(), bitset.New(4), newMockMessages(), WithPeerLocality("zone2"))
+		require.NoError(err)
+		remote = append(remote, p)
+	}
+	local, err := d.addPeer(core.PeerIDFixture(), bitset.New(4), newMockMessages(), WithPeerLocality("zone1"))
+	require.NoError(err)
+
+	// The local peer keeps one of the two regular slots, while remote peers
+	// rotate through the other slot and the optimistic unchoke.
+	unchokedAny := make(map[*peer]bool)
+	for i := 0; i < 6; i++ {
+		clk.Add(time.Second)
+		d.rechoke()
+		require.False(local.serves.isChoked())
+		var unchoked int
+		for _, p := range remote {
+			if !p.serves.isChoked() {
+				unchoked++
+				unchokedAny[p] = true
+			}
+		}
+		require.Equal(2, unchoked)
+	}
+	require.Len(unchokedAny, len(remote))
+
+	require.Equal("zone1", d.Snapshot().Locality)
+	require.True(local.stats().Local)
+	require.Equal("zone1", local.stats().Locality)
+	require.False(remote[0].stats().Local)
+	require.Equal("zone2", remote[0].stats().Locality)
+}
+
+func TestDispatcherTreatsPeersAlikeWithoutLocality(t *testing.T) {
+	require := require.New(t)
+
+	torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(2, 1).MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(Config{DisableEndgame: true, DisableKeepalive: true}, clock.NewMock(), torrent)
+
+	// Peers without a label never share the locality of the Dispatcher.
+	p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, true), newMockMessages())
+	require.NoError(err)
+	require.False(p.stats().Local)
+	q, err := d.addPeer(
+		core.PeerIDFixture(), bitsetutil.FromBools(true, true), newMockMessages(), WithPeerLocality("zone1"))
+	require.NoError(err)
+	require.False(q.stats().Local)
+
+	_, err = d.maybeRequestMorePieces(p)
+	require.NoError(err)
+	require.Len(requestedPieces(p.messages), 2)
+}
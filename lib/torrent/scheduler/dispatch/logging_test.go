@@ -0,0 +1,270 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"errors"
+	"io/ioutil"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/gen/go/proto/p2p"
+	"github.com/uber/kraken/lib/torrent/networkevent"
+	"github.com/uber/kraken/lib/torrent/scheduler/conn"
+	"github.com/uber/kraken/lib/torrent/scheduler/torrentlog"
+	"github.com/uber/kraken/lib/torrent/storage"
+	"github.com/uber/kraken/lib/torrent/storage/agentstorage"
+	"github.com/uber/kraken/lib/torrent/storage/piecereader"
+	"github.com/uber/kraken/utils/bitsetutil"
+)
+
+// countingTorrent counts how often it is marshaled as log field.
+type countingTorrent struct {
+	storage.Torrent
+
+	mu       sync.Mutex
+	marshals int
+}
+
+func (t *countingTorrent) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	t.mu.Lock()
+	t.marshals++
+	t.mu.Unlock()
+	return t.Torrent.(zapcore.ObjectMarshaler).MarshalLogObject(enc)
+}
+
+func (t *countingTorrent) numMarshals() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.marshals
+}
+
+func loggingDispatcher(t storage.Torrent, logCore zapcore.Core) *Dispatcher {
+	d, err := newDispatcher(
+		Config{DisableKeepalive: true, DisablePeerBans: true},
+		tally.NoopScope,
+		clock.NewMock(),
+		networkevent.NewTestProducer(),
+		noopEvents{},
+		core.PeerIDFixture(),
+		t,
+		zap.New(logCore, zap.AddCaller()).Sugar(),
+		torrentlog.NewNopLogger())
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+// callerName returns the function which logged e.
+func callerName(e observer.LoggedEntry) string {
+	name := runtime.FuncForPC(e.Caller.PC).Name()
+	return name[strings.LastIndex(name, ".")+1:]
+}
+
+// sugaredLog returns a logger which formats args and the torrent of d up front,
+// as the Dispatcher did before log and logw formatted fields lazily.
+func sugaredLog(d *Dispatcher, args ...interface{}) *zap.SugaredLogger {
+	return d.logger.With(append(args, d.torrentField)...)
+}
+
+func TestDispatcherHotPathLogsMatchLog(t *testing.T) {
+	torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(4, 1).MetaInfo)
+	defer cleanup()
+
+	logCore, logs := observer.New(zap.DebugLevel)
+	d := loggingDispatcher(torrent, logCore)
+
+	p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false, false, false, false), newMockMessages())
+	require.NoError(t, err)
+
+	var violation error
+	tests := []struct {
+		desc   string
+		caller string
+		log    func()
+		legacy func()
+	}{
+		{
+			"handler error",
+			"handlerFailed",
+			func() {
+				msg := conn.NewAnnouncePieceMessage(4)
+				violation = d.dispatch(p, msg)
+				d.handlerFailed(p, msg.Message.Type, violation)
+			},
+			func() {
+				c, cause := categorize(violation)
+				sugaredLog(d,
+					"peer", p,
+					"category", c.String(),
+					"message_type", int32(p2p.Message_ANNOUCE_PIECE),
+					"error", cause).Error("Error dispatching message")
+			},
+		}, {
+			"failed piece request",
+			"handleError",
+			func() {
+				msg := conn.NewErrorMessage(1, p2p.ErrorMessage_PIECE_REQUEST_FAILED, errors.New("boom"))
+				d.handleError(p, msg.Message.Error)
+			},
+			func() { sugaredLog(d, "peer", p).Errorf("Piece request failed: %s", "boom") },
+		}, {
+			"rejected piece request",
+			"handleError",
+			func() { d.handleError(p, conn.NewRetryErrorMessage(1, errors.New("busy"), 0).Message.Error) },
+			func() { sugaredLog(d, "peer", p).Debugf("Piece request rejected: %s", "busy") },
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+
+			logs.TakeAll()
+			test.log()
+			test.legacy()
+			entries := logs.TakeAll()
+			require.Len(entries, 2)
+
+			actual, expected := entries[0], entries[1]
+			require.Equal(expected.Level, actual.Level)
+			require.Equal(expected.Message, actual.Message)
+			require.Equal(expected.ContextMap(), actual.ContextMap())
+			require.Equal(map[string]interface{}{"id": p.id.String()}, actual.ContextMap()["peer"])
+			require.Equal(map[string]interface{}{
+				"name":       torrent.Digest().Hex(),
+				"hash":       torrent.InfoHash().Hex(),
+				"downloaded": 0,
+			}, actual.ContextMap()["torrent"])
+			require.Equal(test.caller, callerName(actual))
+		})
+	}
+}
+
+func TestDispatcherHotPathLogsFormatNothingUnlessWritten(t *testing.T) {
+	require := require.New(t)
+
+	fixture, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(4, 1).MetaInfo)
+	defer cleanup()
+	torrent := &countingTorrent{Torrent: fixture}
+
+	// Encodes the first entry of each message per minute. Unlike observed
+	// entries, encoded entries format their fields.
+	out := &zaptest.Buffer{}
+	logCore := zapcore.NewCore(
+		zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()), out, zap.InfoLevel)
+	d := loggingDispatcher(torrent, zapcore.NewSampler(logCore, time.Minute, 1, 1000))
+
+	p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false, false, false, false), newMockMessages())
+	require.NoError(err)
+	before := torrent.numMarshals()
+
+	// Debug entries are disabled.
+	for i := 0; i < 10; i++ {
+		d.handleError(p, conn.NewRetryErrorMessage(1, errors.New("busy"), 0).Message.Error)
+		d.log("peer", p).Debugf("Peer %s is busy", p)
+	}
+	require.Empty(out.Lines())
+	require.Equal(before, torrent.numMarshals())
+
+	// All but the first handler error are sampled out.
+	for i := 0; i < 10; i++ {
+		msg := conn.NewAnnouncePieceMessage(4)
+		d.handlerFailed(p, msg.Message.Type, d.dispatch(p, msg))
+	}
+	require.Len(out.Lines(), 1)
+	require.Contains(out.Lines()[0], "Error dispatching message")
+	require.Equal(before+1, torrent.numMarshals())
+}
+
+// productionLogger returns an info level logger which encodes and samples
+// entries like the loggers of agents, but discards them.
+func productionLogger() *zap.SugaredLogger {
+	c := zapcore.NewCore(
+		zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()),
+		zapcore.AddSync(ioutil.Discard),
+		zap.InfoLevel)
+	return zap.New(zapcore.NewSampler(c, time.Second, 100, 100), zap.AddCaller()).Sugar()
+}
+
+// BenchmarkDispatcherHandleAnnouncePiece measures handling announcements of a
+// seeder, whose out of range announcements are logged as handler errors.
+func BenchmarkDispatcherHandleAnnouncePiece(b *testing.B) {
+	for _, bench := range []struct {
+		desc  string
+		index func(i, n int) int
+	}{
+		{"valid", func(i, n int) int { return i % n }},
+		{"out of range", func(i, n int) int { return n + i%n }},
+	} {
+		b.Run(bench.desc, func(b *testing.B) {
+			blob := core.SizedBlobFixture(256, 1)
+			torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+			defer cleanup()
+			for i := 0; i < torrent.NumPieces(); i++ {
+				if err := torrent.WritePiece(piecereader.NewBuffer(blob.Content[i:i+1]), i); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			d, err := newDispatcher(
+				Config{DisableKeepalive: true, DisablePeerBans: true},
+				tally.NoopScope,
+				clock.NewMock(),
+				networkevent.NewTestProducer(),
+				noopEvents{},
+				core.PeerIDFixture(),
+				torrent,
+				productionLogger(),
+				torrentlog.NewNopLogger())
+			if err != nil {
+				b.Fatal(err)
+			}
+			p, err := d.addPeer(
+				core.PeerIDFixture(),
+				bitsetutil.FromBools(make([]bool, torrent.NumPieces())...),
+				newMockMessages())
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			msgs := make([]*conn.Message, torrent.NumPieces())
+			for i := range msgs {
+				msgs[i] = conn.NewAnnouncePieceMessage(bench.index(i, len(msgs)))
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				msg := msgs[i%len(msgs)]
+				if err := d.dispatch(p, msg); err != nil {
+					d.handlerFailed(p, msg.Message.Type, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/uber-go/tally"
+)
+
+// Labels of connections which arrived on no configured network interface, and
+// of connections whose local address is unknown.
+const (
+	_otherInterface   = "other"
+	_unknownInterface = "unknown"
+)
+
+// NetworkInterface labels a local network interface which connections of peers
+// may arrive on, see Config.NetworkInterfaces.
+type NetworkInterface struct {
+	// Name labels metrics of peers on the interface, e.g. "storage". Must be
+	// unique, and neither "other" nor "unknown".
+	Name string `yaml:"name"`
+
+	// CIDRs contain the local addresses of the interface.
+	CIDRs []string `yaml:"cidrs"`
+
+	// Preference ranks the interface for piece requests: peers on interfaces
+	// with a higher preference are requested from ahead of peers on other
+	// interfaces, regardless of latency. Unlisted interfaces have preference
+	// zero.
+	Preference int `yaml:"preference"`
+}
+
+// localAddresser is implemented by Messages which report the local address
+// their connection arrived on, such as conn.Conn.
+type localAddresser interface {
+	LocalAddr() net.Addr
+}
+
+// peerInterface is the network interface which the connection of a peer
+// arrived on.
+type peerInterface struct {
+	name       string
+	preference int
+}
+
+// networkInterfaces classifies the local addresses of connections by the
+// configured network interfaces.
+type networkInterfaces struct {
+	interfaces []NetworkInterface
+	nets       [][]*net.IPNet // CIDRs of each interface.
+}
+
+func newNetworkInterfaces(interfaces []NetworkInterface) (*networkInterfaces, error) {
+	n := &networkInterfaces{interfaces: interfaces}
+	names := make(map[string]bool)
+	for _, ni := range interfaces {
+		if ni.Name == "" {
+			return nil, errors.New("network interface has no name")
+		}
+		if ni.Name == _otherInterface || ni.Name == _unknownInterface || names[ni.Name] {
+			return nil, fmt.Errorf("network interface name %q is reserved or duplicate", ni.Name)
+		}
+		names[ni.Name] = true
+		var nets []*net.IPNet
+		for _, cidr := range ni.CIDRs {
+			_, ipnet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("network interface %s: %s", ni.Name, err)
+			}
+			nets = append(nets, ipnet)
+		}
+		n.nets = append(n.nets, nets)
+	}
+	return n, nil
+}
+
+// configured returns false if no network interfaces are configured, in which
+// case metrics are not tagged by interface.
+func (n *networkInterfaces) configured() bool {
+	return len(n.interfaces) > 0
+}
+
+// classify returns the network interface which addr belongs to. The first
+// matching interface wins.
+func (n *networkInterfaces) classify(addr net.Addr) peerInterface {
+	ip := addrIP(addr)
+	if ip == nil {
+		return peerInterface{name: _unknownInterface}
+	}
+	for i, nets := range n.nets {
+		for _, ipnet := range nets {
+			if ipnet.Contains(ip) {
+				return peerInterface{n.interfaces[i].Name, n.interfaces[i].Preference}
+			}
+		}
+	}
+	return peerInterface{name: _otherInterface}
+}
+
+// addrIP returns the IP of addr, or nil if addr has none.
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case nil:
+		return nil
+	case *net.TCPAddr:
+		if a == nil {
+			return nil
+		}
+		return a.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// localAddr returns the local address which the connection of messages arrived
+// on, or nil if messages does not report it.
+func localAddr(messages Messages) net.Addr {
+	if a, ok := messages.(localAddresser); ok {
+		return a.LocalAddr()
+	}
+	return nil
+}
+
+// interfaceStats returns the stats of d tagged by the network interface of p,
+// or untagged if no network interfaces are configured.
+func (d *Dispatcher) interfaceStats(p *peer) tally.Scope {
+	if !d.interfaces.configured() {
+		return d.stats
+	}
+	return d.stats.Tagged(map[string]string{"interface": p.iface.name})
+}
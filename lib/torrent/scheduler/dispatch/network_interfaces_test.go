@@ -0,0 +1,226 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/torrent/scheduler/conn"
+	"github.com/uber/kraken/lib/torrent/storage/agentstorage"
+	"github.com/uber/kraken/lib/torrent/storage/piecereader"
+	"github.com/uber/kraken/utils/bitsetutil"
+)
+
+// newAddrMessages returns mockMessages of a connection which arrived on ip.
+func newAddrMessages(ip string) *mockMessages {
+	m := newMockMessages()
+	m.localAddr = &net.TCPAddr{IP: net.ParseIP(ip), Port: 16001}
+	return m
+}
+
+// pipeAddr is the address of an in-memory connection, which has no IP.
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+var testNetworkInterfaces = []NetworkInterface{
+	{Name: "storage", CIDRs: []string{"10.1.0.0/16", "fd00:1::/64"}, Preference: 1},
+	{Name: "wan", CIDRs: []string{"192.0.2.0/24"}},
+}
+
+func TestNetworkInterfacesClassify(t *testing.T) {
+	interfaces, err := newNetworkInterfaces(testNetworkInterfaces)
+	require.NoError(t, err)
+
+	tests := []struct {
+		desc     string
+		addr     net.Addr
+		expected peerInterface
+	}{
+		{"storage", &net.TCPAddr{IP: net.ParseIP("10.1.2.3")}, peerInterface{"storage", 1}},
+		{"storage ipv6", &net.TCPAddr{IP: net.ParseIP("fd00:1::5")}, peerInterface{"storage", 1}},
+		{"wan", &net.TCPAddr{IP: net.ParseIP("192.0.2.7")}, peerInterface{"wan", 0}},
+		{"unlisted", &net.TCPAddr{IP: net.ParseIP("10.2.0.1")}, peerInterface{"other", 0}},
+		{"other network", &net.UDPAddr{IP: net.ParseIP("10.1.0.1"), Port: 1}, peerInterface{"storage", 1}},
+		{"no ip", pipeAddr{}, peerInterface{"unknown", 0}},
+		{"nil", nil, peerInterface{"unknown", 0}},
+		{"nil tcp", (*net.TCPAddr)(nil), peerInterface{"unknown", 0}},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require.Equal(t, test.expected, interfaces.classify(test.addr))
+		})
+	}
+}
+
+func TestNewNetworkInterfacesRejectsInvalidConfig(t *testing.T) {
+	tests := []struct {
+		desc       string
+		interfaces []NetworkInterface
+	}{
+		{"no name", []NetworkInterface{{CIDRs: []string{"10.0.0.0/8"}}}},
+		{"reserved name", []NetworkInterface{{Name: "other"}}},
+		{"duplicate name", []NetworkInterface{{Name: "a"}, {Name: "a"}}},
+		{"invalid cidr", []NetworkInterface{{Name: "a", CIDRs: []string{"10.0.0.1"}}}},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			_, err := newNetworkInterfaces(test.interfaces)
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestDispatcherTagsMetricsByNetworkInterface(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(2, 1)
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	stats := tally.NewTestScope("", nil)
+	d := testDispatcher(Config{
+		NetworkInterfaces: testNetworkInterfaces,
+		DisableEndgame:    true,
+		DisableKeepalive:  true,
+	}, clock.NewMock(), torrent)
+	d.stats = stats
+
+	storagePeer, err := d.addPeer(
+		core.PeerIDFixture(), bitsetutil.FromBools(true, false), newAddrMessages("10.1.0.9"))
+	require.NoError(err)
+	wanPeer, err := d.addPeer(
+		core.PeerIDFixture(), bitsetutil.FromBools(false, false), newAddrMessages("192.0.2.9"))
+	require.NoError(err)
+	unknownPeer, err := d.addPeer(
+		core.PeerIDFixture(), bitsetutil.FromBools(false, false), newMockMessages())
+	require.NoError(err)
+
+	// Piece 0 is downloaded from the storage peer, and served to the WAN peer.
+	_, err = d.maybeRequestMorePieces(storagePeer)
+	require.NoError(err)
+	require.NoError(d.dispatch(
+		storagePeer, conn.NewPiecePayloadMessage(0, piecereader.NewBuffer(blob.Content[0:1]))))
+	require.NoError(d.dispatch(wanPeer, conn.NewPieceRequestMessage(0, 1)))
+	waitForServes(t, wanPeer)
+	require.Equal([]int{0}, servedPieces(wanPeer.messages))
+
+	snapshot := stats.Snapshot()
+	counters := snapshot.Counters()
+	require.Equal(int64(1), counters["downloaded_piece_bytes+interface=storage"].Value())
+	require.Equal(int64(1), counters["uploaded_piece_bytes+interface=wan"].Value())
+	histograms := snapshot.Histograms()
+	require.Contains(histograms, "piece_request_latency+attempt=first,endgame=false,interface=storage")
+	require.Contains(histograms, "piece_serve_latency+interface=wan")
+
+	// The interfaces of peers are exposed.
+	require.Equal("storage", storagePeer.stats().Interface)
+	require.Equal("10.1.0.9:16001", storagePeer.stats().LocalAddr)
+	require.Equal("unknown", unknownPeer.stats().Interface)
+	require.Empty(unknownPeer.stats().LocalAddr)
+	interfaces := make(map[string]string)
+	for _, ps := range d.Snapshot().Peers {
+		interfaces[ps.PeerID] = ps.Interface
+	}
+	require.Equal(map[string]string{
+		storagePeer.id.String(): "storage",
+		wanPeer.id.String():     "wan",
+		unknownPeer.id.String(): "unknown",
+	}, interfaces)
+}
+
+func TestDispatcherDoesNotTagMetricsUnlessNetworkInterfacesConfigured(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(1, 1)
+	torrent, cleanup := completeTorrentFixture(t, blob)
+	defer cleanup()
+
+	stats := tally.NewTestScope("", nil)
+	d := testDispatcher(Config{DisableKeepalive: true}, clock.NewMock(), torrent)
+	d.stats = stats
+
+	p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false), newAddrMessages("10.1.0.9"))
+	require.NoError(err)
+	require.NoError(d.dispatch(p, conn.NewPieceRequestMessage(0, 1)))
+	waitForServes(t, p)
+
+	snapshot := stats.Snapshot()
+	require.Equal(int64(1), snapshot.Counters()["uploaded_piece_bytes+"].Value())
+	require.Contains(snapshot.Histograms(), "piece_serve_latency+")
+	require.Empty(p.stats().Interface)
+	require.Equal("10.1.0.9:16001", p.stats().LocalAddr)
+}
+
+func TestDispatcherPrefersPeersOnPreferredNetworkInterfaces(t *testing.T) {
+	for _, disableLatency := range []bool{false, true} {
+		t.Run(fmt.Sprintf("disable_latency_preference=%t", disableLatency), func(t *testing.T) {
+			require := require.New(t)
+
+			clk := clock.NewMock()
+			torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(1, 1).MetaInfo)
+			defer cleanup()
+
+			d := testDispatcher(Config{
+				NetworkInterfaces:        testNetworkInterfaces,
+				PipelineLimit:            1,
+				DisableEndgame:           true,
+				DisableLatencyPreference: disableLatency,
+				DisableKeepalive:         true,
+			}, clk, torrent)
+
+			add := func(ip string, rtt time.Duration) *peer {
+				p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true), newAddrMessages(ip))
+				require.NoError(err)
+				if rtt > 0 {
+					setPieceRTT(clk, p, rtt)
+				}
+				return p
+			}
+			wanFast := add("192.0.2.1", 10*time.Millisecond)
+			wanSlow := add("192.0.2.2", 30*time.Millisecond)
+			storageSlow := add("10.1.0.1", 50*time.Millisecond)
+			storageNew := add("10.1.0.2", 0)
+
+			// Storage peers come first, regardless of their latency.
+			order := d.peersByLatency()
+			if disableLatency {
+				require.ElementsMatch([]*peer{storageSlow, storageNew}, order[:2])
+				require.ElementsMatch([]*peer{wanFast, wanSlow}, order[2:])
+			} else {
+				require.Equal([]*peer{storageSlow, storageNew, wanFast, wanSlow}, order)
+			}
+
+			// The only piece is requested from a storage peer.
+			d.requestMorePiecesFromAll()
+			var requested []*peer
+			for _, p := range order {
+				if len(requestedPieces(p.messages)) > 0 {
+					requested = append(requested, p)
+				}
+			}
+			require.Len(requested, 1)
+			require.Equal("storage", requested[0].iface.name)
+		})
+	}
+}
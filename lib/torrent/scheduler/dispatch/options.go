@@ -0,0 +1,61 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import "context"
+
+type options struct {
+	listeners []Events
+	locality  string
+	ctx       context.Context
+}
+
+// Option allows setting optional Dispatcher parameters.
+type Option func(*options)
+
+// WithEventListeners registers additional consumers of Dispatcher events.
+// Unlike the primary Events passed to New, which receives every event,
+// listeners are best effort: a listener which takes longer than
+// Config.EventListenerTimeout to consume an event, or falls
+// Config.EventListenerQueueSize events behind, is dropped. Panics of listeners
+// are recovered.
+func WithEventListeners(listeners ...Events) Option {
+	return func(o *options) { o.listeners = append(o.listeners, listeners...) }
+}
+
+// withContext ties the Dispatcher to ctx, see NewWithContext.
+func withContext(ctx context.Context) Option {
+	return func(o *options) { o.ctx = ctx }
+}
+
+// WithLocality labels the locality of the Dispatcher, e.g. the zone it runs
+// within. Peers sharing the locality, see WithPeerLocality, are preferred for
+// piece requests and upload slots, see Config.LocalityWeight.
+func WithLocality(label string) Option {
+	return func(o *options) { o.locality = label }
+}
+
+type peerOptions struct {
+	locality string
+}
+
+// PeerOption allows setting optional parameters of peers added to a Dispatcher.
+type PeerOption func(*peerOptions)
+
+// WithPeerLocality labels the locality of a peer, e.g. the zone which the
+// tracker reported for the peer. Peers without a label never share the
+// locality of the Dispatcher.
+func WithPeerLocality(label string) PeerOption {
+	return func(o *peerOptions) { o.locality = label }
+}
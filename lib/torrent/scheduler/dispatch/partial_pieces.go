@@ -0,0 +1,123 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"sync"
+
+	"github.com/uber/kraken/lib/torrent/storage"
+)
+
+// partialPieces tracks the number of bytes received for in-flight pieces, i.e.
+// pieces whose payloads are still being written. Only in-flight pieces are
+// tracked, so memory is bounded by the number of concurrent piece writes.
+type partialPieces struct {
+	threshold int64
+	onChange  func()
+
+	mu         sync.Mutex
+	received   map[int]int64
+	unreported int64 // Bytes received since onChange was last called.
+}
+
+// newPartialPieces creates a new partialPieces which calls onChange once at
+// least threshold bytes were received since the last call, and whenever
+// received bytes are dropped. Coalescing changes keeps onChange off the path
+// of every payload read.
+func newPartialPieces(threshold int64, onChange func()) *partialPieces {
+	if threshold < 1 {
+		threshold = 1
+	}
+	return &partialPieces{
+		threshold: threshold,
+		onChange:  onChange,
+		received:  make(map[int]int64),
+	}
+}
+
+// track returns a PieceReader which records bytes read from pr as received
+// bytes of piece i. The returned reader must be released once the piece is
+// written, abandoned or failed verification.
+func (pp *partialPieces) track(i int, pr storage.PieceReader) *partialPieceReader {
+	return &partialPieceReader{PieceReader: pr, pieces: pp, piece: i}
+}
+
+func (pp *partialPieces) add(i int, n int64) {
+	pp.mu.Lock()
+	pp.received[i] += n
+	pp.unreported += n
+	changed := pp.unreported >= pp.threshold
+	if changed {
+		pp.unreported = 0
+	}
+	pp.mu.Unlock()
+
+	if changed {
+		pp.onChange()
+	}
+}
+
+func (pp *partialPieces) remove(i int, n int64) {
+	if n == 0 {
+		return
+	}
+	pp.mu.Lock()
+	pp.received[i] -= n
+	if pp.received[i] <= 0 {
+		delete(pp.received, i)
+	}
+	pp.unreported = 0
+	pp.mu.Unlock()
+
+	pp.onChange()
+}
+
+// total returns the sum of received bytes of all in-flight pieces, excluding
+// pieces for which skip returns true.
+func (pp *partialPieces) total(skip func(i int) bool) int64 {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	var n int64
+	for i, b := range pp.received {
+		if !skip(i) {
+			n += b
+		}
+	}
+	return n
+}
+
+type partialPieceReader struct {
+	storage.PieceReader
+	pieces *partialPieces
+	piece  int
+	n      int64
+}
+
+func (r *partialPieceReader) Read(p []byte) (int, error) {
+	n, err := r.PieceReader.Read(p)
+	if n > 0 {
+		r.n += int64(n)
+		r.pieces.add(r.piece, int64(n))
+	}
+	return n, err
+}
+
+// release drops the bytes read by r from the received bytes of its piece.
+// Concurrent readers of the same piece are unaffected.
+func (r *partialPieceReader) release() {
+	if r.n > 0 {
+		r.pieces.remove(r.piece, r.n)
+		r.n = 0
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"testing"
+
+	"github.com/uber/kraken/lib/torrent/storage/piecereader"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPartialPiecesCoalescesChanges(t *testing.T) {
+	require := require.New(t)
+
+	var changes int
+	pp := newPartialPieces(10, func() { changes++ })
+
+	pp.add(0, 4)
+	pp.add(1, 4)
+	require.Equal(0, changes)
+	require.Equal(int64(8), pp.total(func(int) bool { return false }))
+
+	pp.add(0, 4)
+	require.Equal(1, changes)
+
+	// Counting restarts after each change.
+	pp.add(1, 9)
+	require.Equal(1, changes)
+	pp.add(1, 1)
+	require.Equal(2, changes)
+
+	// Dropped bytes are always reported.
+	pp.remove(0, 8)
+	require.Equal(3, changes)
+	require.Equal(int64(14), pp.total(func(int) bool { return false }))
+	require.Equal(int64(0), pp.total(func(i int) bool { return i == 1 }))
+}
+
+func TestPartialPieceReaderReportsOncePerThreshold(t *testing.T) {
+	require := require.New(t)
+
+	var changes int
+	pp := newPartialPieces(16, func() { changes++ })
+
+	r := pp.track(0, piecereader.NewBuffer(make([]byte, 64)))
+	buf := make([]byte, 1)
+	for {
+		if _, err := r.Read(buf); err != nil {
+			break
+		}
+	}
+	require.Equal(4, changes)
+
+	r.release()
+	require.Equal(5, changes)
+	require.Equal(int64(0), pp.total(func(int) bool { return false }))
+}
@@ -0,0 +1,85 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"errors"
+	"time"
+)
+
+var errPaused = errors.New("piece request rejected while paused")
+
+// Pause stops d from requesting pieces, e.g. during a maintenance window, while
+// keeping its peers and progress. Piece requests pending with peers are
+// cancelled and forgotten, such that they do not expire into failures of the
+// peers, though payloads already in flight are still written. If
+// Config.RejectPieceRequestsWhilePaused is set, piece requests of peers are
+// rejected with a retryable error as well. Connections and keepalives are kept
+// alive, and idle peers are not evicted. No-op if d is paused already.
+func (d *Dispatcher) Pause() {
+	if !d.paused.CAS(false, true) {
+		return
+	}
+	d.log().Info("Pausing dispatcher")
+	d.stats.Counter("pauses").Inc(1)
+	if !d.SeedOnly() {
+		// Wait for selection passes which began before d was paused, such that
+		// no request is reserved once the requests are cleared.
+		d.peers.Range(func(k, v interface{}) bool {
+			p := v.(*peer)
+			p.requestMu.Lock()
+			p.requestMu.Unlock()
+			return true
+		})
+		cleared := d.pieceRequestManager.ClearRequests()
+		for _, r := range cleared {
+			d.cancelPieceRequest(r.PeerID, r.Piece)
+		}
+		d.stats.Counter("paused_piece_requests").Inc(int64(len(cleared)))
+		d.updateOutstandingRequests()
+	}
+	d.status.notify(StateChanged)
+}
+
+// Resume resumes requesting pieces from all peers after Pause. No-op unless d
+// is paused.
+func (d *Dispatcher) Resume() {
+	if !d.paused.CAS(true, false) {
+		return
+	}
+	d.log().Info("Resuming dispatcher")
+	d.stats.Counter("resumes").Inc(1)
+	now := d.clk.Now()
+	d.resumedAt.Store(now.UnixNano())
+	if d.stall != nil {
+		// Time spent paused does not count towards a stall.
+		d.stall.restart(d.torrent.Bitfield().Count(), now)
+	}
+	d.status.notify(StateChanged)
+	d.requestMorePiecesFromAll()
+}
+
+// Paused returns whether d is paused, see Pause.
+func (d *Dispatcher) Paused() bool {
+	return d.paused.Load()
+}
+
+// lastResumed returns when d was last resumed, or zero if d was never paused.
+func (d *Dispatcher) lastResumed() time.Time {
+	n := d.resumedAt.Load()
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
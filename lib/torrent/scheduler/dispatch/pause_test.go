@@ -0,0 +1,172 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"testing"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/gen/go/proto/p2p"
+	"github.com/uber/kraken/lib/torrent/scheduler/conn"
+	"github.com/uber/kraken/lib/torrent/storage/agentstorage"
+	"github.com/uber/kraken/lib/torrent/storage/piecereader"
+	"github.com/uber/kraken/utils/bitsetutil"
+)
+
+func TestDispatcherPauseStopsPieceRequestsUntilResume(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(4, 1)
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	clk := clock.NewMock()
+	stats := tally.NewTestScope("", nil)
+	config := keepaliveConfig()
+	config.PipelineLimit = 2
+	d := testDispatcher(config, clk, torrent)
+	d.stats = stats
+
+	p, err := d.addPeer(
+		core.PeerIDFixture(), bitsetutil.FromBools(true, true, true, true), newMockMessages())
+	require.NoError(err)
+
+	_, err = d.maybeRequestMorePieces(p)
+	require.NoError(err)
+	requested := requestedPieces(p.messages)
+	require.Len(requested, 2)
+
+	d.Pause()
+	d.Pause()
+	require.True(d.Paused())
+	require.True(d.Progress().Paused)
+	require.True(d.Snapshot().Paused)
+
+	// Pending requests are cancelled and forgotten.
+	require.ElementsMatch(requested, cancelledPieces(p.messages))
+	require.Empty(d.pieceRequestManager.PendingPiecesByPeer())
+
+	// Payloads already in flight are written, but request nothing more.
+	i := requested[0]
+	require.NoError(d.dispatch(p, conn.NewPiecePayloadMessage(i, piecereader.NewBuffer(blob.Content[i:i+1]))))
+	require.True(torrent.HasPiece(i))
+	sent, err := d.maybeRequestMorePieces(p)
+	require.NoError(err)
+	require.False(sent)
+	d.requestMorePiecesFromAll()
+	require.Len(requestedPieces(p.messages), 2)
+
+	// Cleared requests do not expire into failures, and connections are kept
+	// alive.
+	clk.Add(time.Hour)
+	d.resendFailedPieceRequests()
+	require.Len(requestedPieces(p.messages), 2)
+	require.NotContains(stats.Snapshot().Counters(), "piece_request_failures+")
+	d.checkKeepalive(p)
+	require.Equal(1, numSent(p.messages, p2p.Message_KEEPALIVE))
+	require.False(closed(p.messages))
+	require.Equal(1, d.NumPeers())
+
+	d.Resume()
+	require.False(d.Paused())
+	require.False(d.Progress().Paused)
+	resumed := requestedPieces(p.messages)[2:]
+	require.Len(resumed, 2)
+	require.NotContains(resumed, i)
+
+	counters := stats.Snapshot().Counters()
+	require.Equal(int64(1), counters["pauses+"].Value())
+	require.Equal(int64(1), counters["resumes+"].Value())
+	require.Equal(int64(2), counters["paused_piece_requests+"].Value())
+}
+
+func TestDispatcherRejectsPieceRequestsWhilePaused(t *testing.T) {
+	for _, reject := range []bool{false, true} {
+		t.Run(map[bool]string{false: "serve", true: "reject"}[reject], func(t *testing.T) {
+			require := require.New(t)
+
+			blob := core.SizedBlobFixture(2, 1)
+			torrent, cleanup := completeTorrentFixture(t, blob)
+			defer cleanup()
+
+			stats := tally.NewTestScope("", nil)
+			d := testDispatcher(Config{
+				RejectPieceRequestsWhilePaused: reject,
+				DisableKeepalive:               true,
+			}, clock.NewMock(), torrent)
+			d.stats = stats
+
+			p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false, false), newMockMessages())
+			require.NoError(err)
+
+			d.Pause()
+			require.NoError(d.dispatch(p, conn.NewPieceRequestMessage(0, 1)))
+			if reject {
+				msgs := p.messages.(*mockMessages).getSent()
+				require.Len(msgs, 1)
+				require.Equal(p2p.Message_ERROR, msgs[0].Message.Type)
+				require.Equal(p2p.ErrorMessage_PIECE_REQUEST_RETRY, msgs[0].Message.Error.Code)
+				require.Equal(int64(1), stats.Snapshot().Counters()["rejected_paused_piece_requests+"].Value())
+			} else {
+				waitForServes(t, p)
+				require.Equal([]int{0}, servedPieces(p.messages))
+			}
+
+			d.Resume()
+			require.NoError(d.dispatch(p, conn.NewPieceRequestMessage(1, 1)))
+			waitForServes(t, p)
+			require.Contains(servedPieces(p.messages), 1)
+		})
+	}
+}
+
+func TestDispatcherKeepsIdlePeersWhilePaused(t *testing.T) {
+	require := require.New(t)
+
+	torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(2, 1).MetaInfo)
+	defer cleanup()
+
+	clk := clock.NewMock()
+	d := testDispatcher(Config{
+		PeerIdleTimeout:  time.Minute,
+		DisableEndgame:   true,
+		DisableKeepalive: true,
+	}, clk, torrent)
+
+	p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, false), newMockMessages())
+	require.NoError(err)
+	_, err = d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, true), newMockMessages())
+	require.NoError(err)
+
+	d.Pause()
+	clk.Add(time.Hour)
+	d.evictIdlePeers()
+	require.Equal(2, d.NumPeers())
+
+	// Time spent paused does not count as idle.
+	d.Resume()
+	clk.Add(30 * time.Second)
+	d.evictIdlePeers()
+	require.Equal(2, d.NumPeers())
+
+	clk.Add(30 * time.Second)
+	d.evictIdlePeers()
+	require.Equal(1, d.NumPeers())
+	require.True(closed(p.messages))
+}
@@ -0,0 +1,97 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/uber/kraken/gen/go/proto/p2p"
+	"github.com/uber/kraken/lib/torrent/scheduler/conn"
+	"github.com/uber/kraken/lib/torrent/scheduler/wire"
+	"github.com/uber/kraken/lib/torrent/storage"
+)
+
+// newPayloadMessage returns the message serving the chunk of piece i at offset
+// to p. The payload is compressed with the codec negotiated with p, unless
+// Config.DisablePayloadCompression is set.
+func (d *Dispatcher) newPayloadMessage(
+	p *peer, i int, offset int64, payload storage.PieceReader) (*conn.Message, error) {
+
+	_, compress := wire.NegotiatedCodec(p.messages)
+	compress = compress && !d.config.DisablePayloadCompression
+	msg, err := wire.NewPiecePayloadMessage(p.messages, i, offset, payload, compress)
+	if err != nil {
+		return nil, err
+	}
+	if !compress {
+		return msg, nil
+	}
+	pm, ok := wire.PiecePayload(msg.Message)
+	if !ok {
+		return msg, nil
+	}
+	codec, saved, ok := wire.Compression(p.messages, pm)
+	if !ok {
+		d.stats.Counter("incompressible_payloads").Inc(1)
+		return msg, nil
+	}
+	d.stats.Tagged(map[string]string{
+		"codec": strings.ToLower(codec.String()),
+	}).Counter("compressed_payloads").Inc(1)
+	d.stats.Counter("compression_saved_bytes").Inc(saved)
+	if c, ok := conn.CodecCapability(codec); ok {
+		d.useCapability(c)
+	}
+	return msg, nil
+}
+
+// decompressPayload returns the uncompressed payload of msg received from p.
+// Returns an ErrorValidation error if the payload is invalid, in which case it
+// counts as an invalid piece of p.
+func (d *Dispatcher) decompressPayload(
+	p *peer, msg *p2p.PiecePayloadMessage, payload storage.PieceReader) (storage.PieceReader, error) {
+
+	codec, ok := wire.Codec(p.messages, msg)
+	if codec == p2p.PiecePayloadMessage_NONE {
+		return payload, nil
+	}
+	i := int(msg.Index)
+	if !ok {
+		payload.Close()
+		d.markPieceRequestInvalid(p.id, i)
+		d.invalidPieceReceived(p)
+		return nil, validationError(fmt.Errorf(
+			"piece payload of piece %d compressed with %s, which was not negotiated", i, codec))
+	}
+	// Validated before decompressing, since the length determines how much is
+	// allocated.
+	offset, length, ok := wire.Chunk(msg)
+	if !ok || !d.validRange(i, offset, length) {
+		payload.Close()
+		d.markPieceRequestInvalid(p.id, i)
+		d.invalidPieceReceived(p)
+		return nil, validationError(fmt.Errorf(
+			"compressed piece payload: invalid range piece=%d offset=%d length=%d",
+			i, offset, length))
+	}
+	pr, err := conn.DecompressPiecePayload(msg, payload)
+	if err != nil {
+		d.stats.Counter("payload_decompression_failures").Inc(1)
+		d.markPieceRequestInvalid(p.id, i)
+		d.invalidPieceReceived(p)
+		return nil, validationError(fmt.Errorf("decompress payload of piece %d: %s", i, err))
+	}
+	return pr, nil
+}
@@ -0,0 +1,184 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/gen/go/proto/p2p"
+	"github.com/uber/kraken/lib/torrent/scheduler/conn"
+	"github.com/uber/kraken/lib/torrent/storage/agentstorage"
+	"github.com/uber/kraken/lib/torrent/storage/piecereader"
+	"github.com/uber/kraken/utils/bitsetutil"
+)
+
+// compressibleBlobFixture returns a single piece blob which compresses well.
+func compressibleBlobFixture(size int) *core.BlobFixture {
+	b := bytes.Repeat([]byte("kraken "), size/7+1)[:size]
+	d, err := core.NewDigester().FromBytes(b)
+	if err != nil {
+		panic(err)
+	}
+	mi, err := core.NewMetaInfo(d, bytes.NewReader(b), int64(size))
+	if err != nil {
+		panic(err)
+	}
+	return core.CustomBlobFixture(b, d, mi)
+}
+
+func TestDispatcherServesCompressedPayloads(t *testing.T) {
+	tests := []struct {
+		desc     string
+		config   Config
+		messages *mockMessages
+		expected p2p.PiecePayloadMessage_Codec
+	}{
+		{"negotiated", Config{}, newMockMessages(), p2p.PiecePayloadMessage_LZ4},
+		{"fallback", Config{}, newLegacyMockMessages(conn.CompressLZ4), p2p.PiecePayloadMessage_SNAPPY},
+		{"legacy peer", Config{},
+			newLegacyMockMessages(conn.CompressLZ4, conn.CompressSnappy), p2p.PiecePayloadMessage_NONE},
+		{"disabled", Config{DisablePayloadCompression: true}, newMockMessages(), p2p.PiecePayloadMessage_NONE},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+
+			blob := compressibleBlobFixture(4096)
+
+			torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+			defer cleanup()
+
+			require.NoError(torrent.WritePiece(piecereader.NewBuffer(blob.Content), 0))
+
+			d := testDispatcher(test.config, clock.NewMock(), torrent)
+
+			p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false), test.messages)
+			require.NoError(err)
+
+			require.NoError(d.dispatch(p, conn.NewPieceRequestMessage(0, 4096)))
+			waitForServes(t, p)
+
+			sent := test.messages.getSent()
+			require.Len(sent, 1)
+			payload := sent[0].Message.PiecePayload
+			require.Equal(test.expected, payload.Codec)
+			require.Equal(int32(4096), payload.Length)
+
+			pr, err := conn.DecompressPiecePayload(payload, sent[0].Payload)
+			require.NoError(err)
+			b, err := ioutil.ReadAll(pr)
+			require.NoError(err)
+			require.Equal(blob.Content, b)
+
+			// The piece counts as served regardless of compression.
+			require.Equal(1, p.pstats.getPiecesSent())
+		})
+	}
+}
+
+func TestDispatcherServesIncompressiblePayloadsUncompressed(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(4096, 4096)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	require.NoError(torrent.WritePiece(piecereader.NewBuffer(blob.Content), 0))
+
+	stats := tally.NewTestScope("", nil)
+	d := testDispatcher(Config{}, clock.NewMock(), torrent)
+	d.stats = stats
+
+	p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false), newMockMessages())
+	require.NoError(err)
+
+	require.NoError(d.dispatch(p, conn.NewPieceRequestMessage(0, 4096)))
+	waitForServes(t, p)
+
+	sent := p.messages.(*mockMessages).getSent()
+	require.Len(sent, 1)
+	require.Equal(p2p.PiecePayloadMessage_NONE, sent[0].Message.PiecePayload.Codec)
+	require.Equal(int64(1), stats.Snapshot().Counters()["incompressible_payloads+"].Value())
+}
+
+func compressedPayloadMessage(
+	t *testing.T, i int, b []byte, codec p2p.PiecePayloadMessage_Codec) *conn.Message {
+
+	msg, err := conn.NewCompressedPieceChunkPayloadMessage(i, 0, piecereader.NewBuffer(b), codec)
+	require.NoError(t, err)
+	require.Equal(t, codec, msg.Message.PiecePayload.Codec)
+	return msg
+}
+
+func TestDispatcherWritesCompressedPayloads(t *testing.T) {
+	require := require.New(t)
+
+	blob := compressibleBlobFixture(4096)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(Config{}, clock.NewMock(), torrent)
+
+	p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true), newMockMessages())
+	require.NoError(err)
+
+	require.NoError(d.dispatch(
+		p, compressedPayloadMessage(t, 0, blob.Content, p2p.PiecePayloadMessage_SNAPPY)))
+
+	require.True(d.Complete())
+	require.Equal(int64(4096), d.Progress().BytesDownloaded)
+	pr, err := torrent.GetPieceReader(0)
+	require.NoError(err)
+	defer pr.Close()
+	b, err := ioutil.ReadAll(pr)
+	require.NoError(err)
+	require.Equal(blob.Content, b)
+}
+
+func TestDispatcherCorruptCompressedPayloadIsInvalidPiece(t *testing.T) {
+	require := require.New(t)
+
+	blob := compressibleBlobFixture(4096)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	stats := tally.NewTestScope("", nil)
+	d := testDispatcher(Config{}, clock.NewMock(), torrent)
+	d.stats = stats
+
+	p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true), newMockMessages())
+	require.NoError(err)
+
+	msg := compressedPayloadMessage(t, 0, blob.Content, p2p.PiecePayloadMessage_LZ4)
+	encoded, err := ioutil.ReadAll(msg.Payload)
+	require.NoError(err)
+	msg.Payload = piecereader.NewBuffer(encoded[:len(encoded)-1])
+
+	require.Equal(ErrorValidation, Category(d.dispatch(p, msg)))
+
+	require.False(d.Complete())
+	require.Equal(1, p.stats().InvalidPiecesReceived)
+	require.Equal(
+		int64(1), stats.Snapshot().Counters()["payload_decompression_failures+"].Value())
+}
@@ -14,12 +14,17 @@
 package dispatch
 
 import (
+	"net"
 	"sync"
 	"time"
 
 	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/torrent/scheduler/conn"
 	"github.com/andres-erbsen/clock"
 	"github.com/willf/bitset"
+	"go.uber.org/atomic"
+	"go.uber.org/zap/zapcore"
+	"golang.org/x/time/rate"
 )
 
 // peer consolidates bookeeping for a remote peer.
@@ -31,14 +36,124 @@ type peer struct {
 
 	messages Messages
 
+	// Queues the messages sent to the peer in front of messages. Nil if
+	// Config.SendQueueSize is unset. Set before the peer is added.
+	sendQueue *sendQueue
+
+	// Known capabilities negotiated with the peer, sorted by name, and the
+	// number of capabilities the peer listed which we do not implement.
+	capabilities        []conn.Capability
+	unknownCapabilities int
+
 	clk clock.Clock
 
 	// May be accessed outside of the peer struct.
 	pstats *peerStats
 
+	// Piece requests received from the peer which have not been served yet.
+	serves *serveQueue
+
+	// Orders piece request reservations and bitfield updates for the peer before
+	// its removal, such that no request can be reserved for the peer and no
+	// piece can be counted for the peer once it was removed.
+	requestMu sync.Mutex
+	removed   bool
+
+	// Pieces the peer has which we do not. Guarded by requestMu. Nil if not
+	// cached, see Dispatcher.cacheUsefulPieces.
+	useful *bitset.BitSet
+
+	// Whether the peer was counted as a seeder. Set under requestMu, see
+	// Dispatcher.markPeerCompletedLocked.
+	completed *atomic.Bool
+
+	// Whether the peer was sent our completion, whether closing the connection
+	// to the peer was scheduled because both sides completed, and whether it
+	// was closed. See Dispatcher.notifyPeerComplete.
+	notifiedComplete       *atomic.Bool
+	completeCloseScheduled *atomic.Bool
+	closedComplete         *atomic.Bool
+
 	mu                    sync.Mutex // Protects the following fields:
 	lastGoodPieceReceived time.Time
 	lastPieceSent         time.Time
+
+	// When the peer was added, and when a piece was first transferred to or
+	// from the peer. Zero if no piece was transferred yet.
+	addedAt       time.Time
+	firstUsefulAt time.Time
+
+	// Number of requests to the peer which expired since we last received a
+	// good piece from the peer.
+	consecutiveExpiredRequests int
+
+	// Whether we can send pieces to the peer but never receive pieces from it,
+	// and since when.
+	asymmetric      bool
+	asymmetricSince time.Time
+
+	// Last time the peer held an upload slot, and since when it holds its
+	// current slot. Zero if the peer never held one.
+	unchokedAt    time.Time
+	unchokedSince time.Time
+
+	// Whether the peer notified us that it does not serve our piece requests.
+	// Guarded by requestMu.
+	chokedByRemote bool
+
+	// When pieces were last requested from the peer, for pieces which we are
+	// still waiting for.
+	pieceRequestsSentAt map[int]time.Time
+	pieceRTT            *rttEstimator
+
+	// Number of payloads the peer sent for pieces which we requested from other
+	// peers, see crossedPayload. Once set, the peer is unreliable for request
+	// attribution and excluded from latency estimates.
+	crossedPayloads int
+
+	// How long serves to the peer take, from reading the piece until it was
+	// handed to the connection.
+	serveTime *rttEstimator
+
+	// Limits the error messages sent to the peer. Nil if unlimited, see
+	// Config.MaxErrorMessages. Set before the peer is added.
+	errorMessages *rate.Limiter
+
+	// Local address which the connection of the peer arrived on, nil if
+	// unknown, and the network interface it belongs to, unnamed unless
+	// Config.NetworkInterfaces are set. Set before the peer is added.
+	localAddr net.Addr
+	iface     peerInterface
+
+	// Locality label of the peer, empty if unknown, and whether it equals the
+	// locality of the Dispatcher, see WithPeerLocality. Set before the peer is
+	// added.
+	locality string
+	local    bool
+
+	// Number of serves to the peer which failed since the last successful one.
+	consecutiveServeFailures int
+
+	// When pieces which the peer rejected with a retry hint may be requested
+	// from the peer again, and whether a retry is scheduled for then.
+	retryAt        time.Time
+	retryScheduled bool
+
+	bytesUploaded         int64
+	bytesDownloaded       int64
+	invalidPiecesReceived int
+	protocolViolations    int
+	headOfLineBlocks      int
+	downloadRate          *rateEstimator
+	exchange              *exchangeWindow
+
+	// When the peer sent us invalid pieces, within the ban window.
+	invalidPieceTimes []time.Time
+
+	// When we last received any message from the peer, and how many keepalives
+	// were sent to the peer since.
+	lastMessageReceived  time.Time
+	unansweredKeepalives int
 }
 
 func newPeer(
@@ -46,14 +161,32 @@ func newPeer(
 	b *bitset.BitSet,
 	messages Messages,
 	clk clock.Clock,
-	pstats *peerStats) *peer {
+	pstats *peerStats,
+	rateWindow time.Duration,
+	exchangeWindow time.Duration,
+	rttWeight float64) *peer {
 
+	capabilities, unknownCapabilities := negotiatedCapabilities(messages)
 	return &peer{
-		id:       peerID,
-		bitfield: newSyncBitfield(b),
-		messages: messages,
-		clk:      clk,
-		pstats:   pstats,
+		id:                     peerID,
+		bitfield:               newSyncBitfield(b),
+		messages:               messages,
+		capabilities:           capabilities,
+		unknownCapabilities:    unknownCapabilities,
+		clk:                    clk,
+		pstats:                 pstats,
+		completed:              atomic.NewBool(false),
+		notifiedComplete:       atomic.NewBool(false),
+		closedComplete:         atomic.NewBool(false),
+		completeCloseScheduled: atomic.NewBool(false),
+		serves:                 newServeQueue(),
+		pieceRequestsSentAt:    make(map[int]time.Time),
+		pieceRTT:               newRTTEstimator(rttWeight),
+		serveTime:              newRTTEstimator(rttWeight),
+		downloadRate:           newRateEstimator(rateWindow, clk.Now()),
+		exchange:               newExchangeWindow(exchangeWindow, clk.Now()),
+		lastMessageReceived:    clk.Now(),
+		addedAt:                clk.Now(),
 	}
 }
 
@@ -61,6 +194,12 @@ func (p *peer) String() string {
 	return p.id.String()
 }
 
+// MarshalLogObject encodes p as log field without formatting its String.
+func (p *peer) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddString("id", p.id.String())
+	return nil
+}
+
 func (p *peer) getLastGoodPieceReceived() time.Time {
 	p.mu.Lock()
 	defer p.mu.Unlock()
@@ -73,6 +212,8 @@ func (p *peer) touchLastGoodPieceReceived() {
 	defer p.mu.Unlock()
 
 	p.lastGoodPieceReceived = p.clk.Now()
+	p.consecutiveExpiredRequests = 0
+	p.touchUsefulLocked(p.lastGoodPieceReceived)
 }
 
 func (p *peer) getLastPieceSent() time.Time {
@@ -87,19 +228,410 @@ func (p *peer) touchLastPieceSent() {
 	defer p.mu.Unlock()
 
 	p.lastPieceSent = p.clk.Now()
+	p.touchUsefulLocked(p.lastPieceSent)
+}
+
+func (p *peer) touchUsefulLocked(now time.Time) {
+	if p.firstUsefulAt.IsZero() {
+		p.firstUsefulAt = now
+	}
+}
+
+// lifetime summarizes the connection to p, which is removed for reason. p is
+// considered active if a piece was transferred to or from p within
+// activityWindow.
+func (p *peer) lifetime(reason PeerRemovalReason, activityWindow time.Duration) peerLifetime {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.clk.Now()
+	l := peerLifetime{
+		reason:    reason,
+		connected: now.Sub(p.addedAt),
+		useful:    !p.firstUsefulAt.IsZero(),
+	}
+	if l.useful {
+		l.timeToUseful = p.firstUsefulAt.Sub(p.addedAt)
+		l.active = now.Sub(p.lastTransferLocked()) < activityWindow
+	}
+	return l
+}
+
+// lastTransfer returns when a piece was last transferred to or from p. Zero if
+// no piece was transferred yet.
+func (p *peer) lastTransfer() time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.lastTransferLocked()
+}
+
+func (p *peer) lastTransferLocked() time.Time {
+	last := p.lastGoodPieceReceived
+	if p.lastPieceSent.After(last) {
+		last = p.lastPieceSent
+	}
+	return last
+}
+
+// allowErrorMessage returns true if the peer may be sent an error message now.
+func (p *peer) allowErrorMessage() bool {
+	return p.errorMessages == nil || p.errorMessages.AllowN(p.clk.Now(), 1)
+}
+
+// recordServeFailure records a failed serve, returning the number of
+// consecutive failed serves since the last successful one.
+func (p *peer) recordServeFailure() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.consecutiveServeFailures++
+	return p.consecutiveServeFailures
+}
+
+func (p *peer) recordServeSuccess() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.consecutiveServeFailures = 0
+}
+
+// recordExpiredRequest records an expired request, returning the number of
+// consecutive expired requests since the last good piece.
+func (p *peer) recordExpiredRequest() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.consecutiveExpiredRequests++
+	return p.consecutiveExpiredRequests
+}
+
+func (p *peer) isAsymmetric() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.asymmetric
+}
+
+// setAsymmetric sets whether p is asymmetric, returning true if this changed.
+func (p *peer) setAsymmetric(v bool) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	changed := p.asymmetric != v
+	p.asymmetric = v
+	if changed && v {
+		p.asymmetricSince = p.clk.Now()
+	}
+	return changed
+}
+
+// getAsymmetricSince returns since when p is asymmetric. Returns false if p is
+// not asymmetric.
+func (p *peer) getAsymmetricSince() (time.Time, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.asymmetricSince, p.asymmetric
+}
+
+func (p *peer) getUnchokedAt() (at time.Time, since time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.unchokedAt, p.unchokedSince
+}
+
+// touchUnchokedAt records that p holds an upload slot, which p was newly
+// assigned if newly is set.
+func (p *peer) touchUnchokedAt(newly bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.unchokedAt = p.clk.Now()
+	if newly {
+		p.unchokedSince = p.unchokedAt
+	}
+}
+
+func (p *peer) touchPieceRequestSent(i int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.pieceRequestsSentAt[i] = p.clk.Now()
+}
+
+// samplePieceRTT samples the time since piece i was requested, if it is still
+// awaited. Called once the first payload of i arrives, or with a lower bound of
+// the round-trip time once the request expired. Returns the sample, or false if
+// i was not awaited or p is unreliable for request attribution, in which case
+// its payloads may answer requests sent to other peers.
+func (p *peer) samplePieceRTT(i int) (time.Duration, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	sentAt, ok := p.pieceRequestsSentAt[i]
+	if !ok {
+		return 0, false
+	}
+	delete(p.pieceRequestsSentAt, i)
+	if p.crossedPayloads > 0 {
+		return 0, false
+	}
+	rtt := p.clk.Now().Sub(sentAt)
+	p.pieceRTT.add(rtt)
+	return rtt, true
+}
+
+// recordCrossedPayload records that p sent a payload for a piece which we
+// requested from another peer. Returns true if it is the first.
+func (p *peer) recordCrossedPayload() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.crossedPayloads++
+	return p.crossedPayloads == 1
+}
+
+// unreliableAttribution returns whether p sent payloads for pieces which we
+// requested from other peers, such that its latencies are not trusted.
+func (p *peer) unreliableAttribution() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.crossedPayloads > 0
+}
+
+// forgetPieceRequest stops awaiting piece i, e.g. once its request was
+// cancelled.
+func (p *peer) forgetPieceRequest(i int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.pieceRequestsSentAt, i)
+}
+
+func (p *peer) sampleServeTime(t time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.serveTime.add(t)
+}
+
+// getServeTime returns the average time a serve to the peer takes. Zero if
+// nothing was served to the peer yet.
+func (p *peer) getServeTime() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.serveTime.get()
+}
+
+// deferRetry records that rejected pieces may be requested from the peer again
+// at t. Returns true if no retry is scheduled yet, in which case the caller must
+// schedule one.
+func (p *peer) deferRetry(t time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if t.After(p.retryAt) {
+		p.retryAt = t
+	}
+	if p.retryScheduled {
+		return false
+	}
+	p.retryScheduled = true
+	return true
+}
+
+// retryDelay returns how long the scheduled retry must still wait, as retries
+// may have been deferred further since it was scheduled. Once due, the retry is
+// no longer scheduled.
+func (p *peer) retryDelay() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if now := p.clk.Now(); now.Before(p.retryAt) {
+		return p.retryAt.Sub(now)
+	}
+	p.retryScheduled = false
+	return 0
+}
+
+func (p *peer) getPieceRTT() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.pieceRTT.get()
+}
+
+func (p *peer) addBytesUploaded(n int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.bytesUploaded += n
+	p.exchange.addSent(n, p.clk.Now())
+}
+
+func (p *peer) addBytesDownloaded(n int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.bytesDownloaded += n
+	p.downloadRate.add(n, p.clk.Now())
+	p.exchange.addReceived(n, p.clk.Now())
+}
+
+func (p *peer) getBytesDownloaded() int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.bytesDownloaded
+}
+
+// completion returns the fraction of pieces p has.
+func (p *peer) completion() float64 {
+	n := p.bitfield.Len()
+	if n == 0 {
+		return 1
+	}
+	return float64(p.bitfield.Count()) / float64(n)
+}
+
+func (p *peer) getDownloadRate() float64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.downloadRate.get(p.clk.Now())
+}
+
+// getExchange returns the bytes received from and sent to p within the
+// reciprocity window.
+func (p *peer) getExchange() (received, sent int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.exchange.totals(p.clk.Now())
+}
+
+// recordInvalidPiece records an invalid piece received from p, returning the
+// number of invalid pieces received from p within window.
+func (p *peer) recordInvalidPiece(window time.Duration) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.invalidPiecesReceived++
+
+	now := p.clk.Now()
+	var recent []time.Time
+	for _, t := range p.invalidPieceTimes {
+		if now.Sub(t) < window {
+			recent = append(recent, t)
+		}
+	}
+	p.invalidPieceTimes = append(recent, now)
+	return len(p.invalidPieceTimes)
+}
+
+// recordProtocolViolation records a protocol violation by p, returning the
+// number of violations recorded so far.
+func (p *peer) recordProtocolViolation() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.protocolViolations++
+	return p.protocolViolations
+}
+
+func (p *peer) touchLastMessageReceived() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.lastMessageReceived = p.clk.Now()
+	p.unansweredKeepalives = 0
+}
+
+// nextKeepalive decides whether to send p a keepalive, given that p is expected
+// to send us a message at least every interval. Returns how long to wait before
+// deciding again, whether to send a keepalive now, and whether p is dead since
+// it left maxMissed keepalives in a row unanswered.
+func (p *peer) nextKeepalive(
+	interval time.Duration, maxMissed int) (wait time.Duration, send bool, dead bool) {
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	idle := p.clk.Now().Sub(p.lastMessageReceived)
+	if idle < interval {
+		return interval - idle, false, false
+	}
+	if p.unansweredKeepalives >= maxMissed {
+		return 0, false, true
+	}
+	p.unansweredKeepalives++
+	return interval, true, false
+}
+
+func (p *peer) incrementHeadOfLineBlocks() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.headOfLineBlocks++
+}
+
+func (p *peer) stats() PeerStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s := PeerStats{
+		PeerID:                p.id,
+		BytesUploaded:         p.bytesUploaded,
+		BytesDownloaded:       p.bytesDownloaded,
+		GoodPiecesReceived:    p.pstats.getGoodPiecesReceived(),
+		InvalidPiecesReceived: p.invalidPiecesReceived,
+		ProtocolViolations:    p.protocolViolations,
+		CrossedPayloads:       p.crossedPayloads,
+		UnreliableAttribution: p.crossedPayloads > 0,
+		DownloadRate:          p.downloadRate.get(p.clk.Now()),
+		PieceRTT:              p.pieceRTT.get(),
+		HeadOfLineBlocks:      p.headOfLineBlocks,
+		Asymmetric:            p.asymmetric,
+		UnansweredKeepalives:  p.unansweredKeepalives,
+		Capabilities:          p.capabilities,
+		UnknownCapabilities:   p.unknownCapabilities,
+		Interface:             p.iface.name,
+		Locality:              p.locality,
+		Local:                 p.local,
+	}
+	s.RecentBytesReceived, s.RecentBytesSent = p.exchange.totals(p.clk.Now())
+	if p.localAddr != nil {
+		s.LocalAddr = p.localAddr.String()
+	}
+	if p.sendQueue != nil {
+		s.SendQueueDepth = p.sendQueue.depth()
+	}
+	if w, ok := p.messages.(wireCounter); ok {
+		s.WireBytesSent = w.BytesSent()
+		s.WireEfficiency = wireEfficiency(s.BytesUploaded, s.WireBytesSent)
+	}
+	return s
 }
 
 // peerStats wraps stats collected for a given peer.
 type peerStats struct {
 	mu                    sync.Mutex
-	pieceRequestsSent       int // Pieces we requested from the peer.
-	pieceRequestsReceived   int // Pieces the peer requested from us.
-	piecesSent              int // Pieces we sent to the peer.
+	pieceRequestsSent     int // Pieces we requested from the peer.
+	pieceRequestsReceived int // Pieces the peer requested from us.
+	piecesSent            int // Pieces we sent to the peer.
 
 	// Pieces we received from the peer that we didn't already have.
 	goodPiecesReceived int
 	// Pieces we received from the peer that we already had.
 	duplicatePiecesReceived int
+
+	// Piece payload bytes sent to and received from the peer.
+	bytesUploaded   int64
+	bytesDownloaded int64
 }
 
 func (s *peerStats) getPieceRequestsSent() int {
@@ -171,3 +703,17 @@ func (s *peerStats) incrementDuplicatePiecesReceived() {
 
 	s.duplicatePiecesReceived++
 }
+
+func (s *peerStats) addBytesUploaded(n int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.bytesUploaded += n
+}
+
+func (s *peerStats) addBytesDownloaded(n int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.bytesDownloaded += n
+}
@@ -0,0 +1,198 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/uber/kraken/core"
+)
+
+func (d *Dispatcher) watchPeerCompaction() {
+	for {
+		select {
+		case <-d.clk.After(d.config.PeerCompactionInterval):
+			d.compactPeers()
+		case <-d.tornDown:
+			return
+		}
+	}
+}
+
+// compactPeers folds the detail of peers disconnected for longer than
+// Config.PeerDetailTTL, and of the longest disconnected peers beyond
+// Config.MaxPeerDetails, into the aggregate of d.peerStats.
+func (d *Dispatcher) compactPeers() {
+	cutoff := d.clk.Now().Add(-d.config.PeerDetailTTL)
+	connected := func(peerID core.PeerID) bool {
+		_, ok := d.peers.Load(peerID)
+		return ok
+	}
+	if n := d.peerStats.compact(cutoff, d.config.MaxPeerDetails, connected); n > 0 {
+		d.stats.Counter("compacted_peer_entries").Inc(int64(n))
+	}
+}
+
+// peerStatsMap holds the peerStats of every peer added to a Dispatcher. Stats
+// persist after their peer is removed, e.g. for the summaries logged on
+// completion and teardown, until they are compacted into a single aggregate.
+//
+// It is the only per-peer state of a Dispatcher which outlives the connections
+// to peers, and hence the only state which needs compaction. The contributions
+// of peers are the totals of their peerStats. Reputation, i.e. invalid pieces
+// and protocol violations, is counted on the peer and dropped with it, and
+// banned peers are closed rather than remembered. Removals are only logged and
+// emitted as metrics. All other per-peer state, e.g. pending piece requests,
+// retry hints, prefetches and superseed reveals, is cleared by detachPeer.
+type peerStatsMap struct {
+	mu             sync.Mutex
+	stats          map[core.PeerID]*peerStats
+	disconnectedAt map[core.PeerID]time.Time
+	compacted      peerStatsTotals
+	numCompacted   int
+}
+
+func newPeerStatsMap() *peerStatsMap {
+	return &peerStatsMap{
+		stats:          make(map[core.PeerID]*peerStats),
+		disconnectedAt: make(map[core.PeerID]time.Time),
+	}
+}
+
+// connect returns the stats of peerID, which are kept from previous
+// connections of peerID unless they were compacted meanwhile.
+func (m *peerStatsMap) connect(peerID core.PeerID) *peerStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.disconnectedAt, peerID)
+	s, ok := m.stats[peerID]
+	if !ok {
+		s = &peerStats{}
+		m.stats[peerID] = s
+	}
+	return s
+}
+
+// disconnect marks the stats of peerID as compactable, as of t.
+func (m *peerStatsMap) disconnect(peerID core.PeerID, t time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.stats[peerID]; ok {
+		m.disconnectedAt[peerID] = t
+	}
+}
+
+// all returns the stats of all peers which were not compacted.
+func (m *peerStatsMap) all() map[core.PeerID]*peerStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	all := make(map[core.PeerID]*peerStats, len(m.stats))
+	for peerID, s := range m.stats {
+		all[peerID] = s
+	}
+	return all
+}
+
+// size returns the number of peers with stats, and the number of those which
+// are disconnected, i.e. pending compaction.
+func (m *peerStatsMap) size() (int, int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return len(m.stats), len(m.disconnectedAt)
+}
+
+// aggregate returns the totals of the stats of compacted peers, and the number
+// of compacted peers.
+func (m *peerStatsMap) aggregate() (peerStatsTotals, int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.compacted, m.numCompacted
+}
+
+func (m *peerStatsMap) compact(cutoff time.Time, max int, connected func(core.PeerID) bool) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	type entry struct {
+		peerID         core.PeerID
+		disconnectedAt time.Time
+	}
+	var entries []entry
+	for peerID, t := range m.disconnectedAt {
+		if connected(peerID) {
+			// Removed and added again since.
+			continue
+		}
+		entries = append(entries, entry{peerID, t})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].disconnectedAt.Before(entries[j].disconnectedAt)
+	})
+
+	var n int
+	for i, e := range entries {
+		if !e.disconnectedAt.Before(cutoff) && len(entries)-i <= max {
+			break
+		}
+		m.compacted.add(m.stats[e.peerID].totals())
+		m.numCompacted++
+		delete(m.stats, e.peerID)
+		delete(m.disconnectedAt, e.peerID)
+		n++
+	}
+	return n
+}
+
+// peerStatsTotals are the counters of one or more peerStats.
+type peerStatsTotals struct {
+	pieceRequestsSent       int
+	pieceRequestsReceived   int
+	piecesSent              int
+	goodPiecesReceived      int
+	duplicatePiecesReceived int
+	bytesUploaded           int64
+	bytesDownloaded         int64
+}
+
+func (t *peerStatsTotals) add(o peerStatsTotals) {
+	t.pieceRequestsSent += o.pieceRequestsSent
+	t.pieceRequestsReceived += o.pieceRequestsReceived
+	t.piecesSent += o.piecesSent
+	t.goodPiecesReceived += o.goodPiecesReceived
+	t.duplicatePiecesReceived += o.duplicatePiecesReceived
+	t.bytesUploaded += o.bytesUploaded
+	t.bytesDownloaded += o.bytesDownloaded
+}
+
+func (s *peerStats) totals() peerStatsTotals {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return peerStatsTotals{
+		pieceRequestsSent:       s.pieceRequestsSent,
+		pieceRequestsReceived:   s.pieceRequestsReceived,
+		piecesSent:              s.piecesSent,
+		goodPiecesReceived:      s.goodPiecesReceived,
+		duplicatePiecesReceived: s.duplicatePiecesReceived,
+		bytesUploaded:           s.bytesUploaded,
+		bytesDownloaded:         s.bytesDownloaded,
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"testing"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/torrent/storage/agentstorage"
+	"github.com/uber/kraken/utils/bitsetutil"
+)
+
+// sumPeerStats returns the totals of all stats in m, compacted or not.
+func sumPeerStats(m *peerStatsMap) peerStatsTotals {
+	totals, _ := m.aggregate()
+	for _, s := range m.all() {
+		totals.add(s.totals())
+	}
+	return totals
+}
+
+func TestPeerCompactionBoundsChurn(t *testing.T) {
+	require := require.New(t)
+
+	torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(1, 1).MetaInfo)
+	defer cleanup()
+
+	config := Config{
+		PeerCompactionInterval: 10 * time.Minute,
+		PeerDetailTTL:          time.Hour,
+		MaxPeerDetails:         100,
+	}
+	clk := clock.NewMock()
+	stats := tally.NewTestScope("", nil)
+	d := testDispatcher(config, clk, torrent)
+	d.stats = stats
+
+	// A week of churn, where 10 distinct peers come and go every 10 minutes.
+	var added int
+	var expected peerStatsTotals
+	for tick := 0; tick < 7*24*6; tick++ {
+		for i := 0; i < 10; i++ {
+			p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false), newMockMessages())
+			require.NoError(err)
+			p.pstats.incrementPieceRequestsReceived()
+			p.pstats.incrementPiecesSent()
+			expected.pieceRequestsReceived++
+			expected.piecesSent++
+			require.NoError(d.RemovePeer(p.id))
+			added++
+		}
+		clk.Add(config.PeerCompactionInterval)
+		d.compactPeers()
+
+		// peer_stats is the only per-peer state which outlives removals.
+		for name, n := range d.Dump().PeerStateSizes {
+			switch name {
+			case "peer_stats", "peer_stats_disconnected":
+				require.True(n <= config.MaxPeerDetails, "%s: %d", name, n)
+			default:
+				require.Equal(0, n, name)
+			}
+		}
+		require.Equal(expected, sumPeerStats(d.peerStats))
+	}
+	require.Equal(expected, sumPeerStats(d.peerStats))
+
+	_, compacted := d.peerStats.aggregate()
+	require.Equal(added-len(d.peerStats.all()), compacted)
+	require.Equal(compacted, d.Dump().CompactedPeers)
+	require.Equal(
+		int64(compacted),
+		stats.Snapshot().Counters()["compacted_peer_entries+"].Value())
+}
+
+func TestPeerCompactionKeepsConnectedPeers(t *testing.T) {
+	require := require.New(t)
+
+	torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(1, 1).MetaInfo)
+	defer cleanup()
+
+	config := Config{PeerDetailTTL: time.Hour, MaxPeerDetails: 100}
+	clk := clock.NewMock()
+	d := testDispatcher(config, clk, torrent)
+
+	connected, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false), newMockMessages())
+	require.NoError(err)
+
+	reconnected, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false), newMockMessages())
+	require.NoError(err)
+	reconnected.pstats.incrementPiecesSent()
+	require.NoError(d.RemovePeer(reconnected.id))
+
+	removed, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false), newMockMessages())
+	require.NoError(err)
+	require.NoError(d.RemovePeer(removed.id))
+
+	clk.Add(2 * time.Hour)
+
+	// Stats of reconnecting peers are kept across connections.
+	p, err := d.addPeer(reconnected.id, bitsetutil.FromBools(false), newMockMessages())
+	require.NoError(err)
+	require.Equal(reconnected.pstats, p.pstats)
+
+	d.compactPeers()
+
+	all := d.peerStats.all()
+	require.Len(all, 2)
+	require.Contains(all, connected.id)
+	require.Contains(all, reconnected.id)
+	require.Equal(1, all[reconnected.id].getPiecesSent())
+}
+
+func TestPeerStatsMapCompactsLongestDisconnectedBeyondMax(t *testing.T) {
+	require := require.New(t)
+
+	m := newPeerStatsMap()
+	now := time.Now()
+	notConnected := func(core.PeerID) bool { return false }
+
+	var peers []core.PeerID
+	for i := 0; i < 5; i++ {
+		peerID := core.PeerIDFixture()
+		peers = append(peers, peerID)
+		m.connect(peerID).incrementPiecesSent()
+		m.disconnect(peerID, now.Add(time.Duration(i)*time.Second))
+	}
+
+	// No peer is older than the cutoff, but only 2 peers may be kept.
+	require.Equal(3, m.compact(now.Add(-time.Hour), 2, notConnected))
+
+	all := m.all()
+	require.Len(all, 2)
+	require.Contains(all, peers[3])
+	require.Contains(all, peers[4])
+
+	compacted, n := m.aggregate()
+	require.Equal(3, n)
+	require.Equal(3, compacted.piecesSent)
+
+	// Disconnected peers younger than the cutoff and within max are kept.
+	require.Equal(0, m.compact(now.Add(-time.Hour), 2, notConnected))
+}
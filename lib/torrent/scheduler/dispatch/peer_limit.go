@@ -0,0 +1,107 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrTooManyPeers occurs when a peer cannot be added to a Dispatcher which
+// already has Config.MaxPeers peers.
+var ErrTooManyPeers = errors.New("dispatcher has too many peers")
+
+// makeRoomForPeer ensures that d has fewer than Config.MaxPeers peers, evicting
+// the worst idle peers if Config.PeerReplacementPolicy allows. Returns
+// ErrTooManyPeers if no room could be made. Must be called with peerLimitMu
+// held.
+func (d *Dispatcher) makeRoomForPeer() error {
+	if d.NumPeers() < d.config.MaxPeers {
+		// Peers are only ever added under peerLimitMu.
+		return nil
+	}
+	var peers []*peer
+	d.peers.Range(func(k, v interface{}) bool {
+		peers = append(peers, v.(*peer))
+		return true
+	})
+	if d.config.PeerReplacementPolicy == EvictWorstPeer {
+		for len(peers) >= d.config.MaxPeers {
+			i := d.worstIdlePeer(peers)
+			if i < 0 {
+				break
+			}
+			p := peers[i]
+			peers = append(peers[:i], peers[i+1:]...)
+			// Recorded ahead of the resends of the pending requests of p.
+			d.recordEviction(p, peers)
+			if err := d.closePeer(p, PeerRemovalEvicted); err != nil {
+				// Removed concurrently.
+				continue
+			}
+			d.log("peer", p).Info("Evicted peer to make room for a new peer")
+			d.stats.Counter("peer_evictions").Inc(1)
+		}
+	}
+	if len(peers) >= d.config.MaxPeers {
+		d.stats.Counter("peer_limit_rejections").Inc(1)
+		return ErrTooManyPeers
+	}
+	return nil
+}
+
+// worstIdlePeer returns the index of the peer which is least useful to keep
+// among peers, or -1 if no peer is idle. Peers which connected or transferred a
+// piece within Config.PeerActivityWindow, or have serves queued, are not idle.
+// Once d is complete, complete peers need nothing from d and go first.
+// Otherwise, the peer whose last transfer is oldest goes first, such that peers
+// which never transferred a piece go before all others, and ties go to the peer
+// connected longest. Piece requests pending with the evicted peer are resent
+// elsewhere.
+func (d *Dispatcher) worstIdlePeer(peers []*peer) int {
+	seeding := d.Complete()
+	now := d.clk.Now()
+
+	worst := -1
+	var worstComplete bool
+	for i, p := range peers {
+		if !d.idlePeer(p, now) {
+			continue
+		}
+		last := p.lastTransfer()
+		complete := seeding && p.bitfield.Complete()
+		if worst >= 0 {
+			w := peers[worst]
+			if complete != worstComplete {
+				if !complete {
+					continue
+				}
+			} else if wl := w.lastTransfer(); last.After(wl) ||
+				(last.Equal(wl) && !p.addedAt.Before(w.addedAt)) {
+				continue
+			}
+		}
+		worst, worstComplete = i, complete
+	}
+	return worst
+}
+
+// idlePeer returns whether p may be evicted at now, see worstIdlePeer.
+func (d *Dispatcher) idlePeer(p *peer, now time.Time) bool {
+	if now.Sub(p.addedAt) < d.config.PeerActivityWindow || !p.serves.idle() {
+		return false
+	}
+	last := p.lastTransfer()
+	return last.IsZero() || now.Sub(last) >= d.config.PeerActivityWindow
+}
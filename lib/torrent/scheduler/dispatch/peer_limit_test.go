@@ -0,0 +1,180 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"testing"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+	"go.uber.org/zap"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/torrent/networkevent"
+	"github.com/uber/kraken/lib/torrent/scheduler/torrentlog"
+	"github.com/uber/kraken/lib/torrent/storage/agentstorage"
+	"github.com/uber/kraken/utils/bitsetutil"
+)
+
+func TestDispatcherRejectsNewPeersAtLimit(t *testing.T) {
+	require := require.New(t)
+
+	torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(2, 1).MetaInfo)
+	defer cleanup()
+
+	stats := tally.NewTestScope("", nil)
+	d := testDispatcher(Config{MaxPeers: 2}, clock.NewMock(), torrent)
+	d.stats = stats
+
+	p1, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false, false), newMockMessages())
+	require.NoError(err)
+	p2, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false, false), newMockMessages())
+	require.NoError(err)
+
+	_, err = d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false, false), newMockMessages())
+	require.Equal(ErrTooManyPeers, err)
+
+	// Existing peers are not counted as rejections.
+	_, err = d.addPeer(p2.id, bitsetutil.FromBools(false, false), newMockMessages())
+	require.Error(err)
+	require.NotEqual(ErrTooManyPeers, err)
+
+	require.Equal(
+		int64(1), stats.Snapshot().Counters()["peer_limit_rejections+"].Value())
+	require.False(closed(p1.messages))
+
+	// Removing a peer makes room.
+	require.NoError(d.RemovePeer(p1.id))
+	_, err = d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false, false), newMockMessages())
+	require.NoError(err)
+}
+
+func TestDispatcherEvictsWorstIdlePeerAtLimit(t *testing.T) {
+	require := require.New(t)
+
+	torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(4, 1).MetaInfo)
+	defer cleanup()
+
+	config := Config{
+		MaxPeers:              2,
+		PeerReplacementPolicy: EvictWorstPeer,
+		PeerActivityWindow:    10 * time.Second,
+		PipelineLimit:         2,
+		DisableEndgame:        true,
+		DisableKeepalive:      true,
+	}
+	clk := clock.NewMock()
+	stats := tally.NewTestScope("", nil)
+	d := testDispatcher(config, clk, torrent)
+	d.stats = stats
+
+	stalled, err := d.addPeer(
+		core.PeerIDFixture(), bitsetutil.FromBools(true, true, true, true), newMockMessages())
+	require.NoError(err)
+	_, err = d.maybeRequestMorePieces(stalled)
+	require.NoError(err)
+	reserved := requestedPieces(stalled.messages)
+	require.Len(reserved, 2)
+
+	clk.Add(time.Second)
+
+	transferring, err := d.addPeer(
+		core.PeerIDFixture(), bitsetutil.FromBools(true, true, true, true), newMockMessages())
+	require.NoError(err)
+
+	// Both peers recently connected.
+	_, err = d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false, false, false, false), newMockMessages())
+	require.Equal(ErrTooManyPeers, err)
+
+	clk.Add(time.Minute)
+	transferring.touchLastPieceSent()
+
+	newcomer, err := d.addPeer(
+		core.PeerIDFixture(), bitsetutil.FromBools(false, false, false, false), newMockMessages())
+	require.NoError(err)
+
+	require.True(closed(stalled.messages))
+	require.False(closed(transferring.messages))
+	_, ok := d.peers.Load(stalled.id)
+	require.False(ok)
+	_, ok = d.peers.Load(newcomer.id)
+	require.True(ok)
+
+	// Pieces reserved for the evicted peer are requested elsewhere.
+	d.runPendingKick()
+	require.Empty(d.pieceRequestManager.PendingPieces(stalled.id))
+	require.ElementsMatch(reserved, requestedPieces(transferring.messages))
+
+	// Both remaining peers are active.
+	_, err = d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false, false, false, false), newMockMessages())
+	require.Equal(ErrTooManyPeers, err)
+
+	counters := stats.Snapshot().Counters()
+	require.Equal(int64(1), counters["peer_evictions+"].Value())
+	require.Equal(int64(2), counters["peer_limit_rejections+"].Value())
+	require.Equal(
+		int64(1),
+		counters["removed_peers+active=true,reason=evicted,useful=false"].Value())
+}
+
+func TestSeedingDispatcherEvictsCompletePeersFirst(t *testing.T) {
+	require := require.New(t)
+
+	torrent, cleanup := completeTorrentFixture(t, core.SizedBlobFixture(2, 1))
+	defer cleanup()
+
+	config := Config{
+		MaxPeers:              2,
+		PeerReplacementPolicy: EvictWorstPeer,
+		PeerActivityWindow:    10 * time.Second,
+	}
+	clk := clock.NewMock()
+	d := testDispatcher(config, clk, torrent)
+
+	leecher, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false, false), newMockMessages())
+	require.NoError(err)
+
+	clk.Add(time.Second)
+
+	seeder, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, true), newMockMessages())
+	require.NoError(err)
+
+	clk.Add(time.Minute)
+
+	// The leecher connected first, but the seeder needs nothing from d.
+	_, err = d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false, false), newMockMessages())
+	require.NoError(err)
+
+	require.True(closed(seeder.messages))
+	require.False(closed(leecher.messages))
+}
+
+func TestNewDispatcherInvalidPeerReplacementPolicy(t *testing.T) {
+	torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(1, 1).MetaInfo)
+	defer cleanup()
+
+	_, err := newDispatcher(
+		Config{MaxPeers: 1, PeerReplacementPolicy: "evict_random"},
+		tally.NoopScope,
+		clock.NewMock(),
+		networkevent.NewTestProducer(),
+		noopEvents{},
+		core.PeerIDFixture(),
+		torrent,
+		zap.NewNop().Sugar(),
+		torrentlog.NewNopLogger())
+	require.EqualError(t, err, "invalid peer replacement policy: evict_random")
+}
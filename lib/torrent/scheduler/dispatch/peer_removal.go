@@ -0,0 +1,151 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/uber-go/tally"
+)
+
+// PeerRemovalReason classifies why a peer was removed from a Dispatcher.
+type PeerRemovalReason int
+
+const (
+	// PeerRemovalUnspecified is the reason of legacy RemovePeer calls.
+	PeerRemovalUnspecified PeerRemovalReason = iota
+
+	// PeerRemovalClosed denotes the connection to the peer closed, e.g. since
+	// the peer closed it or it failed.
+	PeerRemovalClosed
+
+	// PeerRemovalCompleted denotes the connection was closed since both we and
+	// the peer completed the torrent.
+	PeerRemovalCompleted
+
+	// PeerRemovalBanned denotes the peer was banned for misbehaving.
+	PeerRemovalBanned
+
+	// PeerRemovalTimeout denotes the peer left too many keepalives unanswered.
+	PeerRemovalTimeout
+
+	// PeerRemovalIdle denotes the connection made no progress for too long.
+	PeerRemovalIdle
+
+	// PeerRemovalExpired denotes the connection outlived its TTL.
+	PeerRemovalExpired
+
+	// PeerRemovalTornDown denotes the Dispatcher was torn down.
+	PeerRemovalTornDown
+
+	// PeerRemovalEvicted denotes the peer was evicted to make room for a new
+	// peer, see Config.MaxPeers.
+	PeerRemovalEvicted
+
+	// PeerRemovalServeFailures denotes too many serves to the peer failed in a
+	// row, see Config.MaxConsecutiveServeFailures.
+	PeerRemovalServeFailures
+
+	// PeerRemovalSendQueueFull denotes the send queue of the peer stayed full,
+	// see Config.SendQueueFullTimeout.
+	PeerRemovalSendQueueFull
+)
+
+func (r PeerRemovalReason) String() string {
+	switch r {
+	case PeerRemovalUnspecified:
+		return "unspecified"
+	case PeerRemovalClosed:
+		return "closed"
+	case PeerRemovalCompleted:
+		return "completed"
+	case PeerRemovalBanned:
+		return "banned"
+	case PeerRemovalTimeout:
+		return "timeout"
+	case PeerRemovalIdle:
+		return "idle"
+	case PeerRemovalExpired:
+		return "expired"
+	case PeerRemovalTornDown:
+		return "torn_down"
+	case PeerRemovalEvicted:
+		return "evicted"
+	case PeerRemovalServeFailures:
+		return "serve_failures"
+	case PeerRemovalSendQueueFull:
+		return "send_queue_full"
+	default:
+		return fmt.Sprintf("PeerRemovalReason(%d)", int(r))
+	}
+}
+
+var _peerLifetimeBuckets = tally.MustMakeExponentialDurationBuckets(100*time.Millisecond, 2, 16)
+
+// peerLifetime summarizes the connection to a removed peer.
+type peerLifetime struct {
+	reason PeerRemovalReason
+
+	// How long the peer was connected.
+	connected time.Duration
+
+	// Whether a piece was transferred to or from the peer, and how long after
+	// connecting the first one was.
+	useful       bool
+	timeToUseful time.Duration
+
+	// Whether the peer was still transferring pieces when it was removed.
+	active bool
+}
+
+// closedReason classifies the removal of p once its messages closed.
+func (d *Dispatcher) closedReason(p *peer) PeerRemovalReason {
+	select {
+	case <-d.tornDown:
+		return PeerRemovalTornDown
+	default:
+	}
+	if p.closedComplete.Load() || p.completeCloseScheduled.Load() {
+		// Closed by either side once both completed.
+		return PeerRemovalCompleted
+	}
+	return PeerRemovalClosed
+}
+
+// recordPeerRemoval logs and records the lifetime of p, which was removed for
+// reason. pendingRequests is whether piece requests were still awaited from p.
+func (d *Dispatcher) recordPeerRemoval(p *peer, reason PeerRemovalReason, pendingRequests bool) {
+	l := p.lifetime(reason, d.config.PeerActivityWindow)
+	l.active = l.active || pendingRequests
+
+	d.log(
+		"peer", p,
+		"reason", reason,
+		"connected", l.connected,
+		"useful", l.useful,
+		"time_to_useful", l.timeToUseful,
+		"active", l.active).Info("Removed peer")
+
+	stats := d.stats.Tagged(map[string]string{"reason": reason.String()})
+	stats.Tagged(map[string]string{
+		"useful": strconv.FormatBool(l.useful),
+		"active": strconv.FormatBool(l.active),
+	}).Counter("removed_peers").Inc(1)
+	stats.Histogram("peer_connected_time", _peerLifetimeBuckets).RecordDuration(l.connected)
+	if l.useful {
+		stats.Histogram("peer_time_to_useful", _peerLifetimeBuckets).RecordDuration(l.timeToUseful)
+	}
+}
@@ -0,0 +1,190 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/torrent/scheduler/conn"
+	"github.com/uber/kraken/lib/torrent/storage/agentstorage"
+	"github.com/uber/kraken/lib/torrent/storage/piecereader"
+	"github.com/uber/kraken/utils/bitsetutil"
+)
+
+// histogramSamples returns the non-empty buckets of histogram name, keyed by
+// their upper bounds.
+func histogramSamples(snapshot tally.Snapshot, name string) map[time.Duration]int64 {
+	samples := make(map[time.Duration]int64)
+	h, ok := snapshot.Histograms()[name]
+	if !ok {
+		return samples
+	}
+	for bound, n := range h.Durations() {
+		if n > 0 {
+			samples[bound] = n
+		}
+	}
+	return samples
+}
+
+func TestPeerRemovalLifetimes(t *testing.T) {
+	blob := core.SizedBlobFixture(1, 1)
+
+	tests := []struct {
+		desc string
+		// remove advances the lifecycle of p, which has the only piece, and
+		// removes it.
+		remove               func(d *Dispatcher, clk *clock.Mock, p *peer) error
+		reason               PeerRemovalReason
+		useful               string
+		active               string
+		expectedConnected    time.Duration
+		expectedTimeToUseful map[time.Duration]int64
+	}{
+		{
+			"never useful",
+			func(d *Dispatcher, clk *clock.Mock, p *peer) error {
+				clk.Add(time.Minute)
+				return d.removePeer(p)
+			},
+			PeerRemovalClosed, "false", "false", 102400 * time.Millisecond, nil,
+		}, {
+			"useful and still transferring",
+			func(d *Dispatcher, clk *clock.Mock, p *peer) error {
+				clk.Add(3 * time.Second)
+				if err := d.dispatch(
+					p, conn.NewPiecePayloadMessage(0, piecereader.NewBuffer(blob.Content[0:1]))); err != nil {
+					return err
+				}
+				clk.Add(time.Second)
+				return d.RemovePeerWithReason(p.id, PeerRemovalExpired)
+			},
+			PeerRemovalExpired, "true", "true", 6400 * time.Millisecond,
+			map[time.Duration]int64{3200 * time.Millisecond: 1},
+		}, {
+			"useful but stopped transferring",
+			func(d *Dispatcher, clk *clock.Mock, p *peer) error {
+				if err := d.dispatch(
+					p, conn.NewPiecePayloadMessage(0, piecereader.NewBuffer(blob.Content[0:1]))); err != nil {
+					return err
+				}
+				clk.Add(time.Minute)
+				return d.RemovePeerWithReason(p.id, PeerRemovalIdle)
+			},
+			PeerRemovalIdle, "true", "false", 102400 * time.Millisecond,
+			map[time.Duration]int64{100 * time.Millisecond: 1},
+		}, {
+			"awaiting requested pieces",
+			func(d *Dispatcher, clk *clock.Mock, p *peer) error {
+				if _, err := d.maybeRequestMorePieces(p); err != nil {
+					return err
+				}
+				clk.Add(time.Second)
+				return d.RemovePeerWithReason(p.id, PeerRemovalExpired)
+			},
+			PeerRemovalExpired, "false", "true", 1600 * time.Millisecond, nil,
+		}, {
+			"completed",
+			func(d *Dispatcher, clk *clock.Mock, p *peer) error {
+				p.closedComplete.Store(true)
+				return d.removePeer(p)
+			},
+			PeerRemovalCompleted, "false", "false", 100 * time.Millisecond, nil,
+		}, {
+			"torn down",
+			func(d *Dispatcher, clk *clock.Mock, p *peer) error {
+				d.TearDown()
+				return d.removePeer(p)
+			},
+			PeerRemovalTornDown, "false", "false", 100 * time.Millisecond, nil,
+		}, {
+			"banned",
+			func(d *Dispatcher, clk *clock.Mock, p *peer) error {
+				if !d.banPeer(p) {
+					return errPeerNotDispatched
+				}
+				return nil
+			},
+			PeerRemovalBanned, "false", "false", 100 * time.Millisecond, nil,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+
+			torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+			defer cleanup()
+
+			clk := clock.NewMock()
+			stats := tally.NewTestScope("", nil)
+			d := testDispatcher(Config{}, clk, torrent)
+			d.stats = stats
+
+			p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true), newMockMessages())
+			require.NoError(err)
+
+			require.NoError(test.remove(d, clk, p))
+
+			// Snapshots consume histogram samples, so only one is taken.
+			snapshot := stats.Snapshot()
+			reason := "reason=" + test.reason.String()
+			counter, ok := snapshot.Counters()["removed_peers+active="+test.active+","+reason+
+				",useful="+test.useful]
+			require.True(ok)
+			require.Equal(int64(1), counter.Value())
+
+			require.Equal(
+				map[time.Duration]int64{test.expectedConnected: 1},
+				histogramSamples(snapshot, "peer_connected_time+"+reason))
+			expectedTimeToUseful := test.expectedTimeToUseful
+			if expectedTimeToUseful == nil {
+				expectedTimeToUseful = make(map[time.Duration]int64)
+			}
+			require.Equal(expectedTimeToUseful, histogramSamples(snapshot, "peer_time_to_useful+"+reason))
+		})
+	}
+}
+
+func TestPeerRemovalIsRecordedOnce(t *testing.T) {
+	require := require.New(t)
+
+	torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(1, 1).MetaInfo)
+	defer cleanup()
+
+	stats := tally.NewTestScope("", nil)
+	d := testDispatcher(Config{}, clock.NewMock(), torrent)
+	d.stats = stats
+
+	p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false), newMockMessages())
+	require.NoError(err)
+
+	require.NoError(d.RemovePeerWithReason(p.id, PeerRemovalIdle))
+	// The feed of p observes its messages closing afterwards.
+	require.Equal(errPeerNotDispatched, d.removePeer(p))
+
+	var n int64
+	for name, c := range stats.Snapshot().Counters() {
+		if strings.HasPrefix(name, "removed_peers+") {
+			n += c.Value()
+		}
+	}
+	require.Equal(int64(1), n)
+}
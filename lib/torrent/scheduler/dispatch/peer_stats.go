@@ -0,0 +1,164 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"math"
+	"time"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/torrent/scheduler/conn"
+)
+
+// PeerStats contains transfer statistics of a connected peer.
+type PeerStats struct {
+	PeerID                core.PeerID `json:"peer_id"`
+	BytesUploaded         int64       `json:"bytes_uploaded"`
+	BytesDownloaded       int64       `json:"bytes_downloaded"`
+	GoodPiecesReceived    int         `json:"good_pieces_received"`
+	InvalidPiecesReceived int         `json:"invalid_pieces_received"`
+
+	// ProtocolViolations is the number of malformed messages received from the
+	// peer, such as announcements of pieces out of range.
+	ProtocolViolations int `json:"protocol_violations"`
+
+	// CrossedPayloads is the number of piece payloads received from the peer
+	// which answered piece requests sent to other peers, hinting at the peer
+	// mixing up requesters. UnreliableAttribution is set once there was one,
+	// which excludes the peer from latency estimates.
+	CrossedPayloads       int  `json:"crossed_payloads"`
+	UnreliableAttribution bool `json:"unreliable_attribution,omitempty"`
+
+	// DownloadRate is the exponentially smoothed rate of bytes downloaded from
+	// the peer, in bytes per second.
+	DownloadRate float64 `json:"download_rate"`
+
+	// RecentBytesReceived and RecentBytesSent are the piece bytes received from
+	// and sent to the peer within Config.ReciprocityWindow, which rank the peer
+	// for upload slots.
+	RecentBytesReceived int64 `json:"recent_bytes_received"`
+	RecentBytesSent     int64 `json:"recent_bytes_sent"`
+
+	// PieceRTT is the moving average of the time between requesting a piece
+	// from the peer and receiving it. Zero if unknown.
+	PieceRTT time.Duration `json:"piece_rtt"`
+
+	// WireBytesSent is the total number of bytes sent to the peer, including
+	// protocol overhead. WireEfficiency is the approximate ratio of
+	// BytesUploaded to WireBytesSent. Both are zero if unknown.
+	WireBytesSent  int64   `json:"wire_bytes_sent"`
+	WireEfficiency float64 `json:"wire_efficiency"`
+
+	// HeadOfLineBlocks is the number of times a control message queued to or
+	// from the peer was found stuck behind piece payloads.
+	HeadOfLineBlocks int `json:"head_of_line_blocks"`
+
+	// SendQueueDepth is the number of messages queued to the peer which its
+	// connection did not accept yet, see Config.SendQueueSize.
+	SendQueueDepth int `json:"send_queue_depth"`
+
+	// Asymmetric is set while the peer is excluded from piece selection, since
+	// our piece requests to it keep expiring although we serve it pieces.
+	Asymmetric bool `json:"asymmetric"`
+
+	// UnansweredKeepalives is the number of keepalives sent to the peer since
+	// it last sent us a message.
+	UnansweredKeepalives int `json:"unanswered_keepalives"`
+
+	// LocalAddr is the local address which the connection of the peer arrived
+	// on, and Interface the label of its network interface, see
+	// Config.NetworkInterfaces. Empty if unknown or unconfigured.
+	LocalAddr string `json:"local_addr,omitempty"`
+	Interface string `json:"interface,omitempty"`
+
+	// Locality labels the locality of the peer, e.g. its zone, and Local is
+	// set if it shares the locality of the Dispatcher, see WithPeerLocality.
+	Locality string `json:"locality,omitempty"`
+	Local    bool   `json:"local,omitempty"`
+
+	// Capabilities are the known capabilities negotiated with the peer, sorted
+	// by name. UnknownCapabilities is the number of capabilities the peer
+	// listed which we do not implement, e.g. since it runs a newer version.
+	Capabilities        []conn.Capability `json:"capabilities"`
+	UnknownCapabilities int               `json:"unknown_capabilities"`
+}
+
+// wireCounter is implemented by Messages which count the bytes they write to
+// the wire, such as conn.Conn.
+type wireCounter interface {
+	BytesSent() int64
+}
+
+// wireEfficiency returns the ratio of payload bytes to wire bytes. The counters
+// are updated at different times, so the ratio is clamped to [0, 1].
+func wireEfficiency(payload, wire int64) float64 {
+	if wire <= 0 || payload <= 0 {
+		return 0
+	}
+	return math.Min(float64(payload)/float64(wire), 1)
+}
+
+// rateEstimator estimates the rate of a stream of samples, exponentially
+// decaying samples with time constant window. Not thread-safe.
+type rateEstimator struct {
+	window time.Duration
+	rate   float64
+	last   time.Time
+}
+
+func newRateEstimator(window time.Duration, now time.Time) *rateEstimator {
+	return &rateEstimator{window: window, last: now}
+}
+
+// add records n bytes at now.
+func (e *rateEstimator) add(n int64, now time.Time) {
+	e.rate = e.get(now) + float64(n)/e.window.Seconds()
+	e.last = now
+}
+
+// get returns the estimated rate at now, in bytes per second.
+func (e *rateEstimator) get(now time.Time) float64 {
+	elapsed := now.Sub(e.last)
+	if elapsed <= 0 {
+		return e.rate
+	}
+	return e.rate * math.Exp(-elapsed.Seconds()/e.window.Seconds())
+}
+
+// rttEstimator estimates round-trip times as an exponentially weighted moving
+// average of samples. Not thread-safe.
+type rttEstimator struct {
+	weight  float64
+	rtt     time.Duration
+	sampled bool
+}
+
+func newRTTEstimator(weight float64) *rttEstimator {
+	return &rttEstimator{weight: weight}
+}
+
+// add records sample d. The first sample initializes the estimate.
+func (e *rttEstimator) add(d time.Duration) {
+	if !e.sampled {
+		e.rtt = d
+		e.sampled = true
+		return
+	}
+	e.rtt = time.Duration(e.weight*float64(d) + (1-e.weight)*float64(e.rtt))
+}
+
+// get returns the estimated round-trip time. Zero if there were no samples.
+func (e *rttEstimator) get() time.Duration {
+	return e.rtt
+}
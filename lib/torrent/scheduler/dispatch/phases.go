@@ -0,0 +1,140 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"sync"
+	"time"
+)
+
+// Boundaries between the phases of a Dispatcher, in the order they occur.
+const (
+	_created = iota
+	_firstPeer
+	_firstPiece
+	_endgame
+	_completed
+	_tornDown
+	_numPhaseBoundaries
+)
+
+// Phases breaks the lifetime of a Dispatcher down into wall-clock phases, for
+// latency budgeting. Phases which have not ended yet are zero.
+type Phases struct {
+	// ToFirstPeer spans from creation until the first peer was added.
+	ToFirstPeer time.Duration `json:"to_first_peer"`
+
+	// ToFirstPiece spans from the first peer until the first piece was written.
+	ToFirstPiece time.Duration `json:"to_first_piece"`
+
+	// Transfer spans from the first piece until endgame was entered.
+	Transfer time.Duration `json:"transfer"`
+
+	// Endgame spans from entering endgame until the torrent completed.
+	Endgame time.Duration `json:"endgame"`
+
+	// CompleteToTeardown spans from completion until the Dispatcher was torn
+	// down.
+	CompleteToTeardown time.Duration `json:"complete_to_teardown"`
+}
+
+// Millis returns the phases keyed by metric name, in milliseconds. Zero phases
+// are omitted, and nil is returned if all phases are zero.
+func (p Phases) Millis() map[string]int64 {
+	var ms map[string]int64
+	for name, d := range p.byName() {
+		if d == 0 {
+			continue
+		}
+		if ms == nil {
+			ms = make(map[string]int64)
+		}
+		ms[name] = int64(d / time.Millisecond)
+	}
+	return ms
+}
+
+func (p Phases) byName() map[string]time.Duration {
+	return map[string]time.Duration{
+		"to_first_peer":        p.ToFirstPeer,
+		"to_first_piece":       p.ToFirstPiece,
+		"transfer":             p.Transfer,
+		"endgame":              p.Endgame,
+		"complete_to_teardown": p.CompleteToTeardown,
+	}
+}
+
+// phaseClock records when each phase boundary of a Dispatcher was first
+// reached. Phases are computed lazily from the boundaries.
+type phaseClock struct {
+	mu         sync.Mutex
+	boundaries [_numPhaseBoundaries]time.Time
+}
+
+func newPhaseClock(createdAt time.Time) *phaseClock {
+	c := &phaseClock{}
+	c.boundaries[_created] = createdAt
+	return c
+}
+
+// mark records that boundary b was reached at t, unless it was reached before.
+// Download boundaries reached after completion, e.g. peers added to a
+// Dispatcher which was created complete, are ignored.
+func (c *phaseClock) mark(b int, t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if b < _completed && !c.boundaries[_completed].IsZero() {
+		return
+	}
+	if c.boundaries[b].IsZero() {
+		c.boundaries[b] = t
+	}
+}
+
+// phases computes the phases from the recorded boundaries. Boundaries which
+// were skipped, e.g. the first peer of a Dispatcher which was created complete
+// or endgame if disabled, coincide with the next boundary which was reached,
+// such that skipped phases are zero. Boundaries reached out of order, e.g.
+// endgame entered before the first piece of a small torrent, coincide with the
+// preceding boundary.
+func (c *phaseClock) phases() Phases {
+	c.mu.Lock()
+	b := c.boundaries
+	c.mu.Unlock()
+
+	for i := _numPhaseBoundaries - 2; i > _created; i-- {
+		if b[i].IsZero() {
+			b[i] = b[i+1]
+		}
+	}
+	for i := _created + 1; i < _numPhaseBoundaries; i++ {
+		if !b[i].IsZero() && b[i].Before(b[i-1]) {
+			b[i] = b[i-1]
+		}
+	}
+	span := func(i int) time.Duration {
+		if b[i+1].IsZero() {
+			return 0
+		}
+		return b[i+1].Sub(b[i])
+	}
+	return Phases{
+		ToFirstPeer:        span(_created),
+		ToFirstPiece:       span(_firstPeer),
+		Transfer:           span(_firstPiece),
+		Endgame:            span(_endgame),
+		CompleteToTeardown: span(_completed),
+	}
+}
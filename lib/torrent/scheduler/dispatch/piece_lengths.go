@@ -0,0 +1,40 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import "github.com/uber/kraken/lib/torrent/storage"
+
+// pieceLengths computes the expected length of each piece of a torrent. All
+// pieces are maxLength long, except the last piece, which holds the remaining
+// bytes and may be as short as a single byte.
+type pieceLengths struct {
+	numPieces int
+	length    int64
+	maxLength int64
+}
+
+func newPieceLengths(t storage.Torrent) pieceLengths {
+	return pieceLengths{t.NumPieces(), t.Length(), t.MaxPieceLength()}
+}
+
+// get returns the expected length of piece i, or 0 if i is out of bounds.
+func (l pieceLengths) get(i int) int64 {
+	if i < 0 || i >= l.numPieces {
+		return 0
+	}
+	if i == l.numPieces-1 {
+		return l.length - l.maxLength*int64(i)
+	}
+	return l.maxLength
+}
@@ -0,0 +1,64 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/torrent/storage/agentstorage"
+)
+
+func TestPieceLengths(t *testing.T) {
+	tests := []struct {
+		desc        string
+		length      uint64
+		pieceLength uint64
+		expected    []int64
+	}{
+		{"last piece exactly max", 8, 4, []int64{4, 4}},
+		{"last piece of one byte", 9, 4, []int64{4, 4, 1}},
+		{"last piece one byte short of max", 11, 4, []int64{4, 4, 3}},
+		{"single piece shorter than max", 3, 4, []int64{3}},
+		{"single piece exactly max", 4, 4, []int64{4}},
+		{"single byte", 1, 4, []int64{1}},
+		{"one byte pieces", 3, 1, []int64{1, 1, 1}},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+
+			blob := core.SizedBlobFixture(test.length, test.pieceLength)
+			torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+			defer cleanup()
+
+			l := newPieceLengths(torrent)
+
+			var actual []int64
+			var total int64
+			for i := 0; i < torrent.NumPieces(); i++ {
+				actual = append(actual, l.get(i))
+				total += l.get(i)
+				require.Equal(torrent.PieceLength(i), l.get(i), fmt.Sprintf("piece %d", i))
+			}
+			require.Equal(test.expected, actual)
+			require.Equal(int64(test.length), total)
+
+			require.Equal(int64(0), l.get(-1))
+			require.Equal(int64(0), l.get(len(test.expected)))
+		})
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"testing"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/gen/go/proto/p2p"
+	"github.com/uber/kraken/lib/torrent/scheduler/conn"
+	"github.com/uber/kraken/lib/torrent/storage/agentstorage"
+	"github.com/uber/kraken/utils/bitsetutil"
+)
+
+func TestDispatcherBatchesPieceRequestsToSupportingPeers(t *testing.T) {
+	require := require.New(t)
+
+	torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(4, 1).MetaInfo)
+	defer cleanup()
+
+	stats := tally.NewTestScope("", nil)
+	d := testDispatcher(Config{
+		PipelineLimit:    4,
+		DisableEndgame:   true,
+		DisableKeepalive: true,
+	}, clock.NewMock(), torrent)
+	d.stats = stats
+
+	have := bitsetutil.FromBools(true, true, true, true)
+	p, err := d.addPeer(core.PeerIDFixture(), have, newMockMessages())
+	require.NoError(err)
+	legacy, err := d.addPeer(core.PeerIDFixture(), have, newLegacyMockMessages(conn.BatchRequests))
+	require.NoError(err)
+
+	_, err = d.maybeRequestMorePieces(p)
+	require.NoError(err)
+	sent := p.messages.(*mockMessages).getSent()
+	require.Len(sent, 1)
+	require.Equal(p2p.Message_PIECE_REQUESTS, sent[0].Message.Type)
+	require.ElementsMatch([]int{0, 1, 2, 3}, requestedPieces(p.messages))
+	require.Equal(4, p.pstats.getPieceRequestsSent())
+
+	// Pieces are requested one by one from peers which do not support batches.
+	d.pieceRequestManager.ClearPeer(p.id)
+	_, err = d.maybeRequestMorePieces(legacy)
+	require.NoError(err)
+	require.Equal(4, numSent(legacy.messages, p2p.Message_PIECE_REQUEST))
+	require.Equal(0, numSent(legacy.messages, p2p.Message_PIECE_REQUESTS))
+
+	counters := stats.Snapshot().Counters()
+	require.Equal(int64(1), counters["piece_request_batches+"].Value())
+	require.Equal(int64(4), counters["batched_piece_requests+"].Value())
+}
+
+func TestDispatcherServesBatchedPieceRequestsIndependently(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(12, 4)
+	torrent, cleanup := completeTorrentFixture(t, blob)
+	defer cleanup()
+
+	d := testDispatcher(Config{DisableKeepalive: true}, clock.NewMock(), torrent)
+
+	p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false, false, false), newMockMessages())
+	require.NoError(err)
+
+	// The out of range request of piece 1 fails only piece 1.
+	require.NoError(d.dispatch(p, conn.NewPieceRequestsMessage([]*p2p.PieceRequestMessage{
+		{Index: 0, Offset: 0, Length: 4},
+		{Index: 1, Offset: 8, Length: 4},
+		{Index: 2, Offset: 0, Length: 4},
+	})))
+	waitForServes(t, p)
+
+	require.ElementsMatch([]int{0, 2}, servedPieces(p.messages))
+	var failed []int
+	for _, msg := range p.messages.(*mockMessages).getSent() {
+		if msg.Message.Type == p2p.Message_ERROR {
+			failed = append(failed, int(msg.Message.Error.Index))
+		}
+	}
+	require.Equal([]int{1}, failed)
+	require.Equal(3, p.pstats.getPieceRequestsReceived())
+}
+
+func TestDispatcherRejectsEmptyBatchedPieceRequests(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(2, 1)
+	torrent, cleanup := completeTorrentFixture(t, blob)
+	defer cleanup()
+
+	d := testDispatcher(Config{DisableKeepalive: true}, clock.NewMock(), torrent)
+
+	p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false, false), newMockMessages())
+	require.NoError(err)
+
+	err = d.dispatch(p, conn.NewPieceRequestsMessage([]*p2p.PieceRequestMessage{
+		{Index: 0, Length: 1}, nil,
+	}))
+	require.Equal(ErrorProtocolViolation, Category(err))
+	waitForServes(t, p)
+
+	// The well formed request is served regardless.
+	require.Equal([]int{0}, servedPieces(p.messages))
+}
@@ -0,0 +1,151 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"sync"
+
+	"github.com/willf/bitset"
+
+	"github.com/uber/kraken/gen/go/proto/p2p"
+)
+
+// pieceWrites tracks the writes of received pieces, which run on at most
+// Config.PieceWriteWorkers goroutines at a time.
+type pieceWrites struct {
+	slots chan struct{}
+
+	mu      sync.Mutex
+	wg      sync.WaitGroup
+	closed  bool
+	writing *bitset.BitSet
+	n       int
+}
+
+func newPieceWrites(workers, numPieces int) *pieceWrites {
+	return &pieceWrites{
+		slots:   make(chan struct{}, workers),
+		writing: bitset.New(uint(numPieces)),
+	}
+}
+
+// begin marks piece i as being written. Returns false if i is being written
+// already, or if w was closed, in which case closed is set.
+func (w *pieceWrites) begin(i int) (ok bool, closed bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return false, true
+	}
+	if w.writing.Test(uint(i)) {
+		return false, false
+	}
+	w.writing.Set(uint(i))
+	w.n++
+	w.wg.Add(1)
+	return true, false
+}
+
+// end marks the write of piece i as finished. Returns the number of writes
+// still in flight.
+func (w *pieceWrites) end(i int) int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.writing.Clear(uint(i))
+	w.n--
+	w.wg.Done()
+	return w.n
+}
+
+func (w *pieceWrites) numInFlight() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.n
+}
+
+// inFlight returns the pieces being written, or nil if there are none.
+func (w *pieceWrites) inFlight() *bitset.BitSet {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.n == 0 {
+		return nil
+	}
+	return w.writing.Clone()
+}
+
+// close refuses new writes, and waits for the writes in flight to finish.
+func (w *pieceWrites) close() {
+	w.mu.Lock()
+	w.closed = true
+	w.mu.Unlock()
+
+	w.wg.Wait()
+}
+
+// writeReceivedPiece runs write, which writes received piece i and handles the
+// result, on a write worker rather than on the feed of p, such that a slow disk
+// does not stall the other messages of p. While a worker is busy with i, i is
+// not requested from any peer, and if i was received again meanwhile, discard
+// is called with inFlight set instead of write. Once d is torn down, discard is
+// called instead of write, and teardown waits for the writes in flight. Errors
+// of write are handled like errors of the handler of p. Pieces are written
+// synchronously if Config.PieceWriteWorkers is zero.
+func (d *Dispatcher) writeReceivedPiece(
+	p *peer, i int, write func() error, discard func(inFlight bool)) error {
+
+	if d.pieceWrites == nil {
+		return write()
+	}
+	ok, closed := d.pieceWrites.begin(i)
+	if !ok {
+		discard(!closed)
+		return nil
+	}
+	select {
+	case d.pieceWrites.slots <- struct{}{}:
+	case <-d.tornDown:
+		d.pieceWrites.end(i)
+		discard(false)
+		return nil
+	}
+	d.stats.Gauge("piece_writes_in_flight").Update(float64(d.pieceWrites.numInFlight()))
+
+	// Graceful teardown waits for the write.
+	d.inflight.begin()
+	go func() {
+		defer d.inflight.end()
+		if err := write(); err != nil {
+			d.handlerFailed(p, p2p.Message_PIECE_PAYLOAD, err)
+		}
+		<-d.pieceWrites.slots
+		d.stats.Gauge("piece_writes_in_flight").Update(float64(d.pieceWrites.end(i)))
+	}()
+	return nil
+}
+
+// excludePiecesBeingWritten returns candidates without the pieces which are
+// being written.
+func (d *Dispatcher) excludePiecesBeingWritten(candidates *bitset.BitSet) *bitset.BitSet {
+	if d.pieceWrites == nil {
+		return candidates
+	}
+	if writing := d.pieceWrites.inFlight(); writing != nil {
+		return candidates.Difference(writing)
+	}
+	return candidates
+}
@@ -0,0 +1,131 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"testing"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/torrent/scheduler/conn"
+	"github.com/uber/kraken/lib/torrent/storage/agentstorage"
+	"github.com/uber/kraken/lib/torrent/storage/piecereader"
+	"github.com/uber/kraken/utils/bitsetutil"
+)
+
+func TestDispatcherWritesPiecesOffFeed(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(2, 1)
+	fixture, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+	torrent := &blockingWriteTorrent{
+		Torrent: fixture,
+		writing: make(chan int, 2),
+		release: make(chan struct{}),
+	}
+
+	clk := clock.NewMock()
+	stats := tally.NewTestScope("", nil)
+	events := &recordingEvents{}
+	d := testDispatcher(Config{
+		PieceWriteWorkers: 2,
+		DisableEndgame:    true,
+		DisableKeepalive:  true,
+	}, clk, torrent)
+	d.stats = stats
+	d.emitter = testEmitter(events, tally.NoopScope)
+	defer d.TearDown()
+
+	p1, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, false), newMockMessages())
+	require.NoError(err)
+	p2, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, false), newMockMessages())
+	require.NoError(err)
+
+	_, err = d.maybeRequestMorePieces(p1)
+	require.NoError(err)
+	require.Equal([]int{0}, requestedPieces(p1.messages))
+
+	// The feed of p1 handles messages while piece 0 is being written.
+	require.NoError(d.dispatch(
+		p1, conn.NewPiecePayloadMessage(0, piecereader.NewBuffer(blob.Content[0:1]))))
+	require.Equal(0, <-torrent.writing)
+	require.NoError(d.dispatch(p1, conn.NewAnnouncePieceMessage(1)))
+	require.True(p1.bitfield.Has(1))
+
+	// Piece 0 is not requested again, although its request expired.
+	clk.Add(d.currentPieceRequestTimeout())
+	d.resendFailedPieceRequests()
+	require.Empty(requestedPieces(p2.messages))
+
+	// A duplicate of piece 0 is not written.
+	require.NoError(d.dispatch(
+		p2, conn.NewPiecePayloadMessage(0, piecereader.NewBuffer(blob.Content[0:1]))))
+	require.Equal(int64(1), stats.Snapshot().Counters()["duplicate_pieces_received+endgame=false"].Value())
+	require.Empty(torrent.writing)
+
+	// d completes once the last write committed.
+	require.Equal([]int{1}, requestedPieces(p1.messages)[1:])
+	require.NoError(d.dispatch(
+		p1, conn.NewPiecePayloadMessage(1, piecereader.NewBuffer(blob.Content[1:2]))))
+	require.False(d.Complete())
+	close(torrent.release)
+	require.Eventually(func() bool {
+		return len(events.get()) == 1
+	}, time.Second, 5*time.Millisecond)
+	require.Equal([]string{"complete"}, events.get())
+	require.True(d.Complete())
+}
+
+func TestDispatcherTearDownWaitsForPieceWrites(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(2, 1)
+	fixture, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+	torrent := &blockingWriteTorrent{
+		Torrent: fixture,
+		writing: make(chan int, 2),
+		release: make(chan struct{}),
+	}
+
+	d := testDispatcher(Config{PieceWriteWorkers: 1, DisableKeepalive: true}, clock.NewMock(), torrent)
+
+	p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, true), newMockMessages())
+	require.NoError(err)
+	require.NoError(d.dispatch(
+		p, conn.NewPiecePayloadMessage(0, piecereader.NewBuffer(blob.Content[0:1]))))
+	require.Equal(0, <-torrent.writing)
+
+	tornDown := make(chan struct{})
+	go func() {
+		d.TearDown()
+		close(tornDown)
+	}()
+	require.Never(func() bool { return isDone(tornDown) }, 100*time.Millisecond, 5*time.Millisecond)
+
+	close(torrent.release)
+	require.Eventually(func() bool { return isDone(tornDown) }, time.Second, 5*time.Millisecond)
+	require.True(fixture.HasPiece(0))
+
+	// Pieces received after teardown are discarded.
+	require.NoError(d.dispatch(
+		p, conn.NewPiecePayloadMessage(1, piecereader.NewBuffer(blob.Content[1:2]))))
+	require.Empty(torrent.writing)
+	require.False(fixture.HasPiece(1))
+}
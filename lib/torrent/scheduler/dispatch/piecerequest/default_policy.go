@@ -64,3 +64,7 @@ func (p *defaultPolicy) selectPieces(
 
 	return pieces, nil
 }
+
+func (p *defaultPolicy) nextRound() {}
+
+func (p *defaultPolicy) clear(i int) {}
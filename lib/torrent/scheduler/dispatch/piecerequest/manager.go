@@ -15,6 +15,8 @@ package piecerequest
 
 import (
 	"fmt"
+	"math"
+	"math/rand"
 	"sort"
 	"sync"
 	"time"
@@ -41,17 +43,46 @@ const (
 
 	// StatusInvalid denotes a completed request that resulted in an invalid payload.
 	StatusInvalid
+
+	// StatusRejected denotes a request which the peer rejected transiently, e.g.
+	// due to load. Unlike invalid requests, rejected requests do not count as
+	// failures of the peer.
+	StatusRejected
 )
 
+// fastReceiptDivisor defines which pieces are received well under the request
+// timeout: those received within timeout / fastReceiptDivisor of their request.
+const fastReceiptDivisor = 4
+
 // Request represents a piece request to peer.
 type Request struct {
 	Piece  int
 	PeerID core.PeerID
 	Status Status
 
+	// Retries is the number of times failed requests of Piece were returned by
+	// GetFailedRequests before, i.e. zero for the first request and the first
+	// failure of Piece.
+	Retries int
+
 	sentAt time.Time
 }
 
+// Stats counts the requests tracked by a Manager by status.
+type Stats struct {
+	Pending  int
+	Expired  int
+	Unsent   int
+	Invalid  int
+	Rejected int
+}
+
+// retryState tracks the resend backoff of a piece.
+type retryState struct {
+	retries    int
+	eligibleAt time.Time
+}
+
 // Manager encapsulates thread-safe piece request bookkeeping. It is not responsible
 // for sending nor receiving pieces in any way.
 type Manager struct {
@@ -62,32 +93,102 @@ type Manager struct {
 	requestsByPeer map[core.PeerID]map[int]*Request
 
 	clock   clock.Clock
-	timeout time.Duration
+	timeout TimeoutProvider
 
 	policy        pieceSelectionPolicy
 	pipelineLimit int
+
+	// depths holds the adaptive pipeline limits of peers, which start at
+	// pipelineLimit and stay within [minPipelineLimit, maxPipelineLimit].
+	depths           map[core.PeerID]*pipelineDepth
+	minPipelineLimit int
+	maxPipelineLimit int
+
+	// peerLimits holds per-peer pipeline limits which override depths.
+	peerLimits map[core.PeerID]int
+
+	// maxReservations caps the outstanding requests of each peer, including
+	// expired requests which the peer may still answer. Unlimited if zero.
+	maxReservations int
+
+	// priority holds pieces which are selected ahead of all other candidates,
+	// and which may be reserved under up to hedgeFactor peers at once (i.e.
+	// hedged).
+	priority    map[int]bool
+	hedgeFactor int
+
+	// preferred holds pieces which are selected ahead of all other candidates
+	// but prioritized pieces. Once at most preferredEndgame preferred pieces
+	// remain, they may be reserved under multiple peers at once.
+	preferred        map[int]bool
+	preferredEndgame int
+
+	// unrequestedSince holds when candidate pieces with no requests were first
+	// seen.
+	unrequestedSince map[int]time.Time
+
+	// chunks holds the received chunks of partially received pieces.
+	chunks map[int]*bitset.BitSet
+
+	// completed holds pieces which must never be reserved again.
+	completed map[int]bool
+
+	// retries holds the retry counts and resend backoff of pieces whose requests
+	// failed. Backoff is disabled unless maxBackoff is set.
+	retries        map[int]*retryState
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+
+	// retryAfter holds when pieces which peers rejected with a retry hint may be
+	// reserved under the rejecting peer again.
+	retryAfter map[core.PeerID]map[int]time.Time
+}
+
+// TimeoutProvider returns the current piece request timeout. Requests expire
+// once they were pending for longer than the timeout as of checking, so a
+// shrinking timeout may expire requests sooner than when they were sent.
+type TimeoutProvider func() time.Duration
+
+// FixedTimeout returns a TimeoutProvider which always returns timeout.
+func FixedTimeout(timeout time.Duration) TimeoutProvider {
+	return func() time.Duration { return timeout }
 }
 
 // NewManager creates a new Manager.
 func NewManager(
 	clk clock.Clock,
-	timeout time.Duration,
+	timeout TimeoutProvider,
 	policy string,
-	pipelineLimit int) (*Manager, error) {
+	pipelineLimit int,
+	agingRate float64) (*Manager, error) {
 
 	m := &Manager{
-		requests:       make(map[int][]*Request),
-		requestsByPeer: make(map[core.PeerID]map[int]*Request),
-		clock:          clk,
-		timeout:        timeout,
-		pipelineLimit:  pipelineLimit,
+		requests:         make(map[int][]*Request),
+		requestsByPeer:   make(map[core.PeerID]map[int]*Request),
+		clock:            clk,
+		timeout:          timeout,
+		pipelineLimit:    pipelineLimit,
+		depths:           make(map[core.PeerID]*pipelineDepth),
+		minPipelineLimit: pipelineLimit,
+		maxPipelineLimit: pipelineLimit,
+		peerLimits:       make(map[core.PeerID]int),
+		priority:         make(map[int]bool),
+		hedgeFactor:      2,
+		preferred:        make(map[int]bool),
+		unrequestedSince: make(map[int]time.Time),
+		chunks:           make(map[int]*bitset.BitSet),
+		completed:        make(map[int]bool),
+		retries:          make(map[int]*retryState),
+		retryAfter:       make(map[core.PeerID]map[int]time.Time),
 	}
 
 	switch policy {
 	case DefaultPolicy:
 		m.policy = newDefaultPolicy()
 	case RarestFirstPolicy:
-		m.policy = newRarestFirstPolicy()
+		m.policy = newRarestFirstPolicy(agingRate)
+	case SequentialPolicy:
+		m.policy = newSequentialPolicy()
 	default:
 		return nil, fmt.Errorf("invalid piece selection policy: %s", policy)
 	}
@@ -97,62 +198,509 @@ func NewManager(
 // ReservePieces selects the next piece(s) to be requested from given peer.
 // It selects peers on a rarity-first basis using numPeersByPiece.
 // If allowDuplicates is set, may return pieces which have already been
-// reserved under other peers.
+// reserved under other peers. Prioritized pieces are always selected first,
+// and may always be duplicated, up to the hedge factor. Preferred pieces are selected next, see
+// SetPreferred.
 func (m *Manager) ReservePieces(
 	peerID core.PeerID,
 	candidates *bitset.BitSet,
 	numPeersByPiece syncutil.Counters,
 	allowDuplicates bool) ([]int, error) {
 
+	return m.ReservePiecesUpTo(peerID, candidates, numPeersByPiece, allowDuplicates, math.MaxInt32)
+}
+
+// ReservePiecesUpTo selects pieces like ReservePieces, but stops once peerID
+// holds limit pending requests which have not expired, e.g. to reserve only
+// part of the pipeline of peerID for candidates.
+func (m *Manager) ReservePiecesUpTo(
+	peerID core.PeerID,
+	candidates *bitset.BitSet,
+	numPeersByPiece syncutil.Counters,
+	allowDuplicates bool,
+	limit int) ([]int, error) {
+
 	m.Lock()
 	defer m.Unlock()
 
+	now := m.clock.Now()
+	for i, e := candidates.NextSet(0); e; i, e = candidates.NextSet(i + 1) {
+		if m.completed[int(i)] {
+			continue
+		}
+		if _, ok := m.unrequestedSince[int(i)]; !ok && len(m.requests[int(i)]) == 0 {
+			m.unrequestedSince[int(i)] = now
+		}
+	}
+
 	quota := m.requestQuota(peerID)
+	if room := limit - m.numPending(peerID); room < quota {
+		quota = room
+	}
 	if quota <= 0 {
 		return nil, nil
 	}
 
-	valid := func(i int) bool { return m.validRequest(peerID, i, allowDuplicates) }
-	pieces, err := m.policy.selectPieces(quota, valid, candidates, numPeersByPiece)
-	if err != nil {
-		return nil, err
+	var pieces []int
+	if len(m.priority) > 0 {
+		prioritized := m.prioritized(candidates)
+		valid := func(i int) bool { return m.validHedge(peerID, i) }
+		ps, err := m.policy.selectPieces(quota, valid, prioritized, numPeersByPiece)
+		if err != nil {
+			return nil, err
+		}
+		pieces = append(pieces, ps...)
+		quota -= len(ps)
+		candidates = candidates.Difference(prioritized)
+	}
+	if len(m.preferred) > 0 && quota > 0 {
+		preferred := m.selectable(candidates, m.preferred)
+		dups := allowDuplicates || len(m.preferred) <= m.preferredEndgame
+		valid := func(i int) bool { return m.validRequest(peerID, i, dups) }
+		ps, err := m.policy.selectPieces(quota, valid, preferred, numPeersByPiece)
+		if err != nil {
+			return nil, err
+		}
+		pieces = append(pieces, ps...)
+		quota -= len(ps)
+		candidates = candidates.Difference(preferred)
+	}
+	if quota > 0 {
+		valid := func(i int) bool { return m.validRequest(peerID, i, allowDuplicates) }
+		ps, err := m.policy.selectPieces(quota, valid, candidates, numPeersByPiece)
+		if err != nil {
+			return nil, err
+		}
+		pieces = append(pieces, ps...)
 	}
 
 	// Set as pending in requests map.
 	for _, i := range pieces {
-		r := &Request{
-			Piece:  i,
-			PeerID: peerID,
-			Status: StatusPending,
-			sentAt: m.clock.Now(),
+		delete(m.unrequestedSince, i)
+		var retries int
+		if st, ok := m.retries[i]; ok {
+			retries = st.retries
 		}
-		m.requests[i] = append(m.requests[i], r)
-		if _, ok := m.requestsByPeer[peerID]; !ok {
-			m.requestsByPeer[peerID] = make(map[int]*Request)
-		}
-		m.requestsByPeer[peerID][i] = r
+		m.addRequest(&Request{
+			Piece:   i,
+			PeerID:  peerID,
+			Status:  StatusPending,
+			Retries: retries,
+			sentAt:  now,
+		})
 	}
 
 	return pieces, nil
 }
 
+// SetPipelineBounds allows the pipeline limit of each peer to adapt between min
+// and max, starting at the pipeline limit the Manager was created with. Limits
+// grow by one once a peer returned as many pieces as its limit well under the
+// request timeout in a row, and halve once a request to the peer expired or
+// was invalid. By default, min and max equal the initial limit, i.e. pipeline
+// limits do not adapt.
+func (m *Manager) SetPipelineBounds(min, max int) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.minPipelineLimit = min
+	m.maxPipelineLimit = max
+	for _, d := range m.depths {
+		d.limit = clampInt(d.limit, min, max)
+	}
+}
+
+// SetResendBackoff backs off resends of pieces whose requests keep failing.
+// Once failed requests of a piece were returned by GetFailedRequests, they are
+// withheld for a backoff which starts at initial and doubles with every retry up
+// to max, with jitter such that pieces failing together are not retried
+// together. By default, failed requests are always returned.
+func (m *Manager) SetResendBackoff(initial, max time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.initialBackoff = initial
+	m.maxBackoff = max
+}
+
+// SetHedgeFactor caps the pending requests of each prioritized piece which have
+// not expired yet at factor, i.e. a prioritized piece is reserved under at most
+// factor peers at once. Defaults to 2, i.e. one hedged duplicate on top of the
+// primary request.
+func (m *Manager) SetHedgeFactor(factor int) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.hedgeFactor = factor
+}
+
+// SetMaxReservationsPerPeer caps the total number of outstanding requests of
+// each peer at max, regardless of pipeline limits. Unlike pipeline limits,
+// which only count requests which have not expired yet, the cap counts every
+// request which still awaits a piece, including endgame duplicates and expired
+// requests, such that peers which never return pieces cannot accumulate
+// reservations. Reservations are unlimited if max is zero, the default.
+func (m *Manager) SetMaxReservationsPerPeer(max int) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.maxReservations = max
+}
+
+// HasReservationRoom returns false if peerID is at its reservation cap, i.e.
+// ReservePieces will not reserve any pieces under peerID. See
+// SetMaxReservationsPerPeer.
+func (m *Manager) HasReservationRoom(peerID core.PeerID) bool {
+	m.RLock()
+	defer m.RUnlock()
+
+	return m.reservationRoom(peerID) > 0
+}
+
+// PipelineDepth returns the adaptive pipeline limit of peerID.
+func (m *Manager) PipelineDepth(peerID core.PeerID) int {
+	m.RLock()
+	defer m.RUnlock()
+
+	if d, ok := m.depths[peerID]; ok {
+		return d.limit
+	}
+	return m.pipelineLimit
+}
+
+// RecordPieceReceived grows the pipeline limit of peerID if piece i, which was
+// requested from peerID, was received well under the request timeout. Must be
+// called before the request for i is cleared.
+func (m *Manager) RecordPieceReceived(peerID core.PeerID, i int) {
+	m.Lock()
+	defer m.Unlock()
+
+	r, ok := m.requestsByPeer[peerID][i]
+	if !ok || r.Status != StatusPending {
+		return
+	}
+	d := m.depth(peerID)
+	if m.clock.Now().Sub(r.sentAt) > m.timeout()/fastReceiptDivisor {
+		d.fastReceipts = 0
+		return
+	}
+	d.fastReceipts++
+	if d.fastReceipts >= d.limit {
+		d.limit = clampInt(d.limit+1, m.minPipelineLimit, m.maxPipelineLimit)
+		d.fastReceipts = 0
+	}
+}
+
+// RequestLatency returns how long ago the pending request for piece i was sent
+// to peerID, and the number of retries of i at the time. Returns false if there
+// is no such request. Must be called before the request for i is cleared.
+func (m *Manager) RequestLatency(peerID core.PeerID, i int) (time.Duration, int, bool) {
+	m.RLock()
+	defer m.RUnlock()
+
+	r, ok := m.requestsByPeer[peerID][i]
+	if !ok || r.Status != StatusPending {
+		return 0, 0, false
+	}
+	return m.clock.Now().Sub(r.sentAt), r.Retries, true
+}
+
+// Retries returns the number of times failed requests of piece i were returned
+// by GetFailedRequests, i.e. how often i was retried.
+func (m *Manager) Retries(i int) int {
+	m.RLock()
+	defer m.RUnlock()
+
+	if st, ok := m.retries[i]; ok {
+		return st.retries
+	}
+	return 0
+}
+
+// NumPending returns the number of pending requests which have not expired yet.
+func (m *Manager) NumPending() int {
+	m.RLock()
+	defer m.RUnlock()
+
+	var n int
+	for _, rs := range m.requests {
+		for _, r := range rs {
+			if m.pending(r) {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// Stats returns the number of requests of each status. Pending requests which
+// timed out count as expired.
+func (m *Manager) Stats() Stats {
+	m.RLock()
+	defer m.RUnlock()
+
+	var s Stats
+	for _, rs := range m.requests {
+		for _, r := range rs {
+			switch r.Status {
+			case StatusPending:
+				if m.expired(r) {
+					s.Expired++
+				} else {
+					s.Pending++
+				}
+			case StatusExpired:
+				s.Expired++
+			case StatusUnsent:
+				s.Unsent++
+			case StatusInvalid:
+				s.Invalid++
+			case StatusRejected:
+				s.Rejected++
+			}
+		}
+	}
+	return s
+}
+
+// PeerStateSizes returns the number of peers in each map of m which holds
+// per-peer state. All of them are emptied for a peer by ClearPeer.
+func (m *Manager) PeerStateSizes() map[string]int {
+	m.RLock()
+	defer m.RUnlock()
+
+	return map[string]int{
+		"requests_by_peer": len(m.requestsByPeer),
+		"pipeline_depths":  len(m.depths),
+		"peer_limits":      len(m.peerLimits),
+		"retry_after":      len(m.retryAfter),
+	}
+}
+
+// RecordPieceFailed halves the pipeline limit of peerID after the request for
+// piece i to peerID expired or was invalid. Requests which were sent before the
+// limit was last halved do not halve it again, such that a burst of failures
+// within one pipeline only counts once.
+func (m *Manager) RecordPieceFailed(peerID core.PeerID, i int) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.recordPieceFailed(peerID, i)
+}
+
+// SetPipelineLimit limits the number of pending requests to peerID, in place of
+// its adaptive pipeline limit, until the peer is cleared.
+// Requests already pending beyond limit are kept.
+func (m *Manager) SetPipelineLimit(peerID core.PeerID, limit int) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.peerLimits[peerID] = limit
+}
+
 // MarkUnsent marks the piece request for piece i as unsent.
 func (m *Manager) MarkUnsent(peerID core.PeerID, i int) {
 	m.markStatus(peerID, i, StatusUnsent)
 }
 
-// MarkInvalid marks the piece request for piece i as invalid.
+// MarkInvalid marks the piece request for piece i as invalid, and halves the
+// pipeline limit of peerID as per RecordPieceFailed.
 func (m *Manager) MarkInvalid(peerID core.PeerID, i int) {
-	m.markStatus(peerID, i, StatusInvalid)
+	m.Lock()
+	defer m.Unlock()
+
+	m.recordPieceFailed(peerID, i)
+	m.markStatusLocked(peerID, i, StatusInvalid)
+}
+
+// MarkRejected marks the piece request for piece i as rejected. The pipeline
+// limit of peerID is unaffected.
+func (m *Manager) MarkRejected(peerID core.PeerID, i int) {
+	m.markStatus(peerID, i, StatusRejected)
+}
+
+// MarkRejectedFor marks the piece request for piece i as rejected, like
+// MarkRejected, and withholds i from peerID until retryAfter elapsed, such that
+// i is reserved under other peers meanwhile. Returns false, recording nothing,
+// if peerID has no request for i.
+func (m *Manager) MarkRejectedFor(peerID core.PeerID, i int, retryAfter time.Duration) bool {
+	m.Lock()
+	defer m.Unlock()
+
+	if _, ok := m.requestsByPeer[peerID][i]; !ok {
+		return false
+	}
+	m.markStatusLocked(peerID, i, StatusRejected)
+	pm, ok := m.retryAfter[peerID]
+	if !ok {
+		pm = make(map[int]time.Time)
+		m.retryAfter[peerID] = pm
+	}
+	pm[i] = m.clock.Now().Add(retryAfter)
+	return true
+}
+
+// Prioritize marks pieces to be selected ahead of all other candidates.
+func (m *Manager) Prioritize(pieces []int) {
+	m.Lock()
+	defer m.Unlock()
+
+	for _, i := range pieces {
+		m.priority[i] = true
+	}
+}
+
+// IsPrioritized returns true if piece i was marked by Prioritize.
+func (m *Manager) IsPrioritized(i int) bool {
+	m.RLock()
+	defer m.RUnlock()
+
+	return m.priority[i]
+}
+
+// SetPreferred replaces the preferred pieces, which are selected ahead of all
+// other candidates but prioritized pieces until they complete. Unlike
+// prioritized pieces, preferred pieces are not hedged: they are only duplicated
+// once at most endgameThreshold preferred pieces remain, i.e. in the endgame of
+// the preferred pieces, or if duplicates are allowed anyway.
+func (m *Manager) SetPreferred(pieces []int, endgameThreshold int) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.preferred = make(map[int]bool)
+	for _, i := range pieces {
+		if !m.completed[i] {
+			m.preferred[i] = true
+		}
+	}
+	m.preferredEndgame = endgameThreshold
+}
+
+// Deprioritize clears the priority of pieces and cancels their hedged requests,
+// such that only the earliest pending request of each piece remains. Returns
+// the cancelled requests. Pieces which were never prioritized are ignored.
+func (m *Manager) Deprioritize(pieces []int) []Request {
+	m.Lock()
+	defer m.Unlock()
+
+	var cancelled []Request
+	for _, i := range pieces {
+		if !m.priority[i] {
+			continue
+		}
+		delete(m.priority, i)
+
+		var primary *Request
+		for _, r := range m.requests[i] {
+			if m.pending(r) && (primary == nil || r.sentAt.Before(primary.sentAt)) {
+				primary = r
+			}
+		}
+		if primary == nil {
+			continue
+		}
+		var kept []*Request
+		for _, r := range m.requests[i] {
+			if r != primary && m.pending(r) {
+				m.deleteRequestByPeer(r.PeerID, i)
+				cancelled = append(cancelled, Request{
+					Piece:  r.Piece,
+					PeerID: r.PeerID,
+					Status: r.Status,
+				})
+				continue
+			}
+			kept = append(kept, r)
+		}
+		m.setRequests(i, kept)
+	}
+	return cancelled
 }
 
 // Clear deletes the piece request for piece i. Should be used for freeing up
-// unneeded request bookkeeping.
-func (m *Manager) Clear(i int) {
+// unneeded request bookkeeping. Returns copies of the pending requests for i,
+// which are superseded.
+func (m *Manager) Clear(i int) []Request {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.clear(i)
+}
+
+// MarkComplete clears piece i and refuses to reserve it from now on, as a
+// backstop against requesting pieces which were already received. Returns copies
+// of the pending requests for i, which are superseded.
+func (m *Manager) MarkComplete(i int) []Request {
+	m.Lock()
+	defer m.Unlock()
+
+	m.completed[i] = true
+	return m.clear(i)
+}
+
+// Reset drops all bookkeeping, e.g. once no more pieces will be requested.
+// Returns copies of the requests which were pending, which are superseded.
+func (m *Manager) Reset() []Request {
 	m.Lock()
 	defer m.Unlock()
 
+	var pending []Request
+	for i, rs := range m.requests {
+		for _, r := range rs {
+			if m.pending(r) {
+				pending = append(pending, Request{
+					Piece:  r.Piece,
+					PeerID: r.PeerID,
+					Status: r.Status,
+				})
+			}
+		}
+		m.policy.clear(i)
+	}
+	for i := range m.unrequestedSince {
+		m.policy.clear(i)
+	}
+
+	m.requests = make(map[int][]*Request)
+	m.requestsByPeer = make(map[core.PeerID]map[int]*Request)
+	m.depths = make(map[core.PeerID]*pipelineDepth)
+	m.peerLimits = make(map[core.PeerID]int)
+	m.priority = make(map[int]bool)
+	m.preferred = make(map[int]bool)
+	m.unrequestedSince = make(map[int]time.Time)
+	m.chunks = make(map[int]*bitset.BitSet)
+	m.completed = make(map[int]bool)
+	m.retries = make(map[int]*retryState)
+	m.retryAfter = make(map[core.PeerID]map[int]time.Time)
+	return pending
+}
+
+func (m *Manager) clear(i int) []Request {
+	var pending []Request
+	for _, r := range m.requests[i] {
+		if m.pending(r) {
+			pending = append(pending, Request{
+				Piece:  r.Piece,
+				PeerID: r.PeerID,
+				Status: r.Status,
+			})
+		}
+	}
+
 	delete(m.requests, i)
+	delete(m.priority, i)
+	delete(m.preferred, i)
+	delete(m.unrequestedSince, i)
+	delete(m.chunks, i)
+	delete(m.retries, i)
+	m.policy.clear(i)
+
+	for peerID, pm := range m.retryAfter {
+		delete(pm, i)
+		if len(pm) == 0 {
+			delete(m.retryAfter, peerID)
+		}
+	}
 
 	for peerID, pm := range m.requestsByPeer {
 		delete(pm, i)
@@ -160,10 +708,54 @@ func (m *Manager) Clear(i int) {
 			delete(m.requestsByPeer, peerID)
 		}
 	}
+	return pending
+}
+
+// MarkChunkReceived marks chunk c of piece i, which consists of n chunks, as
+// received. Returns false if the chunk was already received.
+func (m *Manager) MarkChunkReceived(i, c, n int) bool {
+	m.Lock()
+	defer m.Unlock()
+
+	b, ok := m.chunks[i]
+	if !ok {
+		b = bitset.New(uint(n))
+		m.chunks[i] = b
+	}
+	if b.Test(uint(c)) {
+		return false
+	}
+	b.Set(uint(c))
+	return true
+}
+
+// MissingChunks returns the chunks of piece i, which consists of n chunks, which
+// have not been received yet.
+func (m *Manager) MissingChunks(i, n int) []int {
+	m.RLock()
+	defer m.RUnlock()
+
+	var missing []int
+	b := m.chunks[i]
+	for c := 0; c < n; c++ {
+		if b == nil || !b.Test(uint(c)) {
+			missing = append(missing, c)
+		}
+	}
+	return missing
+}
+
+// ClearChunks deletes the received chunks of piece i, e.g. once the assembled
+// piece failed verification.
+func (m *Manager) ClearChunks(i int) {
+	m.Lock()
+	defer m.Unlock()
+
+	delete(m.chunks, i)
 }
 
 // PendingPieces returns the pieces for all pending requests to peerID in sorted
-// order. Intended primarily for testing purposes.
+// order.
 func (m *Manager) PendingPieces(peerID core.PeerID) []int {
 	m.RLock()
 	defer m.RUnlock()
@@ -178,32 +770,271 @@ func (m *Manager) PendingPieces(peerID core.PeerID) []int {
 	return pieces
 }
 
-// ClearPeer deletes all piece requests for peerID.
-func (m *Manager) ClearPeer(peerID core.PeerID) {
+// PendingPiecesByPeer returns the pieces reserved under each peer with pending
+// requests which did not expire yet, in ascending order.
+func (m *Manager) PendingPiecesByPeer() map[core.PeerID][]int {
+	m.RLock()
+	defer m.RUnlock()
+
+	pieces := make(map[core.PeerID][]int)
+	for peerID, rs := range m.requestsByPeer {
+		for i, r := range rs {
+			if m.pending(r) {
+				pieces[peerID] = append(pieces[peerID], i)
+			}
+		}
+	}
+	for _, p := range pieces {
+		sort.Ints(p)
+	}
+	return pieces
+}
+
+// PendingPeers returns the peers holding pending requests for piece i. There
+// may be several if duplicate requests were allowed, e.g. in endgame.
+func (m *Manager) PendingPeers(i int) []core.PeerID {
+	m.RLock()
+	defer m.RUnlock()
+
+	var peers []core.PeerID
+	for _, r := range m.requests[i] {
+		if m.pending(r) {
+			peers = append(peers, r.PeerID)
+		}
+	}
+	return peers
+}
+
+// AwaitingPeers returns the peers whose requests for piece i are still awaited,
+// i.e. pending or expired, since peers may still answer expired requests.
+func (m *Manager) AwaitingPeers(i int) []core.PeerID {
+	m.RLock()
+	defer m.RUnlock()
+
+	var peers []core.PeerID
+	for _, r := range m.requests[i] {
+		if r.Status == StatusPending || r.Status == StatusExpired {
+			peers = append(peers, r.PeerID)
+		}
+	}
+	return peers
+}
+
+// ClearPeer deletes all piece requests for peerID. Returns copies of the deleted
+// requests which were still awaited, i.e. pending or expired, which must be
+// resent elsewhere. Expired requests are returned as well, since once deleted,
+// GetFailedRequests no longer returns them for resending.
+func (m *Manager) ClearPeer(peerID core.PeerID) []Request {
 	m.Lock()
 	defer m.Unlock()
 
+	var cleared []Request
+	for i, r := range m.requestsByPeer[peerID] {
+		if r.Status != StatusPending {
+			continue
+		}
+		status := StatusPending
+		if m.expired(r) {
+			status = StatusExpired
+		}
+		cleared = append(cleared, Request{
+			Piece:  i,
+			PeerID: peerID,
+			Status: status,
+		})
+	}
+	sort.Slice(cleared, func(a, b int) bool { return cleared[a].Piece < cleared[b].Piece })
+
 	delete(m.requestsByPeer, peerID)
+	delete(m.depths, peerID)
+	delete(m.peerLimits, peerID)
+	delete(m.retryAfter, peerID)
 
 	for i, rs := range m.requests {
-		for j, r := range rs {
-			if r.PeerID == peerID {
-				// Eject request.
-				rs[j] = rs[len(rs)-1]
-				m.requests[i] = rs[:len(rs)-1]
-				break
+		var kept []*Request
+		for _, r := range rs {
+			if r.PeerID != peerID {
+				kept = append(kept, r)
 			}
 		}
+		m.setRequests(i, kept)
 	}
+	return cleared
 }
 
-// GetFailedRequests returns a copy of all failed piece requests.
-func (m *Manager) GetFailedRequests() []Request {
+// ClearRequests deletes all piece requests, but keeps what was learned about
+// pieces and peers, e.g. priorities, retry backoff and pipeline limits, such
+// that pieces may be requested again later as if the requests were never sent.
+// Returns copies of the deleted requests which were still awaited, sorted by
+// piece.
+func (m *Manager) ClearRequests() []Request {
+	m.Lock()
+	defer m.Unlock()
+
+	var cleared []Request
+	for i, rs := range m.requests {
+		for _, r := range rs {
+			if r.Status == StatusPending {
+				cleared = append(cleared, Request{
+					Piece:  i,
+					PeerID: r.PeerID,
+					Status: StatusPending,
+				})
+			}
+		}
+	}
+	sort.Slice(cleared, func(a, b int) bool {
+		if cleared[a].Piece != cleared[b].Piece {
+			return cleared[a].Piece < cleared[b].Piece
+		}
+		return cleared[a].PeerID.LessThan(cleared[b].PeerID)
+	})
+
+	m.requests = make(map[int][]*Request)
+	m.requestsByPeer = make(map[core.PeerID]map[int]*Request)
+	m.retryAfter = make(map[core.PeerID]map[int]time.Time)
+	return cleared
+}
+
+// ReconcileSlots recomputes the requests which count against the pipeline limit
+// of each peer from the requests of each piece, which are authoritative, and
+// discards all but the latest request of a piece to the same peer. Returns the
+// number of corrected requests, which is zero unless bookkeeping was
+// inconsistent.
+func (m *Manager) ReconcileSlots() int {
+	m.Lock()
+	defer m.Unlock()
+
+	var corrections int
+	byPeer := make(map[core.PeerID]map[int]*Request)
+	for i, rs := range m.requests {
+		for _, r := range rs {
+			pm, ok := byPeer[r.PeerID]
+			if !ok {
+				pm = make(map[int]*Request)
+				byPeer[r.PeerID] = pm
+			}
+			if prev, ok := pm[i]; ok {
+				corrections++
+				if prev.sentAt.After(r.sentAt) {
+					continue
+				}
+			}
+			pm[i] = r
+		}
+		var kept []*Request
+		for _, r := range rs {
+			if byPeer[r.PeerID][i] == r {
+				kept = append(kept, r)
+			}
+		}
+		m.setRequests(i, kept)
+	}
+	for peerID, pm := range byPeer {
+		for i, r := range pm {
+			if m.requestsByPeer[peerID][i] != r {
+				corrections++
+			}
+		}
+	}
+	for peerID, pm := range m.requestsByPeer {
+		for i := range pm {
+			if _, ok := byPeer[peerID][i]; !ok {
+				corrections++
+			}
+		}
+	}
+	m.requestsByPeer = byPeer
+	return corrections
+}
+
+// NextRound ends the current piece selection round. Under the rarest first
+// policy, pieces which were candidates but were not selected during the round
+// are aged once, no matter how often pieces were reserved within the round.
+func (m *Manager) NextRound() {
+	m.Lock()
+	defer m.Unlock()
+
+	m.policy.nextRound()
+}
+
+// OldestUnrequestedAge returns how long the oldest candidate piece has gone
+// without being requested. Returns 0 if there are no such pieces.
+func (m *Manager) OldestUnrequestedAge() time.Duration {
 	m.RLock()
 	defer m.RUnlock()
 
+	var oldest time.Duration
+	now := m.clock.Now()
+	for _, t := range m.unrequestedSince {
+		if age := now.Sub(t); age > oldest {
+			oldest = age
+		}
+	}
+	return oldest
+}
+
+// ClearUnknownPeers deletes all piece requests to peers for which known returns
+// false, returning copies of the deleted requests.
+func (m *Manager) ClearUnknownPeers(known func(core.PeerID) bool) []Request {
+	m.Lock()
+	defer m.Unlock()
+
+	var cleared []Request
+	for i, rs := range m.requests {
+		var kept []*Request
+		for _, r := range rs {
+			if known(r.PeerID) {
+				kept = append(kept, r)
+				continue
+			}
+			cleared = append(cleared, Request{
+				Piece:  r.Piece,
+				PeerID: r.PeerID,
+				Status: r.Status,
+			})
+		}
+		m.setRequests(i, kept)
+	}
+	for peerID := range m.requestsByPeer {
+		if !known(peerID) {
+			delete(m.requestsByPeer, peerID)
+		}
+	}
+	for peerID := range m.peerLimits {
+		if !known(peerID) {
+			delete(m.peerLimits, peerID)
+		}
+	}
+	return cleared
+}
+
+// GetFailedRequests returns a copy of all failed piece requests, excluding pieces
+// under resend backoff (see SetResendBackoff). A piece is backed off once all of
+// its requests failed, and its backoff is extended every time its requests are
+// returned, on the assumption that the caller resends them.
+func (m *Manager) GetFailedRequests() []Request {
+	m.Lock()
+	defer m.Unlock()
+
+	now := m.clock.Now()
 	var failed []Request
-	for _, rs := range m.requests {
+	for i, rs := range m.requests {
+		var pending bool
+		for _, r := range rs {
+			if m.pending(r) {
+				pending = true
+			}
+		}
+		st, ok := m.retries[i]
+		if ok && !pending && now.Before(st.eligibleAt) {
+			continue
+		}
+		var retries int
+		if ok {
+			retries = st.retries
+		}
+		n := len(failed)
 		for _, r := range rs {
 			status := r.Status
 			if status == StatusPending && m.expired(r) {
@@ -211,17 +1042,120 @@ func (m *Manager) GetFailedRequests() []Request {
 			}
 			if status != StatusPending {
 				failed = append(failed, Request{
-					Piece:  r.Piece,
-					PeerID: r.PeerID,
-					Status: status,
+					Piece:   r.Piece,
+					PeerID:  r.PeerID,
+					Status:  status,
+					Retries: retries,
 				})
 			}
 		}
+		if len(failed) > n && !pending {
+			if !ok {
+				st = &retryState{}
+				m.retries[i] = st
+			}
+			st.retries++
+			if m.maxBackoff > 0 {
+				st.eligibleAt = now.Add(m.backoff(st.retries))
+			}
+		}
 	}
 	return failed
 }
 
+// backoff returns the jittered resend backoff after the given number of retries,
+// which lies within the upper half of the exponential backoff.
+func (m *Manager) backoff(retries int) time.Duration {
+	d := m.initialBackoff
+	for j := 1; j < retries && d < m.maxBackoff; j++ {
+		d *= 2
+	}
+	if d > m.maxBackoff {
+		d = m.maxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func (m *Manager) prioritized(candidates *bitset.BitSet) *bitset.BitSet {
+	return m.selectable(candidates, m.priority)
+}
+
+// selectable returns the candidates which are in pieces.
+func (m *Manager) selectable(candidates *bitset.BitSet, pieces map[int]bool) *bitset.BitSet {
+	b := bitset.New(candidates.Len())
+	for i := range pieces {
+		if candidates.Test(uint(i)) {
+			b.Set(uint(i))
+		}
+	}
+	return b
+}
+
+func (m *Manager) pending(r *Request) bool {
+	return r.Status == StatusPending && !m.expired(r)
+}
+
+// setRequests replaces the requests of piece i with rs, deleting the entry of i
+// once no requests remain.
+func (m *Manager) setRequests(i int, rs []*Request) {
+	if len(rs) == 0 {
+		delete(m.requests, i)
+		return
+	}
+	m.requests[i] = rs
+}
+
+// addRequest adds r to both request indices, replacing any previous request of
+// the same piece to the same peer, such that the indices always agree on which
+// requests count against the pipeline limit of the peer.
+func (m *Manager) addRequest(r *Request) {
+	rs := m.requests[r.Piece]
+	replaced := false
+	for j, prev := range rs {
+		if prev.PeerID == r.PeerID {
+			rs[j] = r
+			replaced = true
+			break
+		}
+	}
+	if !replaced {
+		m.requests[r.Piece] = append(rs, r)
+	}
+	pm, ok := m.requestsByPeer[r.PeerID]
+	if !ok {
+		pm = make(map[int]*Request)
+		m.requestsByPeer[r.PeerID] = pm
+	}
+	pm[r.Piece] = r
+}
+
+func (m *Manager) deleteRequestByPeer(peerID core.PeerID, i int) {
+	pm, ok := m.requestsByPeer[peerID]
+	if !ok {
+		return
+	}
+	delete(pm, i)
+	if len(pm) == 0 {
+		delete(m.requestsByPeer, peerID)
+	}
+}
+
 func (m *Manager) validRequest(peerID core.PeerID, i int, allowDuplicates bool) bool {
+	if m.completed[i] {
+		return false
+	}
+	if t, ok := m.retryAfter[peerID][i]; ok {
+		if m.clock.Now().Before(t) {
+			return false
+		}
+		delete(m.retryAfter[peerID], i)
+		if len(m.retryAfter[peerID]) == 0 {
+			delete(m.retryAfter, peerID)
+		}
+	}
 	for _, r := range m.requests[i] {
 		if r.Status == StatusPending && !m.expired(r) {
 			if r.PeerID == peerID {
@@ -235,14 +1169,31 @@ func (m *Manager) validRequest(peerID core.PeerID, i int, allowDuplicates bool)
 	return true
 }
 
+// validHedge returns whether prioritized piece i may be reserved under peerID,
+// i.e. whether it is a valid duplicate and fewer than hedgeFactor requests of i
+// are pending.
+func (m *Manager) validHedge(peerID core.PeerID, i int) bool {
+	if !m.validRequest(peerID, i, true) {
+		return false
+	}
+	var pending int
+	for _, r := range m.requests[i] {
+		if m.pending(r) {
+			pending++
+		}
+	}
+	return pending < m.hedgeFactor
+}
+
 func (m *Manager) requestQuota(peerID core.PeerID) int {
 	quota := m.pipelineLimit
-	pm, ok := m.requestsByPeer[peerID]
-	if !ok {
-		return quota
+	if d, ok := m.depths[peerID]; ok {
+		quota = d.limit
 	}
-
-	for _, r := range pm {
+	if limit, ok := m.peerLimits[peerID]; ok {
+		quota = limit
+	}
+	for _, r := range m.requestsByPeer[peerID] {
 		if r.Status == StatusPending && !m.expired(r) {
 			quota--
 			if quota == 0 {
@@ -250,12 +1201,42 @@ func (m *Manager) requestQuota(peerID core.PeerID) int {
 			}
 		}
 	}
+	if room := m.reservationRoom(peerID); room < quota {
+		quota = room
+	}
 
 	return quota
 }
 
+// numPending returns the number of pending requests to peerID which have not
+// expired yet.
+func (m *Manager) numPending(peerID core.PeerID) int {
+	var n int
+	for _, r := range m.requestsByPeer[peerID] {
+		if m.pending(r) {
+			n++
+		}
+	}
+	return n
+}
+
+// reservationRoom returns how many more pieces may be reserved under peerID
+// before it reaches the reservation cap, counting expired requests.
+func (m *Manager) reservationRoom(peerID core.PeerID) int {
+	if m.maxReservations <= 0 {
+		return math.MaxInt32
+	}
+	room := m.maxReservations
+	for _, r := range m.requestsByPeer[peerID] {
+		if r.Status == StatusPending {
+			room--
+		}
+	}
+	return room
+}
+
 func (m *Manager) expired(r *Request) bool {
-	expiresAt := r.sentAt.Add(m.timeout)
+	expiresAt := r.sentAt.Add(m.timeout())
 	return m.clock.Now().After(expiresAt)
 }
 
@@ -263,9 +1244,57 @@ func (m *Manager) markStatus(peerID core.PeerID, i int, s Status) {
 	m.Lock()
 	defer m.Unlock()
 
+	m.markStatusLocked(peerID, i, s)
+}
+
+func (m *Manager) markStatusLocked(peerID core.PeerID, i int, s Status) {
 	for _, r := range m.requests[i] {
 		if r.PeerID == peerID {
 			r.Status = s
 		}
 	}
 }
+
+func (m *Manager) recordPieceFailed(peerID core.PeerID, i int) {
+	r, ok := m.requestsByPeer[peerID][i]
+	if !ok {
+		return
+	}
+	d := m.depth(peerID)
+	if r.sentAt.Before(d.shrunkAt) {
+		return
+	}
+	d.limit = clampInt(d.limit/2, m.minPipelineLimit, m.maxPipelineLimit)
+	d.fastReceipts = 0
+	d.shrunkAt = m.clock.Now()
+}
+
+func (m *Manager) depth(peerID core.PeerID) *pipelineDepth {
+	d, ok := m.depths[peerID]
+	if !ok {
+		d = &pipelineDepth{limit: m.pipelineLimit}
+		m.depths[peerID] = d
+	}
+	return d
+}
+
+// pipelineDepth is the adaptive pipeline limit of a peer.
+type pipelineDepth struct {
+	limit int
+
+	// Pieces received well under the request timeout since limit last changed.
+	fastReceipts int
+
+	// When limit was last halved.
+	shrunkAt time.Time
+}
+
+func clampInt(n, min, max int) int {
+	if n < min {
+		return min
+	}
+	if n > max {
+		return max
+	}
+	return n
+}
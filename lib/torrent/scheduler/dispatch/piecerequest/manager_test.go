@@ -14,11 +14,14 @@
 package piecerequest
 
 import (
+	"math/rand"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/andres-erbsen/clock"
 	"github.com/stretchr/testify/require"
+	"github.com/willf/bitset"
 
 	"github.com/uber/kraken/core"
 	"github.com/uber/kraken/utils/bitsetutil"
@@ -31,7 +34,7 @@ func newManager(
 	policy string,
 	pipelineLimit int) *Manager {
 
-	m, err := NewManager(clk, timeout, policy, pipelineLimit)
+	m, err := NewManager(clk, FixedTimeout(timeout), policy, pipelineLimit, 0)
 	if err != nil {
 		panic(err)
 	}
@@ -62,6 +65,41 @@ func TestManagerPipelineLimit(t *testing.T) {
 	require.Len(m.PendingPieces(peerID), 3)
 }
 
+func TestManagerReservePiecesUpTo(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+	m := newManager(clk, 5*time.Second, SequentialPolicy, 4)
+
+	peerID := core.PeerIDFixture()
+	counts := countsFromInts(0, 0, 0, 0, 0, 0)
+
+	pieces, err := m.ReservePieces(peerID, bitsetutil.FromBools(true), counts, false)
+	require.NoError(err)
+	require.Equal([]int{0}, pieces)
+
+	// The pending request counts against the limit.
+	all := bitsetutil.FromBools(true, true, true, true, true, true)
+	pieces, err = m.ReservePiecesUpTo(peerID, all, counts, false, 2)
+	require.NoError(err)
+	require.Equal([]int{1}, pieces)
+
+	pieces, err = m.ReservePiecesUpTo(peerID, all, counts, false, 2)
+	require.NoError(err)
+	require.Empty(pieces)
+
+	// Expired requests do not.
+	clk.Add(5*time.Second + 1)
+	pieces, err = m.ReservePiecesUpTo(peerID, all, counts, false, 1)
+	require.NoError(err)
+	require.Equal([]int{0}, pieces)
+
+	// The pipeline limit still applies.
+	pieces, err = m.ReservePiecesUpTo(peerID, all, counts, false, 10)
+	require.NoError(err)
+	require.Equal([]int{1, 2, 3}, pieces)
+}
+
 func TestManagerReserveExpiredRequest(t *testing.T) {
 	require := require.New(t)
 
@@ -203,6 +241,67 @@ func TestManagerGetFailedRequests(t *testing.T) {
 	require.Contains(failed, Request{Piece: 2, PeerID: p2, Status: StatusExpired})
 }
 
+func TestManagerResendBackoff(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+
+	m := newManager(clk, 5*time.Second, DefaultPolicy, 1)
+	m.SetResendBackoff(time.Second, 8*time.Second)
+
+	p0 := core.PeerIDFixture()
+	p1 := core.PeerIDFixture()
+
+	pieces, err := m.ReservePieces(p0, bitsetutil.FromBools(true), countsFromInts(1), false)
+	require.NoError(err)
+	require.Equal([]int{0}, pieces)
+	m.MarkInvalid(p0, 0)
+
+	// The first failure is returned immediately, and then backed off.
+	require.Equal([]Request{{Piece: 0, PeerID: p0, Status: StatusInvalid}}, m.GetFailedRequests())
+	require.Empty(m.GetFailedRequests())
+
+	clk.Add(time.Second)
+	require.Equal(
+		[]Request{{Piece: 0, PeerID: p0, Status: StatusInvalid, Retries: 1}}, m.GetFailedRequests())
+
+	// The backoff doubles, with jitter within its upper half.
+	clk.Add(999 * time.Millisecond)
+	require.Empty(m.GetFailedRequests())
+	clk.Add(time.Second + time.Millisecond)
+	require.Equal(
+		[]Request{{Piece: 0, PeerID: p0, Status: StatusInvalid, Retries: 2}}, m.GetFailedRequests())
+
+	// The backoff is capped.
+	for retries := 3; retries < 6; retries++ {
+		clk.Add(8 * time.Second)
+		require.Equal(
+			[]Request{{Piece: 0, PeerID: p0, Status: StatusInvalid, Retries: retries}},
+			m.GetFailedRequests())
+	}
+	clk.Add(3999 * time.Millisecond)
+	require.Empty(m.GetFailedRequests())
+
+	// Pieces with pending requests are not backed off, since they do not fail
+	// entirely.
+	pieces, err = m.ReservePieces(p1, bitsetutil.FromBools(true), countsFromInts(1), false)
+	require.NoError(err)
+	require.Equal([]int{0}, pieces)
+	for j := 0; j < 2; j++ {
+		require.Equal(
+			[]Request{{Piece: 0, PeerID: p0, Status: StatusInvalid, Retries: 6}}, m.GetFailedRequests())
+	}
+
+	// Clearing the piece resets its backoff.
+	m.MarkInvalid(p1, 0)
+	m.Clear(0)
+	pieces, err = m.ReservePieces(p1, bitsetutil.FromBools(true), countsFromInts(1), false)
+	require.NoError(err)
+	require.Equal([]int{0}, pieces)
+	m.MarkInvalid(p1, 0)
+	require.Equal([]Request{{Piece: 0, PeerID: p1, Status: StatusInvalid}}, m.GetFailedRequests())
+}
+
 func TestManagerClear(t *testing.T) {
 	require := require.New(t)
 
@@ -217,9 +316,10 @@ func TestManagerClear(t *testing.T) {
 
 	require.Len(m.PendingPieces(peerID), 1)
 
-	m.Clear(0)
+	require.Equal([]Request{{Piece: 0, PeerID: peerID, Status: StatusPending}}, m.Clear(0))
 
 	require.Empty(m.PendingPieces(peerID))
+	require.Empty(m.Clear(0))
 }
 
 func TestManagerClearPeer(t *testing.T) {
@@ -245,10 +345,101 @@ func TestManagerClearPeer(t *testing.T) {
 	require.NoError(err)
 	require.Equal([]int{1}, pieces)
 
-	m.ClearPeer(p1)
+	require.Equal([]Request{{Piece: 0, PeerID: p1, Status: StatusPending}}, m.ClearPeer(p1))
 
 	require.Empty(m.PendingPieces(p1))
 	require.Equal([]int{1}, m.PendingPieces(p2))
+	require.Empty(m.ClearPeer(p1))
+}
+
+func TestManagerClearPeerReturnsExpiredRequests(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+	m := newManager(clk, 5*time.Second, DefaultPolicy, 1)
+
+	p := core.PeerIDFixture()
+
+	pieces, err := m.ReservePieces(p, bitsetutil.FromBools(true, false),
+		countsFromInts(0, 0), false)
+	require.NoError(err)
+	require.Equal([]int{0}, pieces)
+
+	clk.Add(6 * time.Second)
+
+	pieces, err = m.ReservePieces(p, bitsetutil.FromBools(false, true),
+		countsFromInts(0, 0), false)
+	require.NoError(err)
+	require.Equal([]int{1}, pieces)
+
+	require.Equal([]Request{
+		{Piece: 0, PeerID: p, Status: StatusExpired},
+		{Piece: 1, PeerID: p, Status: StatusPending},
+	}, m.ClearPeer(p))
+}
+
+func TestManagerClearRequests(t *testing.T) {
+	require := require.New(t)
+
+	m := newManager(clock.NewMock(), 5*time.Second, DefaultPolicy, 1)
+
+	p1 := core.PeerIDFixture()
+	p2 := core.PeerIDFixture()
+
+	m.Prioritize([]int{1})
+
+	pieces, err := m.ReservePieces(p1, bitsetutil.FromBools(true, true, false),
+		countsFromInts(0, 0, 0), false)
+	require.NoError(err)
+	require.Equal([]int{1}, pieces)
+
+	pieces, err = m.ReservePieces(p2, bitsetutil.FromBools(true, false, true),
+		countsFromInts(0, 0, 0), false)
+	require.NoError(err)
+	require.Len(pieces, 1)
+	m.MarkInvalid(p2, pieces[0])
+
+	require.Equal([]Request{{Piece: 1, PeerID: p1, Status: StatusPending}}, m.ClearRequests())
+	require.Empty(m.PendingPieces(p1))
+	require.Empty(m.GetFailedRequests())
+	require.Empty(m.ClearRequests())
+
+	// Priorities survive, so the prioritized piece is requested first again.
+	require.True(m.IsPrioritized(1))
+	pieces, err = m.ReservePieces(p2, bitsetutil.FromBools(true, true, true),
+		countsFromInts(0, 0, 0), false)
+	require.NoError(err)
+	require.Equal([]int{1}, pieces)
+}
+
+func TestManagerReset(t *testing.T) {
+	require := require.New(t)
+
+	m := newManager(clock.NewMock(), 5*time.Second, DefaultPolicy, 1)
+
+	p1 := core.PeerIDFixture()
+	p2 := core.PeerIDFixture()
+
+	pieces, err := m.ReservePieces(p1, bitsetutil.FromBools(true, false, false),
+		countsFromInts(0, 0, 0), false)
+	require.NoError(err)
+	require.Equal([]int{0}, pieces)
+	m.MarkComplete(1)
+	m.Prioritize([]int{2})
+	require.True(m.MarkChunkReceived(2, 0, 2))
+
+	require.Equal([]Request{{Piece: 0, PeerID: p1, Status: StatusPending}}, m.Reset())
+
+	require.Empty(m.PendingPiecesByPeer())
+	require.Equal(0, m.NumPending())
+	require.Equal([]int{0, 1}, m.MissingChunks(2, 2))
+	require.Empty(m.Reset())
+
+	// Neither completed nor prioritized pieces are remembered.
+	pieces, err = m.ReservePieces(p2, bitsetutil.FromBools(false, true, false),
+		countsFromInts(0, 0, 0), false)
+	require.NoError(err)
+	require.Equal([]int{1}, pieces)
 }
 
 func TestManagerReservePiecesAllowDuplicate(t *testing.T) {
@@ -406,3 +597,988 @@ func TestRarestFirstPolicy(t *testing.T) {
 	require.NoError(err)
 	require.Empty(pieces)
 }
+
+func TestRarestFirstPolicyBreaksTiesRandomly(t *testing.T) {
+	require := require.New(t)
+
+	// Piece 0 is rarest, while pieces 1-4 are equally rare.
+	candidates := bitset.New(5).Complement()
+	counts := countsFromInts(1, 2, 2, 2, 2)
+
+	seen := make(map[int]bool)
+	for i := 0; i < 100; i++ {
+		m := newManager(clock.NewMock(), 5*time.Second, RarestFirstPolicy, 2)
+		pieces, err := m.ReservePieces(core.PeerIDFixture(), candidates, counts, false)
+		require.NoError(err)
+		require.Len(pieces, 2)
+		require.Equal(0, pieces[0])
+		seen[pieces[1]] = true
+	}
+	require.Len(seen, 4)
+}
+
+// simulateChurn reserves a single piece per round from each of several new
+// peers under continuous churn, where piece 0 is always just above the rarest
+// piece. Returns the maximum number of consecutive rounds any piece went
+// unselected.
+func simulateChurn(t *testing.T, agingRate float64, numPieces, rounds int) int {
+	m, err := NewManager(clock.NewMock(), FixedTimeout(5*time.Second), RarestFirstPolicy, 1, agingRate)
+	require.NoError(t, err)
+
+	candidates := bitset.New(uint(numPieces)).Complement()
+	rng := rand.New(rand.NewSource(0))
+
+	lastSelected := make([]int, numPieces)
+	var maxWait int
+	for round := 1; round <= rounds; round++ {
+		counts := syncutil.NewCounters(numPieces)
+		rarest := 1 + rng.Intn(numPieces-1)
+		for i := 1; i < numPieces; i++ {
+			counts.Set(i, 3+rng.Intn(3))
+		}
+		counts.Set(rarest, 1)
+		counts.Set(0, 2)
+
+		// Multiple selections within a round only age skipped pieces once.
+		for j := 0; j < 3; j++ {
+			peerID := core.PeerIDFixture()
+			pieces, err := m.ReservePieces(peerID, candidates, counts, false)
+			require.NoError(t, err)
+			require.Len(t, pieces, 1)
+			lastSelected[pieces[0]] = round
+
+			// Peer leaves before the piece arrives.
+			m.ClearPeer(peerID)
+		}
+		m.NextRound()
+
+		for i := 0; i < numPieces; i++ {
+			if wait := round - lastSelected[i]; wait > maxWait {
+				maxWait = wait
+			}
+		}
+	}
+	return maxWait
+}
+
+func TestRarestFirstPolicyAgingPreventsStarvation(t *testing.T) {
+	numPieces := 10
+	rounds := 1000
+
+	// Without aging, piece 0 is never selected.
+	require.Equal(t, rounds, simulateChurn(t, 0, numPieces, rounds))
+
+	// With aging, every piece is selected within a bounded number of rounds.
+	require.True(t, simulateChurn(t, 0.5, numPieces, rounds) <= 2*numPieces)
+}
+
+func TestRarestFirstPolicyAgesOncePerRound(t *testing.T) {
+	require := require.New(t)
+
+	m, err := NewManager(clock.NewMock(), FixedTimeout(5*time.Second), RarestFirstPolicy, 1, 0.4)
+	require.NoError(err)
+
+	candidates := bitsetutil.FromBools(true, true)
+	counts := countsFromInts(2, 1)
+
+	reserve := func() int {
+		peerID := core.PeerIDFixture()
+		pieces, err := m.ReservePieces(peerID, candidates, counts, false)
+		require.NoError(err)
+		require.Len(pieces, 1)
+		m.ClearPeer(peerID)
+		return pieces[0]
+	}
+
+	// Piece 0 is not aged by selections within a round.
+	for i := 0; i < 10; i++ {
+		require.Equal(1, reserve())
+	}
+
+	// After two rounds, piece 0 improved by 0.8 and is still less rare than
+	// piece 1.
+	m.NextRound()
+	require.Equal(1, reserve())
+	m.NextRound()
+	for i := 0; i < 10; i++ {
+		require.Equal(1, reserve())
+	}
+
+	// After three rounds, piece 0 improved by 1.2 and is rarer than piece 1.
+	m.NextRound()
+	require.Equal(0, reserve())
+}
+
+func TestManagerOldestUnrequestedAge(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+	m := newManager(clk, time.Hour, RarestFirstPolicy, 1)
+
+	require.Equal(time.Duration(0), m.OldestUnrequestedAge())
+
+	p1 := core.PeerIDFixture()
+	p2 := core.PeerIDFixture()
+
+	pieces, err := m.ReservePieces(p1, bitsetutil.FromBools(true, true),
+		countsFromInts(1, 2), false)
+	require.NoError(err)
+	require.Equal([]int{0}, pieces)
+
+	clk.Add(time.Minute)
+	require.Equal(time.Minute, m.OldestUnrequestedAge())
+
+	pieces, err = m.ReservePieces(p2, bitsetutil.FromBools(true, true),
+		countsFromInts(1, 2), false)
+	require.NoError(err)
+	require.Equal([]int{1}, pieces)
+
+	require.Equal(time.Duration(0), m.OldestUnrequestedAge())
+}
+
+func TestManagerPrioritizedPiecesSelectedFirstAndHedged(t *testing.T) {
+	require := require.New(t)
+
+	m := newManager(clock.NewMock(), 5*time.Second, RarestFirstPolicy, 2)
+
+	p1 := core.PeerIDFixture()
+	p2 := core.PeerIDFixture()
+
+	m.Prioritize([]int{2, 3})
+	require.True(m.IsPrioritized(2))
+	require.False(m.IsPrioritized(1))
+
+	pieces, err := m.ReservePieces(p1, bitsetutil.FromBools(true, true, true, true),
+		countsFromInts(0, 0, 1, 2), false)
+	require.NoError(err)
+	require.Equal([]int{2, 3}, pieces)
+
+	// Prioritized pieces may be duplicated even when duplicates are not allowed.
+	pieces, err = m.ReservePieces(p2, bitsetutil.FromBools(true, true, true, true),
+		countsFromInts(0, 0, 1, 2), false)
+	require.NoError(err)
+	require.Equal([]int{2, 3}, pieces)
+}
+
+func TestManagerHedgesPrioritizedPiecesUpToHedgeFactor(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+	m := newManager(clk, 5*time.Second, DefaultPolicy, 4)
+
+	m.Prioritize([]int{0})
+
+	// Of many peers, only the primary and one hedge reserve the piece, and the
+	// others fall back to the remaining candidates.
+	for i := 0; i < 10; i++ {
+		pieces, err := m.ReservePieces(core.PeerIDFixture(), bitsetutil.FromBools(true, true),
+			countsFromInts(10, 10), false)
+		require.NoError(err)
+		if i < 2 {
+			require.Contains(pieces, 0)
+		} else {
+			require.NotContains(pieces, 0)
+		}
+	}
+	require.Len(m.PendingPeers(0), 2)
+
+	// Expired requests leave room for new hedges.
+	clk.Add(6 * time.Second)
+	m.SetHedgeFactor(3)
+	for i := 0; i < 10; i++ {
+		_, err := m.ReservePieces(core.PeerIDFixture(), bitsetutil.FromBools(true, true),
+			countsFromInts(10, 10), false)
+		require.NoError(err)
+	}
+	require.Len(m.PendingPeers(0), 3)
+}
+
+func TestManagerSequentialPolicy(t *testing.T) {
+	require := require.New(t)
+
+	m := newManager(clock.NewMock(), 5*time.Second, SequentialPolicy, 2)
+
+	candidates := bitsetutil.FromBools(true, true, false, true, true, true)
+	counts := countsFromInts(3, 2, 0, 1, 0, 0)
+
+	pieces, err := m.ReservePieces(core.PeerIDFixture(), candidates, counts, false)
+	require.NoError(err)
+	require.Equal([]int{0, 1}, pieces)
+
+	pieces, err = m.ReservePieces(core.PeerIDFixture(), candidates, counts, false)
+	require.NoError(err)
+	require.Equal([]int{3, 4}, pieces)
+}
+
+func TestManagerPreferredPieces(t *testing.T) {
+	require := require.New(t)
+
+	m := newManager(clock.NewMock(), 5*time.Second, SequentialPolicy, 2)
+
+	candidates := bitsetutil.FromBools(true, true, true, true, true, true)
+	counts := countsFromInts(0, 0, 0, 0, 0, 0)
+
+	m.SetPreferred([]int{3, 4, 5}, 1)
+
+	pieces, err := m.ReservePieces(core.PeerIDFixture(), candidates, counts, false)
+	require.NoError(err)
+	require.Equal([]int{3, 4}, pieces)
+
+	// Preferred pieces are not hedged outside of their endgame, so selection
+	// falls back to the other candidates.
+	pieces, err = m.ReservePieces(core.PeerIDFixture(), candidates, counts, false)
+	require.NoError(err)
+	require.Equal([]int{5, 0}, pieces)
+
+	// Once at most the endgame threshold of preferred pieces remain, they are
+	// duplicated.
+	m.MarkComplete(3)
+	m.MarkComplete(5)
+	pieces, err = m.ReservePieces(core.PeerIDFixture(), candidates, counts, false)
+	require.NoError(err)
+	require.Equal([]int{4, 1}, pieces)
+
+	// Selection is back to normal once preferred pieces complete.
+	m.MarkComplete(4)
+	pieces, err = m.ReservePieces(core.PeerIDFixture(), candidates, counts, false)
+	require.NoError(err)
+	require.Equal([]int{2}, pieces)
+}
+
+func TestManagerDeprioritize(t *testing.T) {
+	require := require.New(t)
+
+	m := newManager(clock.NewMock(), 5*time.Second, DefaultPolicy, 2)
+
+	p1 := core.PeerIDFixture()
+	p2 := core.PeerIDFixture()
+
+	m.Prioritize([]int{0})
+
+	pieces, err := m.ReservePieces(p1, bitsetutil.FromBools(true, true),
+		countsFromInts(0, 0), false)
+	require.NoError(err)
+	require.Equal([]int{0, 1}, pieces)
+
+	pieces, err = m.ReservePieces(p2, bitsetutil.FromBools(true, true),
+		countsFromInts(0, 0), false)
+	require.NoError(err)
+	require.Equal([]int{0}, pieces)
+
+	cancelled := m.Deprioritize([]int{0, 1})
+	require.Equal([]Request{{Piece: 0, PeerID: p2, Status: StatusPending}}, cancelled)
+
+	require.Equal([]int{0, 1}, m.PendingPieces(p1))
+	require.Empty(m.PendingPieces(p2))
+
+	require.Empty(m.Deprioritize([]int{0}))
+}
+
+func TestManagerClearUnknownPeers(t *testing.T) {
+	require := require.New(t)
+
+	m := newManager(clock.NewMock(), 5*time.Second, DefaultPolicy, 2)
+
+	p1 := core.PeerIDFixture()
+	p2 := core.PeerIDFixture()
+
+	pieces, err := m.ReservePieces(p1, bitsetutil.FromBools(true, false), countsFromInts(0, 0), false)
+	require.NoError(err)
+	require.Equal([]int{0}, pieces)
+
+	pieces, err = m.ReservePieces(p2, bitsetutil.FromBools(false, true), countsFromInts(0, 0), false)
+	require.NoError(err)
+	require.Equal([]int{1}, pieces)
+
+	cleared := m.ClearUnknownPeers(func(peerID core.PeerID) bool { return peerID == p2 })
+	require.Equal([]Request{{Piece: 0, PeerID: p1, Status: StatusPending}}, cleared)
+
+	require.Empty(m.PendingPieces(p1))
+	require.Equal([]int{1}, m.PendingPieces(p2))
+	require.Empty(m.ClearUnknownPeers(func(core.PeerID) bool { return true }))
+}
+
+func TestManagerChunks(t *testing.T) {
+	require := require.New(t)
+
+	m := newManager(clock.NewMock(), 5*time.Second, DefaultPolicy, 1)
+
+	require.Equal([]int{0, 1, 2}, m.MissingChunks(0, 3))
+
+	require.True(m.MarkChunkReceived(0, 1, 3))
+	require.False(m.MarkChunkReceived(0, 1, 3))
+	require.Equal([]int{0, 2}, m.MissingChunks(0, 3))
+
+	require.True(m.MarkChunkReceived(0, 0, 3))
+	require.True(m.MarkChunkReceived(0, 2, 3))
+	require.Empty(m.MissingChunks(0, 3))
+
+	m.Clear(0)
+	require.Equal([]int{0, 1, 2}, m.MissingChunks(0, 3))
+}
+
+func TestManagerMarkComplete(t *testing.T) {
+	require := require.New(t)
+
+	m := newManager(clock.NewMock(), 5*time.Second, DefaultPolicy, 2)
+
+	p1 := core.PeerIDFixture()
+	p2 := core.PeerIDFixture()
+
+	pieces, err := m.ReservePieces(p1, bitsetutil.FromBools(true, true), countsFromInts(0, 0), false)
+	require.NoError(err)
+	require.Equal([]int{0, 1}, pieces)
+
+	require.Equal([]Request{{Piece: 0, PeerID: p1, Status: StatusPending}}, m.MarkComplete(0))
+	require.Equal([]int{1}, m.PendingPieces(p1))
+
+	// Completed pieces are never reserved, even as duplicates.
+	m.Prioritize([]int{0})
+	pieces, err = m.ReservePieces(p2, bitsetutil.FromBools(true, true), countsFromInts(0, 0), true)
+	require.NoError(err)
+	require.Equal([]int{1}, pieces)
+	require.Zero(m.OldestUnrequestedAge())
+}
+
+func TestManagerPendingPeers(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+	m := newManager(clk, 5*time.Second, DefaultPolicy, 1)
+
+	p1 := core.PeerIDFixture()
+	p2 := core.PeerIDFixture()
+
+	require.Empty(m.PendingPeers(0))
+
+	for _, p := range []core.PeerID{p1, p2} {
+		pieces, err := m.ReservePieces(p, bitsetutil.FromBools(true), countsFromInts(0), true)
+		require.NoError(err)
+		require.Equal([]int{0}, pieces)
+	}
+	require.ElementsMatch([]core.PeerID{p1, p2}, m.PendingPeers(0))
+
+	m.MarkInvalid(p1, 0)
+	require.Equal([]core.PeerID{p2}, m.PendingPeers(0))
+
+	clk.Add(5*time.Second + 1)
+	require.Empty(m.PendingPeers(0))
+}
+
+func TestManagerPendingPiecesByPeer(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+	m := newManager(clk, 5*time.Second, DefaultPolicy, 2)
+
+	p1 := core.PeerIDFixture()
+	p2 := core.PeerIDFixture()
+
+	require.Empty(m.PendingPiecesByPeer())
+
+	pieces, err := m.ReservePieces(
+		p1, bitsetutil.FromBools(true, true, false, false), countsFromInts(0, 0, 0, 0), false)
+	require.NoError(err)
+	require.Len(pieces, 2)
+
+	pieces, err = m.ReservePieces(
+		p2, bitsetutil.FromBools(false, false, true, true), countsFromInts(0, 0, 0, 0), false)
+	require.NoError(err)
+	require.Len(pieces, 2)
+
+	m.MarkInvalid(p2, 2)
+
+	require.Equal(map[core.PeerID][]int{
+		p1: {0, 1},
+		p2: {3},
+	}, m.PendingPiecesByPeer())
+
+	clk.Add(5*time.Second + 1)
+	require.Empty(m.PendingPiecesByPeer())
+}
+
+func TestManagerSetPipelineLimit(t *testing.T) {
+	require := require.New(t)
+
+	m := newManager(clock.NewMock(), 5*time.Second, DefaultPolicy, 3)
+
+	p1 := core.PeerIDFixture()
+	p2 := core.PeerIDFixture()
+
+	candidates := bitsetutil.FromBools(true, true, true, true, true, true)
+	counts := countsFromInts(0, 0, 0, 0, 0, 0)
+
+	m.SetPipelineLimit(p1, 1)
+
+	pieces, err := m.ReservePieces(p1, candidates, counts, false)
+	require.NoError(err)
+	require.Len(pieces, 1)
+
+	pieces, err = m.ReservePieces(p2, candidates, counts, false)
+	require.NoError(err)
+	require.Len(pieces, 3)
+
+	// Clearing the peer restores the default limit.
+	m.ClearPeer(p1)
+	pieces, err = m.ReservePieces(p1, candidates, counts, false)
+	require.NoError(err)
+	require.Len(pieces, 3)
+}
+
+func TestManagerMaxReservationsPerPeerCountsExpiredRequests(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+	timeout := 5 * time.Second
+
+	m := newManager(clk, timeout, SequentialPolicy, 2)
+	m.SetMaxReservationsPerPeer(3)
+
+	peerID := core.PeerIDFixture()
+	counts := countsFromInts(0, 0, 0, 0, 0, 0)
+
+	pieces, err := m.ReservePieces(peerID,
+		bitsetutil.FromBools(true, true, false, false, false, false), counts, false)
+	require.NoError(err)
+	require.Equal([]int{0, 1}, pieces)
+	require.True(m.HasReservationRoom(peerID))
+
+	// The expired requests free the pipeline, but still count against the cap.
+	clk.Add(timeout + 1)
+	candidates := bitsetutil.FromBools(false, false, true, true, true, true)
+	pieces, err = m.ReservePieces(peerID, candidates, counts, false)
+	require.NoError(err)
+	require.Equal([]int{2}, pieces)
+	require.False(m.HasReservationRoom(peerID))
+
+	clk.Add(timeout + 1)
+	pieces, err = m.ReservePieces(peerID, candidates, counts, false)
+	require.NoError(err)
+	require.Empty(pieces)
+	require.Equal([]int{0, 1, 2}, m.PendingPieces(peerID))
+
+	// Receiving a piece makes room for exactly one more.
+	m.MarkComplete(0)
+	require.True(m.HasReservationRoom(peerID))
+	pieces, err = m.ReservePieces(peerID,
+		bitsetutil.FromBools(false, false, false, true, true, true), counts, false)
+	require.NoError(err)
+	require.Equal([]int{3}, pieces)
+	require.False(m.HasReservationRoom(peerID))
+}
+
+func TestManagerMaxReservationsPerPeerCountsEndgameDuplicates(t *testing.T) {
+	require := require.New(t)
+
+	m := newManager(clock.NewMock(), 5*time.Second, DefaultPolicy, 4)
+	m.SetMaxReservationsPerPeer(2)
+
+	p1 := core.PeerIDFixture()
+	p2 := core.PeerIDFixture()
+	candidates := bitsetutil.FromBools(true, true, true)
+	counts := countsFromInts(0, 0, 0)
+
+	pieces, err := m.ReservePieces(p1, candidates, counts, false)
+	require.NoError(err)
+	require.Len(pieces, 2)
+
+	// Endgame duplicates are capped, although the pipeline limit allows more.
+	pieces, err = m.ReservePieces(p2, candidates, counts, true)
+	require.NoError(err)
+	require.Len(pieces, 2)
+	require.False(m.HasReservationRoom(p2))
+
+	pieces, err = m.ReservePieces(p2, candidates, counts, true)
+	require.NoError(err)
+	require.Empty(pieces)
+
+	// Prioritized pieces are capped too.
+	m.Prioritize([]int{0, 1, 2})
+	pieces, err = m.ReservePieces(p1, candidates, counts, true)
+	require.NoError(err)
+	require.Empty(pieces)
+}
+
+func TestManagerClearPeerResetsMaxReservationsPerPeer(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+	timeout := 5 * time.Second
+
+	m := newManager(clk, timeout, DefaultPolicy, 2)
+	m.SetMaxReservationsPerPeer(2)
+
+	p1 := core.PeerIDFixture()
+	p2 := core.PeerIDFixture()
+	candidates := bitsetutil.FromBools(true, true, true, true)
+	counts := countsFromInts(0, 0, 0, 0)
+
+	pieces, err := m.ReservePieces(p1, candidates, counts, true)
+	require.NoError(err)
+	require.Len(pieces, 2)
+	pieces, err = m.ReservePieces(p2, candidates, counts, true)
+	require.NoError(err)
+	require.Len(pieces, 2)
+
+	clk.Add(timeout + 1)
+	require.False(m.HasReservationRoom(p1))
+
+	// Clearing p1 returns its expired requests, and frees its reservations
+	// without affecting the duplicates of p2.
+	require.Len(m.ClearPeer(p1), 2)
+	require.True(m.HasReservationRoom(p1))
+	require.False(m.HasReservationRoom(p2))
+
+	pieces, err = m.ReservePieces(p1, candidates, counts, true)
+	require.NoError(err)
+	require.Len(pieces, 2)
+	pieces, err = m.ReservePieces(p2, candidates, counts, true)
+	require.NoError(err)
+	require.Empty(pieces)
+}
+
+func TestManagerAdaptivePipelineLimit(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+	m := newManager(clk, 4*time.Second, DefaultPolicy, 2)
+	m.SetPipelineBounds(1, 3)
+
+	peerID := core.PeerIDFixture()
+
+	candidates := bitsetutil.FromBools(make([]bool, 16)...).Complement()
+	counts := syncutil.NewCounters(16)
+
+	var pending []int
+	reserve := func(n int) {
+		pieces, err := m.ReservePieces(peerID, candidates, counts, false)
+		require.NoError(err)
+		require.Len(pieces, n)
+		pending = append(pending, pieces...)
+	}
+	receive := func() {
+		i := pending[0]
+		pending = pending[1:]
+		m.RecordPieceReceived(peerID, i)
+		m.MarkComplete(i)
+		candidates.Clear(uint(i))
+	}
+
+	require.Equal(2, m.PipelineDepth(peerID))
+	reserve(2)
+
+	// A slow piece resets the run of fast pieces.
+	clk.Add(100 * time.Millisecond)
+	receive()
+	clk.Add(time.Second)
+	receive()
+	require.Equal(2, m.PipelineDepth(peerID))
+
+	// The limit grows once as many pieces as the limit are received fast.
+	reserve(2)
+	clk.Add(100 * time.Millisecond)
+	receive()
+	require.Equal(2, m.PipelineDepth(peerID))
+	receive()
+	require.Equal(3, m.PipelineDepth(peerID))
+	reserve(3)
+
+	// The limit never exceeds its maximum.
+	receive()
+	receive()
+	receive()
+	require.Equal(3, m.PipelineDepth(peerID))
+	reserve(3)
+
+	// Halving applies once per window of requests.
+	clk.Add(time.Second)
+	m.RecordPieceFailed(peerID, pending[0])
+	require.Equal(1, m.PipelineDepth(peerID))
+	m.RecordPieceFailed(peerID, pending[1])
+	require.Equal(1, m.PipelineDepth(peerID))
+
+	// Unknown requests are ignored.
+	m.RecordPieceReceived(peerID, 16)
+	m.RecordPieceFailed(core.PeerIDFixture(), pending[0])
+	require.Equal(1, m.PipelineDepth(peerID))
+
+	// Clearing the peer restores the initial limit.
+	m.ClearPeer(peerID)
+	require.Equal(2, m.PipelineDepth(peerID))
+}
+
+func TestManagerMarkInvalidShrinksPipelineLimit(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+	m := newManager(clk, 5*time.Second, DefaultPolicy, 4)
+	m.SetPipelineBounds(1, 8)
+
+	peerID := core.PeerIDFixture()
+
+	pieces, err := m.ReservePieces(
+		peerID, bitsetutil.FromBools(true, true, true, true), countsFromInts(0, 0, 0, 0), false)
+	require.NoError(err)
+	require.Len(pieces, 4)
+
+	clk.Add(time.Second)
+	m.MarkInvalid(peerID, pieces[0])
+	m.MarkInvalid(peerID, pieces[1])
+	require.Equal(2, m.PipelineDepth(peerID))
+
+	// The remaining requests count against the halved limit.
+	pieces, err = m.ReservePieces(
+		peerID, bitsetutil.FromBools(true, true, true, true), countsFromInts(0, 0, 0, 0), false)
+	require.NoError(err)
+	require.Empty(pieces)
+}
+
+func TestManagerMarkRejectedKeepsPipelineLimit(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+	m := newManager(clk, 5*time.Second, DefaultPolicy, 4)
+	m.SetPipelineBounds(1, 8)
+
+	peerID := core.PeerIDFixture()
+
+	pieces, err := m.ReservePieces(
+		peerID, bitsetutil.FromBools(true, true, true, true), countsFromInts(0, 0, 0, 0), false)
+	require.NoError(err)
+	require.Len(pieces, 4)
+
+	clk.Add(time.Second)
+	m.MarkRejected(peerID, pieces[0])
+	m.MarkRejected(peerID, pieces[1])
+	require.Equal(4, m.PipelineDepth(peerID))
+
+	require.ElementsMatch([]Request{
+		{Piece: pieces[0], PeerID: peerID, Status: StatusRejected},
+		{Piece: pieces[1], PeerID: peerID, Status: StatusRejected},
+	}, m.GetFailedRequests())
+
+	// Rejected pieces may be reserved again.
+	again, err := m.ReservePieces(
+		peerID, bitsetutil.FromBools(true, true, true, true), countsFromInts(0, 0, 0, 0), false)
+	require.NoError(err)
+	require.ElementsMatch(pieces[:2], again)
+}
+
+func TestManagerMarkRejectedForWithholdsPieceFromPeer(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+	m := newManager(clk, 5*time.Second, DefaultPolicy, 1)
+
+	p0 := core.PeerIDFixture()
+	p1 := core.PeerIDFixture()
+
+	pieces, err := m.ReservePieces(p0, bitsetutil.FromBools(true), countsFromInts(1), false)
+	require.NoError(err)
+	require.Equal([]int{0}, pieces)
+
+	m.MarkRejectedFor(p0, 0, 2*time.Second)
+
+	// Piece 0 is withheld from p0 until the hint elapsed, even if duplicates are
+	// allowed, but may be reserved under other peers.
+	clk.Add(time.Second)
+	pieces, err = m.ReservePieces(p0, bitsetutil.FromBools(true), countsFromInts(1), true)
+	require.NoError(err)
+	require.Empty(pieces)
+
+	pieces, err = m.ReservePieces(p1, bitsetutil.FromBools(true), countsFromInts(1), false)
+	require.NoError(err)
+	require.Equal([]int{0}, pieces)
+
+	clk.Add(time.Second)
+	pieces, err = m.ReservePieces(p0, bitsetutil.FromBools(true), countsFromInts(1), true)
+	require.NoError(err)
+	require.Equal([]int{0}, pieces)
+}
+
+func TestManagerMarkRejectedForIgnoresUnsolicitedHints(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+	m := newManager(clk, 5*time.Second, DefaultPolicy, 1)
+
+	p0 := core.PeerIDFixture()
+	p1 := core.PeerIDFixture()
+
+	pieces, err := m.ReservePieces(p0, bitsetutil.FromBools(true, true), countsFromInts(1, 1), false)
+	require.NoError(err)
+	require.Len(pieces, 1)
+
+	// Neither p1, nor p0 for the piece it was not sent a request for, nor any
+	// out-of-range piece may record a hint.
+	require.False(m.MarkRejectedFor(p1, pieces[0], time.Second))
+	require.False(m.MarkRejectedFor(p0, 1-pieces[0], time.Second))
+	require.False(m.MarkRejectedFor(p0, 1000, time.Second))
+	require.Empty(m.retryAfter)
+
+	require.True(m.MarkRejectedFor(p0, pieces[0], time.Second))
+	require.Len(m.retryAfter[p0], 1)
+}
+
+func TestManagerRequestLatency(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+	m := newManager(clk, 5*time.Second, DefaultPolicy, 1)
+
+	p0 := core.PeerIDFixture()
+	p1 := core.PeerIDFixture()
+
+	_, _, ok := m.RequestLatency(p0, 0)
+	require.False(ok)
+
+	pieces, err := m.ReservePieces(p0, bitsetutil.FromBools(true), countsFromInts(1), false)
+	require.NoError(err)
+	require.Equal([]int{0}, pieces)
+	require.Equal(1, m.NumPending())
+
+	clk.Add(2 * time.Second)
+	latency, retries, ok := m.RequestLatency(p0, 0)
+	require.True(ok)
+	require.Equal(2*time.Second, latency)
+	require.Equal(0, retries)
+
+	// Requests sent after a failure of the piece are retries.
+	m.MarkInvalid(p0, 0)
+	require.Equal(0, m.NumPending())
+	_, _, ok = m.RequestLatency(p0, 0)
+	require.False(ok)
+	require.Len(m.GetFailedRequests(), 1)
+
+	pieces, err = m.ReservePieces(p1, bitsetutil.FromBools(true), countsFromInts(1), false)
+	require.NoError(err)
+	require.Equal([]int{0}, pieces)
+	require.Equal(1, m.NumPending())
+
+	clk.Add(time.Second)
+	latency, retries, ok = m.RequestLatency(p1, 0)
+	require.True(ok)
+	require.Equal(time.Second, latency)
+	require.Equal(1, retries)
+
+	// Expired requests are not pending.
+	clk.Add(5 * time.Second)
+	require.Equal(0, m.NumPending())
+}
+
+func TestManagerReserveAfterExpiryReplacesRequest(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+	m := newManager(clk, 5*time.Second, DefaultPolicy, 1)
+
+	peerID := core.PeerIDFixture()
+
+	pieces, err := m.ReservePieces(peerID, bitsetutil.FromBools(true), countsFromInts(0), false)
+	require.NoError(err)
+	require.Equal([]int{0}, pieces)
+
+	clk.Add(5*time.Second + 1)
+
+	pieces, err = m.ReservePieces(peerID, bitsetutil.FromBools(true), countsFromInts(0), false)
+	require.NoError(err)
+	require.Equal([]int{0}, pieces)
+
+	// The expired request was replaced, so it is not resent and does not
+	// outlive the peer.
+	require.Empty(m.GetFailedRequests())
+	require.Equal([]int{0}, m.PendingPieces(peerID))
+	require.Zero(m.ReconcileSlots())
+
+	m.ClearPeer(peerID)
+	require.Empty(m.PendingPeers(0))
+	clk.Add(5*time.Second + 1)
+	require.Empty(m.GetFailedRequests())
+}
+
+func TestManagerAwaitingPeersIncludesExpiredRequests(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+	m := newManager(clk, 5*time.Second, DefaultPolicy, 1)
+
+	p1 := core.PeerIDFixture()
+	p2 := core.PeerIDFixture()
+
+	_, err := m.ReservePieces(p1, bitsetutil.FromBools(true), countsFromInts(0), false)
+	require.NoError(err)
+	clk.Add(5*time.Second + 1)
+	require.Empty(m.PendingPeers(0))
+	require.Equal([]core.PeerID{p1}, m.AwaitingPeers(0))
+
+	_, err = m.ReservePieces(p2, bitsetutil.FromBools(true), countsFromInts(0), false)
+	require.NoError(err)
+	require.ElementsMatch([]core.PeerID{p1, p2}, m.AwaitingPeers(0))
+
+	m.MarkInvalid(p2, 0)
+	require.Equal([]core.PeerID{p1}, m.AwaitingPeers(0))
+
+	m.Clear(0)
+	require.Empty(m.AwaitingPeers(0))
+}
+
+func TestManagerStats(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+	m := newManager(clk, 5*time.Second, DefaultPolicy, 3)
+	require.Equal(Stats{}, m.Stats())
+
+	reserve := func(peerID core.PeerID, candidates ...bool) []int {
+		pieces, err := m.ReservePieces(
+			peerID, bitsetutil.FromBools(candidates...), countsFromInts(0, 0, 0, 0, 0, 0), false)
+		require.NoError(err)
+		return pieces
+	}
+	peer1 := core.PeerIDFixture()
+	peer2 := core.PeerIDFixture()
+	peer3 := core.PeerIDFixture()
+
+	require.Len(reserve(peer1, true, true), 2)
+	clk.Add(5*time.Second + 1)
+	require.Len(reserve(peer2, false, false, true, true, true), 3)
+	require.Len(reserve(peer3, false, false, false, false, false, true), 1)
+	m.MarkUnsent(peer2, 2)
+	m.MarkInvalid(peer2, 3)
+	m.MarkRejected(peer3, 5)
+
+	require.Equal(Stats{
+		Pending:  1,
+		Expired:  2,
+		Unsent:   1,
+		Invalid:  1,
+		Rejected: 1,
+	}, m.Stats())
+
+	m.ClearPeer(peer1)
+	m.Clear(4)
+	require.Equal(Stats{Unsent: 1, Invalid: 1, Rejected: 1}, m.Stats())
+}
+
+func TestManagerReconcileSlots(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+	m := newManager(clk, 5*time.Second, DefaultPolicy, 2)
+
+	peerID := core.PeerIDFixture()
+
+	candidates := bitsetutil.FromBools(true, true, true, true)
+	counts := countsFromInts(0, 0, 0, 0)
+
+	pieces, err := m.ReservePieces(peerID, candidates, counts, false)
+	require.NoError(err)
+	require.Len(pieces, 2)
+	require.Zero(m.ReconcileSlots())
+
+	// Leak a slot which no piece request backs, and duplicate a request.
+	leaked := candidates.Difference(bitsetutil.FromBools(false, false, false, false).
+		Set(uint(pieces[0])).Set(uint(pieces[1])))
+	i, _ := leaked.NextSet(0)
+	m.requestsByPeer[peerID][int(i)] = &Request{Piece: int(i), PeerID: peerID, sentAt: clk.Now()}
+	m.requests[pieces[0]] = append(m.requests[pieces[0]], &Request{
+		Piece:  pieces[0],
+		PeerID: peerID,
+		sentAt: clk.Now().Add(-time.Second),
+	})
+	m.MarkComplete(pieces[1])
+
+	// The leaked slot is not usable.
+	more, err := m.ReservePieces(peerID, candidates, counts, false)
+	require.NoError(err)
+	require.Empty(more)
+
+	require.Equal(2, m.ReconcileSlots())
+	require.Zero(m.ReconcileSlots())
+	require.Equal([]int{pieces[0]}, m.PendingPieces(peerID))
+	require.Len(m.requests[pieces[0]], 1)
+
+	// The leaked slot is usable again.
+	more, err = m.ReservePieces(peerID, candidates, counts, false)
+	require.NoError(err)
+	require.Len(more, 1)
+}
+
+func TestManagerSlotsConsistentUnderConcurrentExpiry(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+	m := newManager(clk, 5*time.Second, DefaultPolicy, 4)
+
+	const numPieces = 16
+
+	candidates := bitsetutil.FromBools(make([]bool, numPieces)...).Complement()
+
+	var peers []core.PeerID
+	for i := 0; i < 4; i++ {
+		peers = append(peers, core.PeerIDFixture())
+	}
+
+	// Every round, all requests of the previous round have expired, such that
+	// peers re-reserve their expired pieces while other peers clear them.
+	errc := make(chan error, len(peers))
+	for round := 0; round < 50; round++ {
+		var wg sync.WaitGroup
+		for j, peerID := range peers {
+			wg.Add(1)
+			go func(peerID core.PeerID, seed int64) {
+				defer wg.Done()
+				rng := rand.New(rand.NewSource(seed))
+				for k := 0; k < 20; k++ {
+					switch rng.Intn(8) {
+					case 0:
+						m.Clear(rng.Intn(numPieces))
+					case 1:
+						m.GetFailedRequests()
+					default:
+						if _, err := m.ReservePieces(
+							peerID, candidates, syncutil.NewCounters(numPieces), true); err != nil {
+							errc <- err
+							return
+						}
+					}
+				}
+			}(peerID, int64(round*len(peers)+j))
+		}
+		wg.Wait()
+		clk.Add(5*time.Second + 1)
+	}
+	close(errc)
+	for err := range errc {
+		require.NoError(err)
+	}
+
+	require.Zero(m.ReconcileSlots())
+	for i, rs := range m.requests {
+		require.NotEmpty(rs, "piece %d", i)
+	}
+}
+
+func TestManagerTimeoutProvider(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+	timeout := 5 * time.Second
+	m, err := NewManager(
+		clk, func() time.Duration { return timeout }, DefaultPolicy, 1, 0)
+	require.NoError(err)
+
+	peerID := core.PeerIDFixture()
+	pieces, err := m.ReservePieces(peerID, bitsetutil.FromBools(true), countsFromInts(0), false)
+	require.NoError(err)
+	require.Equal([]int{0}, pieces)
+
+	clk.Add(2 * time.Second)
+	require.Empty(m.GetFailedRequests())
+
+	// Requests expire as of the current timeout.
+	timeout = time.Second
+	failed := m.GetFailedRequests()
+	require.Len(failed, 1)
+	require.Equal(StatusExpired, failed[0].Status)
+}
@@ -28,4 +28,11 @@ type pieceSelectionPolicy interface {
 		valid func(int) bool, // whether the given piece is a valid selection or not
 		candidates *bitset.BitSet,
 		numPeersByPiece syncutil.Counters) ([]int, error)
+
+	// nextRound ends the current selection round, e.g. to age the pieces which
+	// were not selected during the round.
+	nextRound()
+
+	// clear drops any state of piece i, e.g. once it is no longer needed.
+	clear(i int)
 }
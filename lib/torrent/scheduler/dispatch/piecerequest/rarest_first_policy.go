@@ -14,19 +14,38 @@
 package piecerequest
 
 import (
-	"github.com/uber/kraken/utils/heap"
+	"math/rand"
+	"sort"
+
 	"github.com/uber/kraken/utils/syncutil"
 
 	"github.com/willf/bitset"
 )
 
 // RarestFirstPolicy selects pieces that the fewest of our peers have to request first.
+// Pieces of equal rarity are selected randomly, such that peers which see the
+// same availability do not all request the same pieces. To prevent starvation
+// of pieces which are never quite the rarest, the rarity of a piece improves by
+// agingRate for every round in which it was a candidate but was not selected.
 const RarestFirstPolicy = "rarest_first"
 
-type rarestFirstPolicy struct{}
+type rarestFirstPolicy struct {
+	agingRate float64
+
+	// skipped holds the pieces which were candidates but were not selected in
+	// the current round.
+	skipped map[int]bool
+
+	// rounds tracks the number of rounds each piece was skipped.
+	rounds map[int]int
+}
 
-func newRarestFirstPolicy() *rarestFirstPolicy {
-	return &rarestFirstPolicy{}
+func newRarestFirstPolicy(agingRate float64) *rarestFirstPolicy {
+	return &rarestFirstPolicy{
+		agingRate: agingRate,
+		skipped:   make(map[int]bool),
+		rounds:    make(map[int]int),
+	}
 }
 
 func (p *rarestFirstPolicy) selectPieces(
@@ -35,26 +54,62 @@ func (p *rarestFirstPolicy) selectPieces(
 	candidates *bitset.BitSet,
 	numPeersByPiece syncutil.Counters) ([]int, error) {
 
-	candidateQueue := heap.NewPriorityQueue()
+	type candidate struct {
+		piece  int
+		rarity float64
+	}
+	var ordered []candidate
 	for i, e := candidates.NextSet(0); e; i, e = candidates.NextSet(i + 1) {
-		candidateQueue.Push(&heap.Item{
-			Value:    int(i),
-			Priority: numPeersByPiece.Get(int(i)),
+		ordered = append(ordered, candidate{
+			piece:  int(i),
+			rarity: float64(numPeersByPiece.Get(int(i))) - p.age(int(i)),
 		})
 	}
+	// Shuffle before the stable sort to break ties randomly.
+	rand.Shuffle(len(ordered), func(i, j int) {
+		ordered[i], ordered[j] = ordered[j], ordered[i]
+	})
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return ordered[i].rarity < ordered[j].rarity
+	})
 
 	pieces := make([]int, 0, limit)
-	for len(pieces) < limit && candidateQueue.Len() > 0 {
-		item, err := candidateQueue.Pop()
-		if err != nil {
-			return nil, err
+	for _, c := range ordered {
+		if len(pieces) == limit {
+			break
 		}
+		if valid(c.piece) {
+			pieces = append(pieces, c.piece)
+		}
+	}
 
-		candidate := item.Value.(int)
-		if valid(candidate) {
-			pieces = append(pieces, candidate)
+	if p.agingRate > 0 {
+		for i, e := candidates.NextSet(0); e; i, e = candidates.NextSet(i + 1) {
+			p.skipped[int(i)] = true
+		}
+		for _, i := range pieces {
+			p.clear(i)
 		}
 	}
 
 	return pieces, nil
 }
+
+// age returns the rarity improvement of piece i.
+func (p *rarestFirstPolicy) age(i int) float64 {
+	return p.agingRate * float64(p.rounds[i])
+}
+
+// nextRound ages the pieces skipped in the current round once, regardless of
+// how many selections the round made.
+func (p *rarestFirstPolicy) nextRound() {
+	for i := range p.skipped {
+		p.rounds[i]++
+	}
+	p.skipped = make(map[int]bool)
+}
+
+func (p *rarestFirstPolicy) clear(i int) {
+	delete(p.skipped, i)
+	delete(p.rounds, i)
+}
@@ -0,0 +1,78 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+// _priorityShareWindow is the number of recent contested serves over which
+// priorityShare bounds the share of priority serves.
+const _priorityShareWindow = 20
+
+// priorityShare bounds the share of serves which priority piece requests, see
+// conn.PriorityRequests, receive while other requests wait, such that bulk
+// requests are not starved. Only serves picked while both kinds of requests
+// wait are counted. Not thread-safe.
+type priorityShare struct {
+	percent     int
+	recent      []bool // Whether each recent contested serve was a priority one.
+	numPriority int
+}
+
+func newPriorityShare(percent int) *priorityShare {
+	return &priorityShare{percent: percent}
+}
+
+// allow returns true if the next contested serve may go to a priority request.
+func (s *priorityShare) allow() bool {
+	p, n := s.numPriority, len(s.recent)
+	if n == _priorityShareWindow {
+		// The oldest serve leaves the window once the next serve is recorded.
+		if s.recent[0] {
+			p--
+		}
+		n--
+	}
+	return p*100 < s.percent*(n+1)
+}
+
+// record records a contested serve.
+func (s *priorityShare) record(priority bool) {
+	s.recent = append(s.recent, priority)
+	if priority {
+		s.numPriority++
+	}
+	if len(s.recent) > _priorityShareWindow {
+		if s.recent[0] {
+			s.numPriority--
+		}
+		s.recent = s.recent[1:]
+	}
+}
+
+// pick returns which of the queued serves to serve next: the next priority
+// serve if allowed by s, else the next other serve. next returns the index of
+// the queued serve of either kind to serve first, or -1 if there is none.
+// Returns -1 if no serve is queued, and whether both kinds were queued, in
+// which case the caller must record the serve once it was picked for good.
+func (s *priorityShare) pick(next func(priority bool) int) (i int, contested bool) {
+	p, b := next(true), next(false)
+	switch {
+	case p < 0:
+		return b, false
+	case b < 0:
+		return p, false
+	case s.allow():
+		return p, true
+	default:
+		return b, true
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"testing"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/gen/go/proto/p2p"
+	"github.com/uber/kraken/lib/torrent/scheduler/conn"
+	"github.com/uber/kraken/lib/torrent/storage/agentstorage"
+	"github.com/uber/kraken/utils/bitsetutil"
+)
+
+func TestPriorityShareBoundsPriorityServesWithinWindow(t *testing.T) {
+	require := require.New(t)
+
+	s := newPriorityShare(25)
+	var n int
+	for i := 0; i < 10*_priorityShareWindow; i++ {
+		priority := s.allow()
+		s.record(priority)
+		if priority {
+			n++
+		}
+	}
+	require.Equal(10*_priorityShareWindow/4, n)
+	require.Len(s.recent, _priorityShareWindow)
+}
+
+func priorityRequest(i int, priority bool) *p2p.PieceRequestMessage {
+	return &p2p.PieceRequestMessage{Index: int32(i), Length: 1, Priority: priority}
+}
+
+func drainServeQueue(q *serveQueue) []int {
+	var served []int
+	for {
+		msg, ok := q.next()
+		if !ok {
+			return served
+		}
+		served = append(served, int(msg.Index))
+	}
+}
+
+func TestServeQueuePriorityRequests(t *testing.T) {
+	tests := []struct {
+		desc     string
+		enable   bool
+		expected []int
+	}{
+		{"enabled", true, []int{3, 0, 4, 1, 2}},
+		{"disabled", false, []int{0, 1, 2, 3, 4}},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			q := newServeQueue()
+			if test.enable {
+				q.enablePriority(50)
+			}
+			for i := 0; i < 5; i++ {
+				q.push(priorityRequest(i, i >= 3))
+			}
+			require.Equal(t, test.expected, drainServeQueue(q))
+		})
+	}
+}
+
+func TestDispatcherSendsPriorityRequestsForPrioritizedPieces(t *testing.T) {
+	require := require.New(t)
+
+	torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(2, 1).MetaInfo)
+	defer cleanup()
+
+	stats := tally.NewTestScope("", nil)
+	d := testDispatcher(Config{DisableKeepalive: true}, clock.NewMock(), torrent)
+	d.stats = stats
+
+	p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, true), newMockMessages())
+	require.NoError(err)
+	legacy, err := d.addPeer(
+		core.PeerIDFixture(), bitsetutil.FromBools(true, true), newLegacyMockMessages(conn.PriorityRequests))
+	require.NoError(err)
+
+	d.PrioritizePieces([]int{0})
+	for _, peer := range []*peer{p, legacy} {
+		for i := 0; i < 2; i++ {
+			require.NoError(d.sendPieceRequest(peer, i))
+		}
+	}
+
+	priorities := func(messages Messages) map[int]bool {
+		m := make(map[int]bool)
+		for _, msg := range messages.(*mockMessages).getSent() {
+			if r := msg.Message.PieceRequest; r != nil {
+				m[int(r.Index)] = r.Priority
+			}
+		}
+		return m
+	}
+	require.Equal(map[int]bool{0: true, 1: false}, priorities(p.messages))
+	require.Equal(map[int]bool{0: false, 1: false}, priorities(legacy.messages))
+	require.Equal(int64(1), stats.Snapshot().Counters()["priority_piece_requests_sent+"].Value())
+}
+
+func TestDispatcherServesPriorityRequestsAheadOfQueuedRequests(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(6, 1)
+	torrent, cleanup := completeTorrentFixture(t, blob)
+	defer cleanup()
+
+	stats := tally.NewTestScope("", nil)
+	d := testDispatcher(Config{
+		PriorityServePercent: 50,
+		EnableChoking:        true,
+		UploadSlots:          1,
+		MaxChokedRequests:    6,
+		DisableKeepalive:     true,
+	}, clock.NewMock(), torrent)
+	d.stats = stats
+
+	// Requests of the peers are held while they are choked, such that they
+	// contend once the peers are unchoked.
+	none := bitsetutil.FromBools(false, false, false, false, false, false)
+	p, err := d.addPeer(core.PeerIDFixture(), none.Clone(), newLegacyMockMessages(conn.Choke))
+	require.NoError(err)
+	legacy, err := d.addPeer(
+		core.PeerIDFixture(), none.Clone(), newLegacyMockMessages(conn.Choke, conn.PriorityRequests))
+	require.NoError(err)
+	for _, peer := range []*peer{p, legacy} {
+		peer.serves.choke()
+		for i := 0; i < 6; i++ {
+			require.NoError(d.dispatch(
+				peer, &conn.Message{Message: &p2p.Message{
+					Type:         p2p.Message_PIECE_REQUEST,
+					PieceRequest: priorityRequest(i, i >= 3),
+				}}))
+		}
+	}
+	require.Equal(
+		int64(3), stats.Snapshot().Counters()["priority_piece_requests_received+"].Value())
+
+	for _, peer := range []*peer{p, legacy} {
+		_, start := peer.serves.unchoke()
+		require.True(start)
+		d.serve(peer)
+	}
+
+	// Priority requests jump ahead of bulk requests, at most every other serve.
+	require.Equal([]int{3, 0, 4, 1, 5, 2}, servedPieces(p.messages))
+	// Priority requests of peers which did not negotiate them are ignored.
+	require.Equal([]int{0, 1, 2, 3, 4, 5}, servedPieces(legacy.messages))
+}
@@ -0,0 +1,51 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+// Progress summarizes how far along the torrent of a Dispatcher is.
+type Progress struct {
+	PiecesCompleted int `json:"pieces_completed"`
+	NumPieces       int `json:"num_pieces"`
+
+	// BytesCompleted includes bytes of partially received pieces.
+	BytesCompleted int64 `json:"bytes_completed"`
+	Length         int64 `json:"length"`
+
+	// BytesDownloaded and BytesUploaded count all piece payload bytes received
+	// from and sent to peers, including duplicate and invalid payloads.
+	BytesDownloaded int64 `json:"bytes_downloaded"`
+	BytesUploaded   int64 `json:"bytes_uploaded"`
+
+	NumPeers int  `json:"num_peers"`
+	Endgame  bool `json:"endgame"`
+
+	// Paused is set while the Dispatcher is paused, see Dispatcher.Pause.
+	Paused bool `json:"paused,omitempty"`
+}
+
+// Progress returns the progress of d's torrent.
+func (d *Dispatcher) Progress() Progress {
+	completed := int(d.torrent.Bitfield().Count())
+	return Progress{
+		PiecesCompleted: completed,
+		NumPieces:       d.torrent.NumPieces(),
+		BytesCompleted:  d.completedBytes(),
+		Length:          d.torrent.Length(),
+		BytesDownloaded: d.bytesDownloaded.Load(),
+		BytesUploaded:   d.bytesUploaded.Load(),
+		NumPeers:        d.NumPeers(),
+		Endgame:         completed < d.torrent.NumPieces() && d.endgame(),
+		Paused:          d.Paused(),
+	}
+}
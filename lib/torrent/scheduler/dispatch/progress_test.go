@@ -0,0 +1,86 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/torrent/scheduler/conn"
+	"github.com/uber/kraken/lib/torrent/storage/agentstorage"
+	"github.com/uber/kraken/lib/torrent/storage/piecereader"
+	"github.com/uber/kraken/utils/bitsetutil"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDispatcherProgress(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(4, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(Config{EndgameThreshold: 1}, clock.NewMock(), torrent)
+
+	require.Equal(Progress{NumPieces: 4, Length: 4}, d.Progress())
+
+	p1, err := d.addPeer(
+		core.PeerIDFixture(), bitsetutil.FromBools(true, true, true, true), newMockMessages())
+	require.NoError(err)
+	p2, err := d.addPeer(
+		core.PeerIDFixture(), bitsetutil.FromBools(false, false, false, false), newMockMessages())
+	require.NoError(err)
+
+	receive := func(i int) {
+		require.NoError(d.dispatch(p1, conn.NewPiecePayloadMessage(
+			i, piecereader.NewBuffer(blob.Content[i:i+1]))))
+	}
+
+	receive(0)
+	receive(0)
+	require.NoError(d.dispatch(p2, conn.NewPieceRequestMessage(0, 1)))
+	waitForServes(t, p2)
+
+	require.Equal(Progress{
+		PiecesCompleted: 1,
+		NumPieces:       4,
+		BytesCompleted:  1,
+		Length:          4,
+		BytesDownloaded: 2,
+		BytesUploaded:   1,
+		NumPeers:        2,
+	}, d.Progress())
+
+	receive(1)
+	receive(2)
+	require.True(d.Progress().Endgame)
+
+	receive(3)
+	require.NoError(d.removePeer(p2))
+	progress := d.Progress()
+	require.Equal(4, progress.PiecesCompleted)
+	require.Equal(int64(4), progress.BytesCompleted)
+	require.Equal(1, progress.NumPeers)
+	require.False(progress.Endgame)
+
+	b, err := json.Marshal(progress)
+	require.NoError(err)
+	var result Progress
+	require.NoError(json.Unmarshal(b, &result))
+	require.Equal(progress, result)
+}
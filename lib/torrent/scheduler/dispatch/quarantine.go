@@ -0,0 +1,189 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/uber/kraken/lib/torrent/storage"
+)
+
+// pieceQuarantine holds the pieces which are suspected to be corrupt in
+// storage, see Config.QuarantineSuspectPieces.
+type pieceQuarantine struct {
+	mu     sync.Mutex
+	pieces map[int]bool
+}
+
+func newPieceQuarantine() *pieceQuarantine {
+	return &pieceQuarantine{pieces: make(map[int]bool)}
+}
+
+// add quarantines piece i. Returns false if i was already quarantined.
+func (q *pieceQuarantine) add(i int) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.pieces[i] {
+		return false
+	}
+	q.pieces[i] = true
+	return true
+}
+
+// release releases piece i from quarantine. Returns false if i was not
+// quarantined.
+func (q *pieceQuarantine) release(i int) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if !q.pieces[i] {
+		return false
+	}
+	delete(q.pieces, i)
+	return true
+}
+
+func (q *pieceQuarantine) has(i int) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.pieces[i]
+}
+
+func (q *pieceQuarantine) size() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.pieces)
+}
+
+// list returns the quarantined pieces in ascending order.
+func (q *pieceQuarantine) list() []int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var res []int
+	for i := range q.pieces {
+		res = append(res, i)
+	}
+	sort.Ints(res)
+	return res
+}
+
+// QuarantinedPieces returns the pieces which d suspects to be corrupt in
+// storage, in ascending order. Quarantined pieces are neither advertised nor
+// served, see Config.QuarantineSuspectPieces.
+func (d *Dispatcher) QuarantinedPieces() []int {
+	return d.quarantine.list()
+}
+
+// advertised returns false if piece i is unadvertised due to slow serves, or
+// quarantined.
+func (d *Dispatcher) advertised(i int) bool {
+	return d.serveLatency.advertised(i) && !d.quarantine.has(i)
+}
+
+// suspectPiece quarantines piece i, which failed sampled serve verification or
+// could not be read from storage for a serve due to err. No-op unless
+// Config.QuarantineSuspectPieces is set.
+func (d *Dispatcher) suspectPiece(i int, err error) {
+	if !d.config.QuarantineSuspectPieces || !d.quarantine.add(i) {
+		return
+	}
+	d.log("piece", i, "error", err).Warn("Quarantined suspect piece")
+	d.stats.Counter("quarantined_pieces").Inc(1)
+	d.stats.Gauge("quarantine_size").Update(float64(d.quarantine.size()))
+
+	pieces := d.QuarantinedPieces()
+	h := d.torrent.InfoHash()
+	d.emitter.emit(func(e Events) { e.PiecesQuarantined(h, pieces) })
+	d.status.notify(QuarantineChanged)
+
+	d.scheduleReverification(i)
+}
+
+// scheduleReverification verifies quarantined piece i again once
+// Config.QuarantineReverifyInterval elapsed, releasing i if it passes and
+// rescheduling the verification otherwise. No-op if the interval is not set.
+func (d *Dispatcher) scheduleReverification(i int) {
+	if d.config.QuarantineReverifyInterval <= 0 {
+		return
+	}
+	d.clk.AfterFunc(d.config.QuarantineReverifyInterval, func() {
+		select {
+		case <-d.tornDown:
+			return
+		default:
+		}
+		if d.invalidating.Load() {
+			return
+		}
+		d.stats.Counter("quarantine_reverifications").Inc(1)
+		if err := d.verifyPiece(i); err != nil {
+			d.log("piece", i, "error", err).Info("Quarantined piece failed re-verification")
+			d.scheduleReverification(i)
+			return
+		}
+		d.releasePiece(i)
+	})
+}
+
+// releasePiece releases piece i, which passed re-verification, from quarantine
+// and advertises i again.
+func (d *Dispatcher) releasePiece(i int) {
+	if !d.quarantine.release(i) {
+		return
+	}
+	d.log("piece", i).Info("Released quarantined piece after re-verification")
+	d.stats.Counter("released_quarantined_pieces").Inc(1)
+	d.stats.Gauge("quarantine_size").Update(float64(d.quarantine.size()))
+	d.status.notify(QuarantineChanged)
+	d.announceToAll(i)
+}
+
+// verifyPiece reads back piece i from storage and verifies it.
+func (d *Dispatcher) verifyPiece(i int) error {
+	pr, err := d.torrent.GetPieceReader(i)
+	if err != nil {
+		return err
+	}
+	defer pr.Close()
+	return storage.VerifyPieceReader(d.verifier, i, pr)
+}
+
+// mergePieces returns the union of the ascending pieces a and b, in ascending
+// order.
+func mergePieces(a, b []int) []int {
+	if len(b) == 0 {
+		return a
+	}
+	if len(a) == 0 {
+		return b
+	}
+	res := make([]int, 0, len(a)+len(b))
+	for len(a) > 0 && len(b) > 0 {
+		switch {
+		case a[0] < b[0]:
+			res, a = append(res, a[0]), a[1:]
+		case b[0] < a[0]:
+			res, b = append(res, b[0]), b[1:]
+		default:
+			res, a, b = append(res, a[0]), a[1:], b[1:]
+		}
+	}
+	res = append(res, a...)
+	return append(res, b...)
+}
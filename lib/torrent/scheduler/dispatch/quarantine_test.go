@@ -0,0 +1,210 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/gen/go/proto/p2p"
+	"github.com/uber/kraken/lib/torrent/scheduler/conn"
+	"github.com/uber/kraken/lib/torrent/storage"
+	"github.com/uber/kraken/utils/bitsetutil"
+)
+
+// corruptibleVerifier fails the verification of the pieces marked corrupt.
+type corruptibleVerifier struct {
+	storage.PieceVerifier
+
+	mu      sync.Mutex
+	corrupt map[int]bool
+}
+
+func (v *corruptibleVerifier) Expected(piece int) []byte {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.corrupt[piece] {
+		return []byte("corrupt")
+	}
+	return v.PieceVerifier.Expected(piece)
+}
+
+func (v *corruptibleVerifier) setCorrupt(piece int, corrupt bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.corrupt[piece] = corrupt
+}
+
+// failedPieces returns the pieces which requests failed for, by error.
+func failedPieces(messages Messages) map[string][]int {
+	failed := make(map[string][]int)
+	for _, msg := range messages.(*mockMessages).getSent() {
+		if msg.Message.Type == p2p.Message_ERROR {
+			e := msg.Message.Error
+			failed[e.Error] = append(failed[e.Error], int(e.Index))
+		}
+	}
+	return failed
+}
+
+func TestMergePieces(t *testing.T) {
+	tests := []struct {
+		a, b     []int
+		expected []int
+	}{
+		{nil, nil, nil},
+		{[]int{1, 3}, nil, []int{1, 3}},
+		{nil, []int{2}, []int{2}},
+		{[]int{1, 3, 5}, []int{2, 3, 6}, []int{1, 2, 3, 5, 6}},
+	}
+	for _, test := range tests {
+		require.Equal(t, test.expected, mergePieces(test.a, test.b))
+	}
+}
+
+func TestDispatcherQuarantinesSuspectPieces(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(8, 2)
+	torrent, cleanup := completeTorrentFixture(t, blob)
+	defer cleanup()
+
+	clk := clock.NewMock()
+	stats := tally.NewTestScope("", nil)
+	events := &recordingEvents{}
+	d := testDispatcher(Config{
+		ServeVerifyInterval:        1,
+		QuarantineSuspectPieces:    true,
+		QuarantineReverifyInterval: time.Minute,
+		DisableKeepalive:           true,
+	}, clk, torrent)
+	d.stats = stats
+	d.emitter = testEmitter(events, tally.NoopScope)
+	verifier := &corruptibleVerifier{PieceVerifier: d.verifier, corrupt: map[int]bool{1: true}}
+	d.verifier = verifier
+
+	p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false, false, false, false), newMockMessages())
+	require.NoError(err)
+
+	request := func(pieces ...int) {
+		for _, i := range pieces {
+			require.NoError(d.dispatch(p, conn.NewPieceRequestMessage(i, 2)))
+		}
+		waitForServes(t, p)
+	}
+
+	// Piece 1 fails verification, and is quarantined rather than failing d.
+	request(0, 1, 2, 3)
+	require.Equal([]int{0, 2, 3}, servedPieces(p.messages))
+	require.Equal([]int{1}, failedPieces(p.messages)[storage.ErrPieceDigestMismatch.Error()])
+	require.Equal([]int{1}, d.QuarantinedPieces())
+	require.Equal([]int{1}, d.Dump().QuarantinedPieces)
+	require.True(d.Complete())
+	require.False(d.Stat().Bitfield().Test(1))
+	require.Eventually(func() bool {
+		for _, e := range events.get() {
+			if e == "quarantined:[1]" {
+				return true
+			}
+		}
+		return false
+	}, time.Second, 5*time.Millisecond)
+
+	// Requests for piece 1 are rejected without reading it, while the other
+	// pieces are still served.
+	request(1, 2, 1)
+	require.Equal([]int{0, 2, 3, 2}, servedPieces(p.messages))
+	require.Equal([]int{1, 1}, failedPieces(p.messages)[errPieceQuarantined.Error()])
+
+	// Piece 1 stays quarantined while it fails re-verification.
+	clk.Add(time.Minute)
+	require.Equal([]int{1}, d.QuarantinedPieces())
+	require.Empty(announcedPieces(p.messages))
+
+	// Once piece 1 was repaired, it is released and advertised again.
+	verifier.setCorrupt(1, false)
+	clk.Add(time.Minute)
+	require.Empty(d.QuarantinedPieces())
+	require.True(d.Stat().Bitfield().Test(1))
+	require.Equal([]int{1}, announcedPieces(p.messages))
+
+	request(1)
+	require.Equal([]int{0, 2, 3, 2, 1}, servedPieces(p.messages))
+
+	counters := stats.Snapshot().Counters()
+	require.Equal(int64(1), counters["quarantined_pieces+"].Value())
+	require.Equal(int64(2), counters["rejected_quarantined_piece_requests+"].Value())
+	require.Equal(int64(2), counters["quarantine_reverifications+"].Value())
+	require.Equal(int64(1), counters["released_quarantined_pieces+"].Value())
+}
+
+func TestDispatcherQuarantineHidesPiecesFromNewPeers(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(8, 2)
+	torrent, cleanup := completeTorrentFixture(t, blob)
+	defer cleanup()
+
+	d := testDispatcher(Config{
+		QuarantineSuspectPieces: true,
+		DisableKeepalive:        true,
+	}, clock.NewMock(), torrent)
+
+	d.suspectPiece(2, storage.ErrPieceDigestMismatch)
+
+	// A complete message would advertise the quarantined piece.
+	p, err := d.addPeer(
+		core.PeerIDFixture(),
+		bitsetutil.FromBools(false, false, false, false),
+		newLegacyMockMessages(conn.AnnouncePieces))
+	require.NoError(err)
+	d.notifyPeerComplete(p)
+	require.Equal(0, numSent(p.messages, p2p.Message_COMPLETE))
+	require.Equal([]int{0, 1, 3}, announcedPieces(p.messages))
+	require.Equal([]int{2}, d.HiddenPieces())
+}
+
+func TestDispatcherDoesNotQuarantineUnlessConfigured(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(8, 2)
+	torrent, cleanup := completeTorrentFixture(t, blob)
+	defer cleanup()
+
+	d := testDispatcher(Config{
+		ServeVerifyInterval: 1,
+		DisableKeepalive:    true,
+	}, clock.NewMock(), torrent)
+	d.verifier = &corruptibleVerifier{PieceVerifier: d.verifier, corrupt: map[int]bool{1: true}}
+
+	p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false, false, false, false), newMockMessages())
+	require.NoError(err)
+	for i := 0; i < 2; i++ {
+		require.NoError(d.dispatch(p, conn.NewPieceRequestMessage(1, 2)))
+		waitForServes(t, p)
+	}
+
+	// Every request is verified and fails instead.
+	require.Equal([]int{1, 1}, failedPieces(p.messages)[storage.ErrPieceDigestMismatch.Error()])
+	require.Empty(d.QuarantinedPieces())
+	require.True(d.Stat().Bitfield().Test(1))
+}
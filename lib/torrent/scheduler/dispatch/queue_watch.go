@@ -0,0 +1,115 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"time"
+
+	"github.com/uber/kraken/lib/torrent/scheduler/conn"
+)
+
+// queueReporter is implemented by Messages which report the messages queued
+// in each direction, such as conn.Conn.
+type queueReporter interface {
+	SendQueueStats() conn.QueueStats
+	ReceiveQueueStats() conn.QueueStats
+}
+
+// queueAgeBuckets are the upper bounds of the buckets in which peers are
+// counted by the age of their oldest queued message.
+var queueAgeBuckets = []struct {
+	name string
+	max  time.Duration
+}{
+	{"100ms", 100 * time.Millisecond},
+	{"1s", time.Second},
+	{"10s", 10 * time.Second},
+	{"inf", time.Duration(1<<63 - 1)},
+}
+
+func queueAgeBucket(age time.Duration) string {
+	for _, b := range queueAgeBuckets {
+		if age <= b.max {
+			return b.name
+		}
+	}
+	return queueAgeBuckets[len(queueAgeBuckets)-1].name
+}
+
+// sampleQueues updates gauges of the messages queued to and from peers, and
+// detects peers whose control messages are stuck behind piece payloads, i.e.
+// head-of-line blocked. Connections of blocked peers are closed if configured.
+func (d *Dispatcher) sampleQueues() {
+	queuedBytes := make(map[string]int64)
+	peersByAge := make(map[string]map[string]int)
+	for _, direction := range []string{"send", "receive"} {
+		peersByAge[direction] = make(map[string]int)
+	}
+	d.peers.Range(func(k, v interface{}) bool {
+		p := v.(*peer)
+		r, ok := p.messages.(queueReporter)
+		if !ok {
+			return true
+		}
+		var blocked bool
+		for direction, s := range map[string]conn.QueueStats{
+			"send":    r.SendQueueStats(),
+			"receive": r.ReceiveQueueStats(),
+		} {
+			queuedBytes[direction] += s.Bytes
+			peersByAge[direction][queueAgeBucket(s.OldestAge)]++
+			if s.OldestControlAge > d.config.HeadOfLineBlockingThreshold {
+				d.log("peer", p, "direction", direction).Infof(
+					"Peer is head-of-line blocked: oldest queued control message is %s old",
+					s.OldestControlAge)
+				d.stats.Tagged(map[string]string{
+					"direction": direction,
+				}).Counter("head_of_line_blocked_peers").Inc(1)
+				blocked = true
+			}
+		}
+		if blocked {
+			p.incrementHeadOfLineBlocks()
+			if d.config.ResetHeadOfLineBlockedConns {
+				d.log("peer", p).Info("Closing connection to head-of-line blocked peer")
+				d.stats.Counter("head_of_line_conn_resets").Inc(1)
+				p.messages.Close()
+			}
+		}
+		return true
+	})
+
+	for direction, buckets := range peersByAge {
+		d.stats.Tagged(map[string]string{
+			"direction": direction,
+		}).Gauge("queued_bytes").Update(float64(queuedBytes[direction]))
+		for _, b := range queueAgeBuckets {
+			d.stats.Tagged(map[string]string{
+				"direction": direction,
+				"age":       b.name,
+			}).Gauge("peers_by_oldest_queued_message").Update(float64(buckets[b.name]))
+		}
+	}
+}
+
+func (d *Dispatcher) watchQueues() {
+	for {
+		select {
+		case <-d.clk.After(d.config.QueueSampleInterval):
+			d.sampleQueues()
+		case <-d.tornDown:
+			return
+		}
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/gen/go/proto/p2p"
+	"github.com/uber/kraken/lib/torrent/networkevent"
+	"github.com/uber/kraken/lib/torrent/scheduler/conn"
+	"github.com/uber/kraken/lib/torrent/scheduler/torrentlog"
+	"github.com/uber/kraken/lib/torrent/storage"
+	"github.com/uber/kraken/lib/torrent/storage/agentstorage"
+	"github.com/uber/kraken/lib/torrent/storage/piecereader"
+	"github.com/uber/kraken/utils/bitsetutil"
+)
+
+// readOnlyTorrent is a storage.ReadOnlyTorrent which counts attempted writes.
+type readOnlyTorrent struct {
+	storage.Torrent
+	writes *atomic.Int32
+}
+
+func newReadOnlyTorrent(t storage.Torrent) readOnlyTorrent {
+	return readOnlyTorrent{t, atomic.NewInt32(0)}
+}
+
+func (t readOnlyTorrent) ReadOnly() bool {
+	return true
+}
+
+func (t readOnlyTorrent) WritePiece(src storage.PieceReader, piece int) error {
+	t.writes.Inc()
+	return errors.New("read-only torrent is being written to")
+}
+
+// completeTorrentFixture returns a complete torrent of blob.
+func completeTorrentFixture(t *testing.T, blob *core.BlobFixture) (storage.Torrent, func()) {
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	for i := 0; i < torrent.NumPieces(); i++ {
+		start := int64(i) * blob.MetaInfo.PieceLength()
+		end := start + torrent.PieceLength(i)
+		require.NoError(t, torrent.WritePiece(piecereader.NewBuffer(blob.Content[start:end]), i))
+	}
+	return torrent, cleanup
+}
+
+func TestReadOnlyDispatcherServesPieces(t *testing.T) {
+	tests := []struct {
+		desc     string
+		config   Config
+		readOnly bool
+	}{
+		{"config", Config{ReadOnly: true}, false},
+		{"storage", Config{}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+
+			torrent, cleanup := completeTorrentFixture(t, core.SizedBlobFixture(2, 1))
+			defer cleanup()
+			if test.readOnly {
+				torrent = newReadOnlyTorrent(torrent)
+			}
+
+			d := testDispatcher(test.config, clock.NewMock(), torrent)
+			require.True(d.readOnly)
+			require.Nil(d.pieceRequestManager)
+
+			p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false, false), newMockMessages())
+			require.NoError(err)
+
+			require.NoError(d.dispatch(p, conn.NewPieceRequestMessage(0, 1)))
+			require.NoError(d.dispatch(p, conn.NewPieceRequestMessage(1, 1)))
+			waitForServes(t, p)
+			require.Equal(2, p.pstats.getPiecesSent())
+
+			// Leech-side calls are no-ops rather than panics.
+			ok, err := d.maybeRequestMorePieces(p)
+			require.NoError(err)
+			require.False(ok)
+			d.PrioritizePieces([]int{0})
+			d.SetPiecePriorities([]PieceRange{{0, 2}})
+			d.DeprioritizePieces([]int{0})
+			require.NoError(d.dispatch(p, conn.NewChokeMessage()))
+			require.NoError(d.dispatch(p, conn.NewErrorMessage(
+				0, p2p.ErrorMessage_PIECE_REQUEST_FAILED, errors.New("some error"))))
+
+			require.NoError(d.RemovePeer(p.id))
+		})
+	}
+}
+
+func TestReadOnlyDispatcherRejectsPiecePayloads(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(2, 1)
+	complete, cleanup := completeTorrentFixture(t, blob)
+	defer cleanup()
+	torrent := newReadOnlyTorrent(complete)
+
+	stats := tally.NewTestScope("", nil)
+	d := testDispatcher(Config{MaxProtocolViolations: 1}, clock.NewMock(), torrent)
+	d.stats = stats
+
+	p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false, false), newMockMessages())
+	require.NoError(err)
+
+	require.Equal(ErrorProtocolViolation, Category(
+		d.dispatch(p, conn.NewPiecePayloadMessage(0, piecereader.NewBuffer(blob.Content[0:1])))))
+	require.Equal(1, p.stats().ProtocolViolations)
+	require.False(closed(p.messages))
+
+	require.Equal(ErrorProtocolViolation, Category(d.dispatch(p, conn.NewPieceChunkPayloadMessage(
+		1, 0, piecereader.NewBuffer(blob.Content[1:2])))))
+	require.True(closed(p.messages))
+
+	require.Equal(int32(0), torrent.writes.Load())
+	require.Equal(int64(0), p.getBytesDownloaded())
+	require.Equal(int64(2), stats.Snapshot().Counters()["protocol_violations+"].Value())
+}
+
+func TestReadOnlyDispatcherRequiresCompleteTorrent(t *testing.T) {
+	tests := []struct {
+		desc     string
+		config   Config
+		readOnly bool
+	}{
+		{"config", Config{ReadOnly: true}, false},
+		{"storage", Config{}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+
+			incomplete, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(2, 1).MetaInfo)
+			defer cleanup()
+			var torrent storage.Torrent = incomplete
+			if test.readOnly {
+				torrent = newReadOnlyTorrent(torrent)
+			}
+
+			_, err := newDispatcher(
+				test.config,
+				tally.NoopScope,
+				clock.NewMock(),
+				networkevent.NewTestProducer(),
+				noopEvents{},
+				core.PeerIDFixture(),
+				torrent,
+				zap.NewNop().Sugar(),
+				torrentlog.NewNopLogger())
+			require.Error(err)
+		})
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import "time"
+
+// _exchangeBuckets is the number of buckets which the window of an
+// exchangeWindow is divided into. Bytes expire from the window one bucket at a
+// time.
+const _exchangeBuckets = 10
+
+// exchangeWindow counts the bytes received from and sent to a peer within a
+// sliding window. Not thread-safe.
+type exchangeWindow struct {
+	bucket   time.Duration
+	head     int64 // Number of the latest bucket, counted from the Unix epoch.
+	received [_exchangeBuckets]int64
+	sent     [_exchangeBuckets]int64
+}
+
+func newExchangeWindow(window time.Duration, now time.Time) *exchangeWindow {
+	bucket := window / _exchangeBuckets
+	if bucket <= 0 {
+		bucket = 1
+	}
+	w := &exchangeWindow{bucket: bucket}
+	w.head = w.number(now)
+	return w
+}
+
+func (w *exchangeWindow) number(t time.Time) int64 {
+	return t.UnixNano() / int64(w.bucket)
+}
+
+// advance expires the buckets which fell out of the window at now.
+func (w *exchangeWindow) advance(now time.Time) {
+	n := w.number(now)
+	if n <= w.head {
+		return
+	}
+	if n-w.head >= _exchangeBuckets {
+		w.received = [_exchangeBuckets]int64{}
+		w.sent = [_exchangeBuckets]int64{}
+	} else {
+		for b := w.head + 1; b <= n; b++ {
+			w.received[b%_exchangeBuckets] = 0
+			w.sent[b%_exchangeBuckets] = 0
+		}
+	}
+	w.head = n
+}
+
+// addReceived records n bytes received from the peer at now.
+func (w *exchangeWindow) addReceived(n int64, now time.Time) {
+	w.advance(now)
+	w.received[w.head%_exchangeBuckets] += n
+}
+
+// addSent records n bytes sent to the peer at now.
+func (w *exchangeWindow) addSent(n int64, now time.Time) {
+	w.advance(now)
+	w.sent[w.head%_exchangeBuckets] += n
+}
+
+// totals returns the bytes received from and sent to the peer within the
+// window ending at now.
+func (w *exchangeWindow) totals(now time.Time) (received, sent int64) {
+	w.advance(now)
+	for i := 0; i < _exchangeBuckets; i++ {
+		received += w.received[i]
+		sent += w.sent[i]
+	}
+	return received, sent
+}
+
+// freeRiding returns whether c downloaded from us within the reciprocity
+// window without sending us anything.
+func (c chokeCandidate) freeRiding() bool {
+	return c.received == 0 && c.sent > 0
+}
+
+// ranksBefore returns true if c should get a regular upload slot before o.
+// Peers which sent us the most bytes within the reciprocity window come first,
+// with ties going to the peers we sent the fewest bytes, such that free riders
+// come last. Without tit-for-tat, peers are ranked by download rate instead.
+func (c chokeCandidate) ranksBefore(o chokeCandidate) bool {
+	if c.received != o.received {
+		return c.received > o.received
+	}
+	if c.sent != o.sent {
+		return c.sent < o.sent
+	}
+	if c.rate != o.rate {
+		return c.rate > o.rate
+	}
+	return c.waitedLonger(o)
+}
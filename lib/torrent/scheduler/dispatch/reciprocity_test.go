@@ -0,0 +1,219 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+	"github.com/willf/bitset"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/torrent/storage/agentstorage"
+)
+
+// rankedPeers returns the interested peers of d in the order in which they get
+// regular upload slots.
+func rankedPeers(d *Dispatcher) []*peer {
+	_, interested := d.chokeCandidates()
+	var peers []*peer
+	for _, c := range interested {
+		peers = append(peers, c.p)
+	}
+	return peers
+}
+
+func TestExchangeWindow(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+	w := newExchangeWindow(10*time.Second, clk.Now())
+
+	w.addReceived(5, clk.Now())
+	clk.Add(4 * time.Second)
+	w.addSent(3, clk.Now())
+	w.addReceived(1, clk.Now())
+
+	received, sent := w.totals(clk.Now())
+	require.Equal(int64(6), received)
+	require.Equal(int64(3), sent)
+
+	// Bytes expire one bucket at a time.
+	clk.Add(6 * time.Second)
+	received, sent = w.totals(clk.Now())
+	require.Equal(int64(1), received)
+	require.Equal(int64(3), sent)
+
+	clk.Add(4 * time.Second)
+	received, sent = w.totals(clk.Now())
+	require.Zero(received)
+	require.Zero(sent)
+
+	// Gaps longer than the window expire everything at once.
+	w.addReceived(7, clk.Now())
+	clk.Add(time.Hour)
+	received, _ = w.totals(clk.Now())
+	require.Zero(received)
+}
+
+func TestDispatcherRechokePrefersReciprocatingPeers(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+	torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(4, 1).MetaInfo)
+	defer cleanup()
+
+	stats := tally.NewTestScope("", nil)
+	d := testDispatcher(Config{
+		EnableChoking:     true,
+		UploadSlots:       3,
+		ReciprocityWindow: 10 * time.Second,
+		DisableKeepalive:  true,
+	}, clk, torrent)
+	d.stats = stats
+
+	add := func() *peer {
+		p, err := d.addPeer(core.PeerIDFixture(), bitset.New(4), newMockMessages())
+		require.NoError(err)
+		return p
+	}
+	giver, helper, freeRider, newcomer := add(), add(), add(), add()
+
+	// giver and helper send us pieces, while freeRider only downloads from us.
+	giver.addBytesDownloaded(2)
+	helper.addBytesDownloaded(1)
+	freeRider.addBytesUploaded(4)
+
+	require.Equal([]*peer{giver, helper, newcomer, freeRider}, rankedPeers(d))
+	require.Equal(float64(1), stats.Snapshot().Gauges()["free_riding_peers+"].Value())
+
+	// The regular slots go to the reciprocating peers, while the optimistic
+	// unchoke alternates between the others, such that newcomer may bootstrap.
+	optimistic := make(map[*peer]int)
+	for i := 0; i < 4; i++ {
+		clk.Add(time.Second)
+		d.rechoke()
+		require.Equal([]bool{true, true}, unchokedPeers(giver, helper))
+		require.ElementsMatch([]bool{true, false}, unchokedPeers(freeRider, newcomer))
+		if !newcomer.serves.isChoked() {
+			optimistic[newcomer]++
+		} else {
+			optimistic[freeRider]++
+		}
+	}
+	require.Equal(map[*peer]int{newcomer: 2, freeRider: 2}, optimistic)
+
+	// Once the contributions of giver and helper fell out of the window,
+	// newcomer, which reciprocated meanwhile, takes the lead, and freeRider,
+	// which keeps downloading without reciprocating, ranks last.
+	clk.Add(10 * time.Second)
+	newcomer.addBytesDownloaded(1)
+	freeRider.addBytesUploaded(1)
+	ranked := rankedPeers(d)
+	require.Equal(newcomer, ranked[0])
+	require.ElementsMatch([]*peer{giver, helper}, ranked[1:3])
+	require.Equal(freeRider, ranked[3])
+
+	s := newcomer.stats()
+	require.Equal(int64(1), s.RecentBytesReceived)
+	require.Zero(s.RecentBytesSent)
+	s = freeRider.stats()
+	require.Zero(s.RecentBytesReceived)
+	require.Equal(int64(1), s.RecentBytesSent)
+	require.Equal(int64(5), s.BytesUploaded)
+}
+
+func TestDispatcherRechokeRanksByDownloadRateWithoutTitForTat(t *testing.T) {
+	for _, disabled := range []bool{false, true} {
+		t.Run(fmt.Sprintf("disable_tit_for_tat=%t", disabled), func(t *testing.T) {
+			require := require.New(t)
+
+			clk := clock.NewMock()
+			torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(4, 1).MetaInfo)
+			defer cleanup()
+
+			d := testDispatcher(Config{
+				EnableChoking:     true,
+				UploadSlots:       2,
+				ReciprocityWindow: time.Second,
+				PeerRateWindow:    time.Minute,
+				DisableTitForTat:  disabled,
+				DisableKeepalive:  true,
+			}, clk, torrent)
+
+			// q was unchoked first, so q waited longer all else being equal.
+			q, err := d.addPeer(core.PeerIDFixture(), bitset.New(4), newMockMessages())
+			require.NoError(err)
+			clk.Add(time.Second)
+			p, err := d.addPeer(core.PeerIDFixture(), bitset.New(4), newMockMessages())
+			require.NoError(err)
+
+			// p sent us a piece, which left the reciprocity window, but still
+			// counts towards its smoothed download rate.
+			p.addBytesDownloaded(1)
+			clk.Add(5 * time.Second)
+
+			if disabled {
+				require.Equal([]*peer{p, q}, rankedPeers(d))
+			} else {
+				require.Equal([]*peer{q, p}, rankedPeers(d))
+			}
+		})
+	}
+}
+
+func TestDispatcherRechokeRotatesSlotsWhileSeedingRegardlessOfReciprocity(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+	blob := core.SizedBlobFixture(4, 1)
+	torrent, cleanup := completeTorrentFixture(t, blob)
+	defer cleanup()
+
+	stats := tally.NewTestScope("", nil)
+	d := testDispatcher(Config{
+		EnableChoking:    true,
+		UploadSlots:      2,
+		DisableKeepalive: true,
+	}, clk, torrent)
+	d.stats = stats
+
+	var peers []*peer
+	for i := 0; i < 3; i++ {
+		p, err := d.addPeer(core.PeerIDFixture(), bitset.New(4), newMockMessages())
+		require.NoError(err)
+		peers = append(peers, p)
+	}
+	// Bytes exchanged before the torrent completed earn no slot, and peers
+	// which only download from a seeder are no free riders.
+	peers[0].addBytesDownloaded(4)
+	peers[1].addBytesUploaded(4)
+
+	chokedAny := make(map[*peer]bool)
+	for i := 0; i < 6; i++ {
+		clk.Add(time.Second)
+		d.rechoke()
+		for _, p := range peers {
+			if p.serves.isChoked() {
+				chokedAny[p] = true
+			}
+		}
+	}
+	require.Len(chokedAny, 3)
+	require.Zero(stats.Snapshot().Gauges()["free_riding_peers+"].Value())
+}
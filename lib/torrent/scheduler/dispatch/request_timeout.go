@@ -0,0 +1,112 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// adaptiveTimeout derives the piece request timeout of a Dispatcher from the
+// observed latencies of its piece requests, as their exponentially weighted
+// moving average plus a number of standard deviations. Thus the timeout
+// tightens on fast links, where stuck requests are detected sooner, and loosens
+// on congested ones, where a static timeout expires requests which would have
+// been served and downloads their pieces twice.
+type adaptiveTimeout struct {
+	weight     float64
+	deviations float64
+	floor      time.Duration
+	ceiling    time.Duration
+
+	mu       sync.Mutex
+	initial  time.Duration
+	mean     float64 // In ns.
+	variance float64 // In ns^2.
+	sampled  bool
+}
+
+func newAdaptiveTimeout(
+	initial time.Duration,
+	weight float64,
+	deviations float64,
+	floor time.Duration,
+	ceiling time.Duration) *adaptiveTimeout {
+
+	return &adaptiveTimeout{
+		weight:     weight,
+		deviations: deviations,
+		floor:      floor,
+		ceiling:    ceiling,
+		initial:    initial,
+	}
+}
+
+// add records latency, the time a piece request took to be served, or a lower
+// bound of it if the request expired.
+func (t *adaptiveTimeout) add(latency time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	x := float64(latency)
+	if !t.sampled {
+		t.mean = x
+		t.variance = 0
+		t.sampled = true
+		return
+	}
+	diff := x - t.mean
+	incr := t.weight * diff
+	t.mean += incr
+	t.variance = (1 - t.weight) * (t.variance + diff*incr)
+}
+
+// get returns the current timeout, which is the initial timeout until the first
+// latency is recorded.
+func (t *adaptiveTimeout) get() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	d := float64(t.initial)
+	if t.sampled {
+		d = t.mean + t.deviations*math.Sqrt(t.variance)
+	}
+	// Clamped before converting, since d may overflow a time.Duration.
+	if d < float64(t.floor) {
+		return t.floor
+	}
+	if d > float64(t.ceiling) {
+		return t.ceiling
+	}
+	return time.Duration(d)
+}
+
+// currentPieceRequestTimeout returns the timeout of piece requests as of now.
+func (d *Dispatcher) currentPieceRequestTimeout() time.Duration {
+	if d.requestTimeout == nil {
+		return d.pieceRequestTimeout
+	}
+	return d.requestTimeout.get()
+}
+
+// samplePieceRequestLatency adapts the piece request timeout to latency, if
+// Config.AdaptivePieceRequestTimeout is set.
+func (d *Dispatcher) samplePieceRequestLatency(latency time.Duration) {
+	if d.requestTimeout == nil {
+		return
+	}
+	d.requestTimeout.add(latency)
+	d.stats.Gauge("piece_request_timeout").Update(d.requestTimeout.get().Seconds())
+}
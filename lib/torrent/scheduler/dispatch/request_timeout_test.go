@@ -0,0 +1,120 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"testing"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/torrent/scheduler/conn"
+	"github.com/uber/kraken/lib/torrent/storage/agentstorage"
+	"github.com/uber/kraken/lib/torrent/storage/piecereader"
+	"github.com/uber/kraken/utils/bitsetutil"
+)
+
+func TestAdaptiveTimeoutTightensAndLoosens(t *testing.T) {
+	require := require.New(t)
+
+	timeout := newAdaptiveTimeout(8*time.Second, 0.125, 4, 500*time.Millisecond, 30*time.Second)
+	require.Equal(8*time.Second, timeout.get())
+
+	// A run of fast pieces tightens the timeout down to the floor.
+	for i := 0; i < 20; i++ {
+		timeout.add(100 * time.Millisecond)
+	}
+	require.Equal(500*time.Millisecond, timeout.get())
+
+	// Jitter widens the timeout beyond the mean.
+	for i := 0; i < 20; i++ {
+		if i%2 == 0 {
+			timeout.add(time.Second)
+		} else {
+			timeout.add(2 * time.Second)
+		}
+	}
+	jittery := timeout.get()
+	require.True(jittery > 2*time.Second, jittery)
+
+	// A run of slow pieces loosens the timeout beyond the static timeout.
+	for i := 0; i < 20; i++ {
+		timeout.add(12 * time.Second)
+	}
+	slow := timeout.get()
+	require.True(slow > 12*time.Second, slow)
+
+	// Up to the ceiling.
+	for i := 0; i < 20; i++ {
+		timeout.add(time.Minute)
+	}
+	require.Equal(30*time.Second, timeout.get())
+}
+
+func TestDispatcherAdaptsPieceRequestTimeout(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(16, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	config := Config{
+		AdaptivePieceRequestTimeout: true,
+		PieceRequestTimeoutFloor:    100 * time.Millisecond,
+		PipelineLimit:               1,
+		DisableEndgame:              true,
+		DisableKeepalive:            true,
+	}
+	clk := clock.NewMock()
+	d := testDispatcher(config, clk, torrent)
+
+	require.Equal(d.pieceRequestTimeout, d.currentPieceRequestTimeout())
+
+	all := make([]bool, 16)
+	for i := range all {
+		all[i] = true
+	}
+	p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(all...), newMockMessages())
+	require.NoError(err)
+
+	// Pieces which arrive within 10ms of their requests tighten the timeout.
+	received := make(map[int]bool)
+	for len(received) < 8 {
+		_, err := d.maybeRequestMorePieces(p)
+		require.NoError(err)
+		clk.Add(10 * time.Millisecond)
+		for _, i := range requestedPieces(p.messages) {
+			if received[i] {
+				continue
+			}
+			received[i] = true
+			require.NoError(d.dispatch(
+				p, conn.NewPiecePayloadMessage(i, piecereader.NewBuffer(blob.Content[i:i+1]))))
+		}
+	}
+	tightened := d.currentPieceRequestTimeout()
+	require.Equal(config.PieceRequestTimeoutFloor, tightened)
+
+	// Requests now expire after the tightened timeout rather than the static one.
+	require.Len(d.pieceRequestManager.PendingPiecesByPeer()[p.id], 1)
+	clk.Add(tightened + 50*time.Millisecond)
+	require.Empty(d.pieceRequestManager.PendingPiecesByPeer()[p.id])
+
+	// The expired request loosens the timeout.
+	d.resendFailedPieceRequests()
+	require.True(d.currentPieceRequestTimeout() > tightened)
+}
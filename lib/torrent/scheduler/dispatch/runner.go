@@ -0,0 +1,428 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/uber-go/tally"
+)
+
+// RunnerConfig configures a Runner.
+type RunnerConfig struct {
+	// Workers is the number of goroutines which run the periodic work of all
+	// Dispatchers sharing the Runner. Defaults to 4.
+	Workers int `yaml:"workers"`
+
+	// Resolution is the granularity of the timing wheel of the Runner: work is
+	// run on the first tick of the wheel at which it is due. Defaults to 100ms.
+	Resolution time.Duration `yaml:"resolution"`
+
+	// Slots is the number of slots of the timing wheel. Work due more than
+	// Slots ticks ahead waits in its slot for multiple revolutions of the wheel.
+	// Defaults to 512.
+	Slots int `yaml:"slots"`
+}
+
+func (c RunnerConfig) applyDefaults() RunnerConfig {
+	if c.Workers == 0 {
+		c.Workers = 4
+	}
+	if c.Resolution == 0 {
+		c.Resolution = 100 * time.Millisecond
+	}
+	if c.Slots == 0 {
+		c.Slots = 512
+	}
+	return c
+}
+
+// RunnerStats is a snapshot of the state of a Runner.
+type RunnerStats struct {
+	// Goroutines is the number of goroutines of the Runner, which stays the
+	// same regardless of how many Dispatchers share it.
+	Goroutines  int `json:"goroutines"`
+	Dispatchers int `json:"dispatchers"`
+
+	// Scheduled is the number of tasks waiting in the timing wheel, Queued the
+	// number of due tasks waiting for a worker, and Running the number of tasks
+	// being run.
+	Scheduled int `json:"scheduled"`
+	Queued    int `json:"queued"`
+	Running   int `json:"running"`
+}
+
+// Runner multiplexes the periodic work of many Dispatchers, such as resending
+// failed piece requests, rechoking, sweeping idle peers and sending keepalives,
+// onto a fixed number of goroutines, see Config.Runner. Dispatchers without a
+// Runner run their periodic work on dedicated goroutines instead, which adds
+// up once there are thousands of active torrents.
+//
+// Work is scheduled on a timing wheel driven by the clock of the Runner, which
+// its Dispatchers must share. The tasks of each Dispatcher run one at a time,
+// in the order in which they fell due, and Dispatchers with due tasks take
+// turns for workers. Hence a slow task of one Dispatcher holds up at most one
+// worker, and delays the due tasks of every other Dispatcher by at most one
+// task per Dispatcher ahead of it in line.
+type Runner struct {
+	config RunnerConfig
+	stats  tally.Scope
+	clk    clock.Clock
+
+	mu        sync.Mutex
+	cond      *sync.Cond
+	wheel     [][]*runnerTask
+	cursor    int64          // Number of the last tick of the wheel processed.
+	ready     []*runnerGroup // Groups with due tasks and none running, in turn.
+	groups    int
+	scheduled int
+	queued    int
+	running   int
+	stopped   bool
+
+	ticker *clock.Ticker
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// runnerTask is a function scheduled on a Runner.
+type runnerTask struct {
+	g  *runnerGroup
+	at time.Time
+	f  func()
+}
+
+// runnerGroup holds the tasks of a single Dispatcher on a Runner.
+type runnerGroup struct {
+	r         *Runner
+	queue     []*runnerTask // Due tasks.
+	scheduled int           // Tasks in the timing wheel.
+	running   bool
+	ready     bool // Whether the group waits in line for a worker.
+	stopped   bool
+}
+
+// NewRunner creates a new Runner and starts its goroutines. Stop must be called
+// once the Runner is no longer needed.
+func NewRunner(config RunnerConfig, stats tally.Scope, clk clock.Clock) *Runner {
+	config = config.applyDefaults()
+	r := &Runner{
+		config: config,
+		stats: stats.Tagged(map[string]string{
+			"module": "dispatch_runner",
+		}),
+		clk:    clk,
+		wheel:  make([][]*runnerTask, config.Slots),
+		ticker: clk.Ticker(config.Resolution),
+		done:   make(chan struct{}),
+	}
+	r.cond = sync.NewCond(&r.mu)
+	r.cursor = r.tick(clk.Now())
+
+	r.wg.Add(config.Workers + 1)
+	go r.drive()
+	for i := 0; i < config.Workers; i++ {
+		go r.work()
+	}
+	return r
+}
+
+// Stop stops the goroutines of r, waiting for tasks being run. Pending tasks
+// are dropped, so Dispatchers sharing r must be torn down first.
+func (r *Runner) Stop() {
+	r.mu.Lock()
+	if r.stopped {
+		r.mu.Unlock()
+		return
+	}
+	r.stopped = true
+	r.cond.Broadcast()
+	r.mu.Unlock()
+
+	r.ticker.Stop()
+	close(r.done)
+	r.wg.Wait()
+}
+
+// Stats returns a snapshot of the state of r.
+func (r *Runner) Stats() RunnerStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return RunnerStats{
+		Goroutines:  r.config.Workers + 1,
+		Dispatchers: r.groups,
+		Scheduled:   r.scheduled,
+		Queued:      r.queued,
+		Running:     r.running,
+	}
+}
+
+// tick returns the number of the tick of the wheel which t falls into.
+func (r *Runner) tick(t time.Time) int64 {
+	return t.UnixNano() / int64(r.config.Resolution)
+}
+
+// drive advances the wheel on every tick of the clock.
+func (r *Runner) drive() {
+	defer r.wg.Done()
+	for {
+		select {
+		case <-r.ticker.C:
+			r.advance(r.clk.Now())
+			s := r.Stats()
+			r.stats.Gauge("dispatchers").Update(float64(s.Dispatchers))
+			r.stats.Gauge("scheduled_tasks").Update(float64(s.Scheduled))
+			r.stats.Gauge("queued_tasks").Update(float64(s.Queued))
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// advance queues the tasks which are due at now, such that tasks which fell due
+// first run first, also if the clock skipped ticks.
+func (r *Runner) advance(now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := r.tick(now)
+	if n <= r.cursor {
+		return
+	}
+	from := r.cursor + 1
+	if slots := int64(len(r.wheel)); n-from >= slots {
+		// Every slot is processed once.
+		from = n - slots + 1
+	}
+	var due []*runnerTask
+	for t := from; t <= n; t++ {
+		slot := int(t % int64(len(r.wheel)))
+		tasks := r.wheel[slot]
+		kept := tasks[:0]
+		for _, task := range tasks {
+			if task.g.stopped {
+				continue
+			}
+			if task.at.After(now) {
+				// Due in a later revolution of the wheel.
+				kept = append(kept, task)
+				continue
+			}
+			task.g.scheduled--
+			r.scheduled--
+			due = append(due, task)
+		}
+		for i := len(kept); i < len(tasks); i++ {
+			tasks[i] = nil
+		}
+		r.wheel[slot] = kept
+	}
+	sort.SliceStable(due, func(i, j int) bool {
+		return due[i].at.Before(due[j].at)
+	})
+	for _, task := range due {
+		r.queueLocked(task)
+	}
+	r.cursor = n
+}
+
+// queueLocked queues the due task, and lines up its group for a worker unless
+// the group is waiting or running already.
+func (r *Runner) queueLocked(task *runnerTask) {
+	g := task.g
+	g.queue = append(g.queue, task)
+	r.queued++
+	if !g.running && !g.ready {
+		g.ready = true
+		r.ready = append(r.ready, g)
+		r.cond.Signal()
+	}
+}
+
+// work runs one due task of the group first in line at a time, then puts the
+// group back in line if it has more due tasks.
+func (r *Runner) work() {
+	defer r.wg.Done()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for {
+		for len(r.ready) == 0 && !r.stopped {
+			r.cond.Wait()
+		}
+		if r.stopped {
+			return
+		}
+		g := r.ready[0]
+		r.ready[0] = nil
+		r.ready = r.ready[1:]
+		g.ready = false
+		if len(g.queue) == 0 {
+			// Stopped meanwhile.
+			continue
+		}
+		task := g.queue[0]
+		g.queue[0] = nil
+		g.queue = g.queue[1:]
+		r.queued--
+		g.running = true
+		r.running++
+		r.mu.Unlock()
+
+		r.stats.Timer("task_lateness").Record(r.clk.Now().Sub(task.at))
+		task.f()
+
+		r.mu.Lock()
+		g.running = false
+		r.running--
+		if len(g.queue) > 0 {
+			g.ready = true
+			r.ready = append(r.ready, g)
+			r.cond.Signal()
+		}
+	}
+}
+
+// register adds a group for the tasks of a Dispatcher.
+func (r *Runner) register() *runnerGroup {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.groups++
+	return &runnerGroup{r: r}
+}
+
+// after runs f on a worker once delay elapsed. No-op once g was stopped.
+func (g *runnerGroup) after(delay time.Duration, f func()) {
+	r := g.r
+	now := r.clk.Now()
+	task := &runnerTask{g: g, at: now.Add(delay), f: f}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if g.stopped || r.stopped {
+		return
+	}
+	if !task.at.After(now) {
+		r.queueLocked(task)
+		return
+	}
+	t := r.tick(task.at)
+	if t <= r.cursor {
+		// The tick of task was processed already, so it runs on the next one.
+		t = r.cursor + 1
+	}
+	slot := int(t % int64(len(r.wheel)))
+	r.wheel[slot] = append(r.wheel[slot], task)
+	g.scheduled++
+	r.scheduled++
+}
+
+// every runs f every interval() until done is closed. Like a dedicated loop,
+// the next run is scheduled once f returned, so runs never overlap. Intervals
+// shorter than the resolution of the Runner, e.g. derived intervals rounding
+// down to zero, are raised to it, such that f runs at most once per tick.
+func (g *runnerGroup) every(interval func() time.Duration, done <-chan struct{}, f func()) {
+	next := func() time.Duration {
+		if d := interval(); d > g.r.config.Resolution {
+			return d
+		}
+		return g.r.config.Resolution
+	}
+	var run func()
+	run = func() {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		f()
+		g.after(next(), run)
+	}
+	g.after(next(), run)
+}
+
+// stop drops the tasks of g. Tasks being run finish. Nil-safe.
+func (g *runnerGroup) stop() {
+	if g == nil {
+		return
+	}
+	r := g.r
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if g.stopped {
+		return
+	}
+	g.stopped = true
+	r.groups--
+	r.queued -= len(g.queue)
+	g.queue = nil
+	// Tasks left in the wheel are dropped once their slot is processed.
+	r.scheduled -= g.scheduled
+	g.scheduled = 0
+}
+
+// afterFunc calls f once delay elapsed, on the Runner of d if configured, else
+// on a goroutine of its own.
+func (d *Dispatcher) afterFunc(delay time.Duration, f func()) {
+	if d.runner != nil {
+		d.runner.after(delay, f)
+		return
+	}
+	d.clk.AfterFunc(delay, f)
+}
+
+// startRunnerLoops schedules the periodic work which New otherwise runs on
+// dedicated goroutines on the Runner of d.
+func (d *Dispatcher) startRunnerLoops() {
+	if !d.SeedOnly() {
+		d.runner.every(func() time.Duration {
+			return d.currentPieceRequestTimeout() / 2
+		}, d.pendingPiecesDone, d.checkPendingPieceRequests)
+	}
+	if d.config.EnableChoking {
+		d.runner.every(constant(d.config.ChokeInterval), d.tornDown, d.rechoke)
+	}
+	d.runner.every(constant(d.config.QueueSampleInterval), d.tornDown, d.sampleQueues)
+	if d.config.PeerCompactionInterval > 0 {
+		d.runner.every(constant(d.config.PeerCompactionInterval), d.tornDown, d.compactPeers)
+	}
+	if d.config.PeerIdleTimeout > 0 {
+		d.runner.every(constant(d.config.PeerIdleTimeout/2), d.tornDown, d.evictIdlePeers)
+	}
+	if !d.config.ImmediateCompletedPeerClose {
+		d.runner.every(
+			constant(d.config.CompletedPeerCloseWindow/10), d.tornDown, d.closeDueCompletedPeers)
+	}
+	if d.config.DownloadDeadline > 0 && !d.torrent.Complete() {
+		d.runner.after(d.config.DownloadDeadline, func() {
+			select {
+			case <-d.pendingPiecesDone:
+			default:
+				d.checkDeadline()
+			}
+		})
+	}
+}
+
+// constant returns an interval function which always returns interval.
+func constant(interval time.Duration) func() time.Duration {
+	return func() time.Duration { return interval }
+}
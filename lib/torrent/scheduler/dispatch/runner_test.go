@@ -0,0 +1,364 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/torrent/networkevent"
+	"github.com/uber/kraken/lib/torrent/scheduler/torrentlog"
+	"github.com/uber/kraken/lib/torrent/storage/agentstorage"
+	"github.com/uber/kraken/utils/bitsetutil"
+)
+
+// waitForRunner waits until r processed all ticks of clk, and ran all due
+// tasks but running.
+func waitForRunner(t *testing.T, r *Runner, clk clock.Clock, running int) {
+	require.Eventually(t, func() bool {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		return r.cursor == r.tick(clk.Now()) && r.queued == 0 && r.running == running
+	}, 5*time.Second, time.Millisecond)
+}
+
+// runRecorder records when the tasks of each of its groups ran.
+type runRecorder struct {
+	mu   sync.Mutex
+	runs map[int][]time.Duration
+}
+
+func (rr *runRecorder) record(group int, at time.Duration) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	rr.runs[group] = append(rr.runs[group], at)
+}
+
+func (rr *runRecorder) get(group int) []time.Duration {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	return append([]time.Duration(nil), rr.runs[group]...)
+}
+
+func TestRunnerRunsTasksOfManyGroupsOnTime(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+	start := clk.Now()
+
+	before := runtime.NumGoroutine()
+	r := NewRunner(RunnerConfig{
+		Workers:    3,
+		Resolution: 100 * time.Millisecond,
+		Slots:      8,
+	}, tally.NoopScope, clk)
+	defer r.Stop()
+
+	// Intervals beyond the 800ms span of the wheel take multiple revolutions.
+	intervals := []time.Duration{
+		100 * time.Millisecond,
+		300 * time.Millisecond,
+		500 * time.Millisecond,
+		1200 * time.Millisecond,
+	}
+	const n = 400
+	done := make(chan struct{})
+	defer close(done)
+	rr := &runRecorder{runs: make(map[int][]time.Duration)}
+	for i := 0; i < n; i++ {
+		i := i
+		g := r.register()
+		g.every(constant(intervals[i%len(intervals)]), done, func() {
+			rr.record(i, clk.Now().Sub(start))
+		})
+	}
+	require.Equal(n, r.Stats().Dispatchers)
+
+	// The groups share the goroutines of the Runner.
+	require.Equal(4, r.Stats().Goroutines)
+	require.True(runtime.NumGoroutine()-before <= r.Stats().Goroutines)
+
+	for step := 0; step < 30; step++ {
+		clk.Add(100 * time.Millisecond)
+		waitForRunner(t, r, clk, 0)
+	}
+
+	// Every task ran on the tick it was due.
+	for i := 0; i < n; i++ {
+		interval := intervals[i%len(intervals)]
+		var expected []time.Duration
+		for at := interval; at <= 3*time.Second; at += interval {
+			expected = append(expected, at)
+		}
+		require.Equal(expected, rr.get(i), "group %d", i)
+	}
+	require.Equal(n, r.Stats().Scheduled)
+}
+
+func TestRunnerRaisesShortIntervalsToResolution(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+	start := clk.Now()
+
+	r := NewRunner(RunnerConfig{Workers: 1, Resolution: 100 * time.Millisecond}, tally.NoopScope, clk)
+	defer r.Stop()
+
+	done := make(chan struct{})
+	defer close(done)
+	rr := &runRecorder{runs: make(map[int][]time.Duration)}
+	for i, interval := range []time.Duration{0, time.Nanosecond} {
+		i := i
+		r.register().every(constant(interval), done, func() {
+			rr.record(i, clk.Now().Sub(start))
+		})
+	}
+
+	for step := 0; step < 3; step++ {
+		clk.Add(100 * time.Millisecond)
+		waitForRunner(t, r, clk, 0)
+	}
+
+	expected := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 300 * time.Millisecond}
+	require.Equal(expected, rr.get(0))
+	require.Equal(expected, rr.get(1))
+}
+
+func TestRunnerCatchesUpOnSkippedTicksInOrder(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+	r := NewRunner(RunnerConfig{Workers: 1, Resolution: 100 * time.Millisecond, Slots: 4}, tally.NoopScope, clk)
+	defer r.Stop()
+
+	var mu sync.Mutex
+	var order []int
+	g := r.register()
+	for _, i := range []int{7, 2, 5, 1} {
+		i := i
+		g.after(time.Duration(i)*100*time.Millisecond, func() {
+			mu.Lock()
+			order = append(order, i)
+			mu.Unlock()
+		})
+	}
+
+	// The clock jumps past all tasks at once, beyond the span of the wheel.
+	clk.Add(time.Second)
+	waitForRunner(t, r, clk, 0)
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal([]int{1, 2, 5, 7}, order)
+	require.Zero(r.Stats().Scheduled)
+}
+
+func TestRunnerIsolatesSlowGroups(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+	start := clk.Now()
+	r := NewRunner(RunnerConfig{Workers: 2, Resolution: 100 * time.Millisecond}, tally.NoopScope, clk)
+	defer r.Stop()
+
+	done := make(chan struct{})
+	defer close(done)
+
+	// The tasks of slow block until released.
+	release := make(chan struct{})
+	slowRuns := atomic.NewInt32(0)
+	slow := r.register()
+	slow.every(constant(100*time.Millisecond), done, func() {
+		slowRuns.Inc()
+		<-release
+	})
+
+	const n = 50
+	rr := &runRecorder{runs: make(map[int][]time.Duration)}
+	for i := 0; i < n; i++ {
+		i := i
+		r.register().every(constant(100*time.Millisecond), done, func() {
+			rr.record(i, clk.Now().Sub(start))
+		})
+	}
+
+	// While the task of slow blocks a worker, the other groups keep running on
+	// time, and slow does not pile up ticks.
+	for step := 0; step < 10; step++ {
+		clk.Add(100 * time.Millisecond)
+		waitForRunner(t, r, clk, 1)
+		r.mu.Lock()
+		require.Zero(slow.scheduled + len(slow.queue))
+		r.mu.Unlock()
+	}
+	var expected []time.Duration
+	for at := 100 * time.Millisecond; at <= time.Second; at += 100 * time.Millisecond {
+		expected = append(expected, at)
+	}
+	for i := 0; i < n; i++ {
+		require.Equal(expected, rr.get(i), "group %d", i)
+	}
+	require.Equal(int32(1), slowRuns.Load())
+
+	// Once released, slow resumes its ticks.
+	close(release)
+	waitForRunner(t, r, clk, 0)
+	clk.Add(100 * time.Millisecond)
+	waitForRunner(t, r, clk, 0)
+	require.Equal(int32(2), slowRuns.Load())
+}
+
+func TestRunnerDropsTasksOfStoppedGroups(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+	r := NewRunner(RunnerConfig{Resolution: 100 * time.Millisecond}, tally.NoopScope, clk)
+	defer r.Stop()
+
+	ran := atomic.NewBool(false)
+	g := r.register()
+	g.after(100*time.Millisecond, func() { ran.Store(true) })
+	require.Equal(RunnerStats{Goroutines: 5, Dispatchers: 1, Scheduled: 1}, r.Stats())
+
+	g.stop()
+	g.stop()
+	g.after(100*time.Millisecond, func() { ran.Store(true) })
+	require.Equal(RunnerStats{Goroutines: 5}, r.Stats())
+
+	clk.Add(time.Second)
+	waitForRunner(t, r, clk, 0)
+	require.False(ran.Load())
+}
+
+// failureCounter counts the Dispatchers which failed.
+type failureCounter struct {
+	noopEvents
+	failures *atomic.Int32
+}
+
+func (e failureCounter) DispatcherFailed(*Dispatcher, TearDownReason) {
+	e.failures.Inc()
+}
+
+func TestDispatchersShareRunner(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+	torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(4, 1).MetaInfo)
+	defer cleanup()
+
+	r := NewRunner(RunnerConfig{Workers: 4, Resolution: 100 * time.Millisecond}, tally.NoopScope, clk)
+	defer r.Stop()
+
+	events := failureCounter{failures: atomic.NewInt32(0)}
+	config := Config{
+		Runner:           r,
+		EnableChoking:    true,
+		PeerIdleTimeout:  time.Minute,
+		DownloadDeadline: 10 * time.Second,
+	}
+
+	before := runtime.NumGoroutine()
+	const n = 200
+	var dispatchers []*Dispatcher
+	for i := 0; i < n; i++ {
+		d, err := New(
+			config,
+			tally.NoopScope,
+			clk,
+			networkevent.NewTestProducer(),
+			events,
+			core.PeerIDFixture(),
+			torrent,
+			zap.NewNop().Sugar(),
+			torrentlog.NewNopLogger())
+		require.NoError(err)
+		dispatchers = append(dispatchers, d)
+	}
+
+	// Without a Runner, each Dispatcher would run several goroutines.
+	require.True(runtime.NumGoroutine()-before < 10)
+	require.Equal(n, r.Stats().Dispatchers)
+
+	// Every Dispatcher misses its deadline on time.
+	for step := 0; step < 99; step++ {
+		clk.Add(100 * time.Millisecond)
+	}
+	waitForRunner(t, r, clk, 0)
+	require.Zero(events.failures.Load())
+	clk.Add(100 * time.Millisecond)
+	waitForRunner(t, r, clk, 0)
+	require.Eventually(func() bool {
+		return events.failures.Load() == n
+	}, 5*time.Second, time.Millisecond)
+
+	for _, d := range dispatchers {
+		d.TearDown()
+	}
+	require.Equal(RunnerStats{Goroutines: 5}, r.Stats())
+}
+
+func TestDispatcherRejectsRunnerWithOtherClock(t *testing.T) {
+	torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(1, 1).MetaInfo)
+	defer cleanup()
+
+	r := NewRunner(RunnerConfig{}, tally.NoopScope, clock.NewMock())
+	defer r.Stop()
+
+	_, err := newDispatcher(
+		Config{Runner: r},
+		tally.NoopScope,
+		clock.NewMock(),
+		networkevent.NewTestProducer(),
+		noopEvents{},
+		core.PeerIDFixture(),
+		torrent,
+		zap.NewNop().Sugar(),
+		torrentlog.NewNopLogger())
+	require.Error(t, err)
+}
+
+func TestDispatcherKickRunsOnRunner(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+	torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(2, 1).MetaInfo)
+	defer cleanup()
+
+	r := NewRunner(RunnerConfig{}, tally.NoopScope, clk)
+	defer r.Stop()
+
+	d := testDispatcher(Config{Runner: r, DisableEndgame: true, DisableKeepalive: true}, clk, torrent)
+	defer d.TearDown()
+
+	p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, true), newMockMessages())
+	require.NoError(err)
+
+	// The pass runs right away, without the clock reaching the next tick.
+	d.Kick()
+	require.Eventually(func() bool {
+		return len(requestedPieces(p.messages)) == 2
+	}, time.Second, time.Millisecond)
+}
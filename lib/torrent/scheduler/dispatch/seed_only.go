@@ -0,0 +1,60 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"github.com/uber/kraken/gen/go/proto/p2p"
+	"github.com/uber/kraken/lib/torrent/scheduler/wire"
+	"github.com/uber/kraken/lib/torrent/storage"
+)
+
+// SeedOnly returns true if d neither requests nor tracks pieces, see
+// Config.SeedOnly.
+func (d *Dispatcher) SeedOnly() bool {
+	return d.seedOnly.Load()
+}
+
+// becomeSeedOnly transitions d, which completed, to seed-only, shedding the
+// state of requesting pieces: pending requests are cancelled, since they are
+// superseded, and the useful pieces cached for peers are dropped. No-op if d
+// was already seed-only.
+func (d *Dispatcher) becomeSeedOnly() {
+	if !d.seedOnly.CAS(false, true) {
+		return
+	}
+	for _, r := range d.pieceRequestManager.Reset() {
+		d.cancelPieceRequest(r.PeerID, r.Piece)
+	}
+	d.updateOutstandingRequests()
+	d.peers.Range(func(k, v interface{}) bool {
+		p := v.(*peer)
+		p.requestMu.Lock()
+		d.releaseUsefulPiecesLocked(p)
+		p.requestMu.Unlock()
+		return true
+	})
+	d.stats.Counter("seed_only_transitions").Inc(1)
+}
+
+// discardSeedOnlyPayload discards a piece payload p sent although d is
+// seed-only, e.g. since the payload was already on its way when d completed.
+func (d *Dispatcher) discardSeedOnlyPayload(
+	p *peer, msg *p2p.PiecePayloadMessage, payload storage.PieceReader) {
+
+	if payload != nil {
+		payload.Close()
+	}
+	_, length, _ := wire.Chunk(msg)
+	d.duplicatePieceReceived(p, int(msg.Index), length)
+}
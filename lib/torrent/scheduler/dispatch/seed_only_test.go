@@ -0,0 +1,136 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"testing"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/torrent/scheduler/conn"
+	"github.com/uber/kraken/lib/torrent/storage"
+	"github.com/uber/kraken/lib/torrent/storage/agentstorage"
+	"github.com/uber/kraken/lib/torrent/storage/piecereader"
+	"github.com/uber/kraken/utils/bitsetutil"
+)
+
+func TestSeedOnlyDispatcher(t *testing.T) {
+	tests := []struct {
+		desc     string
+		config   Config
+		complete bool
+	}{
+		{"complete torrent", Config{}, true},
+		{"config", Config{SeedOnly: true}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+
+			blob := core.SizedBlobFixture(2, 1)
+			var torrent storage.Torrent
+			var cleanup func()
+			if test.complete {
+				torrent, cleanup = completeTorrentFixture(t, blob)
+			} else {
+				torrent, cleanup = agentstorage.TorrentFixture(blob.MetaInfo)
+			}
+			defer cleanup()
+
+			d := testDispatcher(test.config, clock.NewMock(), torrent)
+			require.True(d.SeedOnly())
+			require.True(d.Dump().SeedOnly)
+			require.Nil(d.pieceRequestManager)
+
+			p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, false), newMockMessages())
+			require.NoError(err)
+			require.Nil(p.useful)
+
+			// Announcements only update the bitfield of the peer.
+			require.NoError(d.dispatch(p, conn.NewAnnouncePieceMessage(1)))
+			require.True(p.bitfield.Complete())
+			require.NoError(d.dispatch(p, conn.NewCompleteMessage()))
+			require.Empty(requestedPieces(p.messages))
+
+			// Payloads are discarded rather than written.
+			require.NoError(d.dispatch(
+				p, conn.NewPiecePayloadMessage(0, piecereader.NewBuffer(blob.Content[0:1]))))
+			require.Equal(1, p.pstats.getDuplicatePiecesReceived())
+			require.Equal(test.complete, torrent.HasPiece(0))
+
+			// Leech-side calls are no-ops rather than panics.
+			d.PrioritizePieces([]int{0})
+			d.SetPiecePriorities([]PieceRange{{0, 2}})
+			d.DeprioritizePieces([]int{0})
+			d.NotifyPiecesWritten([]int{0})
+			require.NoError(d.dispatch(p, conn.NewChokeMessage()))
+			require.Empty(d.Snapshot().Peers[0].PendingPieces)
+
+			require.NoError(d.RemovePeer(p.id))
+		})
+	}
+}
+
+func TestDispatcherBecomesSeedOnlyOnCompletion(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(2, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	stats := tally.NewTestScope("", nil)
+	d := testDispatcher(Config{}, clock.NewMock(), torrent)
+	d.stats = stats
+	require.False(d.SeedOnly())
+
+	seeder, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, true), newMockMessages())
+	require.NoError(err)
+	leecher, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, false), newMockMessages())
+	require.NoError(err)
+	require.NotNil(leecher.useful)
+
+	_, err = d.maybeRequestMorePieces(seeder)
+	require.NoError(err)
+	require.NotZero(d.pieceRequestManager.NumPending())
+
+	for i := 0; i < 2; i++ {
+		require.NoError(d.dispatch(
+			seeder, conn.NewPiecePayloadMessage(i, piecereader.NewBuffer(blob.Content[i:i+1]))))
+	}
+	require.True(d.Complete())
+
+	// The request-side state is shed.
+	require.True(d.SeedOnly())
+	require.Zero(d.pieceRequestManager.NumPending())
+	require.Empty(d.pieceRequestManager.PendingPiecesByPeer())
+	require.Nil(leecher.useful)
+	select {
+	case <-d.pendingPiecesDone:
+	default:
+		require.Fail("pending piece requests still watched")
+	}
+	require.Equal(int64(1), stats.Snapshot().Counters()["seed_only_transitions+"].Value())
+
+	// Payloads which were already on their way are discarded.
+	require.NoError(d.dispatch(
+		leecher, conn.NewPiecePayloadMessage(0, piecereader.NewBuffer(blob.Content[0:1]))))
+	require.Equal(1, leecher.pstats.getDuplicatePiecesReceived())
+
+	require.NoError(d.dispatch(leecher, conn.NewAnnouncePieceMessage(1)))
+	require.Empty(requestedPieces(leecher.messages))
+}
@@ -0,0 +1,278 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"go.uber.org/atomic"
+
+	"github.com/uber/kraken/lib/torrent/scheduler/conn"
+	"github.com/uber/kraken/lib/torrent/scheduler/wire"
+)
+
+var (
+	errSendQueueFull   = errors.New("send queue full")
+	errSendQueueClosed = errors.New("send queue closed")
+)
+
+// sendQueue buffers the messages sent to a peer in front of its Messages, such
+// that a peer which stops reading does not stall the goroutines which send it
+// messages, e.g. announcements of pieces we received from other peers.
+type sendQueue struct {
+	messages Messages
+	clk      clock.Clock
+	queue    chan *conn.Message
+	done     chan struct{}
+	canceled <-chan struct{} // Closed once the Dispatcher is torn down.
+	stopOnce sync.Once
+
+	// Called with the first message which the Messages of q failed to send,
+	// after which q is stopped.
+	failed func(*conn.Message, error)
+
+	// Set once the peer was closed for its queue staying full.
+	closing *atomic.Bool
+
+	mu        sync.Mutex
+	fullSince time.Time // Zero unless the last send found the queue full.
+}
+
+func newSendQueue(
+	messages Messages,
+	clk clock.Clock,
+	size int,
+	canceled <-chan struct{},
+	failed func(*conn.Message, error)) *sendQueue {
+
+	return &sendQueue{
+		messages: messages,
+		clk:      clk,
+		queue:    make(chan *conn.Message, size),
+		done:     make(chan struct{}),
+		canceled: canceled,
+		failed:   failed,
+		closing:  atomic.NewBool(false),
+	}
+}
+
+// start hands queued messages to the Messages of q in order until q is stopped
+// or canceled, or a send fails.
+func (q *sendQueue) start() {
+	go func() {
+		for {
+			select {
+			case msg := <-q.queue:
+				if err := q.messages.Send(msg); err != nil {
+					q.stop()
+					q.failed(msg, err)
+					return
+				}
+			case <-q.done:
+				q.discard()
+				return
+			case <-q.canceled:
+				q.stop()
+				return
+			}
+		}
+	}()
+}
+
+// send enqueues msg, or returns errSendQueueFull if q is full.
+func (q *sendQueue) send(msg *conn.Message) error {
+	return q.sendWithin(msg, 0)
+}
+
+// sendWithin enqueues msg, waiting up to timeout for room if q is full.
+// Returns errSendQueueFull if q stayed full, or errSendQueueClosed if q was
+// stopped or canceled meanwhile. The payload of msg, if any, is
+// closed unless msg was enqueued.
+func (q *sendQueue) sendWithin(msg *conn.Message, timeout time.Duration) error {
+	err := q.enqueue(msg, timeout)
+	if err != nil && msg.Payload != nil {
+		msg.Payload.Close()
+	}
+	return err
+}
+
+func (q *sendQueue) enqueue(msg *conn.Message, timeout time.Duration) error {
+	if q.stopped() {
+		return errSendQueueClosed
+	}
+	select {
+	case q.queue <- msg:
+		q.markFull(false)
+		return nil
+	default:
+	}
+	q.markFull(true)
+	if timeout <= 0 {
+		return errSendQueueFull
+	}
+	timer := q.clk.Timer(timeout)
+	defer timer.Stop()
+	select {
+	case q.queue <- msg:
+		q.markFull(false)
+		return nil
+	case <-timer.C:
+		return errSendQueueFull
+	case <-q.done:
+		return errSendQueueClosed
+	case <-q.canceled:
+		return errSendQueueClosed
+	}
+}
+
+func (q *sendQueue) markFull(full bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if !full {
+		q.fullSince = time.Time{}
+	} else if q.fullSince.IsZero() {
+		q.fullSince = q.clk.Now()
+	}
+}
+
+// fullFor returns how long sends have found q full, or zero if the last send
+// did not.
+func (q *sendQueue) fullFor() time.Duration {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.fullSince.IsZero() {
+		return 0
+	}
+	return q.clk.Now().Sub(q.fullSince)
+}
+
+// depth returns the number of queued messages.
+func (q *sendQueue) depth() int {
+	return len(q.queue)
+}
+
+func (q *sendQueue) stopped() bool {
+	select {
+	case <-q.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// stop stops handing queued messages to the Messages of q, and closes the
+// payloads of the messages left in q.
+func (q *sendQueue) stop() {
+	q.stopOnce.Do(func() {
+		close(q.done)
+		q.discard()
+	})
+}
+
+func (q *sendQueue) discard() {
+	for {
+		select {
+		case msg := <-q.queue:
+			if msg.Payload != nil {
+				msg.Payload.Close()
+			}
+		default:
+			return
+		}
+	}
+}
+
+// send sends msg to p. If Config.SendQueueSize is set, msg is dropped rather
+// than waited for if the send queue of p is full, which suits messages whose
+// loss the peer recovers from, such as announcements.
+func (d *Dispatcher) send(p *peer, msg *conn.Message) error {
+	if p.sendQueue == nil {
+		return p.messages.Send(msg)
+	}
+	err := p.sendQueue.send(msg)
+	if err == errSendQueueFull {
+		d.sendQueueFull(p, msg)
+	}
+	return err
+}
+
+// sendBlocking sends msg to p like send, but waits up to
+// Config.SendQueueBlockTimeout for room in the send queue of p, for messages
+// such as piece payloads and requests which are costly to lose.
+func (d *Dispatcher) sendBlocking(p *peer, msg *conn.Message) error {
+	if p.sendQueue == nil {
+		return p.messages.Send(msg)
+	}
+	err := p.sendQueue.sendWithin(msg, d.config.SendQueueBlockTimeout)
+	if err == errSendQueueFull {
+		d.stats.Tagged(map[string]string{
+			"message_type": msg.Message.Type.String(),
+		}).Counter("send_queue_timeouts").Inc(1)
+		d.sendQueueFull(p, msg)
+	}
+	return err
+}
+
+// sendQueueFailed closes p once its send queue failed to send msg, e.g. since
+// the connection to p closed. Piece requests in msg are marked unsent, and the
+// other requests awaited from p are resent elsewhere by closing p, rather than
+// staying reserved under p until Config.PieceRequestTimeout.
+func (d *Dispatcher) sendQueueFailed(p *peer, msg *conn.Message, err error) {
+	d.stats.Tagged(map[string]string{
+		"message_type": msg.Message.Type.String(),
+	}).Counter("send_queue_send_failures").Inc(1)
+
+	var unsent bool
+	if r, ok := wire.PieceRequest(p.messages, msg.Message); ok {
+		d.pieceRequestManager.MarkUnsent(p.id, int(r.Index))
+		unsent = true
+	}
+	if requests, ok := wire.PieceRequests(p.messages, msg.Message); ok {
+		for _, r := range requests {
+			d.pieceRequestManager.MarkUnsent(p.id, int(r.Index))
+		}
+		unsent = true
+	}
+	if unsent {
+		d.declinePieceRequests(declineSendFailed)
+	}
+	if d.closePeer(p, PeerRemovalClosed) != nil {
+		// p was removed meanwhile.
+		return
+	}
+	d.log("peer", p).Infof("Closed peer after send failed: %s", err)
+}
+
+// sendQueueFull records that msg was not sent to p since the send queue of p
+// was full, and closes p once its queue stayed full for
+// Config.SendQueueFullTimeout.
+func (d *Dispatcher) sendQueueFull(p *peer, msg *conn.Message) {
+	d.stats.Tagged(map[string]string{
+		"message_type": msg.Message.Type.String(),
+	}).Counter("send_queue_full_drops").Inc(1)
+
+	full := p.sendQueue.fullFor()
+	if full < d.config.SendQueueFullTimeout || !p.sendQueue.closing.CAS(false, true) {
+		return
+	}
+	d.log("peer", p).Infof("Closing peer whose send queue stayed full for %s", full)
+	d.stats.Counter("send_queue_full_closes").Inc(1)
+	// Senders may hold locks which closing p takes.
+	go d.closePeer(p, PeerRemovalSendQueueFull)
+}
@@ -0,0 +1,220 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/torrent/scheduler/conn"
+	"github.com/uber/kraken/lib/torrent/storage/agentstorage"
+	"github.com/uber/kraken/lib/torrent/storage/piecereader"
+	"github.com/uber/kraken/utils/bitsetutil"
+)
+
+// stuckMessages are the messages of a peer which stopped reading: Send blocks
+// until they are closed.
+type stuckMessages struct {
+	*mockMessages
+
+	once   sync.Once
+	closed chan struct{}
+}
+
+func newStuckMessages() *stuckMessages {
+	return &stuckMessages{mockMessages: newMockMessages(), closed: make(chan struct{})}
+}
+
+func (m *stuckMessages) Send(msg *conn.Message) error {
+	<-m.closed
+	return errors.New("messages closed")
+}
+
+func (m *stuckMessages) Close() {
+	m.once.Do(func() { close(m.closed) })
+	m.mockMessages.Close()
+}
+
+func TestDispatcherSendQueueDoesNotStallOnStuckPeer(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(4, 1)
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	clk := clock.NewMock()
+	stats := tally.NewTestScope("", nil)
+	d := testDispatcher(Config{
+		SendQueueSize:    2,
+		PipelineLimit:    4,
+		DisableEndgame:   true,
+		DisableKeepalive: true,
+	}, clk, torrent)
+	d.stats = stats
+	defer d.TearDown()
+
+	seeder, err := d.addPeer(
+		core.PeerIDFixture(), bitsetutil.FromBools(true, true, true, true), newMockMessages())
+	require.NoError(err)
+	seeder.sendQueue.start()
+	messages := newStuckMessages()
+	stuck, err := d.addPeer(
+		core.PeerIDFixture(), bitsetutil.FromBools(false, false, false, false), messages)
+	require.NoError(err)
+	stuck.sendQueue.start()
+
+	// Pieces received from the seeder are announced to the stuck peer, which
+	// does not stall the download.
+	_, err = d.maybeRequestMorePieces(seeder)
+	require.NoError(err)
+	require.Eventually(func() bool {
+		return len(requestedPieces(seeder.messages)) == 4
+	}, time.Second, 5*time.Millisecond)
+	for _, i := range requestedPieces(seeder.messages) {
+		require.NoError(d.dispatch(
+			seeder, conn.NewPiecePayloadMessage(i, piecereader.NewBuffer(blob.Content[i:i+1]))))
+	}
+	require.True(d.Complete())
+
+	require.Equal(2, stuck.stats().SendQueueDepth)
+	depths := make(map[string]int)
+	for _, ps := range d.Snapshot().Peers {
+		depths[ps.PeerID] = ps.SendQueueDepth
+	}
+	require.Equal(map[string]int{seeder.id.String(): 0, stuck.id.String(): 2}, depths)
+	require.True(stats.Snapshot().Counters()["send_queue_full_drops+message_type=ANNOUCE_PIECE"].Value() > 0)
+	require.False(messages.isClosed())
+
+	// The stuck peer is closed once its queue stayed full for too long.
+	clk.Add(d.config.SendQueueFullTimeout)
+	require.Error(d.send(stuck, conn.NewKeepaliveMessage()))
+	require.Eventually(messages.isClosed, time.Second, 5*time.Millisecond)
+	_, ok := d.peers.Load(stuck.id)
+	require.False(ok)
+	counters := stats.Snapshot().Counters()
+	require.Equal(int64(1), counters["send_queue_full_closes+"].Value())
+	require.Equal(
+		int64(1),
+		counters["removed_peers+active=false,reason=send_queue_full,useful=false"].Value())
+	require.Equal(0, stuck.sendQueue.depth())
+}
+
+func TestDispatcherSendBlockingWaitsForRoomInSendQueue(t *testing.T) {
+	require := require.New(t)
+
+	torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(1, 1).MetaInfo)
+	defer cleanup()
+
+	clk := clock.NewMock()
+	stats := tally.NewTestScope("", nil)
+	d := testDispatcher(Config{SendQueueSize: 1, DisableKeepalive: true}, clk, torrent)
+	d.stats = stats
+	defer d.TearDown()
+
+	// The queue of p is never drained.
+	messages := newStuckMessages()
+	p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true), messages)
+	require.NoError(err)
+	require.NoError(d.send(p, conn.NewKeepaliveMessage()))
+
+	sendBlocking := func() <-chan error {
+		result := make(chan error, 1)
+		go func() { result <- d.sendBlocking(p, conn.NewPieceRequestMessage(0, 1)) }()
+		return result
+	}
+
+	// The request is dropped once it waited for too long.
+	result := sendBlocking()
+	var err2 error
+	require.Eventually(func() bool {
+		clk.Add(time.Second)
+		select {
+		case err2 = <-result:
+			return true
+		default:
+			return false
+		}
+	}, time.Second, 5*time.Millisecond)
+	require.Equal(errSendQueueFull, err2)
+	require.Equal(
+		int64(1),
+		stats.Snapshot().Counters()["send_queue_timeouts+message_type=PIECE_REQUEST"].Value())
+	require.False(messages.isClosed())
+
+	// The request is queued once there is room.
+	result = sendBlocking()
+	<-p.sendQueue.queue
+	require.NoError(<-result)
+	require.Equal(1, p.sendQueue.depth())
+}
+
+func TestDispatcherSendQueueFailureReleasesPieceRequests(t *testing.T) {
+	require := require.New(t)
+
+	torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(1, 1).MetaInfo)
+	defer cleanup()
+
+	stats := tally.NewTestScope("", nil)
+	d := testDispatcher(Config{
+		SendQueueSize:    4,
+		PipelineLimit:    1,
+		DisableEndgame:   true,
+		DisableKeepalive: true,
+	}, clock.NewMock(), torrent)
+	d.stats = stats
+	defer d.TearDown()
+
+	// The connection to p died, which only its send queue notices.
+	messages := newMockMessages()
+	p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true), messages)
+	require.NoError(err)
+	messages.Close()
+	other, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true), newMockMessages())
+	require.NoError(err)
+
+	// The request is queued, so it is only found failed once p's queue sends it.
+	sent, err := d.maybeRequestMorePieces(p)
+	require.NoError(err)
+	require.True(sent)
+	p.sendQueue.start()
+	require.Eventually(func() bool {
+		_, ok := d.peers.Load(p.id)
+		return !ok
+	}, time.Second, 5*time.Millisecond)
+
+	// The piece is requested from another peer rather than staying reserved
+	// under p until the request times out.
+	sent, err = d.maybeRequestMorePieces(other)
+	require.NoError(err)
+	require.True(sent)
+	other.sendQueue.start()
+	require.Eventually(func() bool {
+		return len(requestedPieces(other.messages)) == 1
+	}, time.Second, 5*time.Millisecond)
+
+	counters := stats.Snapshot().Counters()
+	require.Equal(
+		int64(1),
+		counters["send_queue_send_failures+message_type=PIECE_REQUEST"].Value())
+	require.Equal(
+		int64(1),
+		counters["removed_peers+active=false,reason=closed,useful=false"].Value())
+}
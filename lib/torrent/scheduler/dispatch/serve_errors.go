@@ -0,0 +1,48 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"github.com/uber/kraken/gen/go/proto/p2p"
+	"github.com/uber/kraken/lib/torrent/scheduler/conn"
+)
+
+// sendServeError notifies p that its request for piece i failed due to err,
+// unless p was sent too many error messages recently, in which case the error
+// message is dropped. See Config.MaxErrorMessages.
+func (d *Dispatcher) sendServeError(p *peer, i int, err error) {
+	if !p.allowErrorMessage() {
+		d.stats.Counter("suppressed_error_messages").Inc(1)
+		return
+	}
+	d.send(p, conn.NewErrorMessage(i, p2p.ErrorMessage_PIECE_REQUEST_FAILED, err))
+}
+
+// serveFailed notifies p that serving piece i failed due to err, and closes the
+// connection to p once Config.MaxConsecutiveServeFailures serves to p failed in
+// a row.
+func (d *Dispatcher) serveFailed(p *peer, i int, err error) {
+	d.sendServeError(p, i, err)
+
+	n := p.recordServeFailure()
+	if d.config.MaxConsecutiveServeFailures == 0 || n < d.config.MaxConsecutiveServeFailures {
+		return
+	}
+	if err := d.closePeer(p, PeerRemovalServeFailures); err != nil {
+		// Already removed.
+		return
+	}
+	d.log("peer", p).Warnf("Closed connection after %d consecutive serve failures", n)
+	d.stats.Counter("serve_failure_closes").Inc(1)
+}
@@ -0,0 +1,137 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/gen/go/proto/p2p"
+	"github.com/uber/kraken/lib/torrent/scheduler/conn"
+	"github.com/uber/kraken/lib/torrent/storage"
+	"github.com/uber/kraken/utils/bitsetutil"
+)
+
+var errDiskFailure = errors.New("disk failure")
+
+// failingTorrent fails reads of the pieces in failing.
+type failingTorrent struct {
+	storage.Torrent
+	failing map[int]bool
+}
+
+func (t *failingTorrent) GetPieceReader(piece int) (storage.PieceReader, error) {
+	if t.failing[piece] {
+		return nil, errDiskFailure
+	}
+	return t.Torrent.GetPieceReader(piece)
+}
+
+func TestDispatcherLimitsServeErrorMessages(t *testing.T) {
+	tests := []struct {
+		desc       string
+		config     Config
+		expected   []int // Error messages sent after each round of requests.
+		suppressed int64
+	}{
+		{
+			"limited",
+			Config{MaxErrorMessages: 2, ErrorMessageInterval: time.Second},
+			[]int{2, 4},
+			6,
+		}, {
+			"disabled",
+			Config{DisableErrorMessageLimit: true},
+			[]int{5, 10},
+			0,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+
+			blob := core.SizedBlobFixture(4, 2)
+			torrent, cleanup := completeTorrentFixture(t, blob)
+			defer cleanup()
+
+			clk := clock.NewMock()
+			stats := tally.NewTestScope("", nil)
+			test.config.DisableKeepalive = true
+			d := testDispatcher(test.config, clk, &failingTorrent{torrent, map[int]bool{0: true}})
+			d.stats = stats
+
+			p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false, false), newMockMessages())
+			require.NoError(err)
+
+			for _, expected := range test.expected {
+				// A peer retrying in a tight loop.
+				for i := 0; i < 5; i++ {
+					require.NoError(d.dispatch(p, conn.NewPieceRequestMessage(0, 2)))
+					waitForServes(t, p)
+				}
+				require.Equal(expected, numSent(p.messages, p2p.Message_ERROR))
+				clk.Add(time.Second)
+			}
+
+			var suppressed int64
+			if c, ok := stats.Snapshot().Counters()["suppressed_error_messages+"]; ok {
+				suppressed = c.Value()
+			}
+			require.Equal(test.suppressed, suppressed)
+		})
+	}
+}
+
+func TestDispatcherClosesPeerAfterConsecutiveServeFailures(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(4, 2)
+	torrent, cleanup := completeTorrentFixture(t, blob)
+	defer cleanup()
+
+	stats := tally.NewTestScope("", nil)
+	d := testDispatcher(Config{
+		MaxConsecutiveServeFailures: 3,
+		DisableKeepalive:            true,
+	}, clock.NewMock(), &failingTorrent{torrent, map[int]bool{0: true}})
+	d.stats = stats
+
+	p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false, false), newMockMessages())
+	require.NoError(err)
+
+	request := func(pieces ...int) {
+		for _, i := range pieces {
+			require.NoError(d.dispatch(p, conn.NewPieceRequestMessage(i, 2)))
+			waitForServes(t, p)
+		}
+	}
+
+	// A successful serve resets the failures.
+	request(0, 0, 1, 0, 0)
+	require.False(closed(p.messages))
+
+	request(0)
+	require.True(closed(p.messages))
+	_, ok := d.peers.Load(p.id)
+	require.False(ok)
+
+	counters := stats.Snapshot().Counters()
+	require.Equal(int64(1), counters["serve_failure_closes+"].Value())
+}
@@ -0,0 +1,173 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"container/heap"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/uber-go/tally"
+)
+
+var _serveLatencyBuckets = tally.MustMakeExponentialDurationBuckets(time.Millisecond, 2, 16)
+
+// ServeLatency records how long it took to serve a piece to a peer, measured
+// from reading the piece until its payload was handed off to the connection.
+type ServeLatency struct {
+	Piece    int           `json:"piece"`
+	Duration time.Duration `json:"duration"`
+}
+
+// serveLatencyHeap is a min-heap of ServeLatency by duration.
+type serveLatencyHeap []ServeLatency
+
+func (h serveLatencyHeap) Len() int            { return len(h) }
+func (h serveLatencyHeap) Less(i, j int) bool  { return h[i].Duration < h[j].Duration }
+func (h serveLatencyHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *serveLatencyHeap) Push(x interface{}) { *h = append(*h, x.(ServeLatency)) }
+
+func (h *serveLatencyHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
+
+// serveLatencyTracker keeps the slowest piece serves, and stops advertising
+// pieces whose serves are repeatedly slow until they recover.
+type serveLatencyTracker struct {
+	capacity  int
+	threshold time.Duration
+	limit     int
+
+	mu           sync.Mutex // Protects the following fields:
+	slowest      serveLatencyHeap
+	slowServes   map[int]int
+	unadvertised map[int]bool
+}
+
+func newServeLatencyTracker(capacity int, threshold time.Duration, limit int) *serveLatencyTracker {
+	return &serveLatencyTracker{
+		capacity:     capacity,
+		threshold:    threshold,
+		limit:        limit,
+		slowServes:   make(map[int]int),
+		unadvertised: make(map[int]bool),
+	}
+}
+
+// serveLatencyChange describes how recording a serve changed whether its piece
+// is advertised.
+type serveLatencyChange int
+
+const (
+	advertisementUnchanged serveLatencyChange = iota
+	pieceUnadvertised
+	pieceRecovered
+)
+
+// record records a serve of piece which took d. A piece is unadvertised once
+// limit of its serves were slow, and recovers once it is served within
+// threshold again.
+func (t *serveLatencyTracker) record(piece int, d time.Duration) serveLatencyChange {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.capacity > 0 {
+		l := ServeLatency{Piece: piece, Duration: d}
+		if len(t.slowest) < t.capacity {
+			heap.Push(&t.slowest, l)
+		} else if t.slowest[0].Duration < d {
+			t.slowest[0] = l
+			heap.Fix(&t.slowest, 0)
+		}
+	}
+
+	if t.threshold == 0 {
+		return advertisementUnchanged
+	}
+	if d <= t.threshold {
+		if t.unadvertised[piece] {
+			delete(t.unadvertised, piece)
+			return pieceRecovered
+		}
+		return advertisementUnchanged
+	}
+	if t.unadvertised[piece] {
+		return advertisementUnchanged
+	}
+	t.slowServes[piece]++
+	if t.slowServes[piece] < t.limit {
+		return advertisementUnchanged
+	}
+	delete(t.slowServes, piece)
+	t.unadvertised[piece] = true
+	return pieceUnadvertised
+}
+
+// readvertise advertises piece again, returning true if it was unadvertised.
+func (t *serveLatencyTracker) readvertise(piece int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.unadvertised[piece] {
+		return false
+	}
+	delete(t.unadvertised, piece)
+	return true
+}
+
+// advertised returns false if piece was excluded due to slow serves.
+func (t *serveLatencyTracker) advertised(piece int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return !t.unadvertised[piece]
+}
+
+// numUnadvertised returns the number of pieces excluded due to slow serves.
+func (t *serveLatencyTracker) numUnadvertised() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return len(t.unadvertised)
+}
+
+// getUnadvertised returns the pieces excluded due to slow serves, in ascending
+// order.
+func (t *serveLatencyTracker) getUnadvertised() []int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var res []int
+	for i := range t.unadvertised {
+		res = append(res, i)
+	}
+	sort.Ints(res)
+	return res
+}
+
+// getSlowest returns the slowest serves, slowest first.
+func (t *serveLatencyTracker) getSlowest() []ServeLatency {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	res := make([]ServeLatency, len(t.slowest))
+	copy(res, t.slowest)
+	sort.Slice(res, func(i, j int) bool { return res[i].Duration > res[j].Duration })
+	return res
+}
@@ -0,0 +1,210 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"sync"
+	"time"
+
+	"github.com/uber/kraken/core"
+)
+
+// prefetchedPiece is a piece read ahead for a peer.
+type prefetchedPiece struct {
+	length      int64
+	scheduledAt time.Time
+	b           []byte // Nil while the piece is being read.
+}
+
+// peerPrefetches tracks the pieces read ahead for a peer.
+type peerPrefetches struct {
+	lastServed int // -1 if no piece was served to the peer.
+	pieces     map[int]*prefetchedPiece
+}
+
+// servePrefetcher reads ahead the pieces which peers requesting ascending runs
+// of pieces are likely to request next, such that they are served from memory.
+// At most depth pieces are prefetched per peer, and at most maxBytes in total.
+// Prefetched pieces which are not requested within ttl are discarded once the
+// next piece is served to any peer.
+type servePrefetcher struct {
+	depth    int
+	ttl      time.Duration
+	maxBytes int64
+
+	mu    sync.Mutex // Protects the following fields:
+	bytes int64
+	peers map[core.PeerID]*peerPrefetches
+}
+
+func newServePrefetcher(depth int, ttl time.Duration, maxBytes int64) *servePrefetcher {
+	return &servePrefetcher{
+		depth:    depth,
+		ttl:      ttl,
+		maxBytes: maxBytes,
+		peers:    make(map[core.PeerID]*peerPrefetches),
+	}
+}
+
+// served records that piece i was served to peerID at now. If i continues an
+// ascending run, schedules the following pieces which length accepts, and
+// returns them such that they are read and passed to loaded. Also returns the
+// number of prefetched pieces which expired unused.
+func (f *servePrefetcher) served(
+	peerID core.PeerID, i int, now time.Time, length func(j int) (int64, bool)) ([]int, int) {
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	wasted := f.expireLocked(now)
+
+	pp, ok := f.peers[peerID]
+	if !ok {
+		pp = &peerPrefetches{lastServed: -1, pieces: make(map[int]*prefetchedPiece)}
+		f.peers[peerID] = pp
+	}
+	ascending := pp.lastServed >= 0 && i == pp.lastServed+1
+	pp.lastServed = i
+	if !ascending {
+		return nil, wasted
+	}
+
+	var scheduled []int
+	for j := i + 1; j <= i+f.depth && len(pp.pieces) < f.depth; j++ {
+		if _, ok := pp.pieces[j]; ok {
+			continue
+		}
+		n, ok := length(j)
+		if !ok {
+			continue
+		}
+		if f.bytes+n > f.maxBytes {
+			break
+		}
+		f.bytes += n
+		pp.pieces[j] = &prefetchedPiece{length: n, scheduledAt: now}
+		scheduled = append(scheduled, j)
+	}
+	return scheduled, wasted
+}
+
+// loaded stores b as piece i prefetched for peerID, unless the prefetch was
+// discarded while i was being read.
+func (f *servePrefetcher) loaded(peerID core.PeerID, i int, b []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if pp, ok := f.peers[peerID]; ok {
+		if p, ok := pp.pieces[i]; ok && p.b == nil {
+			p.b = b
+		}
+	}
+}
+
+// drop discards the prefetch of piece i for peerID, e.g. if it failed to read.
+func (f *servePrefetcher) drop(peerID core.PeerID, i int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if pp, ok := f.peers[peerID]; ok {
+		f.removeLocked(pp, i)
+	}
+}
+
+// take removes piece i prefetched for peerID, returning its content if it was
+// read already. Otherwise, returns whether the prefetch was wasted.
+func (f *servePrefetcher) take(peerID core.PeerID, i int) (b []byte, wasted bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	pp, ok := f.peers[peerID]
+	if !ok {
+		return nil, false
+	}
+	p, ok := pp.pieces[i]
+	if !ok {
+		return nil, false
+	}
+	f.removeLocked(pp, i)
+	return p.b, p.b == nil
+}
+
+// clear discards all prefetches for peerID, returning how many were discarded.
+func (f *servePrefetcher) clear(peerID core.PeerID) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	pp, ok := f.peers[peerID]
+	if !ok {
+		return 0
+	}
+	n := len(pp.pieces)
+	for i := range pp.pieces {
+		f.removeLocked(pp, i)
+	}
+	delete(f.peers, peerID)
+	return n
+}
+
+// loading returns the number of prefetched pieces which are still being read.
+func (f *servePrefetcher) loading() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var n int
+	for _, pp := range f.peers {
+		for _, p := range pp.pieces {
+			if p.b == nil {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// numPeers returns the number of peers with prefetched pieces.
+func (f *servePrefetcher) numPeers() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return len(f.peers)
+}
+
+// size returns the number of bytes reserved by prefetched pieces.
+func (f *servePrefetcher) size() int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.bytes
+}
+
+func (f *servePrefetcher) expireLocked(now time.Time) int {
+	var n int
+	for _, pp := range f.peers {
+		for i, p := range pp.pieces {
+			if now.Sub(p.scheduledAt) >= f.ttl {
+				f.removeLocked(pp, i)
+				n++
+			}
+		}
+	}
+	return n
+}
+
+func (f *servePrefetcher) removeLocked(pp *peerPrefetches, i int) {
+	if p, ok := pp.pieces[i]; ok {
+		f.bytes -= p.length
+		delete(pp.pieces, i)
+	}
+}
@@ -0,0 +1,200 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/gen/go/proto/p2p"
+	"github.com/uber/kraken/lib/torrent/scheduler/conn"
+	"github.com/uber/kraken/lib/torrent/storage/agentstorage"
+	"github.com/uber/kraken/lib/torrent/storage/piecereader"
+	"github.com/uber/kraken/utils/bitsetutil"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+)
+
+func anyPiece(j int) (int64, bool) { return 1, true }
+
+func TestServePrefetcherSchedulesAscendingRuns(t *testing.T) {
+	require := require.New(t)
+
+	f := newServePrefetcher(2, time.Second, 10)
+	p := core.PeerIDFixture()
+	now := time.Now()
+
+	pieces, _ := f.served(p, 3, now, anyPiece)
+	require.Empty(pieces)
+
+	// Descending.
+	pieces, _ = f.served(p, 2, now, anyPiece)
+	require.Empty(pieces)
+
+	pieces, _ = f.served(p, 3, now, anyPiece)
+	require.Equal([]int{4, 5}, pieces)
+
+	// Still being read.
+	b, wasted := f.take(p, 4)
+	require.Nil(b)
+	require.True(wasted)
+
+	f.loaded(p, 5, []byte{5})
+	b, wasted = f.take(p, 5)
+	require.Equal([]byte{5}, b)
+	require.False(wasted)
+
+	// Discarded prefetches are not stored once read.
+	f.loaded(p, 4, []byte{4})
+	b, _ = f.take(p, 4)
+	require.Nil(b)
+	require.Equal(int64(0), f.size())
+}
+
+func TestServePrefetcherBounds(t *testing.T) {
+	require := require.New(t)
+
+	f := newServePrefetcher(2, time.Second, 3)
+	p1 := core.PeerIDFixture()
+	p2 := core.PeerIDFixture()
+	now := time.Now()
+
+	f.served(p1, 0, now, anyPiece)
+	pieces, _ := f.served(p1, 1, now, anyPiece)
+	require.Equal([]int{2, 3}, pieces)
+
+	// At most depth pieces per peer.
+	pieces, _ = f.served(p1, 2, now, anyPiece)
+	require.Empty(pieces)
+
+	// At most maxBytes in total.
+	f.served(p2, 0, now, anyPiece)
+	pieces, _ = f.served(p2, 1, now, anyPiece)
+	require.Equal([]int{2}, pieces)
+	require.Equal(int64(3), f.size())
+
+	// Unused prefetches expire.
+	pieces, wasted := f.served(p2, 5, now.Add(time.Second), anyPiece)
+	require.Empty(pieces)
+	require.Equal(3, wasted)
+	require.Equal(int64(0), f.size())
+
+	f.served(p1, 6, now, anyPiece)
+	pieces, _ = f.served(p1, 7, now, anyPiece)
+	require.Equal([]int{8, 9}, pieces)
+	require.Equal(2, f.clear(p1))
+	require.Equal(int64(0), f.size())
+}
+
+func counterValue(stats tally.TestScope, name string) int64 {
+	if c, ok := stats.Snapshot().Counters()[name+"+"]; ok {
+		return c.Value()
+	}
+	return 0
+}
+
+func TestDispatcherServePrefetchSequentialRequester(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(8, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	for i := 0; i < 8; i++ {
+		require.NoError(torrent.WritePiece(piecereader.NewBuffer(blob.Content[i:i+1]), i))
+	}
+
+	stats := tally.NewTestScope("", nil)
+
+	d := testDispatcher(Config{ServePrefetchDepth: 2}, clock.NewMock(), torrent)
+	d.stats = stats
+
+	p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(make([]bool, 8)...), newMockMessages())
+	require.NoError(err)
+
+	for i := 0; i < 8; i++ {
+		require.NoError(d.dispatch(p, conn.NewPieceRequestMessage(i, 1)))
+		waitForServes(t, p)
+		require.Eventually(func() bool { return d.prefetch.loading() == 0 }, time.Second, time.Millisecond)
+	}
+
+	sent := p.messages.(*mockMessages).getSent()
+	require.Len(sent, 8)
+	for i, msg := range sent {
+		require.Equal(p2p.Message_PIECE_PAYLOAD, msg.Message.Type)
+		b, err := ioutil.ReadAll(msg.Payload)
+		require.NoError(err)
+		require.Equal(blob.Content[i:i+1], b)
+	}
+
+	// Pieces after the first two were prefetched.
+	require.Equal(int64(6), counterValue(stats, "serve_prefetch_hits"))
+	require.Equal(int64(0), counterValue(stats, "serve_prefetch_wasted"))
+}
+
+func TestDispatcherServePrefetchRandomRequester(t *testing.T) {
+	require := require.New(t)
+
+	const numPieces = 64
+	const depth = 2
+	const maxBytes = 3
+
+	blob := core.SizedBlobFixture(numPieces, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	for i := 0; i < numPieces; i++ {
+		require.NoError(torrent.WritePiece(piecereader.NewBuffer(blob.Content[i:i+1]), i))
+	}
+
+	stats := tally.NewTestScope("", nil)
+
+	config := Config{
+		ServePrefetchDepth: depth,
+		ServePrefetchBytes: maxBytes,
+	}
+	d := testDispatcher(config, clock.NewMock(), torrent)
+	d.stats = stats
+
+	p, err := d.addPeer(
+		core.PeerIDFixture(), bitsetutil.FromBools(make([]bool, numPieces)...), newMockMessages())
+	require.NoError(err)
+
+	order := rand.Perm(numPieces)
+	var ascending int
+	for k, i := range order {
+		if k > 0 && i == order[k-1]+1 {
+			ascending++
+		}
+		require.NoError(d.dispatch(p, conn.NewPieceRequestMessage(i, 1)))
+		waitForServes(t, p)
+		require.True(d.prefetch.size() <= maxBytes)
+	}
+	require.NoError(d.removePeer(p))
+	require.Equal(int64(0), d.prefetch.size())
+
+	// Every prefetch is either used or wasted, and only ascending runs are
+	// prefetched.
+	prefetches := counterValue(stats, "serve_prefetches")
+	wasted := counterValue(stats, "serve_prefetch_wasted")
+	require.Equal(prefetches, counterValue(stats, "serve_prefetch_hits")+wasted)
+	require.True(wasted <= int64(depth*ascending), "wasted %d > %d", wasted, depth*ascending)
+}
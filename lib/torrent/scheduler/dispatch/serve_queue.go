@@ -0,0 +1,193 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"sync"
+
+	"github.com/uber/kraken/gen/go/proto/p2p"
+)
+
+// serveQueue queues piece requests received from a peer, such that requests can
+// be cancelled while they wait to be served. Requests are served by a goroutine
+// which only lives while there are requests to serve and the queue is not
+// choked. Priority requests are served ahead of other requests if enabled, see
+// enablePriority.
+type serveQueue struct {
+	mu        sync.Mutex // Protects the following fields:
+	queue     []*p2p.PieceRequestMessage
+	running   bool
+	current   *p2p.PieceRequestMessage // Request currently being served.
+	cancelled bool                     // Whether current was cancelled.
+	choked    bool                     // Whether requests are held until unchoked.
+	priority  *priorityShare           // Nil if requests are served in order.
+}
+
+func newServeQueue() *serveQueue {
+	return &serveQueue{}
+}
+
+// enablePriority serves priority requests ahead of other requests, up to
+// percent of the requests served while both kinds are queued.
+func (q *serveQueue) enablePriority(percent int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.priority = newPriorityShare(percent)
+}
+
+// push enqueues msg. Returns true if the caller must start a goroutine which
+// serves requests until next returns false.
+func (q *serveQueue) push(msg *p2p.PieceRequestMessage) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.queue = append(q.queue, msg)
+	if q.running || q.choked {
+		return false
+	}
+	q.running = true
+	return true
+}
+
+// next dequeues the next request to serve. Returns false if the queue is empty
+// or choked, in which case the serving goroutine must exit.
+func (q *serveQueue) next() (*p2p.PieceRequestMessage, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.current = nil
+	q.cancelled = false
+	if len(q.queue) == 0 || q.choked {
+		q.running = false
+		return nil, false
+	}
+	j := 0
+	if q.priority != nil {
+		var contested bool
+		j, contested = q.priority.pick(q.firstLocked)
+		if contested {
+			q.priority.record(q.queue[j].Priority)
+		}
+	}
+	q.current = q.queue[j]
+	if j == 0 {
+		q.queue = q.queue[1:]
+	} else {
+		q.queue = append(q.queue[:j], q.queue[j+1:]...)
+	}
+	return q.current, true
+}
+
+// firstLocked returns the index of the first queued request of the given
+// priority, or -1 if there is none.
+func (q *serveQueue) firstLocked(priority bool) int {
+	for j, msg := range q.queue {
+		if msg.Priority == priority {
+			return j
+		}
+	}
+	return -1
+}
+
+// cancel removes all queued requests for piece i, and marks the request being
+// served as cancelled if it is for piece i. Returns the number of removed
+// requests.
+func (q *serveQueue) cancel(i int) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var n int
+	var kept []*p2p.PieceRequestMessage
+	for _, msg := range q.queue {
+		if int(msg.Index) == i {
+			n++
+			continue
+		}
+		kept = append(kept, msg)
+	}
+	q.queue = kept
+	if q.current != nil && int(q.current.Index) == i {
+		q.cancelled = true
+	}
+	return n
+}
+
+// currentCancelled returns true if the request being served was cancelled.
+func (q *serveQueue) currentCancelled() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.cancelled
+}
+
+// clear drops all queued requests. Returns the number of dropped requests.
+func (q *serveQueue) clear() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	n := len(q.queue)
+	q.queue = nil
+	return n
+}
+
+// idle returns true if no requests are queued nor being served.
+func (q *serveQueue) idle() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return !q.running
+}
+
+// choke holds queued and future requests until unchoke is called. The request
+// being served, if any, is not interrupted. Returns true if q was not choked.
+func (q *serveQueue) choke() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	changed := !q.choked
+	q.choked = true
+	return changed
+}
+
+// unchoke releases held requests. Returns whether q was choked, and whether the
+// caller must start a goroutine which serves requests until next returns false.
+func (q *serveQueue) unchoke() (changed bool, start bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	changed = q.choked
+	q.choked = false
+	if q.running || len(q.queue) == 0 {
+		return changed, false
+	}
+	q.running = true
+	return changed, true
+}
+
+// isChoked returns whether requests are held.
+func (q *serveQueue) isChoked() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.choked
+}
+
+// len returns the number of queued requests.
+func (q *serveQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.queue)
+}
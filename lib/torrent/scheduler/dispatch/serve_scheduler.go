@@ -0,0 +1,91 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/uber/kraken/core"
+)
+
+// Serve scheduling policies, see Config.ServeSchedulingPolicy.
+const (
+	// FIFOServePolicy serves queued serves in the order they were queued.
+	FIFOServePolicy = "fifo"
+
+	// CompletionServePolicy serves peers closest to completing the torrent
+	// first, such that new seeders emerge quickly.
+	CompletionServePolicy = "completion"
+)
+
+// QueuedServe describes a serve waiting for the egress limit.
+type QueuedServe struct {
+	PeerID   core.PeerID
+	Piece    int
+	QueuedAt time.Time
+
+	// Priority is whether the peer requested the piece urgently, see
+	// conn.PriorityRequests. Priority serves are served ahead of other serves
+	// regardless of the ServeScheduler, within Config.PriorityServePercent, so
+	// Less only orders serves of equal priority.
+	Priority bool
+
+	// PeerCompletion is the fraction of pieces the peer has, and
+	// PeerBytesDownloaded the bytes we downloaded from the peer, as of when
+	// queued serves are ordered.
+	PeerCompletion      float64
+	PeerBytesDownloaded int64
+}
+
+// ServeScheduler orders serves queued due to Config.EgressBytesPerSec, i.e.
+// decides which peer is served first under contention, among serves of equal
+// priority. The next serve is picked
+// from fresh QueuedServes whenever egress becomes available, so Less must be
+// cheap.
+type ServeScheduler interface {
+	// Less returns true if a should be served before b.
+	Less(a, b QueuedServe) bool
+}
+
+// FIFOServeScheduler serves queued serves in the order they were queued.
+type FIFOServeScheduler struct{}
+
+// Less implements ServeScheduler.
+func (FIFOServeScheduler) Less(a, b QueuedServe) bool {
+	return a.QueuedAt.Before(b.QueuedAt)
+}
+
+// CompletionServeScheduler serves peers with higher completion first, and
+// serves of peers with equal completion in the order they were queued.
+type CompletionServeScheduler struct{}
+
+// Less implements ServeScheduler.
+func (CompletionServeScheduler) Less(a, b QueuedServe) bool {
+	if a.PeerCompletion != b.PeerCompletion {
+		return a.PeerCompletion > b.PeerCompletion
+	}
+	return a.QueuedAt.Before(b.QueuedAt)
+}
+
+func newServeScheduler(policy string) (ServeScheduler, error) {
+	switch policy {
+	case FIFOServePolicy:
+		return FIFOServeScheduler{}, nil
+	case CompletionServePolicy:
+		return CompletionServeScheduler{}, nil
+	default:
+		return nil, fmt.Errorf("invalid serve scheduling policy: %s", policy)
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/utils/bitsetutil"
+)
+
+func servePeerFixture(clk clock.Clock, has ...bool) *peer {
+	return newPeer(
+		core.PeerIDFixture(), bitsetutil.FromBools(has...), newMockMessages(),
+		clk, &peerStats{}, time.Second, time.Second, 0.5)
+}
+
+// queueServes exhausts the burst of l and queues a serve of one byte for each
+// of peers, in order. Returns a channel on which queued serves report their
+// peer once granted.
+func queueServes(t *testing.T, l *egressLimiter, peers ...*peer) <-chan *peer {
+	return queuePriorityServes(t, l, make([]bool, len(peers)), peers...)
+}
+
+// queuePriorityServes queues serves like queueServes, where priority is
+// whether the serve of each peer is a priority one.
+func queuePriorityServes(t *testing.T, l *egressLimiter, priority []bool, peers ...*peer) <-chan *peer {
+	require.True(t, l.wait(peers[0], 0, 1, false))
+
+	granted := make(chan *peer, len(peers))
+	for i, p := range peers {
+		p, priority := p, priority[i]
+		go func() {
+			if l.wait(p, 0, 1, priority) {
+				granted <- p
+			}
+		}()
+		require.Eventually(t, func() bool {
+			return l.numQueued() == i+1
+		}, time.Second, time.Millisecond)
+	}
+	return granted
+}
+
+func nextGranted(t *testing.T, clk *clock.Mock, granted <-chan *peer) *peer {
+	clk.Add(time.Second)
+	select {
+	case p := <-granted:
+		return p
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "queued serve not granted")
+		return nil
+	}
+}
+
+func TestEgressLimiterServeOrder(t *testing.T) {
+	tests := []struct {
+		desc     string
+		policy   string
+		expected []int
+	}{
+		{"fifo", FIFOServePolicy, []int{0, 1, 2}},
+		{"completion", CompletionServePolicy, []int{2, 0, 1}},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+
+			clk := clock.NewMock()
+
+			peers := []*peer{
+				servePeerFixture(clk, true, false, false, false),
+				servePeerFixture(clk, false, false, false, false),
+				servePeerFixture(clk, true, true, true, false),
+			}
+
+			scheduler, err := newServeScheduler(test.policy)
+			require.NoError(err)
+			l := newEgressLimiter(clk, 1, 1, len(peers), scheduler, 50)
+
+			granted := queueServes(t, l, peers...)
+			for _, i := range test.expected {
+				require.Equal(peers[i], nextGranted(t, clk, granted))
+			}
+			require.Equal(0, l.numQueued())
+		})
+	}
+}
+
+func TestEgressLimiterReevaluatesCompletionOfQueuedPeers(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+
+	p1 := servePeerFixture(clk, true, true, false, false)
+	p2 := servePeerFixture(clk, true, false, false, false)
+	p3 := servePeerFixture(clk, false, false, false, false)
+
+	l := newEgressLimiter(clk, 1, 1, 3, CompletionServeScheduler{}, 50)
+
+	granted := queueServes(t, l, p1, p2, p3)
+	require.Equal(p1, nextGranted(t, clk, granted))
+
+	// p3 receives pieces from other peers while queued and overtakes p2.
+	p3.bitfield.Set(0, true)
+	p3.bitfield.Set(1, true)
+	p3.bitfield.Set(2, true)
+
+	require.Equal(p3, nextGranted(t, clk, granted))
+	require.Equal(p2, nextGranted(t, clk, granted))
+}
+
+func TestEgressLimiterServesPriorityRequestsWithinBound(t *testing.T) {
+	tests := []struct {
+		percent  int
+		expected []string
+	}{
+		{100, []string{"p0", "p1", "p2", "b0", "b1", "b2"}},
+		{50, []string{"p0", "b0", "p1", "b1", "p2", "b2"}},
+		{25, []string{"p0", "b0", "b1", "b2", "p1", "p2"}},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("percent=%d", test.percent), func(t *testing.T) {
+			require := require.New(t)
+
+			clk := clock.NewMock()
+
+			// Bulk serves are queued first, and peers requesting bulk serves are
+			// closer to completion.
+			names := make(map[*peer]string)
+			var peers []*peer
+			var priority []bool
+			for _, s := range []struct {
+				name     string
+				priority bool
+				has      bool
+			}{
+				{"b0", false, true},
+				{"b1", false, true},
+				{"b2", false, true},
+				{"p0", true, false},
+				{"p1", true, false},
+				{"p2", true, false},
+			} {
+				p := servePeerFixture(clk, s.has, false)
+				names[p] = s.name
+				peers = append(peers, p)
+				priority = append(priority, s.priority)
+			}
+
+			l := newEgressLimiter(clk, 1, 1, len(peers), CompletionServeScheduler{}, test.percent)
+
+			granted := queuePriorityServes(t, l, priority, peers...)
+			var order []string
+			for range peers {
+				order = append(order, names[nextGranted(t, clk, granted)])
+			}
+			require.Equal(test.expected, order)
+		})
+	}
+}
+
+func TestNewServeSchedulerInvalidPolicy(t *testing.T) {
+	_, err := newServeScheduler("unknown")
+	require.Error(t, err)
+}
@@ -0,0 +1,59 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/uber/kraken/utils/memsize"
+)
+
+// torrentSizeBucket returns the label of the bucket of Config.SizeBuckets which
+// a torrent of length bytes falls into, e.g. "10MB_to_100MB". The labels are
+// derived from thresholds alone, so there are at most len(thresholds)+1.
+func torrentSizeBucket(thresholds []int64, length int64) (string, error) {
+	for i, b := range thresholds {
+		if b <= 0 || (i > 0 && b <= thresholds[i-1]) {
+			return "", errors.New("size buckets must be positive and ascending")
+		}
+	}
+	for i, b := range thresholds {
+		if length < b {
+			if i == 0 {
+				return "under_" + sizeLabel(b), nil
+			}
+			return fmt.Sprintf("%s_to_%s", sizeLabel(thresholds[i-1]), sizeLabel(b)), nil
+		}
+	}
+	return "over_" + sizeLabel(thresholds[len(thresholds)-1]), nil
+}
+
+// sizeLabel formats n bytes in the largest unit which divides n, e.g. "10MB".
+func sizeLabel(n int64) string {
+	for _, u := range []struct {
+		size uint64
+		name string
+	}{
+		{memsize.TB, "TB"},
+		{memsize.GB, "GB"},
+		{memsize.MB, "MB"},
+		{memsize.KB, "KB"},
+	} {
+		if uint64(n)%u.size == 0 {
+			return fmt.Sprintf("%d%s", uint64(n)/u.size, u.name)
+		}
+	}
+	return fmt.Sprintf("%dB", n)
+}
@@ -0,0 +1,142 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"testing"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+	"go.uber.org/zap"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/torrent/networkevent"
+	"github.com/uber/kraken/lib/torrent/scheduler/conn"
+	"github.com/uber/kraken/lib/torrent/scheduler/torrentlog"
+	"github.com/uber/kraken/lib/torrent/storage/agentstorage"
+	"github.com/uber/kraken/lib/torrent/storage/piecereader"
+	"github.com/uber/kraken/utils/bitsetutil"
+	"github.com/uber/kraken/utils/memsize"
+)
+
+func TestTorrentSizeBucket(t *testing.T) {
+	defaults := Config{}.applyDefaults().SizeBuckets
+
+	tests := []struct {
+		desc     string
+		length   int64
+		expected string
+	}{
+		{"empty", 0, "under_10MB"},
+		{"small", int64(memsize.MB), "under_10MB"},
+		{"lower bound", int64(10 * memsize.MB), "10MB_to_100MB"},
+		{"medium", int64(500 * memsize.MB), "100MB_to_1GB"},
+		{"upper bound", int64(memsize.GB) - 1, "100MB_to_1GB"},
+		{"large", int64(5 * memsize.GB), "over_1GB"},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			bucket, err := torrentSizeBucket(defaults, test.length)
+			require.NoError(t, err)
+			require.Equal(t, test.expected, bucket)
+		})
+	}
+}
+
+func TestTorrentSizeBucketLabelsThresholds(t *testing.T) {
+	require := require.New(t)
+
+	thresholds := []int64{1000, int64(1536 * memsize.KB), int64(2 * memsize.TB)}
+	var buckets []string
+	for _, length := range []int64{1, 1000, int64(memsize.GB), int64(3 * memsize.TB)} {
+		bucket, err := torrentSizeBucket(thresholds, length)
+		require.NoError(err)
+		buckets = append(buckets, bucket)
+	}
+	require.Equal([]string{
+		"under_1000B", "1000B_to_1536KB", "1536KB_to_2TB", "over_2TB",
+	}, buckets)
+}
+
+func TestTorrentSizeBucketRejectsInvalidThresholds(t *testing.T) {
+	for _, thresholds := range [][]int64{{0}, {-1, 10}, {10, 10}, {100, 10}} {
+		_, err := torrentSizeBucket(thresholds, 1)
+		require.Error(t, err, "%v", thresholds)
+	}
+}
+
+func TestDispatcherTagsMetricsBySizeBucket(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(2, 1)
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	stats := tally.NewTestScope("", nil)
+	d, err := newDispatcher(
+		Config{
+			SizeBuckets:      []int64{1, 4},
+			DisableEndgame:   true,
+			DisableKeepalive: true,
+		},
+		stats,
+		clock.NewMock(),
+		networkevent.NewTestProducer(),
+		noopEvents{},
+		core.PeerIDFixture(),
+		torrent,
+		zap.NewNop().Sugar(),
+		torrentlog.NewNopLogger())
+	require.NoError(err)
+
+	p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, true), newMockMessages())
+	require.NoError(err)
+	_, err = d.maybeRequestMorePieces(p)
+	require.NoError(err)
+	for _, i := range requestedPieces(p.messages) {
+		require.NoError(d.dispatch(p, conn.NewPiecePayloadMessage(i, piecereader.NewBuffer(blob.Content[i:i+1]))))
+	}
+	require.True(d.Complete())
+
+	// Counters, gauges and histograms alike carry the bucket of the 2 byte torrent.
+	snapshot := stats.Snapshot()
+	counters := snapshot.Counters()
+	require.Equal(int64(2), counters["downloaded_piece_bytes+module=dispatch,size_bucket=1B_to_4B"].Value())
+	require.Contains(
+		snapshot.Gauges(), "outstanding_piece_requests+module=dispatch,size_bucket=1B_to_4B")
+	require.Contains(
+		snapshot.Histograms(),
+		"piece_request_latency+attempt=first,endgame=false,module=dispatch,size_bucket=1B_to_4B")
+	for k := range counters {
+		require.Contains(k, "size_bucket=1B_to_4B")
+	}
+}
+
+func TestNewDispatcherRejectsInvalidSizeBuckets(t *testing.T) {
+	torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(1, 1).MetaInfo)
+	defer cleanup()
+
+	_, err := newDispatcher(
+		Config{SizeBuckets: []int64{10, 5}},
+		tally.NoopScope,
+		clock.NewMock(),
+		networkevent.NewTestProducer(),
+		noopEvents{},
+		core.PeerIDFixture(),
+		torrent,
+		zap.NewNop().Sugar(),
+		torrentlog.NewNopLogger())
+	require.Error(t, err)
+}
@@ -0,0 +1,154 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"sort"
+	"time"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/torrent/scheduler/conn"
+)
+
+// Snapshot is a JSON-serializable snapshot of the state of a Dispatcher and
+// each of its peers, for debugging stuck downloads.
+type Snapshot struct {
+	// Name is the hex digest of the blob, which names the torrent.
+	Name        string    `json:"name"`
+	InfoHash    string    `json:"info_hash"`
+	CreatedAt   time.Time `json:"created_at"`
+	NumPieces   int       `json:"num_pieces"`
+	NumComplete int       `json:"num_complete"`
+	Endgame     bool      `json:"endgame"`
+
+	// Invalidating is set once the torrent is being deleted by the storage
+	// layer, see Dispatcher.BeginInvalidation.
+	Invalidating bool `json:"invalidating,omitempty"`
+
+	// Stalled is set while the torrent made no progress for
+	// Config.StallTimeout, see Events.DispatcherStalled.
+	Stalled bool `json:"stalled,omitempty"`
+
+	// Paused is set while the Dispatcher is paused, see Dispatcher.Pause.
+	Paused bool `json:"paused,omitempty"`
+
+	// Locality labels the locality of the Dispatcher, see WithLocality.
+	Locality string `json:"locality,omitempty"`
+
+	// Peers are sorted by peer id.
+	Peers []PeerSnapshot `json:"peers"`
+
+	// Decisions are the most recent decisions of the Dispatcher, see
+	// Config.DecisionBufferSize.
+	Decisions []Decision `json:"decisions,omitempty"`
+}
+
+// PeerSnapshot is a snapshot of the state of a peer connected to a Dispatcher.
+type PeerSnapshot struct {
+	PeerID    string `json:"peer_id"`
+	NumPieces int    `json:"num_pieces"`
+
+	// PendingPieces are the pieces reserved for the peer, i.e. requested from
+	// the peer and not yet received, in ascending order.
+	PendingPieces []int `json:"pending_pieces"`
+
+	// LastGoodPieceReceived and LastPieceSent are zero if no piece was received
+	// from or sent to the peer yet.
+	LastGoodPieceReceived time.Time `json:"last_good_piece_received"`
+	LastPieceSent         time.Time `json:"last_piece_sent"`
+
+	InvalidPiecesReceived   int `json:"invalid_pieces_received"`
+	DuplicatePiecesReceived int `json:"duplicate_pieces_received"`
+	ProtocolViolations      int `json:"protocol_violations"`
+	UnansweredKeepalives    int `json:"unanswered_keepalives"`
+	SendQueueDepth          int `json:"send_queue_depth"`
+
+	// CrossedPayloads and UnreliableAttribution flag the peer sending payloads
+	// which answered piece requests sent to other peers, see PeerStats.
+	CrossedPayloads       int  `json:"crossed_payloads"`
+	UnreliableAttribution bool `json:"unreliable_attribution,omitempty"`
+
+	// RecentBytesReceived and RecentBytesSent are the piece bytes exchanged
+	// with the peer within the reciprocity window, see PeerStats.
+	RecentBytesReceived int64 `json:"recent_bytes_received"`
+	RecentBytesSent     int64 `json:"recent_bytes_sent"`
+
+	// Capabilities are the known capabilities negotiated with the peer, sorted
+	// by name, see PeerStats.
+	Capabilities        []conn.Capability `json:"capabilities"`
+	UnknownCapabilities int               `json:"unknown_capabilities"`
+
+	// Interface labels the network interface which the connection of the peer
+	// arrived on, see PeerStats.
+	Interface string `json:"interface,omitempty"`
+
+	// Locality labels the locality of the peer, and Local is set if it shares
+	// the locality of the Dispatcher, see PeerStats.
+	Locality string `json:"locality,omitempty"`
+	Local    bool   `json:"local,omitempty"`
+}
+
+// Snapshot returns a snapshot of the state of d and its peers. Safe to call
+// after d was torn down.
+func (d *Dispatcher) Snapshot() Snapshot {
+	var pending map[core.PeerID][]int
+	if !d.SeedOnly() {
+		pending = d.pieceRequestManager.PendingPiecesByPeer()
+	}
+	remaining := d.torrent.NumPieces() - int(d.torrent.Bitfield().Count())
+	s := Snapshot{
+		Name:         d.torrent.Digest().Hex(),
+		InfoHash:     d.torrent.InfoHash().Hex(),
+		CreatedAt:    d.createdAt,
+		NumPieces:    d.torrent.NumPieces(),
+		NumComplete:  d.torrent.NumPieces() - remaining,
+		Endgame:      remaining > 0 && d.config.InEndgame(remaining),
+		Invalidating: d.Invalidating(),
+		Stalled:      d.Stalled(),
+		Paused:       d.Paused(),
+		Locality:     d.locality,
+		Peers:        []PeerSnapshot{},
+		Decisions:    d.Decisions(),
+	}
+	d.peers.Range(func(k, v interface{}) bool {
+		p := v.(*peer)
+		stats := p.stats()
+		s.Peers = append(s.Peers, PeerSnapshot{
+			PeerID:                  p.id.String(),
+			NumPieces:               int(p.bitfield.Count()),
+			PendingPieces:           pending[p.id],
+			LastGoodPieceReceived:   p.getLastGoodPieceReceived(),
+			LastPieceSent:           p.getLastPieceSent(),
+			InvalidPiecesReceived:   stats.InvalidPiecesReceived,
+			DuplicatePiecesReceived: p.pstats.getDuplicatePiecesReceived(),
+			ProtocolViolations:      stats.ProtocolViolations,
+			UnansweredKeepalives:    stats.UnansweredKeepalives,
+			SendQueueDepth:          stats.SendQueueDepth,
+			CrossedPayloads:         stats.CrossedPayloads,
+			UnreliableAttribution:   stats.UnreliableAttribution,
+			RecentBytesReceived:     stats.RecentBytesReceived,
+			RecentBytesSent:         stats.RecentBytesSent,
+			Capabilities:            stats.Capabilities,
+			UnknownCapabilities:     stats.UnknownCapabilities,
+			Interface:               stats.Interface,
+			Locality:                stats.Locality,
+			Local:                   stats.Local,
+		})
+		return true
+	})
+	sort.Slice(s.Peers, func(i, j int) bool {
+		return s.Peers[i].PeerID < s.Peers[j].PeerID
+	})
+	return s
+}
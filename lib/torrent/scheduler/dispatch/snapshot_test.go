@@ -0,0 +1,126 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"encoding/json"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/torrent/scheduler/conn"
+	"github.com/uber/kraken/lib/torrent/storage/agentstorage"
+	"github.com/uber/kraken/lib/torrent/storage/piecereader"
+	"github.com/uber/kraken/utils/bitsetutil"
+)
+
+func TestDispatcherSnapshot(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(4, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	clk := clock.NewMock()
+	clk.Set(time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC))
+	config := Config{
+		PipelineLimit:    2,
+		DisableEndgame:   true,
+		DisableKeepalive: true,
+	}
+	d := testDispatcher(config, clk, torrent)
+
+	seeder, err := d.addPeer(
+		core.PeerIDFixture(), bitsetutil.FromBools(true, true, true, true), newMockMessages())
+	require.NoError(err)
+	_, err = d.maybeRequestMorePieces(seeder)
+	require.NoError(err)
+	received := requestedPieces(seeder.messages)[0]
+
+	clk.Add(time.Second)
+	require.NoError(d.dispatch(
+		seeder, conn.NewPiecePayloadMessage(received, piecereader.NewBuffer(blob.Content[received:received+1]))))
+
+	// Receiving a piece requests another one.
+	var pending []int
+	for _, i := range requestedPieces(seeder.messages) {
+		if i != received {
+			pending = append(pending, i)
+		}
+	}
+	sort.Ints(pending)
+	require.Len(pending, 2)
+
+	leecher, err := d.addPeer(
+		core.PeerIDFixture(), bitsetutil.FromBools(false, false, false, false), newMockMessages())
+	require.NoError(err)
+	require.Equal(ErrorProtocolViolation, Category(d.dispatch(leecher, conn.NewAnnouncePieceMessage(4))))
+
+	s := d.Snapshot()
+	require.Equal(blob.Digest.Hex(), s.Name)
+	require.Equal(blob.MetaInfo.InfoHash().Hex(), s.InfoHash)
+	require.Equal(d.createdAt, s.CreatedAt)
+	require.Equal(4, s.NumPieces)
+	require.Equal(1, s.NumComplete)
+	require.False(s.Endgame)
+
+	peers := map[string]PeerSnapshot{}
+	for _, p := range s.Peers {
+		peers[p.PeerID] = p
+	}
+	require.Len(peers, 2)
+	require.True(s.Peers[0].PeerID < s.Peers[1].PeerID)
+
+	ps := peers[seeder.id.String()]
+	require.Equal(4, ps.NumPieces)
+	require.Equal(pending, ps.PendingPieces)
+	require.Equal(clk.Now(), ps.LastGoodPieceReceived)
+	require.True(ps.LastPieceSent.IsZero())
+
+	pl := peers[leecher.id.String()]
+	require.Equal(0, pl.NumPieces)
+	require.Empty(pl.PendingPieces)
+	require.Equal(1, pl.ProtocolViolations)
+
+	// Snapshots are served as JSON.
+	b, err := json.Marshal(s)
+	require.NoError(err)
+	var result Snapshot
+	require.NoError(json.Unmarshal(b, &result))
+	require.Equal(s.Name, result.Name)
+	require.Len(result.Peers, 2)
+}
+
+func TestReadOnlyDispatcherSnapshot(t *testing.T) {
+	require := require.New(t)
+
+	torrent, cleanup := completeTorrentFixture(t, core.SizedBlobFixture(2, 1))
+	defer cleanup()
+
+	d := testDispatcher(Config{ReadOnly: true}, clock.NewMock(), torrent)
+
+	p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false, false), newMockMessages())
+	require.NoError(err)
+
+	s := d.Snapshot()
+	require.Equal(2, s.NumComplete)
+	require.Len(s.Peers, 1)
+	require.Equal(p.id.String(), s.Peers[0].PeerID)
+	require.Empty(s.Peers[0].PendingPieces)
+}
@@ -0,0 +1,314 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"fmt"
+	"math/rand"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+	"go.uber.org/zap"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/torrent/networkevent"
+	"github.com/uber/kraken/lib/torrent/scheduler/conn"
+	"github.com/uber/kraken/lib/torrent/scheduler/torrentlog"
+	"github.com/uber/kraken/utils/bitsetutil"
+)
+
+// soakPeer is a simulated remote peer of a seeding Dispatcher.
+type soakPeer struct {
+	id       core.PeerID
+	messages *mockMessages
+}
+
+// TestDispatcherSeedsForAWeekWithoutLeaking simulates a week of seeding in
+// hourly epochs, during which peers connect, request pieces, flap, commit
+// protocol violations, complete and disconnect. Every hour, each map of the
+// Dispatcher which holds per-peer state must be bounded. At daily checkpoints,
+// such maps must be empty once all peers left, heap objects and goroutines must
+// not grow, and counters must never decrease.
+func TestDispatcherSeedsForAWeekWithoutLeaking(t *testing.T) {
+	stats := tally.NewTestScope("", nil)
+	require.NoError(t, soakSeeding(t, 7, stats, nil))
+
+	counters := stats.Snapshot().Counters()
+	// Every kind of churn was exercised.
+	for _, k := range []string{
+		"banned_peers+module=dispatch,size_bucket=under_10MB",
+		"peer_timeouts+module=dispatch,size_bucket=under_10MB",
+		"completed_peer_closes+module=dispatch,size_bucket=under_10MB",
+		"compacted_peer_entries+module=dispatch,size_bucket=under_10MB",
+	} {
+		require.True(t, counters[k].Value() > 0, k)
+	}
+}
+
+func TestDispatcherSoakFailsOnLeakedPeerState(t *testing.T) {
+	// Stats of peers which never disconnect are never compacted.
+	err := soakSeeding(t, 1, tally.NewTestScope("", nil), func(d *Dispatcher) {
+		d.peerStats.connect(core.PeerIDFixture())
+	})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "peer_stats: ")
+}
+
+// checkPeerStateSizes returns an error if any of sizes exceeds its bound, or has
+// no bound, such that all per-peer state of a Dispatcher must be bounded.
+func checkPeerStateSizes(sizes, bounds map[string]int) error {
+	for name, n := range sizes {
+		bound, ok := bounds[name]
+		if !ok {
+			return fmt.Errorf("%s: no bound", name)
+		}
+		if n > bound {
+			return fmt.Errorf("%s: %d > %d", name, n, bound)
+		}
+	}
+	return nil
+}
+
+// soakSeeding seeds for the given number of days under churn, returning an
+// error once per-peer state, heap objects or goroutines grow beyond their bounds,
+// or counters of stats decrease. leak, if set, is called hourly to simulate a
+// leak.
+func soakSeeding(t *testing.T, days int, stats tally.TestScope, leak func(*Dispatcher)) error {
+	require := require.New(t)
+
+	const (
+		peersPerHour   = 4
+		maxPeerDetails = 20
+		// heapSlack bounds the heap objects which may be retained across
+		// checkpoints, e.g. by tally and the runtime, without leaking. Well
+		// below one object per peer churned within a few days.
+		heapSlack = 200
+	)
+	config := Config{
+		PeerCompactionInterval:   10 * time.Minute,
+		PeerDetailTTL:            3 * time.Hour,
+		MaxPeerDetails:           maxPeerDetails,
+		CompletedPeerCloseWindow: 5 * time.Minute,
+		KeepaliveInterval:        20 * time.Minute,
+		QueueSampleInterval:      5 * time.Minute,
+		ServePrefetchDepth:       2,
+		Superseed:                true,
+	}
+
+	blob := core.SizedBlobFixture(32, 4)
+	torrent, cleanup := completeTorrentFixture(t, blob)
+	defer cleanup()
+
+	// Unlike the test producer, a disabled producer does not retain events,
+	// which would otherwise count as heap objects of the Dispatcher.
+	events, err := networkevent.NewProducer(networkevent.Config{})
+	require.NoError(err)
+
+	clk := clock.NewMock()
+	d, err := New(
+		config,
+		stats,
+		clk,
+		events,
+		noopEvents{},
+		core.PeerIDFixture(),
+		torrent,
+		zap.NewNop().Sugar(),
+		torrentlog.NewNopLogger())
+	require.NoError(err)
+	defer d.TearDown()
+
+	// Peers which were removed hold no state. Peers which are connected, or
+	// half-open until they time out, hold state in every map, and the stats of
+	// peers removed within PeerDetailTTL persist.
+	hourly := map[string]int{
+		"peers":                           peersPerHour,
+		"announcer_pending":               peersPerHour,
+		"chunk_contributors":              peersPerHour * torrent.NumPieces(),
+		"piece_requests_requests_by_peer": peersPerHour,
+		"piece_requests_pipeline_depths":  peersPerHour,
+		"piece_requests_peer_limits":      peersPerHour,
+		"piece_requests_retry_after":      peersPerHour,
+		"peer_stats":                      maxPeerDetails + 3*peersPerHour,
+		"peer_stats_disconnected":         maxPeerDetails + 2*peersPerHour,
+		"prefetch_peers":                  peersPerHour,
+		"superseed_peers":                 peersPerHour,
+	}
+	empty := make(map[string]int)
+	for name := range hourly {
+		empty[name] = 0
+	}
+
+	rng := rand.New(rand.NewSource(0))
+
+	connect := func(peerID core.PeerID) *soakPeer {
+		p := &soakPeer{peerID, newMockMessages()}
+		require.NoError(d.AddPeer(
+			peerID, bitsetutil.FromBools(make([]bool, torrent.NumPieces())...), p.messages))
+		return p
+	}
+	send := func(p *soakPeer, msg *conn.Message) {
+		// Unbuffered, so msg was received by the feed of p once sent.
+		p.messages.receiver <- msg
+	}
+	// settle waits until the messages sent by p were handled, and the pieces
+	// requested by p were served, such that the clock is not advanced while
+	// the Dispatcher sets timers.
+	settle := func(p *soakPeer) {
+		send(p, conn.NewKeepaliveAckMessage())
+		v, ok := d.peers.Load(p.id)
+		require.True(ok)
+		waitForServes(t, v.(*peer))
+	}
+	// exercise sends the messages of a well-behaved peer.
+	exercise := func(p *soakPeer) {
+		for j := 0; j < 2; j++ {
+			i := rng.Intn(torrent.NumPieces())
+			send(p, conn.NewPieceRequestMessage(i, torrent.PieceLength(i)))
+		}
+		send(p, conn.NewAnnouncePieceMessage(rng.Intn(torrent.NumPieces())))
+	}
+
+	var (
+		baseline     int
+		heapBaseline uint64
+		lastCounters = make(map[string]int64)
+		connected    []*soakPeer
+		halfOpen     []*soakPeer
+	)
+	checkpoint := func() error {
+		// Disconnect everyone, and let the detail of removed peers expire.
+		for _, p := range append(connected, halfOpen...) {
+			p.messages.Close()
+		}
+		connected, halfOpen = nil, nil
+		require.Eventually(func() bool {
+			return d.NumPeers() == 0
+		}, 5*time.Second, time.Millisecond)
+		// Polled by hand, here and below, since require.Eventually runs its
+		// own goroutines.
+		var err error
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+			clk.Add(config.PeerCompactionInterval)
+			if err = checkPeerStateSizes(d.Dump().PeerStateSizes, empty); err == nil {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		if err != nil {
+			return err
+		}
+
+		// Goroutines of removed peers, e.g. serves, exit.
+		if baseline == 0 {
+			baseline = runtime.NumGoroutine()
+		}
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+			if runtime.NumGoroutine() <= baseline {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		if n := runtime.NumGoroutine(); n > baseline {
+			return fmt.Errorf("goroutines grew: %d > %d", n, baseline)
+		}
+
+		runtime.GC()
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		if heapBaseline == 0 {
+			heapBaseline = m.HeapObjects
+		}
+		if m.HeapObjects > heapBaseline+heapSlack {
+			return fmt.Errorf("heap objects grew: %d > %d", m.HeapObjects, heapBaseline+heapSlack)
+		}
+
+		counters := stats.Snapshot().Counters()
+		for k, v := range lastCounters {
+			c, ok := counters[k]
+			if !ok {
+				return fmt.Errorf("counter %s vanished", k)
+			}
+			if c.Value() < v {
+				return fmt.Errorf("counter %s decreased", k)
+			}
+		}
+		for k, c := range counters {
+			lastCounters[k] = c.Value()
+		}
+		return nil
+	}
+
+	for day := 0; day < days; day++ {
+		for hour := 0; hour < 24; hour++ {
+			// Peers of the previous hour disconnect.
+			for _, p := range connected {
+				p.messages.Close()
+			}
+			connected = nil
+
+			for j := 0; j < peersPerHour; j++ {
+				p := connect(core.PeerIDFixture())
+				exercise(p)
+				switch j {
+				case 0:
+					// Flaps, i.e. reconnects with the same peer id.
+					require.NoError(d.RemovePeer(p.id))
+					p = connect(p.id)
+					exercise(p)
+					settle(p)
+				case 1:
+					// Is banned for malformed announcements.
+					settle(p)
+					for k := 0; k <= d.config.MaxProtocolViolations; k++ {
+						send(p, conn.NewAnnouncePieceMessage(torrent.NumPieces()))
+					}
+					require.Eventually(func() bool {
+						return closed(p.messages)
+					}, 5*time.Second, time.Millisecond)
+				case 2:
+					// Completes, and is closed within the close window.
+					send(p, conn.NewCompleteMessage())
+					settle(p)
+				default:
+					// Goes silent without closing the connection, until
+					// removed for missing keepalives.
+					settle(p)
+					halfOpen = append(halfOpen, p)
+					continue
+				}
+				connected = append(connected, p)
+			}
+			if leak != nil {
+				leak(d)
+			}
+
+			for m := 0; m < 6; m++ {
+				clk.Add(10 * time.Minute)
+			}
+
+			if err := checkPeerStateSizes(d.Dump().PeerStateSizes, hourly); err != nil {
+				return fmt.Errorf("day %d, hour %d: %s", day, hour, err)
+			}
+		}
+		if err := checkpoint(); err != nil {
+			return fmt.Errorf("day %d: %s", day, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"sync"
+	"time"
+)
+
+// stallWatcher detects stall episodes of a Dispatcher, i.e. windows in which the
+// number of pieces it has did not increase.
+type stallWatcher struct {
+	timeout time.Duration
+
+	mu           sync.Mutex // Protects the following fields:
+	lastCount    uint
+	lastProgress time.Time
+	stalled      bool
+}
+
+func newStallWatcher(timeout time.Duration, count uint, now time.Time) *stallWatcher {
+	return &stallWatcher{
+		timeout:      timeout,
+		lastCount:    count,
+		lastProgress: now,
+	}
+}
+
+// check records that d has count pieces at now. Returns true if a stall episode
+// began, i.e. count did not increase for the timeout, which happens at most
+// once until count increases again.
+func (w *stallWatcher) check(count uint, now time.Time) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if count > w.lastCount {
+		w.lastCount = count
+		w.lastProgress = now
+		w.stalled = false
+		return false
+	}
+	if w.stalled || now.Sub(w.lastProgress) < w.timeout {
+		return false
+	}
+	w.stalled = true
+	return true
+}
+
+// restart ends any stall episode, and restarts the window at now with count
+// pieces, e.g. once d resumed.
+func (w *stallWatcher) restart(count uint, now time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.lastCount = count
+	w.lastProgress = now
+	w.stalled = false
+}
+
+func (w *stallWatcher) isStalled() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.stalled
+}
+
+// Stalled returns whether d made no progress for Config.StallTimeout, see
+// Events.DispatcherStalled.
+func (d *Dispatcher) Stalled() bool {
+	return d.stall != nil && d.stall.isStalled()
+}
+
+// checkStalled emits DispatcherStalled once d, which is incomplete, received no
+// piece for Config.StallTimeout, e.g. since none of its peers has the pieces it
+// needs.
+func (d *Dispatcher) checkStalled() {
+	if d.stall == nil || d.readOnly || d.torrent.NumPieces() == 0 ||
+		d.draining.Load() || d.invalidating.Load() || d.paused.Load() {
+		return
+	}
+	count := d.torrent.Bitfield().Count()
+	if d.Complete() || !d.stall.check(count, d.clk.Now()) {
+		return
+	}
+	d.log().Infof("No progress for %s, notifying dispatcher stalled", d.config.StallTimeout)
+	d.stats.Counter("stalls").Inc(1)
+	d.status.notify(StateChanged)
+	d.emitter.emit(func(e Events) { e.DispatcherStalled(d) })
+}
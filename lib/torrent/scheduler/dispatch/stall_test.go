@@ -0,0 +1,121 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"testing"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/torrent/scheduler/conn"
+	"github.com/uber/kraken/lib/torrent/storage/agentstorage"
+	"github.com/uber/kraken/lib/torrent/storage/piecereader"
+	"github.com/uber/kraken/utils/bitsetutil"
+)
+
+func TestStallWatcherFiresOncePerEpisode(t *testing.T) {
+	require := require.New(t)
+
+	start := time.Now()
+	w := newStallWatcher(time.Minute, 0, start)
+
+	require.False(w.check(0, start.Add(59*time.Second)))
+	require.True(w.check(0, start.Add(time.Minute)))
+	require.True(w.isStalled())
+	require.False(w.check(0, start.Add(time.Hour)))
+
+	// Progress ends the episode, and restarts the window.
+	require.False(w.check(1, start.Add(time.Hour)))
+	require.False(w.isStalled())
+	require.False(w.check(1, start.Add(time.Hour+59*time.Second)))
+	require.True(w.check(1, start.Add(time.Hour+time.Minute)))
+}
+
+func TestDispatcherStalledWithoutProgress(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(2, 1)
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	clk := clock.NewMock()
+	stats := tally.NewTestScope("", nil)
+	events := &recordingEvents{}
+	d := testDispatcher(Config{
+		StallTimeout:     time.Minute,
+		DisableKeepalive: true,
+	}, clk, torrent)
+	d.stats = stats
+	d.emitter = testEmitter(events, tally.NoopScope)
+
+	// The only peer lacks the pieces we need.
+	_, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false, false), newMockMessages())
+	require.NoError(err)
+
+	clk.Add(59 * time.Second)
+	d.checkStalled()
+	require.False(d.Stalled())
+
+	clk.Add(time.Second)
+	d.checkStalled()
+	require.True(d.Stalled())
+	require.True(d.Snapshot().Stalled)
+
+	// Fired once per stall.
+	clk.Add(time.Hour)
+	d.checkStalled()
+	require.Eventually(func() bool {
+		return len(events.get()) == 1
+	}, time.Second, 5*time.Millisecond)
+
+	// A peer which has a needed piece ends the stall.
+	seeder, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, true), newMockMessages())
+	require.NoError(err)
+	_, err = d.maybeRequestMorePieces(seeder)
+	require.NoError(err)
+	require.NoError(d.dispatch(
+		seeder, conn.NewPiecePayloadMessage(0, piecereader.NewBuffer(blob.Content[0:1]))))
+	d.checkStalled()
+	require.False(d.Stalled())
+
+	clk.Add(time.Minute)
+	d.checkStalled()
+	require.True(d.Stalled())
+	require.Eventually(func() bool {
+		return len(events.get()) == 2
+	}, time.Second, 5*time.Millisecond)
+	require.Equal([]string{"stalled", "stalled"}, events.get())
+	require.Equal(int64(2), stats.Snapshot().Counters()["stalls+"].Value())
+}
+
+func TestDispatcherNeverStallsOnceComplete(t *testing.T) {
+	require := require.New(t)
+
+	torrent, cleanup := completeTorrentFixture(t, core.SizedBlobFixture(2, 1))
+	defer cleanup()
+
+	clk := clock.NewMock()
+	d := testDispatcher(Config{
+		StallTimeout:     time.Minute,
+		DisableKeepalive: true,
+	}, clk, torrent)
+
+	clk.Add(time.Hour)
+	d.checkStalled()
+	require.False(d.Stalled())
+}
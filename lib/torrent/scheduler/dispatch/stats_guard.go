@@ -0,0 +1,614 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/uber-go/tally"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+)
+
+// _maxAggregatedSamples bounds the timer and histogram samples which are kept
+// per metric between flushes. Further samples are dropped.
+const _maxAggregatedSamples = 64
+
+// StatsGuardState describes the guard around the metric emissions of a
+// Dispatcher, see Config.SlowStatsThreshold.
+type StatsGuardState struct {
+	// Degraded is set while metrics are aggregated locally because the metrics
+	// backend is slow.
+	Degraded bool `json:"degraded"`
+
+	// Degradations is how often the backend was found to be slow.
+	Degradations int64 `json:"degradations"`
+
+	// Flushes is the number of completed flushes of aggregated metrics, and
+	// DroppedFlushes the number of flushes which were skipped since the
+	// previous flush was still blocked on the backend. Metrics of skipped
+	// flushes are kept for the next flush.
+	Flushes        int64 `json:"flushes"`
+	DroppedFlushes int64 `json:"dropped_flushes"`
+
+	// DroppedSamples is the number of emissions which were dropped while
+	// degraded, since their metric exceeded Config.MaxAggregatedMetrics or
+	// kept too many timer or histogram samples.
+	DroppedSamples int64 `json:"dropped_samples"`
+}
+
+// StatsGuard returns the state of the guard around the metric emissions of d.
+func (d *Dispatcher) StatsGuard() StatsGuardState {
+	return d.statsGuard.state()
+}
+
+type metricKind int
+
+const (
+	_counterMetric metricKind = iota
+	_gaugeMetric
+	_timerMetric
+	_histogramValueMetric
+	_histogramDurationMetric
+)
+
+// statsGuard guards the handlers of a Dispatcher against a slow metrics
+// backend, since metrics are emitted inline. One in Config.StatsSampleRate
+// emissions is timed, and once an emission takes longer than
+// Config.SlowStatsThreshold, the guard degrades: emissions are aggregated
+// locally without locking, and flushed to the backend every
+// Config.StatsFlushInterval. Once a flush finds the backend fast again, the
+// guard recovers and emits directly.
+//
+// At most one flush runs at a time. Flushes which are due while the previous
+// flush is still blocked on the backend are dropped, and their metrics are
+// kept for the next flush. Emissions never wait for a flush: a flush swaps the
+// generation which is aggregated into atomically, and only the flush waits for
+// emissions which still aggregate into the previous generation.
+type statsGuard struct {
+	backend    tally.Scope
+	clk        clock.Clock
+	sampleRate int64
+	threshold  time.Duration
+	interval   time.Duration
+	maxMetrics int64
+	logger     *zap.SugaredLogger
+	torrent    fmt.Stringer
+
+	calls    *atomic.Int64
+	degraded *atomic.Bool
+	episode  *atomic.Int64 // Identifies the flush loop of the current degradation.
+	flushing *atomic.Bool
+
+	gen atomic.Value // *statsGeneration aggregated into.
+
+	done      chan struct{}
+	closeOnce sync.Once
+
+	degradations   *atomic.Int64
+	flushes        *atomic.Int64
+	droppedFlushes *atomic.Int64
+	droppedSamples *atomic.Int64
+}
+
+func newStatsGuard(
+	backend tally.Scope,
+	clk clock.Clock,
+	config Config,
+	logger *zap.SugaredLogger,
+	torrent fmt.Stringer) *statsGuard {
+
+	g := &statsGuard{
+		backend:        backend,
+		clk:            clk,
+		sampleRate:     int64(config.StatsSampleRate),
+		threshold:      config.SlowStatsThreshold,
+		interval:       config.StatsFlushInterval,
+		maxMetrics:     int64(config.MaxAggregatedMetrics),
+		logger:         logger,
+		torrent:        torrent,
+		calls:          atomic.NewInt64(0),
+		degraded:       atomic.NewBool(false),
+		episode:        atomic.NewInt64(0),
+		flushing:       atomic.NewBool(false),
+		done:           make(chan struct{}),
+		degradations:   atomic.NewInt64(0),
+		flushes:        atomic.NewInt64(0),
+		droppedFlushes: atomic.NewInt64(0),
+		droppedSamples: atomic.NewInt64(0),
+	}
+	g.gen.Store(newStatsGeneration())
+	return g
+}
+
+// scope returns the guarded scope which wraps the backend.
+func (g *statsGuard) scope() tally.Scope {
+	return &guardedScope{guard: g}
+}
+
+// state returns the state of g. Nil-safe, for Dispatchers without a guard.
+func (g *statsGuard) state() StatsGuardState {
+	if g == nil {
+		return StatsGuardState{}
+	}
+	return StatsGuardState{
+		Degraded:       g.degraded.Load(),
+		Degradations:   g.degradations.Load(),
+		Flushes:        g.flushes.Load(),
+		DroppedFlushes: g.droppedFlushes.Load(),
+		DroppedSamples: g.droppedSamples.Load(),
+	}
+}
+
+// close stops flushing periodically. Metrics which are still aggregated are
+// flushed one last time in the background, unless a flush is blocked already.
+// Nil-safe.
+func (g *statsGuard) close() {
+	if g == nil {
+		return
+	}
+	g.closeOnce.Do(func() { close(g.done) })
+}
+
+func (g *statsGuard) closed() bool {
+	select {
+	case <-g.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// emit runs f, which emits to the backend, and degrades g if f was sampled and
+// found slow.
+func (g *statsGuard) emit(f func()) {
+	if g.calls.Inc()%g.sampleRate != 0 {
+		f()
+		return
+	}
+	start := g.clk.Now()
+	f()
+	if elapsed := g.clk.Now().Sub(start); elapsed >= g.threshold {
+		g.degrade(elapsed)
+	}
+}
+
+// aggregate aggregates an emission of the named metric of s via f instead of
+// emitting it, if g is degraded. Returns false if g is healthy, in which case
+// the emission is left to the caller.
+func (g *statsGuard) aggregate(
+	kind metricKind, s *guardedScope, name string, buckets tally.Buckets, f func(*aggregatedMetric)) bool {
+
+	if !g.degraded.Load() {
+		return false
+	}
+	gen := g.enter()
+	defer gen.writers.Dec()
+
+	// Checked again once entered, such that emissions which aggregate after g
+	// recovered are emitted instead of being left in a generation which is not
+	// flushed anymore.
+	if !g.degraded.Load() {
+		return false
+	}
+	if m := gen.metric(g, kind, s, name, buckets); m != nil {
+		f(m)
+	}
+	return true
+}
+
+// enter returns the current generation, registered as written to until its
+// writers count is decremented.
+func (g *statsGuard) enter() *statsGeneration {
+	for {
+		gen := g.gen.Load().(*statsGeneration)
+		gen.writers.Inc()
+		if !gen.sealed.Load() {
+			return gen
+		}
+		// Swapped meanwhile, so the flush may not see this emission.
+		gen.writers.Dec()
+	}
+}
+
+// degrade switches g to aggregating emissions, and starts flushing them
+// periodically.
+func (g *statsGuard) degrade(elapsed time.Duration) {
+	if g.closed() || !g.degraded.CAS(false, true) {
+		return
+	}
+	g.degradations.Inc()
+	episode := g.episode.Inc()
+	g.logger.With("torrent", g.torrent).Warnf(
+		"Metric emission took %s, aggregating metrics locally", elapsed)
+	g.scope().Counter("stats_guard_degradations").Inc(1)
+	go g.flushLoop(episode, g.clk.Ticker(g.interval))
+}
+
+// flushLoop starts a flush on every tick, until g recovers from the
+// degradation identified by episode or is closed.
+func (g *statsGuard) flushLoop(episode int64, ticker *clock.Ticker) {
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-g.done:
+			if g.flushing.CAS(false, true) {
+				go g.flush()
+			}
+			return
+		}
+		if g.episode.Load() != episode || !g.degraded.Load() {
+			return
+		}
+		if !g.flushing.CAS(false, true) {
+			g.droppedFlushes.Inc()
+			g.scope().Counter("stats_guard_dropped_flushes").Inc(1)
+			continue
+		}
+		go g.flush()
+	}
+}
+
+// flush emits the aggregated metrics to the backend, and recovers if no
+// emission was slow.
+func (g *statsGuard) flush() {
+	defer g.flushing.Store(false)
+
+	n, slowest := g.swap().flush(g.clk)
+	g.flushes.Inc()
+	if n == 0 || slowest >= g.threshold || g.closed() {
+		return
+	}
+	// Emissions which saw g degraded before it recovered are flushed right
+	// after, such that no emission is lost.
+	if !g.degraded.CAS(true, false) {
+		return
+	}
+	g.logger.With("torrent", g.torrent).Infof(
+		"Metric emission took %s, emitting metrics directly", slowest)
+	if _, slowest := g.swap().flush(g.clk); slowest >= g.threshold {
+		g.degrade(slowest)
+	}
+}
+
+// swap replaces the generation which is aggregated into, and returns the
+// previous generation once no emission aggregates into it anymore. Emissions
+// only touch atomics, hence are waited for by spinning.
+func (g *statsGuard) swap() *statsGeneration {
+	prev := g.gen.Load().(*statsGeneration)
+	g.gen.Store(newStatsGeneration())
+	prev.sealed.Store(true)
+	for prev.writers.Load() > 0 {
+		runtime.Gosched()
+	}
+	return prev
+}
+
+// metricKey identifies an aggregated metric within a generation.
+type metricKey struct {
+	kind  metricKind
+	scope string // See guardedScope.key.
+	name  string
+}
+
+// statsGeneration holds the metrics aggregated between two flushes.
+type statsGeneration struct {
+	size    *atomic.Int64
+	metrics sync.Map // metricKey to *aggregatedMetric.
+
+	writers *atomic.Int64 // Emissions which aggregate into the generation.
+	sealed  *atomic.Bool  // Set once swapped out, see statsGuard.swap.
+}
+
+func newStatsGeneration() *statsGeneration {
+	return &statsGeneration{
+		size:    atomic.NewInt64(0),
+		writers: atomic.NewInt64(0),
+		sealed:  atomic.NewBool(false),
+	}
+}
+
+// metric returns the aggregate of the named metric of s, or nil if the metric
+// is dropped since too many metrics are aggregated already.
+func (gen *statsGeneration) metric(
+	g *statsGuard, kind metricKind, s *guardedScope, name string, buckets tally.Buckets) *aggregatedMetric {
+
+	key := metricKey{kind, s.key(), name}
+	if v, ok := gen.metrics.Load(key); ok {
+		return v.(*aggregatedMetric)
+	}
+	if gen.size.Inc() > g.maxMetrics {
+		gen.size.Dec()
+		g.droppedSamples.Inc()
+		return nil
+	}
+	v, loaded := gen.metrics.LoadOrStore(key, newAggregatedMetric(g, kind, s, name, buckets))
+	if loaded {
+		gen.size.Dec()
+	}
+	return v.(*aggregatedMetric)
+}
+
+// flush emits all metrics of gen, which no emission aggregates into anymore.
+// Returns the number of emissions, and the slowest emission.
+func (gen *statsGeneration) flush(clk clock.Clock) (int, time.Duration) {
+	var n int
+	var slowest time.Duration
+	gen.metrics.Range(func(_, v interface{}) bool {
+		start := clk.Now()
+		n += v.(*aggregatedMetric).flush()
+		if elapsed := clk.Now().Sub(start); elapsed > slowest {
+			slowest = elapsed
+		}
+		return true
+	})
+	return n, slowest
+}
+
+// aggregatedMetric aggregates the emissions of a metric while degraded.
+type aggregatedMetric struct {
+	guard   *statsGuard
+	kind    metricKind
+	scope   *guardedScope
+	name    string
+	buckets tally.Buckets
+
+	delta    *atomic.Int64   // Sum of counter increments.
+	value    *atomic.Float64 // Last gauge value.
+	updated  *atomic.Bool    // Set once the gauge was updated.
+	samples  []float64       // Timer and histogram samples.
+	nsamples *atomic.Int64
+}
+
+func newAggregatedMetric(
+	g *statsGuard, kind metricKind, s *guardedScope, name string, buckets tally.Buckets) *aggregatedMetric {
+
+	m := &aggregatedMetric{
+		guard:    g,
+		kind:     kind,
+		scope:    s,
+		name:     name,
+		buckets:  buckets,
+		delta:    atomic.NewInt64(0),
+		value:    atomic.NewFloat64(0),
+		updated:  atomic.NewBool(false),
+		nsamples: atomic.NewInt64(0),
+	}
+	switch kind {
+	case _timerMetric, _histogramValueMetric, _histogramDurationMetric:
+		m.samples = make([]float64, _maxAggregatedSamples)
+	}
+	return m
+}
+
+func (m *aggregatedMetric) inc(delta int64) {
+	m.delta.Add(delta)
+}
+
+func (m *aggregatedMetric) update(value float64) {
+	m.value.Store(value)
+	m.updated.Store(true)
+}
+
+func (m *aggregatedMetric) record(sample float64) {
+	i := m.nsamples.Inc() - 1
+	if i >= int64(len(m.samples)) {
+		m.guard.droppedSamples.Inc()
+		return
+	}
+	m.samples[i] = sample
+}
+
+// flush emits m to the backend, and returns the number of emissions.
+func (m *aggregatedMetric) flush() int {
+	s := m.scope.resolve()
+	switch m.kind {
+	case _counterMetric:
+		s.Counter(m.name).Inc(m.delta.Load())
+		return 1
+	case _gaugeMetric:
+		if !m.updated.Load() {
+			return 0
+		}
+		s.Gauge(m.name).Update(m.value.Load())
+		return 1
+	}
+	n := int(m.nsamples.Load())
+	if n > len(m.samples) {
+		n = len(m.samples)
+	}
+	for _, v := range m.samples[:n] {
+		switch m.kind {
+		case _timerMetric:
+			s.Timer(m.name).Record(time.Duration(v))
+		case _histogramValueMetric:
+			s.Histogram(m.name, m.buckets).RecordValue(v)
+		case _histogramDurationMetric:
+			s.Histogram(m.name, m.buckets).RecordDuration(time.Duration(v))
+		}
+	}
+	return n
+}
+
+// guardedScope is a tally.Scope whose emissions are guarded by a statsGuard.
+// Child scopes are resolved against the backend lazily, such that creating
+// them does not block while degraded.
+type guardedScope struct {
+	guard  *statsGuard
+	parent *guardedScope
+	tags   map[string]string
+	prefix string
+
+	resolveOnce sync.Once
+	scope       tally.Scope
+	keyOnce     sync.Once
+	canonical   string
+}
+
+func (s *guardedScope) Counter(name string) tally.Counter {
+	return guardedCounter{s, name}
+}
+
+func (s *guardedScope) Gauge(name string) tally.Gauge {
+	return guardedGauge{s, name}
+}
+
+func (s *guardedScope) Timer(name string) tally.Timer {
+	return guardedTimer{s, name}
+}
+
+func (s *guardedScope) Histogram(name string, buckets tally.Buckets) tally.Histogram {
+	return guardedHistogram{s, name, buckets}
+}
+
+func (s *guardedScope) Tagged(tags map[string]string) tally.Scope {
+	return &guardedScope{guard: s.guard, parent: s, tags: tags}
+}
+
+func (s *guardedScope) SubScope(name string) tally.Scope {
+	return &guardedScope{guard: s.guard, parent: s, prefix: name}
+}
+
+func (s *guardedScope) Capabilities() tally.Capabilities {
+	return s.guard.backend.Capabilities()
+}
+
+// resolve returns the backend scope of s.
+func (s *guardedScope) resolve() tally.Scope {
+	s.resolveOnce.Do(func() {
+		switch {
+		case s.parent == nil:
+			s.scope = s.guard.backend
+		case s.prefix != "":
+			s.scope = s.parent.resolve().SubScope(s.prefix)
+		default:
+			s.scope = s.parent.resolve().Tagged(s.tags)
+		}
+	})
+	return s.scope
+}
+
+// key returns a canonical form of the name prefix and tags of s, which
+// identifies the backend scope of s.
+func (s *guardedScope) key() string {
+	s.keyOnce.Do(func() {
+		var chain []*guardedScope
+		for c := s; c != nil; c = c.parent {
+			chain = append(chain, c)
+		}
+		var prefixes []string
+		tags := make(map[string]string)
+		for i := len(chain) - 1; i >= 0; i-- {
+			if chain[i].prefix != "" {
+				prefixes = append(prefixes, chain[i].prefix)
+			}
+			for k, v := range chain[i].tags {
+				tags[k] = v
+			}
+		}
+		pairs := make([]string, 0, len(tags))
+		for k, v := range tags {
+			pairs = append(pairs, k+"="+v)
+		}
+		sort.Strings(pairs)
+		s.canonical = strings.Join(prefixes, ".") + "+" + strings.Join(pairs, ",")
+	})
+	return s.canonical
+}
+
+type guardedCounter struct {
+	s    *guardedScope
+	name string
+}
+
+func (c guardedCounter) Inc(delta int64) {
+	g := c.s.guard
+	if g.aggregate(_counterMetric, c.s, c.name, nil, func(m *aggregatedMetric) { m.inc(delta) }) {
+		return
+	}
+	g.emit(func() { c.s.resolve().Counter(c.name).Inc(delta) })
+}
+
+type guardedGauge struct {
+	s    *guardedScope
+	name string
+}
+
+func (c guardedGauge) Update(value float64) {
+	g := c.s.guard
+	if g.aggregate(_gaugeMetric, c.s, c.name, nil, func(m *aggregatedMetric) { m.update(value) }) {
+		return
+	}
+	g.emit(func() { c.s.resolve().Gauge(c.name).Update(value) })
+}
+
+type guardedTimer struct {
+	s    *guardedScope
+	name string
+}
+
+func (t guardedTimer) Record(value time.Duration) {
+	g := t.s.guard
+	if g.aggregate(_timerMetric, t.s, t.name, nil, func(m *aggregatedMetric) { m.record(float64(value)) }) {
+		return
+	}
+	g.emit(func() { t.s.resolve().Timer(t.name).Record(value) })
+}
+
+func (t guardedTimer) Start() tally.Stopwatch {
+	return tally.NewStopwatch(t.s.guard.clk.Now(), t)
+}
+
+func (t guardedTimer) RecordStopwatch(start time.Time) {
+	t.Record(t.s.guard.clk.Now().Sub(start))
+}
+
+type guardedHistogram struct {
+	s       *guardedScope
+	name    string
+	buckets tally.Buckets
+}
+
+func (h guardedHistogram) RecordValue(value float64) {
+	g := h.s.guard
+	if g.aggregate(_histogramValueMetric, h.s, h.name, h.buckets, func(m *aggregatedMetric) { m.record(value) }) {
+		return
+	}
+	g.emit(func() { h.s.resolve().Histogram(h.name, h.buckets).RecordValue(value) })
+}
+
+func (h guardedHistogram) RecordDuration(value time.Duration) {
+	g := h.s.guard
+	if g.aggregate(_histogramDurationMetric, h.s, h.name, h.buckets, func(m *aggregatedMetric) {
+		m.record(float64(value))
+	}) {
+		return
+	}
+	g.emit(func() { h.s.resolve().Histogram(h.name, h.buckets).RecordDuration(value) })
+}
+
+func (h guardedHistogram) Start() tally.Stopwatch {
+	return tally.NewStopwatch(h.s.guard.clk.Now(), h)
+}
+
+func (h guardedHistogram) RecordStopwatch(start time.Time) {
+	h.RecordDuration(h.s.guard.clk.Now().Sub(start))
+}
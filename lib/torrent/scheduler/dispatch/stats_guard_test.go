@@ -0,0 +1,360 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/torrent/networkevent"
+	"github.com/uber/kraken/lib/torrent/scheduler/conn"
+	"github.com/uber/kraken/lib/torrent/scheduler/torrentlog"
+	"github.com/uber/kraken/lib/torrent/storage/agentstorage"
+	"github.com/uber/kraken/lib/torrent/storage/piecereader"
+	"github.com/uber/kraken/utils/bitsetutil"
+)
+
+// slowBackend slows down the emissions of the scopes it wraps: while delay is
+// set, emissions advance clk by delay, and while blocked, emissions wait until
+// unblock is called. Delays must only be set while emissions happen on the test
+// goroutine, since the mock clock may only be advanced by one goroutine.
+type slowBackend struct {
+	clk     *clock.Mock
+	delay   *atomic.Duration
+	blocked *atomic.Bool
+	waiting *atomic.Int32
+	release chan struct{}
+}
+
+func newSlowBackend(clk *clock.Mock) *slowBackend {
+	return &slowBackend{
+		clk:     clk,
+		delay:   atomic.NewDuration(0),
+		blocked: atomic.NewBool(false),
+		waiting: atomic.NewInt32(0),
+		release: make(chan struct{}),
+	}
+}
+
+func (b *slowBackend) wait() {
+	if d := b.delay.Load(); d > 0 {
+		b.clk.Add(d)
+	}
+	if b.blocked.Load() {
+		b.waiting.Inc()
+		<-b.release
+		b.waiting.Dec()
+	}
+}
+
+func (b *slowBackend) unblock() {
+	b.blocked.Store(false)
+	close(b.release)
+}
+
+func (b *slowBackend) wrap(s tally.Scope) tally.Scope {
+	return slowScope{s, b}
+}
+
+type slowScope struct {
+	tally.Scope
+	b *slowBackend
+}
+
+func (s slowScope) Counter(name string) tally.Counter {
+	return slowCounter{s.Scope.Counter(name), s.b}
+}
+
+func (s slowScope) Gauge(name string) tally.Gauge {
+	return slowGauge{s.Scope.Gauge(name), s.b}
+}
+
+func (s slowScope) Timer(name string) tally.Timer {
+	return slowTimer{s.Scope.Timer(name), s.b}
+}
+
+func (s slowScope) Histogram(name string, buckets tally.Buckets) tally.Histogram {
+	return slowHistogram{s.Scope.Histogram(name, buckets), s.b}
+}
+
+func (s slowScope) Tagged(tags map[string]string) tally.Scope {
+	return slowScope{s.Scope.Tagged(tags), s.b}
+}
+
+func (s slowScope) SubScope(name string) tally.Scope {
+	return slowScope{s.Scope.SubScope(name), s.b}
+}
+
+type slowCounter struct {
+	tally.Counter
+	b *slowBackend
+}
+
+func (c slowCounter) Inc(delta int64) {
+	c.b.wait()
+	c.Counter.Inc(delta)
+}
+
+type slowGauge struct {
+	tally.Gauge
+	b *slowBackend
+}
+
+func (g slowGauge) Update(value float64) {
+	g.b.wait()
+	g.Gauge.Update(value)
+}
+
+type slowTimer struct {
+	tally.Timer
+	b *slowBackend
+}
+
+func (t slowTimer) Record(value time.Duration) {
+	t.b.wait()
+	t.Timer.Record(value)
+}
+
+type slowHistogram struct {
+	tally.Histogram
+	b *slowBackend
+}
+
+func (h slowHistogram) RecordValue(value float64) {
+	h.b.wait()
+	h.Histogram.RecordValue(value)
+}
+
+func (h slowHistogram) RecordDuration(value time.Duration) {
+	h.b.wait()
+	h.Histogram.RecordDuration(value)
+}
+
+func TestStatsGuardAggregatesWhileBackendIsSlow(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+	backend := newSlowBackend(clk)
+	stats := tally.NewTestScope("", nil)
+	g := newStatsGuard(backend.wrap(stats), clk, Config{
+		StatsSampleRate:    1,
+		SlowStatsThreshold: 10 * time.Millisecond,
+	}.applyDefaults(), zap.NewNop().Sugar(), core.InfoHashFixture())
+	defer g.close()
+	s := g.scope()
+
+	// Fast emissions are passed through.
+	s.Counter("c").Inc(1)
+	require.Equal(int64(1), stats.Snapshot().Counters()["c+"].Value())
+	require.False(g.state().Degraded)
+
+	backend.delay.Store(50 * time.Millisecond)
+	s.Counter("c").Inc(1)
+	require.True(g.state().Degraded)
+
+	// Emissions are aggregated without waiting for the backend.
+	start := clk.Now()
+	for i := 0; i < 100; i++ {
+		s.Counter("c").Inc(1)
+		s.Tagged(map[string]string{"k": "v"}).Counter("c").Inc(2)
+		s.Gauge("g").Update(float64(i))
+		s.Timer("t").Record(time.Millisecond)
+	}
+	require.Equal(start, clk.Now())
+	require.Equal(int64(2), stats.Snapshot().Counters()["c+"].Value())
+
+	// Flushes which are due while a flush is blocked are dropped, and
+	// emissions are still aggregated.
+	backend.delay.Store(0)
+	backend.blocked.Store(true)
+	clk.Add(time.Second)
+	require.Eventually(func() bool {
+		return backend.waiting.Load() == 1
+	}, time.Second, time.Millisecond)
+	clk.Add(time.Second)
+	require.Eventually(func() bool {
+		return g.state().DroppedFlushes == 1
+	}, time.Second, time.Millisecond)
+	s.Counter("c").Inc(1)
+
+	// The blocked flush was slow, so the guard stays degraded until the next
+	// flush finds the backend fast again. No emission is lost.
+	backend.unblock()
+	require.Eventually(func() bool {
+		return g.state().Flushes == 1
+	}, time.Second, time.Millisecond)
+	require.True(g.state().Degraded)
+	clk.Add(time.Second)
+	require.Eventually(func() bool {
+		return !g.state().Degraded
+	}, time.Second, time.Millisecond)
+
+	snapshot := stats.Snapshot()
+	counters := snapshot.Counters()
+	require.Equal(int64(103), counters["c+"].Value())
+	require.Equal(int64(200), counters["c+k=v"].Value())
+	require.Equal(int64(1), counters["stats_guard_degradations+"].Value())
+	require.Equal(int64(1), counters["stats_guard_dropped_flushes+"].Value())
+	require.Equal(float64(99), snapshot.Gauges()["g+"].Value())
+	require.Len(snapshot.Timers()["t+"].Values(), _maxAggregatedSamples)
+
+	state := g.state()
+	require.Equal(int64(1), state.Degradations)
+	require.Equal(int64(2), state.Flushes)
+	require.Equal(int64(1), state.DroppedFlushes)
+	require.Equal(int64(100-_maxAggregatedSamples), state.DroppedSamples)
+
+	s.Counter("c").Inc(1)
+	require.Equal(int64(104), stats.Snapshot().Counters()["c+"].Value())
+}
+
+func TestStatsGuardLosesNoEmissionsConcurrentWithFlushes(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+	backend := newSlowBackend(clk)
+	stats := tally.NewTestScope("", nil)
+	g := newStatsGuard(backend.wrap(stats), clk, Config{
+		StatsSampleRate:    1,
+		SlowStatsThreshold: 10 * time.Millisecond,
+	}.applyDefaults(), zap.NewNop().Sugar(), core.InfoHashFixture())
+	defer g.close()
+	s := g.scope()
+
+	backend.delay.Store(50 * time.Millisecond)
+	s.Counter("c").Inc(1)
+	require.True(g.state().Degraded)
+
+	backend.delay.Store(0)
+	s.Counter("c").Inc(1)
+
+	// The flush recovers, swapping generations twice while emissions aggregate
+	// or already emit directly.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				s.Counter("c").Inc(1)
+			}
+		}()
+	}
+	clk.Add(time.Second)
+	require.Eventually(func() bool {
+		return !g.state().Degraded
+	}, time.Second, time.Millisecond)
+	wg.Wait()
+
+	require.Equal(int64(4002), stats.Snapshot().Counters()["c+"].Value())
+}
+
+func TestStatsGuardDropsMetricsBeyondLimit(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+	backend := newSlowBackend(clk)
+	stats := tally.NewTestScope("", nil)
+	g := newStatsGuard(backend.wrap(stats), clk, Config{
+		StatsSampleRate:      1,
+		SlowStatsThreshold:   10 * time.Millisecond,
+		MaxAggregatedMetrics: 2,
+	}.applyDefaults(), zap.NewNop().Sugar(), core.InfoHashFixture())
+	defer g.close()
+	s := g.scope()
+
+	backend.delay.Store(50 * time.Millisecond)
+	s.Counter("a").Inc(1)
+	require.True(g.state().Degraded)
+	backend.delay.Store(0)
+
+	// The degradation counter takes the first slot.
+	s.Counter("a").Inc(1)
+	s.Counter("b").Inc(1)
+	require.Equal(int64(1), g.state().DroppedSamples)
+
+	clk.Add(time.Second)
+	require.Eventually(func() bool {
+		return !g.state().Degraded
+	}, time.Second, time.Millisecond)
+	counters := stats.Snapshot().Counters()
+	require.Equal(int64(2), counters["a+"].Value())
+	require.NotContains(counters, "b+")
+}
+
+func TestDispatcherHandlersStayFastWhileMetricsBackendIsSlow(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(4, 1)
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	clk := clock.NewMock()
+	backend := newSlowBackend(clk)
+	stats := tally.NewTestScope("", nil)
+	d, err := newDispatcher(
+		Config{
+			PipelineLimit:      3,
+			StatsSampleRate:    1,
+			SlowStatsThreshold: 10 * time.Millisecond,
+			DisableEndgame:     true,
+			DisableKeepalive:   true,
+		},
+		backend.wrap(stats),
+		clk,
+		networkevent.NewTestProducer(),
+		noopEvents{},
+		core.PeerIDFixture(),
+		torrent,
+		zap.NewNop().Sugar(),
+		torrentlog.NewNopLogger())
+	require.NoError(err)
+	defer d.statsGuard.close()
+
+	p, err := d.addPeer(
+		core.PeerIDFixture(), bitsetutil.FromBools(true, true, true, true), newMockMessages())
+	require.NoError(err)
+
+	backend.delay.Store(50 * time.Millisecond)
+	_, err = d.maybeRequestMorePieces(p)
+	require.NoError(err)
+	require.True(d.StatsGuard().Degraded)
+
+	// Handlers no longer wait for the backend.
+	start := clk.Now()
+	requested := requestedPieces(p.messages)
+	require.Len(requested, 3)
+	for _, i := range requested {
+		require.NoError(d.dispatch(p, conn.NewPiecePayloadMessage(i, piecereader.NewBuffer(blob.Content[i:i+1]))))
+	}
+	require.Equal(start, clk.Now())
+	require.Equal(d.StatsGuard(), d.Dump().StatsGuard)
+
+	backend.delay.Store(0)
+	clk.Add(time.Second)
+	require.Eventually(func() bool {
+		return !d.StatsGuard().Degraded
+	}, time.Second, time.Millisecond)
+	counters := stats.Snapshot().Counters()
+	require.Equal(int64(3), counters["downloaded_piece_bytes+module=dispatch,size_bucket=under_10MB"].Value())
+	require.Equal(int64(1), counters["stats_guard_degradations+module=dispatch,size_bucket=under_10MB"].Value())
+}
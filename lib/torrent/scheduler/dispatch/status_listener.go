@@ -0,0 +1,156 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"sync"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+)
+
+// StatusChange is a bitmask of Dispatcher status fields which changed.
+type StatusChange uint8
+
+// StatusChange flags.
+const (
+	// PeersChanged indicates a peer was added or removed.
+	PeersChanged StatusChange = 1 << iota
+
+	// ProgressChanged indicates the completion percentage of the torrent changed.
+	ProgressChanged
+
+	// StateChanged indicates the Dispatcher transitioned state, e.g. completed.
+	StateChanged
+
+	// QuarantineChanged indicates a piece was quarantined or released, see
+	// Dispatcher.QuarantinedPieces.
+	QuarantineChanged
+)
+
+// StatusListener is notified of material Dispatcher status changes, at most once
+// per Config.StatusInterval. Notifications are delivered serially with Events.
+type StatusListener interface {
+	StatusChanged(d *Dispatcher, changes StatusChange)
+}
+
+// statusNotifier coalesces status changes into at most one StatusListener
+// notification per interval. No-op if listener is nil.
+type statusNotifier struct {
+	d        *Dispatcher
+	listener StatusListener
+	interval time.Duration
+	clk      clock.Clock
+
+	mu           sync.Mutex // Protects the following fields:
+	pending      StatusChange
+	timer        *clock.Timer
+	lastNotified time.Time
+	lastPercent  int
+	closed       bool
+}
+
+func newStatusNotifier(
+	d *Dispatcher, listener StatusListener, interval time.Duration, clk clock.Clock) *statusNotifier {
+
+	return &statusNotifier{
+		d:           d,
+		listener:    listener,
+		interval:    interval,
+		clk:         clk,
+		lastPercent: -1,
+	}
+}
+
+// progress notifies ProgressChanged if the completion percentage of the torrent
+// crossed a percent boundary since the last call.
+func (n *statusNotifier) progress() {
+	if n.listener == nil {
+		return
+	}
+	length := n.d.Length()
+	if length == 0 {
+		return
+	}
+	percent := int(n.d.completedBytes() * 100 / length)
+
+	n.mu.Lock()
+	changed := percent != n.lastPercent
+	n.lastPercent = percent
+	n.mu.Unlock()
+
+	if changed {
+		n.notify(ProgressChanged)
+	}
+}
+
+// notify records changes, delivering them immediately if no notification was
+// delivered within the last interval, else once the interval elapses.
+func (n *statusNotifier) notify(changes StatusChange) {
+	if n.listener == nil {
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.closed {
+		return
+	}
+	n.pending |= changes
+	if n.timer != nil {
+		// Already scheduled.
+		return
+	}
+	delay := n.lastNotified.Add(n.interval).Sub(n.clk.Now())
+	if delay <= 0 {
+		n.flushLocked()
+		return
+	}
+	n.timer = n.clk.AfterFunc(delay, n.flush)
+}
+
+func (n *statusNotifier) flush() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.timer = nil
+	if n.closed {
+		return
+	}
+	n.flushLocked()
+}
+
+func (n *statusNotifier) flushLocked() {
+	changes := n.pending
+	n.pending = 0
+	n.lastNotified = n.clk.Now()
+	n.d.emitter.emit(func(Events) { n.listener.StatusChanged(n.d, changes) })
+}
+
+// close stops all pending and future notifications.
+func (n *statusNotifier) close() {
+	if n.listener == nil {
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.closed = true
+	if n.timer != nil {
+		n.timer.Stop()
+		n.timer = nil
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/torrent/scheduler/conn"
+	"github.com/uber/kraken/lib/torrent/storage/agentstorage"
+	"github.com/uber/kraken/lib/torrent/storage/piecereader"
+	"github.com/uber/kraken/utils/bitsetutil"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingStatusListener records all received status changes in order.
+type recordingStatusListener struct {
+	mu      sync.Mutex
+	changes []StatusChange
+}
+
+func (l *recordingStatusListener) StatusChanged(d *Dispatcher, changes StatusChange) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.changes = append(l.changes, changes)
+}
+
+func (l *recordingStatusListener) get() []StatusChange {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]StatusChange(nil), l.changes...)
+}
+
+func (l *recordingStatusListener) waitFor(t *testing.T, expected []StatusChange) {
+	require.Eventually(t, func() bool {
+		return len(l.get()) >= len(expected)
+	}, time.Second, 5*time.Millisecond)
+	require.Equal(t, expected, l.get())
+}
+
+func TestStatusListenerCoalescesChangesPerInterval(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+	clk.Set(time.Now())
+
+	blob := core.SizedBlobFixture(4, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	listener := &recordingStatusListener{}
+	config := Config{
+		StatusListener: listener,
+		StatusInterval: time.Second,
+	}
+	d := testDispatcher(config, clk, torrent)
+
+	// First change is delivered immediately.
+	p1, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(true, true, true, true), newMockMessages())
+	require.NoError(err)
+	listener.waitFor(t, []StatusChange{PeersChanged})
+
+	// Many changes within the interval are coalesced into one notification.
+	var peers []*peer
+	for i := 0; i < 10; i++ {
+		p, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false, false, false, false), newMockMessages())
+		require.NoError(err)
+		peers = append(peers, p)
+	}
+	for _, p := range peers {
+		require.NoError(d.removePeer(p))
+	}
+	require.NoError(d.dispatch(
+		p1, conn.NewPiecePayloadMessage(0, piecereader.NewBuffer(blob.Content[0:1]))))
+
+	time.Sleep(50 * time.Millisecond)
+	require.Len(listener.get(), 1)
+
+	clk.Add(time.Second)
+	listener.waitFor(t, []StatusChange{PeersChanged, PeersChanged | ProgressChanged})
+
+	// No changes, no notifications.
+	clk.Add(5 * time.Second)
+	time.Sleep(50 * time.Millisecond)
+	require.Len(listener.get(), 2)
+
+	// Interval has elapsed, so completion is delivered immediately.
+	for i := 1; i < 4; i++ {
+		require.NoError(d.dispatch(
+			p1, conn.NewPiecePayloadMessage(i, piecereader.NewBuffer(blob.Content[i:i+1]))))
+	}
+	listener.waitFor(t, []StatusChange{
+		PeersChanged,
+		PeersChanged | ProgressChanged,
+		ProgressChanged,
+	})
+
+	clk.Add(time.Second)
+	listener.waitFor(t, []StatusChange{
+		PeersChanged,
+		PeersChanged | ProgressChanged,
+		ProgressChanged,
+		ProgressChanged | StateChanged,
+	})
+}
+
+func TestStatusListenerStopsNotifyingAfterTearDown(t *testing.T) {
+	require := require.New(t)
+
+	clk := clock.NewMock()
+	clk.Set(time.Now())
+
+	torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(1, 1).MetaInfo)
+	defer cleanup()
+
+	listener := &recordingStatusListener{}
+	d := testDispatcher(Config{StatusListener: listener}, clk, torrent)
+
+	_, err := d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false), newMockMessages())
+	require.NoError(err)
+	_, err = d.addPeer(core.PeerIDFixture(), bitsetutil.FromBools(false), newMockMessages())
+	require.NoError(err)
+
+	d.TearDown()
+
+	clk.Add(time.Minute)
+	time.Sleep(50 * time.Millisecond)
+	require.Equal([]StatusChange{PeersChanged}, listener.get())
+}
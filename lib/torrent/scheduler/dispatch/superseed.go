@@ -0,0 +1,104 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"sync"
+
+	"github.com/uber/kraken/core"
+)
+
+// superseeder decides which pieces a seeding Dispatcher reveals to each peer in
+// superseed mode. Each peer is revealed at most perPeer pieces at a time, taken
+// from a cursor which rotates through the torrent, such that distinct peers are
+// revealed distinct pieces. A peer is only revealed another piece once it
+// announces one of its revealed pieces back, i.e. once the piece propagated.
+type superseeder struct {
+	numPieces int
+	perPeer   int
+
+	mu       sync.Mutex // Protects the following fields:
+	cursor   int
+	revealed map[core.PeerID]map[int]bool
+}
+
+func newSuperseeder(numPieces, perPeer int) *superseeder {
+	return &superseeder{
+		numPieces: numPieces,
+		perPeer:   perPeer,
+		revealed:  make(map[core.PeerID]map[int]bool),
+	}
+}
+
+// add starts revealing pieces to peerID.
+func (s *superseeder) add(peerID core.PeerID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.revealed[peerID] = make(map[int]bool)
+}
+
+// reveal returns the pieces to newly reveal to peerID, such that peerID has
+// perPeer pieces revealed which it has yet to announce. Pieces for which skip
+// returns true are never revealed, and nothing is revealed to dropped peers.
+func (s *superseeder) reveal(peerID core.PeerID, skip func(i int) bool) []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.revealed[peerID]
+	if !ok {
+		return nil
+	}
+	var pieces []int
+	for n := 0; n < s.numPieces && len(r) < s.perPeer; n++ {
+		i := s.cursor
+		s.cursor = (s.cursor + 1) % s.numPieces
+		if r[i] || skip(i) {
+			continue
+		}
+		r[i] = true
+		pieces = append(pieces, i)
+	}
+	return pieces
+}
+
+// announced records that peerID announced piece i. Returns true if i was
+// revealed to peerID, i.e. if peerID may be revealed another piece.
+func (s *superseeder) announced(peerID core.PeerID, i int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := s.revealed[peerID]
+	if !r[i] {
+		return false
+	}
+	delete(r, i)
+	return true
+}
+
+// drop forgets the pieces revealed to peerID.
+func (s *superseeder) drop(peerID core.PeerID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.revealed, peerID)
+}
+
+// numPeers returns the number of peers which pieces were revealed to.
+func (s *superseeder) numPeers() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.revealed)
+}
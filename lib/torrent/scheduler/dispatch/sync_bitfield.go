@@ -15,50 +15,91 @@ package dispatch
 
 import (
 	"bytes"
+	"fmt"
 	"sync"
 
 	"github.com/willf/bitset"
 )
 
+// bitfieldIndexError is returned when a bit outside of the length of a
+// syncBitfield is set.
+type bitfieldIndexError struct {
+	index  uint
+	length uint
+}
+
+func (e *bitfieldIndexError) Error() string {
+	return fmt.Sprintf("bitfield index out of range: %d >= %d", e.index, e.length)
+}
+
+// bitfieldLengthError is returned when a bitfield whose length differs from the
+// expected length is combined with a syncBitfield, or registered for a torrent.
+type bitfieldLengthError struct {
+	length   uint
+	expected uint
+}
+
+func (e *bitfieldLengthError) Error() string {
+	return fmt.Sprintf("bitfield length mismatch: %d != %d", e.length, e.expected)
+}
+
+// syncBitfield is a thread-safe bitfield whose length is fixed at construction.
+// Bitset operations silently grow bitsets when setting bits out of range, and
+// truncate or extend results when combining bitsets of different lengths, so
+// all mutations and combinations are validated against the fixed length, and
+// fail without modifying the bitfield.
 type syncBitfield struct {
 	sync.RWMutex
 	b *bitset.BitSet
+	n uint
 }
 
 func newSyncBitfield(b *bitset.BitSet) *syncBitfield {
 	return &syncBitfield{
 		b: b.Clone(),
+		n: b.Len(),
 	}
 }
 
+// Copy returns a copy of s. Note that bitset.Copy only copies as many bits as
+// the destination holds, so s is cloned instead.
 func (s *syncBitfield) Copy() *bitset.BitSet {
 	s.RLock()
 	defer s.RUnlock()
 
-	b := &bitset.BitSet{}
-	s.b.Copy(b)
-	return b
+	return s.b.Clone()
 }
 
-func (s *syncBitfield) Intersection(other *bitset.BitSet) *bitset.BitSet {
+// Intersection returns the bits set in both s and other, which must be of the
+// same length as s.
+func (s *syncBitfield) Intersection(other *bitset.BitSet) (*bitset.BitSet, error) {
+	if other.Len() != s.n {
+		return nil, &bitfieldLengthError{other.Len(), s.n}
+	}
+
 	s.RLock()
 	defer s.RUnlock()
 
-	return s.b.Intersection(other)
+	return s.b.Intersection(other), nil
 }
 
+// Len returns the fixed length of s.
 func (s *syncBitfield) Len() uint {
+	return s.n
+}
+
+func (s *syncBitfield) Has(i uint) bool {
 	s.RLock()
 	defer s.RUnlock()
 
-	return s.b.Len()
+	return s.b.Test(i)
 }
 
-func (s *syncBitfield) Has(i uint) bool {
+func (s *syncBitfield) Count() uint {
 	s.RLock()
 	defer s.RUnlock()
 
-	return s.b.Test(i)
+	return s.b.Count()
 }
 
 func (s *syncBitfield) Complete() bool {
@@ -68,11 +109,38 @@ func (s *syncBitfield) Complete() bool {
 	return s.b.All()
 }
 
-func (s *syncBitfield) Set(i uint, v bool) {
+// Set sets bit i to v, returning true if this changed the bit.
+func (s *syncBitfield) Set(i uint, v bool) (bool, error) {
+	if i >= s.n {
+		return false, &bitfieldIndexError{i, s.n}
+	}
+
 	s.Lock()
 	defer s.Unlock()
 
+	changed := s.b.Test(i) != v
 	s.b.SetTo(i, v)
+	return changed, nil
+}
+
+// Apply sets all bits which are set in diff, returning the indices of the bits
+// which changed. If any bit set in diff is out of range, s is not modified.
+func (s *syncBitfield) Apply(diff *bitset.BitSet) ([]uint, error) {
+	if i, ok := diff.NextSet(s.n); ok {
+		return nil, &bitfieldIndexError{i, s.n}
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	var changed []uint
+	for i, ok := diff.NextSet(0); ok; i, ok = diff.NextSet(i + 1) {
+		if !s.b.Test(i) {
+			s.b.Set(i)
+			changed = append(changed, i)
+		}
+	}
+	return changed, nil
 }
 
 // GetAllSet returns the indices of all set bits in the bitset.
@@ -91,13 +159,19 @@ func (s *syncBitfield) GetAllSet() []uint {
 	return all
 }
 
-func (s *syncBitfield) SetAll(v bool) {
+// SetAll sets all bits to v, returning the indices of the bits which changed.
+func (s *syncBitfield) SetAll(v bool) []uint {
 	s.Lock()
 	defer s.Unlock()
 
-	for i := uint(0); i < s.b.Len(); i++ {
+	var changed []uint
+	for i := uint(0); i < s.n; i++ {
+		if s.b.Test(i) != v {
+			changed = append(changed, i)
+		}
 		s.b.SetTo(i, v)
 	}
+	return changed
 }
 
 func (s *syncBitfield) String() string {
@@ -14,11 +14,13 @@
 package dispatch
 
 import (
+	"math/rand"
 	"testing"
 
 	"github.com/uber/kraken/utils/bitsetutil"
 
 	"github.com/stretchr/testify/require"
+	"github.com/willf/bitset"
 )
 
 func TestSyncBitfieldDuplicateSetDoesNotDoubleCount(t *testing.T) {
@@ -51,9 +53,125 @@ func TestSyncBitfieldNewCountsNumComplete(t *testing.T) {
 	require.True(b.Complete())
 }
 
+func TestSyncBitfieldCopy(t *testing.T) {
+	require := require.New(t)
+
+	b := newSyncBitfield(bitsetutil.FromBools(true, false, true))
+	c := b.Copy()
+	require.True(bitsetutil.FromBools(true, false, true).Equal(c))
+
+	c.Set(1)
+	require.Equal("101", b.String())
+}
+
 func TestSyncBitfieldString(t *testing.T) {
 	require := require.New(t)
 
 	b := newSyncBitfield(bitsetutil.FromBools(true, false, true, false))
 	require.Equal("1010", b.String())
 }
+
+func TestSyncBitfieldSetOutOfRange(t *testing.T) {
+	require := require.New(t)
+
+	// Setting the bit past the end used to grow the bitfield, such that it
+	// could never become complete again.
+	b := newSyncBitfield(bitsetutil.FromBools(true, true))
+
+	changed, err := b.Set(2, true)
+	require.Equal(&bitfieldIndexError{2, 2}, err)
+	require.False(changed)
+	require.Equal(uint(2), b.Len())
+	require.Equal("11", b.String())
+	require.True(b.Complete())
+}
+
+func TestSyncBitfieldApplyOutOfRangeIsAtomic(t *testing.T) {
+	require := require.New(t)
+
+	b := newSyncBitfield(bitsetutil.FromBools(false, false, false))
+
+	changed, err := b.Apply(bitsetutil.FromBools(true, false, false, true))
+	require.Equal(&bitfieldIndexError{3, 3}, err)
+	require.Empty(changed)
+	require.Equal("000", b.String())
+
+	changed, err = b.Apply(bitsetutil.FromBools(true, false, true))
+	require.NoError(err)
+	require.Equal([]uint{0, 2}, changed)
+	require.Equal("101", b.String())
+
+	// Diffs shorter than the bitfield are fine.
+	changed, err = b.Apply(bitsetutil.FromBools(true, true))
+	require.NoError(err)
+	require.Equal([]uint{1}, changed)
+	require.True(b.Complete())
+}
+
+func TestSyncBitfieldIntersectionLengthMismatch(t *testing.T) {
+	require := require.New(t)
+
+	b := newSyncBitfield(bitsetutil.FromBools(true, false, true))
+
+	_, err := b.Intersection(bitsetutil.FromBools(true, true))
+	require.Equal(&bitfieldLengthError{2, 3}, err)
+
+	r, err := b.Intersection(bitsetutil.FromBools(false, true, true))
+	require.NoError(err)
+	require.True(bitsetutil.FromBools(false, false, true).Equal(r))
+}
+
+// TestSyncBitfieldRandomOperations applies random Set and Apply operations,
+// including out of range indices, to a syncBitfield and a reference model.
+func TestSyncBitfieldRandomOperations(t *testing.T) {
+	require := require.New(t)
+
+	rng := rand.New(rand.NewSource(1))
+
+	for iter := 0; iter < 200; iter++ {
+		n := uint(rng.Intn(130))
+		model := make([]bool, n)
+		b := newSyncBitfield(bitset.New(n))
+
+		for op := 0; op < 50; op++ {
+			if rng.Intn(2) == 0 {
+				i := uint(rng.Intn(int(n) + 10))
+				v := rng.Intn(2) == 0
+				changed, err := b.Set(i, v)
+				if i >= n {
+					require.Equal(&bitfieldIndexError{i, n}, err)
+					require.False(changed)
+				} else {
+					require.NoError(err)
+					require.Equal(model[i] != v, changed)
+					model[i] = v
+				}
+			} else {
+				diff := bitset.New(0)
+				var outOfRange bool
+				for k := rng.Intn(4); k > 0; k-- {
+					i := uint(rng.Intn(int(n) + 10))
+					diff.Set(i)
+					outOfRange = outOfRange || i >= n
+				}
+				changed, err := b.Apply(diff)
+				if outOfRange {
+					require.IsType(&bitfieldIndexError{}, err)
+					require.Empty(changed)
+				} else {
+					require.NoError(err)
+					var expected []uint
+					for i, ok := diff.NextSet(0); ok; i, ok = diff.NextSet(i + 1) {
+						if !model[i] {
+							expected = append(expected, i)
+							model[i] = true
+						}
+					}
+					require.Equal(expected, changed)
+				}
+			}
+			require.Equal(n, b.Len())
+			require.True(bitsetutil.FromBools(model...).Equal(b.Copy()), "expected %v, got %s", model, b)
+		}
+	}
+}
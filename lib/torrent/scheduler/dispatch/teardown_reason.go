@@ -0,0 +1,76 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import "fmt"
+
+// TearDownReason classifies why a Dispatcher was torn down.
+type TearDownReason int
+
+const (
+	// TearDownUnspecified is the reason of legacy TearDown calls.
+	TearDownUnspecified TearDownReason = iota
+
+	// TearDownIdle denotes the torrent made no progress for too long.
+	TearDownIdle
+
+	// TearDownRemoved denotes the torrent was manually removed.
+	TearDownRemoved
+
+	// TearDownShutdown denotes the process is shutting down.
+	TearDownShutdown
+
+	// TearDownCompleted denotes the torrent completed, and is no longer seeded.
+	TearDownCompleted
+
+	// TearDownCorruption denotes the download failed because more than
+	// Config.MaxCorruptPieces received pieces failed verification.
+	TearDownCorruption
+
+	// TearDownDeadline denotes the download failed because the torrent was not
+	// complete within Config.DownloadDeadline.
+	TearDownDeadline
+
+	// TearDownCanceled denotes the context which the Dispatcher was created
+	// with was done, see NewWithContext.
+	TearDownCanceled
+)
+
+// Failure returns true if r denotes the download of the torrent failed.
+func (r TearDownReason) Failure() bool {
+	return r == TearDownCorruption || r == TearDownDeadline
+}
+
+func (r TearDownReason) String() string {
+	switch r {
+	case TearDownUnspecified:
+		return "unspecified"
+	case TearDownIdle:
+		return "idle"
+	case TearDownRemoved:
+		return "removed"
+	case TearDownShutdown:
+		return "shutdown"
+	case TearDownCompleted:
+		return "completed"
+	case TearDownCorruption:
+		return "corruption"
+	case TearDownDeadline:
+		return "deadline"
+	case TearDownCanceled:
+		return "canceled"
+	default:
+		return fmt.Sprintf("TearDownReason(%d)", int(r))
+	}
+}
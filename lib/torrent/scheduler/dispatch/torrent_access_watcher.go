@@ -17,18 +17,26 @@ import (
 	"sync"
 	"time"
 
-	"github.com/uber/kraken/lib/torrent/storage"
 	"github.com/andres-erbsen/clock"
+	"github.com/uber/kraken/lib/torrent/storage"
 )
 
 // torrentAccessWatcher wraps a storage.Torrent and records when it is written to
 // and when it is read from. Read times are measured when piece readers are closed.
+// Once invalidated, the torrent can no longer be read from nor written to.
 type torrentAccessWatcher struct {
 	storage.Torrent
 	clk       clock.Clock
 	mu        sync.Mutex
 	lastWrite time.Time
 	lastRead  time.Time
+
+	// accesses counts open piece readers and piece writes in progress.
+	accesses int
+
+	// invalidated is closed once the torrent was invalidated and accesses
+	// dropped to zero. Nil until invalidate is called.
+	invalidated chan struct{}
 }
 
 func newTorrentAccessWatcher(t storage.Torrent, clk clock.Clock) *torrentAccessWatcher {
@@ -41,6 +49,11 @@ func newTorrentAccessWatcher(t storage.Torrent, clk clock.Clock) *torrentAccessW
 }
 
 func (w *torrentAccessWatcher) WritePiece(src storage.PieceReader, piece int) error {
+	if !w.acquire() {
+		return errTorrentInvalidated
+	}
+	defer w.release()
+
 	err := w.Torrent.WritePiece(src, piece)
 	if err == nil {
 		w.touchLastWrite()
@@ -50,11 +63,13 @@ func (w *torrentAccessWatcher) WritePiece(src storage.PieceReader, piece int) er
 
 type pieceReaderCloseWatcher struct {
 	storage.PieceReader
-	w *torrentAccessWatcher
+	w    *torrentAccessWatcher
+	once sync.Once
 }
 
 func (w *pieceReaderCloseWatcher) Close() error {
 	err := w.PieceReader.Close()
+	w.once.Do(w.w.release)
 	if err != nil {
 		w.w.touchLastRead()
 	}
@@ -62,11 +77,53 @@ func (w *pieceReaderCloseWatcher) Close() error {
 }
 
 func (w *torrentAccessWatcher) GetPieceReader(piece int) (storage.PieceReader, error) {
+	if !w.acquire() {
+		return nil, errTorrentInvalidated
+	}
 	pr, err := w.Torrent.GetPieceReader(piece)
-	if err == nil {
-		pr = &pieceReaderCloseWatcher{pr, w}
+	if err != nil {
+		w.release()
+		return nil, err
+	}
+	return &pieceReaderCloseWatcher{PieceReader: pr, w: w}, nil
+}
+
+// acquire returns false if the torrent was invalidated, else counts an access
+// which must be released.
+func (w *torrentAccessWatcher) acquire() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.invalidated != nil {
+		return false
+	}
+	w.accesses++
+	return true
+}
+
+func (w *torrentAccessWatcher) release() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.accesses--
+	if w.accesses == 0 && w.invalidated != nil {
+		close(w.invalidated)
+	}
+}
+
+// invalidate refuses all further accesses of the torrent, and returns a channel
+// which is closed once accesses in progress were released.
+func (w *torrentAccessWatcher) invalidate() <-chan struct{} {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.invalidated == nil {
+		w.invalidated = make(chan struct{})
+		if w.accesses == 0 {
+			close(w.invalidated)
+		}
 	}
-	return pr, err
+	return w.invalidated
 }
 
 func (w *torrentAccessWatcher) touchLastWrite() {
@@ -0,0 +1,91 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// unavailablePieces tracks how long missing pieces have had no peer to request
+// them from.
+type unavailablePieces struct {
+	mu       sync.Mutex
+	timeout  time.Duration
+	since    map[int]time.Time
+	reported map[int]bool
+}
+
+func newUnavailablePieces(timeout time.Duration) *unavailablePieces {
+	return &unavailablePieces{
+		timeout:  timeout,
+		since:    make(map[int]time.Time),
+		reported: make(map[int]bool),
+	}
+}
+
+// update records that pieces are currently unavailable, forgetting all other
+// pieces. Returns the sorted pieces which have been unavailable for longer than
+// timeout and were not returned before. Pieces are only returned again once
+// they became available in between.
+func (u *unavailablePieces) update(pieces []int, now time.Time) []int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	current := make(map[int]bool, len(pieces))
+	for _, i := range pieces {
+		current[i] = true
+	}
+	for i := range u.since {
+		if !current[i] {
+			delete(u.since, i)
+			delete(u.reported, i)
+		}
+	}
+	var expired []int
+	for _, i := range pieces {
+		since, ok := u.since[i]
+		if !ok {
+			u.since[i] = now
+			continue
+		}
+		if !u.reported[i] && now.Sub(since) >= u.timeout {
+			u.reported[i] = true
+			expired = append(expired, i)
+		}
+	}
+	sort.Ints(expired)
+	return expired
+}
+
+// report returns the sorted pieces which were not returned before, regardless
+// of timeout, and records them as returned until they become available.
+func (u *unavailablePieces) report(pieces []int, now time.Time) []int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	var unreported []int
+	for _, i := range pieces {
+		if _, ok := u.since[i]; !ok {
+			u.since[i] = now
+		}
+		if !u.reported[i] {
+			u.reported[i] = true
+			unreported = append(unreported, i)
+		}
+	}
+	sort.Ints(unreported)
+	return unreported
+}
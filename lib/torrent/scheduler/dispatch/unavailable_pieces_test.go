@@ -0,0 +1,57 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnavailablePiecesUpdate(t *testing.T) {
+	require := require.New(t)
+
+	u := newUnavailablePieces(time.Minute)
+	start := time.Now()
+
+	require.Empty(u.update([]int{3, 1}, start))
+	require.Empty(u.update([]int{3, 1, 2}, start.Add(30*time.Second)))
+	require.Equal([]int{1, 3}, u.update([]int{3, 1, 2}, start.Add(time.Minute)))
+	require.Empty(u.update([]int{3, 1, 2}, start.Add(80*time.Second)))
+
+	// Piece 1 became available, so it is reported again once it was
+	// unavailable for the full timeout.
+	require.Equal([]int{2}, u.update([]int{3, 2}, start.Add(90*time.Second)))
+	require.Empty(u.update([]int{3, 2, 1}, start.Add(2*time.Minute)))
+	require.Equal([]int{1}, u.update([]int{3, 2, 1}, start.Add(3*time.Minute)))
+}
+
+func TestUnavailablePiecesReport(t *testing.T) {
+	require := require.New(t)
+
+	u := newUnavailablePieces(time.Minute)
+	start := time.Now()
+
+	require.Empty(u.update([]int{1}, start))
+	require.Equal([]int{1, 2}, u.report([]int{2, 1}, start.Add(time.Second)))
+	require.Empty(u.report([]int{2, 1}, start.Add(2*time.Second)))
+
+	// Reported pieces are not returned again by update while unavailable.
+	require.Empty(u.update([]int{1, 2}, start.Add(time.Hour)))
+
+	// Piece 1 became available, so it is reported again.
+	require.Empty(u.update([]int{2}, start.Add(2*time.Hour)))
+	require.Equal([]int{1}, u.report([]int{1, 2}, start.Add(2*time.Hour)))
+}
@@ -0,0 +1,81 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"github.com/willf/bitset"
+)
+
+// usefulPiecesSize returns the approximate memory cost in bytes of caching the
+// useful pieces of a peer.
+func (d *Dispatcher) usefulPiecesSize() int64 {
+	return 8 * int64((d.torrent.NumPieces()+63)/64)
+}
+
+// cacheUsefulPieces caches the pieces which p has but we do not, such that
+// requesting pieces from p need not intersect bitfields. Complete peers are not
+// cached, since their useful pieces are simply the pieces we lack, and neither
+// are peers which exceed the UsefulPiecesCacheBytes budget. Seed-only
+// dispatchers need no useful pieces at all.
+func (d *Dispatcher) cacheUsefulPieces(p *peer) {
+	p.requestMu.Lock()
+	defer p.requestMu.Unlock()
+
+	if p.removed || p.useful != nil || p.bitfield.Complete() || d.SeedOnly() {
+		return
+	}
+	size := d.usefulPiecesSize()
+	if d.usefulPiecesBytes.Add(size) > d.config.UsefulPiecesCacheBytes {
+		d.usefulPiecesBytes.Sub(size)
+		d.stats.Counter("uncached_useful_pieces").Inc(1)
+		return
+	}
+	p.useful = d.peerPiecesIn(p, d.torrent.Bitfield().Complement())
+}
+
+// releaseUsefulPiecesLocked drops the cached useful pieces of p. Caller must
+// hold p.requestMu.
+func (d *Dispatcher) releaseUsefulPiecesLocked(p *peer) {
+	if p.useful == nil {
+		return
+	}
+	p.useful = nil
+	d.usefulPiecesBytes.Sub(d.usefulPiecesSize())
+}
+
+// usefulPiecesLocked returns the pieces which p has but we do not. The result
+// must not be modified, nor used once p.requestMu is released. Caller must hold
+// p.requestMu.
+func (d *Dispatcher) usefulPiecesLocked(p *peer) *bitset.BitSet {
+	if p.useful != nil {
+		return p.useful
+	}
+	return d.peerPiecesIn(p, d.torrent.Bitfield().Complement())
+}
+
+// clearUsefulPieces removes pieces, which were just written, from the cached
+// useful pieces of all peers.
+func (d *Dispatcher) clearUsefulPieces(pieces ...int) {
+	d.peers.Range(func(k, v interface{}) bool {
+		p := v.(*peer)
+		p.requestMu.Lock()
+		if p.useful != nil {
+			for _, i := range pieces {
+				p.useful.Clear(uint(i))
+			}
+		}
+		p.requestMu.Unlock()
+		return true
+	})
+}
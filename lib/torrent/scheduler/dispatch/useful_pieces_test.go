@@ -0,0 +1,197 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+	"github.com/willf/bitset"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/torrent/scheduler/conn"
+	"github.com/uber/kraken/lib/torrent/storage/agentstorage"
+	"github.com/uber/kraken/lib/torrent/storage/piecereader"
+)
+
+func randomBitfield(rng *rand.Rand, n int, p float64) *bitset.BitSet {
+	b := bitset.New(uint(n))
+	for i := 0; i < n; i++ {
+		if rng.Float64() < p {
+			b.Set(uint(i))
+		}
+	}
+	return b
+}
+
+// requireUsefulPiecesCached checks that the cached useful pieces of all peers
+// match the intersection of their bitfield with the pieces we lack. Nothing is
+// cached once d is seed-only.
+func requireUsefulPiecesCached(t *testing.T, d *Dispatcher) {
+	d.peers.Range(func(k, v interface{}) bool {
+		p := v.(*peer)
+		p.requestMu.Lock()
+		defer p.requestMu.Unlock()
+
+		if p.bitfield.Complete() || d.SeedOnly() {
+			require.Nil(t, p.useful)
+			return true
+		}
+		require.NotNil(t, p.useful)
+		expected, err := p.bitfield.Intersection(d.torrent.Bitfield().Complement())
+		require.NoError(t, err)
+		require.True(t, expected.Equal(p.useful), "peer %s: expected %s, got %s",
+			p, expected.DumpAsBits(), p.useful.DumpAsBits())
+		return true
+	})
+}
+
+func TestUsefulPiecesMatchBitfieldsUnderRandomUpdates(t *testing.T) {
+	for seed := int64(0); seed < 20; seed++ {
+		rng := rand.New(rand.NewSource(seed))
+		numPieces := 1 + rng.Intn(100)
+
+		blob := core.SizedBlobFixture(uint64(numPieces), 1)
+
+		torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+
+		d := testDispatcher(Config{}, clock.NewMock(), torrent)
+
+		var peers []*peer
+		addPeer := func() {
+			p, err := d.addPeer(
+				core.PeerIDFixture(), randomBitfield(rng, numPieces, rng.Float64()), newMockMessages())
+			require.NoError(t, err)
+			peers = append(peers, p)
+		}
+		for i := 0; i < 5; i++ {
+			addPeer()
+		}
+
+		for op := 0; op < 200 && !d.Complete(); op++ {
+			i := rng.Intn(numPieces)
+			switch rng.Intn(6) {
+			case 0:
+				// Announce a piece.
+				require.NoError(t, d.dispatch(
+					peers[rng.Intn(len(peers))], conn.NewAnnouncePieceMessage(i)))
+			case 1:
+				// Receive a piece from a peer.
+				require.NoError(t, d.dispatch(peers[rng.Intn(len(peers))],
+					conn.NewPiecePayloadMessage(i, piecereader.NewBuffer(blob.Content[i:i+1]))))
+			case 2:
+				// Fetch pieces out-of-band.
+				var written []int
+				for j := 0; j < 1+rng.Intn(3); j++ {
+					k := rng.Intn(numPieces)
+					torrent.WritePiece(piecereader.NewBuffer(blob.Content[k:k+1]), k)
+					written = append(written, k)
+				}
+				d.NotifyPiecesWritten(written)
+			case 3:
+				require.NoError(t, d.dispatch(peers[rng.Intn(len(peers))], conn.NewCompleteMessage()))
+			case 4:
+				j := rng.Intn(len(peers))
+				require.NoError(t, d.removePeer(peers[j]))
+				peers = append(peers[:j], peers[j+1:]...)
+				addPeer()
+			case 5:
+				// Serve a piece, which we assume the peer received.
+				if torrent.HasPiece(i) {
+					p := peers[rng.Intn(len(peers))]
+					require.NoError(t, d.dispatch(p, conn.NewPieceRequestMessage(i, 1)))
+					waitForServes(t, p)
+				}
+			}
+			requireUsefulPiecesCached(t, d)
+		}
+		cleanup()
+	}
+}
+
+func TestUsefulPiecesCacheBudget(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(128, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	stats := tally.NewTestScope("", nil)
+
+	// 128 pieces take 16 bytes per peer, so only two peers fit.
+	d := testDispatcher(Config{UsefulPiecesCacheBytes: 40}, clock.NewMock(), torrent)
+	d.stats = stats
+
+	b := bitset.New(128).Set(3)
+	var peers []*peer
+	for i := 0; i < 3; i++ {
+		p, err := d.addPeer(core.PeerIDFixture(), b, newMockMessages())
+		require.NoError(err)
+		peers = append(peers, p)
+	}
+	require.NotNil(peers[0].useful)
+	require.NotNil(peers[1].useful)
+	require.Nil(peers[2].useful)
+	require.Equal(int64(32), d.usefulPiecesBytes.Load())
+	require.Equal(int64(1), stats.Snapshot().Counters()["uncached_useful_pieces+"].Value())
+
+	// Uncached peers still have their pieces requested.
+	_, err := d.maybeRequestMorePieces(peers[2])
+	require.NoError(err)
+	require.Equal(map[int]int{3: 1}, numRequestsPerPiece(peers[2].messages))
+
+	// Complete peers are not cached.
+	seeder, err := d.addPeer(core.PeerIDFixture(), bitset.New(128).Complement(), newMockMessages())
+	require.NoError(err)
+	require.Nil(seeder.useful)
+
+	// Completion and removal release the budget.
+	require.NoError(d.dispatch(peers[0], conn.NewCompleteMessage()))
+	require.Nil(peers[0].useful)
+	require.NoError(d.removePeer(peers[1]))
+	require.Equal(int64(0), d.usefulPiecesBytes.Load())
+}
+
+func benchmarkUsefulPieces(b *testing.B, cacheBytes int64) {
+	blob := core.SizedBlobFixture(4096, 1)
+
+	torrent, cleanup := agentstorage.TorrentFixture(blob.MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(Config{UsefulPiecesCacheBytes: cacheBytes}, clock.NewMock(), torrent)
+
+	rng := rand.New(rand.NewSource(0))
+	p, err := d.addPeer(core.PeerIDFixture(), randomBitfield(rng, 4096, 0.5), newMockMessages())
+	require.NoError(b, err)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p.requestMu.Lock()
+		d.usefulPiecesLocked(p)
+		p.requestMu.Unlock()
+	}
+}
+
+func BenchmarkUsefulPiecesCached(b *testing.B) {
+	benchmarkUsefulPieces(b, 1<<20)
+}
+
+func BenchmarkUsefulPiecesUncached(b *testing.B) {
+	benchmarkUsefulPieces(b, 1)
+}
@@ -0,0 +1,253 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"sort"
+	"sync"
+)
+
+// declineReason is why a peer was not sent any piece request when it was asked
+// for more pieces.
+type declineReason int
+
+// Decline reasons, see the piece_request_declines metric.
+const (
+	// declineAsymmetric means the peer has not sent us pieces which we requested
+	// before, see Config.AsymmetricPeerMinExpiredRequests.
+	declineAsymmetric declineReason = iota
+
+	// declineIngressThrottled means requests were deferred by the ingress limit.
+	declineIngressThrottled
+
+	// declineChoked means the peer choked us.
+	declineChoked
+
+	// declineNoCandidates means the peer has no piece we still need.
+	declineNoCandidates
+
+	// declineNoReservation means no candidate of the peer could be reserved,
+	// e.g. since the pipeline of the peer is full or the candidates are
+	// requested from other peers.
+	declineNoReservation
+
+	// declineSendFailed means sending the requests to the peer failed.
+	declineSendFailed
+
+	numDeclineReasons
+)
+
+func (r declineReason) String() string {
+	switch r {
+	case declineAsymmetric:
+		return "asymmetric"
+	case declineIngressThrottled:
+		return "ingress_throttled"
+	case declineChoked:
+		return "choked"
+	case declineNoCandidates:
+		return "no_candidates"
+	case declineNoReservation:
+		return "no_reservation"
+	case declineSendFailed:
+		return "send_failed"
+	default:
+		return "unknown"
+	}
+}
+
+// _numTopDeclineReasons bounds the decline reasons listed in Utilization.
+const _numTopDeclineReasons = 3
+
+// Utilization is how much of the request parallelism which a Dispatcher is
+// configured for it actually sustains, see Dispatcher.Utilization.
+type Utilization struct {
+	// EWMA is the moving average of the fraction of the theoretical maximum of
+	// piece requests in flight, i.e. of the pipeline limit times the number of
+	// peers, capped at the number of remaining pieces, which were in flight
+	// when sampled. Zero until sampled.
+	EWMA    float64 `json:"ewma"`
+	Samples int     `json:"samples"`
+
+	// LowSamples is the number of samples below
+	// Config.LowUtilizationThreshold. TopDeclineReasons are the reasons why
+	// peers were sent no piece requests most often while utilization was low,
+	// most frequent first.
+	LowSamples        int            `json:"low_samples"`
+	TopDeclineReasons []DeclineCount `json:"top_decline_reasons,omitempty"`
+}
+
+// DeclineCount is how often peers were sent no piece requests for Reason.
+type DeclineCount struct {
+	Reason string `json:"reason"`
+	Count  int64  `json:"count"`
+}
+
+// utilizationTracker samples the request parallelism of a Dispatcher and
+// attributes low utilization to the reasons why peers were sent no requests.
+type utilizationTracker struct {
+	weight    float64
+	threshold float64
+
+	mu          sync.Mutex // Protects the following fields:
+	ewma        float64
+	samples     int
+	lowSamples  int
+	declines    [numDeclineReasons]int64 // Since the last sample.
+	lowDeclines [numDeclineReasons]int64 // Over samples below threshold.
+}
+
+func newUtilizationTracker(weight, threshold float64) *utilizationTracker {
+	return &utilizationTracker{
+		weight:    weight,
+		threshold: threshold,
+	}
+}
+
+// decline records that a peer was sent no piece requests for reason.
+func (u *utilizationTracker) decline(reason declineReason) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.declines[reason]++
+}
+
+// sample records that inflight of max piece requests were in flight. Returns
+// the updated moving average, the declines since the last sample, and whether
+// the sample was below the threshold. max must be positive.
+func (u *utilizationTracker) sample(
+	inflight, max int) (float64, [numDeclineReasons]int64, bool) {
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	v := float64(inflight) / float64(max)
+	if v > 1 {
+		// Endgame requests pieces from several peers at once.
+		v = 1
+	}
+	if u.samples == 0 {
+		u.ewma = v
+	} else {
+		u.ewma = u.weight*v + (1-u.weight)*u.ewma
+	}
+	u.samples++
+
+	declines := u.declines
+	u.declines = [numDeclineReasons]int64{}
+	if v >= u.threshold {
+		return u.ewma, declines, false
+	}
+	u.lowSamples++
+	for r, n := range declines {
+		u.lowDeclines[r] += n
+	}
+	return u.ewma, declines, true
+}
+
+func (u *utilizationTracker) snapshot() Utilization {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	s := Utilization{
+		EWMA:       u.ewma,
+		Samples:    u.samples,
+		LowSamples: u.lowSamples,
+	}
+	for r, n := range u.lowDeclines {
+		if n > 0 {
+			s.TopDeclineReasons = append(
+				s.TopDeclineReasons, DeclineCount{declineReason(r).String(), n})
+		}
+	}
+	sort.Slice(s.TopDeclineReasons, func(i, j int) bool {
+		a, b := s.TopDeclineReasons[i], s.TopDeclineReasons[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		return a.Reason < b.Reason
+	})
+	if len(s.TopDeclineReasons) > _numTopDeclineReasons {
+		s.TopDeclineReasons = s.TopDeclineReasons[:_numTopDeclineReasons]
+	}
+	return s
+}
+
+// Utilization returns how much of its configured request parallelism d
+// sustained.
+func (d *Dispatcher) Utilization() Utilization {
+	return d.utilization.snapshot()
+}
+
+// logUtilization logs the utilization d sustained, once d completed.
+func (d *Dispatcher) logUtilization() {
+	u := d.Utilization()
+	if u.Samples == 0 {
+		return
+	}
+	d.log(
+		"utilization", u.EWMA,
+		"samples", u.Samples,
+		"low_samples", u.LowSamples,
+		"top_decline_reasons", u.TopDeclineReasons).Info("Request parallelism utilization")
+}
+
+// declinePieceRequests records that a peer was sent no piece requests for reason.
+func (d *Dispatcher) declinePieceRequests(reason declineReason) {
+	d.utilization.decline(reason)
+	d.stats.Tagged(map[string]string{
+		"reason": reason.String(),
+	}).Counter("piece_request_declines").Inc(1)
+}
+
+// maxPieceRequests returns the theoretical maximum of piece requests in flight,
+// i.e. the pipeline limit times the number of peers, capped at the number of
+// remaining pieces.
+func (d *Dispatcher) maxPieceRequests() int {
+	remaining := d.torrent.NumPieces() - int(d.torrent.Bitfield().Count())
+	max := d.config.PipelineLimit * d.NumPeers()
+	if remaining < max {
+		return remaining
+	}
+	return max
+}
+
+// sampleUtilization samples the piece requests in flight against their
+// theoretical maximum. If utilization is low, the reasons why peers were sent
+// no requests since the last sample are recorded.
+func (d *Dispatcher) sampleUtilization() {
+	if d.SeedOnly() || d.Complete() || d.draining.Load() || d.invalidating.Load() ||
+		d.paused.Load() {
+		return
+	}
+	max := d.maxPieceRequests()
+	if max <= 0 {
+		// No peers, so there is no parallelism to sustain.
+		return
+	}
+	ewma, declines, low := d.utilization.sample(d.pieceRequestManager.NumPending(), max)
+	d.stats.Gauge("parallelism_utilization").Update(ewma)
+	if !low {
+		return
+	}
+	d.stats.Counter("low_utilization_samples").Inc(1)
+	for r, n := range declines {
+		if n == 0 {
+			continue
+		}
+		d.stats.Tagged(map[string]string{
+			"reason": declineReason(r).String(),
+		}).Counter("low_utilization_declines").Inc(n)
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dispatch
+
+import (
+	"testing"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/torrent/storage/agentstorage"
+	"github.com/uber/kraken/utils/bitsetutil"
+)
+
+func TestUtilizationTrackerMath(t *testing.T) {
+	require := require.New(t)
+
+	u := newUtilizationTracker(0.5, 0.5)
+	require.Equal(Utilization{}, u.snapshot())
+
+	// The first sample seeds the average.
+	ewma, _, low := u.sample(3, 6)
+	require.Equal(0.5, ewma)
+	require.False(low)
+
+	u.decline(declineNoReservation)
+	u.decline(declineNoReservation)
+	u.decline(declineChoked)
+	ewma, declines, low := u.sample(1, 4)
+	require.Equal(0.375, ewma)
+	require.True(low)
+	require.Equal(int64(2), declines[declineNoReservation])
+	require.Equal(int64(1), declines[declineChoked])
+
+	// Declines while utilization is high are not attributed.
+	u.decline(declineSendFailed)
+	ewma, _, low = u.sample(10, 4)
+	require.Equal(0.6875, ewma, "endgame duplicates are capped at full utilization")
+	require.False(low)
+
+	require.Equal(Utilization{
+		EWMA:       0.6875,
+		Samples:    3,
+		LowSamples: 1,
+		TopDeclineReasons: []DeclineCount{
+			{"no_reservation", 2},
+			{"choked", 1},
+		},
+	}, u.snapshot())
+}
+
+func TestUtilizationTrackerListsTopDeclineReasons(t *testing.T) {
+	require := require.New(t)
+
+	u := newUtilizationTracker(0.5, 0.5)
+	for r := declineReason(0); r < numDeclineReasons; r++ {
+		for i := 0; i <= int(r); i++ {
+			u.decline(r)
+		}
+	}
+	u.sample(0, 1)
+
+	require.Equal([]DeclineCount{
+		{"send_failed", 6},
+		{"no_reservation", 5},
+		{"no_candidates", 4},
+	}, u.snapshot().TopDeclineReasons)
+}
+
+func TestDispatcherUtilizationAttributesDeclines(t *testing.T) {
+	require := require.New(t)
+
+	torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(4, 1).MetaInfo)
+	defer cleanup()
+
+	stats := tally.NewTestScope("", nil)
+	d := testDispatcher(Config{
+		PipelineLimit:           2,
+		LowUtilizationThreshold: 0.6,
+		DisableEndgame:          true,
+		DisableKeepalive:        true,
+	}, clock.NewMock(), torrent)
+	d.stats = stats
+
+	seeder, err := d.addPeer(
+		core.PeerIDFixture(), bitsetutil.FromBools(true, true, true, true), newMockMessages())
+	require.NoError(err)
+	leecher, err := d.addPeer(
+		core.PeerIDFixture(), bitsetutil.FromBools(false, false, false, false), newMockMessages())
+	require.NoError(err)
+
+	// The seeder fills its pipeline, while the leecher has nothing we need.
+	sent, err := d.maybeRequestMorePieces(seeder)
+	require.NoError(err)
+	require.True(sent)
+	for i := 0; i < 3; i++ {
+		sent, err = d.maybeRequestMorePieces(leecher)
+		require.NoError(err)
+		require.False(sent)
+	}
+	sent, err = d.maybeRequestMorePieces(seeder)
+	require.NoError(err)
+	require.False(sent)
+
+	// 2 requests in flight of at most min(2 pipeline * 2 peers, 4 pieces).
+	d.sampleUtilization()
+
+	expected := Utilization{
+		EWMA:       0.5,
+		Samples:    1,
+		LowSamples: 1,
+		TopDeclineReasons: []DeclineCount{
+			{"no_candidates", 3},
+			{"no_reservation", 1},
+		},
+	}
+	require.Equal(expected, d.Utilization())
+	require.Equal(expected, d.Dump().Utilization)
+
+	snapshot := stats.Snapshot()
+	require.Equal(0.5, snapshot.Gauges()["parallelism_utilization+"].Value())
+	counters := snapshot.Counters()
+	require.Equal(int64(3), counters["piece_request_declines+reason=no_candidates"].Value())
+	require.Equal(int64(1), counters["piece_request_declines+reason=no_reservation"].Value())
+	require.Equal(int64(1), counters["low_utilization_samples+"].Value())
+	require.Equal(int64(3), counters["low_utilization_declines+reason=no_candidates"].Value())
+
+	d.TearDown()
+	r, err := d.ExportAudit()
+	require.NoError(err)
+	require.Equal(&expected, r.Utilization)
+}
+
+func TestDispatcherUtilizationSkipsSamplesWithoutPeers(t *testing.T) {
+	require := require.New(t)
+
+	torrent, cleanup := agentstorage.TorrentFixture(core.SizedBlobFixture(2, 1).MetaInfo)
+	defer cleanup()
+
+	d := testDispatcher(Config{DisableKeepalive: true}, clock.NewMock(), torrent)
+
+	d.sampleUtilization()
+	require.Equal(Utilization{}, d.Utilization())
+}
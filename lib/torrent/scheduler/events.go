@@ -14,6 +14,7 @@
 package scheduler
 
 import (
+	"fmt"
 	"time"
 
 	"github.com/uber/kraken/core"
@@ -112,10 +113,30 @@ func (l *liftedEventLoop) DispatcherComplete(d *dispatch.Dispatcher) {
 	l.send(dispatcherCompleteEvent{d})
 }
 
+func (l *liftedEventLoop) DispatcherFailed(d *dispatch.Dispatcher, reason dispatch.TearDownReason) {
+	l.send(dispatcherFailedEvent{d, reason})
+}
+
 func (l *liftedEventLoop) PeerRemoved(peerID core.PeerID, h core.InfoHash) {
 	l.send(peerRemovedEvent{peerID, h})
 }
 
+func (l *liftedEventLoop) PeerBanned(peerID core.PeerID, h core.InfoHash) {
+	l.send(peerBannedEvent{peerID, h})
+}
+
+func (l *liftedEventLoop) PiecesUnavailable(h core.InfoHash, pieces []int) {
+	l.send(piecesUnavailableEvent{h, pieces})
+}
+
+func (l *liftedEventLoop) PiecesQuarantined(h core.InfoHash, pieces []int) {
+	l.send(piecesQuarantinedEvent{h, pieces})
+}
+
+func (l *liftedEventLoop) DispatcherStalled(d *dispatch.Dispatcher) {
+	l.send(dispatcherStalledEvent{d})
+}
+
 func (l *liftedEventLoop) AnnounceTick() {
 	l.send(announceTickEvent{})
 }
@@ -125,12 +146,10 @@ type connClosedEvent struct {
 	c *conn.Conn
 }
 
-// apply ejects the conn from the scheduler's active connections.
+// apply ejects the conn from the scheduler's active connections, if it was not
+// ejected already when its peer was removed from the dispatcher.
 func (e connClosedEvent) apply(s *state) {
-	s.conns.DeleteActive(e.c)
-	if err := s.conns.Blacklist(e.c.PeerID(), e.c.InfoHash()); err != nil {
-		s.log("conn", e.c).Infof("Cannot blacklist active conn: %s", err)
-	}
+	s.ejectConn(e.c)
 }
 
 // incomingHandshakeEvent when a handshake was received from a new connection.
@@ -157,10 +176,19 @@ func (e incomingHandshakeEvent) apply(s *state) {
 		return
 	}
 	var rb conn.RemoteBitfields
+	var hidden []int
+	var version int
+	// Until a dispatcher exists, a complete torrent is hidden entirely in
+	// superseed mode, as its dispatcher will superseed.
+	superseed := s.sched.config.Dispatch.Superseed
 	if ctrl, ok := s.torrentControls[e.pc.InfoHash()]; ok {
 		rb = ctrl.dispatcher.RemoteBitfields()
+		hidden = ctrl.dispatcher.HiddenPieces()
+		superseed = false
+		// Read before the bitfield is, see dispatch.BitfieldSnapshot.
+		version = ctrl.dispatcher.BitfieldVersion()
 	}
-	go s.sched.establishIncomingHandshake(e.pc, rb)
+	go s.sched.establishIncomingHandshake(e.pc, rb, hidden, superseed, version)
 }
 
 // failedIncomingHandshakeEvent occurs when a pending incoming connection fails
@@ -180,11 +208,16 @@ type incomingConnEvent struct {
 	c         *conn.Conn
 	bitfield  *bitset.BitSet
 	info      *storage.TorrentInfo
+	version   int // Bitfield version of info, see dispatch.BitfieldSnapshot.
 }
 
 // apply transitions a fully-handshaked incoming conn from pending to active.
 func (e incomingConnEvent) apply(s *state) {
-	if err := s.addIncomingConn(e.namespace, e.c, e.bitfield, e.info); err != nil {
+	if err := s.addIncomingConn(e.namespace, e.c, e.bitfield, e.info, e.version); err != nil {
+		if err == dispatch.ErrTooManyPeers {
+			s.rejectConnAtPeerLimit(e.c)
+			return
+		}
 		s.log("conn", e.c).Errorf("Error adding incoming conn: %s", err)
 		e.c.Close()
 		return
@@ -211,11 +244,17 @@ type outgoingConnEvent struct {
 	c        *conn.Conn
 	bitfield *bitset.BitSet
 	info     *storage.TorrentInfo
+	version  int    // Bitfield version of info, see dispatch.BitfieldSnapshot.
+	zone     string // Zone of the remote peer reported by the tracker, if known.
 }
 
 // apply transitions a fully-handshaked outgoing conn from pending to active.
 func (e outgoingConnEvent) apply(s *state) {
-	if err := s.addOutgoingConn(e.c, e.bitfield, e.info); err != nil {
+	if err := s.addOutgoingConn(e.c, e.bitfield, e.info, e.version, e.zone); err != nil {
+		if err == dispatch.ErrTooManyPeers {
+			s.rejectConnAtPeerLimit(e.c)
+			return
+		}
 		s.log("conn", e.c).Errorf("Error adding outgoing conn: %s", err)
 		e.c.Close()
 		return
@@ -268,7 +307,8 @@ type announceResultEvent struct {
 // if there is capacity. These connections are added to the scheduler's pending
 // connections and handshaked asynchronously.
 //
-// Also marks the dispatcher as ready to announce again.
+// Also marks the dispatcher as ready to announce again, and kicks it to
+// re-evaluate its piece requests.
 func (e announceResultEvent) apply(s *state) {
 	ctrl, ok := s.torrentControls[e.infoHash]
 	if !ok {
@@ -276,10 +316,17 @@ func (e announceResultEvent) apply(s *state) {
 		return
 	}
 	s.announceQueue.Ready(e.infoHash)
+	ctrl.peerZones = make(map[core.PeerID]string)
+	for _, p := range e.peers {
+		if p.Zone != "" {
+			ctrl.peerZones[p.PeerID] = p.Zone
+		}
+	}
 	if ctrl.dispatcher.Complete() {
 		// Torrent is already complete, don't open any new connections.
 		return
 	}
+	ctrl.dispatcher.Kick()
 	for _, p := range e.peers {
 		if p.PeerID == s.sched.pctx.PeerID {
 			// Tracker may return our own peer.
@@ -294,8 +341,9 @@ func (e announceResultEvent) apply(s *state) {
 			}
 			continue
 		}
+		info, version := ctrl.dispatcher.StatWithVersion()
 		go s.sched.initializeOutgoingHandshake(
-			p, ctrl.dispatcher.Stat(), ctrl.dispatcher.RemoteBitfields(), ctrl.namespace)
+			p, info, version, ctrl.dispatcher.RemoteBitfields(), ctrl.namespace)
 	}
 }
 
@@ -330,14 +378,19 @@ func (e newTorrentEvent) apply(s *state) {
 		}
 		s.log("torrent", e.torrent).Info("Added new torrent")
 	}
-	if ctrl.dispatcher.Complete() {
+	if !ctrl.complete && ctrl.dispatcher.Complete() {
+		// The DispatcherComplete event of ctrl is still being delivered. Clients
+		// do not wait for it, so its completion is applied right away.
+		dispatcherCompleteEvent{ctrl.dispatcher}.apply(s)
+	}
+	if ctrl.complete {
 		e.errc <- nil
 		return
 	}
 	ctrl.errors = append(ctrl.errors, e.errc)
 
 	// Immediately announce new torrents.
-	go s.sched.announce(ctrl.dispatcher.Digest(), ctrl.dispatcher.InfoHash(), ctrl.dispatcher.Complete())
+	go s.sched.announce(ctrl.dispatcher.Digest(), ctrl.dispatcher.InfoHash(), false)
 }
 
 // dispatcherCompleteEvent occurs when a dispatcher finishes downloading its torrent.
@@ -349,16 +402,25 @@ type dispatcherCompleteEvent struct {
 func (e dispatcherCompleteEvent) apply(s *state) {
 	infoHash := e.dispatcher.InfoHash()
 
-	s.conns.ClearBlacklist(infoHash)
-	s.announceQueue.Eject(infoHash)
 	ctrl, ok := s.torrentControls[infoHash]
-	if !ok {
-		s.log("dispatcher", e.dispatcher).Error("Completed dispatcher not found")
+	if !ok || ctrl.dispatcher != e.dispatcher {
+		// The dispatcher was removed while its completion was being delivered,
+		// and removeTorrent already answered its clients.
+		s.log("dispatcher", e.dispatcher).Info("Ignoring completion of removed dispatcher")
 		return
 	}
+	if ctrl.complete {
+		// Already applied by a newTorrentEvent.
+		return
+	}
+	s.conns.ClearBlacklist(infoHash)
+	s.announceQueue.Eject(infoHash)
+
+	ctrl.complete = true
 	for _, errc := range ctrl.errors {
 		errc <- nil
 	}
+	ctrl.errors = nil
 	if ctrl.localRequest {
 		// Normalize the download time for all torrent sizes to a per MB value.
 		// Skip torrents that are less than a MB in size because we can't measure
@@ -371,20 +433,153 @@ func (e dispatcherCompleteEvent) apply(s *state) {
 	}
 
 	s.log("hash", infoHash).Info("Torrent complete")
-	s.sched.netevents.Produce(networkevent.TorrentCompleteEvent(infoHash, s.sched.pctx.PeerID))
+	event := networkevent.TorrentCompleteEvent(infoHash, s.sched.pctx.PeerID).
+		WithPhases(ctrl.dispatcher.Phases().Millis())
+	if cause, ok := ctrl.dispatcher.EndgameCause(); ok {
+		event.WithEndgameCause(cause.String())
+	}
+	s.sched.netevents.Produce(event.At(s.sched.clock.Now()))
 
 	// Immediately announce completed torrents.
 	go s.sched.announce(ctrl.dispatcher.Digest(), ctrl.dispatcher.InfoHash(), true)
 }
 
+// dispatcherFailedEvent occurs when a dispatcher fails to download its torrent.
+type dispatcherFailedEvent struct {
+	dispatcher *dispatch.Dispatcher
+	reason     dispatch.TearDownReason
+}
+
+// apply removes the torrent of the failed dispatcher, failing its clients.
+func (e dispatcherFailedEvent) apply(s *state) {
+	infoHash := e.dispatcher.InfoHash()
+
+	ctrl, ok := s.torrentControls[infoHash]
+	if !ok || ctrl.dispatcher != e.dispatcher {
+		s.log("dispatcher", e.dispatcher).Info("Ignoring failure of removed dispatcher")
+		return
+	}
+	s.log("hash", infoHash, "reason", e.reason).Error("Torrent failed")
+	s.removeTorrent(infoHash, e.reason, failureError(e.reason))
+}
+
+// failureError returns the error sent to clients of a torrent whose download
+// failed for reason.
+func failureError(reason dispatch.TearDownReason) error {
+	switch reason {
+	case dispatch.TearDownCorruption:
+		return ErrTorrentCorrupt
+	case dispatch.TearDownDeadline:
+		return ErrTorrentDeadline
+	default:
+		return fmt.Errorf("torrent failed: %s", reason)
+	}
+}
+
 // peerRemovedEvent occurs when a dispatcher removes a peer with a closed
-// connection. Currently is a no-op.
+// connection.
 type peerRemovedEvent struct {
 	peerID   core.PeerID
 	infoHash core.InfoHash
 }
 
-func (e peerRemovedEvent) apply(s *state) {}
+// apply ejects the closed conn of the removed peer without waiting for its
+// connClosedEvent, freeing capacity for a replacement peer. If the torrent is
+// incomplete, its dispatcher is kicked to request the pieces of the removed
+// peer from the remaining peers, and unless announcing already, the torrent is
+// announced immediately to find the replacement.
+func (e peerRemovedEvent) apply(s *state) {
+	c, ok := s.conns.ActiveConn(e.peerID, e.infoHash)
+	if !ok || !c.IsClosed() {
+		// Already ejected, or replaced by a new conn of the peer.
+		return
+	}
+	s.ejectConn(c)
+
+	ctrl, ok := s.torrentControls[e.infoHash]
+	if !ok || ctrl.dispatcher.Complete() {
+		return
+	}
+	ctrl.dispatcher.Kick()
+	if !s.announceQueue.Pull(e.infoHash) {
+		return
+	}
+	s.sched.stats.Counter("peer_removed_announces").Inc(1)
+	go s.sched.announce(ctrl.dispatcher.Digest(), e.infoHash, false)
+}
+
+// peerBannedEvent occurs when a dispatcher banned a peer for sending invalid
+// pieces.
+type peerBannedEvent struct {
+	peerID   core.PeerID
+	infoHash core.InfoHash
+}
+
+// apply blacklists the banned peer, such that it is not reconnected to, and
+// kicks the dispatcher to move the pieces of the peer elsewhere.
+func (e peerBannedEvent) apply(s *state) {
+	s.sched.stats.Counter("banned_peers").Inc(1)
+	if err := s.conns.Blacklist(e.peerID, e.infoHash); err != nil {
+		s.log("peer", e.peerID, "hash", e.infoHash).Infof("Cannot blacklist banned peer: %s", err)
+	}
+	if ctrl, ok := s.torrentControls[e.infoHash]; ok && !ctrl.dispatcher.Complete() {
+		ctrl.dispatcher.Kick()
+	}
+}
+
+// piecesUnavailableEvent occurs when a dispatcher has no peer to request pieces
+// from.
+type piecesUnavailableEvent struct {
+	infoHash core.InfoHash
+	pieces   []int
+}
+
+// apply records that the swarm of a torrent cannot provide pieces.
+func (e piecesUnavailableEvent) apply(s *state) {
+	s.log("hash", e.infoHash).Infof("No peer can provide %d pieces", len(e.pieces))
+	s.sched.stats.Counter("unavailable_pieces").Inc(int64(len(e.pieces)))
+}
+
+// piecesQuarantinedEvent occurs when a dispatcher quarantined pieces which are
+// suspected to be corrupt in storage.
+type piecesQuarantinedEvent struct {
+	infoHash core.InfoHash
+	pieces   []int
+}
+
+// apply records that a torrent seeds all but the quarantined pieces.
+func (e piecesQuarantinedEvent) apply(s *state) {
+	s.log("hash", e.infoHash).Warnf("Quarantined pieces %v", e.pieces)
+	s.sched.stats.Counter("piece_quarantines").Inc(1)
+}
+
+// dispatcherStalledEvent occurs when a dispatcher made no progress for a while,
+// e.g. since none of its peers has the pieces it needs.
+type dispatcherStalledEvent struct {
+	dispatcher *dispatch.Dispatcher
+}
+
+// apply announces the torrent of the stalled dispatcher early, such that the
+// tracker may return fresh peers.
+func (e dispatcherStalledEvent) apply(s *state) {
+	infoHash := e.dispatcher.InfoHash()
+
+	ctrl, ok := s.torrentControls[infoHash]
+	if !ok || ctrl.dispatcher != e.dispatcher || ctrl.dispatcher.Complete() {
+		return
+	}
+	s.log("hash", infoHash).Info("Dispatcher stalled, announcing early")
+	s.sched.stats.Counter("dispatcher_stalls").Inc(1)
+	go s.sched.announce(ctrl.dispatcher.Digest(), infoHash, false)
+}
+
+// closeConn closes c, removing its peer from the dispatcher of ctrl for reason.
+// c is closed directly if its peer is not dispatched yet.
+func closeConn(ctrl *torrentControl, c *conn.Conn, reason dispatch.PeerRemovalReason) {
+	if err := ctrl.dispatcher.RemovePeerWithReason(c.PeerID(), reason); err != nil {
+		c.Close()
+	}
+}
 
 // preemptionTickEvent occurs periodically to preempt unneeded conns and remove
 // idle torrentControls.
@@ -405,12 +600,12 @@ func (e preemptionTickEvent) apply(s *state) {
 			ctrl.dispatcher.LastPieceSent(c.PeerID()))
 		if s.sched.clock.Now().Sub(lastProgress) > s.sched.config.ConnTTI {
 			s.log("conn", c).Info("Closing idle conn")
-			c.Close()
+			closeConn(ctrl, c, dispatch.PeerRemovalIdle)
 			continue
 		}
 		if s.sched.clock.Now().Sub(c.CreatedAt()) > s.sched.config.ConnTTL {
 			s.log("conn", c).Info("Closing expired conn")
-			c.Close()
+			closeConn(ctrl, c, dispatch.PeerRemovalExpired)
 			continue
 		}
 	}
@@ -430,9 +625,12 @@ func (e preemptionTickEvent) apply(s *state) {
 			s.sched.torrentlog.LeechTimeout(ctrl.dispatcher.Digest(), h)
 		}
 
-		if idleSeeder || idleLeecher {
-			s.log("hash", h, "inprogress", !ctrl.dispatcher.Complete()).Info("Removing idle torrent")
-			s.removeTorrent(h, ErrTorrentTimeout)
+		if idleSeeder {
+			s.log("hash", h).Info("Removing idle seeded torrent")
+			s.removeTorrent(h, dispatch.TearDownCompleted, nil)
+		} else if idleLeecher {
+			s.log("hash", h).Info("Removing idle torrent")
+			s.removeTorrent(h, dispatch.TearDownIdle, ErrTorrentTimeout)
 		}
 	}
 }
@@ -464,12 +662,75 @@ func (e removeTorrentEvent) apply(s *state) {
 			s.log(
 				"hash", h,
 				"inprogress", !ctrl.dispatcher.Complete()).Info("Removing torrent")
-			s.removeTorrent(h, ErrTorrentRemoved)
+			s.removeTorrent(h, dispatch.TearDownRemoved, ErrTorrentRemoved)
 		}
 	}
 	e.errc <- s.sched.torrentArchive.DeleteTorrent(e.digest)
 }
 
+// invalidateTorrentEvent occurs when a torrent is about to be removed via
+// scheduler API, gracefully. The result is nil if no torrent for digest is
+// active.
+type invalidateTorrentEvent struct {
+	digest core.Digest
+	result chan (<-chan struct{})
+}
+
+func (e invalidateTorrentEvent) apply(s *state) {
+	for h, ctrl := range s.torrentControls {
+		if ctrl.dispatcher.Digest() == e.digest {
+			s.log("hash", h).Info("Invalidating torrent")
+			e.result <- ctrl.dispatcher.BeginInvalidation()
+			return
+		}
+	}
+	e.result <- nil
+}
+
+// torrentProgressEvent occurs when the progress of a torrent is requested via
+// scheduler API.
+type torrentProgressEvent struct {
+	digest core.Digest
+	result chan torrentProgressResult
+}
+
+type torrentProgressResult struct {
+	progress dispatch.Progress
+	err      error
+}
+
+func (e torrentProgressEvent) apply(s *state) {
+	for _, ctrl := range s.torrentControls {
+		if ctrl.dispatcher.Digest() == e.digest {
+			e.result <- torrentProgressResult{progress: ctrl.dispatcher.Progress()}
+			return
+		}
+	}
+	e.result <- torrentProgressResult{err: ErrTorrentNotFound}
+}
+
+// torrentSnapshotEvent occurs when a debug snapshot of a torrent is requested
+// via scheduler API.
+type torrentSnapshotEvent struct {
+	digest core.Digest
+	result chan torrentSnapshotResult
+}
+
+type torrentSnapshotResult struct {
+	snapshot dispatch.Snapshot
+	err      error
+}
+
+func (e torrentSnapshotEvent) apply(s *state) {
+	for _, ctrl := range s.torrentControls {
+		if ctrl.dispatcher.Digest() == e.digest {
+			e.result <- torrentSnapshotResult{snapshot: ctrl.dispatcher.Snapshot()}
+			return
+		}
+	}
+	e.result <- torrentSnapshotResult{err: ErrTorrentNotFound}
+}
+
 // probeEvent occurs when a probe is manually requested via scheduler API.
 // The event loop is unbuffered, so if a probe can be successfully sent, then
 // the event loop is healthy.
@@ -488,7 +749,7 @@ func (e shutdownEvent) apply(s *state) {
 	}
 	// Notify local clients of pending torrents that they will not complete.
 	for _, ctrl := range s.torrentControls {
-		ctrl.dispatcher.TearDown()
+		ctrl.dispatcher.TearDownWithReason(dispatch.TearDownShutdown)
 		for _, errc := range ctrl.errors {
 			errc <- ErrSchedulerStopped
 		}
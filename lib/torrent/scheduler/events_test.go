@@ -26,8 +26,10 @@ import (
 	"github.com/uber/kraken/lib/torrent/scheduler/announcequeue"
 	"github.com/uber/kraken/lib/torrent/scheduler/conn"
 	"github.com/uber/kraken/lib/torrent/scheduler/connstate"
+	"github.com/uber/kraken/lib/torrent/scheduler/dispatch"
 	"github.com/uber/kraken/lib/torrent/storage"
 	"github.com/uber/kraken/lib/torrent/storage/agentstorage"
+	"github.com/uber/kraken/lib/torrent/storage/piecereader"
 	mockannounceclient "github.com/uber/kraken/mocks/tracker/announceclient"
 	mockmetainfoclient "github.com/uber/kraken/mocks/tracker/metainfoclient"
 	"github.com/uber/kraken/tracker/announceclient"
@@ -50,6 +52,16 @@ func (l *mockEventLoop) expect(e event) {
 	}
 }
 
+func (l *mockEventLoop) next() event {
+	select {
+	case e := <-l.c:
+		return e
+	case <-time.After(5 * time.Second):
+		l.t.Fatal("timed out waiting for event")
+		return nil
+	}
+}
+
 func (l *mockEventLoop) send(e event) bool {
 	l.c <- e
 	return true
@@ -121,6 +133,26 @@ func (m *stateMocks) newTorrent() storage.Torrent {
 	return t
 }
 
+// newCompleteTorrent creates a torrent with all pieces already written.
+func (m *stateMocks) newCompleteTorrent() storage.Torrent {
+	blob := core.SizedBlobFixture(4, 1)
+
+	m.metainfoClient.EXPECT().
+		Download(_testNamespace, blob.Digest).
+		Return(blob.MetaInfo, nil)
+
+	t, err := m.torrentArchive.CreateTorrent(_testNamespace, blob.Digest)
+	if err != nil {
+		panic(err)
+	}
+	for i := 0; i < t.NumPieces(); i++ {
+		if err := t.WritePiece(piecereader.NewBuffer(blob.Content[i:i+1]), i); err != nil {
+			panic(err)
+		}
+	}
+	return t
+}
+
 func TestAnnounceTickEvent(t *testing.T) {
 	require := require.New(t)
 
@@ -174,7 +206,7 @@ func TestAnnounceTickEventSkipsFullTorrents(t *testing.T) {
 		defer cleanup()
 
 		require.NoError(state.conns.AddPending(c.PeerID(), c.InfoHash(), nil))
-		require.NoError(state.addOutgoingConn(c, info.Bitfield(), info))
+		require.NoError(state.addOutgoingConn(c, info.Bitfield(), info, 0, ""))
 	}
 
 	empty, err := state.addTorrent(_testNamespace, mocks.newTorrent(), true)
@@ -229,3 +261,334 @@ func TestAnnounceTickEventSkipsFullTorrents(t *testing.T) {
 		infoHash: full.dispatcher.InfoHash(),
 	})
 }
+
+func TestNewTorrentEventAppliesPendingDispatcherComplete(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newStateMocks(t)
+	defer cleanup()
+
+	state := mocks.newState(Config{})
+
+	tor := mocks.newCompleteTorrent()
+
+	mocks.announceClient.EXPECT().
+		Announce(
+			tor.Digest(),
+			tor.InfoHash(),
+			true,
+			announceclient.V2).
+		Return(nil, time.Second, nil)
+
+	// The dispatcher is complete, so the client is answered and the torrent
+	// announced before the scheduler receives its completion.
+	errc := make(chan error, 1)
+	newTorrentEvent{_testNamespace, tor, errc}.apply(state)
+	require.NoError(<-errc)
+
+	ctrl := state.torrentControls[tor.InfoHash()]
+	require.True(ctrl.complete)
+	require.Empty(ctrl.errors)
+
+	// The completion is delivered concurrently with the announce result, and
+	// is applied only once.
+	var results []event
+	for i := 0; i < 2; i++ {
+		e := mocks.eventLoop.next()
+		if complete, ok := e.(dispatcherCompleteEvent); ok {
+			require.Equal(ctrl.dispatcher, complete.dispatcher)
+			complete.apply(state)
+			continue
+		}
+		results = append(results, e)
+	}
+	require.Equal([]event{announceResultEvent{infoHash: ctrl.dispatcher.InfoHash()}}, results)
+
+	// Later requests are answered immediately.
+	newTorrentEvent{_testNamespace, tor, errc}.apply(state)
+	require.NoError(<-errc)
+}
+
+func TestDispatcherCompleteEventIgnoresRemovedDispatcher(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newStateMocks(t)
+	defer cleanup()
+
+	state := mocks.newState(Config{})
+
+	tor := mocks.newCompleteTorrent()
+
+	ctrl, err := state.addTorrent(_testNamespace, tor, true)
+	require.NoError(err)
+	errc := make(chan error, 1)
+	ctrl.errors = append(ctrl.errors, errc)
+	stale := mocks.eventLoop.next()
+
+	// Removing the torrent while its completion is being delivered answers
+	// waiting clients.
+	state.removeTorrent(tor.InfoHash(), dispatch.TearDownRemoved, ErrTorrentRemoved)
+	require.NoError(<-errc)
+
+	ctrl, err = state.addTorrent(_testNamespace, tor, true)
+	require.NoError(err)
+	ctrl.errors = append(ctrl.errors, errc)
+	current := mocks.eventLoop.next()
+
+	// The completion of the removed dispatcher does not complete the new one.
+	stale.apply(state)
+	require.False(ctrl.complete)
+	require.Len(errc, 0)
+
+	mocks.announceClient.EXPECT().
+		Announce(tor.Digest(), tor.InfoHash(), true, announceclient.V2).
+		Return(nil, time.Second, nil)
+
+	current.apply(state)
+	require.True(ctrl.complete)
+	require.NoError(<-errc)
+
+	mocks.eventLoop.expect(announceResultEvent{
+		infoHash: tor.InfoHash(),
+	})
+}
+
+func TestDispatcherFailedEventFailsClients(t *testing.T) {
+	tests := []struct {
+		reason   dispatch.TearDownReason
+		expected error
+	}{
+		{dispatch.TearDownCorruption, ErrTorrentCorrupt},
+		{dispatch.TearDownDeadline, ErrTorrentDeadline},
+	}
+	for _, test := range tests {
+		t.Run(test.reason.String(), func(t *testing.T) {
+			require := require.New(t)
+
+			mocks, cleanup := newStateMocks(t)
+			defer cleanup()
+
+			state := mocks.newState(Config{})
+
+			tor := mocks.newTorrent()
+
+			ctrl, err := state.addTorrent(_testNamespace, tor, true)
+			require.NoError(err)
+			errc := make(chan error, 1)
+			ctrl.errors = append(ctrl.errors, errc)
+
+			dispatcherFailedEvent{ctrl.dispatcher, test.reason}.apply(state)
+			require.Equal(test.expected, <-errc)
+			require.NotContains(state.torrentControls, tor.InfoHash())
+
+			reason, ok := ctrl.dispatcher.FinalReason()
+			require.True(ok)
+			require.Equal(test.reason, reason)
+
+			// Failures of removed dispatchers are ignored.
+			dispatcherFailedEvent{ctrl.dispatcher, test.reason}.apply(state)
+		})
+	}
+}
+
+func TestDispatcherStalledEventAnnouncesEarly(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newStateMocks(t)
+	defer cleanup()
+
+	state := mocks.newState(Config{})
+
+	ctrl, err := state.addTorrent(_testNamespace, mocks.newTorrent(), true)
+	require.NoError(err)
+	h := ctrl.dispatcher.InfoHash()
+
+	mocks.announceClient.EXPECT().
+		Announce(ctrl.dispatcher.Digest(), h, false, announceclient.V2).
+		Return(nil, time.Second, nil)
+
+	dispatcherStalledEvent{ctrl.dispatcher}.apply(state)
+
+	mocks.eventLoop.expect(announceResultEvent{
+		infoHash: h,
+	})
+
+	// Stalls of removed dispatchers are ignored.
+	state.removeTorrent(h, dispatch.TearDownUnspecified, nil)
+	dispatcherStalledEvent{ctrl.dispatcher}.apply(state)
+}
+
+func TestPeerRemovedEventEjectsConnAndAnnouncesEarly(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newStateMocks(t)
+	defer cleanup()
+
+	state := mocks.newState(Config{
+		ConnState: connstate.Config{
+			MaxOpenConnectionsPerTorrent: 2,
+		},
+	})
+
+	ctrl, err := state.addTorrent(_testNamespace, mocks.newTorrent(), true)
+	require.NoError(err)
+	h := ctrl.dispatcher.InfoHash()
+	info := ctrl.dispatcher.Stat()
+
+	var conns []*conn.Conn
+	for i := 0; i < 2; i++ {
+		_, c, cleanup := conn.PipeFixture(conn.Config{}, info)
+		defer cleanup()
+
+		require.NoError(state.conns.AddPending(c.PeerID(), c.InfoHash(), nil))
+		require.NoError(state.addOutgoingConn(c, info.Bitfield(), info, 0, ""))
+		conns = append(conns, c)
+	}
+	require.True(state.conns.Saturated(h))
+
+	mocks.announceClient.EXPECT().
+		Announce(ctrl.dispatcher.Digest(), h, false, announceclient.V2).
+		Return(nil, time.Second, nil)
+
+	// The conn is ejected on removal of its peer, without waiting for the conn
+	// closed event, and the torrent announces right away.
+	conns[0].Close()
+	peerRemovedEvent{conns[0].PeerID(), h}.apply(state)
+
+	_, ok := state.conns.ActiveConn(conns[0].PeerID(), h)
+	require.False(ok)
+	require.True(state.conns.Blacklisted(conns[0].PeerID(), h))
+	require.False(state.conns.Saturated(h))
+
+	require.ElementsMatch([]event{
+		peerRemovedEvent{conns[0].PeerID(), h},
+		announceResultEvent{infoHash: h},
+	}, []event{mocks.eventLoop.next(), mocks.eventLoop.next()})
+
+	// The conn closed event of the ejected conn noops.
+	connClosedEvent{conns[0]}.apply(state)
+	require.True(state.conns.Blacklisted(conns[0].PeerID(), h))
+
+	// While an announce is pending, removed peers do not announce again.
+	conns[1].Close()
+	peerRemovedEvent{conns[1].PeerID(), h}.apply(state)
+	mocks.eventLoop.expect(peerRemovedEvent{conns[1].PeerID(), h})
+	require.Empty(state.conns.ActiveConns())
+}
+
+func TestPeerRemovedEventIgnoresOpenConns(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newStateMocks(t)
+	defer cleanup()
+
+	state := mocks.newState(Config{})
+
+	ctrl, err := state.addTorrent(_testNamespace, mocks.newTorrent(), true)
+	require.NoError(err)
+	info := ctrl.dispatcher.Stat()
+
+	_, c, cleanup := conn.PipeFixture(conn.Config{}, info)
+	defer cleanup()
+
+	require.NoError(state.conns.AddPending(c.PeerID(), c.InfoHash(), nil))
+	require.NoError(state.addOutgoingConn(c, info.Bitfield(), info, 0, ""))
+
+	// A stale removal of a peer whose new conn is open is ignored.
+	peerRemovedEvent{c.PeerID(), c.InfoHash()}.apply(state)
+
+	active, ok := state.conns.ActiveConn(c.PeerID(), c.InfoHash())
+	require.True(ok)
+	require.Equal(c, active)
+	require.False(state.conns.Blacklisted(c.PeerID(), c.InfoHash()))
+}
+
+func TestPeerBannedEventBlacklistsPeer(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newStateMocks(t)
+	defer cleanup()
+
+	state := mocks.newState(Config{})
+
+	peerID := core.PeerIDFixture()
+	h := core.InfoHashFixture()
+
+	peerBannedEvent{peerID, h}.apply(state)
+	require.True(state.conns.Blacklisted(peerID, h))
+
+	// Banning an already blacklisted peer is harmless.
+	peerBannedEvent{peerID, h}.apply(state)
+	require.True(state.conns.Blacklisted(peerID, h))
+}
+
+func TestRemoveCompleteTorrentTearsDownDispatcher(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newStateMocks(t)
+	defer cleanup()
+
+	state := mocks.newState(Config{})
+
+	tor := mocks.newCompleteTorrent()
+
+	ctrl, err := state.addTorrent(_testNamespace, tor, true)
+	require.NoError(err)
+	errc := make(chan error, 1)
+	ctrl.errors = append(ctrl.errors, errc)
+	mocks.eventLoop.next()
+
+	// Seeded torrents are torn down, answering clients still waiting on the
+	// completion being delivered.
+	state.removeTorrent(tor.InfoHash(), dispatch.TearDownCompleted, nil)
+	require.NoError(<-errc)
+
+	reason, ok := ctrl.dispatcher.FinalReason()
+	require.True(ok)
+	require.Equal(dispatch.TearDownCompleted, reason)
+}
+
+func TestConnsCarryZonesOfAnnouncedPeers(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newStateMocks(t)
+	defer cleanup()
+
+	state := mocks.newState(Config{})
+
+	ctrl, err := state.addTorrent(_testNamespace, mocks.newTorrent(), true)
+	require.NoError(err)
+	require.Equal(state.sched.pctx.Zone, ctrl.dispatcher.Locality())
+	info := ctrl.dispatcher.Stat()
+
+	_, incoming, cleanup := conn.PipeFixture(conn.Config{}, info)
+	defer cleanup()
+	_, outgoing, cleanup := conn.PipeFixture(conn.Config{}, info)
+	defer cleanup()
+
+	// Both peers are pending already, so no handshakes are initialized.
+	require.NoError(state.conns.AddPending(incoming.PeerID(), info.InfoHash(), nil))
+	require.NoError(state.conns.AddPending(outgoing.PeerID(), info.InfoHash(), nil))
+	announceResultEvent{
+		infoHash: info.InfoHash(),
+		peers: []*core.PeerInfo{
+			{PeerID: incoming.PeerID(), Zone: state.sched.pctx.Zone},
+			{PeerID: outgoing.PeerID(), Zone: "other"},
+		},
+	}.apply(state)
+
+	require.NoError(state.addIncomingConn(_testNamespace, incoming, info.Bitfield(), info, 0))
+	require.NoError(state.addOutgoingConn(outgoing, info.Bitfield(), info, 0, "other"))
+
+	zones := make(map[core.PeerID]string)
+	for _, p := range ctrl.dispatcher.Snapshot().Peers {
+		id, err := core.NewPeerID(p.PeerID)
+		require.NoError(err)
+		zones[id] = p.Locality
+		require.Equal(id == incoming.PeerID(), p.Local)
+	}
+	require.Equal(map[core.PeerID]string{
+		incoming.PeerID(): state.sched.pctx.Zone,
+		outgoing.PeerID(): "other",
+	}, zones)
+}
@@ -30,6 +30,7 @@ import (
 	"github.com/uber/kraken/lib/torrent/scheduler/announcer"
 	"github.com/uber/kraken/lib/torrent/scheduler/conn"
 	"github.com/uber/kraken/lib/torrent/scheduler/connstate"
+	"github.com/uber/kraken/lib/torrent/scheduler/dispatch"
 	"github.com/uber/kraken/lib/torrent/scheduler/torrentlog"
 	"github.com/uber/kraken/lib/torrent/storage"
 	"github.com/uber/kraken/tracker/announceclient"
@@ -42,6 +43,8 @@ var (
 	ErrSchedulerStopped  = errors.New("scheduler has been stopped")
 	ErrTorrentTimeout    = errors.New("torrent timed out")
 	ErrTorrentRemoved    = errors.New("torrent manually removed")
+	ErrTorrentCorrupt    = errors.New("torrent failed due to corrupt pieces")
+	ErrTorrentDeadline   = errors.New("torrent missed its download deadline")
 	ErrSendEventTimedOut = errors.New("event loop send timed out")
 )
 
@@ -51,6 +54,9 @@ type Scheduler interface {
 	Download(namespace string, d core.Digest) error
 	BlacklistSnapshot() ([]connstate.BlacklistedConn, error)
 	RemoveTorrent(d core.Digest) error
+	InvalidateTorrent(d core.Digest) error
+	TorrentProgress(d core.Digest) (dispatch.Progress, error)
+	TorrentSnapshot(d core.Digest) (dispatch.Snapshot, error)
 	Probe() error
 }
 
@@ -264,6 +270,10 @@ func (s *scheduler) Download(namespace string, d core.Digest) error {
 			errTag = "scheduler_stopped"
 		case ErrTorrentRemoved:
 			errTag = "removed"
+		case ErrTorrentCorrupt:
+			errTag = "corrupt"
+		case ErrTorrentDeadline:
+			errTag = "deadline"
 		default:
 			errTag = "unknown"
 		}
@@ -299,6 +309,53 @@ func (s *scheduler) RemoveTorrent(d core.Digest) error {
 	return <-errc
 }
 
+// InvalidateTorrent removes the torrent for d like RemoveTorrent, but first
+// waits up to Config.InvalidationTimeout for its dispatcher to finish serves in
+// flight and close its piece readers, such that peers are not failed by reads
+// of deleted files. Should be used to evict torrents from storage.
+func (s *scheduler) InvalidateTorrent(d core.Digest) error {
+	// Buffer size of 1 so sends do not block.
+	result := make(chan (<-chan struct{}), 1)
+	if !s.eventLoop.send(invalidateTorrentEvent{d, result}) {
+		return ErrSchedulerStopped
+	}
+	if invalidated := <-result; invalidated != nil {
+		select {
+		case <-invalidated:
+		case <-s.clock.After(s.config.InvalidationTimeout):
+			s.log("hash", d).Warnf(
+				"Torrent not invalidated within %s, removing regardless", s.config.InvalidationTimeout)
+			s.stats.Counter("invalidation_timeouts").Inc(1)
+		}
+	}
+	return s.RemoveTorrent(d)
+}
+
+// TorrentProgress returns the progress of the active torrent for d. Returns
+// ErrTorrentNotFound if no torrent for d is being leeched or seeded.
+func (s *scheduler) TorrentProgress(d core.Digest) (dispatch.Progress, error) {
+	// Buffer size of 1 so sends do not block.
+	result := make(chan torrentProgressResult, 1)
+	if !s.eventLoop.send(torrentProgressEvent{d, result}) {
+		return dispatch.Progress{}, ErrSchedulerStopped
+	}
+	r := <-result
+	return r.progress, r.err
+}
+
+// TorrentSnapshot returns a debug snapshot of the active torrent for d and its
+// peers. Returns ErrTorrentNotFound if no torrent for d is being leeched or
+// seeded.
+func (s *scheduler) TorrentSnapshot(d core.Digest) (dispatch.Snapshot, error) {
+	// Buffer size of 1 so sends do not block.
+	result := make(chan torrentSnapshotResult, 1)
+	if !s.eventLoop.send(torrentSnapshotEvent{d, result}) {
+		return dispatch.Snapshot{}, ErrSchedulerStopped
+	}
+	r := <-result
+	return r.snapshot, r.err
+}
+
 // Probe verifies that the scheduler event loop is running and unblocked.
 func (s *scheduler) Probe() error {
 	return s.eventLoop.sendTimeout(probeEvent{}, s.config.ProbeTimeout)
@@ -377,26 +434,43 @@ func (s *scheduler) failIncomingHandshake(pc *conn.PendingConn, err error) {
 }
 
 // establishIncomingHandshake attempts to establish a pending conn initialized
-// by a remote peer. Success / failure is communicated via events.
-func (s *scheduler) establishIncomingHandshake(pc *conn.PendingConn, rb conn.RemoteBitfields) {
+// by a remote peer. Success / failure is communicated via events. Hidden pieces
+// are excluded from the bitfield sent to the remote peer, as are all pieces of
+// complete torrents if superseed is set. version is the bitfield version of the
+// dispatcher of the torrent as of before the bitfield is read, if any.
+func (s *scheduler) establishIncomingHandshake(
+	pc *conn.PendingConn, rb conn.RemoteBitfields, hidden []int, superseed bool, version int) {
+
 	info, err := s.torrentArchive.Stat(pc.Namespace(), pc.Digest())
 	if err != nil {
 		s.failIncomingHandshake(pc, fmt.Errorf("torrent stat: %s", err))
 		return
 	}
+	if superseed && info.Bitfield().All() {
+		hidden = make([]int, info.NumPieces())
+		for i := range hidden {
+			hidden[i] = i
+		}
+	}
+	info = info.ExcludePieces(hidden...)
 	c, err := s.handshaker.Establish(pc, info, rb)
 	if err != nil {
 		s.failIncomingHandshake(pc, fmt.Errorf("establish handshake: %s", err))
 		return
 	}
 	s.torrentlog.IncomingConnectionAccept(pc.Digest(), pc.InfoHash(), pc.PeerID())
-	s.eventLoop.send(incomingConnEvent{pc.Namespace(), c, pc.Bitfield(), info})
+	s.eventLoop.send(incomingConnEvent{pc.Namespace(), c, pc.Bitfield(), info, version})
 }
 
 // initializeOutgoingHandshake attempts to initialize a conn to a remote peer.
-// Success / failure is communicated via events.
+// Success / failure is communicated via events. version is the bitfield version
+// of info, see dispatch.BitfieldSnapshot.
 func (s *scheduler) initializeOutgoingHandshake(
-	p *core.PeerInfo, info *storage.TorrentInfo, rb conn.RemoteBitfields, namespace string) {
+	p *core.PeerInfo,
+	info *storage.TorrentInfo,
+	version int,
+	rb conn.RemoteBitfields,
+	namespace string) {
 
 	addr := fmt.Sprintf("%s:%d", p.IP, p.Port)
 	result, err := s.handshaker.Initialize(p.PeerID, addr, info, rb, namespace)
@@ -410,7 +484,7 @@ func (s *scheduler) initializeOutgoingHandshake(
 		return
 	}
 	s.torrentlog.OutgoingConnectionAccept(info.Digest(), info.InfoHash(), p.PeerID)
-	s.eventLoop.send(outgoingConnEvent{result.Conn, result.Bitfield, info})
+	s.eventLoop.send(outgoingConnEvent{result.Conn, result.Bitfield, info, version, p.Zone})
 }
 
 func (s *scheduler) log(args ...interface{}) *zap.SugaredLogger {
@@ -14,6 +14,9 @@
 package scheduler
 
 import (
+	"crypto/md5"
+	"crypto/sha256"
+	"hash"
 	"os"
 	"sync"
 	"testing"
@@ -24,6 +27,7 @@ import (
 	"github.com/uber/kraken/lib/hostlist"
 	"github.com/uber/kraken/lib/torrent/networkevent"
 	"github.com/uber/kraken/lib/torrent/scheduler/announcequeue"
+	"github.com/uber/kraken/lib/torrent/storage"
 	"github.com/uber/kraken/lib/torrent/storage/piecereader"
 	"github.com/uber/kraken/tracker/announceclient"
 	"github.com/uber/kraken/utils/bitsetutil"
@@ -49,13 +53,87 @@ func TestDownloadTorrentWithSeederAndLeecher(t *testing.T) {
 	mocks.metaInfoClient.EXPECT().Download(
 		namespace, blob.Digest).Return(blob.MetaInfo, nil).Times(2)
 
-	seeder.writeTorrent(namespace, blob)
-	require.NoError(seeder.scheduler.Download(namespace, blob.Digest))
+	seeder.seed(t, namespace, blob)
 
 	require.NoError(leecher.scheduler.Download(namespace, blob.Digest))
 	leecher.checkTorrent(t, namespace, blob)
 }
 
+func TestDownloadTorrentWithPieceVerifier(t *testing.T) {
+	tests := []struct {
+		desc    string
+		newHash func() hash.Hash
+	}{
+		{"sha256", sha256.New},
+		{"md5", md5.New},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+
+			mocks, cleanup := newTestMocks(t)
+			defer cleanup()
+
+			blob := core.NewBlobFixture()
+			namespace := core.TagFixture()
+
+			// Both peers advertise and verify digests of pieces computed by the
+			// verifier, and the seeder samples its own pieces before serving them.
+			config := configFixture()
+			config.Dispatch.PieceVerifier = storage.PieceVerifierFixture(test.newHash, blob.Content)
+			config.Dispatch.ServeVerifyInterval = 1
+			config.Conn.PieceVerifier = nil
+
+			seeder := mocks.newPeer(config)
+			leecher := mocks.newPeer(config)
+
+			mocks.metaInfoClient.EXPECT().Download(
+				namespace, blob.Digest).Return(blob.MetaInfo, nil).Times(2)
+
+			seeder.seed(t, namespace, blob)
+
+			require.NoError(leecher.scheduler.Download(namespace, blob.Digest))
+			leecher.checkTorrent(t, namespace, blob)
+		})
+	}
+}
+
+func TestDownloadTorrentWithOneByteLastPiece(t *testing.T) {
+	tests := []struct {
+		desc      string
+		chunkSize int64
+	}{
+		{"streaming", 0},
+		{"chunked", 2},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+
+			mocks, cleanup := newTestMocks(t)
+			defer cleanup()
+
+			config := configFixture()
+			config.Dispatch.ChunkSize = test.chunkSize
+
+			seeder := mocks.newPeer(config)
+			leecher := mocks.newPeer(config)
+
+			// Eight pieces of 4 bytes and a final piece of 1 byte.
+			blob := core.SizedBlobFixture(33, 4)
+			namespace := core.TagFixture()
+
+			mocks.metaInfoClient.EXPECT().Download(
+				namespace, blob.Digest).Return(blob.MetaInfo, nil).Times(2)
+
+			seeder.seed(t, namespace, blob)
+
+			require.NoError(leecher.scheduler.Download(namespace, blob.Digest))
+			leecher.checkTorrent(t, namespace, blob)
+		})
+	}
+}
+
 func TestDownloadManyTorrentsWithSeederAndLeecher(t *testing.T) {
 	require := require.New(t)
 
@@ -79,8 +157,7 @@ func TestDownloadManyTorrentsWithSeederAndLeecher(t *testing.T) {
 		go func() {
 			defer wg.Done()
 
-			seeder.writeTorrent(namespace, blob)
-			require.NoError(seeder.scheduler.Download(namespace, blob.Digest))
+			seeder.seed(t, namespace, blob)
 
 			require.NoError(leecher.scheduler.Download(namespace, blob.Digest))
 			leecher.checkTorrent(t, namespace, blob)
@@ -110,8 +187,7 @@ func TestDownloadManyTorrentsWithSeederAndManyLeechers(t *testing.T) {
 		mocks.metaInfoClient.EXPECT().Download(
 			namespace, blob.Digest).Return(blob.MetaInfo, nil).Times(6)
 
-		seeder.writeTorrent(namespace, blob)
-		require.NoError(seeder.scheduler.Download(namespace, blob.Digest))
+		seeder.seed(t, namespace, blob)
 	}
 
 	var wg sync.WaitGroup
@@ -187,8 +263,7 @@ func TestSeederTTI(t *testing.T) {
 	w := newEventWatcher()
 
 	seeder := mocks.newPeer(config, withEventLoop(w), withClock(clk))
-	seeder.writeTorrent(namespace, blob)
-	require.NoError(seeder.scheduler.Download(namespace, blob.Digest))
+	seeder.seed(t, namespace, blob)
 
 	leecher := mocks.newPeer(config, withClock(clk))
 
@@ -268,8 +343,7 @@ func TestMultipleDownloadsForSameTorrentSucceed(t *testing.T) {
 	config := configFixture()
 
 	seeder := mocks.newPeer(config)
-	seeder.writeTorrent(namespace, blob)
-	require.NoError(seeder.scheduler.Download(namespace, blob.Digest))
+	seeder.seed(t, namespace, blob)
 
 	leecher := mocks.newPeer(config)
 
@@ -324,8 +398,7 @@ func TestNetworkEvents(t *testing.T) {
 	mocks.metaInfoClient.EXPECT().Download(
 		namespace, blob.Digest).Return(blob.MetaInfo, nil).Times(2)
 
-	seeder.writeTorrent(namespace, blob)
-	require.NoError(seeder.scheduler.Download(namespace, blob.Digest))
+	seeder.seed(t, namespace, blob)
 
 	require.NoError(leecher.scheduler.Download(namespace, blob.Digest))
 	leecher.checkTorrent(t, namespace, blob)
@@ -348,9 +421,10 @@ func TestNetworkEvents(t *testing.T) {
 	leecherExpected := []*networkevent.Event{
 		networkevent.AddTorrentEvent(h, lid, bitsetutil.FromBools(false), config.ConnState.MaxOpenConnectionsPerTorrent),
 		networkevent.AddActiveConnEvent(h, lid, sid),
-		networkevent.RequestPieceEvent(h, lid, sid, 0),
+		networkevent.RequestPieceEvent(h, lid, sid, 0, 1),
 		networkevent.ReceivePieceEvent(h, lid, sid, 0),
-		networkevent.TorrentCompleteEvent(h, lid),
+		// The only piece is in endgame from the start, and the seeder has it.
+		networkevent.TorrentCompleteEvent(h, lid).WithEndgameCause("slow_tail"),
 		networkevent.DropActiveConnEvent(h, lid, sid),
 		networkevent.BlacklistConnEvent(h, lid, sid, config.ConnState.BlacklistDuration),
 	}
@@ -412,8 +486,7 @@ func TestSchedulerReload(t *testing.T) {
 		mocks.metaInfoClient.EXPECT().Download(
 			namespace, blob.Digest).Return(blob.MetaInfo, nil).Times(2)
 
-		seeder.writeTorrent(namespace, blob)
-		require.NoError(seeder.scheduler.Download(namespace, blob.Digest))
+		seeder.seed(t, namespace, blob)
 
 		require.NoError(leecher.scheduler.Download(namespace, blob.Digest))
 		leecher.checkTorrent(t, namespace, blob)
@@ -458,6 +531,80 @@ func TestSchedulerRemoveTorrent(t *testing.T) {
 	require.True(os.IsNotExist(err))
 }
 
+func TestSchedulerInvalidateTorrent(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newTestMocks(t)
+	defer cleanup()
+
+	seeder := mocks.newPeer(configFixture())
+
+	blob := core.NewBlobFixture()
+	namespace := core.TagFixture()
+
+	mocks.metaInfoClient.EXPECT().Download(namespace, blob.Digest).Return(blob.MetaInfo, nil)
+
+	seeder.seed(t, namespace, blob)
+
+	require.NoError(seeder.scheduler.InvalidateTorrent(blob.Digest))
+
+	_, err := seeder.scheduler.TorrentSnapshot(blob.Digest)
+	require.Equal(ErrTorrentNotFound, err)
+	_, err = seeder.torrentArchive.Stat(namespace, blob.Digest)
+	require.True(os.IsNotExist(err))
+}
+
+func TestSchedulerTorrentProgress(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newTestMocks(t)
+	defer cleanup()
+
+	seeder := mocks.newPeer(configFixture())
+
+	blob := core.NewBlobFixture()
+	namespace := core.TagFixture()
+
+	_, err := seeder.scheduler.TorrentProgress(blob.Digest)
+	require.Equal(ErrTorrentNotFound, err)
+
+	mocks.metaInfoClient.EXPECT().Download(namespace, blob.Digest).Return(blob.MetaInfo, nil)
+
+	seeder.seed(t, namespace, blob)
+
+	progress, err := seeder.scheduler.TorrentProgress(blob.Digest)
+	require.NoError(err)
+	require.Equal(blob.MetaInfo.NumPieces(), progress.PiecesCompleted)
+	require.Equal(blob.MetaInfo.NumPieces(), progress.NumPieces)
+	require.Equal(blob.MetaInfo.Length(), progress.Length)
+	require.Equal(progress.Length, progress.BytesCompleted)
+}
+
+func TestSchedulerTorrentSnapshot(t *testing.T) {
+	require := require.New(t)
+
+	mocks, cleanup := newTestMocks(t)
+	defer cleanup()
+
+	seeder := mocks.newPeer(configFixture())
+
+	blob := core.NewBlobFixture()
+	namespace := core.TagFixture()
+
+	_, err := seeder.scheduler.TorrentSnapshot(blob.Digest)
+	require.Equal(ErrTorrentNotFound, err)
+
+	mocks.metaInfoClient.EXPECT().Download(namespace, blob.Digest).Return(blob.MetaInfo, nil)
+
+	seeder.seed(t, namespace, blob)
+
+	snapshot, err := seeder.scheduler.TorrentSnapshot(blob.Digest)
+	require.NoError(err)
+	require.Equal(blob.Digest.Hex(), snapshot.Name)
+	require.Equal(blob.MetaInfo.NumPieces(), snapshot.NumComplete)
+	require.Empty(snapshot.Peers)
+}
+
 func TestSchedulerProbe(t *testing.T) {
 	require := require.New(t)
 
@@ -35,6 +35,15 @@ type torrentControl struct {
 	dispatcher   *dispatch.Dispatcher
 	errors       []chan error
 	localRequest bool
+
+	// complete is set once the DispatcherComplete event of dispatcher has been
+	// applied. Dispatchers deliver events serially, so unlike
+	// dispatcher.Complete(), complete is consistent with the events applied so far.
+	complete bool
+
+	// peerZones are the zones of the peers returned by the latest announce, by
+	// which the zones of incoming conns are looked up.
+	peerZones map[core.PeerID]string
 }
 
 // state is a superset of scheduler, which includes protected state which can
@@ -78,7 +87,8 @@ func (s *state) addTorrent(
 		s.sched.pctx.PeerID,
 		t,
 		s.sched.logger,
-		s.sched.torrentlog)
+		s.sched.torrentlog,
+		dispatch.WithLocality(s.sched.pctx.Zone))
 	if err != nil {
 		return nil, fmt.Errorf("new dispatcher: %s", err)
 	}
@@ -92,33 +102,47 @@ func (s *state) addTorrent(
 		t.InfoHash(),
 		s.sched.pctx.PeerID,
 		t.Bitfield(),
-		s.sched.config.ConnState.MaxOpenConnectionsPerTorrent))
+		s.sched.config.ConnState.MaxOpenConnectionsPerTorrent).At(s.sched.clock.Now()))
 	s.torrentControls[t.InfoHash()] = ctrl
 	return ctrl, nil
 }
 
-// removeTorrent tears down the torrentControl associated with h, sending err to
-// all clients waiting on this torrent.
-func (s *state) removeTorrent(h core.InfoHash, err error) {
+// removeTorrent tears down the torrentControl associated with h for reason,
+// sending err to all clients waiting on this torrent.
+func (s *state) removeTorrent(h core.InfoHash, reason dispatch.TearDownReason, err error) {
 	ctrl, ok := s.torrentControls[h]
 	if !ok {
 		return
 	}
 	if !ctrl.dispatcher.Complete() {
-		ctrl.dispatcher.TearDown()
+		ctrl.dispatcher.TearDownWithReason(reason)
 		s.announceQueue.Eject(h)
 		for _, errc := range ctrl.errors {
 			errc <- err
 		}
-		s.sched.netevents.Produce(networkevent.TorrentCancelledEvent(h, s.sched.pctx.PeerID))
+		s.sched.netevents.Produce(
+			networkevent.TorrentCancelledEvent(h, s.sched.pctx.PeerID).At(s.sched.clock.Now()))
 		s.sched.torrentArchive.DeleteTorrent(ctrl.dispatcher.Digest())
+	} else {
+		ctrl.dispatcher.TearDownWithReason(reason)
+		if !ctrl.complete {
+			// The DispatcherComplete event of ctrl is still being delivered, and
+			// will be ignored once ctrl is removed.
+			for _, errc := range ctrl.errors {
+				errc <- nil
+			}
+		}
 	}
 	delete(s.torrentControls, h)
 }
 
 // addOutgoingConn adds a conn, initialized by us, to state. The conn must already
 // be in a pending state, and the torrent control must already be initialized.
-func (s *state) addOutgoingConn(c *conn.Conn, b *bitset.BitSet, info *storage.TorrentInfo) error {
+// info was sent at handshake, as of bitfield version. zone is the zone of the
+// remote peer, if known.
+func (s *state) addOutgoingConn(
+	c *conn.Conn, b *bitset.BitSet, info *storage.TorrentInfo, version int, zone string) error {
+
 	if err := s.conns.MovePendingToActive(c); err != nil {
 		return fmt.Errorf("move pending to active: %s", err)
 	}
@@ -127,7 +151,12 @@ func (s *state) addOutgoingConn(c *conn.Conn, b *bitset.BitSet, info *storage.To
 	if !ok {
 		return errors.New("torrent controls must be created before sending handshake")
 	}
-	if err := ctrl.dispatcher.AddPeer(c.PeerID(), b, c); err != nil {
+	snapshot := dispatch.BitfieldSnapshot{Bitfield: info.Bitfield(), Version: version}
+	if err := ctrl.dispatcher.AddPeerSince(
+		c.PeerID(), b, c, snapshot, dispatch.WithPeerLocality(zone)); err != nil {
+		if err == dispatch.ErrTooManyPeers {
+			return err
+		}
 		return fmt.Errorf("add conn to dispatcher: %s", err)
 	}
 	return nil
@@ -135,9 +164,13 @@ func (s *state) addOutgoingConn(c *conn.Conn, b *bitset.BitSet, info *storage.To
 
 // addIncomingConn adds a conn, initialized by a remote peer, to state. The conn
 // must already be in a pending state. Initializes a torrent control if not
-// present.
+// present. info was sent at handshake, as of bitfield version.
 func (s *state) addIncomingConn(
-	namespace string, c *conn.Conn, b *bitset.BitSet, info *storage.TorrentInfo) error {
+	namespace string,
+	c *conn.Conn,
+	b *bitset.BitSet,
+	info *storage.TorrentInfo,
+	version int) error {
 
 	if err := s.conns.MovePendingToActive(c); err != nil {
 		return fmt.Errorf("move pending to active: %s", err)
@@ -154,12 +187,42 @@ func (s *state) addIncomingConn(
 			return err
 		}
 	}
-	if err := ctrl.dispatcher.AddPeer(c.PeerID(), b, c); err != nil {
+	// The zone of the remote peer is only known if it was announced recently.
+	snapshot := dispatch.BitfieldSnapshot{Bitfield: info.Bitfield(), Version: version}
+	if err := ctrl.dispatcher.AddPeerSince(
+		c.PeerID(), b, c, snapshot, dispatch.WithPeerLocality(ctrl.peerZones[c.PeerID()])); err != nil {
+		if err == dispatch.ErrTooManyPeers {
+			return err
+		}
 		return fmt.Errorf("add conn to dispatcher: %s", err)
 	}
 	return nil
 }
 
+// rejectConnAtPeerLimit closes c, which the dispatcher of its torrent rejected
+// since it is at its peer limit. This is expected for popular torrents rather
+// than an error. c is blacklisted once it closes, such that we do not connect
+// to the same peer again right away.
+func (s *state) rejectConnAtPeerLimit(c *conn.Conn) {
+	s.log("conn", c).Info("Rejecting conn: dispatcher is at its peer limit")
+	s.sched.stats.Counter("conns_rejected_at_peer_limit").Inc(1)
+	c.Close()
+}
+
+// ejectConn deletes the closed conn c from the active connections and
+// blacklists it, such that we do not connect to the same peer again right away.
+// Noops for the blacklist if c was already blacklisted, e.g. since c was ejected
+// before.
+func (s *state) ejectConn(c *conn.Conn) {
+	s.conns.DeleteActive(c)
+	if s.conns.Blacklisted(c.PeerID(), c.InfoHash()) {
+		return
+	}
+	if err := s.conns.Blacklist(c.PeerID(), c.InfoHash()); err != nil {
+		s.log("conn", c).Infof("Cannot blacklist active conn: %s", err)
+	}
+}
+
 func (s *state) log(args ...interface{}) *zap.SugaredLogger {
 	return s.sched.log(args...)
 }
@@ -20,6 +20,7 @@ import (
 	"os"
 	"reflect"
 	"strconv"
+	"sync"
 	"testing"
 	"time"
 
@@ -112,9 +113,41 @@ type testPeer struct {
 	stats          tally.TestScope
 	testProducer   *networkevent.TestProducer
 	cads           *store.CADownloadStore
+	announces      *announceRecorder
 	cleanup        *testutil.Cleanup
 }
 
+// announceRecorder records the torrents which were announced as complete.
+type announceRecorder struct {
+	announceclient.Client
+
+	mu       sync.Mutex
+	complete map[core.InfoHash]bool
+}
+
+func newAnnounceRecorder(c announceclient.Client) *announceRecorder {
+	return &announceRecorder{Client: c, complete: make(map[core.InfoHash]bool)}
+}
+
+func (r *announceRecorder) Announce(
+	d core.Digest, h core.InfoHash, complete bool, version int) ([]*core.PeerInfo, time.Duration, error) {
+
+	peers, interval, err := r.Client.Announce(d, h, complete, version)
+	if err == nil && complete {
+		r.mu.Lock()
+		r.complete[h] = true
+		r.mu.Unlock()
+	}
+	return peers, interval, err
+}
+
+func (r *announceRecorder) announcedComplete(h core.InfoHash) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.complete[h]
+}
+
 func (m *testMocks) newPeer(config Config, options ...option) *testPeer {
 	var cleanup testutil.Cleanup
 	m.cleanup.Add(cleanup.Run)
@@ -132,7 +165,8 @@ func (m *testMocks) newPeer(config Config, options ...option) *testPeer {
 		IP:     "localhost",
 		Port:   findFreePort(),
 	}
-	ac := announceclient.New(pctx, hashring.NoopPassiveRing(hostlist.Fixture(m.trackerAddr)), nil)
+	ac := newAnnounceRecorder(
+		announceclient.New(pctx, hashring.NoopPassiveRing(hostlist.Fixture(m.trackerAddr)), nil))
 	tp := networkevent.NewTestProducer()
 
 	s, err := newScheduler(config, ta, stats, pctx, ac, tp, options...)
@@ -144,7 +178,7 @@ func (m *testMocks) newPeer(config Config, options ...option) *testPeer {
 	}
 	cleanup.Add(s.Stop)
 
-	return &testPeer{pctx, s, ta, stats, tp, cads, &cleanup}
+	return &testPeer{pctx, s, ta, stats, tp, cads, ac, &cleanup}
 }
 
 func (m *testMocks) newPeers(n int, config Config) []*testPeer {
@@ -171,6 +205,21 @@ func (p *testPeer) writeTorrent(namespace string, blob *core.BlobFixture) {
 	}
 }
 
+// seed writes blob into the storage of p and seeds it. Since seeders announce
+// asynchronously, seed waits for the tracker to know p as seeder, such that
+// leechers find p on their first announce.
+func (p *testPeer) seed(t *testing.T, namespace string, blob *core.BlobFixture) {
+	p.writeTorrent(namespace, blob)
+	require.NoError(t, p.scheduler.Download(namespace, blob.Digest))
+
+	h := blob.MetaInfo.InfoHash()
+	if err := testutil.PollUntilTrue(5*time.Second, func() bool {
+		return p.announces.announcedComplete(h)
+	}); err != nil {
+		t.Fatalf("scheduler=%s did not announce hash=%s: %s", p.pctx.PeerID, h, err)
+	}
+}
+
 func (p *testPeer) checkTorrent(t *testing.T, namespace string, blob *core.BlobFixture) {
 	require := require.New(t)
 
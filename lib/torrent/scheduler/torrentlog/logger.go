@@ -226,6 +226,10 @@ type LeecherSummary struct {
 	PeerID           core.PeerID
 	RequestsReceived int
 	PiecesSent       int
+
+	// Approximate ratio of piece payload bytes to total bytes sent to the peer.
+	// Zero if unknown.
+	WireEfficiency float64
 }
 
 // MarshalLogObject marshals a LeecherSummary for logging.
@@ -233,6 +237,7 @@ func (s LeecherSummary) MarshalLogObject(enc zapcore.ObjectEncoder) error {
 	enc.AddString("peer_id", s.PeerID.String())
 	enc.AddInt("requests_received", s.RequestsReceived)
 	enc.AddInt("pieces_sent", s.PiecesSent)
+	enc.AddFloat64("wire_efficiency", s.WireEfficiency)
 	return nil
 }
 
@@ -0,0 +1,211 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// Package wire is the compatibility layer between the dispatcher and the p2p
+// protocol. Fields and messages added by protocol extensions are only read and
+// written if the extension was negotiated with the peer, and messages which
+// lack their body are reported as absent rather than dereferenced, such that
+// the dispatcher degrades gracefully with peers of any version.
+package wire
+
+import (
+	"time"
+
+	"github.com/uber/kraken/gen/go/proto/p2p"
+	"github.com/uber/kraken/lib/torrent/scheduler/conn"
+	"github.com/uber/kraken/lib/torrent/storage"
+)
+
+// Capabilities reports the capabilities negotiated with a peer, e.g. a
+// conn.Conn.
+type Capabilities interface {
+	Supports(conn.Capability) bool
+}
+
+// PieceRequest returns the piece request of msg, see Request. Returns false if
+// msg has no piece request.
+func PieceRequest(c Capabilities, msg *p2p.Message) (*p2p.PieceRequestMessage, bool) {
+	return Request(c, msg.GetPieceRequest())
+}
+
+// Request returns r as received from a peer with capabilities c: priority is
+// cleared unless conn.PriorityRequests was negotiated. Returns false if r is
+// nil.
+func Request(c Capabilities, r *p2p.PieceRequestMessage) (*p2p.PieceRequestMessage, bool) {
+	if r == nil {
+		return nil, false
+	}
+	if r.Priority && !c.Supports(conn.PriorityRequests) {
+		return &p2p.PieceRequestMessage{Index: r.Index, Offset: r.Offset, Length: r.Length}, true
+	}
+	return r, true
+}
+
+// PieceRequests returns the batched requests of msg, whose entries are read with
+// Request. Returns false if conn.BatchRequests was not negotiated, or msg has no
+// batch.
+func PieceRequests(c Capabilities, msg *p2p.Message) ([]*p2p.PieceRequestMessage, bool) {
+	if !c.Supports(conn.BatchRequests) || msg.GetPieceRequests() == nil {
+		return nil, false
+	}
+	return msg.PieceRequests.Requests, true
+}
+
+// PiecePayload returns the piece payload of msg. Returns false if msg has no
+// piece payload.
+func PiecePayload(msg *p2p.Message) (*p2p.PiecePayloadMessage, bool) {
+	pm := msg.GetPiecePayload()
+	return pm, pm != nil
+}
+
+// Codec returns the codec which the blob following pm is compressed with.
+// Returns false if the codec was not negotiated, in which case the blob cannot
+// be read.
+func Codec(c Capabilities, pm *p2p.PiecePayloadMessage) (p2p.PiecePayloadMessage_Codec, bool) {
+	if pm.Codec == p2p.PiecePayloadMessage_NONE {
+		return pm.Codec, true
+	}
+	capability, ok := conn.CodecCapability(pm.Codec)
+	if !ok || !c.Supports(capability) {
+		return pm.Codec, false
+	}
+	return pm.Codec, true
+}
+
+// Chunk returns the range of the piece which the blob following pm covers, once
+// uncompressed. Returns false if the range is malformed, i.e. offset or length
+// is negative.
+func Chunk(pm *p2p.PiecePayloadMessage) (offset, length int64, ok bool) {
+	offset, length = int64(pm.Offset), int64(pm.Length)
+	return offset, length, offset >= 0 && length >= 0
+}
+
+// Compression returns the codec which the blob following pm is compressed with,
+// and how many bytes compression saved. Returns false if pm is not compressed,
+// or its codec was not negotiated with c.
+func Compression(c Capabilities, pm *p2p.PiecePayloadMessage) (
+	codec p2p.PiecePayloadMessage_Codec, saved int64, ok bool) {
+
+	if codec, ok = Codec(c, pm); !ok || codec == p2p.PiecePayloadMessage_NONE {
+		return codec, 0, false
+	}
+	return codec, int64(pm.Length - pm.WireLength), true
+}
+
+// AnnouncePiece returns the index of the piece announced by msg. Returns false
+// if msg has no announcement.
+func AnnouncePiece(msg *p2p.Message) (int, bool) {
+	a := msg.GetAnnouncePiece()
+	if a == nil {
+		return 0, false
+	}
+	return int(a.Index), true
+}
+
+// AnnouncePieces returns the bitfield of the pieces announced by msg. Returns
+// false if conn.AnnouncePieces was not negotiated, or msg has no announcement.
+func AnnouncePieces(c Capabilities, msg *p2p.Message) ([]byte, bool) {
+	if !c.Supports(conn.AnnouncePieces) || msg.GetAnnouncePieces() == nil {
+		return nil, false
+	}
+	return msg.AnnouncePieces.BitfieldBytes, true
+}
+
+// CancelPiece returns the index of the piece cancelled by msg. Returns false if
+// msg has no cancellation.
+func CancelPiece(msg *p2p.Message) (int, bool) {
+	cm := msg.GetCancelPiece()
+	if cm == nil {
+		return 0, false
+	}
+	return int(cm.Index), true
+}
+
+// Error returns the error of msg. Returns false if msg has no error.
+func Error(msg *p2p.Message) (*p2p.ErrorMessage, bool) {
+	e := msg.GetError()
+	return e, e != nil
+}
+
+// RetryAfter returns how long the sender of e asked us to wait before requesting
+// the piece of e again. Returns false if the sender gave no hint, or
+// conn.RetryAfter was not negotiated.
+func RetryAfter(c Capabilities, e *p2p.ErrorMessage) (time.Duration, bool) {
+	if e.Code != p2p.ErrorMessage_PIECE_REQUEST_RETRY ||
+		e.RetryAfterMillis <= 0 || !c.Supports(conn.RetryAfter) {
+		return 0, false
+	}
+	return time.Duration(e.RetryAfterMillis) * time.Millisecond, true
+}
+
+// NewPieceRequestMessage returns a Message requesting length bytes at offset of
+// piece index from a peer with capabilities c. The request is only marked as
+// priority if conn.PriorityRequests was negotiated.
+func NewPieceRequestMessage(
+	c Capabilities, index int, offset, length int64, priority bool) *conn.Message {
+
+	if priority && c.Supports(conn.PriorityRequests) {
+		return conn.NewPriorityPieceChunkRequestMessage(index, offset, length)
+	}
+	return conn.NewPieceChunkRequestMessage(index, offset, length)
+}
+
+// NegotiatedCodec returns the codec which payloads sent to a peer with
+// capabilities c are compressed with. Returns false if no codec was negotiated.
+func NegotiatedCodec(c Capabilities) (p2p.PiecePayloadMessage_Codec, bool) {
+	codec := conn.NegotiatedCodec(c)
+	return codec, codec != p2p.PiecePayloadMessage_NONE
+}
+
+// NewPiecePayloadMessage returns a Message for sending the chunk pr of piece
+// index starting at offset to a peer with capabilities c. If compress is set,
+// the chunk is compressed with the codec negotiated with c, if any. pr is closed
+// once sent, or on error.
+func NewPiecePayloadMessage(
+	c Capabilities, index int, offset int64, pr storage.PieceReader, compress bool) (*conn.Message, error) {
+
+	codec, ok := NegotiatedCodec(c)
+	if !compress || !ok {
+		return conn.NewPieceChunkPayloadMessage(index, offset, pr), nil
+	}
+	return conn.NewCompressedPieceChunkPayloadMessage(index, offset, pr, codec)
+}
+
+// NewPieceRequestsMessage returns a Message batching requests, which are piece
+// request Messages, for a peer with capabilities c. Returns false if
+// conn.BatchRequests was not negotiated, in which case requests must be sent
+// one by one.
+func NewPieceRequestsMessage(c Capabilities, requests []*conn.Message) (*conn.Message, bool) {
+	if !c.Supports(conn.BatchRequests) {
+		return nil, false
+	}
+	batch := make([]*p2p.PieceRequestMessage, 0, len(requests))
+	for _, msg := range requests {
+		if r := msg.Message.GetPieceRequest(); r != nil {
+			batch = append(batch, r)
+		}
+	}
+	return conn.NewPieceRequestsMessage(batch), true
+}
+
+// NewRetryErrorMessage returns a Message rejecting the request of piece index
+// of a peer with capabilities c transiently. The retryAfter hint is dropped
+// unless conn.RetryAfter was negotiated.
+func NewRetryErrorMessage(
+	c Capabilities, index int, err error, retryAfter time.Duration) *conn.Message {
+
+	if !c.Supports(conn.RetryAfter) {
+		retryAfter = 0
+	}
+	return conn.NewRetryErrorMessage(index, err, retryAfter)
+}
@@ -0,0 +1,325 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package wire
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+
+	"github.com/uber/kraken/gen/go/proto/p2p"
+	"github.com/uber/kraken/lib/torrent/scheduler/conn"
+	"github.com/uber/kraken/lib/torrent/storage/piecereader"
+)
+
+// capabilities are the capabilities negotiated with a test peer.
+type capabilities map[conn.Capability]bool
+
+func (c capabilities) Supports(capability conn.Capability) bool {
+	return c[capability]
+}
+
+// Peers of the version which predates all extensions negotiate none, and peers
+// of this version negotiate all.
+var (
+	_old = capabilities{}
+	_new = func() capabilities {
+		c := capabilities{}
+		for _, capability := range conn.KnownCapabilities() {
+			c[capability] = true
+		}
+		return c
+	}()
+)
+
+// roundTrip encodes and decodes msg, as if it was sent to a peer.
+func roundTrip(t *testing.T, msg *p2p.Message) *p2p.Message {
+	b, err := proto.Marshal(msg)
+	require.NoError(t, err)
+	decoded := &p2p.Message{}
+	require.NoError(t, proto.Unmarshal(b, decoded))
+	return decoded
+}
+
+// strip returns msg without the fields and messages added by extensions, i.e.
+// msg as encoded or decoded by a peer which predates all extensions.
+func strip(msg *p2p.Message) *p2p.Message {
+	s := proto.Clone(msg).(*p2p.Message)
+	s.AnnouncePieces = nil
+	s.PieceRequests = nil
+	if s.PieceRequest != nil {
+		s.PieceRequest.Priority = false
+	}
+	if s.PiecePayload != nil {
+		s.PiecePayload.Codec = p2p.PiecePayloadMessage_NONE
+		s.PiecePayload.WireLength = 0
+	}
+	if s.Error != nil {
+		s.Error.RetryAfterMillis = 0
+	}
+	return s
+}
+
+type request struct {
+	index, offset, length int
+	priority              bool
+}
+
+type payload struct {
+	index, offset, length int
+	codec                 p2p.PiecePayloadMessage_Codec
+	readable, compressed  bool
+}
+
+type errorView struct {
+	index      int
+	code       p2p.ErrorMessage_ErrorCode
+	retryAfter time.Duration
+}
+
+// read reads msg received from a peer with capabilities c like the dispatcher.
+// Returns nil if msg is unreadable.
+func read(c Capabilities, msg *p2p.Message) interface{} {
+	switch msg.Type {
+	case p2p.Message_PIECE_REQUEST:
+		r, ok := PieceRequest(c, msg)
+		if !ok {
+			return nil
+		}
+		return request{int(r.Index), int(r.Offset), int(r.Length), r.Priority}
+	case p2p.Message_PIECE_REQUESTS:
+		requests, ok := PieceRequests(c, msg)
+		if !ok {
+			return nil
+		}
+		var rs []request
+		for _, r := range requests {
+			if r, ok := Request(c, r); ok {
+				rs = append(rs, request{int(r.Index), int(r.Offset), int(r.Length), r.Priority})
+			}
+		}
+		return rs
+	case p2p.Message_PIECE_PAYLOAD:
+		pm, ok := PiecePayload(msg)
+		if !ok {
+			return nil
+		}
+		offset, length, ok := Chunk(pm)
+		if !ok {
+			return nil
+		}
+		codec, readable := Codec(c, pm)
+		_, _, compressed := Compression(c, pm)
+		return payload{int(pm.Index), int(offset), int(length), codec, readable, compressed}
+	case p2p.Message_ERROR:
+		e, ok := Error(msg)
+		if !ok {
+			return nil
+		}
+		retryAfter, _ := RetryAfter(c, e)
+		return errorView{int(e.Index), e.Code, retryAfter}
+	case p2p.Message_ANNOUCE_PIECE:
+		i, ok := AnnouncePiece(msg)
+		if !ok {
+			return nil
+		}
+		return i
+	case p2p.Message_ANNOUNCE_PIECES:
+		b, ok := AnnouncePieces(c, msg)
+		if !ok {
+			return nil
+		}
+		return b
+	case p2p.Message_CANCEL_PIECE:
+		i, ok := CancelPiece(msg)
+		if !ok {
+			return nil
+		}
+		return i
+	}
+	panic("unexpected message type " + msg.Type.String())
+}
+
+func TestCompatibility(t *testing.T) {
+	compressible := bytes.Repeat([]byte{'a'}, 128)
+	incompressible := make([]byte, 128)
+	rand.New(rand.NewSource(0)).Read(incompressible)
+	codec, ok := NegotiatedCodec(_new)
+	require.True(t, ok)
+
+	tests := []struct {
+		desc string
+		// build builds the message which we send to a peer with capabilities c.
+		build func(t *testing.T, c Capabilities) *p2p.Message
+		// full is read by peers which negotiated all extensions.
+		full interface{}
+		// degraded is read from peers which predate all extensions.
+		degraded interface{}
+		// unnegotiated is read if a peer sets fields of extensions which were
+		// not negotiated.
+		unnegotiated interface{}
+	}{
+		{
+			desc: "piece request",
+			build: func(t *testing.T, c Capabilities) *p2p.Message {
+				return NewPieceRequestMessage(c, 1, 2, 3, true).Message
+			},
+			full:         request{1, 2, 3, true},
+			degraded:     request{1, 2, 3, false},
+			unnegotiated: request{1, 2, 3, false},
+		}, {
+			desc: "piece requests",
+			build: func(t *testing.T, c Capabilities) *p2p.Message {
+				requests := []*conn.Message{
+					NewPieceRequestMessage(c, 1, 0, 4, true),
+					NewPieceRequestMessage(c, 2, 0, 4, false),
+				}
+				if msg, ok := NewPieceRequestsMessage(c, requests); ok {
+					return msg.Message
+				}
+				// Sent one by one instead.
+				return requests[0].Message
+			},
+			full:         []request{{1, 0, 4, true}, {2, 0, 4, false}},
+			degraded:     request{1, 0, 4, false},
+			unnegotiated: nil,
+		}, {
+			desc: "piece payload",
+			build: func(t *testing.T, c Capabilities) *p2p.Message {
+				msg, err := NewPiecePayloadMessage(c, 3, 0, piecereader.NewBuffer(compressible), true)
+				require.NoError(t, err)
+				return msg.Message
+			},
+			full:         payload{3, 0, 128, codec, true, true},
+			degraded:     payload{3, 0, 128, p2p.PiecePayloadMessage_NONE, true, false},
+			unnegotiated: payload{3, 0, 128, codec, false, false},
+		}, {
+			desc: "piece chunk payload",
+			build: func(t *testing.T, c Capabilities) *p2p.Message {
+				msg, err := NewPiecePayloadMessage(c, 3, 256, piecereader.NewBuffer(compressible), true)
+				require.NoError(t, err)
+				return msg.Message
+			},
+			full:         payload{3, 256, 128, codec, true, true},
+			degraded:     payload{3, 256, 128, p2p.PiecePayloadMessage_NONE, true, false},
+			unnegotiated: payload{3, 256, 128, codec, false, false},
+		}, {
+			desc: "uncompressed piece payload",
+			build: func(t *testing.T, c Capabilities) *p2p.Message {
+				msg, err := NewPiecePayloadMessage(c, 3, 0, piecereader.NewBuffer(compressible), false)
+				require.NoError(t, err)
+				return msg.Message
+			},
+			full:         payload{3, 0, 128, p2p.PiecePayloadMessage_NONE, true, false},
+			degraded:     payload{3, 0, 128, p2p.PiecePayloadMessage_NONE, true, false},
+			unnegotiated: payload{3, 0, 128, p2p.PiecePayloadMessage_NONE, true, false},
+		}, {
+			desc: "incompressible piece payload",
+			build: func(t *testing.T, c Capabilities) *p2p.Message {
+				msg, err := NewPiecePayloadMessage(c, 3, 0, piecereader.NewBuffer(incompressible), true)
+				require.NoError(t, err)
+				return msg.Message
+			},
+			full:         payload{3, 0, 128, p2p.PiecePayloadMessage_NONE, true, false},
+			degraded:     payload{3, 0, 128, p2p.PiecePayloadMessage_NONE, true, false},
+			unnegotiated: payload{3, 0, 128, p2p.PiecePayloadMessage_NONE, true, false},
+		}, {
+			desc: "retry error",
+			build: func(t *testing.T, c Capabilities) *p2p.Message {
+				return NewRetryErrorMessage(c, 4, errors.New("busy"), time.Second).Message
+			},
+			full:         errorView{4, p2p.ErrorMessage_PIECE_REQUEST_RETRY, time.Second},
+			degraded:     errorView{4, p2p.ErrorMessage_PIECE_REQUEST_RETRY, 0},
+			unnegotiated: errorView{4, p2p.ErrorMessage_PIECE_REQUEST_RETRY, 0},
+		}, {
+			desc: "announce piece",
+			build: func(t *testing.T, c Capabilities) *p2p.Message {
+				return conn.NewAnnouncePieceMessage(5).Message
+			},
+			full:         5,
+			degraded:     5,
+			unnegotiated: 5,
+		}, {
+			desc: "announce pieces",
+			build: func(t *testing.T, c Capabilities) *p2p.Message {
+				if !c.Supports(conn.AnnouncePieces) {
+					return conn.NewAnnouncePieceMessage(5).Message
+				}
+				return &p2p.Message{
+					Type:           p2p.Message_ANNOUNCE_PIECES,
+					AnnouncePieces: &p2p.AnnouncePiecesMessage{BitfieldBytes: []byte{1, 2}},
+				}
+			},
+			full:         []byte{1, 2},
+			degraded:     5,
+			unnegotiated: nil,
+		}, {
+			desc: "cancel piece",
+			build: func(t *testing.T, c Capabilities) *p2p.Message {
+				return conn.NewCancelPieceMessage(6).Message
+			},
+			full:         6,
+			degraded:     6,
+			unnegotiated: 6,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			t.Run("new to new", func(t *testing.T) {
+				msg := roundTrip(t, test.build(t, _new))
+				require.Equal(t, test.full, read(_new, msg))
+			})
+			t.Run("new to old", func(t *testing.T) {
+				// Old peers lose nothing which they could have read.
+				msg := roundTrip(t, test.build(t, _old))
+				require.True(t, proto.Equal(strip(msg), msg))
+			})
+			t.Run("old to new", func(t *testing.T) {
+				msg := strip(roundTrip(t, test.build(t, _old)))
+				require.Equal(t, test.degraded, read(_old, msg))
+			})
+			t.Run("unnegotiated", func(t *testing.T) {
+				msg := roundTrip(t, test.build(t, _new))
+				require.Equal(t, test.unnegotiated, read(_old, msg))
+			})
+			t.Run("missing body", func(t *testing.T) {
+				msg := roundTrip(t, &p2p.Message{Type: test.build(t, _new).Type})
+				require.Nil(t, read(_new, msg))
+			})
+		})
+	}
+}
+
+func TestNegotiatedCodec(t *testing.T) {
+	codec, ok := NegotiatedCodec(_old)
+	require.False(t, ok)
+	require.Equal(t, p2p.PiecePayloadMessage_NONE, codec)
+}
+
+func TestChunkRejectsMalformedRanges(t *testing.T) {
+	_, _, ok := Chunk(&p2p.PiecePayloadMessage{Offset: -1, Length: 4})
+	require.False(t, ok)
+	_, _, ok = Chunk(&p2p.PiecePayloadMessage{Offset: 0, Length: -1})
+	require.False(t, ok)
+}
+
+func TestRequestDropsNilEntries(t *testing.T) {
+	_, ok := Request(_new, nil)
+	require.False(t, ok)
+}
@@ -0,0 +1,29 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package agentstorage
+
+import "github.com/uber/kraken/lib/torrent/storage"
+
+type options struct {
+	pieceVerifier storage.PieceVerifierFactory
+}
+
+// Option allows setting optional Torrent and TorrentArchive parameters.
+type Option func(*options)
+
+// WithPieceVerifier verifies written pieces with the verifiers created by f,
+// instead of the checksums declared by the torrent metainfo.
+func WithPieceVerifier(f storage.PieceVerifierFactory) Option {
+	return func(o *options) { o.pieceVerifier = f }
+}
@@ -14,6 +14,7 @@
 package agentstorage
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
@@ -27,12 +28,10 @@ import (
 
 	"github.com/willf/bitset"
 	"go.uber.org/atomic"
+	"go.uber.org/zap/zapcore"
 )
 
-var (
-	errPieceNotComplete   = errors.New("piece not complete")
-	errWritePieceConflict = errors.New("piece is already being written to")
-)
+var errPieceNotComplete = errors.New("piece not complete")
 
 // caDownloadStore defines the CADownloadStore methods which Torrent requires. Useful
 // for testing purposes, where we need to mock certain methods.
@@ -49,20 +48,40 @@ type caDownloadStore interface {
 // pieces. Behavior is undefined if multiple Torrent instances are backed
 // by the same file store and metainfo.
 type Torrent struct {
-	metaInfo    *core.MetaInfo
-	cads        caDownloadStore
-	pieces      []*piece
-	numComplete *atomic.Int32
-	committed   *atomic.Bool
+	metaInfo      *core.MetaInfo
+	verifier      storage.PieceVerifier
+	cads          caDownloadStore
+	pieces        []*piece
+	numComplete   *atomic.Int32
+	bytesComplete *atomic.Int64
+	committed     *atomic.Bool
 }
 
 // NewTorrent creates a new Torrent.
-func NewTorrent(cads caDownloadStore, mi *core.MetaInfo) (*Torrent, error) {
+func NewTorrent(cads caDownloadStore, mi *core.MetaInfo, opts ...Option) (*Torrent, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	verifier, err := storage.NewPieceVerifier(
+		o.pieceVerifier, storage.NewTorrentInfo(mi, bitset.New(uint(mi.NumPieces()))))
+	if err != nil {
+		return nil, fmt.Errorf("piece verifier: %s", err)
+	}
+
 	pieces, numComplete, err := restorePieces(mi.Digest(), cads, mi.NumPieces())
 	if err != nil {
 		return nil, fmt.Errorf("restore pieces: %s", err)
 	}
 
+	var bytesComplete int64
+	for i, p := range pieces {
+		if p.complete() {
+			bytesComplete += mi.GetPieceLength(i)
+		}
+	}
+
 	committed := false
 	if numComplete == len(pieces) {
 		if err := cads.MoveDownloadFileToCache(mi.Digest().Hex()); err != nil && !os.IsExist(err) {
@@ -72,11 +91,13 @@ func NewTorrent(cads caDownloadStore, mi *core.MetaInfo) (*Torrent, error) {
 	}
 
 	return &Torrent{
-		cads:        cads,
-		metaInfo:    mi,
-		pieces:      pieces,
-		numComplete: atomic.NewInt32(int32(numComplete)),
-		committed:   atomic.NewBool(committed),
+		cads:          cads,
+		metaInfo:      mi,
+		verifier:      verifier,
+		pieces:        pieces,
+		numComplete:   atomic.NewInt32(int32(numComplete)),
+		bytesComplete: atomic.NewInt64(bytesComplete),
+		committed:     atomic.NewBool(committed),
 	}, nil
 }
 
@@ -121,10 +142,9 @@ func (t *Torrent) Complete() bool {
 	return t.committed.Load()
 }
 
-// BytesDownloaded returns an estimate of the number of bytes downloaded in the
-// torrent.
+// BytesDownloaded returns the number of bytes of complete pieces in the torrent.
 func (t *Torrent) BytesDownloaded() int64 {
-	return min(int64(t.numComplete.Load())*t.metaInfo.PieceLength(), t.metaInfo.Length())
+	return t.bytesComplete.Load()
 }
 
 // Bitfield returns the bitfield of pieces where true denotes a complete piece
@@ -140,10 +160,18 @@ func (t *Torrent) Bitfield() *bitset.BitSet {
 }
 
 func (t *Torrent) String() string {
-	downloaded := int(float64(t.BytesDownloaded()) / float64(t.metaInfo.Length()) * 100)
 	return fmt.Sprintf(
 		"torrent(name=%s, hash=%s, downloaded=%d%%)",
-		t.Digest().Hex(), t.InfoHash().Hex(), downloaded)
+		t.Digest().Hex(), t.InfoHash().Hex(),
+		storage.PercentDownloaded(t.BytesDownloaded(), t.metaInfo.Length()))
+}
+
+// MarshalLogObject encodes t as log field, with the same attributes as String.
+func (t *Torrent) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddString("name", t.Digest().Hex())
+	enc.AddString("hash", t.InfoHash().Hex())
+	enc.AddInt("downloaded", storage.PercentDownloaded(t.BytesDownloaded(), t.metaInfo.Length()))
+	return nil
 }
 
 func (t *Torrent) getPiece(pi int) (*piece, error) {
@@ -168,6 +196,7 @@ func (t *Torrent) markPieceComplete(pi int) error {
 	}
 	t.pieces[pi].markComplete()
 	t.numComplete.Inc()
+	t.bytesComplete.Add(t.metaInfo.GetPieceLength(pi))
 	return nil
 }
 
@@ -179,17 +208,21 @@ func (t *Torrent) writePiece(src storage.PieceReader, pi int) error {
 	}
 	defer f.Close()
 
-	h := core.PieceHash()
-	r := io.TeeReader(src, h) // Calculates piece sum as we write to file.
+	h := t.verifier.Hash()
+	r := io.TeeReader(src, h) // Calculates piece digest as we write to file.
 
 	if _, err := f.Seek(t.getFileOffset(pi), 0); err != nil {
 		return fmt.Errorf("seek: %s", err)
 	}
 	if _, err := io.Copy(f, r); err != nil {
+		if err == storage.ErrPieceDigestMismatch {
+			// Failed by a verifying reader.
+			return err
+		}
 		return fmt.Errorf("copy: %s", err)
 	}
-	if h.Sum32() != t.metaInfo.GetPieceSum(pi) {
-		return errors.New("invalid piece sum")
+	if !bytes.Equal(h.Sum(nil), t.verifier.Expected(pi)) {
+		return storage.ErrPieceDigestMismatch
 	}
 
 	if err := t.markPieceComplete(pi); err != nil {
@@ -214,12 +247,12 @@ func (t *Torrent) WritePiece(src storage.PieceReader, pi int) error {
 		return storage.ErrPieceComplete
 	}
 	if piece.dirty() {
-		return errWritePieceConflict
+		return storage.ErrPieceWriteConflict
 	}
 
 	dirty, complete := piece.tryMarkDirty()
 	if dirty {
-		return errWritePieceConflict
+		return storage.ErrPieceWriteConflict
 	} else if complete {
 		return storage.ErrPieceComplete
 	}
@@ -231,6 +264,11 @@ func (t *Torrent) WritePiece(src storage.PieceReader, pi int) error {
 	if err := t.writePiece(src, pi); err != nil {
 		// Allow other threads to write this piece since we mysteriously failed.
 		piece.markEmpty()
+		if err == storage.ErrPieceDigestMismatch {
+			// Returned as is, such that callers can tell corrupt pieces from
+			// failed writes.
+			return err
+		}
 		return fmt.Errorf("write piece: %s", err)
 	}
 
@@ -293,10 +331,3 @@ func (t *Torrent) MissingPieces() []int {
 func (t *Torrent) getFileOffset(pi int) int64 {
 	return t.metaInfo.PieceLength() * int64(pi)
 }
-
-func min(a, b int64) int64 {
-	if a < b {
-		return a
-	}
-	return b
-}
@@ -33,19 +33,21 @@ type TorrentArchive struct {
 	stats          tally.Scope
 	cads           *store.CADownloadStore
 	metaInfoClient metainfoclient.Client
+	opts           []Option
 }
 
 // NewTorrentArchive creates a new TorrentArchive.
 func NewTorrentArchive(
 	stats tally.Scope,
 	cads *store.CADownloadStore,
-	mic metainfoclient.Client) *TorrentArchive {
+	mic metainfoclient.Client,
+	opts ...Option) *TorrentArchive {
 
 	stats = stats.Tagged(map[string]string{
 		"module": "agenttorrentarchive",
 	})
 
-	return &TorrentArchive{stats, cads, mic}
+	return &TorrentArchive{stats, cads, mic, opts}
 }
 
 // Stat returns TorrentInfo for the given digest. Returns os.ErrNotExist if the
@@ -101,7 +103,7 @@ func (a *TorrentArchive) CreateTorrent(namespace string, d core.Digest) (storage
 	} else if err != nil {
 		return nil, fmt.Errorf("get metainfo: %s", err)
 	}
-	t, err := NewTorrent(a.cads, tm.MetaInfo)
+	t, err := NewTorrent(a.cads, tm.MetaInfo, a.opts...)
 	if err != nil {
 		return nil, fmt.Errorf("initialize torrent: %s", err)
 	}
@@ -114,7 +116,7 @@ func (a *TorrentArchive) GetTorrent(namespace string, d core.Digest) (storage.To
 	if err := a.cads.Any().GetMetadata(d.Hex(), &tm); err != nil {
 		return nil, fmt.Errorf("get metainfo: %s", err)
 	}
-	t, err := NewTorrent(a.cads, tm.MetaInfo)
+	t, err := NewTorrent(a.cads, tm.MetaInfo, a.opts...)
 	if err != nil {
 		return nil, fmt.Errorf("initialize torrent: %s", err)
 	}
@@ -14,6 +14,8 @@
 package agentstorage
 
 import (
+	"crypto/md5"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -89,6 +91,27 @@ func TestTorrentWriteUpdatesBytesDownloadedAndBitfield(t *testing.T) {
 	require.Equal(bitsetutil.FromBools(true, false), tor.Bitfield())
 }
 
+func TestTorrentBytesDownloadedWithShortLastPiece(t *testing.T) {
+	require := require.New(t)
+
+	cads, cleanup := store.CADownloadStoreFixture()
+	defer cleanup()
+
+	// Last piece is 1 byte.
+	blob := core.SizedBlobFixture(9, 4)
+
+	prepareStore(cads, blob.MetaInfo)
+
+	tor, err := NewTorrent(cads, blob.MetaInfo)
+	require.NoError(err)
+
+	require.NoError(tor.WritePiece(piecereader.NewBuffer(blob.Content[8:]), 2))
+	require.Equal(int64(1), tor.BytesDownloaded())
+
+	require.NoError(tor.WritePiece(piecereader.NewBuffer(blob.Content[:4]), 0))
+	require.Equal(int64(5), tor.BytesDownloaded())
+}
+
 func TestTorrentWriteComplete(t *testing.T) {
 	require := require.New(t)
 
@@ -118,6 +141,56 @@ func TestTorrentWriteComplete(t *testing.T) {
 	require.Equal(storage.ErrPieceComplete, tor.WritePiece(piecereader.NewBuffer(blob.Content[:1]), 0))
 }
 
+func TestTorrentWriteVerifiesPieceDigests(t *testing.T) {
+	blob := core.SizedBlobFixture(8, 4)
+
+	tests := []struct {
+		desc string
+		opts []Option
+	}{
+		{"metainfo checksums", nil},
+		{"sha256 verifier", []Option{WithPieceVerifier(storage.PieceVerifierFixture(sha256.New, blob.Content))}},
+		{"md5 verifier", []Option{WithPieceVerifier(storage.PieceVerifierFixture(md5.New, blob.Content))}},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+
+			cads, cleanup := store.CADownloadStoreFixture()
+			defer cleanup()
+
+			prepareStore(cads, blob.MetaInfo)
+
+			tor, err := NewTorrent(cads, blob.MetaInfo, test.opts...)
+			require.NoError(err)
+
+			corrupt := append([]byte(nil), blob.Content[:4]...)
+			corrupt[0]++
+			err = tor.WritePiece(piecereader.NewBuffer(corrupt), 0)
+			require.Error(err)
+			require.Contains(err.Error(), storage.ErrPieceDigestMismatch.Error())
+			require.False(tor.HasPiece(0))
+
+			// The piece may be written again once it failed verification.
+			require.NoError(tor.WritePiece(piecereader.NewBuffer(blob.Content[:4]), 0))
+			require.NoError(tor.WritePiece(piecereader.NewBuffer(blob.Content[4:]), 1))
+			require.True(tor.Complete())
+		})
+	}
+}
+
+func TestNewTorrentRejectsInvalidPieceVerifier(t *testing.T) {
+	cads, cleanup := store.CADownloadStoreFixture()
+	defer cleanup()
+
+	blob := core.SizedBlobFixture(8, 4)
+	prepareStore(cads, blob.MetaInfo)
+
+	_, err := NewTorrent(cads, blob.MetaInfo, WithPieceVerifier(
+		func(*storage.TorrentInfo) (storage.PieceVerifier, error) { return nil, errors.New("some error") }))
+	require.Error(t, err)
+}
+
 func TestTorrentWriteMultiplePieceConcurrent(t *testing.T) {
 	require := require.New(t)
 
@@ -178,11 +251,11 @@ func TestTorrentWriteSamePieceConcurrent(t *testing.T) {
 
 			pi := int(math.Mod(float64(i), float64(len(blob.Content))))
 
-			// If another goroutine is currently writing, we should get errWritePieceConflict.
+			// If another goroutine is currently writing, we should get ErrPieceWriteConflict.
 			// If another goroutine has finished writing, we should get storage.ErrPieceComplete.
 			err := tor.WritePiece(piecereader.NewBuffer([]byte{blob.Content[pi]}), pi)
 			if err != nil {
-				require.Contains([]error{errWritePieceConflict, storage.ErrPieceComplete}, err)
+				require.Contains([]error{storage.ErrPieceWriteConflict, storage.ErrPieceComplete}, err)
 			}
 
 			start := time.Now()
@@ -279,7 +352,7 @@ func TestTorrentWritePieceConflictsDoNotBlock(t *testing.T) {
 
 	// Writing while another goroutine is mid-write should not block.
 	<-w.startWriting
-	require.Equal(errWritePieceConflict, tor.WritePiece(piecereader.NewBuffer(blob.Content), 0))
+	require.Equal(storage.ErrPieceWriteConflict, tor.WritePiece(piecereader.NewBuffer(blob.Content), 0))
 	w.stopWriting <- true
 
 	<-done
@@ -349,6 +422,30 @@ func TestTorrentRestoreCompletedTorrent(t *testing.T) {
 	require.NoError(err)
 
 	require.True(tor.Complete())
+	require.Equal(int64(8), tor.BytesDownloaded())
+}
+
+func TestTorrentRestoreBytesDownloadedWithShortLastPiece(t *testing.T) {
+	require := require.New(t)
+
+	cads, cleanup := store.CADownloadStoreFixture()
+	defer cleanup()
+
+	// Pieces are 4, 4 and 1 bytes long.
+	blob := core.SizedBlobFixture(9, 4)
+
+	prepareStore(cads, blob.MetaInfo)
+
+	tor, err := NewTorrent(cads, blob.MetaInfo)
+	require.NoError(err)
+
+	require.NoError(tor.WritePiece(piecereader.NewBuffer(blob.Content[8:9]), 2))
+	require.NoError(tor.WritePiece(piecereader.NewBuffer(blob.Content[0:4]), 0))
+
+	tor, err = NewTorrent(cads, blob.MetaInfo)
+	require.NoError(err)
+
+	require.Equal(int64(5), tor.BytesDownloaded())
 }
 
 func TestTorrentRestoreInProgressTorrent(t *testing.T) {
@@ -14,6 +14,8 @@
 package storage
 
 import (
+	"hash"
+
 	"github.com/uber/kraken/core"
 	"github.com/uber/kraken/utils/bitsetutil"
 	"github.com/uber/kraken/utils/randutil"
@@ -25,3 +27,29 @@ func TorrentInfoFixture(size, pieceLength uint64) *TorrentInfo {
 	bitfield := bitsetutil.FromBools(randutil.Bools(mi.NumPieces())...)
 	return NewTorrentInfo(mi, bitfield)
 }
+
+// PieceVerifierFixture returns a PieceVerifierFactory which verifies the pieces
+// of content with digests computed by newHash, for testing purposes.
+func PieceVerifierFixture(newHash func() hash.Hash, content []byte) PieceVerifierFactory {
+	return func(info *TorrentInfo) (PieceVerifier, error) {
+		v := &fixtureVerifier{newHash: newHash}
+		var offset int64
+		for i := 0; i < info.NumPieces(); i++ {
+			n := info.metainfo.GetPieceLength(i)
+			h := newHash()
+			h.Write(content[offset : offset+n])
+			v.expected = append(v.expected, h.Sum(nil))
+			offset += n
+		}
+		return v, nil
+	}
+}
+
+type fixtureVerifier struct {
+	newHash  func() hash.Hash
+	expected [][]byte
+}
+
+func (v *fixtureVerifier) Expected(piece int) []byte { return v.expected[piece] }
+
+func (v *fixtureVerifier) Hash() hash.Hash { return v.newHash() }
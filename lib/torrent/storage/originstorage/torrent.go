@@ -24,6 +24,7 @@ import (
 
 	"github.com/willf/bitset"
 	"go.uber.org/atomic"
+	"go.uber.org/zap/zapcore"
 )
 
 // Torrent errors.
@@ -98,16 +99,28 @@ func (t *Torrent) WritePiece(src storage.PieceReader, pi int) error {
 	return ErrReadOnly
 }
 
+// ReadOnly always returns true.
+func (t *Torrent) ReadOnly() bool {
+	return true
+}
+
 // Bitfield always returns a completed bitfield.
 func (t *Torrent) Bitfield() *bitset.BitSet {
 	return bitset.New(uint(t.NumPieces())).Complement()
 }
 
 func (t *Torrent) String() string {
-	downloaded := int(float64(t.BytesDownloaded()) / float64(t.metaInfo.Length()) * 100)
+	downloaded := storage.PercentDownloaded(t.BytesDownloaded(), t.metaInfo.Length())
 	return fmt.Sprintf("torrent(hash=%s, downloaded=%d%%)", t.InfoHash().Hex(), downloaded)
 }
 
+// MarshalLogObject encodes t as log field, with the same attributes as String.
+func (t *Torrent) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddString("hash", t.InfoHash().Hex())
+	enc.AddInt("downloaded", storage.PercentDownloaded(t.BytesDownloaded(), t.metaInfo.Length()))
+	return nil
+}
+
 type opener struct {
 	torrent *Torrent
 }
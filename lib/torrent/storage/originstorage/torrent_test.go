@@ -21,6 +21,7 @@ import (
 
 	"github.com/uber/kraken/core"
 	"github.com/uber/kraken/lib/store"
+	"github.com/uber/kraken/lib/torrent/storage"
 	"github.com/uber/kraken/lib/torrent/storage/piecereader"
 	"github.com/uber/kraken/utils/bitsetutil"
 
@@ -104,4 +105,5 @@ func TestTorrentWritePieceError(t *testing.T) {
 
 	err = tor.WritePiece(piecereader.NewBuffer([]byte{}), 0)
 	require.Equal(ErrReadOnly, err)
+	require.True(storage.IsReadOnly(tor))
 }
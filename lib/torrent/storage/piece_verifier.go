@@ -0,0 +1,122 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/uber/kraken/core"
+)
+
+// ErrPieceDigestMismatch is returned when a piece does not match the digest
+// expected by its PieceVerifier.
+var ErrPieceDigestMismatch = errors.New("piece digest mismatch")
+
+// PieceVerifier verifies the pieces of a torrent.
+type PieceVerifier interface {
+	// Expected returns the expected digest of piece. Does not check bounds.
+	Expected(piece int) []byte
+
+	// Hash returns a new hash.Hash which computes piece digests.
+	Hash() hash.Hash
+}
+
+// PieceVerifierFactory creates the PieceVerifier of a torrent.
+type PieceVerifierFactory func(*TorrentInfo) (PieceVerifier, error)
+
+// NewPieceVerifier creates the PieceVerifier of info with f. If f is nil, the
+// checksums declared by the torrent metainfo are used. Returns an error if f
+// fails, or if the digests it expects do not match its hash.
+func NewPieceVerifier(f PieceVerifierFactory, info *TorrentInfo) (PieceVerifier, error) {
+	if f == nil {
+		return metaInfoVerifier{info.metainfo}, nil
+	}
+	v, err := f(info)
+	if err != nil {
+		return nil, err
+	}
+	if v == nil {
+		return nil, errors.New("no piece verifier")
+	}
+	size := v.Hash().Size()
+	for i := 0; i < info.NumPieces(); i++ {
+		if n := len(v.Expected(i)); n != size {
+			return nil, fmt.Errorf(
+				"piece %d: expected digest has %d bytes, hash has %d bytes", i, n, size)
+		}
+	}
+	return v, nil
+}
+
+// VerifyPiece returns true if b is piece of a torrent verified by v.
+func VerifyPiece(v PieceVerifier, piece int, b []byte) bool {
+	h := v.Hash()
+	h.Write(b)
+	return bytes.Equal(h.Sum(nil), v.Expected(piece))
+}
+
+// VerifyPieceReader reads piece from r and returns ErrPieceDigestMismatch if it
+// was not verified by v.
+func VerifyPieceReader(v PieceVerifier, piece int, r io.Reader) error {
+	h := v.Hash()
+	if _, err := io.Copy(h, r); err != nil {
+		return fmt.Errorf("read: %s", err)
+	}
+	if !bytes.Equal(h.Sum(nil), v.Expected(piece)) {
+		return ErrPieceDigestMismatch
+	}
+	return nil
+}
+
+// NewVerifyingReader returns a PieceReader which reads piece from r, computing
+// its digest as it is read. The read which reaches the end of r returns
+// ErrPieceDigestMismatch instead of io.EOF if the piece was not verified by v.
+func NewVerifyingReader(v PieceVerifier, piece int, r PieceReader) PieceReader {
+	return &verifyingReader{r, v.Hash(), v.Expected(piece)}
+}
+
+type verifyingReader struct {
+	PieceReader
+	hash     hash.Hash
+	expected []byte
+}
+
+func (r *verifyingReader) Read(b []byte) (int, error) {
+	n, err := r.PieceReader.Read(b)
+	r.hash.Write(b[:n])
+	if err == io.EOF && !bytes.Equal(r.hash.Sum(nil), r.expected) {
+		return n, ErrPieceDigestMismatch
+	}
+	return n, err
+}
+
+// metaInfoVerifier verifies pieces with the checksums of torrent metainfo.
+type metaInfoVerifier struct {
+	metainfo *core.MetaInfo
+}
+
+func (v metaInfoVerifier) Expected(piece int) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v.metainfo.GetPieceSum(piece))
+	return b
+}
+
+func (v metaInfoVerifier) Hash() hash.Hash {
+	return core.PieceHash()
+}
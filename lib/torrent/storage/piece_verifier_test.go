@@ -0,0 +1,120 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"testing"
+
+	"github.com/uber/kraken/core"
+	"github.com/uber/kraken/lib/torrent/storage/piecereader"
+	"github.com/uber/kraken/utils/bitsetutil"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewPieceVerifierDefaultsToMetaInfoChecksums(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(10, 4)
+	info := NewTorrentInfo(blob.MetaInfo, bitsetutil.FromBools(false, false, false))
+
+	v, err := NewPieceVerifier(nil, info)
+	require.NoError(err)
+	for i := 0; i < info.NumPieces(); i++ {
+		sum, ok := info.PieceSum(i)
+		require.True(ok)
+		require.Equal(fmt.Sprintf("%08x", sum), fmt.Sprintf("%x", v.Expected(i)))
+	}
+	require.True(VerifyPiece(v, 2, blob.Content[8:]))
+	require.False(VerifyPiece(v, 2, blob.Content[4:6]))
+}
+
+func TestNewPieceVerifierFixture(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(10, 4)
+	info := NewTorrentInfo(blob.MetaInfo, bitsetutil.FromBools(false, false, false))
+
+	v, err := NewPieceVerifier(PieceVerifierFixture(sha256.New, blob.Content), info)
+	require.NoError(err)
+	require.Len(v.Expected(0), sha256.Size)
+	require.True(VerifyPiece(v, 0, blob.Content[:4]))
+	require.True(VerifyPiece(v, 2, blob.Content[8:]))
+	require.False(VerifyPiece(v, 1, blob.Content[:4]))
+}
+
+type badDigestVerifier struct{}
+
+func (badDigestVerifier) Expected(piece int) []byte { return []byte{1, 2} }
+
+func (badDigestVerifier) Hash() hash.Hash { return sha256.New() }
+
+func TestNewPieceVerifierErrors(t *testing.T) {
+	tests := []struct {
+		desc    string
+		factory PieceVerifierFactory
+	}{
+		{
+			"factory error",
+			func(*TorrentInfo) (PieceVerifier, error) { return nil, errors.New("some error") },
+		}, {
+			"nil verifier",
+			func(*TorrentInfo) (PieceVerifier, error) { return nil, nil },
+		}, {
+			"digest size mismatch",
+			func(*TorrentInfo) (PieceVerifier, error) { return badDigestVerifier{}, nil },
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			_, err := NewPieceVerifier(test.factory, TorrentInfoFixture(4, 1))
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestVerifyPieceReader(t *testing.T) {
+	require := require.New(t)
+
+	blob := core.SizedBlobFixture(10, 4)
+	info := NewTorrentInfo(blob.MetaInfo, bitsetutil.FromBools(false, false, false))
+
+	v, err := NewPieceVerifier(PieceVerifierFixture(sha256.New, blob.Content), info)
+	require.NoError(err)
+	require.NoError(VerifyPieceReader(v, 1, bytes.NewReader(blob.Content[4:8])))
+	require.Equal(ErrPieceDigestMismatch, VerifyPieceReader(v, 1, bytes.NewReader(blob.Content[:4])))
+}
+
+func TestVerifyingReader(t *testing.T) {
+	blob := core.SizedBlobFixture(10, 4)
+	info := NewTorrentInfo(blob.MetaInfo, bitsetutil.FromBools(false, false, false))
+
+	for _, f := range []PieceVerifierFactory{nil, PieceVerifierFixture(sha256.New, blob.Content)} {
+		v, err := NewPieceVerifier(f, info)
+		require.NoError(t, err)
+
+		b, err := ioutil.ReadAll(NewVerifyingReader(v, 2, piecereader.NewBuffer(blob.Content[8:])))
+		require.NoError(t, err)
+		require.Equal(t, blob.Content[8:], b)
+
+		_, err = ioutil.ReadAll(NewVerifyingReader(v, 2, piecereader.NewBuffer(blob.Content[:2])))
+		require.Equal(t, ErrPieceDigestMismatch, err)
+	}
+}
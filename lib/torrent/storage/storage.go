@@ -29,6 +29,10 @@ var ErrNotFound = errors.New("torrent not found")
 // complete.
 var ErrPieceComplete = errors.New("piece is already complete")
 
+// ErrPieceWriteConflict occurs when Torrent cannot write a piece because another
+// write of the piece is in progress.
+var ErrPieceWriteConflict = errors.New("piece is already being written to")
+
 // PieceReader defines operations for lazy piece reading.
 type PieceReader interface {
 	io.ReadCloser
@@ -56,6 +60,20 @@ type Torrent interface {
 	GetPieceReader(piece int) (PieceReader, error)
 }
 
+// ReadOnlyTorrent is implemented by Torrents which never accept writes, e.g.
+// since their blob is already complete on the origin.
+type ReadOnlyTorrent interface {
+	Torrent
+	ReadOnly() bool
+}
+
+// IsReadOnly returns true if t is a ReadOnlyTorrent which reports itself as
+// read-only.
+func IsReadOnly(t Torrent) bool {
+	r, ok := t.(ReadOnlyTorrent)
+	return ok && r.ReadOnly()
+}
+
 // TorrentArchive creates and open torrent file
 type TorrentArchive interface {
 	Stat(namespace string, d core.Digest) (*TorrentInfo, error)
@@ -28,9 +28,21 @@ type TorrentInfo struct {
 
 // NewTorrentInfo creates a new TorrentInfo.
 func NewTorrentInfo(mi *core.MetaInfo, bitfield *bitset.BitSet) *TorrentInfo {
-	numComplete := bitfield.Count()
-	downloaded := int(float64(numComplete) / float64(mi.NumPieces()) * 100)
-	return &TorrentInfo{mi, bitfield, downloaded}
+	// Pieces are weighed by their length, since the last piece may be shorter.
+	var bytes int64
+	for i, ok := bitfield.NextSet(0); ok; i, ok = bitfield.NextSet(i + 1) {
+		bytes += mi.GetPieceLength(int(i))
+	}
+	return &TorrentInfo{mi, bitfield, PercentDownloaded(bytes, mi.Length())}
+}
+
+// PercentDownloaded returns bytes as an integer percent of length. Empty blobs
+// have nothing to download, so they are always 100 percent downloaded.
+func PercentDownloaded(bytes, length int64) int {
+	if length <= 0 {
+		return 100
+	}
+	return int(float64(bytes) / float64(length) * 100)
 }
 
 func (i *TorrentInfo) String() string {
@@ -47,9 +59,28 @@ func (i *TorrentInfo) InfoHash() core.InfoHash {
 	return i.metainfo.InfoHash()
 }
 
-// MaxPieceLength returns the max piece length of the torrent.
+// MaxPieceLength returns the max piece length of the torrent. Note, this is
+// shorter than the configured piece length for single piece torrents.
 func (i *TorrentInfo) MaxPieceLength() int64 {
-	return i.metainfo.PieceLength()
+	return i.metainfo.GetPieceLength(0)
+}
+
+// NumPieces returns the number of pieces in the torrent.
+func (i *TorrentInfo) NumPieces() int {
+	return i.metainfo.NumPieces()
+}
+
+// PieceLength returns the length of piece i. Returns 0 if i is out of bounds.
+func (i *TorrentInfo) PieceLength(piece int) int64 {
+	return i.metainfo.GetPieceLength(piece)
+}
+
+// PieceSum returns the checksum of piece i. Returns false if i is out of bounds.
+func (i *TorrentInfo) PieceSum(piece int) (uint32, bool) {
+	if piece < 0 || piece >= i.metainfo.NumPieces() {
+		return 0, false
+	}
+	return i.metainfo.GetPieceSum(piece), true
 }
 
 // PercentDownloaded returns the percent of bytes downloaded as an integer
@@ -63,3 +94,15 @@ func (i *TorrentInfo) PercentDownloaded() int {
 func (i *TorrentInfo) Bitfield() *bitset.BitSet {
 	return i.bitfield
 }
+
+// ExcludePieces returns a copy of i whose bitfield excludes pieces.
+func (i *TorrentInfo) ExcludePieces(pieces ...int) *TorrentInfo {
+	if len(pieces) == 0 {
+		return i
+	}
+	b := i.bitfield.Clone()
+	for _, p := range pieces {
+		b.Clear(uint(p))
+	}
+	return NewTorrentInfo(i.metainfo, b)
+}
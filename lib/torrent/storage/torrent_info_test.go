@@ -48,3 +48,62 @@ func TestTorrentInfoPercentDownloaded(t *testing.T) {
 		})
 	}
 }
+
+func TestTorrentInfoShortLastPiece(t *testing.T) {
+	tests := []struct {
+		desc              string
+		size              uint64
+		pieceLength       uint64
+		bitfield          *bitset.BitSet
+		percentDownloaded int
+		maxPieceLength    int64
+	}{
+		{"one byte last piece", 9, 4, bitsetutil.FromBools(false, false, true), 11, 4},
+		{"max size last piece", 8, 4, bitsetutil.FromBools(false, true), 50, 4},
+		{"single piece shorter than max", 3, 4, bitsetutil.FromBools(true), 100, 3},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+
+			mi := core.SizedBlobFixture(test.size, test.pieceLength).MetaInfo
+			info := NewTorrentInfo(mi, test.bitfield)
+			require.Equal(test.percentDownloaded, info.PercentDownloaded())
+			require.Equal(test.maxPieceLength, info.MaxPieceLength())
+		})
+	}
+}
+
+func TestTorrentInfoEmptyBlob(t *testing.T) {
+	require := require.New(t)
+
+	mi := core.SizedBlobFixture(0, 4).MetaInfo
+	info := NewTorrentInfo(mi, bitset.New(uint(mi.NumPieces())))
+	require.Equal(100, info.PercentDownloaded())
+}
+
+func TestTorrentInfoExcludePieces(t *testing.T) {
+	require := require.New(t)
+
+	mi := core.SizedBlobFixture(100, 25).MetaInfo
+	b := bitsetutil.FromBools(true, true, true, false)
+	info := NewTorrentInfo(mi, b)
+
+	excluded := info.ExcludePieces(0, 3)
+	require.Equal(bitsetutil.FromBools(false, true, true, false), excluded.Bitfield())
+	require.Equal(50, excluded.PercentDownloaded())
+	require.Equal(mi.InfoHash(), excluded.InfoHash())
+
+	// The original info is unchanged.
+	require.Equal(bitsetutil.FromBools(true, true, true, false), info.Bitfield())
+	require.Equal(info, info.ExcludePieces())
+}
+
+func TestPercentDownloaded(t *testing.T) {
+	require := require.New(t)
+
+	require.Equal(0, PercentDownloaded(0, 9))
+	require.Equal(11, PercentDownloaded(1, 9))
+	require.Equal(100, PercentDownloaded(9, 9))
+	require.Equal(100, PercentDownloaded(0, 0))
+}
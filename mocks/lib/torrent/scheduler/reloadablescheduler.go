@@ -9,6 +9,7 @@ import (
 	core "github.com/uber/kraken/core"
 	scheduler "github.com/uber/kraken/lib/torrent/scheduler"
 	connstate "github.com/uber/kraken/lib/torrent/scheduler/connstate"
+	dispatch "github.com/uber/kraken/lib/torrent/scheduler/dispatch"
 	reflect "reflect"
 )
 
@@ -64,6 +65,20 @@ func (mr *MockReloadableSchedulerMockRecorder) Download(arg0, arg1 interface{})
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Download", reflect.TypeOf((*MockReloadableScheduler)(nil).Download), arg0, arg1)
 }
 
+// InvalidateTorrent mocks base method
+func (m *MockReloadableScheduler) InvalidateTorrent(arg0 core.Digest) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "InvalidateTorrent", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// InvalidateTorrent indicates an expected call of InvalidateTorrent
+func (mr *MockReloadableSchedulerMockRecorder) InvalidateTorrent(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "InvalidateTorrent", reflect.TypeOf((*MockReloadableScheduler)(nil).InvalidateTorrent), arg0)
+}
+
 // Probe mocks base method
 func (m *MockReloadableScheduler) Probe() error {
 	m.ctrl.T.Helper()
@@ -115,3 +130,33 @@ func (mr *MockReloadableSchedulerMockRecorder) Stop() *gomock.Call {
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Stop", reflect.TypeOf((*MockReloadableScheduler)(nil).Stop))
 }
+
+// TorrentProgress mocks base method
+func (m *MockReloadableScheduler) TorrentProgress(arg0 core.Digest) (dispatch.Progress, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "TorrentProgress", arg0)
+	ret0, _ := ret[0].(dispatch.Progress)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// TorrentProgress indicates an expected call of TorrentProgress
+func (mr *MockReloadableSchedulerMockRecorder) TorrentProgress(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TorrentProgress", reflect.TypeOf((*MockReloadableScheduler)(nil).TorrentProgress), arg0)
+}
+
+// TorrentSnapshot mocks base method
+func (m *MockReloadableScheduler) TorrentSnapshot(arg0 core.Digest) (dispatch.Snapshot, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "TorrentSnapshot", arg0)
+	ret0, _ := ret[0].(dispatch.Snapshot)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// TorrentSnapshot indicates an expected call of TorrentSnapshot
+func (mr *MockReloadableSchedulerMockRecorder) TorrentSnapshot(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TorrentSnapshot", reflect.TypeOf((*MockReloadableScheduler)(nil).TorrentSnapshot), arg0)
+}
@@ -8,6 +8,7 @@ import (
 	gomock "github.com/golang/mock/gomock"
 	core "github.com/uber/kraken/core"
 	connstate "github.com/uber/kraken/lib/torrent/scheduler/connstate"
+	dispatch "github.com/uber/kraken/lib/torrent/scheduler/dispatch"
 	reflect "reflect"
 )
 
@@ -63,6 +64,20 @@ func (mr *MockSchedulerMockRecorder) Download(arg0, arg1 interface{}) *gomock.Ca
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Download", reflect.TypeOf((*MockScheduler)(nil).Download), arg0, arg1)
 }
 
+// InvalidateTorrent mocks base method
+func (m *MockScheduler) InvalidateTorrent(arg0 core.Digest) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "InvalidateTorrent", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// InvalidateTorrent indicates an expected call of InvalidateTorrent
+func (mr *MockSchedulerMockRecorder) InvalidateTorrent(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "InvalidateTorrent", reflect.TypeOf((*MockScheduler)(nil).InvalidateTorrent), arg0)
+}
+
 // Probe mocks base method
 func (m *MockScheduler) Probe() error {
 	m.ctrl.T.Helper()
@@ -102,3 +117,33 @@ func (mr *MockSchedulerMockRecorder) Stop() *gomock.Call {
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Stop", reflect.TypeOf((*MockScheduler)(nil).Stop))
 }
+
+// TorrentProgress mocks base method
+func (m *MockScheduler) TorrentProgress(arg0 core.Digest) (dispatch.Progress, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "TorrentProgress", arg0)
+	ret0, _ := ret[0].(dispatch.Progress)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// TorrentProgress indicates an expected call of TorrentProgress
+func (mr *MockSchedulerMockRecorder) TorrentProgress(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TorrentProgress", reflect.TypeOf((*MockScheduler)(nil).TorrentProgress), arg0)
+}
+
+// TorrentSnapshot mocks base method
+func (m *MockScheduler) TorrentSnapshot(arg0 core.Digest) (dispatch.Snapshot, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "TorrentSnapshot", arg0)
+	ret0, _ := ret[0].(dispatch.Snapshot)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// TorrentSnapshot indicates an expected call of TorrentSnapshot
+func (mr *MockSchedulerMockRecorder) TorrentSnapshot(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TorrentSnapshot", reflect.TypeOf((*MockScheduler)(nil).TorrentSnapshot), arg0)
+}
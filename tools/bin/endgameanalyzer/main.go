@@ -0,0 +1,90 @@
+// Copyright (c) 2016-2019 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"text/tabwriter"
+
+	"github.com/uber/kraken/lib/torrent/networkevent"
+	"github.com/uber/kraken/lib/torrent/scheduler/dispatch"
+	"github.com/uber/kraken/lib/torrent/scheduler/dispatch/analyze"
+
+	"github.com/alecthomas/kingpin"
+	"gopkg.in/yaml.v2"
+)
+
+// Replays the piece requests recorded in a network event file through each
+// dispatcher configuration of a YAML list, and prints the configurations ranked
+// by projected download time, duplicate bytes and resends.
+func main() {
+	eventFile := kingpin.Arg("events", "Network event file").Required().File()
+	matrixFile := kingpin.Arg("configs", "YAML list of dispatcher configs").Required().File()
+	pieceLength := kingpin.Flag("piece-length", "piece length in bytes").Default("4194304").Int64()
+	kingpin.Parse()
+
+	events, err := readEvents(*eventFile)
+	if err != nil {
+		log.Fatalf("Error reading events: %s", err)
+	}
+	recordings, err := analyze.ParseEvents(events, *pieceLength)
+	if err != nil {
+		log.Fatalf("Error parsing events: %s", err)
+	}
+	b, err := ioutil.ReadAll(*matrixFile)
+	if err != nil {
+		log.Fatalf("Error reading configs: %s", err)
+	}
+	var matrix []dispatch.Config
+	if err := yaml.Unmarshal(b, &matrix); err != nil {
+		log.Fatalf("Error unmarshalling configs: %s", err)
+	}
+	report, err := analyze.Analyze(recordings, matrix)
+	if err != nil {
+		log.Fatalf("Error analyzing: %s", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "RANK\tPIPELINE\tENDGAME\tMIN TIMEOUT\tPER MB\tDURATION\tDELTA\tDUPLICATE BYTES\tRESENDS\tINCOMPLETE")
+	for i, r := range report.Results {
+		c := r.Config.WithDefaults()
+		endgame := fmt.Sprint(c.EndgameThreshold)
+		if c.DisableEndgame {
+			endgame = "off"
+		}
+		fmt.Fprintf(w, "%d\t%d\t%s\t%s\t%s\t%s\t%s\t%d\t%d\t%d\n",
+			i+1, c.PipelineLimit, endgame, c.PieceRequestMinTimeout, c.PieceRequestTimeoutPerMb,
+			r.Duration, r.Delta, r.DuplicateBytes, r.Resends, r.Incomplete)
+	}
+	w.Flush()
+}
+
+func readEvents(f *os.File) ([]*networkevent.Event, error) {
+	var events []*networkevent.Event
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var event networkevent.Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			log.Printf("Error unmarshalling event: %s\n", err)
+			continue
+		}
+		events = append(events, &event)
+	}
+	return events, scanner.Err()
+}
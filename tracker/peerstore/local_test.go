@@ -143,3 +143,17 @@ func TestLocalStoreConcurrency(t *testing.T) {
 	}
 	wg.Wait()
 }
+
+func TestLocalStoreGetPeersPopulatesZone(t *testing.T) {
+	s := NewLocalStore(LocalConfig{TTL: 10 * time.Minute}, clock.NewMock())
+	defer s.Close()
+
+	h := core.InfoHashFixture()
+	p := core.PeerInfoFixture()
+	p.Zone = "zone1"
+	require.NoError(t, s.UpdatePeer(h, p))
+
+	peers, err := s.GetPeers(h, 1)
+	require.NoError(t, err)
+	require.Equal(t, []*core.PeerInfo{p}, peers)
+}
@@ -31,12 +31,23 @@ func peerSetKey(h core.InfoHash, window int64) string {
 	return fmt.Sprintf("peerset:%s:%d", h.String(), window)
 }
 
+// peerZonesKey is the hash of zones of the peers of h, keyed by
+// serializePeerAddr. Zones are kept out of the peer set members, which trackers
+// unaware of zones could not parse.
+func peerZonesKey(h core.InfoHash) string {
+	return fmt.Sprintf("peerzones:%s", h.String())
+}
+
 func serializePeer(p *core.PeerInfo) string {
 	var completeBit int
 	if p.Complete {
 		completeBit = 1
 	}
-	return fmt.Sprintf("%s:%s:%d:%d", p.PeerID.String(), p.IP, p.Port, completeBit)
+	return fmt.Sprintf("%s:%d", serializePeerAddr(p.PeerID, p.IP, p.Port), completeBit)
+}
+
+func serializePeerAddr(peerID core.PeerID, ip string, port int) string {
+	return fmt.Sprintf("%s:%s:%d", peerID.String(), ip, port)
 }
 
 type peerIdentity struct {
@@ -143,6 +154,15 @@ func (s *RedisStore) UpdatePeer(h core.InfoHash, p *core.PeerInfo) error {
 	if err := c.Send("EXPIREAT", k, expireAt); err != nil {
 		return fmt.Errorf("send EXPIREAT: %s", err)
 	}
+	if p.Zone != "" {
+		zk := peerZonesKey(h)
+		if err := c.Send("HSET", zk, serializePeerAddr(p.PeerID, p.IP, p.Port), p.Zone); err != nil {
+			return fmt.Errorf("send HSET: %s", err)
+		}
+		if err := c.Send("EXPIREAT", zk, expireAt); err != nil {
+			return fmt.Errorf("send EXPIREAT: %s", err)
+		}
+	}
 	if err := c.Flush(); err != nil {
 		return fmt.Errorf("flush: %s", err)
 	}
@@ -152,6 +172,14 @@ func (s *RedisStore) UpdatePeer(h core.InfoHash, p *core.PeerInfo) error {
 	if _, err := c.Receive(); err != nil {
 		return fmt.Errorf("EXPIREAT: %s", err)
 	}
+	if p.Zone != "" {
+		if _, err := c.Receive(); err != nil {
+			return fmt.Errorf("HSET: %s", err)
+		}
+		if _, err := c.Receive(); err != nil {
+			return fmt.Errorf("EXPIREAT: %s", err)
+		}
+	}
 	return nil
 }
 
@@ -192,8 +220,30 @@ func (s *RedisStore) GetPeers(h core.InfoHash, n int) ([]*core.PeerInfo, error)
 
 	var peers []*core.PeerInfo
 	for id, complete := range selected {
-		p := core.NewPeerInfo(id.peerID, id.ip, id.port, false, complete)
-		peers = append(peers, p)
+		peers = append(peers, core.NewPeerInfo(id.peerID, id.ip, id.port, false, complete))
+	}
+	if err := s.populateZones(c, h, peers); err != nil {
+		// Zones are advisory, hence peers are returned without them.
+		log.Errorf("Error getting peer zones: %s", err)
 	}
 	return peers, nil
 }
+
+// populateZones sets the zones of peers which announced one.
+func (s *RedisStore) populateZones(c redis.Conn, h core.InfoHash, peers []*core.PeerInfo) error {
+	if len(peers) == 0 {
+		return nil
+	}
+	args := redis.Args{peerZonesKey(h)}
+	for _, p := range peers {
+		args = args.Add(serializePeerAddr(p.PeerID, p.IP, p.Port))
+	}
+	zones, err := redis.Strings(c.Do("HMGET", args...))
+	if err != nil {
+		return err
+	}
+	for i, p := range peers {
+		p.Zone = zones[i]
+	}
+	return nil
+}
@@ -21,6 +21,7 @@ import (
 
 	"github.com/alicebob/miniredis"
 	"github.com/andres-erbsen/clock"
+	"github.com/garyburd/redigo/redis"
 	"github.com/stretchr/testify/require"
 )
 
@@ -48,6 +49,7 @@ func TestRedisStoreGetPeersPopulatesPeerInfoFields(t *testing.T) {
 
 	p := core.PeerInfoFixture()
 	p.Complete = true
+	p.Zone = "zone1"
 
 	require.NoError(s.UpdatePeer(h, p))
 
@@ -56,6 +58,36 @@ func TestRedisStoreGetPeersPopulatesPeerInfoFields(t *testing.T) {
 	require.Equal(peers, []*core.PeerInfo{p})
 }
 
+func TestRedisStoreKeepsZoneOutOfPeerSet(t *testing.T) {
+	require := require.New(t)
+
+	config := redisConfigFixture()
+
+	s, err := NewRedisStore(config, clock.New())
+	require.NoError(err)
+
+	h := core.InfoHashFixture()
+
+	p := core.PeerInfoFixture()
+	p.Zone = "zone1"
+	require.NoError(s.UpdatePeer(h, p))
+
+	// Members stay parseable by trackers unaware of zones.
+	c := s.pool.Get()
+	defer c.Close()
+	members, err := redis.Strings(c.Do("SMEMBERS", peerSetKey(h, s.curPeerSetWindow())))
+	require.NoError(err)
+	require.Equal([]string{serializePeer(p)}, members)
+
+	// Re-announcing under another zone does not duplicate the peer.
+	p.Zone = "zone2"
+	require.NoError(s.UpdatePeer(h, p))
+
+	peers, err := s.GetPeers(h, 2)
+	require.NoError(err)
+	require.Equal([]*core.PeerInfo{p}, peers)
+}
+
 func TestRedisStoreGetPeersFromMultipleWindows(t *testing.T) {
 	require := require.New(t)
 